@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request bodies longer than this are cut in the access log
+const maxAccessLogBody = 4096
+
+// accessLogger writes one JSON line per API request. Read requests are
+// sampled, writes and failed requests are always logged
+type accessLogger struct {
+	mu     sync.Mutex
+	out    io.Writer
+	sample float64        // fraction of read requests logged
+	redact bool           // replace written values in logged bodies
+	random func() float64 // sampling source, replaced in tests
+}
+
+// accessLogEntry is a line of the access log
+type accessLogEntry struct {
+	Time      time.Time       `json:"time"`
+	Remote    string          `json:"remote"`
+	Tenant    string          `json:"tenant,omitempty"`
+	Permit    string          `json:"permit,omitempty"` // write permit of a write, see --write-permits
+	Method    string          `json:"method"`
+	Path      string          `json:"path"`
+	Query     string          `json:"query,omitempty"`
+	Status    int             `json:"status"`
+	Bytes     int             `json:"bytes"`
+	LatencyMs float64         `json:"latencyMs"`
+	Body      json.RawMessage `json:"body,omitempty"`
+	Sampled   float64         `json:"sampled,omitempty"` // sampling rate of a sampled read
+}
+
+// Access log of this service, nil when disabled
+var serviceAccessLog *accessLogger
+
+// openAccessLog opens the access log: "-" writes to stderr, everything else
+// is a file the lines are appended to
+func openAccessLog(path string, sample float64, redact bool) (*accessLogger, error) {
+	if sample < 0 || sample > 1 {
+		return nil, fmt.Errorf("sampling rate must be between 0 and 1, got %g", sample)
+	}
+	var out io.Writer = os.Stderr
+	if path != "-" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open access log: %v", err)
+		}
+		out = f
+	}
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return &accessLogger{out: out, sample: sample, redact: redact, random: rnd.Float64}, nil
+}
+
+// middleware logs the requests of a handler. It sits in front of the tenant
+// check so rejected tokens show up as well. A nil logger logs nothing
+func (l *accessLogger) middleware(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		read := isReadRequest(r)
+		var body []byte
+		if !read && r.Body != nil {
+			// Keep the start of the body for the log and hand the whole body on
+			body, _ = io.ReadAll(io.LimitReader(r.Body, maxAccessLogBody+1))
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		}
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		latency := time.Since(start)
+
+		sampled := read && rec.status < 400 && l.sample < 1
+		if sampled && l.draw() >= l.sample {
+			return
+		}
+		entry := accessLogEntry{
+			Time:      start.UTC(),
+			Remote:    r.RemoteAddr,
+			Tenant:    accessLogTenant(r),
+			Permit:    r.Header.Get(permitHeader),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Query:     r.URL.RawQuery,
+			Status:    rec.status,
+			Bytes:     rec.bytes,
+			LatencyMs: float64(latency.Microseconds()) / 1000,
+			Body:      l.logBody(body),
+		}
+		if sampled {
+			entry.Sampled = l.sample
+		}
+		l.write(entry)
+	})
+}
+
+// draw returns the next sampling number
+func (l *accessLogger) draw() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.random()
+}
+
+// write appends a line to the log
+func (l *accessLogger) write(entry accessLogEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(data, '\n'))
+}
+
+// accessLogTenant names the tenant of a request's token. Tokens themselves
+// never go into the log
+func accessLogTenant(r *http.Request) string {
+	if serviceTenants == nil {
+		return ""
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "-"
+	}
+	if t := serviceTenants.lookup(token); t != nil {
+		return t.Name
+	}
+	return "invalid"
+}
+
+// logBody returns a request body for the log: JSON as is or with its values
+// redacted, anything else as a string. Values of sensitive nodes are always
+// redacted, and bodies that cannot be checked for them are while there are
+// sensitive nodes
+func (l *accessLogger) logBody(body []byte) json.RawMessage {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+	redactAll := l.redact || len(serviceSensitive) > 0
+	if len(body) > maxAccessLogBody {
+		data, _ := json.Marshal(fmt.Sprintf("%s... (truncated)", body[:maxAccessLogBody]))
+		if redactAll {
+			data, _ = json.Marshal(redactedValue)
+		}
+		return data
+	}
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		data, _ := json.Marshal(string(body))
+		if redactAll {
+			data, _ = json.Marshal(redactedValue)
+		}
+		return data
+	}
+	if l.redact {
+		doc = redactValues(doc)
+	} else {
+		doc = serviceSensitive.redactSensitive(doc)
+	}
+	data, _ := json.Marshal(doc)
+	return data
+}
+
+// redactValues replaces the written values of a request document, keeping
+// the node IDs and data types that say what was written
+func redactValues(doc interface{}) interface{} {
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			switch key {
+			case "value", "values":
+				v[key] = redactedValue
+			default:
+				v[key] = redactValues(field)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactValues(v[i])
+		}
+	}
+	return doc
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeAccessLog(t *testing.T, out *bytes.Buffer) []accessLogEntry {
+	var entries []accessLogEntry
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry accessLogEntry
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// TestAccessLogMiddleware tests the logged fields, that handlers still get
+// the whole body and that values are redacted
+func TestAccessLogMiddleware(t *testing.T) {
+	var out bytes.Buffer
+	l := &accessLogger{out: &out, sample: 1, redact: true}
+	var received string
+	handler := l.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		received = string(data)
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("queued"))
+	}))
+
+	body := `{"namespace":"3","type":"s","identifier":"Setpoint","value":"42","dataType":"float"}`
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/node?wait=1", strings.NewReader(body)))
+	assert.Equal(t, body, received)
+
+	entries := decodeAccessLog(t, &out)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "POST", entries[0].Method)
+	assert.Equal(t, "/api/node", entries[0].Path)
+	assert.Equal(t, "wait=1", entries[0].Query)
+	assert.Equal(t, http.StatusAccepted, entries[0].Status)
+	assert.Equal(t, 6, entries[0].Bytes)
+	assert.JSONEq(t, `{"namespace":"3","type":"s","identifier":"Setpoint","value":"(redacted)","dataType":"float"}`, string(entries[0].Body))
+}
+
+// TestAccessLogSampling tests that only successful reads are sampled
+func TestAccessLogSampling(t *testing.T) {
+	var out bytes.Buffer
+	draws := []float64{0.9, 0.1}
+	l := &accessLogger{out: &out, sample: 0.5, random: func() float64 {
+		d := draws[0]
+		draws = draws[1:]
+		return d
+	}}
+	handler := l.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/missing" {
+			http.NotFound(w, r)
+		}
+	}))
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/api/node", nil),       // dropped
+		httptest.NewRequest(http.MethodGet, "/api/node", nil),       // sampled
+		httptest.NewRequest(http.MethodGet, "/api/missing", nil),    // error
+		httptest.NewRequest(http.MethodDelete, "/api/polls/1", nil), // write
+	} {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	entries := decodeAccessLog(t, &out)
+	require.Len(t, entries, 3)
+	assert.Equal(t, 0.5, entries[0].Sampled)
+	assert.Equal(t, http.StatusNotFound, entries[1].Status)
+	assert.Zero(t, entries[1].Sampled)
+	assert.Equal(t, "DELETE", entries[2].Method)
+}
+
+// TestAccessLogTenant tests that the tenant is logged instead of the token
+func TestAccessLogTenant(t *testing.T) {
+	defer func() { serviceTenants = nil }()
+	serviceTenants = &tenantRegistry{tenants: []*tenant{{Name: "acme", Token: "acme-token", Access: "read"}}}
+
+	var out bytes.Buffer
+	l := &accessLogger{out: &out, sample: 1}
+	handler := l.middleware(serviceTenants.middleware(http.NotFoundHandler()))
+	for _, token := range []string{"acme-token", "wrong"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/info", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	entries := decodeAccessLog(t, &out)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "acme", entries[0].Tenant)
+	assert.Equal(t, "invalid", entries[1].Tenant)
+	assert.Equal(t, http.StatusUnauthorized, entries[1].Status)
+	assert.NotContains(t, out.String(), "acme-token")
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+)
+
+// Who annotates with plccli annotate, from its --user flag
+var annotationUser string
+
+// runAnnotate adds an annotation to the timeline of the service's connection,
+// tagged with the --influx-tag tags. Prints the annotation's InfluxDB line
+// with --format influx
+func runAnnotate(args []string, host string, port int, format string, tags []influxTag) (string, error) {
+	text := strings.Join(args, " ")
+	if strings.TrimSpace(text) == "" {
+		return "", fmt.Errorf("annotate needs a text, e.g. plccli annotate \"changed die on press 3\"")
+	}
+	name := annotationUser
+	if name == "" {
+		name = currentUser()
+	}
+	extra := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		extra[tag.Key] = tag.Value
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	a, err := newServiceClient(host, port).Annotate(ctx, Annotation{Text: text, User: name, Tags: extra})
+	if err != nil {
+		return "", err
+	}
+	if format == "influx" {
+		return a.Line, nil
+	}
+	return fmt.Sprintf("Annotated %s at %s as %s: %s (via %s:%d)",
+		a.Connection, a.Time.Local().Format(time.RFC3339), a.User, a.Text, host, port), nil
+}
+
+// currentUser returns the login name of the user running plccli
+func currentUser() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Measurement of annotation lines
+const annotationMeasurement = "annotation"
+
+// Annotations the service keeps for GET /api/annotations
+const maxAnnotations = 100
+
+// Longest annotation text
+const maxAnnotationText = 1024
+
+// annotationLog keeps the recent annotations of the connection. Annotations
+// put the context of people, e.g. "changed die on press 3", on the same
+// timeline as the machine data: they go to the poll file's buffer and sinks
+// as InfluxDB lines like sampled values
+type annotationLog struct {
+	mu          sync.Mutex
+	annotations []Annotation
+}
+
+// Annotations of this service
+var serviceAnnotations = &annotationLog{}
+
+// add keeps an annotation, dropping the oldest beyond maxAnnotations
+func (l *annotationLog) add(a Annotation) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.annotations = append(l.annotations, a)
+	if len(l.annotations) > maxAnnotations {
+		l.annotations = l.annotations[len(l.annotations)-maxAnnotations:]
+	}
+}
+
+// since returns the annotations after a time, oldest first
+func (l *annotationLog) since(t time.Time) []Annotation {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	annotations := []Annotation{}
+	for _, a := range l.annotations {
+		if a.Time.After(t) {
+			annotations = append(annotations, a)
+		}
+	}
+	return annotations
+}
+
+// annotationLine formats an annotation as an InfluxDB line: the connection,
+// endpoint, user and tenant tags, then the extra tags sorted by key (which
+// override those of the same key), and the text as string field
+func annotationLine(a Annotation, maintenance bool) string {
+	tags := []influxTag{{"connection", a.Connection}}
+	if a.Endpoint != "" {
+		tags = append(tags, influxTag{"endpoint", a.Endpoint})
+	}
+	if a.User != "" {
+		tags = append(tags, influxTag{"user", a.User})
+	}
+	if a.Tenant != "" {
+		tags = append(tags, influxTag{"tenant", a.Tenant})
+	}
+	keys := make([]string, 0, len(a.Tags))
+	for key := range a.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		replaced := false
+		for i := range tags {
+			if tags[i].Key == key {
+				tags[i].Value = a.Tags[key]
+				replaced = true
+			}
+		}
+		if !replaced {
+			tags = append(tags, influxTag{key, a.Tags[key]})
+		}
+	}
+	if maintenance {
+		tags = append(tags, maintenanceTag)
+	}
+
+	tagEscaper := strings.NewReplacer(",", "\\,", "=", "\\=", " ", "\\ ", "\n", "\\n")
+	textEscaper := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+	var b strings.Builder
+	b.WriteString(annotationMeasurement)
+	for _, tag := range tags {
+		if tag.Value == "" {
+			continue // Line protocol has no empty tag values
+		}
+		b.WriteString(",")
+		b.WriteString(tagEscaper.Replace(tag.Key))
+		b.WriteString("=")
+		b.WriteString(tagEscaper.Replace(tag.Value))
+	}
+	fmt.Fprintf(&b, " text=\"%s\" %d", textEscaper.Replace(a.Text), a.Time.UnixNano())
+	return b.String()
+}
+
+// annotationRequest is the body of POST /api/annotations
+type annotationRequest struct {
+	Text string            `json:"text"`
+	User string            `json:"user,omitempty"` // who annotates, the tenant's name when empty
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// handleAnnotationsRequest adds an annotation (POST /api/annotations) or
+// lists the recent ones (GET /api/annotations?since=1h)
+func handleAnnotationsRequest(w http.ResponseWriter, r *http.Request, endpoint string) {
+	switch r.Method {
+	case http.MethodGet:
+		since, err := parseSince(r.URL.Query().Get("since"), time.Now())
+		if err != nil {
+			sendJSONResponseGeneric(w, map[string]interface{}{"error": "since: " + err.Error()})
+			return
+		}
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"annotations": serviceAnnotations.since(since),
+		})
+
+	case http.MethodPost:
+		var req annotationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": fmt.Sprintf("Failed to parse request: %v", err),
+			})
+			return
+		}
+		text := strings.TrimSpace(req.Text)
+		if text == "" {
+			sendJSONResponseGeneric(w, map[string]interface{}{"error": "an annotation needs a text"})
+			return
+		}
+		if len(text) > maxAnnotationText {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": fmt.Sprintf("annotation text has %d bytes, at most %d", len(text), maxAnnotationText),
+			})
+			return
+		}
+		a := Annotation{
+			Text:       text,
+			User:       strings.TrimSpace(req.User),
+			Tenant:     tenantName(r),
+			Connection: connectionName,
+			Endpoint:   endpoint,
+			Tags:       req.Tags,
+			Time:       time.Now().UTC(),
+		}
+		if a.User == "" {
+			a.User = a.Tenant
+		}
+		maintenance := serviceMaintenance.active()
+		a.Line = annotationLine(a, maintenance)
+
+		serviceAnnotations.add(a)
+		if servicePollFile != nil {
+			var lines prioritized
+			lines[priorityProcess] = []string{a.Line}
+			servicePollFile.add(lines, maintenance)
+		}
+		log.Printf("[%s] Annotation by %s (%s): %s", connectionName, a.User, permitHolder(r), a.Text)
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"annotation": a,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestAnnotationLine tests the tags and escaping of annotation lines, which
+// webhook sinks always pass on
+func TestAnnotationLine(t *testing.T) {
+	a := Annotation{
+		Text:       `changed die on press 3, "B" side`,
+		User:       "Jo Smith",
+		Connection: "line1",
+		Endpoint:   "opc.tcp://plc:4840",
+		Tags:       map[string]string{"site": "plant1", "area": "press shop", "user": "jsmith"},
+		Time:       time.Unix(0, 1700000000000000000),
+	}
+	assert.Equal(t, `annotation,connection=line1,endpoint=opc.tcp://plc:4840,user=jsmith,area=press\ shop,site=plant1 text="changed die on press 3, \"B\" side" 1700000000000000000`,
+		annotationLine(a, false))
+
+	a.Tags = nil
+	a.Endpoint = ""
+	a.Tenant = "acme"
+	line := annotationLine(a, true)
+	assert.True(t, strings.HasPrefix(line, `annotation,connection=line1,user=Jo\ Smith,tenant=acme,maintenance=true text=`), line)
+
+	_, err := parseInfluxLine(line)
+	assert.NoError(t, err)
+
+	// Webhook sinks notify of every annotation, not only of changed ones
+	changes := newChangeFilter()
+	changes.ack([]string{line})
+	assert.Equal(t, []string{line, line}, changes.filter([]string{line, line}))
+}
+
+// TestAnnotate tests annotating with the client library: the annotation is
+// stamped, kept, listed and sent to the poll file's sinks
+func TestAnnotate(t *testing.T) {
+	defer func(log *annotationLog, s *pollScheduler, name string) {
+		serviceAnnotations, servicePollFile, connectionName = log, s, name
+	}(serviceAnnotations, servicePollFile, connectionName)
+	connectionName = "line1"
+	serviceAnnotations = &annotationLog{}
+	pf := &pollFile{Buffer: 10, Sinks: []*pollSink{{URL: "http://sink"}}}
+	servicePollFile = newPollScheduler(pf, nil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/annotations", func(w http.ResponseWriter, r *http.Request) {
+		handleAnnotationsRequest(w, r, "opc.tcp://plc:4840")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	client := newServiceClient(u.Hostname(), port)
+	_, err = client.Annotate(ctx, Annotation{Text: "  "})
+	assert.ErrorContains(t, err, "needs a text")
+	_, err = client.Annotate(ctx, Annotation{Text: strings.Repeat("x", maxAnnotationText+1)})
+	assert.Error(t, err)
+
+	annotationUser = "alice"
+	defer func() { annotationUser = "" }()
+	line, err := runAnnotate([]string{"changed", "die", "on", "press", "3"}, u.Hostname(), port, "influx", []influxTag{{"site", "plant1"}})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(line, `annotation,connection=line1,endpoint=opc.tcp://plc:4840,user=alice,site=plant1 text="changed die on press 3" `), line)
+
+	buffered, _ := servicePollFile.buffer.drain()
+	assert.Equal(t, []string{line}, buffered)
+	sinkLines, _ := servicePollFile.sinks[0].drain()
+	assert.Equal(t, []string{line}, sinkLines[priorityProcess])
+
+	out, err := runAnnotate([]string{"shift handover"}, u.Hostname(), port, "default", nil)
+	require.NoError(t, err)
+	assert.Contains(t, out, "Annotated line1 at ")
+	assert.Contains(t, out, "as alice: shift handover")
+
+	annotations, err := client.Annotations(ctx, time.Hour)
+	require.NoError(t, err)
+	require.Len(t, annotations, 2)
+	assert.Equal(t, "changed die on press 3", annotations[0].Text)
+	assert.Equal(t, map[string]string{"site": "plant1"}, annotations[0].Tags)
+	assert.WithinDuration(t, time.Now(), annotations[1].Time, time.Minute)
+
+	for i := 0; i < maxAnnotations; i++ {
+		serviceAnnotations.add(Annotation{Text: "x", Time: time.Now()})
+	}
+	assert.Len(t, serviceAnnotations.since(time.Time{}), maxAnnotations)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often the service checks --api-tls-cert and --api-tls-key for a
+// renewed certificate
+const apiTLSCheckInterval = 10 * time.Second
+
+// certReloader serves the certificate of the API's TLS listener and loads it
+// again when cert-manager, certbot or anyone else replaces the files, so a
+// renewal does not need a restart that drops subscriptions
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	checked string // Size and modification time of the files last loaded, or tried, to report a bad pair once
+}
+
+// TLS certificate of this service's API, nil to serve plain HTTP
+var serviceTLS *certReloader
+
+// newCertReloader loads the certificate and key of the API
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("--api-tls-cert and --api-tls-key go together")
+	}
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// stamp identifies the current contents of the certificate and key files by
+// their size and modification time. Symlinks, as cert-manager and certbot
+// use, are followed
+func (r *certReloader) stamp() (string, error) {
+	stamp := ""
+	for _, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		stamp += fmt.Sprintf("%d/%d;", info.Size(), info.ModTime().UnixNano())
+	}
+	return stamp, nil
+}
+
+// reload loads the certificate and key when the files changed since the
+// last check. A pair that does not load, e.g. while only the certificate is
+// renewed, keeps the previous certificate
+func (r *certReloader) reload() (bool, error) {
+	stamp, err := r.stamp()
+	if err != nil {
+		return false, fmt.Errorf("failed to read API TLS certificate: %v", err)
+	}
+	r.mu.RLock()
+	unchanged := stamp == r.checked
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checked = stamp
+	if err != nil {
+		return false, fmt.Errorf("failed to load API TLS certificate %s with key %s: %v", r.certFile, r.keyFile, err)
+	}
+	r.cert = &cert
+	return true, nil
+}
+
+// getCertificate returns the current certificate for a TLS handshake
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// expires returns when the current certificate stops being valid
+func (r *certReloader) expires() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	leaf, err := x509.ParseCertificate(r.cert.Certificate[0])
+	if err != nil {
+		return time.Time{}
+	}
+	return leaf.NotAfter
+}
+
+// watch reloads the certificate when its files change, until ctx is done
+func (r *certReloader) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := r.reload()
+			if err != nil {
+				log.Printf("[%s] Keeping the current API TLS certificate: %v", connectionName, err)
+			} else if reloaded {
+				log.Printf("[%s] Reloaded API TLS certificate %s, valid until %s", connectionName, r.certFile,
+					r.expires().Format(time.RFC3339))
+			}
+		}
+	}
+}
+
+// apiScheme returns the URL scheme of the service's API
+func apiScheme() string {
+	if serviceTLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// listenAndServeAPI serves the API over HTTPS with the reloaded certificate
+// of --api-tls-cert, or over plain HTTP without one
+func listenAndServeAPI(ctx context.Context, server *http.Server) error {
+	if serviceTLS == nil {
+		return server.ListenAndServe()
+	}
+	server.TLSConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: serviceTLS.getCertificate,
+	}
+	log.Printf("[%s] Serving the API over TLS with %s, valid until %s", connectionName, serviceTLS.certFile,
+		serviceTLS.expires().Format(time.RFC3339))
+	go serviceTLS.watch(ctx, apiTLSCheckInterval)
+	return server.ListenAndServeTLS("", "")
+}
+
+// TLS settings of the clients of a service started with --api-tls-cert, nil
+// for plain HTTP
+var apiClientTLS *tls.Config
+
+// loadAPIClientTLS returns the TLS settings of --api-tls and --api-tls-ca:
+// the system's CAs, or only the CA of the file, which implies --api-tls
+func loadAPIClientTLS(enabled bool, caFile string) (*tls.Config, error) {
+	if caFile == "" {
+		if !enabled {
+			return nil, nil
+		}
+		return &tls.Config{MinVersion: tls.VersionTLS12}, nil
+	}
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file %s: %v", caFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates in CA file %s", caFile)
+	}
+	return &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: pool}, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	uatest "github.com/gopcua/opcua/tests/python"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"umicli/pkg/plcclient"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1, valid for
+// validFor, and its key. The certificate is returned to trust it
+func writeTestCert(t *testing.T, certFile, keyFile string, validFor time.Duration) *x509.Certificate {
+	certPEM, keyPEM, err := uatest.GenerateCert("127.0.0.1", 2048, validFor)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(certFile, certPEM, 0644))
+	require.NoError(t, os.WriteFile(keyFile, keyPEM, 0600))
+	block, _ := pem.Decode(certPEM)
+	require.NotNil(t, block)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	return cert
+}
+
+// TestCertReloader tests that the API serves a renewed certificate without
+// a restart and keeps the previous one while the files do not load
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	_, err := newCertReloader(certFile, "")
+	assert.ErrorContains(t, err, "go together")
+	_, err = newCertReloader(certFile, keyFile)
+	assert.Error(t, err, "no files yet")
+
+	first := writeTestCert(t, certFile, keyFile, 24*time.Hour)
+	reloader, err := newCertReloader(certFile, keyFile)
+	require.NoError(t, err)
+	assert.Equal(t, first.NotAfter, reloader.expires())
+	reloaded, err := reloader.reload()
+	require.NoError(t, err)
+	assert.False(t, reloaded, "unchanged files are not loaded again")
+
+	serviceTLS = reloader
+	t.Cleanup(func() { serviceTLS = nil })
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	mux := http.NewServeMux()
+	registerHandlers(mux, "opc.tcp://mock", 8765)
+	server := &http.Server{Addr: "127.0.0.1:" + strconv.Itoa(port), Handler: mux}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go listenAndServeAPI(ctx, server)
+	defer server.Close()
+	assert.Equal(t, "https", apiScheme())
+
+	// The certificate the listener presents, trusting both
+	roots := x509.NewCertPool()
+	roots.AddCert(first)
+	served := func() time.Time {
+		var conn *tls.Conn
+		require.Eventually(t, func() bool {
+			conn, err = tls.Dial("tcp", server.Addr, &tls.Config{RootCAs: roots})
+			return err == nil
+		}, 5*time.Second, 20*time.Millisecond, "%v", err)
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].NotAfter
+	}
+	assert.Equal(t, first.NotAfter, served())
+
+	client := plcclient.New("127.0.0.1", port).WithTLS(&tls.Config{RootCAs: roots})
+	_, err = client.Maintenance(ctx)
+	assert.NoError(t, err)
+	_, err = plcclient.New("127.0.0.1", port).Maintenance(ctx)
+	assert.Error(t, err, "plain HTTP is not served")
+
+	// A certificate without its key keeps the previous one
+	require.NoError(t, os.WriteFile(certFile, []byte("renewing"), 0644))
+	_, err = reloader.reload()
+	assert.ErrorContains(t, err, "failed to load API TLS certificate")
+	assert.Equal(t, first.NotAfter, served())
+
+	time.Sleep(10 * time.Millisecond) // A new modification time
+	second := writeTestCert(t, certFile, keyFile, 48*time.Hour)
+	roots.AddCert(second)
+	reloaded, err = reloader.reload()
+	require.NoError(t, err)
+	assert.True(t, reloaded)
+	assert.Equal(t, second.NotAfter, served())
+}
+
+// TestLoadAPIClientTLS tests the TLS settings of --api-tls and --api-tls-ca
+func TestLoadAPIClientTLS(t *testing.T) {
+	config, err := loadAPIClientTLS(false, "")
+	require.NoError(t, err)
+	assert.Nil(t, config, "plain HTTP")
+	config, err = loadAPIClientTLS(true, "")
+	require.NoError(t, err)
+	assert.Nil(t, config.RootCAs, "the system's CAs")
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.crt")
+	writeTestCert(t, caFile, filepath.Join(dir, "ca.key"), time.Hour)
+	config, err = loadAPIClientTLS(false, caFile)
+	require.NoError(t, err)
+	assert.NotNil(t, config.RootCAs)
+
+	_, err = loadAPIClientTLS(false, filepath.Join(dir, "ca.key"))
+	assert.ErrorContains(t, err, "no PEM certificates")
+	_, err = loadAPIClientTLS(false, filepath.Join(dir, "missing.crt"))
+	assert.ErrorContains(t, err, "failed to read CA file")
+}
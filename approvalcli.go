@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// runApprovalsCommand runs approvals request, list, confirm or reject
+// against the service
+func runApprovalsCommand(args []string, host string, port int) (string, error) {
+	if len(args) < 1 {
+		return "", fmt.Errorf("missing approvals command: request, list, confirm or reject")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout(10*time.Second))
+	defer cancel()
+	client := newServiceClient(host, port)
+
+	switch args[0] {
+	case "request":
+		if len(args) < 5 || strings.TrimSpace(strings.Join(args[4:], " ")) == "" {
+			return "", fmt.Errorf("approvals request needs <node-id> <value> <type> <reason>, e.g. plccli approvals request \"ns=3;s=Cmd.Bypass\" true bool \"bypass light curtain for cleaning\"")
+		}
+		write, err := client.RequestApproval(ctx, PendingWrite{
+			NodeID:   args[1],
+			Value:    args[2],
+			DataType: args[3],
+			Reason:   strings.Join(args[4:], " "),
+		})
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s\nWaiting until %s for another tenant to confirm writing %s to %s (via %s:%d): plccli approvals confirm %s",
+			write.ID, write.Expires.Local().Format(time.RFC3339), write.Value, write.NodeID, host, port, write.ID), nil
+
+	case "list":
+		writes, err := client.Approvals(ctx)
+		if err != nil {
+			return "", err
+		}
+		return formatApprovals(writes, time.Now()), nil
+
+	case "confirm":
+		if len(args) != 2 {
+			return "", fmt.Errorf("approvals confirm needs an approval ID")
+		}
+		result, err := client.ConfirmApproval(ctx, args[1])
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Confirmed approval %s: wrote %v to %s (via %s:%d)", args[1], result.Value, result.NodeID, host, port), nil
+
+	case "reject":
+		if len(args) != 2 {
+			return "", fmt.Errorf("approvals reject needs an approval ID")
+		}
+		if err := client.RejectApproval(ctx, args[1]); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Rejected approval %s (via %s:%d)", args[1], host, port), nil
+	}
+	return "", fmt.Errorf("unknown approvals command %s, expected request, list, confirm or reject", args[0])
+}
+
+// formatApprovals lists pending writes one per line with their remaining time
+func formatApprovals(writes []PendingWrite, now time.Time) string {
+	if len(writes) == 0 {
+		return "No writes waiting for a confirmation"
+	}
+	var lines []string
+	for _, w := range writes {
+		lines = append(lines, fmt.Sprintf("%s  %s left  %s = %s (%s)  by %s  %s",
+			w.ID, w.Expires.Sub(now).Round(time.Second), w.NodeID, w.Value, w.DataType, w.RequestedBy, w.Reason))
+	}
+	return strings.Join(lines, "\n")
+}
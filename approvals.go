@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+
+	"umicli/pkg/plcclient"
+)
+
+// How long a write of a critical node waits for its confirmation, unless
+// --approval-timeout says otherwise
+const defaultApprovalTimeout = 15 * time.Minute
+
+// approvalRegistry holds the writes of critical nodes (critical rules of the
+// write policy) that wait for a second person. A tenant requests the write,
+// another tenant confirms it within the timeout and only then is it sent to
+// the PLC. Every step is logged
+type approvalRegistry struct {
+	mu      sync.Mutex
+	timeout time.Duration // how long a write waits for its confirmation
+	pending map[string]PendingWrite
+	now     func() time.Time // replaced in tests
+}
+
+// Writes of this service waiting for a confirmation, nil when the write
+// policy marks no node critical
+var serviceApprovals *approvalRegistry
+
+// approvedContextKey marks the writes of confirmed approvals, and the dry
+// runs checking requested ones, in the request context
+type approvedContextKey struct{}
+
+// newApprovalRegistry creates a registry whose writes wait for at most
+// timeout
+func newApprovalRegistry(timeout time.Duration) (*approvalRegistry, error) {
+	if timeout <= 0 {
+		return nil, fmt.Errorf("the approval timeout must be positive, got %v", timeout)
+	}
+	return &approvalRegistry{
+		timeout: timeout,
+		pending: make(map[string]PendingWrite),
+		now:     time.Now,
+	}, nil
+}
+
+// request adds a write of a tenant, RequestedBy by its identity, waiting for
+// a confirmation
+func (reg *approvalRegistry) request(write PendingWrite) (PendingWrite, error) {
+	if write.RequestedBy == "" {
+		return PendingWrite{}, fmt.Errorf("requesting an approval needs the token of a tenant")
+	}
+	write.Reason = strings.TrimSpace(write.Reason)
+	if write.Reason == "" {
+		return PendingWrite{}, fmt.Errorf("a write of a critical node needs a reason")
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return PendingWrite{}, fmt.Errorf("failed to create approval ID: %v", err)
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	now := reg.now()
+	reg.expire(now)
+	write.ID = hex.EncodeToString(id)
+	write.Requested = now.UTC()
+	write.Expires = now.Add(reg.timeout).UTC()
+	reg.pending[write.ID] = write
+	return write, nil
+}
+
+// confirm removes a pending write for a tenant, by its identity, to run it.
+// The tenant that requested a write cannot confirm it
+func (reg *approvalRegistry) confirm(id, tenant string) (PendingWrite, error) {
+	if tenant == "" {
+		return PendingWrite{}, fmt.Errorf("confirming an approval needs the token of a tenant")
+	}
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.expire(reg.now())
+	write, ok := reg.pending[id]
+	if !ok {
+		return PendingWrite{}, fmt.Errorf("unknown or expired approval %s", id)
+	}
+	if write.RequestedBy == "" || write.RequestedBy == tenant {
+		return PendingWrite{}, fmt.Errorf("approval %s was requested by %s and needs another tenant to confirm it", id, tenant)
+	}
+	delete(reg.pending, id)
+	return write, nil
+}
+
+// reject removes a pending write without running it
+func (reg *approvalRegistry) reject(id string) (PendingWrite, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.expire(reg.now())
+	write, ok := reg.pending[id]
+	if !ok {
+		return PendingWrite{}, fmt.Errorf("unknown or expired approval %s", id)
+	}
+	delete(reg.pending, id)
+	return write, nil
+}
+
+// list returns the pending writes of all tenants, so others can confirm
+// them, the earliest to expire first
+func (reg *approvalRegistry) list() []PendingWrite {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.expire(reg.now())
+	writes := []PendingWrite{}
+	for _, write := range reg.pending {
+		writes = append(writes, write)
+	}
+	sort.Slice(writes, func(i, j int) bool {
+		return writes[i].Expires.Before(writes[j].Expires)
+	})
+	return writes
+}
+
+// expire drops and logs the writes nobody confirmed by now. The caller holds
+// mu
+func (reg *approvalRegistry) expire(now time.Time) {
+	for id, write := range reg.pending {
+		if !now.Before(write.Expires) {
+			delete(reg.pending, id)
+			log.Printf("[%s] Approval %s expired unconfirmed: %s to %s requested by tenant %s", connectionName, id,
+				serviceSensitive.loggedValueOf(write.NodeID, write.Value), write.NodeID, write.RequestedBy)
+		}
+	}
+}
+
+// allowWithoutApproval rejects writes of critical nodes unless they come
+// from a confirmed approval. A rejected write is logged and answered with
+// the error
+func allowWithoutApproval(w http.ResponseWriter, r *http.Request, id *ua.NodeID, nodeIDStr string) bool {
+	err := checkApproved(r.Context(), id)
+	if err == nil {
+		return true
+	}
+	resp, _ := writeRejected(permitHolder(r), nodeIDStr, err)
+	sendJSONResponse(w, resp)
+	return false
+}
+
+// checkApproved returns an error for a write of a critical node unless ctx
+// carries its confirmed approval
+func checkApproved(ctx context.Context, id *ua.NodeID) error {
+	return approvalError(ctx, id.String(), serviceWritePolicy.criticalRule(id))
+}
+
+// checkRefApproved is checkApproved for a reference of a backend connection
+func checkRefApproved(ctx context.Context, ref string) error {
+	return approvalError(ctx, ref, serviceWritePolicy.criticalRuleRef(ref))
+}
+
+// approvalError returns the error of a write of a target that matches a
+// critical rule, nil for other targets and confirmed approvals
+func approvalError(ctx context.Context, target string, rule *nodeRule) error {
+	if rule == nil || ctx.Value(approvedContextKey{}) != nil {
+		return nil
+	}
+	return fmt.Errorf("%s is critical (rule %s of the write policy), its writes need a second person: request one with plccli approvals request", target, rule.text)
+}
+
+// writeApproved runs a pending write for a caller like POST /api/node, see
+// performWrite, or a reference of a backend connection like POST /api/points.
+// With dryRun it only checks the write
+func writeApproved(ctx context.Context, caller writeCaller, write PendingWrite, dryRun bool) NodeResponse {
+	ctx = context.WithValue(ctx, approvedContextKey{}, write.ID)
+	if serviceBackend != nil {
+		if write.Attribute != "" {
+			return NodeResponse{NodeID: write.NodeID, Error: "references of backend connections have no attributes"}
+		}
+		resp, _ := performPointWrite(ctx, caller, pointWrite{Ref: write.NodeID, Value: write.Value, DataType: write.DataType, dryRun: dryRun})
+		return resp
+	}
+	namespace, idType, identifier, err := plcclient.ParseNodeID(write.NodeID)
+	if err != nil {
+		return NodeResponse{NodeID: write.NodeID, Error: err.Error()}
+	}
+	resp, _ := performWrite(ctx, caller, nodeWrite{
+		Namespace: namespace, Type: idType, Identifier: identifier,
+		Value: write.Value, DataType: write.DataType, Attribute: write.Attribute, DryRun: dryRun,
+	})
+	return resp
+}
+
+// approvalRequest is the body of POST /api/approvals
+type approvalRequest struct {
+	NodeID    string `json:"nodeId"`
+	Value     string `json:"value"`
+	DataType  string `json:"dataType"`
+	Attribute string `json:"attribute,omitempty"` // Value when empty
+	Reason    string `json:"reason"`
+}
+
+// handleApprovalsRequest lists (GET /api/approvals), requests (POST
+// /api/approvals), shows (GET /api/approvals/<id>), confirms (POST
+// /api/approvals/<id>/confirm) and rejects (DELETE /api/approvals/<id>)
+// writes of critical nodes
+func handleApprovalsRequest(w http.ResponseWriter, r *http.Request) {
+	if serviceApprovals == nil {
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"error": "approvals are not enabled, mark nodes critical in the --write-policy file",
+		})
+		return
+	}
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/approvals"), "/")
+	approvalID, action, _ := strings.Cut(rest, "/")
+	by := permitHolder(r)
+
+	switch {
+	case approvalID == "" && r.Method == http.MethodPost:
+		var req approvalRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": fmt.Sprintf("Failed to parse request: %v", err),
+			})
+			return
+		}
+		if req.NodeID == "" || req.Value == "" || req.DataType == "" {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": "Missing required fields: nodeId, value and dataType are required",
+			})
+			return
+		}
+		if strings.TrimSpace(req.Reason) == "" {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": "a write of a critical node needs a reason",
+			})
+			return
+		}
+		write := PendingWrite{NodeID: req.NodeID, Value: req.Value, DataType: req.DataType, Attribute: req.Attribute,
+			Reason: req.Reason, RequestedBy: tenantIdentity(r)}
+		if err := checkCritical(write.NodeID); err != nil {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": err.Error(),
+			})
+			return
+		}
+		// Checked now, so nobody confirms a write the service would refuse
+		if check := writeApproved(r.Context(), requestCaller(r), write, true); check.Error != "" {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": check.Error,
+			})
+			return
+		}
+		write, err := serviceApprovals.request(write)
+		if err != nil {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": err.Error(),
+			})
+			return
+		}
+		log.Printf("[%s] Approval %s requested by %s until %s: %s to %s (%s): %s", connectionName, write.ID, by,
+			write.Expires.Format(time.RFC3339), serviceSensitive.loggedValueOf(write.NodeID, write.Value), write.NodeID, write.DataType, write.Reason)
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"approval": write,
+		})
+
+	case approvalID == "" && r.Method == http.MethodGet:
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"approvals": serviceApprovals.list(),
+		})
+
+	case approvalID != "" && action == "" && r.Method == http.MethodGet:
+		for _, write := range serviceApprovals.list() {
+			if write.ID == approvalID {
+				sendJSONResponseGeneric(w, map[string]interface{}{
+					"approval": write,
+				})
+				return
+			}
+		}
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"error": fmt.Sprintf("unknown or expired approval %s", approvalID),
+		})
+
+	case approvalID != "" && action == "confirm" && r.Method == http.MethodPost:
+		write, err := serviceApprovals.confirm(approvalID, tenantIdentity(r))
+		if err != nil {
+			log.Printf("[%s] Confirmation of approval %s by %s rejected: %v", connectionName, approvalID, by, err)
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": err.Error(),
+			})
+			return
+		}
+		log.Printf("[%s] Approval %s confirmed by %s: %s to %s requested by tenant %s: %s", connectionName, write.ID, by,
+			serviceSensitive.loggedValueOf(write.NodeID, write.Value), write.NodeID, write.RequestedBy, write.Reason)
+		result := writeApproved(r.Context(), requestCaller(r), write, false)
+		if result.Error != "" {
+			log.Printf("[%s] Approved write %s of %s failed: %s", connectionName, write.ID, write.NodeID, result.Error)
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"approval": write,
+				"result":   result,
+				"error":    result.Error,
+			})
+			return
+		}
+		log.Printf("[%s] Approved write %s of %s to %s done", connectionName, write.ID,
+			serviceSensitive.loggedValueOf(write.NodeID, write.Value), write.NodeID)
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"approval": write,
+			"result":   result,
+		})
+
+	case approvalID != "" && action == "" && r.Method == http.MethodDelete:
+		write, err := serviceApprovals.reject(approvalID)
+		if err != nil {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": err.Error(),
+			})
+			return
+		}
+		log.Printf("[%s] Approval %s rejected by %s: %s to %s requested by tenant %s", connectionName, write.ID, by,
+			serviceSensitive.loggedValueOf(write.NodeID, write.Value), write.NodeID, write.RequestedBy)
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"rejected": write.ID,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// checkCritical returns an error unless the write policy marks a node
+// critical, as writes of other nodes need no approval
+func checkCritical(nodeID string) error {
+	if serviceBackend != nil {
+		if serviceWritePolicy.criticalRuleRef(nodeID) == nil {
+			return fmt.Errorf("%s is not critical, write it with point set", nodeID)
+		}
+		return nil
+	}
+	namespace, idType, identifier, err := plcclient.ParseNodeID(nodeID)
+	if err != nil {
+		return err
+	}
+	id, err := resolveNodeID(requestNodeID(namespace, idType, identifier))
+	if err != nil {
+		return fmt.Errorf("Invalid node ID: %v", err)
+	}
+	if serviceWritePolicy.criticalRule(id) == nil {
+		return fmt.Errorf("%s is not critical, write it with set", nodeID)
+	}
+	return nil
+}
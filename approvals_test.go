@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"umicli/pkg/plcclient"
+)
+
+// TestApprovalRegistry tests requesting, confirming, rejecting and expiring
+// writes of critical nodes
+func TestApprovalRegistry(t *testing.T) {
+	_, err := newApprovalRegistry(0)
+	assert.Error(t, err)
+
+	reg, err := newApprovalRegistry(15 * time.Minute)
+	require.NoError(t, err)
+	now := time.Date(2026, 10, 16, 8, 0, 0, 0, time.UTC)
+	reg.now = func() time.Time { return now }
+
+	_, err = reg.request(PendingWrite{NodeID: "ns=3;s=Cmd.Bypass", Value: "true", DataType: "bool", RequestedBy: "alice"})
+	assert.EqualError(t, err, "a write of a critical node needs a reason")
+	_, err = reg.request(PendingWrite{NodeID: "ns=3;s=Cmd.Bypass", Value: "true", DataType: "bool", Reason: "cleaning"})
+	assert.ErrorContains(t, err, "needs the token of a tenant")
+	write, err := reg.request(PendingWrite{NodeID: "ns=3;s=Cmd.Bypass", Value: "true", DataType: "bool", Reason: " cleaning ", RequestedBy: "alice"})
+	require.NoError(t, err)
+	assert.Len(t, write.ID, 32)
+	assert.Equal(t, "cleaning", write.Reason)
+	assert.Equal(t, now.Add(15*time.Minute), write.Expires)
+	assert.Equal(t, []PendingWrite{write}, reg.list())
+
+	_, err = reg.confirm(write.ID, "")
+	assert.ErrorContains(t, err, "needs the token of a tenant")
+	_, err = reg.confirm(write.ID, "alice")
+	assert.EqualError(t, err, "approval "+write.ID+" was requested by alice and needs another tenant to confirm it")
+	confirmed, err := reg.confirm(write.ID, "bob")
+	require.NoError(t, err)
+	assert.Equal(t, write, confirmed)
+	_, err = reg.confirm(write.ID, "carol")
+	assert.Error(t, err, "a write runs once")
+
+	rejected, err := reg.request(PendingWrite{NodeID: "ns=3;s=Cmd.Bypass", Value: "true", Reason: "cleaning", RequestedBy: "alice"})
+	require.NoError(t, err)
+	_, err = reg.reject(rejected.ID)
+	require.NoError(t, err)
+	_, err = reg.confirm(rejected.ID, "bob")
+	assert.Error(t, err)
+
+	expired, err := reg.request(PendingWrite{NodeID: "ns=3;s=Cmd.Bypass", Value: "true", Reason: "cleaning", RequestedBy: "alice"})
+	require.NoError(t, err)
+	now = now.Add(15 * time.Minute)
+	assert.Empty(t, reg.list())
+	_, err = reg.confirm(expired.ID, "bob")
+	assert.EqualError(t, err, "unknown or expired approval "+expired.ID)
+}
+
+// TestApprovals tests that writes of a critical node of the simulated PLC
+// are rejected until a second tenant confirms them
+func TestApprovals(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	connectMock(t, ctx)
+	setpoint := "nsu=" + mockNamespaceURI + ";s=Setpoint"
+	rule, err := parseNodeRule(setpoint)
+	require.NoError(t, err)
+	serviceWritePolicy = &writePolicy{critical: []nodeRule{rule}}
+	serviceApprovals, err = newApprovalRegistry(time.Minute)
+	require.NoError(t, err)
+	t.Cleanup(func() { serviceWritePolicy, serviceApprovals = nil, nil })
+
+	tenants := &tenantRegistry{tenants: []*tenant{
+		{Name: "alice", Token: "alice-token", Access: "write", source: "file"},
+		{Name: "bob", Token: "bob-token", Access: "write", source: "file"},
+	}}
+	mux := http.NewServeMux()
+	registerHandlers(mux, "opc.tcp://mock", 8765)
+	server := httptest.NewServer(tenants.middleware(mux))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.NoError(t, err)
+	alice := plcclient.New(u.Hostname(), port).WithToken("alice-token")
+	bob := plcclient.New(u.Hostname(), port).WithToken("bob-token")
+
+	_, err = alice.Write(ctx, plcclient.WriteRequest{NodeID: setpoint, Value: "42", DataType: "float"})
+	assert.ErrorContains(t, err, "is critical (rule "+setpoint+" of the write policy)")
+	_, err = alice.Write(ctx, plcclient.WriteRequest{NodeID: setpoint, Value: "42", DataType: "float", DryRun: true})
+	assert.NoError(t, err, "dry runs write nothing")
+	_, err = alice.RequestApproval(ctx, PendingWrite{NodeID: "nsu=" + mockNamespaceURI + ";s=Temperature", Value: "1", DataType: "double", Reason: "test"})
+	assert.ErrorContains(t, err, "is not critical")
+	_, err = alice.RequestApproval(ctx, PendingWrite{NodeID: setpoint, Value: "hot", DataType: "float", Reason: "test"})
+	assert.Error(t, err, "checked like a dry run")
+
+	write, err := alice.RequestApproval(ctx, PendingWrite{NodeID: setpoint, Value: "42", DataType: "float", Reason: "new recipe"})
+	require.NoError(t, err)
+	assert.Equal(t, "file:alice", write.RequestedBy)
+	writes, err := bob.Approvals(ctx)
+	require.NoError(t, err)
+	require.Len(t, writes, 1)
+	assert.Contains(t, formatApprovals(writes, time.Now()), "by file:alice  new recipe")
+
+	_, err = alice.ConfirmApproval(ctx, write.ID)
+	assert.ErrorContains(t, err, "needs another tenant")
+	result, err := bob.ConfirmApproval(ctx, write.ID)
+	require.NoError(t, err)
+	assert.Equal(t, setpoint, result.NodeID)
+
+	id, err := resolveNodeID(setpoint)
+	require.NoError(t, err)
+	value, err := readNodeDataValue(ctx, opcuaClient, id)
+	require.NoError(t, err)
+	assert.Equal(t, float32(42), value.Value.Value())
+
+	_, err = bob.ConfirmApproval(ctx, write.ID)
+	assert.ErrorContains(t, err, "unknown or expired approval")
+}
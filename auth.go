@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Time an authentication hook may take before the request is answered with
+// 503
+const authHookTimeout = 5 * time.Second
+
+// Default of --auth-cache-ttl
+const defaultAuthCacheTTL = time.Minute
+
+// authenticator checks the bearer tokens of API requests against a central
+// identity provider, for plants that do not want to list every token in a
+// tenants file. It returns the tenant of a token, nil if the provider rejects
+// the token, and an error if the provider could not be asked
+type authenticator interface {
+	authenticate(ctx context.Context, token string) (*tenant, error)
+}
+
+// newAuthenticator returns the authenticator of an --auth source:
+//
+//	command:/usr/local/bin/check-token   command reading the token on stdin
+//	introspect:https://idp/introspect    OAuth 2.0 token introspection (RFC 7662)
+//	jwt:https://idp/realms/plant         JWTs of an OIDC issuer, checked with its JWKS
+func newAuthenticator(source string) (authenticator, error) {
+	kind, arg, _ := strings.Cut(source, ":")
+	switch kind {
+	case "command":
+		if arg == "" {
+			return nil, fmt.Errorf("command: needs a command, e.g. command:/usr/local/bin/check-token")
+		}
+		return commandAuthenticator{command: arg}, nil
+	case "introspect":
+		return newIntrospectionAuthenticator(arg, os.Getenv)
+	case "jwt":
+		return newJWTAuthenticator(arg, os.Getenv)
+	}
+	return nil, fmt.Errorf("unknown auth source %q, use command:<command>, introspect:<url> or jwt:<issuer>", source)
+}
+
+// commandAuthenticator runs a command with sh for each token it has not
+// seen within the cache TTL. The token is on its stdin, the connection in
+// PLCCLI_CONNECTION. Exit code 0 accepts the token, the command printing the
+// tenant as JSON ({"name": "alice", "access": "write", "labels": {...}}), 1
+// rejects it. Other exit codes are failures
+type commandAuthenticator struct {
+	command string
+}
+
+func (c commandAuthenticator) authenticate(ctx context.Context, token string) (*tenant, error) {
+	ctx, cancel := context.WithTimeout(ctx, authHookTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", c.command)
+	cmd.Env = append(os.Environ(), "PLCCLI_CONNECTION="+connectionName)
+	cmd.Stdin = strings.NewReader(token + "\n")
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("auth command failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var t tenant
+	if err := json.Unmarshal(out, &t); err != nil {
+		return nil, fmt.Errorf("auth command printed no tenant JSON: %v", err)
+	}
+	if t.Name == "" {
+		return nil, fmt.Errorf("auth command printed a tenant without name")
+	}
+	t.source = "command"
+	switch t.Access {
+	case "":
+		t.Access = "read"
+	case "read", "write":
+	default:
+		return nil, fmt.Errorf("auth command printed access %q, must be read or write", t.Access)
+	}
+	return &t, nil
+}
+
+// introspectionAuthenticator asks the token introspection endpoint of an
+// OAuth 2.0 / OIDC provider about tokens, with the client credentials of
+// $PLCCLI_AUTH_CLIENT_ID and $PLCCLI_AUTH_CLIENT_SECRET. Active tokens with
+// the scope <prefix>:read get read access, with <prefix>:write write access.
+// The prefix is $PLCCLI_AUTH_SCOPE, plccli by default
+type introspectionAuthenticator struct {
+	url          string
+	clientID     string
+	clientSecret string
+	scope        string
+	client       *http.Client
+}
+
+func newIntrospectionAuthenticator(endpoint string, getenv func(string) string) (*introspectionAuthenticator, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("introspect: needs the URL of the introspection endpoint, e.g. introspect:https://idp/oauth2/introspect")
+	}
+	a := &introspectionAuthenticator{
+		url:          endpoint,
+		clientID:     getenv("PLCCLI_AUTH_CLIENT_ID"),
+		clientSecret: getenv("PLCCLI_AUTH_CLIENT_SECRET"),
+		scope:        getenv("PLCCLI_AUTH_SCOPE"),
+		client:       &http.Client{Timeout: authHookTimeout},
+	}
+	if a.clientID == "" {
+		return nil, fmt.Errorf("introspect: $PLCCLI_AUTH_CLIENT_ID is not set")
+	}
+	if a.scope == "" {
+		a.scope = "plccli"
+	}
+	return a, nil
+}
+
+func (a *introspectionAuthenticator) authenticate(ctx context.Context, token string) (*tenant, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(a.clientID), url.QueryEscape(a.clientSecret))
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("introspection failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("introspection failed with status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var result struct {
+		Active   bool   `json:"active"`
+		Scope    string `json:"scope"`
+		Username string `json:"username"`
+		Subject  string `json:"sub"`
+		ClientID string `json:"client_id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid introspection response: %v", err)
+	}
+	if !result.Active {
+		return nil, nil
+	}
+	t := &tenant{Name: result.Username, Access: scopeAccess(a.scope, strings.Fields(result.Scope)), source: "introspect"}
+	for _, name := range []string{result.Subject, result.ClientID} {
+		if t.Name == "" {
+			t.Name = name
+		}
+	}
+	if t.Access == "" || t.Name == "" {
+		return nil, nil
+	}
+	return t, nil
+}
+
+// scopeAccess returns the access the scopes or roles of a token give:
+// write with <prefix>:write, read with <prefix>:read, "" without either
+func scopeAccess(prefix string, scopes []string) string {
+	access := ""
+	for _, scope := range scopes {
+		switch scope {
+		case prefix + ":write":
+			access = "write"
+		case prefix + ":read":
+			if access == "" {
+				access = "read"
+			}
+		}
+	}
+	return access
+}
+
+// authCache remembers the answers of an authenticator for a while, so the
+// identity provider is asked once per token and TTL rather than per request.
+// Tokens are kept as hashes. Failures to ask are not cached
+type authCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[[sha256.Size]byte]authCacheEntry
+	now     func() time.Time
+}
+
+type authCacheEntry struct {
+	tenant  *tenant // nil for rejected tokens
+	expires time.Time
+}
+
+func newAuthCache(ttl time.Duration) *authCache {
+	return &authCache{ttl: ttl, entries: make(map[[sha256.Size]byte]authCacheEntry), now: time.Now}
+}
+
+// get returns the cached answer for a token, false if there is none
+func (c *authCache) get(token string) (*tenant, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[sha256.Sum256([]byte(token))]
+	if !ok || !c.now().Before(entry.expires) {
+		return nil, false
+	}
+	return entry.tenant, true
+}
+
+// authenticate returns the cached answer for a token or asks auth
+func (c *authCache) authenticate(ctx context.Context, auth authenticator, token string) (*tenant, error) {
+	if t, ok := c.get(token); ok {
+		return t, nil
+	}
+
+	t, err := auth.authenticate(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	// Tenants of JWTs are not kept beyond the expiry of the token
+	expires := now.Add(c.ttl)
+	if t != nil && !t.expires.IsZero() && t.expires.Before(expires) {
+		expires = t.expires
+	}
+	c.entries[sha256.Sum256([]byte(token))] = authCacheEntry{tenant: t, expires: expires}
+	return t, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCommandAuthenticator tests accepted, rejected and failing tokens of an
+// auth command and that the service asks it once per token within the TTL
+func TestCommandAuthenticator(t *testing.T) {
+	calls := filepath.Join(t.TempDir(), "calls")
+	script := filepath.Join(t.TempDir(), "check-token")
+	require.NoError(t, os.WriteFile(script, []byte(`#!/bin/sh
+read token
+echo "$token" >> `+calls+`
+case "$token" in
+  alice) echo '{"name": "alice", "access": "write", "labels": {"site": "'$PLCCLI_CONNECTION'"}}' ;;
+  bob) echo '{"name": "bob"}' ;;
+  broken) echo 'not json' ;;
+  down) echo 'idp unreachable' >&2; exit 2 ;;
+  *) exit 1 ;;
+esac
+`), 0755))
+	auth, err := newAuthenticator("command:" + script)
+	require.NoError(t, err)
+
+	reg := &tenantRegistry{tenants: []*tenant{{Name: "acme", Token: "acme-token", Access: "read"}}, auth: auth, cache: newAuthCache(time.Minute)}
+	ctx := context.Background()
+	alice, err := reg.authenticate(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, &tenant{Name: "alice", Access: "write", Labels: map[string]string{"site": connectionName}, source: "command"}, alice)
+	bob, err := reg.authenticate(ctx, "bob")
+	require.NoError(t, err)
+	assert.Equal(t, "read", bob.Access)
+	nobody, err := reg.authenticate(ctx, "mallory")
+	require.NoError(t, err)
+	assert.Nil(t, nobody)
+	_, err = reg.authenticate(ctx, "broken")
+	assert.Error(t, err)
+	_, err = reg.authenticate(ctx, "down")
+	assert.ErrorContains(t, err, "idp unreachable")
+
+	// Cached answers and tenants file tokens do not run the command
+	acme, err := reg.authenticate(ctx, "acme-token")
+	require.NoError(t, err)
+	assert.Equal(t, "acme", acme.Name)
+	reg.authenticate(ctx, "alice")
+	reg.authenticate(ctx, "mallory")
+	assert.Equal(t, "alice", reg.lookup("alice").Name)
+	data, err := os.ReadFile(calls)
+	require.NoError(t, err)
+	assert.Equal(t, "alice\nbob\nmallory\nbroken\ndown\n", string(data))
+
+	// A failing hook answers 503, not 401
+	handler := reg.middleware(http.NotFoundHandler())
+	for token, status := range map[string]int{"alice": http.StatusNotFound, "mallory": http.StatusUnauthorized, "down": http.StatusServiceUnavailable} {
+		req := httptest.NewRequest(http.MethodGet, "/api/info", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, status, rec.Code, token)
+	}
+
+	_, err = newAuthenticator("ldap:dc=plant")
+	assert.Error(t, err)
+}
+
+// TestIntrospectionAuthenticator tests mapping introspection responses to
+// tenants by scope
+func TestIntrospectionAuthenticator(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, secret, _ := r.BasicAuth()
+		assert.Equal(t, "plccli-gw", user)
+		assert.Equal(t, "s3cret", secret)
+		w.Header().Set("Content-Type", "application/json")
+		switch r.PostFormValue("token") {
+		case "operator":
+			w.Write([]byte(`{"active": true, "username": "jdoe", "scope": "openid line1:read line1:write"}`))
+		case "dashboard":
+			w.Write([]byte(`{"active": true, "client_id": "grafana", "scope": "line1:read"}`))
+		case "other-app":
+			w.Write([]byte(`{"active": true, "sub": "x", "scope": "billing:write"}`))
+		case "error":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.Write([]byte(`{"active": false}`))
+		}
+	}))
+	defer server.Close()
+
+	env := map[string]string{"PLCCLI_AUTH_CLIENT_ID": "plccli-gw", "PLCCLI_AUTH_CLIENT_SECRET": "s3cret", "PLCCLI_AUTH_SCOPE": "line1"}
+	auth, err := newIntrospectionAuthenticator(server.URL, func(key string) string { return env[key] })
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	operator, err := auth.authenticate(ctx, "operator")
+	require.NoError(t, err)
+	assert.Equal(t, &tenant{Name: "jdoe", Access: "write", source: "introspect"}, operator)
+	dashboard, err := auth.authenticate(ctx, "dashboard")
+	require.NoError(t, err)
+	assert.Equal(t, &tenant{Name: "grafana", Access: "read", source: "introspect"}, dashboard)
+	for _, token := range []string{"other-app", "expired"} {
+		rejected, err := auth.authenticate(ctx, token)
+		require.NoError(t, err)
+		assert.Nil(t, rejected, token)
+	}
+	_, err = auth.authenticate(ctx, "error")
+	assert.Error(t, err)
+
+	_, err = newIntrospectionAuthenticator(server.URL, func(string) string { return "" })
+	assert.Error(t, err, "no client ID")
+	_, err = newIntrospectionAuthenticator("idp:443", func(key string) string { return env[key] })
+	assert.Error(t, err)
+}
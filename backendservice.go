@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"umicli/pkg/backend"
+)
+
+// References per /api/points read
+const maxBackendRefs = 256
+
+// Interval of /api/points/stream when the request does not set one
+const defaultPointsInterval = time.Second
+
+// Timeout of /api/points reads and writes when the request does not set one
+const defaultPointsTimeout = 10 * time.Second
+
+// Backend of a service or direct mode whose endpoint scheme is registered
+// with pkg/backend, nil for OPC UA connections
+var serviceBackend backend.Backend
+
+// builtinBackend is a backend of this package with an HTTP API of its own,
+// e.g. /api/modbus, served next to /api/points
+type builtinBackend interface {
+	api(endpoint string) deviceAPI
+}
+
+// isBackendEndpoint reports whether a backend is registered for the scheme
+// of an endpoint
+func isBackendEndpoint(endpoint string) bool {
+	_, ok := backend.Lookup(endpoint)
+	return ok
+}
+
+// startBackendService runs the service of a connection to a device of a
+// registered backend. The OPC UA endpoints are not served, reads and writes
+// go through /api/points and the backend's own endpoints
+func startBackendService(endpoint string, timeout, port int, verbose bool) {
+	setConnection(port, verbose)
+	api, err := openBackend(endpoint, timeout, verbose)
+	if err != nil {
+		log.Fatalf("[%s] %v", connectionName, err)
+	}
+	// Requests connect when needed, a device that is down at start is no
+	// reason to stop
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	if err := serviceBackend.Connect(ctx); err != nil {
+		log.Printf("[%s] Warning: %v", connectionName, err)
+	}
+	cancel()
+	api.run(port)
+}
+
+// startBackendDirect serves the API of a device on a loopback port for
+// --direct, like startDirect does for OPC UA servers
+func startBackendDirect(endpoint string, timeout int, verbose bool) (int, error) {
+	startDeviceDirect(verbose)
+	api, err := openBackend(endpoint, timeout, verbose)
+	if err != nil {
+		return 0, err
+	}
+	return api.serveDirect()
+}
+
+// openBackend creates the backend of an endpoint, makes it the service's
+// backend and returns its HTTP API
+func openBackend(endpoint string, timeout int, verbose bool) (deviceAPI, error) {
+	reg, ok := backend.Lookup(endpoint)
+	if !ok {
+		return deviceAPI{}, fmt.Errorf("no backend for endpoint %q, known schemes: %s", endpoint, strings.Join(backend.Schemes(), ", "))
+	}
+	b, err := reg.Factory(endpoint, backend.Options{Timeout: time.Duration(timeout) * time.Second, Verbose: verbose})
+	if err != nil {
+		return deviceAPI{}, err
+	}
+	serviceBackend = b
+	if builtin, ok := b.(builtinBackend); ok {
+		return builtin.api(endpoint), nil
+	}
+	address := endpoint
+	if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+		address = u.Host
+	}
+	return deviceAPI{
+		name:     reg.Name,
+		protocol: reg.Scheme,
+		endpoint: endpoint,
+		address:  address,
+		example:  "/api/points?ref=...",
+		register: func(mux *http.ServeMux) {},
+		close:    func() { b.Close() },
+	}, nil
+}
+
+// noBackendError is the error of /api/points on connections without a
+// registered backend
+func noBackendError() string {
+	return "Not a backend connection, use --endpoint with one of the schemes " + strings.Join(backend.Schemes(), ", ")
+}
+
+// stampBackendResults stamps the values read without a source timestamp
+// with the time of the read. Backends of protocols with timestamps keep
+// theirs
+func stampBackendResults(results []NodeResponse, sampled time.Time) {
+	for i := range results {
+		if results[i].SourceTimestamp == nil {
+			stampResults(results[i:i+1], sampled)
+		}
+	}
+}
+
+// handlePointsRequest reads the references of ?ref=... (GET) or writes
+// {"ref", "value", "dataType"} (POST) through the connection's backend
+func handlePointsRequest(w http.ResponseWriter, r *http.Request) {
+	if serviceBackend == nil {
+		sendJSONResponseGeneric(w, map[string]string{"error": noBackendError()})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		refs := r.URL.Query()["ref"]
+		if len(refs) == 0 {
+			sendJSONResponseGeneric(w, map[string]string{"error": "Missing ref parameter"})
+			return
+		}
+		if len(refs) > maxBackendRefs {
+			sendJSONResponseGeneric(w, map[string]string{"error": fmt.Sprintf("Too many references, at most %d per read", maxBackendRefs)})
+			return
+		}
+		timeout, err := requestTimeout(r, "", defaultPointsTimeout)
+		if err != nil {
+			sendJSONResponseGeneric(w, map[string]string{"error": err.Error()})
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		results, err := serviceBackend.Read(ctx, refs)
+		if err != nil {
+			sendJSONResponseGeneric(w, map[string]string{"error": err.Error()})
+			return
+		}
+		sampled := time.Now()
+		stampBackendResults(results, sampled)
+		serviceRecent.record(results, sampled)
+		sendJSONResponseGeneric(w, map[string]interface{}{"results": results})
+
+	case http.MethodPost:
+		var req pointWrite
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendJSONResponseGeneric(w, NodeResponse{Error: fmt.Sprintf("Invalid request body: %v", err)})
+			return
+		}
+		if req.Timeout == "" {
+			req.Timeout = r.URL.Query().Get("timeout")
+		}
+		caller := requestCaller(r)
+		caller.queued = func(id string) {
+			w.Header().Set(operationIDHeader, id)
+		}
+		result, _ := performPointWrite(r.Context(), caller, req)
+		sendJSONResponseGeneric(w, result)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// pointWrite is a write of POST /api/points
+type pointWrite struct {
+	Ref      string `json:"ref"`
+	Value    string `json:"value"`
+	DataType string `json:"dataType"`
+	Timeout  string `json:"timeout,omitempty"`  // Instead of defaultPointsTimeout, e.g. 30s
+	Priority string `json:"priority,omitempty"` // In the write queue, high when empty
+	dryRun   bool   // Only check the write, for approval requests
+}
+
+// performPointWrite writes a reference through the service's backend like
+// performWrite writes a node: through the write queue, the write policy, the
+// approvals of critical references and the write limits, whose ref= rules
+// match references
+func performPointWrite(ctx context.Context, caller writeCaller, req pointWrite) (NodeResponse, error) {
+	if req.Ref == "" {
+		return writeFailed(NodeResponse{Error: "Missing ref"})
+	}
+	if err := serviceWritePolicy.checkRef(req.Ref); err != nil {
+		return writeRejected(caller.by, req.Ref, err)
+	}
+	if !req.dryRun {
+		if err := checkRefApproved(ctx, req.Ref); err != nil {
+			return writeRejected(caller.by, req.Ref, err)
+		}
+	}
+	if err := serviceWriteLimits.checkRef(req.Ref, req.Value); err != nil {
+		return writeRejected(caller.by, req.Ref, err)
+	}
+	timeout, err := parseTimeout(req.Timeout, defaultPointsTimeout)
+	if err != nil {
+		return writeFailed(NodeResponse{NodeID: req.Ref, Error: err.Error()})
+	}
+	if req.dryRun {
+		return NodeResponse{NodeID: req.Ref, Value: req.Value, DataType: req.DataType}, nil
+	}
+	priority, err := parseWritePriority(req.Priority)
+	if err != nil {
+		return writeFailed(NodeResponse{NodeID: req.Ref, Error: err.Error()})
+	}
+
+	var resp NodeResponse
+	var writeErr error
+	err = serviceWrites.do(req.Ref, "point", priority, caller.owner(), caller.queued, func() {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		result, err := serviceBackend.Write(ctx, req.Ref, req.Value, req.DataType)
+		if err != nil {
+			log.Printf("[%s] Write of %s failed: %v", connectionName, req.Ref, err)
+			resp, writeErr = writeFailed(NodeResponse{NodeID: req.Ref, Error: fmt.Sprintf("Failed to write: %v", err)})
+			return
+		}
+		if isVerbose {
+			log.Printf("[%s] Wrote %v to %s", connectionName, serviceSensitive.loggedValueOf(result.NodeID, result.Value), result.NodeID)
+		}
+		resp = result
+	})
+	if err != nil {
+		return writeFailed(NodeResponse{NodeID: req.Ref, Error: err.Error()})
+	}
+	return resp, writeErr
+}
+
+// handlePointsBrowseRequest lists the values below ?ref=, down to
+// ?maxdepth= levels, for backends that can browse
+func handlePointsBrowseRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if serviceBackend == nil {
+		sendJSONResponseGeneric(w, map[string]string{"error": noBackendError()})
+		return
+	}
+	maxDepth := 3
+	if s := r.URL.Query().Get("maxdepth"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			sendJSONResponseGeneric(w, map[string]string{"error": fmt.Sprintf("invalid maxdepth %q", s)})
+			return
+		}
+		maxDepth = n
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	nodes, err := serviceBackend.Browse(ctx, r.URL.Query().Get("ref"), maxDepth)
+	if err != nil {
+		if errors.Is(err, backend.ErrNotSupported) {
+			err = fmt.Errorf("browsing is %w", err)
+		}
+		sendJSONResponseGeneric(w, map[string]string{"error": err.Error()})
+		return
+	}
+	sendJSONResponseGeneric(w, map[string]interface{}{"nodes": nodes})
+}
+
+// handlePointsStreamRequest streams the values of ?ref=... as server-sent
+// values events whenever they change, checked every ?interval=
+func handlePointsStreamRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if serviceBackend == nil {
+		http.Error(w, noBackendError(), http.StatusBadRequest)
+		return
+	}
+	refs := r.URL.Query()["ref"]
+	if len(refs) == 0 || len(refs) > maxBackendRefs {
+		http.Error(w, fmt.Sprintf("Give 1-%d ref parameters", maxBackendRefs), http.StatusBadRequest)
+		return
+	}
+	interval := defaultPointsInterval
+	if s := r.URL.Query().Get("interval"); s != "" {
+		var err error
+		if interval, err = time.ParseDuration(s); err != nil || interval < 100*time.Millisecond {
+			http.Error(w, fmt.Sprintf("Invalid interval %q, at least 100ms", s), http.StatusBadRequest)
+			return
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	values := make(chan []NodeResponse)
+	done := make(chan error, 1)
+	go func() {
+		done <- serviceBackend.Subscribe(ctx, refs, interval, func(results []NodeResponse) {
+			select {
+			case values <- results:
+			case <-ctx.Done():
+			}
+		})
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ping := time.NewTicker(eventStreamPing)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-done:
+			if err != nil {
+				data, _ := json.Marshal(map[string]string{"error": err.Error()})
+				fmt.Fprintf(w, "event: error\ndata: %s\n\n", data)
+				flusher.Flush()
+			}
+			return
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case results := <-values:
+			sampled := time.Now()
+			stampBackendResults(results, sampled)
+			serviceRecent.record(results, sampled)
+			data, _ := json.Marshal(results)
+			fmt.Fprintf(w, "event: values\ndata: %s\n\n", data)
+		}
+		flusher.Flush()
+	}
+}
+
+// readBackendSample reads the references of a poll file group through the
+// service's backend. A failed read fails every reference of the group
+func readBackendSample(ctx context.Context, refs []string, synchronized bool) []NodeResponse {
+	results, err := serviceBackend.Read(ctx, refs)
+	if err != nil {
+		results = make([]NodeResponse, len(refs))
+		for i, ref := range refs {
+			results[i] = NodeResponse{NodeID: ref, RequestedNodeID: ref, Error: err.Error()}
+		}
+		return results
+	}
+	stampBackendResults(results, time.Now())
+	return results
+}
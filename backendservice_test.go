@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"umicli/pkg/backend"
+	"umicli/pkg/plcclient"
+)
+
+func init() {
+	backend.Register("fakedev", "Fake Device", func(endpoint string, opts backend.Options) (backend.Backend, error) {
+		return &fakeDeviceBackend{values: map[string]string{"motor.speed": "1500"}}, nil
+	})
+}
+
+// fakeDeviceBackend is a backend linked in from outside the package, with
+// string values that can be browsed
+type fakeDeviceBackend struct {
+	mu     sync.Mutex
+	values map[string]string
+}
+
+func (b *fakeDeviceBackend) Connect(ctx context.Context) error { return nil }
+
+func (b *fakeDeviceBackend) Read(ctx context.Context, refs []string) ([]NodeResponse, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	results := make([]NodeResponse, len(refs))
+	for i, ref := range refs {
+		results[i] = NodeResponse{NodeID: ref, RequestedNodeID: ref, DataType: "string"}
+		if value, ok := b.values[ref]; ok {
+			results[i].Value = value
+		} else {
+			results[i].Error = "no such value"
+		}
+	}
+	return results, nil
+}
+
+func (b *fakeDeviceBackend) Write(ctx context.Context, ref, value, dataType string) (NodeResponse, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if dataType != "" && dataType != "string" {
+		return NodeResponse{}, fmt.Errorf("values are strings")
+	}
+	b.values[ref] = value
+	return NodeResponse{NodeID: ref, RequestedNodeID: ref, Value: value, DataType: "string"}, nil
+}
+
+func (b *fakeDeviceBackend) Browse(ctx context.Context, ref string, maxDepth int) ([]BrowseNode, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var nodes []BrowseNode
+	for name := range b.values {
+		if strings.HasPrefix(name, ref) {
+			nodes = append(nodes, BrowseNode{NodeID: name, Path: name, DataType: "string", Writable: true})
+		}
+	}
+	return nodes, nil
+}
+
+func (b *fakeDeviceBackend) Subscribe(ctx context.Context, refs []string, interval time.Duration, fn func([]NodeResponse)) error {
+	return backend.Poll(ctx, b, refs, interval, fn)
+}
+
+func (b *fakeDeviceBackend) Close() error { return nil }
+
+// TestBackendService tests the API of a backend linked in from outside the
+// package: reads, writes, browsing and streams through /api/points, and the
+// point command's formatting
+func TestBackendService(t *testing.T) {
+	defer func(b backend.Backend) { serviceBackend = b }(serviceBackend)
+	assert.True(t, isBackendEndpoint("fakedev://press3"))
+	assert.True(t, isBackendEndpoint("modbus://meter"))
+	assert.False(t, isBackendEndpoint("opc.tcp://plc:4840"))
+
+	api, err := openBackend("fakedev://press3:9000", 5, false)
+	require.NoError(t, err)
+	assert.Equal(t, "fakedev", api.protocol)
+	assert.Equal(t, "press3:9000", api.address)
+	mux := http.NewServeMux()
+	api.registerAll(mux, 8765)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	client := newServiceClient(u.Hostname(), port)
+	written, err := client.WritePoint(ctx, "motor.speed", "1800", "")
+	require.NoError(t, err)
+	assert.Equal(t, "string", written.DataType)
+	_, err = client.WritePoint(ctx, "motor.speed", "1800", "float")
+	assert.ErrorContains(t, err, "values are strings")
+
+	results, err := client.ReadPoints(ctx, "motor.speed", "motor.torque")
+	require.NoError(t, err)
+	assert.Equal(t, "1800", results[0].Value)
+	assert.NotNil(t, results[0].SourceTimestamp)
+	assert.Equal(t, "no such value", results[1].Error)
+
+	nodes, err := client.BrowsePoints(ctx, "motor", 1)
+	require.NoError(t, err)
+	require.Len(t, nodes, 1)
+	out, err := browsePoints("motor", 1, u.Hostname(), port)
+	require.NoError(t, err)
+	assert.Contains(t, out, "motor.speed")
+
+	// Points are measured by the protocol of the connection
+	line, err := getDeviceValues([]string{"motor.speed"}, (*plcclient.HTTPClient).ReadPoints, u.Hostname(), port, "influx", "", bitOptions{}, influxOptions{})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(line, "fakedev,node_id=motor.speed,"), line)
+
+	// Streams send the values, then changes only
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(streamCtx, http.MethodGet, server.URL+"/api/points/stream?ref=motor.speed&interval=100ms", nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	scanner := bufio.NewScanner(resp.Body)
+	nextData := func() string {
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				return data
+			}
+		}
+		return ""
+	}
+	assert.Contains(t, nextData(), `"value":"1800"`)
+	_, err = client.WritePoint(ctx, "motor.speed", "1900", "")
+	require.NoError(t, err)
+	assert.Contains(t, nextData(), `"value":"1900"`)
+
+	resp, err = http.Get(server.URL + "/api/points/stream?ref=motor.speed&interval=1ms")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Writes are PLC writes for permits and maintenance
+	assert.True(t, isPLCWrite(httptest.NewRequest(http.MethodPost, "/api/points", nil)))
+	assert.False(t, isPLCWrite(httptest.NewRequest(http.MethodGet, "/api/points", nil)))
+
+	serviceBackend = nil
+	_, err = client.ReadPoints(ctx, "motor.speed")
+	assert.ErrorContains(t, err, "fakedev")
+}
+
+// TestPointWriteGuards tests that writes of /api/points go through the write
+// policy, the approvals and the write limits with ref= rules
+func TestPointWriteGuards(t *testing.T) {
+	defer func(b backend.Backend) { serviceBackend = b }(serviceBackend)
+	device := &fakeDeviceBackend{values: map[string]string{}}
+	serviceBackend = device
+
+	safety, err := parseNodeRule("ref=motor.safety*")
+	require.NoError(t, err)
+	bypass, err := parseNodeRule("ref=motor.bypass")
+	require.NoError(t, err)
+	speed, err := parseNodeRule("ref=motor.speed")
+	require.NoError(t, err)
+	highest := 2000.0
+	serviceWritePolicy = &writePolicy{deny: []nodeRule{safety}, critical: []nodeRule{bypass}}
+	serviceWriteLimits = writeLimits{{rule: speed, max: &highest}}
+	t.Cleanup(func() { serviceWritePolicy, serviceWriteLimits = nil, nil })
+	_, err = parseNodeRule("ref=")
+	assert.Error(t, err)
+
+	ctx := context.Background()
+	caller := writeCaller{by: "test"}
+	_, err = performPointWrite(ctx, caller, pointWrite{Ref: "motor.safety.reset", Value: "1"})
+	assert.ErrorContains(t, err, "denied by rule ref=motor.safety*")
+	resp, err := performPointWrite(ctx, caller, pointWrite{Ref: "motor.speed", Value: "2500"})
+	assert.ErrorContains(t, err, "above the maximum 2000")
+	assert.Equal(t, resp.Error, err.Error())
+	_, err = performPointWrite(ctx, caller, pointWrite{Ref: "motor.speed", Value: "1800", Timeout: "soon"})
+	assert.ErrorContains(t, err, "invalid timeout")
+	_, err = performPointWrite(ctx, caller, pointWrite{Ref: "motor.bypass", Value: "1"})
+	assert.ErrorContains(t, err, "need a second person")
+	assert.Empty(t, device.values, "nothing written")
+
+	var queued string
+	caller.queued = func(id string) { queued = id }
+	resp, err = performPointWrite(ctx, caller, pointWrite{Ref: "motor.speed", Value: "1800"})
+	require.NoError(t, err)
+	assert.Equal(t, "1800", resp.Value)
+	assert.NotEmpty(t, queued, "through the write queue")
+
+	_, err = performPointWrite(ctx, caller, pointWrite{Ref: "motor.bypass", Value: "1", dryRun: true})
+	require.NoError(t, err)
+	assert.NotContains(t, device.values, "motor.bypass", "dry run")
+	_, err = performPointWrite(context.WithValue(ctx, approvedContextKey{}, "a1"), caller, pointWrite{Ref: "motor.bypass", Value: "1"})
+	require.NoError(t, err)
+	assert.Equal(t, "1", device.values["motor.bypass"])
+	assert.NoError(t, checkCritical("motor.bypass"))
+	assert.ErrorContains(t, checkCritical("motor.speed"), "not critical")
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Window of the bandwidth usage in /api/stats
+const bandwidthWindow = time.Minute
+
+// sinkBudget keeps an HTTP sink within a number of request body bytes per
+// second, for sites paying per MB on cellular links. Lines go by priority
+// class: alarms first, then process values; what does not fit waits for the
+// next push. Diagnostic lines get what is left, and when that is not enough
+// they are downsampled to the latest line of each series
+type sinkBudget struct {
+	mu    sync.Mutex
+	rate  float64 // Bytes per second
+	now   func() time.Time
+	last  time.Time
+	spare float64 // Bytes that may be sent now, negative after going over
+	ratio float64 // Body bytes per line byte of the last request, < 1 with gzip
+
+	sentBytes   int64
+	downsampled int64
+	waiting     int
+	window      []sentBytes // Requests of the last bandwidthWindow
+}
+
+// sentBytes is a request body sent at a time
+type sentBytes struct {
+	time  time.Time
+	bytes int64
+}
+
+// newSinkBudget returns the budget of a sink's bandwidth setting, e.g. 2KB
+// or 2KB/s
+func newSinkBudget(bandwidth string) (*sinkBudget, error) {
+	rate, err := parseByteSize(strings.TrimSuffix(strings.TrimSpace(bandwidth), "/s"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid bandwidth: %v", err)
+	}
+	b := &sinkBudget{rate: float64(rate), ratio: 1, now: time.Now}
+	b.last = b.now()
+	return b, nil
+}
+
+// plan returns the lines to send now within the budget and the lines that
+// wait, by class. A class only gets what its more important classes left.
+// The budget grows by rate every second, up to a minute of bytes, so pauses
+// do not add up to bursts
+func (b *sinkBudget) plan(lines prioritized) (send, wait prioritized) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	b.spare = min(b.spare+now.Sub(b.last).Seconds()*b.rate, b.rate*bandwidthWindow.Seconds())
+	b.last = now
+
+	spare := b.spare
+	take := func(lines []string) int {
+		n := 0
+		for _, line := range lines {
+			cost := float64(len(line)+1) * b.ratio
+			if cost > spare {
+				break
+			}
+			spare -= cost
+			n++
+		}
+		return n
+	}
+
+	blocked := false // A more important class waits
+	for class, classLines := range lines {
+		if class == priorityDiagnostic && len(classLines) > 0 &&
+			(blocked || float64(linesSize(classLines))*b.ratio > spare) {
+			latest := latestPerSeries(classLines)
+			b.downsampled += int64(len(classLines) - len(latest))
+			classLines = latest
+		}
+		if blocked {
+			wait[class] = classLines
+			continue
+		}
+		n := take(classLines)
+		if n == 0 && send.len() == 0 && len(classLines) > 0 && b.spare >= b.rate*bandwidthWindow.Seconds() {
+			n = 1 // A line bigger than a minute of bytes would block the sink forever
+			spare = 0
+		}
+		send[class] = classLines[:n]
+		wait[class] = classLines[n:]
+		blocked = len(wait[class]) > 0
+	}
+	b.waiting = wait.len()
+	return send, wait
+}
+
+// spent takes a request off the budget: lineBytes of lines sent as
+// bodyBytes, which differ with gzip
+func (b *sinkBudget) spent(lineBytes, bodyBytes int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	b.spare -= float64(bodyBytes)
+	if lineBytes > 0 {
+		b.ratio = float64(bodyBytes) / float64(lineBytes)
+	}
+	b.sentBytes += int64(bodyBytes)
+	b.window = append(b.trim(now), sentBytes{time: now, bytes: int64(bodyBytes)})
+}
+
+// trim drops the requests older than bandwidthWindow. Callers must hold b.mu
+func (b *sinkBudget) trim(now time.Time) []sentBytes {
+	kept := b.window[:0]
+	for _, s := range b.window {
+		if now.Sub(s.time) < bandwidthWindow {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+// stats returns the budget, the bytes per second sent in the last minute and
+// the lines waiting or downsampled, for /api/stats
+func (b *sinkBudget) stats() map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.window = b.trim(b.now())
+	var recent int64
+	for _, s := range b.window {
+		recent += s.bytes
+	}
+	return map[string]interface{}{
+		"limit":       b.rate,
+		"usage":       float64(recent) / bandwidthWindow.Seconds(),
+		"sentBytes":   b.sentBytes,
+		"waiting":     b.waiting,
+		"downsampled": b.downsampled,
+	}
+}
+
+// bandwidthStatsSnapshot returns the budgets of the poll file sinks with
+// bandwidth, by sink
+func bandwidthStatsSnapshot() map[string]interface{} {
+	stats := make(map[string]interface{})
+	if s := servicePollFile; s != nil {
+		for _, sink := range s.file.Sinks {
+			if sink.budget != nil {
+				stats[sink.name()] = sink.budget.stats()
+			}
+		}
+	}
+	return stats
+}
+
+// linesSize returns the bytes of lines in a request body
+func linesSize(lines []string) int {
+	n := 0
+	for _, line := range lines {
+		n += len(line) + 1
+	}
+	return n
+}
+
+// latestPerSeries keeps the latest line of each series, the measurement,
+// tags and field names of a line, in the order of the lines
+func latestPerSeries(lines []string) []string {
+	latest := make(map[string]int, len(lines))
+	for i, line := range lines {
+		latest[seriesKey(line)] = i
+	}
+	var kept []string
+	for i, line := range lines {
+		if latest[seriesKey(line)] == i {
+			kept = append(kept, line)
+		}
+	}
+	return kept
+}
+
+// seriesKey returns the measurement and tags of a line with the names of its
+// fields
+func seriesKey(line string) string {
+	l, err := parseInfluxLine(line)
+	if err != nil {
+		return line
+	}
+	key := l.measurement + "," + l.tags
+	for _, field := range l.fields {
+		key += " " + field.name
+	}
+	return key
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSinkBudget tests that process values go first, diagnostic lines are
+// downsampled when the budget is short and the usage of /api/stats
+func TestSinkBudget(t *testing.T) {
+	b, err := newSinkBudget("100B/s")
+	require.NoError(t, err)
+	now := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+	b.now = func() time.Time { return now }
+	b.last = now
+
+	process := []string{
+		"boiler,node_id=ns\\=3;s\\=Temperature value=21.5 1", // 49 bytes with the line break
+		"boiler,node_id=ns\\=3;s\\=Temperature value=21.6 2",
+		"boiler,node_id=ns\\=3;s\\=Temperature value=21.7 3",
+	}
+	diagnostic := []string{
+		"energy,node_id=ns\\=3;s\\=Meter value=1001 1",
+		"energy,node_id=ns\\=3;s\\=Meter value=1002 2",
+		"energy,node_id=ns\\=3;s\\=Power value=41.2 2",
+	}
+
+	// One second: two of the process values, diagnostic lines wait
+	// downsampled
+	now = now.Add(time.Second)
+	send, wait := b.plan(prioritized{priorityProcess: process, priorityDiagnostic: diagnostic})
+	assert.Equal(t, process[:2], send.flatten())
+	assert.Equal(t, process[2:], wait[priorityProcess])
+	assert.Equal(t, diagnostic[1:], wait[priorityDiagnostic], "the latest line of each series")
+	b.spent(linesSize(send.flatten()), linesSize(send.flatten()))
+
+	// Two seconds later: the waiting process value and what fits of the
+	// diagnostic lines
+	now = now.Add(2 * time.Second)
+	send, wait = b.plan(wait)
+	assert.Equal(t, []string{process[2], diagnostic[1], diagnostic[2]}, send.flatten())
+	assert.Zero(t, wait.len())
+	b.spent(linesSize(send.flatten()), linesSize(send.flatten()))
+
+	stats := b.stats()
+	assert.Equal(t, 100.0, stats["limit"])
+	assert.Equal(t, int64(233), stats["sentBytes"])
+	assert.InDelta(t, 233.0/60, stats["usage"], 0.001)
+	assert.Equal(t, int64(1), stats["downsampled"])
+
+	// An hour of pause adds up to a minute of bytes only
+	now = now.Add(time.Hour)
+	b.plan(prioritized{})
+	assert.Equal(t, 6000.0, b.spare)
+	assert.Equal(t, 0.0, b.stats()["usage"])
+
+	for _, bad := range []string{"", "fast", "-1KB/s"} {
+		_, err := newSinkBudget(bad)
+		assert.Error(t, err, bad)
+	}
+}
@@ -2,6 +2,13 @@ package main
 
 import (
 	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
 // BitValue represents a single bit extracted from a value
@@ -11,6 +18,43 @@ type BitValue struct {
 	Name   string // Human-readable name for this bit
 }
 
+// bitOptions controls how values are expanded into individual bits
+type bitOptions struct {
+	enabled  bool       // Expand values into individual bits
+	names    []string   // Names for all 32 bits (nil for defaults)
+	nameMap  bitNameMap // Per-node sparse bit names from --bit-names-file
+	selected []int      // Bits to emit (nil for all 32)
+	summary  bool       // Also emit any_alarm, active_count and raw summary fields
+	edges    bool       // Emit only rising/falling transitions (poll mode)
+
+	// Bits of the data type of each node, 8, 16 or 32, see widthFor
+	widths map[string]int
+}
+
+// BitSummary holds aggregate state of a set of bits
+type BitSummary struct {
+	AnyActive   int    // 1 if any bit is set, 0 otherwise
+	ActiveCount int    // Number of bits set
+	Raw         uint32 // The full 32-bit word
+}
+
+// BitEdge is a transition of a single bit between two reads
+type BitEdge struct {
+	BitValue
+	Rising       bool          // true for 0->1, false for 1->0
+	HighDuration time.Duration // How long the bit was high (falling edges only)
+}
+
+// bitEdgeTracker remembers the last state of each bit per node to detect edges
+type bitEdgeTracker struct {
+	states map[string]map[int]*bitState
+}
+
+type bitState struct {
+	value     int
+	highSince time.Time
+}
+
 // getBitValue extracts a single bit from a uint32 value
 // bitNum: 0 (LSB) to 31 (MSB)
 // Returns: 0 or 1
@@ -38,20 +82,20 @@ func validateBitNames(names []string) error {
 	return nil
 }
 
-// extractBits extracts all 32 bits (0-31) from a uint32 value
-// value: the uint32 value to extract bits from
+// extractBits extracts the bits of a word of the given width (8, 16 or 32)
+// value: the word to extract bits from, see toBitWord
 // bitNames: optional slice of exactly 32 bit names (or nil for defaults)
 //
-// Returns: slice of 32 BitValue structs, one for each bit
-func extractBits(value uint32, bitNames []string) ([]BitValue, error) {
+// Returns: slice of width BitValue structs, one for each bit
+func extractBits(value uint32, width int, bitNames []string) ([]BitValue, error) {
 	// Validate bit names first
 	if err := validateBitNames(bitNames); err != nil {
 		return nil, err
 	}
 
-	// Extract all 32 bits (0-31)
-	results := make([]BitValue, 32)
-	for bitNum := 0; bitNum < 32; bitNum++ {
+	// Extract the bits of the word (0 to width-1)
+	results := make([]BitValue, width)
+	for bitNum := 0; bitNum < width; bitNum++ {
 		bitValue := getBitValue(value, bitNum)
 
 		// Determine bit name
@@ -71,3 +115,447 @@ func extractBits(value uint32, bitNames []string) ([]BitValue, error) {
 
 	return results, nil
 }
+
+// parseBitNames splits a comma-separated list of bit names, trimming whitespace
+//
+// Returns: nil for an empty string (default names)
+func parseBitNames(namesStr string) []string {
+	if namesStr == "" {
+		return nil
+	}
+	names := strings.Split(namesStr, ",")
+	for i := range names {
+		names[i] = strings.TrimSpace(names[i])
+	}
+	return names
+}
+
+// bitNameMap maps node IDs (normalized to ns=X;t=Y), Modbus points or Logix
+// tags to names of individual bits
+type bitNameMap map[string]map[int]string
+
+// loadBitNameMap reads a YAML (or JSON) file mapping node IDs to sparse bit
+// names, e.g.
+//
+//	"ns=5;s=alarm_rack":
+//	  0: motor_fault
+//	  7: drive_fault
+//
+// Bits without a name keep their default (or --bit-names) name
+func loadBitNameMap(path string) (bitNameMap, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read bit names file: %v", err)
+	}
+
+	var raw map[string]map[int]string
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid bit names file %s: %v", path, err)
+	}
+
+	nameMap := make(bitNameMap, len(raw))
+	for nodeID, names := range raw {
+		key, err := bitNameKey(nodeID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bit names file %s: %v", path, err)
+		}
+		for bitNum, name := range names {
+			if bitNum < 0 || bitNum > 31 {
+				return nil, fmt.Errorf("invalid bit names file %s: bit %d of %s out of range (0-31)", path, bitNum, nodeID)
+			}
+			if strings.TrimSpace(name) == "" {
+				return nil, fmt.Errorf("invalid bit names file %s: empty name for bit %d of %s", path, bitNum, nodeID)
+			}
+		}
+		nameMap[key] = names
+	}
+	return nameMap, nil
+}
+
+// bitNameKey returns the key of a node in bit name maps: the normalized OPC
+// UA node ID, the Modbus point as parseModbusPoint prints it, or the Logix
+// tag
+func bitNameKey(nodeID string) (string, error) {
+	if isModbusPoint(nodeID) {
+		p, err := parseModbusPoint(nodeID)
+		if err != nil {
+			return "", err
+		}
+		return p.String(), nil
+	}
+	if isENIPTag(nodeID) {
+		tag, err := parseENIPTag(nodeID)
+		return tag.name, err
+	}
+	return normalizeNodeID(nodeID)
+}
+
+// normalizeNodeID returns a node ID in the ns=X;t=Y form, so comma and
+// semicolon spellings of the same node match
+func normalizeNodeID(nodeID string) (string, error) {
+	namespace, idType, identifier, err := parseNodeID(nodeID)
+	if err != nil {
+		return "", err
+	}
+	return requestNodeID(namespace, idType, identifier), nil
+}
+
+// namesFor returns the 32 bit names for a node: names from the bit names file
+// override --bit-names, which overrides the default bit_N names
+// Returns the --bit-names list unchanged when the file has no entry for the node
+func (o bitOptions) namesFor(nodeID string) []string {
+	key, err := bitNameKey(nodeID)
+	if err != nil {
+		return o.names
+	}
+	sparse, ok := o.nameMap[key]
+	if !ok {
+		return o.names
+	}
+
+	names := make([]string, 32)
+	for bitNum := range names {
+		if len(o.names) == 32 {
+			names[bitNum] = o.names[bitNum]
+		} else {
+			names[bitNum] = fmt.Sprintf("bit_%d", bitNum)
+		}
+		if name, ok := sparse[bitNum]; ok {
+			names[bitNum] = strings.TrimSpace(name)
+		}
+	}
+	return names
+}
+
+// widthFor returns the bits of the data type of a node's value: 8, 16 or 32.
+// Values decoded from JSON are float64, they take the width of the node's
+// data type, 32 when it is not known
+func (o bitOptions) widthFor(nodeID string, value interface{}) int {
+	switch value.(type) {
+	case int8, uint8:
+		return 8
+	case int16, uint16:
+		return 16
+	case int32, uint32:
+		return 32
+	}
+	if width := o.widths[nodeID]; width > 0 {
+		return width
+	}
+	return 32
+}
+
+// dataTypeBits returns the bits of an integer data type that is narrower than
+// 64 bits, by its name in opcua set (sbyte to uint32), Modbus (int16 to
+// uint32) or EtherNet/IP (SINT to UDINT, BYTE to DWORD), 0 for other types
+func dataTypeBits(dataType string) int {
+	switch strings.ToLower(dataType) {
+	case "sbyte", "byte", "sint", "usint":
+		return 8
+	case "int16", "uint16", "int", "uint", "word":
+		return 16
+	case "int32", "uint32", "dint", "udint", "dword":
+		return 32
+	}
+	return 0
+}
+
+// word converts the value of a node into the word to extract bits from and
+// returns it with its width. Selected bits beyond the width are rejected
+func (o bitOptions) word(nodeID string, value interface{}) (uint32, int, error) {
+	width := o.widthFor(nodeID, value)
+	for _, bitNum := range o.selected {
+		if bitNum >= width {
+			return 0, 0, fmt.Errorf("bit %d is beyond the %d bits of %s", bitNum, width, nodeID)
+		}
+	}
+	word, err := toBitWord(value, width)
+	return word, width, err
+}
+
+// summarizeBits aggregates the given bits; raw is the full word they came from
+func summarizeBits(raw uint32, bits []BitValue) BitSummary {
+	summary := BitSummary{Raw: raw}
+	for _, bit := range bits {
+		summary.ActiveCount += bit.Value
+	}
+	if summary.ActiveCount > 0 {
+		summary.AnyActive = 1
+	}
+	return summary
+}
+
+// toBitWord converts a numeric value into the word of the given width (8,
+// 16 or 32 bits, see widthFor) used for bit extraction
+//
+// Semantics:
+//   - Unsigned values must fit in the width, e.g. 0 to 65535 for 16 bits
+//   - Negative values are treated as signed words of the width (SINT, INT,
+//     DINT) and reinterpreted as two's complement, so int32(-1) yields
+//     0xFFFFFFFF and int16(-1) yields 0xFFFF
+//   - Values outside e.g. -32768..65535 for 16 bits return an error instead of
+//     being truncated
+//   - Floats (values decoded from JSON) must hold a whole number in that range
+func toBitWord(value interface{}, width int) (uint32, error) {
+	low, high := -int64(1)<<(width-1), int64(1)<<width-1
+	var v int64
+	switch n := value.(type) {
+	case float64:
+		if math.IsNaN(n) || math.IsInf(n, 0) || n != math.Trunc(n) {
+			return 0, fmt.Errorf("value %v is not a whole number and cannot be used for bit extraction", n)
+		}
+		if n < float64(low) || n > float64(high) {
+			return 0, fmt.Errorf("value %v does not fit in %d bits for bit extraction", n, width)
+		}
+		v = int64(n)
+	case float32:
+		return toBitWord(float64(n), width)
+	case int:
+		v = int64(n)
+	case int8:
+		v = int64(n)
+	case int16:
+		v = int64(n)
+	case int32:
+		v = int64(n)
+	case int64:
+		v = n
+	case uint:
+		if uint64(n) > uint64(high) {
+			return 0, fmt.Errorf("value %v does not fit in %d bits for bit extraction", n, width)
+		}
+		return uint32(n), nil
+	case uint8:
+		v = int64(n)
+	case uint16:
+		v = int64(n)
+	case uint32:
+		v = int64(n)
+	case uint64:
+		if n > uint64(high) {
+			return 0, fmt.Errorf("value %v does not fit in %d bits for bit extraction", n, width)
+		}
+		return uint32(n), nil
+	default:
+		return 0, fmt.Errorf("value type %T cannot be converted to uint32 for bit extraction", value)
+	}
+
+	if v < low || v > high {
+		return 0, fmt.Errorf("value %d does not fit in %d bits for bit extraction", v, width)
+	}
+	// Signed words keep their two's complement bit pattern within the width
+	return uint32(v & high), nil
+}
+
+// setWordBit returns the integer word with one bit set or cleared, keeping
+// the OPC UA integer type of the word so it can be written back unchanged
+// bitNum: 0 (LSB) up to the width of the type minus one
+func setWordBit(word interface{}, bitNum int, on bool) (interface{}, error) {
+	width := 0
+	var bits uint64
+	switch v := word.(type) {
+	case uint8:
+		width, bits = 8, uint64(v)
+	case uint16:
+		width, bits = 16, uint64(v)
+	case uint32:
+		width, bits = 32, uint64(v)
+	case uint64:
+		width, bits = 64, v
+	case int8:
+		width, bits = 8, uint64(uint8(v))
+	case int16:
+		width, bits = 16, uint64(uint16(v))
+	case int32:
+		width, bits = 32, uint64(uint32(v))
+	case int64:
+		width, bits = 64, uint64(v)
+	default:
+		return nil, fmt.Errorf("value of type %T is not an integer word", word)
+	}
+
+	if bitNum < 0 || bitNum >= width {
+		return nil, fmt.Errorf("bit %d out of range for %d-bit word (0-%d)", bitNum, width, width-1)
+	}
+
+	if on {
+		bits |= 1 << uint(bitNum)
+	} else {
+		bits &^= 1 << uint(bitNum)
+	}
+
+	switch word.(type) {
+	case uint8:
+		return uint8(bits), nil
+	case uint16:
+		return uint16(bits), nil
+	case uint32:
+		return uint32(bits), nil
+	case uint64:
+		return bits, nil
+	case int8:
+		return int8(uint8(bits)), nil
+	case int16:
+		return int16(uint16(bits)), nil
+	case int32:
+		return int32(uint32(bits)), nil
+	default:
+		return int64(bits), nil
+	}
+}
+
+// parseBitSelection parses a bit selection like "3,7,12-15" into a sorted
+// list of unique bit numbers (0-31)
+//
+// Returns: nil for an empty selection (meaning all bits)
+func parseBitSelection(spec string) ([]int, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+
+	var seen [32]bool
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		// Either a single bit ("7") or an inclusive range ("12-15")
+		lo, hi := part, part
+		if idx := strings.Index(part, "-"); idx >= 0 {
+			lo, hi = strings.TrimSpace(part[:idx]), strings.TrimSpace(part[idx+1:])
+		}
+
+		start, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bit selection '%s': %v", part, err)
+		}
+		end, err := strconv.Atoi(hi)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bit selection '%s': %v", part, err)
+		}
+		if start < 0 || end > 31 || start > end {
+			return nil, fmt.Errorf("invalid bit selection '%s'. Bits must be in range 0-31", part)
+		}
+
+		for b := start; b <= end; b++ {
+			seen[b] = true
+		}
+	}
+
+	var selected []int
+	for b, ok := range seen {
+		if ok {
+			selected = append(selected, b)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("bit selection '%s' does not select any bits", spec)
+	}
+
+	return selected, nil
+}
+
+// selectBits filters extracted bits down to the selected bit numbers
+// A nil or empty selection returns all bits unchanged
+func selectBits(bits []BitValue, selected []int) []BitValue {
+	if len(selected) == 0 {
+		return bits
+	}
+
+	results := make([]BitValue, 0, len(selected))
+	for _, bitNum := range selected {
+		for _, bit := range bits {
+			if bit.BitNum == bitNum {
+				results = append(results, bit)
+				break
+			}
+		}
+	}
+	return results
+}
+
+// bitsFlag backs the --bits flag. It behaves like a boolean flag when given
+// without a value (all 32 bits) and accepts a bit selection via --bits=3,7,12-15
+type bitsFlag struct {
+	enabled  bool
+	selected []int
+}
+
+func (f *bitsFlag) String() string {
+	if f == nil || !f.enabled {
+		return "false"
+	}
+	if len(f.selected) == 0 {
+		return "true"
+	}
+	parts := make([]string, len(f.selected))
+	for i, b := range f.selected {
+		parts[i] = strconv.Itoa(b)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *bitsFlag) Set(value string) error {
+	switch strings.ToLower(value) {
+	case "true":
+		f.enabled, f.selected = true, nil
+		return nil
+	case "false":
+		f.enabled, f.selected = false, nil
+		return nil
+	}
+
+	selected, err := parseBitSelection(value)
+	if err != nil {
+		return err
+	}
+	f.enabled, f.selected = true, selected
+	return nil
+}
+
+// IsBoolFlag allows --bits to be given without a value
+func (f *bitsFlag) IsBoolFlag() bool {
+	return true
+}
+
+func newBitEdgeTracker() *bitEdgeTracker {
+	return &bitEdgeTracker{states: make(map[string]map[int]*bitState)}
+}
+
+// update records the current bits of a node and returns the edges since the
+// previous update. The first update only establishes the baseline; bits that
+// are already high count their high duration from that first read
+func (t *bitEdgeTracker) update(nodeID string, bits []BitValue, now time.Time) []BitEdge {
+	states, ok := t.states[nodeID]
+	if !ok {
+		states = make(map[int]*bitState)
+		t.states[nodeID] = states
+	}
+
+	var edges []BitEdge
+	for _, bit := range bits {
+		st, seen := states[bit.BitNum]
+		if !seen {
+			st = &bitState{value: bit.Value}
+			if bit.Value == 1 {
+				st.highSince = now
+			}
+			states[bit.BitNum] = st
+			continue
+		}
+
+		switch {
+		case st.value == 0 && bit.Value == 1:
+			st.highSince = now
+			edges = append(edges, BitEdge{BitValue: bit, Rising: true})
+		case st.value == 1 && bit.Value == 0:
+			edges = append(edges, BitEdge{BitValue: bit, HighDuration: now.Sub(st.highSince)})
+			st.highSince = time.Time{}
+		}
+		st.value = bit.Value
+	}
+
+	return edges
+}
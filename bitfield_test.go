@@ -1,7 +1,11 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -259,7 +263,7 @@ func TestExtractBits(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			results, err := extractBits(tt.value, tt.bitNames)
+			results, err := extractBits(tt.value, 32, tt.bitNames)
 
 			if tt.wantErr {
 				assert.Error(t, err)
@@ -273,3 +277,300 @@ func TestExtractBits(t *testing.T) {
 		})
 	}
 }
+
+// TestParseBitSelection tests parsing of --bits selections like "3,7,12-15"
+func TestParseBitSelection(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    []int
+		wantErr bool
+	}{
+		{name: "empty selects all", spec: "", want: nil},
+		{name: "single bit", spec: "7", want: []int{7}},
+		{name: "list and range", spec: "3,7,12-15", want: []int{3, 7, 12, 13, 14, 15}},
+		{name: "unsorted with duplicates", spec: "15,3,12-15,3", want: []int{3, 12, 13, 14, 15}},
+		{name: "whitespace tolerated", spec: " 0 , 30-31 ", want: []int{0, 30, 31}},
+		{name: "bit 32 out of range", spec: "32", wantErr: true},
+		{name: "negative bit", spec: "-1", wantErr: true},
+		{name: "reversed range", spec: "15-12", wantErr: true},
+		{name: "not a number", spec: "motor", wantErr: true},
+		{name: "only separators", spec: ",,", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseBitSelection(tt.spec)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// TestSelectBits tests that only the selected bits are kept, with their names
+func TestSelectBits(t *testing.T) {
+	all, err := extractBits(134217856, 32, nil) // bits 7 and 27 set
+	require.NoError(t, err)
+
+	assert.Len(t, selectBits(all, nil), 32, "nil selection keeps all bits")
+
+	selected := selectBits(all, []int{7, 12, 27})
+	require.Len(t, selected, 3)
+	assert.Equal(t, BitValue{BitNum: 7, Value: 1, Name: "bit_7"}, selected[0])
+	assert.Equal(t, BitValue{BitNum: 12, Value: 0, Name: "bit_12"}, selected[1])
+	assert.Equal(t, BitValue{BitNum: 27, Value: 1, Name: "bit_27"}, selected[2])
+}
+
+// TestBitsFlag tests that --bits works both as a boolean and with a selection
+func TestBitsFlag(t *testing.T) {
+	var f bitsFlag
+	assert.True(t, f.IsBoolFlag())
+	assert.Equal(t, "false", f.String())
+
+	require.NoError(t, f.Set("true"))
+	assert.True(t, f.enabled)
+	assert.Nil(t, f.selected)
+	assert.Equal(t, "true", f.String())
+
+	require.NoError(t, f.Set("3,7,12-13"))
+	assert.True(t, f.enabled)
+	assert.Equal(t, []int{3, 7, 12, 13}, f.selected)
+	assert.Equal(t, "3,7,12,13", f.String())
+
+	assert.Error(t, f.Set("40"))
+}
+
+// TestToBitWord tests signed and overflow-safe conversion to a word of the
+// data type's width, 32 bits unless given
+func TestToBitWord(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   interface{}
+		width   int
+		want    uint32
+		wantErr bool
+	}{
+		{name: "uint32 max", value: uint32(0xFFFFFFFF), want: 0xFFFFFFFF},
+		{name: "production value as float64", value: float64(134217856), want: 134217856},
+		{name: "negative int32 DINT", value: int32(-2147483520), want: 0x80000080},
+		{name: "negative int32 -1", value: int32(-1), want: 0xFFFFFFFF},
+		{name: "negative DINT decoded from JSON", value: float64(-2147483520), want: 0x80000080},
+		{name: "int16 as DINT", value: int16(-1), want: 0xFFFFFFFF},
+		{name: "negative INT", value: int16(-1), width: 16, want: 0xFFFF},
+		{name: "negative INT decoded from JSON", value: float64(-2), width: 16, want: 0xFFFE},
+		{name: "negative SINT", value: int8(-128), width: 8, want: 0x80},
+		{name: "UINT max", value: uint16(0xFFFF), width: 16, want: 0xFFFF},
+		{name: "UINT overflow from JSON", value: float64(65536), width: 16, wantErr: true},
+		{name: "INT below range from JSON", value: float64(-32769), width: 16, wantErr: true},
+		{name: "byte overflow", value: uint64(256), width: 8, wantErr: true},
+		{name: "uint64 in range", value: uint64(0xFFFFFFFF), want: 0xFFFFFFFF},
+		{name: "int64 in range", value: int64(42), want: 42},
+		{name: "uint64 overflow", value: uint64(0x100000000), wantErr: true},
+		{name: "int64 overflow", value: int64(0x100000000), wantErr: true},
+		{name: "int64 below int32 range", value: int64(-2147483649), wantErr: true},
+		{name: "float64 overflow", value: float64(5e9), wantErr: true},
+		{name: "fractional float", value: float64(3.5), wantErr: true},
+		{name: "string", value: "3", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			width := tt.width
+			if width == 0 {
+				width = 32
+			}
+			got, err := toBitWord(tt.value, width)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got, "expected 0x%08X, got 0x%08X", tt.want, got)
+		})
+	}
+}
+
+// TestBitWidth tests that words have the width of the node's data type and
+// that bits beyond it cannot be selected
+func TestBitWidth(t *testing.T) {
+	opts := bitOptions{widths: map[string]int{"ns=3;s=Status": 16}}
+	assert.Equal(t, 16, opts.widthFor("ns=3;s=Status", float64(-1)))
+	assert.Equal(t, 32, opts.widthFor("ns=3;s=Other", float64(-1)), "unknown data types are 32 bits")
+	assert.Equal(t, 8, opts.widthFor("ns=3;s=Other", uint8(1)), "values of the service keep their type")
+	assert.Equal(t, 16, dataTypeBits("Int16"))
+	assert.Equal(t, 8, dataTypeBits("USINT"))
+	assert.Zero(t, dataTypeBits("float"))
+
+	word, width, err := opts.word("ns=3;s=Status", float64(-1))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0xFFFF), word)
+	bits, err := extractBits(word, width, nil)
+	require.NoError(t, err)
+	require.Len(t, bits, 16, "no bits 16-31 of a 16-bit INT")
+	assert.Equal(t, "bit_15", bits[15].Name)
+
+	opts.selected = []int{3, 20}
+	_, _, err = opts.word("ns=3;s=Status", float64(-1))
+	assert.EqualError(t, err, "bit 20 is beyond the 16 bits of ns=3;s=Status")
+	_, _, err = opts.word("ns=3;s=Other", float64(-1))
+	assert.NoError(t, err)
+
+	lines, err := formatInfluxOutputWithBits("alarms", "ns=3;s=Status", float64(-1), "opc.tcp://plc:4840", bitOptions{widths: opts.widths, summary: true}, influxOptions{})
+	require.NoError(t, err)
+	require.Len(t, lines, 17)
+	assert.Contains(t, lines[16], "raw=65535u")
+}
+
+// TestSummarizeBits tests the aggregate any_alarm/active_count/raw summary
+func TestSummarizeBits(t *testing.T) {
+	all, err := extractBits(134217856, 32, nil) // bits 7 and 27 set
+	require.NoError(t, err)
+
+	summary := summarizeBits(134217856, all)
+	assert.Equal(t, BitSummary{AnyActive: 1, ActiveCount: 2, Raw: 134217856}, summary)
+
+	// Only the selected bits are counted, raw stays the full word
+	summary = summarizeBits(134217856, selectBits(all, []int{0, 1, 2}))
+	assert.Equal(t, BitSummary{AnyActive: 0, ActiveCount: 0, Raw: 134217856}, summary)
+}
+
+// TestParseBitNames tests splitting and trimming of --bit-names
+func TestParseBitNames(t *testing.T) {
+	assert.Nil(t, parseBitNames(""))
+	assert.Equal(t, []string{"motor_fault", "temp_high"}, parseBitNames("motor_fault, temp_high"))
+}
+
+// TestBitEdgeTracker tests rising/falling edge detection with high durations
+func TestBitEdgeTracker(t *testing.T) {
+	tracker := newBitEdgeTracker()
+	start := time.Date(2025, 3, 9, 14, 0, 0, 0, time.UTC)
+
+	read := func(value uint32) []BitValue {
+		bits, err := extractBits(value, 32, nil)
+		require.NoError(t, err)
+		return selectBits(bits, []int{0, 7})
+	}
+
+	// First read establishes the baseline, no edges
+	assert.Empty(t, tracker.update("ns=5;s=alarms", read(0x00000080), start))
+
+	// No change, no edges
+	assert.Empty(t, tracker.update("ns=5;s=alarms", read(0x00000080), start.Add(time.Second)))
+
+	// Bit 0 rises
+	edges := tracker.update("ns=5;s=alarms", read(0x00000081), start.Add(2*time.Second))
+	require.Len(t, edges, 1)
+	assert.Equal(t, 0, edges[0].BitNum)
+	assert.True(t, edges[0].Rising)
+
+	// Bit 0 and bit 7 fall; durations measured from their rising edge / first read
+	edges = tracker.update("ns=5;s=alarms", read(0x00000000), start.Add(5*time.Second))
+	require.Len(t, edges, 2)
+	assert.Equal(t, 0, edges[0].BitNum)
+	assert.False(t, edges[0].Rising)
+	assert.Equal(t, 3*time.Second, edges[0].HighDuration)
+	assert.Equal(t, 7, edges[1].BitNum)
+	assert.Equal(t, 5*time.Second, edges[1].HighDuration)
+
+	// Other nodes are tracked independently
+	assert.Empty(t, tracker.update("ns=5;s=other", read(0x00000081), start.Add(6*time.Second)))
+}
+
+// TestSetWordBit tests setting and clearing bits while keeping the word type
+func TestSetWordBit(t *testing.T) {
+	tests := []struct {
+		name    string
+		word    interface{}
+		bit     int
+		on      bool
+		want    interface{}
+		wantErr bool
+	}{
+		{name: "set uint16 bit", word: uint16(0x0001), bit: 4, on: true, want: uint16(0x0011)},
+		{name: "clear uint16 bit", word: uint16(0x0011), bit: 0, on: false, want: uint16(0x0010)},
+		{name: "set already set bit", word: uint32(0x80), bit: 7, on: true, want: uint32(0x80)},
+		{name: "uint32 MSB", word: uint32(0), bit: 31, on: true, want: uint32(0x80000000)},
+		{name: "byte", word: uint8(0xFF), bit: 7, on: false, want: uint8(0x7F)},
+		{name: "int16 sign bit", word: int16(0), bit: 15, on: true, want: int16(-32768)},
+		{name: "int32 clear sign bit", word: int32(-1), bit: 31, on: false, want: int32(0x7FFFFFFF)},
+		{name: "uint64 high bit", word: uint64(0), bit: 63, on: true, want: uint64(1 << 63)},
+		{name: "bit beyond uint16", word: uint16(0), bit: 16, on: true, wantErr: true},
+		{name: "negative bit", word: uint32(0), bit: -1, on: true, wantErr: true},
+		{name: "float word", word: 1.0, bit: 0, on: true, wantErr: true},
+		{name: "boolean", word: true, bit: 0, on: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := setWordBit(tt.word, tt.bit, tt.on)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// TestLoadBitNameMap tests loading sparse per-node bit names from a YAML file
+func TestLoadBitNameMap(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "alarms.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+"ns=5;s=alarm_rack1":
+  0: motor_fault
+  7: drive_fault
+"ns=5,s=alarm_rack2":
+  3: estop_active
+`), 0644))
+
+	nameMap, err := loadBitNameMap(path)
+	require.NoError(t, err)
+	assert.Equal(t, "drive_fault", nameMap["ns=5;s=alarm_rack1"][7])
+	assert.Equal(t, "estop_active", nameMap["ns=5;s=alarm_rack2"][3])
+
+	for name, content := range map[string]string{
+		"bit out of range": "\"ns=5;s=a\":\n  32: too_high\n",
+		"empty name":       "\"ns=5;s=a\":\n  1: \"\"\n",
+		"invalid node ID":  "\"ns=5;alarm_rack\":\n  1: fault\n",
+		"not a map":        "- a\n- b\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			badPath := filepath.Join(dir, "bad.yaml")
+			require.NoError(t, os.WriteFile(badPath, []byte(content), 0644))
+			_, err := loadBitNameMap(badPath)
+			assert.Error(t, err)
+		})
+	}
+
+	_, err = loadBitNameMap(filepath.Join(dir, "missing.yaml"))
+	assert.Error(t, err)
+}
+
+// TestBitOptionsNamesFor tests that file names override --bit-names and defaults per node
+func TestBitOptionsNamesFor(t *testing.T) {
+	opts := bitOptions{nameMap: bitNameMap{"ns=5;s=rack": {7: "drive_fault"}}}
+
+	names := opts.namesFor("ns=5,s=rack")
+	require.Len(t, names, 32)
+	assert.Equal(t, "bit_0", names[0])
+	assert.Equal(t, "drive_fault", names[7])
+
+	// Nodes without an entry keep the defaults
+	assert.Nil(t, opts.namesFor("ns=5;s=other"))
+
+	// --bit-names fills the bits the file does not name
+	opts.names = make([]string, 32)
+	for i := range opts.names {
+		opts.names[i] = fmt.Sprintf("cli_%d", i)
+	}
+	names = opts.namesFor("ns=5;s=rack")
+	assert.Equal(t, "cli_0", names[0])
+	assert.Equal(t, "drive_fault", names[7])
+	assert.Equal(t, opts.names, opts.namesFor("ns=5;s=other"))
+}
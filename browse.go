@@ -1,20 +1,18 @@
 package main
 
 import (
-    "context"
-    "encoding/json"
-    "fmt"
-    "io"
-    "net/http"
-    "net/url"
-    "os"
-    "strings"
-    "text/tabwriter"
-    "time"
-
-    "github.com/gopcua/opcua"
-    "github.com/gopcua/opcua/id"
-    "github.com/gopcua/opcua/ua"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+
+	"umicli/pkg/plcclient"
 )
 
 // NodeInfo represents discovered node information
@@ -31,18 +29,18 @@ type NodeInfo struct {
 
 // getEndpointTag gets a cleaned endpoint tag for InfluxDB format
 func getEndpointTag(host string, port int) string {
-    // Get connection info to extract endpoint
-    info, err := getConnectionInfo(host, port)
-    if err != nil {
-        return "unknown"
-    }
-    
-    endpoint, ok := info["endpoint"].(string)
-    if !ok {
-        return "unknown"
-    }
-    
-    // Clean endpoint for tags - only replace characters not allowed in InfluxDB tags
+	// Get connection info to extract endpoint
+	info, err := getConnectionInfo(host, port)
+	if err != nil {
+		return "unknown"
+	}
+
+	endpoint, ok := info["endpoint"].(string)
+	if !ok {
+		return "unknown"
+	}
+
+	// Clean endpoint for tags - only replace characters not allowed in InfluxDB tags
 	tagEscaper := strings.NewReplacer(
 		",", "\\,",
 		"=", "\\=",
@@ -50,70 +48,131 @@ func getEndpointTag(host string, port int) string {
 	)
 
 	cleanEndpoint := tagEscaper.Replace(endpoint)
-    return cleanEndpoint
+	return cleanEndpoint
 }
 
+// Flags of opcua browse
+var (
+	browseMaxNodes     int    // --max-nodes, 0 for all
+	browseContinuation string // --continuation of a browse stopped at --max-nodes
+	browseRefresh      bool   // --refresh, browse the PLC instead of the cache
+)
+
+// Nodes per page of a browse through the service
+const browsePageSize = 500
+
 // Browse nodes from the OPC UA server using the HTTP service
-func browseNode(startNodeID string, maxDepth int, host string, port int, format string) error {
+// With async the browse runs as a service job that is polled until done.
+// Otherwise it is fetched in pages, each printed when it arrives, so no
+// request has to cover the whole address space. With maxNodes it stops
+// after that many nodes and prints how to continue
+func browseNode(startNodeID string, maxDepth int, async bool, host string, port int, format string, maxNodes int, continuation string, refresh bool) error {
+	if async && (maxNodes > 0 || continuation != "") {
+		return fmt.Errorf("--max-nodes and --continuation do not work with --async")
+	}
+
+	// Complete browses come from and go to the browse cache
+	var cache *browseCache
+	if maxNodes == 0 && continuation == "" {
+		cache = loadBrowseCache(host, port)
+	}
+	if cache != nil && !refresh {
+		if entry, ok := cache.get(startNodeID, maxDepth); ok {
+			fmt.Fprintf(os.Stderr, "Cached browse of %s from %s ago, --refresh to browse the PLC again\n",
+				startNodeID, time.Since(entry.Time).Round(time.Second))
+			newBrowsePrinter(format, host, port).print(entry.Nodes)
+			return nil
+		}
+	}
 
 	if format != "influx" {
-		fmt.Printf("Browsing node %s (max depth: %d)...\n", startNodeID, maxDepth)
+		if continuation != "" {
+			fmt.Println("Continuing browse...")
+		} else {
+			fmt.Printf("Browsing node %s (max depth: %d)...\n", startNodeID, maxDepth)
+		}
+	}
+	out := newBrowsePrinter(format, host, port)
+
+	if async {
+		nodes, err := browseNodeAsync(startNodeID, maxDepth, host, port)
+		if err != nil {
+			return err
+		}
+		out.print(nodes)
+		cacheBrowse(cache, startNodeID, maxDepth, nodes)
+		return nil
+	}
+
+	client := newServiceClient(host, port)
+	printed := 0
+	var all []plcclient.BrowseNode // For the cache
+	for {
+		limit := browsePageSize
+		if maxNodes > 0 && maxNodes-printed < limit {
+			limit = maxNodes - printed
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), callTimeout(120*time.Second))
+		page, err := client.BrowsePaged(ctx, startNodeID, maxDepth, limit, continuation)
+		cancel()
+		if err != nil {
+			if continuation != "" {
+				fmt.Fprintf(os.Stderr, "Browse stopped after %d nodes, continue with --continuation %s\n", printed, continuation)
+			}
+			return err
+		}
+		if maxNodes > 0 && printed+len(page.Nodes) > maxNodes {
+			page.Nodes = page.Nodes[:maxNodes-printed] // Services without paging send all nodes
+		}
+		out.print(page.Nodes)
+		printed += len(page.Nodes)
+		if cache != nil {
+			all = append(all, page.Nodes...)
+		}
+		continuation = page.Continuation
+		if continuation == "" {
+			cacheBrowse(cache, startNodeID, maxDepth, all)
+			return nil
+		}
+		if maxNodes > 0 && printed >= maxNodes {
+			fmt.Fprintf(os.Stderr, "Stopped at --max-nodes %d, continue with --continuation %s\n", maxNodes, continuation)
+			return nil
+		}
+	}
+}
+
+// cacheBrowse keeps a complete browse in the cache, if there is one
+func cacheBrowse(cache *browseCache, startNodeID string, maxDepth int, nodes []plcclient.BrowseNode) {
+	if cache == nil {
+		return
+	}
+	if err := cache.put(startNodeID, maxDepth, nodes); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
 	}
-    
-    // Create a client with timeout
-    client := &http.Client{
-        Timeout: 120 * time.Second,
-    }
-    
-    // Build the request URL with host and port
-    reqURL := fmt.Sprintf("http://%s:%d/api/browse?nodeid=%s&maxdepth=%d", 
-        host, port, url.QueryEscape(startNodeID), maxDepth)
-    
-    // Make the request
-    resp, err := client.Get(reqURL)
-    if err != nil {
-        return fmt.Errorf("cannot connect to OPCUA service on %s:%d: %v (is it running?)", host, port, err)
-    }
-    defer resp.Body.Close()
-    
-    // Read response body
-    body, err := io.ReadAll(resp.Body)
-    if err != nil {
-        return fmt.Errorf("error reading response: %v", err)
-    }
-    
-    // Check HTTP status
-    if resp.StatusCode != http.StatusOK {
-        return fmt.Errorf("service error: %s", body)
-    }
-    
-    // Parse the JSON response
-    var browseResp struct {
-        Nodes []struct {
-            NodeId      string `json:"nodeId"`
-            BrowseName  string `json:"browseName"`
-            Path        string `json:"path"`
-            DataType    string `json:"dataType"`
-            Writable    bool   `json:"writable"`
-            Description string `json:"description"`
-        } `json:"nodes"`
-        Error string `json:"error,omitempty"`
-    }
-    
-    if err := json.Unmarshal(body, &browseResp); err != nil {
-        return fmt.Errorf("error parsing response: %v", err)
-    }
-    
-    // Check for errors in the response
-    if browseResp.Error != "" {
-        return fmt.Errorf("service reported error: %s", browseResp.Error)
-    }
-    
-    // Check format and print results accordingly
+}
+
+// browsePrinter prints the pages of a browse as InfluxDB lines or as a
+// table whose header comes with the first page
+type browsePrinter struct {
+	format   string
+	endpoint string // Tag of InfluxDB lines
+	header   bool
+}
+
+func newBrowsePrinter(format, host string, port int) *browsePrinter {
+	p := &browsePrinter{format: format}
 	if format == "influx" {
+		p.endpoint = getEndpointTag(host, port)
+	}
+	return p
+}
+
+// print prints the nodes of a page
+func (p *browsePrinter) print(nodes []plcclient.BrowseNode) {
+	if p.format == "influx" {
 		// Print results in InfluxDB Line Protocol format
 		timestamp := time.Now().UnixNano()
-		
+
 		// Create a replacer for escaping special characters in tag values
 		tagEscaper := strings.NewReplacer(
 			",", "\\,",
@@ -121,19 +180,18 @@ func browseNode(startNodeID string, maxDepth int, host string, port int, format
 			" ", "\\ ",
 			"\"", "\\\"",
 		)
-		
-		for _, node := range browseResp.Nodes {
+
+		// Get endpoint for the connection
+		endpointTag := tagEscaper.Replace(p.endpoint)
+		for _, node := range nodes {
 			// Clean up names for InfluxDB compatibility - escape special characters
 			measurementName := "opcua_node"
-			
+
 			// Escape special characters in tag values
 			nodePath := tagEscaper.Replace(node.Path)
-			nodeId := tagEscaper.Replace(node.NodeId)
+			nodeId := tagEscaper.Replace(node.NodeID)
 			dataType := tagEscaper.Replace(node.DataType)
-			
-			// Get endpoint for the connection
-			endpointTag := tagEscaper.Replace(getEndpointTag(host, port))
-			
+
 			// Generate line protocol format
 			// measurement,tag1=value1,tag2=value2 field1=value1,field2=value2 timestamp
 			fmt.Printf("%s,node_id=%s,path=%s,data_type=%s,endpoint=%s writable=%v,description=\"%s\" %d\n",
@@ -146,60 +204,75 @@ func browseNode(startNodeID string, maxDepth int, host string, port int, format
 				strings.Replace(node.Description, "\"", "\\\"", -1),
 				timestamp)
 		}
-	} else {
-        // Original tabular format
-        w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-        fmt.Fprintln(w, "Path\tNodeID\tDataType\tWritable\tDescription")
-        fmt.Fprintln(w, "----\t------\t--------\t--------\t-----------")
-        
-        for _, node := range browseResp.Nodes {
-            fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%s\n",
-                node.Path,
-                node.NodeId,
-                node.DataType,
-                node.Writable,
-                strings.ReplaceAll(node.Description, "\n", " "))
-        }
-        w.Flush()
-    }
-    
-    return nil
-}
+		return
+	}
 
-// This function will be called from service.go to perform the actual browse
-func doBrowse(ctx context.Context, client *opcua.Client, startNodeID string, maxDepth int) ([]NodeInfo, error) {
-	id, err := ua.ParseNodeID(startNodeID)
-	if err != nil {
-		return nil, fmt.Errorf("invalid node id: %v", err)
+	// Tabular format, aligned per page
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if !p.header {
+		fmt.Fprintln(w, "Path\tNodeID\tDataType\tWritable\tDescription")
+		fmt.Fprintln(w, "----\t------\t--------\t--------\t-----------")
+		p.header = true
 	}
+	for _, node := range nodes {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%s\n",
+			node.Path,
+			node.NodeID,
+			node.DataType,
+			node.Writable,
+			strings.ReplaceAll(node.Description, "\n", " "))
+	}
+	w.Flush()
+}
+
+// browseNodeAsync browses with a service job, reporting progress on stderr
+// Each poll is a short request, so no proxy timeout applies to big browses
+func browseNodeAsync(startNodeID string, maxDepth int, host string, port int) ([]plcclient.BrowseNode, error) {
+	client := newServiceClient(host, port)
 
-	// Create root node
-	n := client.Node(id)
-	
-	// Perform browse operation recursively
-	nodes, err := browseRecursive(ctx, n, "", 0, maxDepth)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	job, err := client.StartJob(ctx, plcclient.JobRequest{Kind: "browse", NodeID: startNodeID, MaxDepth: maxDepth})
+	cancel()
 	if err != nil {
 		return nil, err
 	}
-	
-	return nodes, nil
-}
 
-// Recursive function to browse nodes
-func browseRecursive(ctx context.Context, n *opcua.Node, path string, level, maxDepth int) ([]NodeInfo, error) {
-	if level > maxDepth {
-		return nil, nil
+	for job.Running() {
+		fmt.Fprintf(os.Stderr, "\rJob %s: %d nodes browsed", job.ID, job.Progress)
+		time.Sleep(time.Second)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		job, err = client.Job(ctx, job.ID)
+		cancel()
+		if err != nil {
+			fmt.Fprintln(os.Stderr)
+			return nil, err
+		}
 	}
+	fmt.Fprintf(os.Stderr, "\rJob %s: %d nodes browsed, %s\n", job.ID, job.Progress, job.State)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+	return client.BrowseJobResult(ctx, job.ID)
+}
+
+// This function will be called from service.go to perform the actual browse
+// visited, if not nil, is incremented atomically for every node visited
+func doBrowse(ctx context.Context, client *opcua.Client, startNodeID string, maxDepth int, visited *int64) ([]NodeInfo, error) {
+	return browsePage(ctx, client, newBrowseCursor(startNodeID, maxDepth), 0, visited)
+}
 
+// browseNodeInfo reads the attributes of a node found below path
+func browseNodeInfo(ctx context.Context, n *opcua.Node, path string) (NodeInfo, error) {
 	// Get node attributes
-	attrs, err := n.Attributes(ctx, 
-		ua.AttributeIDNodeClass, 
-		ua.AttributeIDBrowseName, 
-		ua.AttributeIDDescription, 
-		ua.AttributeIDAccessLevel, 
+	attrs, err := n.Attributes(ctx,
+		ua.AttributeIDNodeClass,
+		ua.AttributeIDBrowseName,
+		ua.AttributeIDDescription,
+		ua.AttributeIDAccessLevel,
 		ua.AttributeIDDataType)
 	if err != nil {
-		return nil, err
+		return NodeInfo{}, err
 	}
 
 	// Create node info
@@ -261,41 +334,7 @@ func browseRecursive(ctx context.Context, n *opcua.Node, path string, level, max
 	// Set path
 	info.Path = joinPath(path, info.BrowseName)
 
-	// Store results
-	var nodes []NodeInfo
-	if info.NodeClass == ua.NodeClassVariable {
-		nodes = append(nodes, info)
-	}
-
-	// Browse child nodes
-	browseChildren := func(refType uint32) error {
-		refs, err := n.ReferencedNodes(ctx, refType, ua.BrowseDirectionForward, ua.NodeClassAll, true)
-		if err != nil {
-			return fmt.Errorf("references lookup error: %v", err)
-		}
-		
-		for _, rn := range refs {
-			children, err := browseRecursive(ctx, rn, info.Path, level+1, maxDepth)
-			if err != nil {
-				return fmt.Errorf("browse children error: %v", err)
-			}
-			nodes = append(nodes, children...)
-		}
-		return nil
-	}
-
-	// Browse different reference types
-	if err := browseChildren(id.HasComponent); err != nil {
-		return nil, err
-	}
-	if err := browseChildren(id.Organizes); err != nil {
-		return nil, err
-	}
-	if err := browseChildren(id.HasProperty); err != nil {
-		return nil, err
-	}
-
-	return nodes, nil
+	return info, nil
 }
 
 // Helper to join path components
@@ -304,4 +343,4 @@ func joinPath(a, b string) string {
 		return b
 	}
 	return a + "." + b
-}
\ No newline at end of file
+}
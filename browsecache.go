@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"umicli/pkg/plcclient"
+)
+
+// Characters not allowed in the file names of browse caches
+var browseCacheUnsafe = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// browseCache keeps the results of complete browses of a connection on disk,
+// in the user's cache directory (~/.cache/plccli on Linux), so repeated
+// browses of big address spaces don't load the PLC every time. The results
+// hold as long as the endpoint and the server's namespace array are the
+// same: when either changed, e.g. after a firmware update, they are dropped
+type browseCache struct {
+	path string
+
+	Endpoint   string                      `json:"endpoint"`
+	Namespaces []string                    `json:"namespaces"`
+	Entries    map[string]browseCacheEntry `json:"entries"` // By start node and depth
+}
+
+// browseCacheEntry is the result of a browse
+type browseCacheEntry struct {
+	Time  time.Time              `json:"time"`
+	Nodes []plcclient.BrowseNode `json:"nodes"`
+}
+
+// loadBrowseCache returns the browse cache of the service's connection, nil
+// if the service has no namespace array to key it by (not connected, or not
+// an OPC UA connection) or there is no cache directory
+func loadBrowseCache(host string, port int) *browseCache {
+	info, err := getConnectionInfo(host, port)
+	if err != nil {
+		return nil
+	}
+	var namespaces []string
+	raw, _ := info["namespaces"].([]interface{})
+	for _, ns := range raw {
+		uri, _ := ns.(string)
+		namespaces = append(namespaces, uri)
+	}
+	if len(namespaces) == 0 {
+		return nil
+	}
+	connection, _ := info["connection"].(string)
+	if connection == "" {
+		connection = host + "-" + strconv.Itoa(port)
+	}
+	endpoint, _ := info["endpoint"].(string)
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return nil
+	}
+	path := filepath.Join(dir, "plccli", "browse-"+browseCacheUnsafe.ReplaceAllString(connection, "_")+".json")
+	return openBrowseCache(path, endpoint, namespaces)
+}
+
+// openBrowseCache reads a cache file. A missing or unreadable file, or one of
+// another endpoint or namespace array, gives an empty cache
+func openBrowseCache(path, endpoint string, namespaces []string) *browseCache {
+	c := &browseCache{}
+	if data, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(data, c)
+	}
+	if c.Endpoint != endpoint || !slices.Equal(c.Namespaces, namespaces) {
+		c.Entries = nil
+	}
+	if c.Entries == nil {
+		c.Entries = make(map[string]browseCacheEntry)
+	}
+	c.path, c.Endpoint, c.Namespaces = path, endpoint, namespaces
+	return c
+}
+
+// browseCacheKey is the key of the browse of a node to a depth
+func browseCacheKey(nodeID string, maxDepth int) string {
+	return nodeID + " " + strconv.Itoa(maxDepth)
+}
+
+// get returns the cached browse of a node to a depth
+func (c *browseCache) get(nodeID string, maxDepth int) (browseCacheEntry, bool) {
+	entry, ok := c.Entries[browseCacheKey(nodeID, maxDepth)]
+	return entry, ok
+}
+
+// put keeps the result of a browse and saves the cache
+func (c *browseCache) put(nodeID string, maxDepth int, nodes []plcclient.BrowseNode) error {
+	c.Entries[browseCacheKey(nodeID, maxDepth)] = browseCacheEntry{Time: time.Now().UTC(), Nodes: nodes}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return fmt.Errorf("failed to create the cache directory: %v", err)
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write the browse cache: %v", err)
+	}
+	return os.Rename(tmp, c.path)
+}
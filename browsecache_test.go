@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestBrowseCache tests that complete browses are answered from the cache
+// until --refresh or a new namespace array, and partial ones never are
+func TestBrowseCache(t *testing.T) {
+	cacheDir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cacheDir)
+	t.Setenv("HOME", t.TempDir())
+
+	namespaces := []string{"http://opcfoundation.org/UA/", "urn:plc"}
+	browses := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/info", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"connection": "line 1", "endpoint": "opc.tcp://plc:4840", "namespaces": namespaces,
+		})
+	})
+	mux.HandleFunc("/api/browse", func(w http.ResponseWriter, r *http.Request) {
+		browses++
+		w.Write([]byte(`{"nodes": [{"nodeId": "ns=1;s=A", "browseName": "A"}, {"nodeId": "ns=1;s=B", "browseName": "B"}]}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.NoError(t, err)
+	host := u.Hostname()
+
+	require.NoError(t, browseNode("i=84", 3, false, host, port, "default", 0, "", false))
+	require.NoError(t, browseNode("i=84", 3, false, host, port, "default", 0, "", false))
+	assert.Equal(t, 1, browses, "the second browse comes from the cache")
+
+	cache := loadBrowseCache(host, port)
+	require.NotNil(t, cache)
+	assert.Equal(t, filepath.Join(cacheDir, "plccli", "browse-line_1.json"), cache.path)
+	entry, ok := cache.get("i=84", 3)
+	require.True(t, ok)
+	assert.Len(t, entry.Nodes, 2)
+	_, ok = cache.get("i=84", 2)
+	assert.False(t, ok, "another depth")
+
+	require.NoError(t, browseNode("i=84", 3, false, host, port, "default", 0, "", true))
+	assert.Equal(t, 2, browses, "--refresh")
+	require.NoError(t, browseNode("i=84", 3, false, host, port, "default", 1, "", false))
+	assert.Equal(t, 3, browses, "--max-nodes")
+
+	namespaces = append(namespaces, "urn:plc:diagnostics")
+	require.NoError(t, browseNode("i=84", 3, false, host, port, "default", 0, "", false))
+	assert.Equal(t, 4, browses, "the namespace array changed")
+	require.NoError(t, browseNode("i=84", 3, false, host, port, "default", 0, "", false))
+	assert.Equal(t, 4, browses)
+
+	// A corrupt file is an empty cache
+	require.NoError(t, os.WriteFile(cache.path, []byte("{"), 0644))
+	require.NoError(t, browseNode("i=84", 3, false, host, port, "default", 0, "", false))
+	assert.Equal(t, 5, browses)
+}
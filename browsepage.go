@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// Most nodes a page of /api/browse may ask for
+const maxBrowsePage = 10000
+
+// Nodes visited per returned node at most in a page, so pages of subtrees
+// with few variables end in time too
+const browsePageVisits = 10
+
+// Reference types followed by browse, in the order of its results
+var browseReferenceTypes = []uint32{id.HasComponent, id.Organizes, id.HasProperty}
+
+// browseFrame is a node of a paged browse whose children are not all
+// visited yet: the reference type followed and the next child of it
+type browseFrame struct {
+	NodeID string `json:"n"`
+	Path   string `json:"p"`
+	Ref    int    `json:"r"` // Index into browseReferenceTypes
+	Child  int    `json:"c"`
+
+	children []*opcua.Node // Children of Ref, browsed again after resuming
+}
+
+// browseCursor is the position of a depth-first browse. Encoded as
+// continuation token it holds the chain of nodes from the start node down
+// to the next one, so a browse resumes from any service without state
+// kept between requests. Children are found by their position among the
+// references of their parent, a subtree that changes between pages may
+// skip or repeat nodes
+type browseCursor struct {
+	Start    string        `json:"s"`
+	MaxDepth int           `json:"d"`
+	Started  bool          `json:"v,omitempty"` // The start node is visited
+	Stack    []browseFrame `json:"f,omitempty"`
+}
+
+func newBrowseCursor(startNodeID string, maxDepth int) *browseCursor {
+	return &browseCursor{Start: startNodeID, MaxDepth: maxDepth}
+}
+
+// done reports whether the browse visited all nodes
+func (c *browseCursor) done() bool {
+	return c.Started && len(c.Stack) == 0
+}
+
+// token encodes the cursor as continuation token
+func (c *browseCursor) token() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// parseBrowseToken decodes a continuation token of /api/browse
+func parseBrowseToken(token string) (*browseCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	var c browseCursor
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil || c.Start == "" {
+		return nil, fmt.Errorf("invalid continuation token")
+	}
+	for _, f := range c.Stack {
+		if f.Ref < 0 || f.Child < 0 {
+			return nil, fmt.Errorf("invalid continuation token")
+		}
+	}
+	return &c, nil
+}
+
+// browsePage browses on from the cursor until limit variables are found,
+// limit*browsePageVisits nodes are visited or the subtree is done, and
+// moves the cursor behind them. A limit of 0 browses the whole subtree. The
+// variables are in depth-first order: a node, then its children by
+// HasComponent, Organizes and HasProperty. visited, if
+// not nil, is incremented atomically for every node visited
+func browsePage(ctx context.Context, client *opcua.Client, c *browseCursor, limit int, visited *int64) ([]NodeInfo, error) {
+	var nodes []NodeInfo
+	visits := 0
+	visit := func(n *opcua.Node, path string, level int) error {
+		info, err := browseNodeInfo(ctx, n, path)
+		if err != nil {
+			return err
+		}
+		visits++
+		if visited != nil {
+			atomic.AddInt64(visited, 1)
+		}
+		if info.NodeClass == ua.NodeClassVariable {
+			nodes = append(nodes, info)
+		}
+		if level < c.MaxDepth {
+			c.Stack = append(c.Stack, browseFrame{NodeID: n.ID.String(), Path: info.Path})
+		}
+		return nil
+	}
+
+	if !c.Started {
+		start, err := resolveNodeID(c.Start)
+		if err != nil {
+			return nil, fmt.Errorf("invalid node id: %v", err)
+		}
+		if c.MaxDepth >= 0 {
+			if err := visit(client.Node(start), "", 0); err != nil {
+				return nil, err
+			}
+		}
+		c.Started = true
+	}
+
+	for len(c.Stack) > 0 && (limit <= 0 || len(nodes) < limit && visits < limit*browsePageVisits) {
+		top := &c.Stack[len(c.Stack)-1]
+		if top.Ref >= len(browseReferenceTypes) {
+			c.Stack = c.Stack[:len(c.Stack)-1]
+			continue
+		}
+		if top.children == nil {
+			nodeID, err := ua.ParseNodeID(top.NodeID)
+			if err != nil {
+				return nil, fmt.Errorf("invalid node id %s in continuation token", top.NodeID)
+			}
+			refs, err := client.Node(nodeID).ReferencedNodes(ctx, browseReferenceTypes[top.Ref], ua.BrowseDirectionForward, ua.NodeClassAll, true)
+			if err != nil {
+				return nil, fmt.Errorf("references lookup error: %v", err)
+			}
+			top.children = append([]*opcua.Node{}, refs...)
+		}
+		if top.Child >= len(top.children) {
+			top.Ref, top.Child, top.children = top.Ref+1, 0, nil
+			continue
+		}
+		child := top.children[top.Child]
+		top.Child++
+		if err := visit(child, top.Path, len(c.Stack)); err != nil {
+			return nil, fmt.Errorf("browse children error: %v", err)
+		}
+	}
+	return nodes, nil
+}
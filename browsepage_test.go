@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"umicli/pkg/plcclient"
+)
+
+// TestBrowsePaging tests that the pages of a browse, each resumed from the
+// continuation token of the one before, hold the nodes of a browse in one
+// request
+func TestBrowsePaging(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	connectMock(t, ctx)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/browse", handleBrowseRequest)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.NoError(t, err)
+	client := newServiceClient(u.Hostname(), port)
+
+	all, err := client.Browse(ctx, "i=85", 2)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, len(all), len(mockVariables))
+
+	var paged []plcclient.BrowseNode
+	pages := 0
+	continuation := ""
+	for {
+		page, err := client.BrowsePaged(ctx, "i=85", 2, 2, continuation)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(page.Nodes), 2)
+		paged = append(paged, page.Nodes...)
+		pages++
+		if continuation = page.Continuation; continuation == "" {
+			break
+		}
+		require.Less(t, pages, 1000)
+	}
+	assert.Equal(t, all, paged)
+	assert.GreaterOrEqual(t, pages, len(mockVariables)/2)
+
+	_, err = client.BrowsePaged(ctx, "i=85", 2, 2, "not-a-token")
+	assert.ErrorContains(t, err, "invalid continuation token")
+	_, err = client.BrowsePaged(ctx, "i=85", 2, maxBrowsePage+1, "")
+	assert.ErrorContains(t, err, "invalid limit")
+}
+
+// TestBrowseCursor tests encoding browse positions as continuation tokens
+func TestBrowseCursor(t *testing.T) {
+	c := newBrowseCursor("ns=3;s=Line1", 4)
+	assert.False(t, c.done())
+	c.Started = true
+	c.Stack = []browseFrame{{NodeID: "ns=3;s=Line1", Path: "Line1", Ref: 1, Child: 7}}
+
+	parsed, err := parseBrowseToken(c.token())
+	require.NoError(t, err)
+	assert.Equal(t, c, parsed)
+	parsed.Stack = nil
+	assert.True(t, parsed.done())
+
+	for _, token := range []string{"", "e30", "eyJzIjoiaT04NCIsImYiOlt7InIiOi0xfV19"} {
+		_, err := parseBrowseToken(token)
+		assert.Error(t, err, token)
+	}
+}
+
+// TestBrowseMaxNodes tests that opcua browse stops at --max-nodes, asking
+// the service for no more nodes than it prints
+func TestBrowseMaxNodes(t *testing.T) {
+	var limits []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limits = append(limits, r.URL.Query().Get("limit"))
+		switch r.URL.Query().Get("continuation") {
+		case "":
+			w.Write([]byte(`{"nodes": [{"nodeId": "ns=3;s=A"}, {"nodeId": "ns=3;s=B"}], "continuation": "next"}`))
+		case "next":
+			w.Write([]byte(`{"nodes": [{"nodeId": "ns=3;s=C"}], "continuation": "last"}`))
+		default:
+			w.Write([]byte(`{"nodes": [{"nodeId": "ns=3;s=D"}]}`))
+		}
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.NoError(t, err)
+
+	require.NoError(t, browseNode("i=84", 3, false, u.Hostname(), port, "default", 3, "", false))
+	assert.Equal(t, []string{"3", "1"}, limits)
+
+	limits = nil
+	require.NoError(t, browseNode("i=84", 3, false, u.Hostname(), port, "default", 0, "next", false))
+	assert.Equal(t, []string{"500", "500"}, limits)
+	assert.Error(t, browseNode("i=84", 3, true, u.Hostname(), port, "default", 10, "", false))
+}
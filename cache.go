@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+)
+
+// valueCache keeps the values read for API requests for a short time, so
+// dashboards refreshing the same nodes do not hammer slow PLCs, e.g. behind
+// serial bridges. Only good values are kept, and writes drop the values of
+// the written nodes. Polls and other service internals always read the PLC
+type valueCache struct {
+	ttl time.Duration // 0 disables the cache
+
+	mu      sync.Mutex
+	entries map[string]cachedValue
+}
+
+type cachedValue struct {
+	value   *ua.DataValue
+	expires time.Time
+}
+
+// Read cache of the service, the TTL is set by --cache-ttl
+var serviceCache = newValueCache(0)
+
+func newValueCache(ttl time.Duration) *valueCache {
+	return &valueCache{ttl: ttl, entries: make(map[string]cachedValue)}
+}
+
+// get returns the value of a node if it is younger than the TTL
+func (c *valueCache) get(nodeID *ua.NodeID) (*ua.DataValue, bool) {
+	if c.ttl <= 0 {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[nodeID.String()]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, nodeID.String())
+		return nil, false
+	}
+	return entry.value, true
+}
+
+// put keeps a good value of a node
+func (c *valueCache) put(nodeID *ua.NodeID, value *ua.DataValue) {
+	if c.ttl <= 0 || value == nil || value.Status != ua.StatusOK {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Drop expired values now and then so unread nodes do not pile up
+	if len(c.entries) >= 1024 {
+		now := time.Now()
+		for key, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+	}
+	c.entries[nodeID.String()] = cachedValue{value: value, expires: time.Now().Add(c.ttl)}
+}
+
+// invalidate drops the values of written nodes
+func (c *valueCache) invalidate(req *ua.WriteRequest) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, n := range req.NodesToWrite {
+		delete(c.entries, n.NodeID.String())
+	}
+}
+
+// clear drops all values, e.g. after a reconnect where namespace indexes
+// may have changed
+func (c *valueCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]cachedValue)
+}
+
+// freshRead reports whether a request bypasses the cache with fresh=true
+func freshRead(r *http.Request, bodyFresh bool) bool {
+	fresh, _ := strconv.ParseBool(r.URL.Query().Get("fresh"))
+	return fresh || bodyFresh
+}
+
+// readCachedDataValue is readNodeDataValue through the cache. A fresh read
+// skips the cache but updates it
+func readCachedDataValue(ctx context.Context, client *opcua.Client, nodeID *ua.NodeID, fresh bool) (*ua.DataValue, error) {
+	if !fresh {
+		if value, ok := serviceCache.get(nodeID); ok {
+			return value, nil
+		}
+	}
+	value, err := readNodeDataValue(ctx, client, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	serviceCache.put(nodeID, value)
+	return value, nil
+}
+
+// readCachedDataValues is readNodeDataValues through the cache: only the
+// nodes without a cached value are read
+func readCachedDataValues(ctx context.Context, client *opcua.Client, nodeIDs []*ua.NodeID, fresh bool) ([]*ua.DataValue, error) {
+	values := make([]*ua.DataValue, len(nodeIDs))
+	var missing []*ua.NodeID
+	var positions []int
+	for i, nodeID := range nodeIDs {
+		if !fresh {
+			if value, ok := serviceCache.get(nodeID); ok {
+				values[i] = value
+				continue
+			}
+		}
+		missing = append(missing, nodeID)
+		positions = append(positions, i)
+	}
+	if len(missing) == 0 {
+		return values, nil
+	}
+
+	read, err := readNodeDataValues(ctx, client, missing)
+	if err != nil {
+		return nil, err
+	}
+	for j, i := range positions {
+		values[i] = read[j]
+		serviceCache.put(missing[j], read[j])
+	}
+	return values, nil
+}
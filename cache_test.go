@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestValueCache tests expiry and invalidation of cached values
+func TestValueCache(t *testing.T) {
+	id := ua.NewStringNodeID(2, "Counter")
+	good := &ua.DataValue{Value: ua.MustVariant(int32(1))}
+
+	off := newValueCache(0)
+	off.put(id, good)
+	_, ok := off.get(id)
+	assert.False(t, ok, "a TTL of 0 disables the cache")
+
+	c := newValueCache(50 * time.Millisecond)
+	c.put(ua.NewStringNodeID(2, "Missing"), &ua.DataValue{Status: ua.StatusBadNodeIDUnknown})
+	_, ok = c.get(ua.NewStringNodeID(2, "Missing"))
+	assert.False(t, ok, "bad values are not cached")
+
+	c.put(id, good)
+	value, ok := c.get(id)
+	require.True(t, ok)
+	assert.Same(t, good, value)
+	c.invalidate(&ua.WriteRequest{NodesToWrite: []*ua.WriteValue{{NodeID: ua.NewStringNodeID(2, "Counter")}}})
+	_, ok = c.get(id)
+	assert.False(t, ok, "writes drop the value")
+
+	c.put(id, good)
+	time.Sleep(60 * time.Millisecond)
+	_, ok = c.get(id)
+	assert.False(t, ok, "expired")
+}
+
+// TestCachedReads tests that API reads of the simulated PLC are served from
+// the cache until a fresh read or a write
+func TestCachedReads(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	connectMock(t, ctx)
+	serviceCache = newValueCache(time.Minute)
+	t.Cleanup(func() { serviceCache = newValueCache(0) })
+
+	get := func(identifier, query string) NodeResponse {
+		rec := httptest.NewRecorder()
+		handleNodeRequest(rec, httptest.NewRequest("GET", "/api/node?namespace="+url.QueryEscape(mockNamespaceURI)+"&type=s&identifier="+identifier+query, nil))
+		var resp NodeResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		require.Empty(t, resp.Error)
+		return resp
+	}
+
+	// The counter counts up every second
+	first := get("Counter", "")
+	time.Sleep(1500 * time.Millisecond)
+	assert.Equal(t, first.Value, get("Counter", "").Value)
+	fresh := get("Counter", "&fresh=true")
+	assert.NotEqual(t, first.Value, fresh.Value)
+	assert.Equal(t, fresh.Value, get("Counter", "").Value, "fresh reads update the cache")
+
+	// Batch reads share the cache and read only the missing nodes
+	body := `{"nodes": [
+		{"namespace": "` + mockNamespaceURI + `", "type": "s", "identifier": "Counter"},
+		{"namespace": "` + mockNamespaceURI + `", "type": "s", "identifier": "Name"}
+	]}`
+	rec := httptest.NewRecorder()
+	handleBatchNodeRequest(rec, httptest.NewRequest("POST", "/api/nodes", strings.NewReader(body)))
+	var batch struct {
+		Results []NodeResponse `json:"results"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &batch))
+	require.Len(t, batch.Results, 2)
+	assert.Equal(t, fresh.Value, batch.Results[0].Value)
+	assert.Equal(t, "press-1", batch.Results[1].Value)
+
+	// A write drops the cached value
+	name, err := resolveNodeID("nsu=" + mockNamespaceURI + ";s=Name")
+	require.NoError(t, err)
+	_, err = writeOPCUA(ctx, opcuaClient, &ua.WriteRequest{NodesToWrite: []*ua.WriteValue{{
+		NodeID:      name,
+		AttributeID: ua.AttributeIDValue,
+		Value:       &ua.DataValue{EncodingMask: ua.DataValueValue, Value: ua.MustVariant("press-2")},
+	}}})
+	require.NoError(t, err)
+	assert.Equal(t, "press-2", get("Name", "").Value)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"umicli/pkg/backend"
+)
+
+// Data types of opcua set, as the node write handler converts them
+var setDataTypes = []string{
+	"boolean", "sbyte", "byte", "int16", "uint16", "int32", "uint32", "int64", "uint64",
+	"float", "double", "string", "localizedtext", "dtl", "struct",
+}
+
+// Values of --format, with what they print
+var outputFormats = []capabilityFormat{
+	{Name: "influx", About: "InfluxDB line protocol (the default)"},
+	{Name: "default", About: "Human-readable output"},
+	{Name: "json", About: "JSON, of query and capabilities"},
+}
+
+// capabilities is what plccli capabilities reports of the binary, so tooling
+// can adapt to the version installed on a gateway
+type capabilities struct {
+	Version       string               `json:"version"`
+	Commit        string               `json:"commit"`
+	Built         string               `json:"built"`
+	Commands      []capabilityCommand  `json:"commands"`
+	DataTypes     map[string][]string  `json:"dataTypes"` // By protocol
+	OutputFormats []capabilityFormat   `json:"outputFormats"`
+	Drivers       []capabilityDriver   `json:"drivers"`
+	ExitCodes     []capabilityExitCode `json:"exitCodes"`
+	Profile       string               `json:"profile"`    // full, minimal or custom, see buildProfile
+	Components    []*buildComponent    `json:"components"` // Optional components, included or not
+}
+
+// capabilityCommand is a subcommand with the flags it takes after its name
+type capabilityCommand struct {
+	Name  string   `json:"name"`
+	Args  string   `json:"args,omitempty"`
+	About string   `json:"about"`
+	Flags []string `json:"flags"`
+}
+
+// capabilityFormat is a value of --format
+type capabilityFormat struct {
+	Name  string `json:"name"`
+	About string `json:"about"`
+}
+
+// capabilityDriver is a protocol plccli connects to, by the scheme of
+// --endpoint
+type capabilityDriver struct {
+	Scheme string `json:"scheme"`
+	Name   string `json:"name"`
+}
+
+// capabilityExitCode is an exit code of the CLI and its class of failure
+type capabilityExitCode struct {
+	Code  int    `json:"code"`
+	Name  string `json:"name"`
+	About string `json:"about"`
+}
+
+// collectCapabilities lists the commands, data types, output formats,
+// protocol drivers, exit codes and optional components of the binary
+func collectCapabilities() capabilities {
+	c := capabilities{
+		Version:       buildVersion,
+		Commit:        buildCommit,
+		Built:         buildTime,
+		OutputFormats: outputFormats,
+		DataTypes:     map[string][]string{"opcua": setDataTypes},
+		Drivers:       []capabilityDriver{{Scheme: "opc.tcp", Name: "OPC UA"}},
+		ExitCodes:     exitCodeClasses,
+		Profile:       buildProfile(),
+		Components:    buildComponents,
+	}
+	if findComponent("modbus").Included {
+		c.DataTypes["modbus"] = modbusTypeNames()
+	}
+	if findComponent("enip").Included {
+		c.DataTypes["enip"] = enipTypeNames()
+	}
+	for i := range commands {
+		cmd := capabilityCommand{Name: commands[i].name, Args: commands[i].args, About: commands[i].about, Flags: []string{}}
+		commands[i].flagSet().VisitAll(func(f *flag.Flag) {
+			cmd.Flags = append(cmd.Flags, f.Name)
+		})
+		c.Commands = append(c.Commands, cmd)
+	}
+	for _, reg := range backend.Registrations() {
+		if excludedScheme(reg.Scheme) {
+			continue
+		}
+		c.Drivers = append(c.Drivers, capabilityDriver{Scheme: reg.Scheme, Name: reg.Name})
+	}
+	return c
+}
+
+// modbusTypeNames returns the data types of Modbus registers, with the
+// -swapped variants of the multi-register types
+func modbusTypeNames() []string {
+	var names []string
+	for name, width := range modbusTypeWidths {
+		names = append(names, name)
+		if width > 1 {
+			names = append(names, name+"-swapped")
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// enipTypeNames returns the atomic EtherNet/IP types and STRING
+func enipTypeNames() []string {
+	var names []string
+	for _, t := range cipTypes {
+		names = append(names, t.name)
+	}
+	return append(names, "STRING")
+}
+
+// runCapabilities prints the capabilities of the binary, as JSON with
+// --format json
+func runCapabilities(format string) (string, error) {
+	c := collectCapabilities()
+	if format == "json" {
+		// Arguments like <node-id> are not HTML
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(c); err != nil {
+			return "", err
+		}
+		return strings.TrimSuffix(buf.String(), "\n"), nil
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "plccli %s (%s, built %s)\n\nCommands:\n", c.Version, c.Commit, c.Built)
+	for _, cmd := range c.Commands {
+		fmt.Fprintf(&b, "  %s", cmd.Name)
+		if cmd.Args != "" {
+			fmt.Fprintf(&b, " %s", cmd.Args)
+		}
+		fmt.Fprintf(&b, "\n      %s\n", cmd.About)
+	}
+	b.WriteString("\nData types:\n")
+	for _, protocol := range []string{"opcua", "modbus", "enip"} {
+		if c.DataTypes[protocol] == nil {
+			continue
+		}
+		fmt.Fprintf(&b, "  %-7s %s\n", protocol, strings.Join(c.DataTypes[protocol], ", "))
+	}
+	b.WriteString("\nOutput formats:\n")
+	for _, f := range c.OutputFormats {
+		fmt.Fprintf(&b, "  %-8s %s\n", f.Name, f.About)
+	}
+	b.WriteString("\nExit codes:\n")
+	for _, e := range c.ExitCodes {
+		fmt.Fprintf(&b, "  %d  %-14s %s\n", e.Code, e.Name, e.About)
+	}
+	fmt.Fprintf(&b, "\nComponents (%s profile):\n", c.Profile)
+	for _, comp := range c.Components {
+		state := "included"
+		if !comp.Included {
+			state = "left out"
+		}
+		fmt.Fprintf(&b, "  %-9s %-8s %s (tag %s)\n", comp.Name, state, comp.About, comp.Tag)
+	}
+	b.WriteString("\nDrivers:\n")
+	for i, d := range c.Drivers {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "  %-11s %s", d.Scheme, d.Name)
+	}
+	return b.String(), nil
+}
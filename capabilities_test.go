@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCapabilities tests the commands, data types and drivers plccli
+// capabilities lists
+func TestCapabilities(t *testing.T) {
+	out, err := runCapabilities("json")
+	require.NoError(t, err)
+	var c capabilities
+	require.NoError(t, json.Unmarshal([]byte(out), &c))
+	assert.Equal(t, buildVersion, c.Version)
+	assert.Contains(t, out, `"args": "<node-id> <value> [data-type]"`)
+
+	byName := map[string]capabilityCommand{}
+	for _, cmd := range c.Commands {
+		byName[cmd.Name] = cmd
+	}
+	assert.Len(t, byName, len(commands))
+	assert.Contains(t, byName["opcua get"].Flags, "interval")
+	assert.Contains(t, byName["opcua browse"].Flags, "max-nodes", "flags of the command itself")
+	assert.Equal(t, []string{"format"}, byName["capabilities"].Flags)
+
+	assert.Contains(t, c.DataTypes["opcua"], "localizedtext")
+	assert.Equal(t, "influx", c.OutputFormats[0].Name)
+	assert.Contains(t, c.Drivers, capabilityDriver{Scheme: "opc.tcp", Name: "OPC UA"})
+	assert.Equal(t, buildProfile(), c.Profile)
+	assert.Len(t, c.Components, len(buildComponents))
+
+	// Drivers and their data types of the components in this build
+	if findComponent("modbus").Included {
+		assert.Contains(t, c.DataTypes["modbus"], "float32-swapped")
+		assert.NotContains(t, c.DataTypes["modbus"], "uint16-swapped")
+		assert.Contains(t, c.Drivers, capabilityDriver{Scheme: "modbus", Name: "Modbus TCP"})
+	} else {
+		assert.NotContains(t, c.DataTypes, "modbus")
+		assert.NotContains(t, c.Drivers, capabilityDriver{Scheme: "modbus", Name: "Modbus TCP"})
+	}
+	if findComponent("enip").Included {
+		assert.Contains(t, c.DataTypes["enip"], "STRING")
+		assert.Contains(t, c.Drivers, capabilityDriver{Scheme: "enip", Name: "EtherNet/IP"})
+	} else {
+		assert.NotContains(t, c.Drivers, capabilityDriver{Scheme: "enip", Name: "EtherNet/IP"})
+	}
+	for i, e := range c.ExitCodes {
+		assert.Equal(t, i, e.Code, "exit codes are numbered without gaps")
+	}
+
+	text, err := runCapabilities("influx")
+	require.NoError(t, err)
+	assert.Contains(t, text, "  opcua set <node-id> <value> [data-type]\n      Write a value to a node\n")
+	assert.Contains(t, text, "Components ("+buildProfile()+" profile):\n")
+	assert.Contains(t, text, "  5  write-rejected Write refused")
+}
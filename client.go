@@ -2,112 +2,330 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
-	"net/url"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+
+	"umicli/pkg/plcclient"
 )
 
+// newServiceClient returns a client for the service with the --token of the
+// tenant, under the service's --api-base-path
+func newServiceClient(host string, port int) *plcclient.HTTPClient {
+	client := plcclient.New(host, port).WithToken(*token).WithPermit(*permit).WithOpTimeout(*opTimeout).WithBasePath(*apiBasePath)
+	if apiClientTLS != nil {
+		client = client.WithTLS(apiClientTLS)
+	}
+	return client
+}
+
+// callTimeout returns how long to wait for a service call whose OPC UA
+// operations take up to def, or up to --op-timeout when that is set
+func callTimeout(def time.Duration) time.Duration {
+	if *opTimeout > 0 {
+		return *opTimeout + 5*time.Second
+	}
+	return def
+}
+
 // parseNodeID extracts namespace, type and identifier from an OPC UA node ID
 func parseNodeID(nodeID string) (string, string, string, error) {
-	// Expected formats: ns=X,Y=Z or ns=X;Y=Z
-	var namespace, idType, identifier string
-	
-	// Determine which separator is used (comma or semicolon)
-	var parts []string
-	if strings.Contains(nodeID, ",") {
-		parts = strings.Split(nodeID, ",")
-	} else if strings.Contains(nodeID, ";") {
-		parts = strings.Split(nodeID, ";")
-	} else {
-		return "", "", "", fmt.Errorf("invalid node ID format. Expected format: ns=X,Y=Z or ns=X;Y=Z")
-	}
-	
-	// Extract components
-	if len(parts) == 2 {
-		// Extract namespace
-		nsParts := strings.Split(parts[0], "=")
-		if len(nsParts) == 2 && nsParts[0] == "ns" {
-			namespace = nsParts[1]
-		}
-		
-		// Extract type and identifier
-		idParts := strings.Split(parts[1], "=")
-		if len(idParts) == 2 {
-			idType = idParts[0]
-			identifier = idParts[1]
-		}
-	}
-	
-	if namespace == "" || idType == "" || identifier == "" {
-		return "", "", "", fmt.Errorf("invalid node ID format. Expected format: ns=X,Y=Z or ns=X;Y=Z where Y is 'i' or 's'")
-	}
-	
-	// Validate that idType is either 'i' or 's'
-	if idType != "i" && idType != "s" {
-		return "", "", "", fmt.Errorf("unsupported identifier type '%s'. Only 'i' (numeric) and 's' (string) are supported", idType)
-	}
-	
-	return namespace, idType, identifier, nil
+	return plcclient.ParseNodeID(nodeID)
+}
+
+// influxTag is an extra tag added to every InfluxDB line
+type influxTag struct {
+	Key   string
+	Value string
+}
+
+// influxOptions customizes the InfluxDB line protocol output
+type influxOptions struct {
+	tags      []influxTag    // Extra tags, e.g. site=plant1 (override node_id/endpoint if same key)
+	fieldName string         // Name of the value field (default: value)
+	timestamp string         // Line timestamp: now (default), source or server
+	at        time.Time      // Timestamp of the value being formatted (zero = now)
+	shifts    *shiftCalendar // Optional shift calendar; adds a shift tag
+	batchNode string         // Optional node whose value tags all lines of a read (batch/lot ID)
+	batchTag  string         // Tag key for the batch node value (default: batch)
+}
+
+// forResult returns the options with the line timestamp taken from a read result
+// according to the timestamp mode. Falls back to the current time when the
+// server did not supply the requested timestamp. The symbolic name of an
+// enumeration value is added as state tag, the unit and range of an analog
+// item as unit, eu_low and eu_high tags
+func (o influxOptions) forResult(result NodeResponse) influxOptions {
+	if meta := metadataTags(result); len(meta) > 0 {
+		o.tags = append(meta, o.tags...)
+	}
+	if result.EnumName != "" {
+		o.tags = append([]influxTag{{"state", result.EnumName}}, o.tags...)
+	}
+	o.at = time.Time{}
+	switch o.timestamp {
+	case "source":
+		if result.SourceTimestamp != nil {
+			o.at = *result.SourceTimestamp
+		}
+	case "server":
+		if result.ServerTimestamp != nil {
+			o.at = *result.ServerTimestamp
+		}
+	}
+	return o
+}
+
+// lineTimestamp returns the line protocol timestamp in nanoseconds
+func (o influxOptions) lineTimestamp() int64 {
+	if o.at.IsZero() {
+		return time.Now().UnixNano()
+	}
+	return o.at.UnixNano()
+}
+
+// valueField returns the configured value field name
+func (o influxOptions) valueField() string {
+	if o.fieldName == "" {
+		return "value"
+	}
+	fieldEscaper := strings.NewReplacer(
+		",", "\\,",
+		"=", "\\=",
+		" ", "\\ ",
+	)
+	return fieldEscaper.Replace(o.fieldName)
+}
+
+// stringField returns the field name used for string values
+func (o influxOptions) stringField() string {
+	return "string_" + o.valueField()
+}
+
+// tagSet builds the escaped tag section of a line, starting with a comma:
+// node_id, endpoint and the shift at the line timestamp, followed by the extra tags
+func (o influxOptions) tagSet(nodeID, endpoint string) string {
+	tagEscaper := strings.NewReplacer(
+		",", "\\,",
+		"=", "\\=",
+		" ", "\\ ",
+		"\"", "\\\"",
+	)
+
+	tags := []influxTag{{"node_id", nodeID}, {"endpoint", endpoint}}
+	if o.shifts != nil {
+		if shiftID, _ := o.shifts.at(time.Unix(0, o.lineTimestamp())); shiftID != "" {
+			tags = append(tags, influxTag{"shift", shiftID})
+		}
+	}
+	for _, extra := range o.tags {
+		replaced := false
+		for i := range tags {
+			if tags[i].Key == extra.Key {
+				tags[i].Value = extra.Value
+				replaced = true
+			}
+		}
+		if !replaced {
+			tags = append(tags, extra)
+		}
+	}
+
+	var b strings.Builder
+	for _, tag := range tags {
+		b.WriteString(",")
+		b.WriteString(tagEscaper.Replace(tag.Key))
+		b.WriteString("=")
+		b.WriteString(tagEscaper.Replace(tag.Value))
+	}
+	return b.String()
+}
+
+// withBatchTag returns the options with the current value of the batch node
+// added as a tag, so all lines of one read carry the same batch ID.
+// Empty values (no batch running) add no tag
+func (o influxOptions) withBatchTag(host string, port int) (influxOptions, error) {
+	if o.batchNode == "" {
+		return o, nil
+	}
+
+	results, err := readNodeValues([]string{o.batchNode}, host, port, plcclient.ReadOptions{})
+	if err != nil {
+		return o, fmt.Errorf("failed to read batch node %s: %v", o.batchNode, err)
+	}
+	if results[0].Error != "" {
+		return o, fmt.Errorf("failed to read batch node %s: %s", o.batchNode, results[0].Error)
+	}
+
+	batchID := strings.TrimSpace(fmt.Sprintf("%v", results[0].Value))
+	if batchID == "" {
+		return o, nil
+	}
+
+	key := o.batchTag
+	if key == "" {
+		key = "batch"
+	}
+	o.tags = append(append([]influxTag{}, o.tags...), influxTag{key, batchID})
+	return o, nil
+}
+
+// withTenantLabels returns the options with the labels of the tenant added as
+// tags, before the --influx-tag tags so those can override them
+func (o influxOptions) withTenantLabels(host string, port int) (influxOptions, error) {
+	info, err := getConnectionInfo(host, port)
+	if err != nil {
+		return o, err
+	}
+	labels, _ := info["labels"].(map[string]interface{})
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tags := make([]influxTag, 0, len(keys)+len(o.tags))
+	for _, key := range keys {
+		tags = append(tags, influxTag{key, fmt.Sprintf("%v", labels[key])})
+	}
+	o.tags = append(tags, o.tags...)
+	return o, nil
+}
+
+// influxTagsFlag collects repeatable --influx-tag key=value flags
+type influxTagsFlag []influxTag
+
+func (f *influxTagsFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	parts := make([]string, len(*f))
+	for i, tag := range *f {
+		parts[i] = tag.Key + "=" + tag.Value
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *influxTagsFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" || val == "" {
+		return fmt.Errorf("invalid tag '%s'. Expected format: key=value", value)
+	}
+	*f = append(*f, influxTag{Key: key, Value: val})
+	return nil
 }
 
 // formatInfluxOutput converts a value to InfluxDB Line Protocol format
-func formatInfluxOutput(measurementName, nodeID string, value interface{}, dataType string, endpoint string) string {
-    tagEscaper := strings.NewReplacer(
-        ",", "\\,",
-        "=", "\\=",
-        " ", "\\ ",
-        "\"", "\\\"",
-    )
-
-    // Clean up names for InfluxDB compatibility
-    cleanNodeID := tagEscaper.Replace(nodeID)
-    cleanEndpoint := tagEscaper.Replace(endpoint)
-
-    // Handle different value types - FIXED TO OUTPUT NUMERIC VALUES
-    var valueStr string
-    switch v := value.(type) {
-    case string:
-        // Try to parse timestamp strings to unix time
-        if t, err := time.Parse("2006-01-02T15:04:05.999999Z", v); err == nil {
-            // Convert timestamp to unix nanoseconds (numeric)
-            valueStr = fmt.Sprintf("value=%d", t.UnixNano())
-        } else if t, err := time.Parse("2006-01-02T15:04:05Z", v); err == nil {
-            // Try without microseconds
-            valueStr = fmt.Sprintf("value=%d", t.UnixNano())
-        } else {
-            // For non-timestamp strings, create a constant numeric value and keep string as tag
-            valueStr = fmt.Sprintf("value=1,string_value=\"%s\"", strings.Replace(v, "\"", "\\\"", -1))
-        }
-    case bool:
-        // Convert boolean to numeric (0 or 1)
-        if v {
-            valueStr = "value=1"
-        } else {
-            valueStr = "value=0"
-        }
-    case float64, float32, int, int32, int64, uint, uint32, uint64:
-        valueStr = fmt.Sprintf("value=%v", v)
-    default:
-        // Fallback: convert to string and add numeric constant
-        valueStr = fmt.Sprintf("value=1,string_value=\"%v\"", v)
-    }
-    
-    timestamp := time.Now().UnixNano()
-    return fmt.Sprintf("%s,node_id=%s,endpoint=%s %s %d",
-        measurementName,
-        cleanNodeID,
-        cleanEndpoint,
-        valueStr,
-        timestamp)
+func formatInfluxOutput(measurementName, nodeID string, value interface{}, dataType string, endpoint string, opts influxOptions) string {
+	field := opts.valueField()
+	stringField := opts.stringField()
+
+	// Handle different value types - FIXED TO OUTPUT NUMERIC VALUES
+	var valueStr string
+	switch v := value.(type) {
+	case string:
+		// Try to parse timestamp strings to unix time
+		if t, err := time.Parse("2006-01-02T15:04:05.999999Z", v); err == nil {
+			// Convert timestamp to unix nanoseconds (numeric)
+			valueStr = fmt.Sprintf("%s=%d", field, t.UnixNano())
+		} else if t, err := time.Parse("2006-01-02T15:04:05Z", v); err == nil {
+			// Try without microseconds
+			valueStr = fmt.Sprintf("%s=%d", field, t.UnixNano())
+		} else {
+			// For non-timestamp strings, create a constant numeric value and keep string as tag
+			valueStr = fmt.Sprintf("%s=1,%s=\"%s\"", field, stringField, strings.Replace(v, "\"", "\\\"", -1))
+		}
+	case bool:
+		// Convert boolean to numeric (0 or 1)
+		if v {
+			valueStr = field + "=1"
+		} else {
+			valueStr = field + "=0"
+		}
+	case float64, float32, int, int32, int64, uint, uint32, uint64:
+		valueStr = fmt.Sprintf("%s=%v", field, v)
+	default:
+		// Fallback: convert to string and add numeric constant
+		valueStr = fmt.Sprintf("%s=1,%s=\"%v\"", field, stringField, v)
+	}
+
+	timestamp := opts.lineTimestamp()
+	return fmt.Sprintf("%s%s %s %d",
+		measurementName,
+		opts.tagSet(nodeID, endpoint),
+		valueStr,
+		timestamp)
+}
+
+// formatInfluxLines formats a read value as InfluxDB lines. Decoded structures
+// are flattened to one line per field, tagged with the field path (e.g.
+// field=Motor.Speed or field=Counts[2]); other values give a single line
+func formatInfluxLines(measurementName, nodeID string, value interface{}, endpoint string, opts influxOptions) []string {
+	if !isStructValue(value) {
+		return []string{formatInfluxOutput(measurementName, nodeID, value, "", endpoint, opts)}
+	}
+
+	var lines []string
+	flattenStruct("", value, func(path string, leaf interface{}) {
+		fieldOpts := opts
+		fieldOpts.tags = append([]influxTag{{"field", path}}, opts.tags...)
+		lines = append(lines, formatInfluxOutput(measurementName, nodeID, leaf, "", endpoint, fieldOpts))
+	})
+	return lines
+}
+
+// isStructValue reports whether a value is a decoded structure or array of structures
+func isStructValue(value interface{}) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return true
+	case []interface{}:
+		for _, elem := range v {
+			if _, ok := elem.(map[string]interface{}); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// flattenStruct calls fn for each leaf of a decoded structure, fields in name order
+func flattenStruct(path string, value interface{}, fn func(path string, leaf interface{})) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fieldPath := name
+			if path != "" {
+				fieldPath = path + "." + name
+			}
+			flattenStruct(fieldPath, v[name], fn)
+		}
+	case []interface{}:
+		for i, elem := range v {
+			flattenStruct(fmt.Sprintf("%s[%d]", path, i), elem, fn)
+		}
+	default:
+		fn(path, v)
+	}
 }
 
 // formatInfluxOutputWithBits formats a uint32 value with bit expansion for InfluxDB
 // Returns a slice of InfluxDB line protocol strings, one for each of the 32 bits
-func formatInfluxOutputWithBits(measurementName, nodeID string, value interface{}, endpoint string, bitNames []string) ([]string, error) {
+// (or only for the selected bits), followed by a summary line when requested
+func formatInfluxOutputWithBits(measurementName, nodeID string, value interface{}, endpoint string, opts bitOptions, influxOpts influxOptions) ([]string, error) {
 	tagEscaper := strings.NewReplacer(
 		",", "\\,",
 		"=", "\\=",
@@ -115,121 +333,214 @@ func formatInfluxOutputWithBits(measurementName, nodeID string, value interface{
 		"\"", "\\\"",
 	)
 
-	// Convert value to uint32
-	var uint32Value uint32
-	switch v := value.(type) {
-	case float64:
-		uint32Value = uint32(v)
-	case float32:
-		uint32Value = uint32(v)
-	case int:
-		uint32Value = uint32(v)
-	case int32:
-		uint32Value = uint32(v)
-	case int64:
-		uint32Value = uint32(v)
-	case uint:
-		uint32Value = uint32(v)
-	case uint32:
-		uint32Value = v
-	case uint64:
-		uint32Value = uint32(v)
-	default:
-		return nil, fmt.Errorf("value type %T cannot be converted to uint32 for bit extraction", value)
+	// Convert value to a word of its data type's width (negative values are
+	// two's complement)
+	uint32Value, width, err := opts.word(nodeID, value)
+	if err != nil {
+		return nil, err
 	}
 
-	// Extract all 32 bits
-	bits, err := extractBits(uint32Value, bitNames)
+	// Extract all bits of the word
+	bits, err := extractBits(uint32Value, width, opts.namesFor(nodeID))
 	if err != nil {
 		return nil, err
 	}
+	bits = selectBits(bits, opts.selected)
 
 	// Format each bit as a separate InfluxDB line
-	cleanNodeID := tagEscaper.Replace(nodeID)
-	cleanEndpoint := tagEscaper.Replace(endpoint)
-	timestamp := time.Now().UnixNano()
+	tagSet := influxOpts.tagSet(nodeID, endpoint)
+	field := influxOpts.valueField()
+	timestamp := influxOpts.lineTimestamp()
 
 	lines := make([]string, 0, len(bits))
 	for _, bit := range bits {
 		cleanBitName := tagEscaper.Replace(bit.Name)
-		line := fmt.Sprintf("%s,node_id=%s,endpoint=%s,bit=%d,bit_name=%s value=%d %d",
+		line := fmt.Sprintf("%s%s,bit=%d,bit_name=%s %s=%d %d",
 			measurementName,
-			cleanNodeID,
-			cleanEndpoint,
+			tagSet,
 			bit.BitNum,
 			cleanBitName,
+			field,
 			bit.Value,
 			timestamp)
 		lines = append(lines, line)
 	}
 
+	// Aggregate state of the emitted bits plus the raw word
+	if opts.summary {
+		summary := summarizeBits(uint32Value, bits)
+		line := fmt.Sprintf("%s%s any_alarm=%d,active_count=%d,raw=%du %d",
+			measurementName,
+			tagSet,
+			summary.AnyActive,
+			summary.ActiveCount,
+			summary.Raw,
+			timestamp)
+		lines = append(lines, line)
+	}
+
 	return lines, nil
 }
 
-func setNodeValue(nodeID string, value string, dataType string, host string, port int, format string) (string, error) {
-	namespace, idType, identifier, err := parseNodeID(nodeID)
+// nodeBitWidths returns the bits of the data types of nodes for --bits, see
+// bitOptions.widthFor. Nodes of other types, and all nodes when the service
+// cannot check them, are taken as 32-bit words
+func nodeBitWidths(nodeIDs []string, host string, port int) map[string]int {
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout(10*time.Second))
+	defer cancel()
+
+	checks, err := newServiceClient(host, port).Validate(ctx, nodeIDs...)
 	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: data types unknown, bits are taken from 32-bit words: %v\n", err)
+		return nil
+	}
+	widths := make(map[string]int)
+	for _, check := range checks {
+		if width := dataTypeBits(check.DataType); width > 0 {
+			widths[check.NodeID] = width
+		}
+	}
+	return widths
+}
+
+// formatInfluxBitEdges formats bit transitions as InfluxDB line protocol
+// Falling edges carry the duration the bit was high in milliseconds
+func formatInfluxBitEdges(measurementName, nodeID, endpoint string, edges []BitEdge, timestamp int64, influxOpts influxOptions) []string {
+	tagEscaper := strings.NewReplacer(
+		",", "\\,",
+		"=", "\\=",
+		" ", "\\ ",
+		"\"", "\\\"",
+	)
+
+	tagSet := influxOpts.tagSet(nodeID, endpoint)
+	field := influxOpts.valueField()
+
+	lines := make([]string, 0, len(edges))
+	for _, edge := range edges {
+		var fields string
+		edgeType := "rising"
+		if edge.Rising {
+			fields = field + "=1"
+		} else {
+			edgeType = "falling"
+			fields = fmt.Sprintf("%s=0,high_duration_ms=%d", field, edge.HighDuration.Milliseconds())
+		}
+
+		lines = append(lines, fmt.Sprintf("%s%s,bit=%d,bit_name=%s,edge=%s %s %d",
+			measurementName,
+			tagSet,
+			edge.BitNum,
+			tagEscaper.Replace(edge.Name),
+			edgeType,
+			fields,
+			timestamp))
+	}
+	return lines
+}
+
+// writeCheck guards a set: --dry-run only shows the write, --confirm asks
+// before it
+type writeCheck struct {
+	dryRun  bool
+	confirm bool
+	in      io.Reader // Answer to the --confirm prompt
+	out     io.Writer // Where the --confirm prompt goes
+}
+
+// previewWrite has the service convert the value of a write without writing
+// it and reads the current value, so the preview shows exactly what changes.
+// current is "" for other attributes than Value or when the read failed
+func previewWrite(client *plcclient.HTTPClient, req plcclient.WriteRequest) (preview NodeResponse, current string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout(10*time.Second))
+	defer cancel()
+
+	req.DryRun = true
+	if preview, err = client.Write(ctx, req); err != nil {
+		return preview, "", err
+	}
+
+	if req.Attribute == "" || strings.EqualFold(req.Attribute, "Value") {
+		results, err := client.ReadWith(ctx, plcclient.ReadOptions{Fresh: true}, req.NodeID)
+		if err == nil && results[0].Error == "" {
+			current = fmt.Sprintf("%v", results[0].Value)
+		}
+	}
+	return preview, current, nil
+}
+
+// confirmWrite asks whether to go ahead with a write, anything but y or yes
+// is a no
+func confirmWrite(in io.Reader, out io.Writer, prompt string) bool {
+	fmt.Fprintf(out, "%s? [y/N] ", prompt)
+	var answer string
+	fmt.Fscanln(in, &answer)
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func setNodeValue(nodeID string, value string, dataType string, attribute string, priority string, host string, port int, format string, influxOpts influxOptions, check writeCheck) (string, error) {
+	if _, _, _, err := parseNodeID(nodeID); err != nil {
 		return "", err
 	}
-	
-	// Data type is REQUIRED
+
+	// Text attributes (DisplayName, Description) imply their data type
 	if dataType == "" {
-		return "", fmt.Errorf("data type is required for writing values. Use one of: boolean, sbyte, byte, int16, uint16, int32, uint32, int64, uint64, float, double, string")
-	}
-	
-	// Prepare the request body
-	requestBody := map[string]interface{}{
-		"namespace":  namespace,
-		"type":       idType,
-		"identifier": identifier,
-		"value":      value,
-		"dataType":   dataType,
-	}
-	
-	// Convert request to JSON
-	jsonData, err := json.Marshal(requestBody)
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %v", err)
-	}
-	
-	// Build the request URL with host and port
-	reqURL := fmt.Sprintf("http://%s:%d/api/node", host, port)
-	
-	// Create a client with timeout
-	client := &http.Client{
-		Timeout: 10 * time.Second,
+		dataType = defaultAttributeDataType(attribute)
 	}
-	
-	// Make the POST request
-	resp, err := client.Post(reqURL, "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		// Enhanced error message with connection details
-		return "", fmt.Errorf("cannot connect to OPCUA service on %s:%d: %v (is it running?)", host, port, err)
+
+	// Data type is REQUIRED
+	if dataType == "" {
+		return "", fmt.Errorf("data type is required for writing values. Use one of: boolean, sbyte, byte, int16, uint16, int32, uint32, int64, uint64, float, double, string, or --auto-type")
 	}
-	defer resp.Body.Close()
-	
-	// Read response body
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("error reading response: %v", err)
+
+	// Structures are JSON documents, sent as one line so they also fit InfluxDB output
+	if strings.EqualFold(dataType, "struct") {
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, []byte(value)); err != nil {
+			return "", fmt.Errorf("invalid JSON structure value: %v", err)
+		}
+		value = compact.String()
 	}
-	
-	// Check HTTP status
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("service error: %s", body)
+
+	client := newServiceClient(host, port)
+	req := plcclient.WriteRequest{
+		NodeID:    nodeID,
+		Value:     value,
+		DataType:  dataType,
+		Attribute: attribute,
+		Priority:  priority,
 	}
-	
-	// Parse the JSON response
-	var nodeResp NodeResponse
-	if err := json.Unmarshal(body, &nodeResp); err != nil {
-		return "", fmt.Errorf("error parsing response: %v", err)
+
+	if check.dryRun || check.confirm {
+		preview, current, err := previewWrite(client, req)
+		if err != nil {
+			return "", err
+		}
+		target := nodeID
+		if attribute != "" && !strings.EqualFold(attribute, "Value") {
+			target = attribute + " of " + nodeID
+		}
+		change := fmt.Sprintf("%s to %v with type %s", target, preview.Value, preview.DataType)
+		if current != "" {
+			change = fmt.Sprintf("%s from %s to %v with type %s", target, current, preview.Value, preview.DataType)
+		}
+		if check.dryRun {
+			return fmt.Sprintf("Dry run: would set %s (via %s:%d)", change, host, port), nil
+		}
+		if !confirmWrite(check.in, check.out, "Set "+change) {
+			return "", fmt.Errorf("write cancelled, %s was not changed", target)
+		}
 	}
-	
-	// Check for errors in the response
-	if nodeResp.Error != "" {
-		return "", fmt.Errorf("service reported error: %s", nodeResp.Error)
+
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout(10*time.Second))
+	defer cancel()
+
+	nodeResp, err := client.Write(ctx, req)
+	if err != nil {
+		return "", err
 	}
-	
+
 	// Get endpoint for the connection
 	info, err := getConnectionInfo(host, port)
 	if err != nil {
@@ -237,32 +548,64 @@ func setNodeValue(nodeID string, value string, dataType string, host string, por
 		info = map[string]interface{}{"endpoint": "unknown"}
 	}
 	endpoint, _ := info["endpoint"].(string)
-	
+
 	if format == "influx" {
-		return formatInfluxOutput("opcua_set", nodeID, value, dataType, endpoint), nil
+		return formatInfluxOutput("opcua_set", nodeID, value, dataType, endpoint, influxOpts), nil
 	}
 
 	// Original format
+	if attribute != "" && !strings.EqualFold(attribute, "Value") {
+		return fmt.Sprintf("Successfully set %s of %s to %v with type %s (via %s:%d)", attribute, nodeID, nodeResp.Value, dataType, host, port), nil
+	}
 	return fmt.Sprintf("Successfully set %s to %v with type %s (via %s:%d)", nodeID, nodeResp.Value, dataType, host, port), nil
 }
 
-func getNodeValues(nodeIDs []string, host string, port int, format string, measurement string, extractBits bool, bitNamesStr string) (string, error) {
+// setNodeBit sets or clears a single bit of an integer word node
+func setNodeBit(nodeID string, bit int, on bool, host string, port int, format string, influxOpts influxOptions) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout(10*time.Second))
+	defer cancel()
+
+	nodeResp, err := newServiceClient(host, port).SetBit(ctx, nodeID, bit, on)
+	if err != nil {
+		return "", err
+	}
+
+	value := 0
+	if on {
+		value = 1
+	}
+
+	// Words come back as JSON numbers; print them without exponent
+	word := fmt.Sprintf("%v", nodeResp.Value)
+	if f, ok := nodeResp.Value.(float64); ok {
+		word = strconv.FormatFloat(f, 'f', -1, 64)
+	}
+
+	if format == "influx" {
+		endpoint := "unknown"
+		if info, err := getConnectionInfo(host, port); err == nil {
+			endpoint, _ = info["endpoint"].(string)
+		}
+		influxOpts.tags = append(append([]influxTag{}, influxOpts.tags...), influxTag{"bit", strconv.Itoa(bit)})
+		return fmt.Sprintf("opcua_set%s %s=%di,word=%si %d",
+			influxOpts.tagSet(nodeID, endpoint),
+			influxOpts.valueField(),
+			value,
+			word,
+			influxOpts.lineTimestamp()), nil
+	}
+
+	return fmt.Sprintf("Successfully set bit %d of %s to %d, word is now %s (via %s:%d)", bit, nodeID, value, word, host, port), nil
+}
+
+func getNodeValues(nodeIDs []string, host string, port int, format string, measurement string, readOpts plcclient.ReadOptions, bitOpts bitOptions, influxOpts influxOptions, counterOpts counterOptions, transforms valueTransforms) (string, error) {
 	if len(nodeIDs) == 0 {
 		return "", fmt.Errorf("no node IDs provided")
 	}
 
-	// Parse bit names if provided
-	var bitNames []string
-	if bitNamesStr != "" {
-		bitNames = strings.Split(bitNamesStr, ",")
-		// Trim whitespace from each name
-		for i := range bitNames {
-			bitNames[i] = strings.TrimSpace(bitNames[i])
-		}
-		// Validate bit names
-		if err := validateBitNames(bitNames); err != nil {
-			return "", err
-		}
+	// Validate bit names if provided
+	if err := validateBitNames(bitOpts.names); err != nil {
+		return "", err
 	}
 
 	// Get endpoint for the connection
@@ -272,206 +615,361 @@ func getNodeValues(nodeIDs []string, host string, port int, format string, measu
 		info = map[string]interface{}{"endpoint": "unknown"}
 	}
 	endpoint, _ := info["endpoint"].(string)
+	influxOpts = influxOpts.withMaintenance(info)
 
-	// If there's only one node ID, use the existing method
-	if len(nodeIDs) == 1 {
-		return getNodeValue(nodeIDs[0], host, port, format, endpoint, measurement, extractBits, bitNames)
-	}
-	
-	// For multiple nodes, build a batch request
-	var requestParams []map[string]string
-	
-	for _, nodeID := range nodeIDs {
-		namespace, idType, identifier, err := parseNodeID(nodeID)
-		if err != nil {
-			return "", err
+	// Tag the lines with the running batch; a failed batch read keeps the data untagged
+	if format == "influx" {
+		if influxOpts, err = influxOpts.withBatchTag(host, port); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
 		}
-		
-		requestParams = append(requestParams, map[string]string{
-			"namespace":  namespace,
-			"type":       idType,
-			"identifier": identifier,
-		})
-	}
-	
-	// Convert request to JSON
-	jsonData, err := json.Marshal(map[string]interface{}{
-		"nodes": requestParams,
-	})
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %v", err)
 	}
-	
-	// Build the request URL with host and port
-	reqURL := fmt.Sprintf("http://%s:%d/api/nodes", host, port)
-	
-	// Create a client with timeout
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-	}
-	
-	// Make the POST request
-	resp, err := client.Post(reqURL, "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		// Enhanced error message with connection details
-		return "", fmt.Errorf("cannot connect to OPCUA service on %s:%d: %v (is it running?)", host, port, err)
+
+	// If there's only one node ID, use the existing method
+	if len(nodeIDs) == 1 {
+		return getNodeValue(nodeIDs[0], host, port, format, endpoint, measurement, readOpts, bitOpts, influxOpts, counterOpts, transforms)
 	}
-	defer resp.Body.Close()
-	
-	// Read response body
-	body, err := io.ReadAll(resp.Body)
+
+	// For multiple nodes, use a batch request
+	results, err := readNodeValues(nodeIDs, host, port, readOpts)
 	if err != nil {
-		return "", fmt.Errorf("error reading response: %v", err)
-	}
-	
-	// Check HTTP status
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("service error: %s", body)
-	}
-	
-	// Parse the JSON response
-	var batchResp struct {
-		Results []NodeResponse `json:"results"`
-		Error   string         `json:"error,omitempty"`
-	}
-	
-	if err := json.Unmarshal(body, &batchResp); err != nil {
-		return "", fmt.Errorf("error parsing response: %v", err)
+		return "", err
 	}
-	
-	// Check for errors in the response
-	if batchResp.Error != "" {
-		return "", fmt.Errorf("service reported error: %s", batchResp.Error)
+
+	// Turn counter readings into deltas or totals
+	for i := range results {
+		if results[i].Error != "" {
+			continue
+		}
+		results[i].Value, err = counterOpts.apply(nodeIDs[i], results[i].Value)
+		if err != nil {
+			return "", fmt.Errorf("counter transform failed for %s: %v", nodeIDs[i], err)
+		}
+		// Scale the value with its --transform expression
+		results[i].Value, err = transforms.apply(nodeIDs[i], results[i].Value)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", nodeIDs[i], err)
+		}
 	}
-	
+
 	// Format the output based on the desired format
 	if format == "influx" {
 		var lines []string
-		for i, result := range batchResp.Results {
+		for i, result := range results {
 			if result.Error != "" {
 				continue // Skip nodes with errors
 			}
 
 			// Check if bit expansion is requested
-			if extractBits {
-				bitLines, err := formatInfluxOutputWithBits(measurement, nodeIDs[i], result.Value, endpoint, bitNames)
+			if bitOpts.enabled {
+				bitLines, err := formatInfluxOutputWithBits(measurement, nodeIDs[i], result.Value, endpoint, bitOpts, influxOpts.forResult(result))
 				if err != nil {
 					return "", fmt.Errorf("bit expansion failed for %s: %v", nodeIDs[i], err)
 				}
 				lines = append(lines, bitLines...)
 			} else {
-				lines = append(lines, formatInfluxOutput(measurement, nodeIDs[i], result.Value, "", endpoint))
+				lines = append(lines, formatInfluxLines(measurement, nodeIDs[i], result.Value, endpoint, influxOpts.forResult(result))...)
 			}
 		}
 		return strings.Join(lines, "\n"), nil
 	}
-	
-	// Default format - just return the values
-	var values []string
-	for _, result := range batchResp.Results {
+
+	return formatDefaultResults(nodeIDs, results), nil
+}
+
+// duplicateNode is a node ID given more than once to get
+type duplicateNode struct {
+	nodeID string
+	count  int
+}
+
+// duplicateNodeIDs returns the node IDs that appear more than once, in order
+// of their first occurrence. Spellings of the same node count as one node
+func duplicateNodeIDs(nodeIDs []string) []duplicateNode {
+	counts := make(map[string]int)
+	first := make(map[string]string)
+	var order []string
+	for _, nodeID := range nodeIDs {
+		key := nodeID
+		if namespace, idType, identifier, err := parseNodeID(nodeID); err == nil {
+			key = namespace + ";" + idType + "=" + identifier
+		}
+		if counts[key] == 0 {
+			first[key] = nodeID
+			order = append(order, key)
+		}
+		counts[key]++
+	}
+	var duplicates []duplicateNode
+	for _, key := range order {
+		if counts[key] > 1 {
+			duplicates = append(duplicates, duplicateNode{nodeID: first[key], count: counts[key]})
+		}
+	}
+	return duplicates
+}
+
+// formatDefaultResults prints the results of a batch read in the default
+// format: one line per requested node, in request order, with the node ID as
+// given and its value or error separated by a tab
+func formatDefaultResults(nodeIDs []string, results []NodeResponse) string {
+	lines := make([]string, len(results))
+	for i, result := range results {
+		value := formatDefaultValue(result)
 		if result.Error != "" {
-			values = append(values, fmt.Sprintf("Error: %s", result.Error))
-		} else {
-			values = append(values, fmt.Sprintf("%v", result.Value))
+			value = fmt.Sprintf("Error: %s", result.Error)
 		}
+		lines[i] = nodeIDs[i] + "\t" + value
 	}
-	return strings.Join(values, "\n"), nil
+	return strings.Join(lines, "\n")
 }
 
-func getNodeValue(nodeID string, host string, port int, format string, endpoint string, measurement string, extractBits bool, bitNames []string) (string, error) {
-	namespace, idType, identifier, err := parseNodeID(nodeID)
-	if err != nil {
-		return "", err
+// formatDefaultValue formats a read result for the default output format
+// Enumeration values are followed by their symbolic name, e.g. "3 (Running)",
+// values of analog items by their unit, e.g. "21.5 °C", and decoded
+// structures are printed as JSON
+func formatDefaultValue(result NodeResponse) string {
+	if result.EnumName != "" {
+		return fmt.Sprintf("%v (%s)", result.Value, result.EnumName)
+	}
+	if isStructValue(result.Value) {
+		if data, err := json.Marshal(result.Value); err == nil {
+			return string(data)
+		}
 	}
-	
-	// Build the request URL with host, port and parameters
-	reqURL := fmt.Sprintf("http://%s:%d/api/node?namespace=%s&type=%s&identifier=%s", 
-		host, port, url.QueryEscape(namespace), url.QueryEscape(idType), url.QueryEscape(identifier))
-	
-	// Create a client with timeout
-	client := &http.Client{
-		Timeout: 10 * time.Second,
+	if result.Unit != "" {
+		return fmt.Sprintf("%v %s", result.Value, result.Unit)
 	}
-	
-	// Make the request
-	resp, err := client.Get(reqURL)
-	if err != nil {
-		// Enhanced error message with connection details
-		return "", fmt.Errorf("cannot connect to OPCUA service on %s:%d: %v (is it running?)", host, port, err)
+	return fmt.Sprintf("%v", result.Value)
+}
+
+// pollNodeValues reads the nodes every interval until interrupted and prints
+// the output of each read. With bit edge detection only bit transitions are
+// printed. Read errors are reported on stderr and polling continues
+func pollNodeValues(nodeIDs []string, host string, port int, format string, measurement string, readOpts plcclient.ReadOptions, bitOpts bitOptions, influxOpts influxOptions, counterOpts counterOptions, transforms valueTransforms, interval time.Duration) error {
+	if !bitOpts.edges {
+		for {
+			value, err := getNodeValues(nodeIDs, host, port, format, measurement, readOpts, bitOpts, influxOpts, counterOpts, transforms)
+			if err == nil {
+				err = counterOpts.save()
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			} else {
+				fmt.Println(value)
+			}
+			time.Sleep(interval)
+		}
 	}
-	defer resp.Body.Close()
-	
-	// Read response body
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("error reading response: %v", err)
+
+	if err := validateBitNames(bitOpts.names); err != nil {
+		return err
 	}
-	
-	// Check HTTP status
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("service error: %s", body)
+
+	endpoint := "unknown"
+	if info, err := getConnectionInfo(host, port); err == nil {
+		endpoint, _ = info["endpoint"].(string)
 	}
-	
-	// Parse the JSON response
-	var nodeResp NodeResponse
-	if err := json.Unmarshal(body, &nodeResp); err != nil {
-		return "", fmt.Errorf("error parsing response: %v", err)
+
+	tracker := newBitEdgeTracker()
+	for {
+		tickOpts, err := influxOpts.withBatchTag(host, port)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+		if info, err := getConnectionInfo(host, port); err == nil {
+			tickOpts = tickOpts.withMaintenance(info)
+		}
+		results, err := readNodeValues(nodeIDs, host, port, readOpts)
+		now := time.Now()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+
+		var lines []string
+		for i, result := range results {
+			if result.Error != "" {
+				continue // Skip nodes with errors, keep their previous state
+			}
+			word, width, err := bitOpts.word(nodeIDs[i], result.Value)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: bit expansion failed for %s: %v\n", nodeIDs[i], err)
+				continue
+			}
+			bits, _ := extractBits(word, width, bitOpts.namesFor(nodeIDs[i]))
+			edges := tracker.update(nodeIDs[i], selectBits(bits, bitOpts.selected), now)
+			lines = append(lines, formatInfluxBitEdges(measurement, nodeIDs[i], endpoint, edges, now.UnixNano(), tickOpts)...)
+		}
+		if len(lines) > 0 {
+			fmt.Println(strings.Join(lines, "\n"))
+		}
+
+		time.Sleep(interval)
 	}
-	
+}
+
+// readNodeValues reads several nodes with a single batch request to the service
+// Per-node failures are reported in the Error field of each result
+func readNodeValues(nodeIDs []string, host string, port int, readOpts plcclient.ReadOptions) ([]NodeResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout(10*time.Second))
+	defer cancel()
+
+	return newServiceClient(host, port).ReadWith(ctx, readOpts, nodeIDs...)
+}
+
+func getNodeValue(nodeID string, host string, port int, format string, endpoint string, measurement string, readOpts plcclient.ReadOptions, bitOpts bitOptions, influxOpts influxOptions, counterOpts counterOptions, transforms valueTransforms) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout(10*time.Second))
+	defer cancel()
+
+	results, err := newServiceClient(host, port).ReadWith(ctx, readOpts, nodeID)
+	if err != nil {
+		return "", err
+	}
+	nodeResp := results[0]
+
 	// Check for errors in the response
-	if nodeResp.Error != "" {
-		return "", fmt.Errorf("service reported error: %s", nodeResp.Error)
+	if err := nodeResp.Err(); err != nil {
+		return "", err
 	}
-	
+
+	// Turn counter readings into deltas or totals
+	nodeResp.Value, err = counterOpts.apply(nodeID, nodeResp.Value)
+	if err != nil {
+		return "", fmt.Errorf("counter transform failed: %v", err)
+	}
+
+	// Scale the value with its --transform expression
+	nodeResp.Value, err = transforms.apply(nodeID, nodeResp.Value)
+	if err != nil {
+		return "", err
+	}
+
 	if format == "influx" {
 		// Check if bit expansion is requested
-		if extractBits {
-			bitLines, err := formatInfluxOutputWithBits(measurement, nodeID, nodeResp.Value, endpoint, bitNames)
+		if bitOpts.enabled {
+			bitLines, err := formatInfluxOutputWithBits(measurement, nodeID, nodeResp.Value, endpoint, bitOpts, influxOpts.forResult(nodeResp))
 			if err != nil {
 				return "", fmt.Errorf("bit expansion failed: %v", err)
 			}
 			return strings.Join(bitLines, "\n"), nil
 		}
-		return formatInfluxOutput(measurement, nodeID, nodeResp.Value, "", endpoint), nil
+		return strings.Join(formatInfluxLines(measurement, nodeID, nodeResp.Value, endpoint, influxOpts.forResult(nodeResp)), "\n"), nil
 	}
 
 	// Original format
-	return fmt.Sprintf("%v", nodeResp.Value), nil
+	return formatDefaultValue(nodeResp), nil
 }
 
-// Add this function to get information about a connection
-func getConnectionInfo(host string, port int) (map[string]interface{}, error) {
-	// Create a client with timeout
+// getStateDurations fetches the state duration accumulators of the service
+func getStateDurations(host string, port int, format string, influxOpts influxOptions) (string, error) {
 	client := &http.Client{
-		Timeout: 2 * time.Second,
-	}
-	
-	// Build the request URL with host and port
-	reqURL := fmt.Sprintf("http://%s:%d/api/info", host, port)
-	
-	// Make the request
-	resp, err := client.Get(reqURL)
+		Timeout: 10 * time.Second,
+	}
+	scheme := "http"
+	if apiClientTLS != nil {
+		client.Transport = &http.Transport{TLSClientConfig: apiClientTLS}
+		scheme = "https"
+	}
+
+	reqURL := fmt.Sprintf("%s://%s:%d%s/api/states", scheme, host, port, *apiBasePath)
+	req, err := http.NewRequest(http.MethodGet, reqURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %v", err)
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+	resp, err := client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("cannot connect to OPCUA service on %s:%d: %v", host, port, err)
+		return "", &plcclient.ConnectionError{Host: host, Port: port, Err: err}
 	}
 	defer resp.Body.Close()
-	
-	// Read response body
+
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("error reading response: %v", err)
+		return "", fmt.Errorf("error reading response: %v", err)
 	}
-	
-	// Check HTTP status
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("service error: %s", body)
+		return "", &plcclient.ServiceError{Message: string(body), HTTPStatus: resp.StatusCode}
+	}
+
+	var statesResp struct {
+		States []StateDurations `json:"states"`
+	}
+	if err := json.Unmarshal(body, &statesResp); err != nil {
+		return "", fmt.Errorf("error parsing response: %v", err)
+	}
+	if len(statesResp.States) == 0 {
+		return "", fmt.Errorf("no state nodes are tracked. Start the service with --track-state <node-id>")
+	}
+
+	endpoint := "unknown"
+	if info, err := getConnectionInfo(host, port); err == nil {
+		endpoint, _ = info["endpoint"].(string)
+	}
+
+	return formatStateDurations(statesResp.States, format, endpoint, influxOpts), nil
+}
+
+// formatStateDurations formats state duration accumulators, one line per node and state
+// In InfluxDB format, duration_s is the total time spent in the state and
+// active is 1 for the node's current state
+func formatStateDurations(states []StateDurations, format string, endpoint string, influxOpts influxOptions) string {
+	tagEscaper := strings.NewReplacer(
+		",", "\\,",
+		"=", "\\=",
+		" ", "\\ ",
+		"\"", "\\\"",
+	)
+	timestamp := influxOpts.lineTimestamp()
+
+	var lines []string
+	for _, node := range states {
+		nodeOpts := influxOpts
+		if node.Shift != "" {
+			// Durations restart with the service's shift calendar, tag them with its shift
+			nodeOpts.shifts = nil
+			nodeOpts.tags = append([]influxTag{{"shift", node.Shift}}, influxOpts.tags...)
+		}
+		for _, state := range sortedStates(node.Durations) {
+			active := 0
+			if state == node.Current {
+				active = 1
+			}
+			if format == "influx" {
+				lines = append(lines, fmt.Sprintf("opcua_state%s,state=%s duration_s=%.3f,active=%d %d",
+					nodeOpts.tagSet(node.NodeID, endpoint),
+					tagEscaper.Replace(state),
+					node.Durations[state],
+					active,
+					timestamp))
+			} else {
+				marker := ""
+				if active == 1 {
+					marker = " (current)"
+				}
+				lines = append(lines, fmt.Sprintf("%s state=%s %s%s",
+					node.NodeID, state, time.Duration(node.Durations[state]*float64(time.Second)).Round(time.Second), marker))
+			}
+		}
 	}
-	
-	// Parse the JSON response
-	var info map[string]interface{}
-	if err := json.Unmarshal(body, &info); err != nil {
-		return nil, fmt.Errorf("error parsing response: %v", err)
+	return strings.Join(lines, "\n")
+}
+
+// cancelServiceOperation cancels a queued write or running browse in the service
+func cancelServiceOperation(opID string, host string, port int) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := newServiceClient(host, port).Cancel(ctx, opID); err != nil {
+		return "", err
 	}
-	
-	return info, nil
-}
\ No newline at end of file
+	return fmt.Sprintf("Cancelled operation %s (via %s:%d)", opID, host, port), nil
+}
+
+// Add this function to get information about a connection
+func getConnectionInfo(host string, port int) (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	return newServiceClient(host, port).Info(ctx)
+}
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -57,6 +63,19 @@ func TestParseNodeID(t *testing.T) {
 			wantIdentifier: `"Root"."Objects"."Temperature"`,
 			wantErr:        false,
 		},
+		{
+			name:           "namespace URI",
+			nodeID:         "nsu=http://siemens.com/simatic;s=DB1.Var",
+			wantNamespace:  "http://siemens.com/simatic",
+			wantType:       "s",
+			wantIdentifier: "DB1.Var",
+			wantErr:        false,
+		},
+		{
+			name:    "namespace URI without identifier",
+			nodeID:  "nsu=http://siemens.com/simatic",
+			wantErr: true,
+		},
 		{
 			name:    "invalid format - no separator",
 			nodeID:  "invalid",
@@ -105,7 +124,7 @@ func TestFormatInfluxOutput(t *testing.T) {
 			wantContain: []string{
 				"opcua_node",
 				"node_id=ns\\=3;s\\=BoolValue", // semicolon is not escaped in tag values
-				"value=1", // boolean true should be 1
+				"value=1",                      // boolean true should be 1
 				"endpoint=opc.tcp://192.168.1.100:4840",
 			},
 		},
@@ -162,7 +181,7 @@ func TestFormatInfluxOutput(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			output := formatInfluxOutput(tt.measurement, tt.nodeID, tt.value, tt.dataType, tt.endpoint)
+			output := formatInfluxOutput(tt.measurement, tt.nodeID, tt.value, tt.dataType, tt.endpoint, influxOptions{})
 
 			// Check that all expected strings are present
 			for _, want := range tt.wantContain {
@@ -185,7 +204,7 @@ func TestFormatInfluxOutputWithBits_ProductionValue(t *testing.T) {
 	nodeID := `ns=5;s="Root"."Objects"."event_rack"`
 	endpoint := "opc.tcp://172.18.11.10:4840"
 
-	lines, err := formatInfluxOutputWithBits(measurement, nodeID, value, endpoint, nil)
+	lines, err := formatInfluxOutputWithBits(measurement, nodeID, value, endpoint, bitOptions{}, influxOptions{})
 	require.NoError(t, err, "should not error with valid uint32 value")
 	require.Len(t, lines, 32, "should return exactly 32 lines (one per bit)")
 
@@ -243,7 +262,7 @@ func TestFormatInfluxOutputWithBits_CustomBitNames(t *testing.T) {
 		"interlock", "maintenance", "reserved_30", "reserved_31",
 	}
 
-	lines, err := formatInfluxOutputWithBits(measurement, nodeID, value, endpoint, bitNames)
+	lines, err := formatInfluxOutputWithBits(measurement, nodeID, value, endpoint, bitOptions{names: bitNames}, influxOptions{})
 	require.NoError(t, err)
 	require.Len(t, lines, 32)
 
@@ -288,7 +307,7 @@ func TestFormatInfluxOutputWithBits_TypeConversions(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			lines, err := formatInfluxOutputWithBits(measurement, nodeID, tt.value, endpoint, nil)
+			lines, err := formatInfluxOutputWithBits(measurement, nodeID, tt.value, endpoint, bitOptions{}, influxOptions{})
 			require.NoError(t, err, "type %T should be convertible to uint32", tt.value)
 			require.Len(t, lines, 32)
 
@@ -317,7 +336,7 @@ func TestFormatInfluxOutputWithBits_InvalidTypes(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			lines, err := formatInfluxOutputWithBits(measurement, nodeID, tt.value, endpoint, nil)
+			lines, err := formatInfluxOutputWithBits(measurement, nodeID, tt.value, endpoint, bitOptions{}, influxOptions{})
 			assert.Error(t, err, "should error for non-numeric type %T", tt.value)
 			assert.Nil(t, lines, "should return nil lines on error")
 			assert.Contains(t, err.Error(), "cannot be converted to uint32", "error should mention conversion failure")
@@ -344,7 +363,7 @@ func TestFormatInfluxOutputWithBits_TagEscaping(t *testing.T) {
 		"bit24", "bit25", "bit26", "bit27", "bit28", "bit29", "bit30", "bit31",
 	}
 
-	lines, err := formatInfluxOutputWithBits(measurement, nodeID, value, endpoint, bitNames)
+	lines, err := formatInfluxOutputWithBits(measurement, nodeID, value, endpoint, bitOptions{names: bitNames}, influxOptions{})
 	require.NoError(t, err)
 	require.Len(t, lines, 32)
 
@@ -374,10 +393,204 @@ func TestFormatInfluxOutputWithBits_WrongNumberOfNames(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			lines, err := formatInfluxOutputWithBits(measurement, nodeID, value, endpoint, tt.bitNames)
+			lines, err := formatInfluxOutputWithBits(measurement, nodeID, value, endpoint, bitOptions{names: tt.bitNames}, influxOptions{})
 			assert.Error(t, err, "should error with %d bit names", len(tt.bitNames))
 			assert.Nil(t, lines)
 			assert.Contains(t, err.Error(), "must be exactly 32")
 		})
 	}
 }
+
+// TestFormatInfluxOutputWithBits_Selection tests that only selected bits are emitted
+func TestFormatInfluxOutputWithBits_Selection(t *testing.T) {
+	value := uint32(134217856) // bits 7 and 27 set
+
+	lines, err := formatInfluxOutputWithBits("event_rack", "ns=5;s=alarms", value, "opc.tcp://localhost:4840", bitOptions{selected: []int{3, 7, 27}}, influxOptions{})
+	require.NoError(t, err)
+	require.Len(t, lines, 3)
+
+	assert.Contains(t, lines[0], "bit=3,bit_name=bit_3 value=0 ")
+	assert.Contains(t, lines[1], "bit=7,bit_name=bit_7 value=1 ")
+	assert.Contains(t, lines[2], "bit=27,bit_name=bit_27 value=1 ")
+}
+
+// TestFormatInfluxOutputWithBits_Summary tests the summary line after the bit lines
+func TestFormatInfluxOutputWithBits_Summary(t *testing.T) {
+	value := uint32(134217856) // bits 7 and 27 set
+
+	lines, err := formatInfluxOutputWithBits("event_rack", "ns=5;s=alarms", value, "opc.tcp://localhost:4840", bitOptions{summary: true}, influxOptions{})
+	require.NoError(t, err)
+	require.Len(t, lines, 33, "32 bit lines plus one summary line")
+
+	summary := lines[32]
+	assert.True(t, strings.HasPrefix(summary, "event_rack,node_id=ns\\=5;s\\=alarms,endpoint=opc.tcp://localhost:4840 "))
+	assert.NotContains(t, summary, "bit=")
+	assert.Contains(t, summary, " any_alarm=1,active_count=2,raw=134217856u ")
+
+	// Timestamp matches the bit lines
+	assert.Equal(t, lines[0][strings.LastIndex(lines[0], " "):], summary[strings.LastIndex(summary, " "):])
+}
+
+// TestFormatInfluxBitEdges tests line protocol output for bit transitions
+func TestFormatInfluxBitEdges(t *testing.T) {
+	edges := []BitEdge{
+		{BitValue: BitValue{BitNum: 7, Value: 1, Name: "drive fault"}, Rising: true},
+		{BitValue: BitValue{BitNum: 27, Value: 0, Name: "light_curtain"}, HighDuration: 1500 * time.Millisecond},
+	}
+
+	lines := formatInfluxBitEdges("event_rack", "ns=5;s=alarms", "opc.tcp://localhost:4840", edges, 1761836282581869000, influxOptions{})
+	require.Len(t, lines, 2)
+	assert.Equal(t, `event_rack,node_id=ns\=5;s\=alarms,endpoint=opc.tcp://localhost:4840,bit=7,bit_name=drive\ fault,edge=rising value=1 1761836282581869000`, lines[0])
+	assert.Equal(t, `event_rack,node_id=ns\=5;s\=alarms,endpoint=opc.tcp://localhost:4840,bit=27,bit_name=light_curtain,edge=falling value=0,high_duration_ms=1500 1761836282581869000`, lines[1])
+}
+
+// TestFormatInfluxOutput_CustomTagsAndField tests extra tags and custom field names
+func TestFormatInfluxOutput_CustomTagsAndField(t *testing.T) {
+	opts := influxOptions{
+		tags:      []influxTag{{"site", "plant 1"}, {"line", "L2"}, {"endpoint", "press-3"}},
+		fieldName: "temperature",
+	}
+
+	output := formatInfluxOutput("machine", "ns=3;s=Temp", 42.5, "", "opc.tcp://localhost:4840", opts)
+	assert.Regexp(t, `^machine,node_id=ns\\=3;s\\=Temp,endpoint=press-3,site=plant\\ 1,line=L2 temperature=42.5 \d+$`, output)
+
+	output = formatInfluxOutput("machine", "ns=3;s=Name", "idle", "", "opc.tcp://localhost:4840", opts)
+	assert.Contains(t, output, ` temperature=1,string_temperature="idle" `)
+
+	lines, err := formatInfluxOutputWithBits("event_rack", "ns=5;s=alarms", uint32(1), "opc.tcp://localhost:4840", bitOptions{selected: []int{0}}, opts)
+	require.NoError(t, err)
+	require.Len(t, lines, 1)
+	assert.Contains(t, lines[0], ",site=plant\\ 1,line=L2,bit=0,bit_name=bit_0 temperature=1 ")
+}
+
+// TestInfluxTagsFlag tests parsing of repeatable --influx-tag flags
+func TestInfluxTagsFlag(t *testing.T) {
+	var f influxTagsFlag
+	require.NoError(t, f.Set("site=plant1"))
+	require.NoError(t, f.Set("machine=press=3"))
+	assert.Equal(t, influxTagsFlag{{"site", "plant1"}, {"machine", "press=3"}}, f)
+	assert.Equal(t, "site=plant1,machine=press=3", f.String())
+
+	assert.Error(t, f.Set("site"))
+	assert.Error(t, f.Set("=plant1"))
+	assert.Error(t, f.Set("site="))
+}
+
+// TestInfluxOptionsForResult tests choosing the line timestamp from a read result
+func TestInfluxOptionsForResult(t *testing.T) {
+	source := time.Date(2025, 3, 9, 14, 30, 0, 0, time.UTC)
+	server := source.Add(250 * time.Millisecond)
+	result := NodeResponse{NodeID: "ns=3;s=Temp", Value: 21.5, SourceTimestamp: &source, ServerTimestamp: &server}
+
+	opts := influxOptions{timestamp: "source"}.forResult(result)
+	assert.Equal(t, source.UnixNano(), opts.lineTimestamp())
+	assert.Regexp(t, ` value=21.5 1741530600000000000$`, formatInfluxOutput("m", "ns=3;s=Temp", 21.5, "", "opc.tcp://localhost:4840", opts))
+
+	opts = influxOptions{timestamp: "server"}.forResult(result)
+	assert.Equal(t, server.UnixNano(), opts.lineTimestamp())
+
+	// Missing timestamps and the default mode fall back to the current time
+	before := time.Now().UnixNano()
+	opts = influxOptions{timestamp: "source"}.forResult(NodeResponse{Value: 1.0})
+	assert.GreaterOrEqual(t, opts.lineTimestamp(), before)
+	opts = influxOptions{}.forResult(result)
+	assert.GreaterOrEqual(t, opts.lineTimestamp(), before)
+}
+
+// TestStructOutput tests the flattened InfluxDB lines and JSON default output of decoded structures
+func TestStructOutput(t *testing.T) {
+	value := map[string]interface{}{
+		"Speed":  12.5,
+		"Name":   "Press3",
+		"Counts": []interface{}{7.0, 9.0},
+		"Axis":   map[string]interface{}{"Position": 101.25},
+	}
+
+	lines := formatInfluxLines("m", "ns=3;s=Drive", value, "e", influxOptions{})
+	require.Len(t, lines, 5)
+	assert.Regexp(t, `^m,node_id=ns\\=3;s\\=Drive,endpoint=e,field=Axis.Position value=101.25 \d+$`, lines[0])
+	assert.Contains(t, lines[1], ",field=Counts[0] value=7 ")
+	assert.Contains(t, lines[2], ",field=Counts[1] value=9 ")
+	assert.Contains(t, lines[3], `,field=Name value=1,string_value="Press3" `)
+	assert.Contains(t, lines[4], ",field=Speed value=12.5 ")
+
+	// Plain arrays keep their single line
+	assert.Len(t, formatInfluxLines("m", "ns=3;s=Array", []interface{}{1.0, 2.0}, "e", influxOptions{}), 1)
+
+	assert.Equal(t, `{"Axis":{"Position":101.25},"Counts":[7,9],"Name":"Press3","Speed":12.5}`, formatDefaultValue(NodeResponse{Value: value}))
+}
+
+// TestEnumNameOutput tests the state tag and default output of decoded enumeration values
+func TestEnumNameOutput(t *testing.T) {
+	result := NodeResponse{NodeID: "ns=3;s=Mode", Value: 3.0, EnumName: "Running"}
+
+	opts := influxOptions{tags: []influxTag{{"site", "plant1"}}}.forResult(result)
+	assert.Equal(t, ",node_id=ns\\=3;s\\=Mode,endpoint=e,state=Running,site=plant1", opts.tagSet("ns=3;s=Mode", "e"))
+	assert.Equal(t, "3 (Running)", formatDefaultValue(result))
+	assert.Equal(t, "3", formatDefaultValue(NodeResponse{Value: 3.0}))
+
+	// Lines without an enumeration name are untouched
+	opts = influxOptions{}.forResult(NodeResponse{Value: 3.0})
+	assert.Empty(t, opts.tags)
+}
+
+// TestInfluxOptionsWithBatchTag tests tagging lines with the value of the batch node
+func TestInfluxOptionsWithBatchTag(t *testing.T) {
+	batchID := "LOT 2025-117  "
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Batch", r.URL.Query().Get("identifier"))
+		json.NewEncoder(w).Encode(NodeResponse{NodeID: "ns=3;s=Batch", Value: batchID})
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.NoError(t, err)
+
+	opts := influxOptions{tags: []influxTag{{"site", "plant1"}}, batchNode: "ns=3;s=Batch", batchTag: "lot"}
+	tagged, err := opts.withBatchTag(u.Hostname(), port)
+	require.NoError(t, err)
+	assert.Equal(t, ",node_id=ns\\=3;s\\=Temp,endpoint=e,site=plant1,lot=LOT\\ 2025-117", tagged.tagSet("ns=3;s=Temp", "e"))
+	assert.Len(t, opts.tags, 1, "original options are unchanged")
+
+	// No batch running
+	batchID = ""
+	tagged, err = opts.withBatchTag(u.Hostname(), port)
+	require.NoError(t, err)
+	assert.Equal(t, opts.tags, tagged.tags)
+
+	// Without a batch node no read is made
+	tagged, err = influxOptions{}.withBatchTag("localhost", 1)
+	require.NoError(t, err)
+	assert.Empty(t, tagged.tags)
+}
+
+// TestFormatDefaultResults tests that batch reads print one line per requested
+// node in request order, errors included
+func TestFormatDefaultResults(t *testing.T) {
+	nodeIDs := []string{"ns=3;s=B", "ns=3,s=Missing", "ns=3;s=A"}
+	results := []NodeResponse{
+		{NodeID: "ns=3;s=B", Value: 2.5},
+		{NodeID: "ns=3;s=Missing", Error: "Failed to read node: StatusBadNodeIDUnknown"},
+		{NodeID: "ns=3;s=A", Value: 3.0, EnumName: "Running"},
+	}
+	assert.Equal(t, "ns=3;s=B\t2.5\n"+
+		"ns=3,s=Missing\tError: Failed to read node: StatusBadNodeIDUnknown\n"+
+		"ns=3;s=A\t3 (Running)", formatDefaultResults(nodeIDs, results))
+}
+
+// TestDuplicateNodeIDs tests finding node IDs given more than once
+func TestDuplicateNodeIDs(t *testing.T) {
+	assert.Empty(t, duplicateNodeIDs([]string{"ns=3;s=A", "ns=3;s=B"}))
+	assert.Equal(t, []duplicateNode{{nodeID: "ns=3;s=B", count: 3}, {nodeID: "ns=3;s=A", count: 2}},
+		duplicateNodeIDs([]string{"ns=3;s=B", "ns=3;s=A", "ns=3,s=B", "ns=3;s=A", "ns=3;s=B"}))
+}
+
+// TestConfirmWrite tests the answers --confirm takes as a yes
+func TestConfirmWrite(t *testing.T) {
+	for answer, want := range map[string]bool{"y\n": true, "YES\n": true, "n\n": false, "\n": false, "": false, "sure\n": false} {
+		var out strings.Builder
+		assert.Equal(t, want, confirmWrite(strings.NewReader(answer), &out, "Set ns=3;s=Setpoint from 21 to 22 with type float"), "%q", answer)
+		assert.Equal(t, "Set ns=3;s=Setpoint from 21 to 22 with type float? [y/N] ", out.String())
+	}
+}
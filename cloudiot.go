@@ -0,0 +1,694 @@
+//go:build !minimal && !nocloudiot
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	azureAPIVersion    = "2021-04-12"
+	sasTokenLifetime   = time.Hour
+	cloudKeepAlive     = time.Minute
+	cloudDialTimeout   = 30 * time.Second
+	cloudRenewBefore   = 5 * time.Minute // Reconnect with new credentials this long before they expire
+	maxAzureMessage    = 256 << 10       // Bytes of a device-to-cloud message
+	maxAWSMessage      = 128 << 10       // Bytes of an MQTT message
+	maxBrokerMessage   = 1 << 20         // Bytes of a message to an MQTT broker
+	awsIoTService      = "iotdevicegateway"
+	defaultCloudState  = "connecting"
+	defaultStatusEvery = time.Minute // Status reports with the backlog of the sink
+)
+
+func init() {
+	includeComponent("cloudiot")
+}
+
+// Region of an AWS IoT device data endpoint
+var awsEndpointRegion = regexp.MustCompile(`\.iot\.([a-z0-9-]+)\.amazonaws\.com(\.cn)?$`)
+
+// azureIoT is the device of an Azure IoT Hub sink. It authenticates with SAS
+// tokens from a device key or with an X.509 certificate
+type azureIoT struct {
+	Hub     string `yaml:"hub"`     // Host name, e.g. plant.azure-devices.net
+	Device  string `yaml:"device"`  // Device ID
+	Key     string `yaml:"key"`     // Symmetric device key (base64) for SAS tokens
+	KeyFile string `yaml:"keyFile"` // Or a file with it
+	Cert    string `yaml:"cert"`    // Or a device certificate (PEM)
+	CertKey string `yaml:"certKey"` // and its private key
+}
+
+// awsIoT is the thing of an AWS IoT Core sink. It authenticates with an X.509
+// certificate (mutual TLS on port 8883) or with SigV4 (MQTT over WebSocket on
+// port 443) and AWS credentials from the sink or the environment
+type awsIoT struct {
+	Endpoint string `yaml:"endpoint"` // Device data endpoint, e.g. a1b2c3-ats.iot.eu-central-1.amazonaws.com
+	Thing    string `yaml:"thing"`    // Thing name, the client ID and shadow
+	Topic    string `yaml:"topic"`    // Default plccli/<thing>/values
+	Cert     string `yaml:"cert"`     // Certificate (PEM) for mutual TLS
+	CertKey  string `yaml:"certKey"`
+
+	Region              string `yaml:"region"`              // Default from the endpoint
+	AccessKeyID         string `yaml:"accessKeyId"`         // Default $AWS_ACCESS_KEY_ID
+	SecretAccessKey     string `yaml:"secretAccessKey"`     // Default $AWS_SECRET_ACCESS_KEY
+	SecretAccessKeyFile string `yaml:"secretAccessKeyFile"` // Or a file with it
+	SessionToken        string `yaml:"sessionToken"`        // Default $AWS_SESSION_TOKEN
+}
+
+// mqttBroker is the MQTT broker of a sink, e.g. Mosquitto or the broker of
+// an Ignition SCADA, getting the lines as JSON messages or as the metrics of
+// a Sparkplug B edge node
+type mqttBroker struct {
+	Broker       string `yaml:"broker"`   // mqtt://host[:1883] or mqtts://host[:8883]
+	ClientID     string `yaml:"clientId"` // Default plccli-<connection>
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"passwordFile"` // Or a file with it
+	CA           string `yaml:"ca"`           // CA certificates (PEM) of an mqtts broker, default the system's
+	Topic        string `yaml:"topic"`        // Of the JSON messages, default plccli/<connection>/values
+
+	Sparkplug *mqttSparkplug `yaml:"sparkplug"` // Sparkplug B instead of JSON, see sparkplug.go
+}
+
+// cloudStatus is the connection status a cloud sink reports in the device
+// twin or thing shadow, under "plccli"
+type cloudStatus struct {
+	Connection  string    `json:"connection"`
+	Endpoint    string    `json:"endpoint"`
+	State       string    `json:"state"` // connecting, connected or disconnected
+	Since       time.Time `json:"since"`
+	Error       string    `json:"error,omitempty"` // why the connection was lost
+	Maintenance bool      `json:"maintenance"`
+
+	Buffer *cloudBacklog `json:"buffer,omitempty"`
+}
+
+// cloudBacklog is what waits at the edge for a cloud sink, so the cloud side
+// sees a backlog building up, e.g. over a slow uplink, without asking the
+// gateway
+type cloudBacklog struct {
+	Lines    int64      `json:"lines"`              // Buffered for the sink
+	Oldest   *time.Time `json:"oldest,omitempty"`   // Source timestamp of the oldest buffered line
+	Evicted  int64      `json:"evicted"`            // Lines dropped since the start, buffer full
+	LastSent *time.Time `json:"lastSent,omitempty"` // Last successful publish
+}
+
+// cloudSink sends the lines of a poll file sink to a cloud IoT platform over
+// MQTT, as JSON messages like those of webhook sinks, and reports the status
+// of the PLC connection to the device twin or thing shadow. MQTT sinks send
+// them to a broker, as JSON or Sparkplug B, and report no status
+type cloudSink struct {
+	name       string // For log messages
+	telemetry  string // Topic of the lines
+	maxMessage int    // Bytes, larger batches are split
+	replies    string // Topic filter of the replies to status reports, or of Sparkplug commands
+
+	dial   func(ctx context.Context) (io.ReadWriteCloser, error)
+	login  func(now time.Time) (mqttLogin, time.Time, error)  // And when the credentials expire, zero if never
+	report func(status cloudStatus, rid int) (string, []byte) // nil for MQTT sinks
+	reply  func(topic string, payload []byte)
+
+	sparkplug *sparkplugNode // Of MQTT sinks publishing Sparkplug B
+
+	buffer      *priorityBuffer // Of the sink, for the backlog in status reports
+	statusEvery time.Duration
+
+	mu       sync.Mutex
+	client   *mqttClient
+	expires  time.Time
+	rid      int // Request ID of the last status report
+	status   cloudStatus
+	lastSent time.Time
+}
+
+// newAzureSink returns the cloud sink of an IoT Hub device
+func newAzureSink(cfg *azureIoT) (*cloudSink, error) {
+	if cfg.Hub == "" || cfg.Device == "" {
+		return nil, fmt.Errorf("azureIoT needs hub and device")
+	}
+	if countSet(cfg.Key, cfg.KeyFile, cfg.Cert) != 1 {
+		return nil, fmt.Errorf("azureIoT needs one of key, keyFile or cert")
+	}
+	tlsConfig := &tls.Config{ServerName: cfg.Hub}
+	var key []byte
+	if cfg.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.CertKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the device certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	} else {
+		encoded, err := secretValue(cfg.Key, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if key, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return nil, fmt.Errorf("device key is not base64: %v", err)
+		}
+	}
+
+	resource := cfg.Hub + "/devices/" + cfg.Device
+	return &cloudSink{
+		name:       "azureIoT " + resource,
+		telemetry:  "devices/" + cfg.Device + "/messages/events/$.ct=application%2Fjson&$.ce=utf-8",
+		maxMessage: maxAzureMessage,
+		replies:    "$iothub/twin/res/#",
+		dial: func(ctx context.Context) (io.ReadWriteCloser, error) {
+			return dialTLS(ctx, net.JoinHostPort(cfg.Hub, "8883"), tlsConfig)
+		},
+		login: func(now time.Time) (mqttLogin, time.Time, error) {
+			login := mqttLogin{
+				clientID:  cfg.Device,
+				username:  cfg.Hub + "/" + cfg.Device + "/?api-version=" + azureAPIVersion,
+				keepAlive: cloudKeepAlive,
+			}
+			if key == nil {
+				return login, time.Time{}, nil
+			}
+			expires := now.Add(sasTokenLifetime)
+			login.password = azureSASToken(resource, key, expires)
+			return login, expires, nil
+		},
+		report: func(status cloudStatus, rid int) (string, []byte) {
+			payload, _ := json.Marshal(map[string]interface{}{"plccli": status})
+			return "$iothub/twin/PATCH/properties/reported/?$rid=" + strconv.Itoa(rid), payload
+		},
+		reply: func(topic string, payload []byte) {
+			// $iothub/twin/res/{status}/?$rid={rid}
+			code, _, _ := strings.Cut(strings.TrimPrefix(topic, "$iothub/twin/res/"), "/")
+			if !strings.HasPrefix(code, "2") {
+				log.Printf("[%s] Sink azureIoT %s: twin update failed with status %s: %s", connectionName, resource, code, payload)
+			}
+		},
+		status: cloudStatus{State: defaultCloudState, Since: time.Now().UTC()},
+	}, nil
+}
+
+// azureSASToken returns a shared access signature for a resource of an IoT
+// hub, valid until expires
+func azureSASToken(resource string, key []byte, expires time.Time) string {
+	sr := url.QueryEscape(resource)
+	se := strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(sr + "\n" + se))
+	sig := url.QueryEscape(base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	return "SharedAccessSignature sr=" + sr + "&sig=" + sig + "&se=" + se
+}
+
+// awsCredentials sign the WebSocket URL of a SigV4 AWS IoT sink
+type awsCredentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+}
+
+// newAWSSink returns the cloud sink of an AWS IoT thing. Credentials missing
+// from the sink are looked up with getenv at each connect, so rotated
+// temporary credentials are picked up
+func newAWSSink(cfg *awsIoT, getenv func(string) string) (*cloudSink, error) {
+	if cfg.Endpoint == "" || cfg.Thing == "" {
+		return nil, fmt.Errorf("awsIoT needs endpoint and thing")
+	}
+	topic := cfg.Topic
+	if topic == "" {
+		topic = "plccli/" + cfg.Thing + "/values"
+	}
+	shadow := "$aws/things/" + cfg.Thing + "/shadow/update"
+	c := &cloudSink{
+		name:       "awsIoT " + cfg.Endpoint + "/" + cfg.Thing,
+		telemetry:  topic,
+		maxMessage: maxAWSMessage,
+		replies:    shadow + "/rejected",
+		login: func(time.Time) (mqttLogin, time.Time, error) {
+			return mqttLogin{clientID: cfg.Thing, keepAlive: cloudKeepAlive}, time.Time{}, nil
+		},
+		report: func(status cloudStatus, _ int) (string, []byte) {
+			payload, _ := json.Marshal(map[string]interface{}{
+				"state": map[string]interface{}{"reported": map[string]interface{}{"plccli": status}},
+			})
+			return shadow, payload
+		},
+		reply: func(topic string, payload []byte) {
+			log.Printf("[%s] Sink awsIoT %s: shadow update rejected: %s", connectionName, cfg.Thing, payload)
+		},
+		status: cloudStatus{State: defaultCloudState, Since: time.Now().UTC()},
+	}
+
+	if cfg.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.CertKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the thing certificate: %v", err)
+		}
+		tlsConfig := &tls.Config{ServerName: cfg.Endpoint, Certificates: []tls.Certificate{cert}}
+		c.dial = func(ctx context.Context) (io.ReadWriteCloser, error) {
+			return dialTLS(ctx, net.JoinHostPort(cfg.Endpoint, "8883"), tlsConfig)
+		}
+		return c, nil
+	}
+
+	region := cfg.Region
+	if region == "" {
+		m := awsEndpointRegion.FindStringSubmatch(cfg.Endpoint)
+		if m == nil {
+			return nil, fmt.Errorf("awsIoT needs a region for endpoint %s", cfg.Endpoint)
+		}
+		region = m[1]
+	}
+	credentials := func() (awsCredentials, error) {
+		creds := awsCredentials{cfg.AccessKeyID, cfg.SecretAccessKey, cfg.SessionToken}
+		if cfg.SecretAccessKeyFile != "" {
+			secret, err := secretValue("", cfg.SecretAccessKeyFile)
+			if err != nil {
+				return creds, err
+			}
+			creds.secretAccessKey = secret
+		}
+		if creds.accessKeyID == "" && creds.secretAccessKey == "" {
+			creds = awsCredentials{getenv("AWS_ACCESS_KEY_ID"), getenv("AWS_SECRET_ACCESS_KEY"), getenv("AWS_SESSION_TOKEN")}
+		}
+		if creds.accessKeyID == "" || creds.secretAccessKey == "" {
+			return creds, fmt.Errorf("awsIoT needs cert and certKey, or AWS credentials")
+		}
+		return creds, nil
+	}
+	if _, err := credentials(); err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{ServerName: cfg.Endpoint}
+	c.dial = func(ctx context.Context) (io.ReadWriteCloser, error) {
+		creds, err := credentials()
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dialTLS(ctx, net.JoinHostPort(cfg.Endpoint, "443"), tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		ws, err := dialWebSocket(conn, awsPresignedURL(cfg.Endpoint, region, creds, time.Now()))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return ws, nil
+	}
+	return c, nil
+}
+
+// newMQTTSink returns the sink of an MQTT broker
+func newMQTTSink(cfg *mqttBroker) (*cloudSink, error) {
+	if cfg.Broker == "" {
+		return nil, fmt.Errorf("mqtt needs broker")
+	}
+	dial, err := mqttDialer(cfg.Broker, cfg.CA)
+	if err != nil {
+		return nil, err
+	}
+	password, err := secretValue(cfg.Password, cfg.PasswordFile)
+	if err != nil {
+		return nil, err
+	}
+	clientID := cfg.ClientID
+	if clientID == "" {
+		clientID = "plccli-" + connectionName
+	}
+	c := &cloudSink{
+		name:       "mqtt " + cfg.Broker,
+		telemetry:  cfg.Topic,
+		maxMessage: maxBrokerMessage,
+		dial:       dial,
+		status:     cloudStatus{State: defaultCloudState, Since: time.Now().UTC()},
+	}
+	login := mqttLogin{clientID: clientID, username: cfg.Username, password: password, keepAlive: cloudKeepAlive}
+	if cfg.Sparkplug == nil {
+		if c.telemetry == "" {
+			c.telemetry = "plccli/" + connectionName + "/values"
+		}
+		c.login = func(time.Time) (mqttLogin, time.Time, error) {
+			return login, time.Time{}, nil
+		}
+		return c, nil
+	}
+
+	if cfg.Topic != "" {
+		return nil, fmt.Errorf("mqtt takes topic or sparkplug, not both")
+	}
+	if c.sparkplug, err = newSparkplugNode(cfg.Sparkplug); err != nil {
+		return nil, err
+	}
+	c.name += " " + c.sparkplug.topic("NDATA")
+	c.replies = c.sparkplug.topic("NCMD")
+	c.login = func(now time.Time) (mqttLogin, time.Time, error) {
+		login := login
+		login.willTopic, login.willPayload = c.sparkplug.will(now)
+		return login, time.Time{}, nil
+	}
+	c.reply = func(topic string, payload []byte) {
+		if sparkplugRebirthRequested(payload) {
+			go c.rebirth() // Not on the read goroutine, publishing waits on it
+		}
+	}
+	return c, nil
+}
+
+// awsPresignedURL returns the WebSocket URL of an AWS IoT endpoint signed
+// with SigV4. The session token is added after signing, as AWS IoT wants it
+func awsPresignedURL(host, region string, creds awsCredentials, now time.Time) string {
+	now = now.UTC()
+	date := now.Format("20060102")
+	amzDate := now.Format("20060102T150405Z")
+	scope := date + "/" + region + "/" + awsIoTService + "/aws4_request"
+
+	query := map[string]string{
+		"X-Amz-Algorithm":     "AWS4-HMAC-SHA256",
+		"X-Amz-Credential":    creds.accessKeyID + "/" + scope,
+		"X-Amz-Date":          amzDate,
+		"X-Amz-SignedHeaders": "host",
+	}
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = awsEscape(key) + "=" + awsEscape(query[key])
+	}
+	canonicalQuery := strings.Join(pairs, "&")
+
+	emptyHash := sha256.Sum256(nil)
+	canonicalRequest := "GET\n/mqtt\n" + canonicalQuery + "\nhost:" + host + "\n\nhost\n" + hex.EncodeToString(emptyHash[:])
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + creds.secretAccessKey)
+	for _, part := range []string{date, region, awsIoTService, "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	signed := "wss://" + host + "/mqtt?" + canonicalQuery + "&X-Amz-Signature=" + hex.EncodeToString(key)
+	if creds.sessionToken != "" {
+		signed += "&X-Amz-Security-Token=" + awsEscape(creds.sessionToken)
+	}
+	return signed
+}
+
+// awsEscape percent-encodes all but the unreserved characters, as SigV4 does
+func awsEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// dialTLS connects to a broker with TLS
+func dialTLS(ctx context.Context, addr string, config *tls.Config) (net.Conn, error) {
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: cloudDialTimeout}, Config: config}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", addr, err)
+	}
+	return conn, nil
+}
+
+// mqttDialer returns the dial of an mqtt:// or mqtts:// broker URL, over TLS
+// with the CA certificates of caFile or the system's for mqtts
+func mqttDialer(broker, caFile string) (func(ctx context.Context) (io.ReadWriteCloser, error), error) {
+	u, err := url.Parse(broker)
+	if err != nil || (u.Scheme != "mqtt" && u.Scheme != "mqtts") || u.Hostname() == "" {
+		return nil, fmt.Errorf("broker %q is not mqtt://host[:port] or mqtts://host[:port]", broker)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		port := "1883"
+		if u.Scheme == "mqtts" {
+			port = "8883"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	if u.Scheme == "mqtt" {
+		if caFile != "" {
+			return nil, fmt.Errorf("ca is for mqtts:// brokers")
+		}
+		return func(ctx context.Context) (io.ReadWriteCloser, error) {
+			dialer := &net.Dialer{Timeout: cloudDialTimeout}
+			conn, err := dialer.DialContext(ctx, "tcp", addr)
+			if err != nil {
+				return nil, fmt.Errorf("failed to connect to %s: %v", addr, err)
+			}
+			return conn, nil
+		}, nil
+	}
+	tlsConfig, err := loadAPIClientTLS(true, caFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ServerName = u.Hostname()
+	return func(ctx context.Context) (io.ReadWriteCloser, error) {
+		return dialTLS(ctx, addr, tlsConfig)
+	}, nil
+}
+
+// secretValue returns a value of a sink or the first line of its file
+func secretValue(value, file string) (string, error) {
+	if file == "" {
+		return value, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", file, err)
+	}
+	value = strings.TrimRight(string(data), "\r\n")
+	if value == "" {
+		return "", fmt.Errorf("%s is empty", file)
+	}
+	return value, nil
+}
+
+// session returns the MQTT connection, connecting when there is none or its
+// credentials are about to expire. A new connection subscribes to the replies
+// and reports the status, or publishes the NBIRTH of a Sparkplug node.
+// Callers hold mu
+func (c *cloudSink) session(ctx context.Context) (*mqttClient, error) {
+	now := time.Now()
+	if c.client != nil && c.client.closed() == nil && (c.expires.IsZero() || now.Add(cloudRenewBefore).Before(c.expires)) {
+		return c.client, nil
+	}
+	c.disconnect()
+
+	login, expires, err := c.login(now)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newMQTTClient(ctx, conn, login, c.reply)
+	if err != nil {
+		return nil, err
+	}
+	if c.replies != "" {
+		if err := client.subscribe(ctx, c.replies); err != nil {
+			client.close()
+			return nil, err
+		}
+	}
+	if c.sparkplug != nil {
+		if err := c.sparkplug.birth(ctx, client); err != nil {
+			client.close()
+			return nil, err
+		}
+	}
+	c.client, c.expires = client, expires
+	log.Printf("[%s] Sink %s: connected", connectionName, c.name)
+	c.publishStatus(ctx)
+	return client, nil
+}
+
+// disconnect closes the MQTT connection. Callers hold mu
+func (c *cloudSink) disconnect() {
+	if c.client != nil {
+		c.client.close()
+		c.client = nil
+	}
+}
+
+func (c *cloudSink) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.disconnect()
+}
+
+// rebirth publishes the NBIRTH of a Sparkplug node again, as a host
+// application asked with an NCMD
+func (c *cloudSink) rebirth() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client == nil || c.client.closed() != nil {
+		return // Connecting again publishes it
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mqttAckTimeout)
+	defer cancel()
+	if err := c.sparkplug.birth(ctx, c.client); err != nil {
+		log.Printf("[%s] Sink %s: rebirth failed: %v", connectionName, c.name, err)
+		c.disconnect()
+	}
+}
+
+// send publishes lines as JSON messages with QoS 1, splitting batches larger
+// than the platform takes, or as Sparkplug B. A failed publish drops the
+// connection, the next send connects again
+func (c *cloudSink) send(ctx context.Context, lines []string, budget *sinkBudget) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	client, err := c.session(ctx)
+	if err != nil {
+		return err
+	}
+	if c.sparkplug != nil {
+		err = c.sparkplug.publish(ctx, client, lines, c.maxMessage, budget)
+	} else {
+		err = c.publishLines(ctx, client, lines, budget)
+	}
+	if err != nil {
+		if _, rejected := err.(*sinkRejectedError); !rejected {
+			c.disconnect()
+		}
+		return err
+	}
+	c.lastSent = time.Now().UTC()
+	return nil
+}
+
+// publishLines publishes lines in one message, or in halves when too large
+func (c *cloudSink) publishLines(ctx context.Context, client *mqttClient, lines []string, budget *sinkBudget) error {
+	payload, err := webhookPayload(lines)
+	if err != nil {
+		return fmt.Errorf("failed to encode notifications: %v", err)
+	}
+	if len(payload) > c.maxMessage {
+		if len(lines) == 1 {
+			return &sinkRejectedError{status: "message too large", body: fmt.Sprintf("%d bytes, at most %d", len(payload), c.maxMessage)}
+		}
+		half := len(lines) / 2
+		if err := c.publishLines(ctx, client, lines[:half], budget); err != nil {
+			return err
+		}
+		return c.publishLines(ctx, client, lines[half:], budget)
+	}
+	if err := client.publish(ctx, c.telemetry, payload, 1); err != nil {
+		return err
+	}
+	if budget != nil {
+		budget.spent(linesSize(lines), len(payload))
+	}
+	return nil
+}
+
+// watch follows the connection events until ctx is done and reports the
+// status after each burst of them, and with the backlog every statusEvery.
+// MQTT sinks report no status
+func (c *cloudSink) watch(ctx context.Context, bus *eventBus) {
+	if c.report == nil {
+		return
+	}
+	events, stop := bus.subscribe(0)
+	defer stop()
+	every := c.statusEvery
+	if every <= 0 {
+		every = defaultStatusEvery
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.mu.Lock()
+			if c.client != nil && c.client.closed() == nil {
+				c.publishStatus(ctx) // Disconnected sinks report when they connect
+			}
+			c.mu.Unlock()
+		case e := <-events:
+			c.mu.Lock()
+			c.update(e)
+			for queued := true; queued; {
+				select {
+				case e := <-events:
+					c.update(e)
+				default:
+					queued = false
+				}
+			}
+			if c.client != nil && c.client.closed() == nil {
+				c.publishStatus(ctx)
+			} else if _, err := c.session(ctx); err != nil { // Reports on connect
+				log.Printf("[%s] Sink %s: status report failed: %v", connectionName, c.name, err)
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// update applies a connection event to the status. Callers hold mu
+func (c *cloudSink) update(e serviceEvent) {
+	c.status.Connection, c.status.Endpoint, c.status.Since = e.Connection, e.Endpoint, e.Time
+	switch e.Type {
+	case eventDisconnect:
+		c.status.State, c.status.Error = "disconnected", e.Error
+	default:
+		c.status.State, c.status.Error = "connected", ""
+	}
+}
+
+// publishStatus reports the status to the twin or shadow. Callers hold mu
+func (c *cloudSink) publishStatus(ctx context.Context) {
+	if c.client == nil || c.report == nil {
+		return
+	}
+	c.rid++
+	status := c.status
+	if status.Connection == "" {
+		status.Connection = connectionName
+	}
+	status.Maintenance = serviceMaintenance.active()
+	if c.buffer != nil {
+		status.Buffer = c.backlog()
+	}
+	topic, payload := c.report(status, c.rid)
+	if err := c.client.publish(ctx, topic, payload, 0); err != nil {
+		log.Printf("[%s] Sink %s: status report failed: %v", connectionName, c.name, err)
+	}
+}
+
+// backlog returns the backlog of the sink. Callers hold mu
+func (c *cloudSink) backlog() *cloudBacklog {
+	stats := c.buffer.stats()
+	backlog := &cloudBacklog{Lines: stats["lines"], Evicted: stats["evicted"]}
+	if oldest, ok := c.buffer.oldest(); ok {
+		oldest = oldest.UTC()
+		backlog.Oldest = &oldest
+	}
+	if !c.lastSent.IsZero() {
+		lastSent := c.lastSent
+		backlog.LastSent = &lastSent
+	}
+	return backlog
+}
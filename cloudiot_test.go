@@ -0,0 +1,376 @@
+//go:build !minimal && !nocloudiot
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBroker is an MQTT broker on the other end of a pipe, recording the
+// logins and publishes of a client
+type fakeBroker struct {
+	mu        sync.Mutex
+	logins    [][]byte            // Bodies of the CONNECT packets
+	publishes map[string][][]byte // Payloads by topic
+	refuse    byte                // CONNACK return code
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{publishes: make(map[string][][]byte)}
+}
+
+// dial returns the client end of a new connection to the broker
+func (b *fakeBroker) dial(ctx context.Context) (io.ReadWriteCloser, error) {
+	client, server := net.Pipe()
+	go b.serve(server)
+	return client, nil
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		header, body, err := readMQTTPacket(r)
+		if err != nil {
+			return
+		}
+		switch header >> 4 {
+		case mqttConnect:
+			b.mu.Lock()
+			b.logins = append(b.logins, body)
+			refuse := b.refuse
+			b.mu.Unlock()
+			conn.Write(mqttPacket(mqttConnAck<<4, []byte{0, refuse}))
+		case mqttSubscribe:
+			conn.Write(mqttPacket(mqttSubAck<<4, append(body[:2:2], 0)))
+		case mqttPublish:
+			topic, rest, _ := cutMQTTString(body)
+			var id []byte
+			if header>>1&0x03 > 0 {
+				id, rest = rest[:2], rest[2:]
+			}
+			b.mu.Lock()
+			b.publishes[topic] = append(b.publishes[topic], rest)
+			b.mu.Unlock()
+			if id != nil {
+				conn.Write(mqttPacket(mqttPubAck<<4, id))
+			}
+		case mqttPingReq:
+			conn.Write([]byte{mqttPingResp << 4, 0})
+		case mqttDisconnect:
+			return
+		}
+	}
+}
+
+// published returns the payloads of a topic
+func (b *fakeBroker) published(topic string) [][]byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.publishes[topic]
+}
+
+// TestMQTTPacket tests the remaining length encoding and string fields
+func TestMQTTPacket(t *testing.T) {
+	assert.Equal(t, []byte{0x30, 0}, mqttPacket(0x30, nil))
+	packet := mqttPacket(0x30, make([]byte, 321))
+	assert.Equal(t, []byte{0x30, 0xc1, 0x02}, packet[:3])
+	header, body, err := readMQTTPacket(bufio.NewReader(strings.NewReader(string(packet))))
+	require.NoError(t, err)
+	assert.Equal(t, byte(0x30), header)
+	assert.Len(t, body, 321)
+
+	s, rest, ok := cutMQTTString(append(appendMQTTString(nil, "a/b"), 1, 2))
+	assert.True(t, ok)
+	assert.Equal(t, "a/b", s)
+	assert.Equal(t, []byte{1, 2}, rest)
+	_, _, ok = cutMQTTString([]byte{0, 5, 'a'})
+	assert.False(t, ok)
+}
+
+// TestAzureIoTSink tests that an IoT Hub sink logs in with a SAS token,
+// sends the lines as device-to-cloud messages and reports the connection
+// status in the device twin
+func TestAzureIoTSink(t *testing.T) {
+	defer func(name string) { connectionName = name }(connectionName)
+	connectionName = "line1"
+
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "device.key")
+	require.NoError(t, os.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString([]byte("s3cret"))+"\n"), 0600))
+	pf, err := loadPollFile(writePollFile(t, "sinks:\n  - azureIoT: {hub: plant.azure-devices.net, device: line1, keyFile: "+keyFile+"}\npolls:\n  - {node: ns=1;s=Speed, interval: 1s}\n"))
+	require.NoError(t, err)
+	sink := pf.Sinks[0]
+	require.NotNil(t, sink.cloud)
+	assert.Equal(t, "azureIoT plant.azure-devices.net/devices/line1", sink.name())
+
+	broker := newFakeBroker()
+	sink.cloud.dial = broker.dial
+	speed := `conveyor,node_id=ns\=1;s\=Speed value=1.5 1772352000000000000`
+	require.NoError(t, sink.send(context.Background(), nil, []string{speed, speed}))
+	defer sink.cloud.close()
+
+	broker.mu.Lock()
+	require.Len(t, broker.logins, 1)
+	login := string(broker.logins[0])
+	broker.mu.Unlock()
+	assert.Contains(t, login, "plant.azure-devices.net/line1/?api-version="+azureAPIVersion)
+	assert.Contains(t, login, "SharedAccessSignature sr=plant.azure-devices.net%2Fdevices%2Fline1&sig=")
+
+	messages := broker.published("devices/line1/messages/events/$.ct=application%2Fjson&$.ce=utf-8")
+	require.Len(t, messages, 1)
+	var body webhookBody
+	require.NoError(t, json.Unmarshal(messages[0], &body))
+	assert.Equal(t, "line1", body.Connection)
+	assert.Len(t, body.Notifications, 2)
+
+	require.Eventually(t, func() bool {
+		return len(broker.published("$iothub/twin/PATCH/properties/reported/?$rid=1")) == 1
+	}, time.Second, time.Millisecond, "reported on connect")
+	reports := broker.published("$iothub/twin/PATCH/properties/reported/?$rid=1")
+	assert.Contains(t, string(reports[0]), `{"plccli":{"connection":"line1","endpoint":"","state":"connecting"`)
+
+	// Connection events update the twin
+	bus := newEventBus(nil)
+	bus.endpoint = "opc.tcp://plc:4840"
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		sink.cloud.watch(ctx, bus)
+		close(done)
+	}()
+	bus.publish(serviceEvent{Type: eventDisconnect, Error: "EOF"})
+	require.Eventually(t, func() bool {
+		return len(broker.published("$iothub/twin/PATCH/properties/reported/?$rid=2")) == 1
+	}, time.Second, time.Millisecond)
+	cancel()
+	<-done
+	var report struct{ Plccli cloudStatus }
+	require.NoError(t, json.Unmarshal(broker.published("$iothub/twin/PATCH/properties/reported/?$rid=2")[0], &report))
+	assert.Equal(t, "disconnected", report.Plccli.State)
+	assert.Equal(t, "EOF", report.Plccli.Error)
+	assert.Equal(t, "opc.tcp://plc:4840", report.Plccli.Endpoint)
+
+	// A refused login fails the push, the lines stay buffered
+	sink.cloud.close()
+	broker.mu.Lock()
+	broker.refuse = 5
+	broker.mu.Unlock()
+	assert.ErrorContains(t, sink.send(context.Background(), nil, []string{speed}), "not authorized")
+
+	for _, bad := range []string{
+		"sinks:\n  - azureIoT: {hub: plant.azure-devices.net}\npolls:\n  - {node: ns=3;s=A, interval: 1s}\n",
+		"sinks:\n  - azureIoT: {hub: plant.azure-devices.net, device: line1}\npolls:\n  - {node: ns=3;s=A, interval: 1s}\n",
+		"sinks:\n  - azureIoT: {hub: plant.azure-devices.net, device: line1, key: not-base64!}\npolls:\n  - {node: ns=3;s=A, interval: 1s}\n",
+		"sinks:\n  - azureIoT: {hub: plant.azure-devices.net, device: line1, key: czNjcmV0}\n    gzip: true\npolls:\n  - {node: ns=3;s=A, interval: 1s}\n",
+		"sinks:\n  - azureIoT: {hub: plant.azure-devices.net, device: line1, key: czNjcmV0}\n    url: http://sink\npolls:\n  - {node: ns=3;s=A, interval: 1s}\n",
+	} {
+		_, err := loadPollFile(writePollFile(t, bad))
+		assert.Error(t, err, bad)
+	}
+}
+
+// TestAzureSASToken tests the signature of SAS tokens
+func TestAzureSASToken(t *testing.T) {
+	token := azureSASToken("plant.azure-devices.net/devices/line1", []byte("s3cret"), time.Unix(1772352000, 0))
+	assert.True(t, strings.HasPrefix(token, "SharedAccessSignature sr=plant.azure-devices.net%2Fdevices%2Fline1&sig="), token)
+	assert.True(t, strings.HasSuffix(token, "&se=1772352000"), token)
+	assert.Equal(t, token, azureSASToken("plant.azure-devices.net/devices/line1", []byte("s3cret"), time.Unix(1772352000, 0)))
+	assert.NotEqual(t, token, azureSASToken("plant.azure-devices.net/devices/line1", []byte("other"), time.Unix(1772352000, 0)))
+}
+
+// TestAWSIoTSink tests the SigV4 WebSocket URL, large batches split to fit
+// AWS IoT messages and shadow updates
+func TestAWSIoTSink(t *testing.T) {
+	env := map[string]string{"AWS_ACCESS_KEY_ID": "AKIDEXAMPLE", "AWS_SECRET_ACCESS_KEY": "wJalrXUtnFEMI", "AWS_SESSION_TOKEN": "tok/en+"}
+	getenv := func(key string) string { return env[key] }
+	cloud, err := newAWSSink(&awsIoT{Endpoint: "a1b2c3-ats.iot.eu-central-1.amazonaws.com", Thing: "line1"}, getenv)
+	require.NoError(t, err)
+
+	signed := awsPresignedURL("a1b2c3-ats.iot.eu-central-1.amazonaws.com", "eu-central-1",
+		awsCredentials{"AKIDEXAMPLE", "wJalrXUtnFEMI", "tok/en+"}, time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC))
+	u, err := url.Parse(signed)
+	require.NoError(t, err)
+	assert.Equal(t, "wss", u.Scheme)
+	assert.Equal(t, "/mqtt", u.Path)
+	q := u.Query()
+	assert.Equal(t, "AKIDEXAMPLE/20260301/eu-central-1/iotdevicegateway/aws4_request", q.Get("X-Amz-Credential"))
+	assert.Equal(t, "20260301T080000Z", q.Get("X-Amz-Date"))
+	assert.Len(t, q.Get("X-Amz-Signature"), 64)
+	assert.Equal(t, "tok/en+", q.Get("X-Amz-Security-Token"))
+	assert.True(t, strings.HasSuffix(signed, "&X-Amz-Security-Token=tok%2Fen%2B"), "added after signing")
+
+	broker := newFakeBroker()
+	cloud.dial = broker.dial
+	defer cloud.close()
+	var lines []string
+	for i := 0; i < 2000; i++ {
+		lines = append(lines, `alarms,node_id=ns\=5;s\=Alarms,endpoint=opc.tcp://plc:4840 text="`+strings.Repeat("x", 100)+`" 1772352000000000000`)
+	}
+	require.NoError(t, cloud.send(context.Background(), lines, nil))
+	messages := broker.published("plccli/line1/values")
+	require.Greater(t, len(messages), 1, "split")
+	sent := 0
+	for _, message := range messages {
+		assert.LessOrEqual(t, len(message), maxAWSMessage)
+		var body webhookBody
+		require.NoError(t, json.Unmarshal(message, &body))
+		sent += len(body.Notifications)
+	}
+	assert.Equal(t, len(lines), sent)
+
+	require.Eventually(t, func() bool {
+		return len(broker.published("$aws/things/line1/shadow/update")) == 1
+	}, time.Second, time.Millisecond, "reported on connect")
+	shadow := broker.published("$aws/things/line1/shadow/update")
+	assert.Contains(t, string(shadow[0]), `{"state":{"reported":{"plccli":{`)
+
+	delete(env, "AWS_ACCESS_KEY_ID")
+	_, err = newAWSSink(&awsIoT{Endpoint: "a1b2c3-ats.iot.eu-central-1.amazonaws.com", Thing: "line1"}, getenv)
+	assert.Error(t, err, "no credentials")
+	_, err = newAWSSink(&awsIoT{Endpoint: "mqtt.example.com", Thing: "line1", AccessKeyID: "a", SecretAccessKey: "b"}, getenv)
+	assert.ErrorContains(t, err, "region")
+}
+
+// TestWebSocketConn tests the handshake and framing of MQTT over WebSocket
+func TestWebSocketConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		r := bufio.NewReader(server)
+		req, err := http.ReadRequest(r)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, "mqtt", req.Header.Get("Sec-WebSocket-Protocol"))
+		assert.Equal(t, "/mqtt?X-Amz-Date=x", req.URL.RequestURI())
+		sum := sha1.Sum([]byte(req.Header.Get("Sec-WebSocket-Key") + webSocketGUID))
+		io.WriteString(server, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: "+base64.StdEncoding.EncodeToString(sum[:])+"\r\n\r\n")
+
+		// Echo a masked frame unmasked, after a ping answered with a pong
+		head := make([]byte, 2)
+		io.ReadFull(r, head)
+		mask := make([]byte, 4)
+		io.ReadFull(r, mask)
+		payload := make([]byte, head[1]&0x7f)
+		io.ReadFull(r, payload)
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+		server.Write([]byte{0x89, 1, 'p'})
+		pong := make([]byte, 7)
+		io.ReadFull(r, pong)
+		assert.Equal(t, byte(0x8A), pong[0])
+		server.Write(append([]byte{0x82, byte(len(payload))}, payload...))
+	}()
+
+	ws, err := dialWebSocket(client, "wss://broker/mqtt?X-Amz-Date=x")
+	require.NoError(t, err)
+	_, err = ws.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(ws, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+// TestCloudBacklog tests that the status reports of cloud sinks carry the
+// backlog buffered for them
+func TestCloudBacklog(t *testing.T) {
+	pf, err := loadPollFile(writePollFile(t, "buffer: 3\nsinks:\n  - azureIoT: {hub: plant.azure-devices.net, device: line1, key: czNjcmV0}\n    statusInterval: 30s\npolls:\n  - {node: ns=1;s=Speed, interval: 1s}\n"))
+	require.NoError(t, err)
+	sink := pf.Sinks[0]
+	assert.Equal(t, 30*time.Second, sink.cloud.statusEvery)
+	s := newPollScheduler(pf, nil)
+
+	var lines prioritized
+	lines[priorityAlarm] = []string{`alarms,node_id=ns\=1;s\=Alarm active=true 1772352002000000000`}
+	lines[priorityDiagnostic] = []string{
+		`diag,node_id=ns\=1;s\=Cpu value=12 1772352000000000000`,
+		`diag,node_id=ns\=1;s\=Cpu value=13 1772352001000000000`,
+		`diag,node_id=ns\=1;s\=Cpu value=14 1772352003000000000`,
+	}
+	s.add(lines, false)
+
+	broker := newFakeBroker()
+	sink.cloud.dial = broker.dial
+	defer sink.cloud.close()
+	require.NoError(t, sink.send(context.Background(), nil, []string{`conveyor value=1 1772352004000000000`}))
+	sink.cloud.mu.Lock()
+	sink.cloud.publishStatus(context.Background())
+	sink.cloud.mu.Unlock()
+
+	require.Eventually(t, func() bool {
+		return len(broker.published("$iothub/twin/PATCH/properties/reported/?$rid=2")) == 1
+	}, time.Second, time.Millisecond)
+	var first, second struct{ Plccli cloudStatus }
+	require.NoError(t, json.Unmarshal(broker.published("$iothub/twin/PATCH/properties/reported/?$rid=1")[0], &first))
+	require.NoError(t, json.Unmarshal(broker.published("$iothub/twin/PATCH/properties/reported/?$rid=2")[0], &second))
+
+	backlog := second.Plccli.Buffer
+	require.NotNil(t, backlog)
+	assert.Equal(t, int64(3), backlog.Lines)
+	assert.Equal(t, int64(1), backlog.Evicted, "the oldest diagnostic line")
+	require.NotNil(t, backlog.Oldest)
+	assert.Equal(t, time.Unix(0, 1772352001000000000).UTC(), *backlog.Oldest)
+	assert.Nil(t, first.Plccli.Buffer.LastSent, "reported on connect, before the first publish")
+	require.NotNil(t, backlog.LastSent)
+	assert.WithinDuration(t, time.Now(), *backlog.LastSent, time.Minute)
+
+	for _, bad := range []string{
+		"sinks:\n  - {url: http://sink, statusInterval: 1m}\npolls:\n  - {node: ns=3;s=A, interval: 1s}\n",
+		"sinks:\n  - azureIoT: {hub: plant.azure-devices.net, device: line1, key: czNjcmV0}\n    statusInterval: 10ms\npolls:\n  - {node: ns=3;s=A, interval: 1s}\n",
+	} {
+		_, err := loadPollFile(writePollFile(t, bad))
+		assert.Error(t, err, bad)
+	}
+}
+
+// TestRuleMQTT tests that the MQTT action of a rule logs in and publishes
+// the firing with QoS 1
+func TestRuleMQTT(t *testing.T) {
+	broker := newFakeBroker()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go broker.serve(conn)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	m := &ruleMQTT{Broker: "mqtt://" + l.Addr().String(), Topic: "plant/alarms", Username: "edge", QoS: 1}
+	require.NoError(t, m.check())
+	require.NoError(t, publishRuleMQTT(ctx, m, []byte(`{"rule":"door_open"}`)))
+	assert.Equal(t, [][]byte{[]byte(`{"rule":"door_open"}`)}, broker.published("plant/alarms"))
+	broker.mu.Lock()
+	assert.Contains(t, string(broker.logins[0]), "edge")
+	broker.refuse = 5
+	broker.mu.Unlock()
+	assert.ErrorContains(t, publishRuleMQTT(ctx, m, nil), "not authorized")
+	assert.Error(t, (&ruleMQTT{Broker: "mqtt://broker", Topic: "t", QoS: 2}).check())
+}
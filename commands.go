@@ -0,0 +1,445 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// command describes a subcommand and the flags it accepts after its name,
+// e.g. plccli opcua get --measurement temperature <node-id>. Flags are
+// shared with the global flags of the same name, which still work before
+// the subcommand; global flags the command does not take are rejected
+type command struct {
+	name  string   // opcua get, service run, ...
+	args  string   // positional arguments for the usage line
+	about string   // one line description
+	flags []string // names of global flags the command takes
+	local func(fs *flag.FlagSet)
+}
+
+// Groups of flags several commands take
+var (
+	serviceClientFlags = []string{"connection", "ports-file", "service-host", "port", "token", "api-base-path", "api-tls", "api-tls-ca", "verbose"}
+	plcFlags           = []string{"endpoint", "username", "password", "password-file", "credentials-source", "auth-method", "security-policy", "security-mode", "cert", "key", "gen-cert", "app-uri", "timeout"}
+	directFlags        = append([]string{"direct"}, plcFlags...)
+	influxLineFlags    = []string{"format", "influx-field-name", "influx-timestamp", "influx-tag", "shifts"}
+	influxFlags        = flagGroups(influxLineFlags, []string{"measurement", "influx-measurement", "batch-node", "batch-tag"})
+)
+
+// File of opcua validate, from its --file flag
+var validateFile string
+
+// Options of plccli query, from its flags
+var (
+	queryDB    string
+	querySince string
+	queryUntil string
+	queryLimit int
+)
+
+// Flags parsed after the subcommand, nil without a subcommand
+var commandFlagSet *flag.FlagSet
+
+// The subcommands with their own flags
+var commands = []command{
+	{
+		name:  "opcua get",
+		args:  "<node-id|@group> [node-id ...]",
+		about: "Read the values of nodes",
+		flags: flagGroups(serviceClientFlags, directFlags, influxFlags, []string{
+			"op-timeout", "interval", "bits", "bits-summary", "bit-names", "bit-names-file", "bit-edges",
+			"counter", "counter-max", "counter-state", "transform", "transform-file", "decode-enums", "with-metadata",
+			"warn-duplicates", "fresh", "synchronized",
+		}),
+	},
+	{
+		name:  "opcua set",
+		args:  "<node-id> <value> [data-type]",
+		about: "Write a value to a node",
+		flags: flagGroups(serviceClientFlags, directFlags, influxLineFlags, []string{
+			"op-timeout", "auto-type", "data-type", "attribute", "value-file", "write-priority", "dry-run", "confirm",
+			"permit", "decimal-separator",
+		}),
+	},
+	{
+		name:  "opcua set-bit",
+		args:  "<node-id> <bit-num> <0|1>",
+		about: "Set or clear one bit of an integer word",
+		flags: flagGroups(serviceClientFlags, directFlags, influxLineFlags, []string{"op-timeout", "permit"}),
+	},
+	{
+		name:  "opcua browse",
+		args:  "[node-id] [max-depth]",
+		about: "Browse the node tree, by default from the Objects folder 3 levels deep",
+		flags: flagGroups(serviceClientFlags, directFlags, []string{"format", "op-timeout", "async"}),
+		local: func(fs *flag.FlagSet) {
+			fs.IntVar(&browseMaxNodes, "max-nodes", 0, "Stop after this many nodes and print the token to continue with")
+			fs.StringVar(&browseContinuation, "continuation", "", "Continue a browse from the token it printed when it stopped")
+			fs.BoolVar(&browseRefresh, "refresh", false, "Browse the PLC instead of the browse cache, and update the cache")
+		},
+	},
+	{
+		name:  "opcua subscribe",
+		about: "Browse the variables below a node and monitor their values",
+		flags: flagGroups(serviceClientFlags, directFlags, influxFlags, []string{"op-timeout", "interval", "transform", "transform-file", "decode-enums", "with-metadata", "fresh"}),
+		local: func(fs *flag.FlagSet) {
+			fs.StringVar(&subscribeSubtree, "subtree", "", "Node whose variables to monitor")
+			fs.IntVar(&subscribeDepth, "max-depth", 3, "Levels to browse below the node")
+			fs.IntVar(&subscribeMaxItems, "max-items", defaultSubscribeItems, "Most variables to monitor")
+			fs.DurationVar(&subscribeRebrowse, "rebrowse", 0, "Browse the node again at this interval (e.g. 5m) and monitor the variables added or removed since")
+		},
+	},
+	{
+		name:  "opcua tui",
+		args:  "[node-id] [max-depth]",
+		about: "Browse the address space in a terminal UI, with live values, a watch list and writes (Objects folder, 5 levels deep by default)",
+		flags: flagGroups(serviceClientFlags, directFlags, []string{"interval", "permit", "decimal-separator"}),
+	},
+	{
+		name:  "opcua watch",
+		args:  "<node-id> [node-id ...]",
+		about: "Show a table of the values of nodes, their quality and last change, refreshed every --interval with changed cells highlighted",
+		flags: flagGroups(serviceClientFlags, directFlags, []string{"interval"}),
+	},
+	{
+		name:  "opcua states",
+		about: "Show the durations of the states tracked by the service",
+		flags: flagGroups(serviceClientFlags, influxFlags),
+	},
+	{
+		name:  "opcua validate",
+		args:  "[node-id ...]",
+		about: "Check that nodes exist with the expected access and data type",
+		flags: flagGroups(serviceClientFlags, directFlags, []string{"op-timeout"}),
+		local: func(fs *flag.FlagSet) {
+			fs.StringVar(&validateFile, "file", "", "File with one node per line: <node-id> [r|w|rw] [data-type], - for stdin")
+		},
+	},
+	{
+		name:  "opcua assert",
+		args:  "<node-id> <operator> <expected>",
+		about: "Compare the value of a node (==, !=, <, <=, >, >=) and exit with code 1 unless it holds, for acceptance tests in CI",
+		flags: flagGroups(serviceClientFlags, directFlags, []string{"interval", "decimal-separator"}),
+		local: func(fs *flag.FlagSet) {
+			fs.DurationVar(&assertWithin, "within", 0, "Read the node every --interval until the comparison holds, for at most this long")
+		},
+	},
+	{
+		name:  "modbus get",
+		args:  "<unit> <register-type> <address> [count] [type]",
+		about: "Read coils, discrete inputs or registers of a Modbus connection",
+		flags: flagGroups(serviceClientFlags, []string{"direct", "endpoint", "timeout"}, influxFlags, []string{
+			"interval", "bits", "bits-summary", "bit-names", "bit-names-file",
+		}),
+	},
+	{
+		name:  "modbus set",
+		args:  "<unit> <register-type> <address> <value> [type]",
+		about: "Write a coil or holding register of a Modbus connection",
+		flags: flagGroups(serviceClientFlags, []string{"direct", "endpoint", "timeout", "permit", "decimal-separator"}),
+	},
+	{
+		name:  "enip get",
+		args:  "<tag> [tag ...]",
+		about: "Read Logix tags of an EtherNet/IP connection",
+		flags: flagGroups(serviceClientFlags, []string{"direct", "endpoint", "timeout"}, influxFlags, []string{
+			"interval", "bits", "bits-summary", "bit-names", "bit-names-file",
+		}),
+	},
+	{
+		name:  "enip set",
+		args:  "<tag> <value> [type]",
+		about: "Write a Logix tag of an EtherNet/IP connection",
+		flags: flagGroups(serviceClientFlags, []string{"direct", "endpoint", "timeout", "permit", "decimal-separator"}),
+	},
+	{
+		name:  "point get",
+		args:  "<ref> [ref ...]",
+		about: "Read references of a connection through its protocol backend",
+		flags: flagGroups(serviceClientFlags, []string{"direct", "endpoint", "timeout"}, influxFlags, []string{
+			"interval", "bits", "bits-summary", "bit-names", "bit-names-file",
+		}),
+	},
+	{
+		name:  "point set",
+		args:  "<ref> <value> [type]",
+		about: "Write a reference of a connection through its protocol backend",
+		flags: flagGroups(serviceClientFlags, []string{"direct", "endpoint", "timeout", "permit", "decimal-separator"}),
+	},
+	{
+		name:  "point browse",
+		args:  "[ref] [max-depth]",
+		about: "List the references of a device whose backend can browse",
+		flags: flagGroups(serviceClientFlags, []string{"direct", "endpoint", "timeout"}),
+	},
+	{
+		name:  "query",
+		args:  "[node-id ...]",
+		about: "Read the samples a SQLite sink of the poll file stored, of all nodes or the given ones",
+		flags: []string{"format"},
+		local: func(fs *flag.FlagSet) {
+			fs.StringVar(&queryDB, "db", "", "Database file of the sink (its sqlite setting)")
+			fs.StringVar(&querySince, "since", "", "Samples from this time on, an RFC 3339 time or a duration back from now (e.g. 24h)")
+			fs.StringVar(&queryUntil, "until", "", "Samples up to this time, like --since")
+			fs.IntVar(&queryLimit, "limit", 1000, "Latest samples to print, 0 for all")
+		},
+	},
+	{
+		name:  "cancel",
+		args:  "<op-id>",
+		about: "Cancel a queued write, running browse or job of the service",
+		flags: serviceClientFlags,
+	},
+	{
+		name:  "permit request",
+		args:  "<reason>",
+		about: "Request a time-limited write permit from a service started with --write-permits",
+		flags: serviceClientFlags,
+		local: func(fs *flag.FlagSet) {
+			fs.DurationVar(&permitDuration, "duration", 0, "How long the permit lasts, the longest the service issues when 0")
+		},
+	},
+	{
+		name:  "permit list",
+		about: "List the active write permits",
+		flags: serviceClientFlags,
+	},
+	{
+		name:  "permit revoke",
+		args:  "<permit-id>",
+		about: "End a write permit before it expires",
+		flags: serviceClientFlags,
+	},
+	{
+		name:  "approvals request",
+		args:  "<node-id> <value> <type> <reason>",
+		about: "Ask for a write of a node marked critical in the write policy, run once another tenant confirms it",
+		flags: serviceClientFlags,
+	},
+	{
+		name:  "approvals list",
+		about: "List the writes of critical nodes waiting for a confirmation",
+		flags: serviceClientFlags,
+	},
+	{
+		name:  "approvals confirm",
+		args:  "<approval-id>",
+		about: "Confirm a write of a critical node requested by another tenant and run it",
+		flags: flagGroups(serviceClientFlags, []string{"permit"}),
+	},
+	{
+		name:  "approvals reject",
+		args:  "<approval-id>",
+		about: "Drop a write of a critical node waiting for a confirmation",
+		flags: serviceClientFlags,
+	},
+	{
+		name:  "maintenance start",
+		args:  "<reason>",
+		about: "Mark the connection as under maintenance: values are tagged maintenance=true, writes blocked and alerts suppressed",
+		flags: serviceClientFlags,
+		local: func(fs *flag.FlagSet) {
+			fs.DurationVar(&maintenanceDuration, "duration", 0, "How long the maintenance lasts, until maintenance end when 0")
+		},
+	},
+	{
+		name:  "maintenance status",
+		about: "Show whether the connection is under maintenance",
+		flags: serviceClientFlags,
+	},
+	{
+		name:  "maintenance end",
+		about: "End the maintenance of the connection",
+		flags: serviceClientFlags,
+	},
+	{
+		name:  "schedules import",
+		args:  "<file.csv>",
+		about: "Replace the recurring writes of the service by those of a CSV file of node, value, type and cron columns",
+		flags: flagGroups(serviceClientFlags, []string{"decimal-separator"}),
+		local: func(fs *flag.FlagSet) {
+			fs.StringVar(&scheduleDelimiter, "delimiter", "", "Column delimiter, e.g. ';' (default: from the header row, else ',')")
+		},
+	},
+	{
+		name:  "schedules list",
+		about: "List the recurring writes of the service with their next and last runs",
+		flags: serviceClientFlags,
+	},
+	{
+		name:  "schedules clear",
+		about: "Remove all recurring writes of the service",
+		flags: serviceClientFlags,
+	},
+	{
+		name:  "shell",
+		about: "Run get, set, browse and monitor at a prompt with history and tab completion of node IDs, or from a script on stdin",
+		flags: flagGroups(serviceClientFlags, influxFlags, []string{"decode-enums"}),
+	},
+	{
+		name:  "run",
+		args:  "<script.plc|-> [NAME=value ...]",
+		about: "Run a script of get, set, wait and assert commands with variables, stopping at the first failing line",
+		flags: flagGroups(serviceClientFlags, influxFlags, []string{"decode-enums", "decimal-separator"}),
+	},
+	{
+		name:  "test",
+		args:  "<suite.yaml> [NAME=value ...]",
+		about: "Run the tests of a YAML suite of script steps and report them, also as JUnit XML",
+		flags: flagGroups(serviceClientFlags, influxFlags, []string{"decode-enums", "decimal-separator", "interval"}),
+		local: func(fs *flag.FlagSet) {
+			fs.StringVar(&junitFile, "junit", "", "Write a JUnit XML report of the tests to this file")
+		},
+	},
+	{
+		name:  "annotate",
+		args:  "<text>",
+		about: "Put a note, e.g. \"changed die on press 3\", on the timeline of the connection, sent to the poll file's sinks",
+		flags: flagGroups(serviceClientFlags, []string{"format", "influx-tag"}),
+		local: func(fs *flag.FlagSet) {
+			fs.StringVar(&annotationUser, "user", "", "Who annotates (default: the login name)")
+		},
+	},
+	{
+		name:  "capabilities",
+		about: "List the commands, data types, output formats and protocol drivers of this binary",
+		flags: []string{"format"},
+	},
+	{
+		name:  "service run",
+		about: "Run the service, like --service",
+		flags: flagGroups(plcFlags, []string{
+			"connection", "ports-file", "port", "verbose", "mock", "track-state", "state-interval", "shifts",
+			"poll-file", "recent-size", "recent-max-age", "influx-url", "influx-token", "influx-org", "influx-bucket", "influx-gzip", "influx-batch", "groups", "cache-ttl",
+			"tenants", "api-auth", "api-auth-cache-ttl", "write-policy", "approval-timeout", "write-limits", "write-permits", "rate-limit", "rate-limit-global", "max-ops", "max-ops-global", "access-log", "access-log-sample", "access-log-redact", "sensitive-nodes", "debug-faults", "api-base-path", "api-tls-cert", "api-tls-key", "cors-origins",
+			"connect-jitter", "keepalive-interval", "keepalive-node", "on-disconnect-cmd", "rules", "retry-session-writes", "decimal-separator",
+		}),
+	},
+	{
+		name:  "service export-state",
+		args:  "[file]",
+		about: "Save the poll groups and client certificate of the running service",
+		flags: flagGroups(serviceClientFlags, []string{"cert", "key"}),
+	},
+	{
+		name:  "service import-state",
+		args:  "<file>",
+		about: "Recreate exported poll groups and certificate on a replacement gateway",
+		flags: flagGroups(serviceClientFlags, []string{"cert", "key"}),
+	},
+}
+
+func flagGroups(groups ...[]string) []string {
+	var names []string
+	for _, group := range groups {
+		names = append(names, group...)
+	}
+	return names
+}
+
+// findCommand returns the command the arguments start with and the number of
+// arguments naming it
+func findCommand(args []string) (*command, int) {
+	for i := range commands {
+		words := strings.Fields(commands[i].name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == commands[i].name {
+			return &commands[i], len(words)
+		}
+	}
+	return nil, 0
+}
+
+// flagSet returns the flags of a command. Global flags are bound to the same
+// values, so setting one after the subcommand is like setting it before
+func (c *command) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("plccli "+c.name, flag.ExitOnError)
+	for _, name := range c.flags {
+		// Every name is a global flag, see TestCommandFlags
+		global := flag.Lookup(name)
+		if global == nil {
+			continue
+		}
+		fs.Var(global.Value, name, global.Usage)
+		fs.Lookup(name).DefValue = global.DefValue
+	}
+	if c.local != nil {
+		c.local(fs)
+	}
+	fs.Usage = func() {
+		out := fs.Output()
+		usage := "Usage: plccli [global flags] " + c.name + " [flags]"
+		if c.args != "" {
+			usage += " " + c.args
+		}
+		fmt.Fprintf(out, "%s\n\n%s\n\nFlags:\n", usage, c.about)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseCommandFlags checks the flags given before a subcommand, parsed into
+// global, parses the flags after it and returns the arguments without them.
+// Flags end at the first positional argument, so values like -5 of set are
+// not taken for flags
+func parseCommandFlags(global *flag.FlagSet, args []string) []string {
+	if len(args) == 2 && args[0] == "opcua" && (args[1] == "help" || args[1] == "-h" || args[1] == "--help") {
+		printUsage()
+		os.Exit(0)
+	}
+	c, n := findCommand(args)
+	if c == nil {
+		return args
+	}
+	if err := c.checkGlobalFlags(global); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitUsage)
+	}
+	fs := c.flagSet()
+	commandFlagSet = fs
+	fs.Parse(args[n:])
+	rest := fs.Args()
+
+	// Allow "--bits 3,7,12-15" as well as "--bits=3,7,12-15", see main
+	if c.name == "opcua get" && bits.enabled && len(bits.selected) == 0 && len(rest) > 0 {
+		if selected, err := parseBitSelection(rest[0]); err == nil {
+			bits.selected = selected
+			fs.Parse(rest[1:])
+			rest = fs.Args()
+		}
+	}
+
+	if c.name == "service run" {
+		if len(rest) > 0 {
+			fmt.Fprintf(os.Stderr, "Error: unexpected arguments for service run: %s\n", strings.Join(rest, " "))
+			os.Exit(exitUsage)
+		}
+		*service = true
+		return nil
+	}
+	return append(append([]string{}, args[:n]...), rest...)
+}
+
+// checkGlobalFlags returns an error for the flags given before the command
+// that it does not take, e.g. --measurement of opcua set
+func (c *command) checkGlobalFlags(global *flag.FlagSet) error {
+	takes := make(map[string]bool, len(c.flags))
+	for _, name := range c.flags {
+		takes[name] = true
+	}
+	var extra []string
+	global.Visit(func(f *flag.Flag) {
+		if !takes[f.Name] {
+			extra = append(extra, "--"+f.Name)
+		}
+	})
+	switch len(extra) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("%s is not a flag of %s, see plccli %s --help", extra[0], c.name, c.name)
+	default:
+		return fmt.Errorf("%s are not flags of %s, see plccli %s --help", strings.Join(extra, ", "), c.name, c.name)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCommandFlags tests parsing the flags after a subcommand
+func TestCommandFlags(t *testing.T) {
+	// Every flag of a command must exist
+	for _, c := range commands {
+		for _, name := range c.flags {
+			assert.NotNil(t, flag.Lookup(name), "--%s of %s", name, c.name)
+		}
+	}
+
+	oldMeasurement, oldBits, oldAutoType := *measurement, *bits, *autoType
+	defer func() {
+		*measurement, *bits, *autoType = oldMeasurement, oldBits, oldAutoType
+		validateFile, *service, *mock = "", false, false
+	}()
+	global := flag.NewFlagSet("plccli", flag.ContinueOnError)
+
+	args := parseCommandFlags(global, []string{"opcua", "get", "--measurement", "temp", "--bits", "3,7", "ns=3;s=A", "ns=3;s=B"})
+	assert.Equal(t, []string{"opcua", "get", "ns=3;s=A", "ns=3;s=B"}, args)
+	assert.Equal(t, "temp", *measurement)
+	assert.True(t, bits.enabled)
+	assert.Equal(t, []int{3, 7}, bits.selected)
+
+	// Flags end at the first argument, negative values are no flags
+	args = parseCommandFlags(global, []string{"opcua", "set", "--auto-type", "ns=3;s=A", "-5"})
+	assert.Equal(t, []string{"opcua", "set", "ns=3;s=A", "-5"}, args)
+	assert.True(t, *autoType)
+
+	args = parseCommandFlags(global, []string{"opcua", "validate", "--file", "nodes.txt"})
+	assert.Equal(t, []string{"opcua", "validate"}, args)
+	assert.Equal(t, "nodes.txt", validateFile)
+
+	assert.Empty(t, parseCommandFlags(global, []string{"service", "run", "--mock"}))
+	assert.True(t, *service)
+
+	// Unknown commands are left to main
+	args = parseCommandFlags(global, []string{"opcua", "frobnicate", "--x"})
+	assert.Equal(t, []string{"opcua", "frobnicate", "--x"}, args)
+}
+
+// TestCommandGlobalFlags tests that flags before a subcommand are only taken
+// when the command takes them
+func TestCommandGlobalFlags(t *testing.T) {
+	global := flag.NewFlagSet("plccli", flag.ContinueOnError)
+	for _, name := range []string{"connection", "measurement", "bits", "format"} {
+		f := flag.Lookup(name)
+		global.Var(f.Value, name, f.Usage)
+	}
+	oldMeasurement, oldFormat, oldBits := *measurement, *outputFormat, *bits
+	defer func() { *measurement, *outputFormat, *bits = oldMeasurement, oldFormat, oldBits }()
+	set, _ := findCommand([]string{"opcua", "set"})
+	get, _ := findCommand([]string{"opcua", "get"})
+
+	require.NoError(t, global.Parse([]string{"--connection", "line1", "--format", "influx"}))
+	assert.NoError(t, set.checkGlobalFlags(global))
+	assert.NoError(t, get.checkGlobalFlags(global))
+
+	require.NoError(t, global.Parse([]string{"--measurement", "temp"}))
+	assert.EqualError(t, set.checkGlobalFlags(global), "--measurement is not a flag of opcua set, see plccli opcua set --help")
+	assert.NoError(t, get.checkGlobalFlags(global))
+
+	require.NoError(t, global.Parse([]string{"--bits"}))
+	assert.EqualError(t, set.checkGlobalFlags(global), "--bits, --measurement are not flags of opcua set, see plccli opcua set --help")
+	assert.NoError(t, get.checkGlobalFlags(global))
+}
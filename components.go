@@ -0,0 +1,82 @@
+package main
+
+import "fmt"
+
+// buildComponent is an optional part of plccli that build tags leave out of
+// the binary, e.g. for gateways with little flash or builds without cgo.
+// The files of a component build unless its tag or minimal is set, and
+// include it from an init function; the files of the opposite constraint
+// answer with errNotIncluded:
+//
+//	go build -tags minimal                # OPC UA and the CLI only
+//	go build -tags "nomodbus nocloudiot"  # everything else
+type buildComponent struct {
+	Name     string `json:"name"`
+	Tag      string `json:"tag"` // Build tag leaving it out
+	About    string `json:"about"`
+	Included bool   `json:"included"`
+
+	schemes []string // Of its backend's endpoints
+}
+
+// The optional components, included by their files
+var buildComponents = []*buildComponent{
+	{Name: "historian", Tag: "nohistorian", About: "SQLite sinks and plccli query, needs cgo"},
+	{Name: "modbus", Tag: "nomodbus", About: "Modbus TCP driver, plccli modbus and /api/modbus", schemes: []string{"modbus", "modbus+tcp"}},
+	{Name: "enip", Tag: "noenip", About: "EtherNet/IP driver, plccli enip and /api/enip", schemes: []string{"enip"}},
+	{Name: "cloudiot", Tag: "nocloudiot", About: "Azure IoT Hub and AWS IoT Core sinks, MQTT actions of rules"},
+}
+
+// findComponent returns an optional component by name
+func findComponent(name string) *buildComponent {
+	for _, c := range buildComponents {
+		if c.Name == name {
+			return c
+		}
+	}
+	panic("unknown build component " + name)
+}
+
+// includeComponent records that a component is compiled in
+func includeComponent(name string) {
+	findComponent(name).Included = true
+}
+
+// errNotIncluded is the error of a feature whose component this build
+// leaves out
+func errNotIncluded(name string) error {
+	c := findComponent(name)
+	return fmt.Errorf("%s is not included in this build of plccli (%s profile), build it without -tags minimal or %s",
+		c.Name, buildProfile(), c.Tag)
+}
+
+// buildProfile names the components of this build: full with all of them,
+// minimal with none and custom in between
+func buildProfile() string {
+	included := 0
+	for _, c := range buildComponents {
+		if c.Included {
+			included++
+		}
+	}
+	switch included {
+	case len(buildComponents):
+		return "full"
+	case 0:
+		return "minimal"
+	}
+	return "custom"
+}
+
+// excludedScheme reports whether the backend of an endpoint scheme is left
+// out of this build. Such a backend stays registered to tell so
+func excludedScheme(scheme string) bool {
+	for _, c := range buildComponents {
+		for _, s := range c.schemes {
+			if s == scheme {
+				return !c.Included
+			}
+		}
+	}
+	return false
+}
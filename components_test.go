@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"umicli/pkg/backend"
+)
+
+// TestBuildProfile tests the profile named by the included components
+func TestBuildProfile(t *testing.T) {
+	included := make([]bool, len(buildComponents))
+	for i, c := range buildComponents {
+		included[i] = c.Included
+	}
+	t.Cleanup(func() {
+		for i, c := range buildComponents {
+			c.Included = included[i]
+		}
+	})
+
+	set := func(in bool) {
+		for _, c := range buildComponents {
+			c.Included = in
+		}
+	}
+	set(true)
+	assert.Equal(t, "full", buildProfile())
+	assert.False(t, excludedScheme("modbus"))
+	set(false)
+	assert.Equal(t, "minimal", buildProfile())
+	assert.True(t, excludedScheme("modbus+tcp"))
+	assert.False(t, excludedScheme("opc.tcp"))
+	findComponent("enip").Included = true
+	assert.Equal(t, "custom", buildProfile())
+	assert.EqualError(t, errNotIncluded("modbus"),
+		"modbus is not included in this build of plccli (custom profile), build it without -tags minimal or nomodbus")
+	assert.Panics(t, func() { findComponent("s7") })
+}
+
+// TestComponentsOfThisBuild tests that the components of this build work and
+// the others fail with errNotIncluded, by the tags of the test run
+func TestComponentsOfThisBuild(t *testing.T) {
+	_, err := openHistorian(t.TempDir()+"/h.db", defaultRetention, 0)
+	if findComponent("historian").Included {
+		assert.NoError(t, err)
+	} else {
+		assert.EqualError(t, err, errNotIncluded("historian").Error())
+	}
+
+	_, err = newAWSSink(&awsIoT{}, func(string) string { return "" })
+	if findComponent("cloudiot").Included {
+		assert.ErrorContains(t, err, "awsIoT needs")
+	} else {
+		assert.EqualError(t, err, errNotIncluded("cloudiot").Error())
+	}
+
+	for _, tc := range []struct{ scheme, endpoint string }{
+		{"modbus", "modbus://127.0.0.1:1502"},
+		{"enip", "enip://127.0.0.1"},
+	} {
+		b, err := backend.Open(tc.endpoint, backend.Options{})
+		if excludedScheme(tc.scheme) {
+			assert.ErrorContains(t, err, "is not included in this build", tc.endpoint)
+			continue
+		}
+		require.NoError(t, err, tc.endpoint)
+		assert.NoError(t, b.Close())
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/gopcua/opcua"
+)
+
+// Types of connection state events, from the state changes of the OPC UA
+// client including those of its own reconnects
+const (
+	stateConnecting       = "connecting"        // first connection attempt
+	stateConnected        = "connected"         // session up
+	stateDisconnected     = "disconnected"      // connection lost or closed
+	stateReconnecting     = "reconnecting"      // trying to get the session back
+	stateSessionRecreated = "session_recreated" // up again with a new session
+)
+
+// connStates turns the state changes of the clients of the service into
+// connection state events. A session that replaces an earlier one, after
+// the service reconnected or the client recreated it, is reported as
+// session_recreated: subscriptions and other session state are gone then
+type connStates struct {
+	mu      sync.Mutex
+	last    string         // last event type published
+	session *opcua.Session // last session seen up
+	bus     *eventBus
+}
+
+// Connection state events of this service
+var connectionEvents = newEventBus(serviceMaintenance)
+
+var serviceConnStates = &connStates{bus: connectionEvents}
+
+// stateEvent returns the event type for a state change of a client, "" when
+// it is not worth an event
+func (s *connStates) stateEvent(client *opcua.Client, state opcua.ConnState) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var typ string
+	switch state {
+	case opcua.Connecting:
+		typ = stateConnecting
+		if s.session != nil {
+			typ = stateReconnecting
+		}
+	case opcua.Connected:
+		typ = stateConnected
+		if session := client.Session(); session != s.session {
+			if s.session != nil {
+				typ = stateSessionRecreated
+			}
+			s.session = session
+		}
+	case opcua.Disconnected, opcua.Closed:
+		typ = stateDisconnected
+	case opcua.Reconnecting:
+		typ = stateReconnecting
+	}
+	if typ == s.last {
+		return ""
+	}
+	s.last = typ
+	return typ
+}
+
+// watch publishes the state changes of a client until it is closed or stop
+// is closed, e.g. because it never connected. The changes the client made
+// before stop was closed are still published
+func (s *connStates) watch(client *opcua.Client, states <-chan opcua.ConnState, stop <-chan struct{}) {
+	for {
+		select {
+		case state := <-states:
+			if s.handle(client, state) {
+				return
+			}
+		case <-stop:
+			for {
+				select {
+				case state := <-states:
+					if s.handle(client, state) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// handle publishes the event of a state change and reports whether the
+// client is closed. Later states of a closed client would only confuse those
+// of the client replacing it
+func (s *connStates) handle(client *opcua.Client, state opcua.ConnState) bool {
+	if typ := s.stateEvent(client, state); typ != "" {
+		s.bus.publish(serviceEvent{Type: typ})
+	}
+	return state == opcua.Closed
+}
+
+// handleConnectionEventsRequest streams the connection state events as
+// server-sent events, like /api/events
+func handleConnectionEventsRequest(w http.ResponseWriter, r *http.Request) {
+	streamEvents(w, r, connectionEvents)
+}
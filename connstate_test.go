@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestConnectionEvents tests the connection state events of a first connect
+// and of a reconnect of the service
+func TestConnectionEvents(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	t.Setenv("HOME", t.TempDir())
+	serverCtx, stop := context.WithCancel(context.Background())
+	m, err := startMockServer(serverCtx)
+	require.NoError(t, err)
+	connectionEvents = newEventBus(nil)
+	serviceConnStates = &connStates{bus: connectionEvents}
+	t.Cleanup(func() {
+		closeOPCUA()
+		stop()
+		connectionEvents = newEventBus(nil)
+		serviceConnStates = &connStates{bus: connectionEvents}
+		serviceNamespaces = &namespaceTable{}
+		serviceLimits = &limitsTable{limits: defaultOperationLimits()}
+	})
+
+	events, stopEvents := connectionEvents.subscribe(0)
+	defer stopEvents()
+	next := func() string {
+		select {
+		case e := <-events:
+			return e.Type
+		case <-ctx.Done():
+			return "timeout"
+		}
+	}
+
+	require.NoError(t, connectOPCUA(ctx, m.endpoint, "", "", "cert.pem", "key.pem", false, "", 10))
+	assert.Equal(t, stateConnecting, next())
+	assert.Equal(t, stateConnected, next())
+
+	reconnectOPCUA(ctx, m.endpoint, "", "", "cert.pem", "key.pem", false, "", 10)
+	assert.Equal(t, stateDisconnected, next())
+	assert.Equal(t, stateReconnecting, next())
+	assert.Equal(t, stateSessionRecreated, next(), "the service replaced the session")
+	assert.Empty(t, events)
+}
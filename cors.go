@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Headers of the API that browsers may read from cross-origin responses
+const corsExposedHeaders = "X-Dropped-Lines, Retry-After, X-Operation-ID"
+
+// Base path of this service's API, "" for the root
+var serviceBasePath string
+
+// CORS policy of this service, nil when disabled
+var serviceCORS *corsPolicy
+
+// normalizeBasePath returns the --api-base-path with a leading and without a
+// trailing slash, "" when the API is served at the root
+func normalizeBasePath(path string) (string, error) {
+	path = strings.Trim(strings.TrimSpace(path), "/")
+	if path == "" {
+		return "", nil
+	}
+	if strings.ContainsAny(path, "?# ") {
+		return "", fmt.Errorf("invalid API base path %q", path)
+	}
+	return "/" + path, nil
+}
+
+// withBasePath serves the API under the base path, e.g. /plccli/api/info for
+// a service behind a reverse proxy that forwards /plccli/ to it. Handlers
+// still see /api/... paths, requests outside the base path get a 404
+func withBasePath(basePath string, next http.Handler) http.Handler {
+	if basePath == "" {
+		return next
+	}
+	return http.StripPrefix(basePath, next)
+}
+
+// corsPolicy answers the CORS requests of browser-based HMIs calling the API
+// from other origins
+type corsPolicy struct {
+	origins map[string]bool // Allowed origins, e.g. https://hmi.plant.local
+	any     bool            // --cors-origins *
+}
+
+// newCORSPolicy parses a comma separated list of origins, * for any. An
+// empty list disables CORS and returns nil
+func newCORSPolicy(list string) (*corsPolicy, error) {
+	c := &corsPolicy{origins: make(map[string]bool)}
+	for _, origin := range strings.Split(list, ",") {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		switch {
+		case origin == "":
+		case origin == "*":
+			c.any = true
+		case !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://"):
+			return nil, fmt.Errorf("invalid origin %q, expected e.g. https://hmi.plant.local", origin)
+		default:
+			c.origins[origin] = true
+		}
+	}
+	if !c.any && len(c.origins) == 0 {
+		return nil, nil
+	}
+	return c, nil
+}
+
+// allowed reports whether requests of an origin may read the API's responses
+func (c *corsPolicy) allowed(origin string) bool {
+	return c.any || c.origins[origin]
+}
+
+// middleware adds the CORS headers to the responses to allowed origins and
+// answers their preflight requests. It sits in front of the tenant check,
+// browsers send preflights without the Authorization header. A nil policy
+// adds nothing
+func (c *corsPolicy) middleware(next http.Handler) http.Handler {
+	if c == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		w.Header().Add("Vary", "Origin")
+		if !c.allowed(origin) {
+			if preflight {
+				http.Error(w, fmt.Sprintf("Forbidden: origin %s is not allowed (--cors-origins)", origin), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if c.any {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if !preflight {
+			w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, "+permitHeader)
+		w.Header().Set("Access-Control-Max-Age", "600")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCORSPolicy tests preflights, the headers of allowed origins and that
+// preflights pass before the tenant check
+func TestCORSPolicy(t *testing.T) {
+	cors, err := newCORSPolicy("https://hmi.plant.local, http://10.0.0.5:3000/")
+	require.NoError(t, err)
+	tenants := &tenantRegistry{tenants: []*tenant{{Name: "hmi", Token: "secret", Access: "read"}}}
+	handler := cors.middleware(tenants.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Dropped-Lines", "0")
+		w.WriteHeader(http.StatusOK)
+	})))
+
+	request := func(method, origin, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/info", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", "GET")
+			req.Header.Set("Access-Control-Request-Headers", "authorization")
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := request(http.MethodOptions, "https://hmi.plant.local", "")
+	assert.Equal(t, http.StatusNoContent, rec.Code, "preflights carry no token")
+	assert.Equal(t, "https://hmi.plant.local", rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, rec.Header().Get("Access-Control-Allow-Headers"), "Authorization")
+	assert.Contains(t, rec.Header().Get("Access-Control-Allow-Methods"), "DELETE")
+
+	rec = request(http.MethodGet, "http://10.0.0.5:3000", "secret")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "http://10.0.0.5:3000", rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, rec.Header().Get("Access-Control-Expose-Headers"), "X-Dropped-Lines")
+	assert.Equal(t, "Origin", rec.Header().Get("Vary"))
+
+	rec = request(http.MethodGet, "http://10.0.0.5:3000", "")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "requests still need the token")
+
+	rec = request(http.MethodOptions, "https://evil.example", "")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = request(http.MethodGet, "https://evil.example", "secret")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+
+	rec = request(http.MethodGet, "", "secret")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get("Vary"), "requests without Origin are not CORS requests")
+
+	any, err := newCORSPolicy("*")
+	require.NoError(t, err)
+	assert.True(t, any.allowed("https://anywhere.example"))
+
+	none, err := newCORSPolicy("")
+	require.NoError(t, err)
+	assert.Nil(t, none)
+	_, err = newCORSPolicy("hmi.plant.local")
+	assert.Error(t, err)
+}
+
+// TestBasePath tests serving the API under --api-base-path
+func TestBasePath(t *testing.T) {
+	for in, want := range map[string]string{"": "", "/": "", "plccli": "/plccli", "/plccli/": "/plccli", "/tools/plccli": "/tools/plccli"} {
+		got, err := normalizeBasePath(in)
+		require.NoError(t, err, in)
+		assert.Equal(t, want, got, in)
+	}
+	_, err := normalizeBasePath("/plccli?x=1")
+	assert.Error(t, err)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/info", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	})
+	handler := withBasePath("/plccli", mux)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/plccli/api/info", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "/api/info", rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/info", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
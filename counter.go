@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// counterOptions controls the counter rollover transform
+type counterOptions struct {
+	mode      string          // "" (off), "delta" or "total"
+	max       float64         // Counter wrap-around maximum (0 = decreases are resets)
+	stateFile string          // Optional file to persist state between invocations
+	tracker   *counterTracker // State of each counter node
+	shifts    *shiftCalendar  // Optional shift calendar; totals restart at each shift boundary
+}
+
+// counterTracker keeps the last raw value and running total of counter nodes
+type counterTracker struct {
+	States map[string]*counterState `json:"states"`
+}
+
+type counterState struct {
+	Last       float64   `json:"last"`
+	Total      float64   `json:"total"`
+	ShiftStart time.Time `json:"shiftStart,omitempty"`
+}
+
+func newCounterTracker() *counterTracker {
+	return &counterTracker{States: make(map[string]*counterState)}
+}
+
+// update records a new raw counter value and returns the monotonic delta since
+// the previous value and the cumulative total
+//
+// A decrease is a rollover when max is set (the counter wrapped at max back to 0),
+// otherwise a reset (the counter restarted from 0, e.g. at a shift change).
+// The first value of a node establishes the baseline: delta 0, total = value.
+// When shiftStart differs from the previous value's, a new shift has begun and
+// the total restarts with the delta
+func (t *counterTracker) update(nodeID string, value, max float64, shiftStart time.Time) (float64, float64) {
+	st, ok := t.States[nodeID]
+	if !ok {
+		t.States[nodeID] = &counterState{Last: value, Total: value, ShiftStart: shiftStart}
+		return 0, value
+	}
+
+	var delta float64
+	switch {
+	case value >= st.Last:
+		delta = value - st.Last
+	case max > 0 && st.Last <= max:
+		delta = (max - st.Last) + value + 1
+	default:
+		delta = value
+	}
+
+	if !shiftStart.Equal(st.ShiftStart) {
+		st.Total = 0
+		st.ShiftStart = shiftStart
+	}
+
+	st.Last = value
+	st.Total += delta
+	return delta, st.Total
+}
+
+// apply transforms a raw counter value according to the counter mode
+// Values pass through unchanged when the transform is off
+func (o counterOptions) apply(nodeID string, value interface{}) (interface{}, error) {
+	if o.mode == "" {
+		return value, nil
+	}
+
+	raw, err := counterValue(value)
+	if err != nil {
+		return nil, err
+	}
+
+	_, shiftStart := o.shifts.at(time.Now())
+	delta, total := o.tracker.update(nodeID, raw, o.max, shiftStart)
+	if o.mode == "delta" {
+		return delta, nil
+	}
+	return total, nil
+}
+
+// counterValue converts a numeric node value to float64
+func counterValue(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	case int32:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case uint:
+		return float64(v), nil
+	case uint32:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	}
+	return 0, fmt.Errorf("value type %T is not a numeric counter", value)
+}
+
+// loadCounterTracker loads counter state from a file
+// A missing file starts with empty state
+func loadCounterTracker(path string) (*counterTracker, error) {
+	tracker := newCounterTracker()
+	if path == "" {
+		return tracker, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return tracker, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read counter state %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, tracker); err != nil {
+		return nil, fmt.Errorf("failed to parse counter state %s: %v", path, err)
+	}
+	if tracker.States == nil {
+		tracker.States = make(map[string]*counterState)
+	}
+	return tracker, nil
+}
+
+// save writes the counter state to the state file, if configured
+func (o counterOptions) save() error {
+	if o.mode == "" || o.stateFile == "" {
+		return nil
+	}
+	data, err := json.Marshal(o.tracker)
+	if err != nil {
+		return fmt.Errorf("failed to encode counter state: %v", err)
+	}
+	if err := os.WriteFile(o.stateFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write counter state %s: %v", o.stateFile, err)
+	}
+	return nil
+}
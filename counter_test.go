@@ -0,0 +1,90 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCounterTrackerUpdate tests deltas and totals across resets and rollovers
+func TestCounterTrackerUpdate(t *testing.T) {
+	tests := []struct {
+		name       string
+		max        float64
+		values     []float64
+		wantDeltas []float64
+		wantTotals []float64
+	}{
+		{
+			name:       "increasing counter",
+			values:     []float64{100, 105, 105, 120},
+			wantDeltas: []float64{0, 5, 0, 15},
+			wantTotals: []float64{100, 105, 105, 120},
+		},
+		{
+			name:       "shift reset to zero",
+			values:     []float64{500, 520, 3, 10},
+			wantDeltas: []float64{0, 20, 3, 7},
+			wantTotals: []float64{500, 520, 523, 530},
+		},
+		{
+			name:       "uint16 rollover",
+			max:        65535,
+			values:     []float64{65530, 65535, 4},
+			wantDeltas: []float64{0, 5, 5},
+			wantTotals: []float64{65530, 65535, 65540},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newCounterTracker()
+			for i, v := range tt.values {
+				delta, total := tracker.update("ns=3;s=Counter", v, tt.max, time.Time{})
+				assert.Equal(t, tt.wantDeltas[i], delta, "delta after value %v", v)
+				assert.Equal(t, tt.wantTotals[i], total, "total after value %v", v)
+			}
+		})
+	}
+}
+
+// TestCounterOptionsApply tests the transform applied to node values
+func TestCounterOptionsApply(t *testing.T) {
+	off := counterOptions{}
+	v, err := off.apply("ns=3;s=Counter", "not a number")
+	require.NoError(t, err)
+	assert.Equal(t, "not a number", v, "values pass through when the transform is off")
+
+	delta := counterOptions{mode: "delta", tracker: newCounterTracker()}
+	_, err = delta.apply("ns=3;s=Counter", float64(10))
+	require.NoError(t, err)
+	v, err = delta.apply("ns=3;s=Counter", uint32(12))
+	require.NoError(t, err)
+	assert.Equal(t, float64(2), v)
+
+	_, err = delta.apply("ns=3;s=Counter", "text")
+	assert.Error(t, err)
+}
+
+// TestCounterStateFile tests that counter state survives between invocations
+func TestCounterStateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "counters.json")
+
+	tracker, err := loadCounterTracker(path)
+	require.NoError(t, err, "missing state file starts empty")
+
+	opts := counterOptions{mode: "total", stateFile: path, tracker: tracker}
+	_, err = opts.apply("ns=3;s=Counter", float64(500))
+	require.NoError(t, err)
+	require.NoError(t, opts.save())
+
+	reloaded, err := loadCounterTracker(path)
+	require.NoError(t, err)
+	opts.tracker = reloaded
+	v, err := opts.apply("ns=3;s=Counter", float64(2)) // reset after restart
+	require.NoError(t, err)
+	assert.Equal(t, float64(502), v)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envFlags are the flags that can also be set with an environment variable,
+// so credentials do not have to appear on the command line (ps, shell
+// history). Flags given on the command line take precedence
+var envFlags = []struct {
+	flag string
+	env  string
+}{
+	{"endpoint", "PLCCLI_ENDPOINT"},
+	{"username", "PLCCLI_USERNAME"},
+	{"credentials-source", "PLCCLI_CREDENTIALS_SOURCE"},
+	{"auth-method", "PLCCLI_AUTH_METHOD"},
+	{"security-policy", "PLCCLI_SECURITY_POLICY"},
+	{"security-mode", "PLCCLI_SECURITY_MODE"},
+	{"connection", "PLCCLI_CONNECTION"},
+	{"ports-file", "PLCCLI_PORTS_FILE"},
+	{"service-host", "PLCCLI_SERVICE_HOST"},
+	{"token", "PLCCLI_TOKEN"},
+	{"permit", "PLCCLI_PERMIT"},
+	{"api-base-path", "PLCCLI_API_BASE_PATH"},
+	{"api-tls-ca", "PLCCLI_API_TLS_CA"},
+	{"influx-token", "PLCCLI_INFLUX_TOKEN"},
+}
+
+// Environment variables of the password, see applyEnvFlags
+const (
+	passwordEnv     = "PLCCLI_PASSWORD"
+	passwordFileEnv = "PLCCLI_PASSWORD_FILE"
+)
+
+// commandLineFlags returns the names of the flags given on the command line,
+// before or after the subcommand
+func commandLineFlags(sets ...*flag.FlagSet) map[string]bool {
+	given := make(map[string]bool)
+	for _, fs := range sets {
+		if fs != nil {
+			fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+		}
+	}
+	return given
+}
+
+// applyEnvFlags sets the flags of envFlags not given on the command line from
+// the environment, and the password from the first of --password,
+// --password-file, $PLCCLI_PASSWORD and $PLCCLI_PASSWORD_FILE
+func applyEnvFlags(fs *flag.FlagSet, given map[string]bool, getenv func(string) string) error {
+	for _, f := range envFlags {
+		if given[f.flag] {
+			continue
+		}
+		if value := getenv(f.env); value != "" {
+			if err := fs.Set(f.flag, value); err != nil {
+				return fmt.Errorf("$%s: %v", f.env, err)
+			}
+		}
+	}
+
+	if given["password"] && given["password-file"] {
+		return fmt.Errorf("--password and --password-file exclude each other")
+	}
+	var file string
+	switch {
+	case given["password"]:
+		return nil
+	case given["password-file"]:
+		file = fs.Lookup("password-file").Value.String()
+	case getenv(passwordEnv) != "":
+		return fs.Set("password", getenv(passwordEnv))
+	case getenv(passwordFileEnv) != "":
+		file = getenv(passwordFileEnv)
+	default:
+		return nil
+	}
+	password, err := readPasswordFile(file)
+	if err != nil {
+		return err
+	}
+	return fs.Set("password", password)
+}
+
+// readPasswordFile reads a password from a file, e.g. a Docker or systemd
+// secret. A trailing line break is not part of the password
+func readPasswordFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the password file: %v", err)
+	}
+	password := strings.TrimRight(string(data), "\r\n")
+	if password == "" {
+		return "", fmt.Errorf("password file %s is empty", path)
+	}
+	return password, nil
+}
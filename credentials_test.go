@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestApplyEnvFlags tests that flags fall back to PLCCLI_* variables and the
+// precedence of the password sources
+func TestApplyEnvFlags(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "password")
+	require.NoError(t, os.WriteFile(secret, []byte("from-file\n"), 0600))
+
+	parse := func(env map[string]string, args ...string) (*flag.FlagSet, error) {
+		fs := flag.NewFlagSet("plccli", flag.ContinueOnError)
+		fs.String("endpoint", "opc.tcp://default:4840", "")
+		fs.String("username", "", "")
+		fs.String("password", "", "")
+		fs.String("password-file", "", "")
+		for _, f := range envFlags {
+			if fs.Lookup(f.flag) == nil {
+				fs.String(f.flag, "", "")
+			}
+		}
+		require.NoError(t, fs.Parse(args))
+		return fs, applyEnvFlags(fs, commandLineFlags(fs), func(key string) string { return env[key] })
+	}
+	value := func(fs *flag.FlagSet, name string) string {
+		return fs.Lookup(name).Value.String()
+	}
+
+	env := map[string]string{"PLCCLI_ENDPOINT": "opc.tcp://env:4840", "PLCCLI_USERNAME": "operator", "PLCCLI_PASSWORD": "from-env"}
+	fs, err := parse(env)
+	require.NoError(t, err)
+	assert.Equal(t, "opc.tcp://env:4840", value(fs, "endpoint"))
+	assert.Equal(t, "operator", value(fs, "username"))
+	assert.Equal(t, "from-env", value(fs, "password"))
+
+	fs, err = parse(env, "--endpoint", "opc.tcp://flag:4840", "--password", "from-flag")
+	require.NoError(t, err)
+	assert.Equal(t, "opc.tcp://flag:4840", value(fs, "endpoint"), "flags take precedence")
+	assert.Equal(t, "from-flag", value(fs, "password"))
+
+	fs, err = parse(env, "--password-file", secret)
+	require.NoError(t, err)
+	assert.Equal(t, "from-file", value(fs, "password"), "--password-file takes precedence over $PLCCLI_PASSWORD")
+
+	fs, err = parse(map[string]string{"PLCCLI_PASSWORD_FILE": secret})
+	require.NoError(t, err)
+	assert.Equal(t, "from-file", value(fs, "password"))
+
+	fs, err = parse(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "opc.tcp://default:4840", value(fs, "endpoint"))
+	assert.Equal(t, "", value(fs, "password"))
+
+	_, err = parse(nil, "--password", "x", "--password-file", secret)
+	assert.Error(t, err)
+	_, err = parse(nil, "--password-file", filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
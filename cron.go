@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Runs further away than this are not searched for by cronSchedule.next, so
+// expressions that never match (e.g. 0 0 30 2 *) end
+const cronHorizon = 5 * 366 * 24 * time.Hour
+
+// Shorthands of cron expressions
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Names of months and weekdays in cron expressions
+var (
+	cronMonths   = []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	cronWeekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// cronSchedule is a parsed five-field cron expression (minute, hour, day of
+// month, month, day of week) as in crontab(5): lists, ranges, steps and the
+// names of months and weekdays. As in cron, a day matches either day field
+// when both are restricted
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64 // Bit n set when n matches
+	domAll, dowAll                bool   // The field started with *
+}
+
+// parseCron parses a cron expression, e.g. "30 5 * * mon-fri" or "@daily"
+func parseCron(expr string) (*cronSchedule, error) {
+	spec := strings.TrimSpace(expr)
+	if macro, ok := cronMacros[strings.ToLower(spec)]; ok {
+		spec = macro
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q, expected minute hour day-of-month month day-of-week", expr)
+	}
+
+	// Like in cron, */n counts as * for the day fields
+	c := &cronSchedule{domAll: strings.HasPrefix(fields[2], "*"), dowAll: strings.HasPrefix(fields[4], "*")}
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("invalid minute in cron expression %q: %v", expr, err)
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("invalid hour in cron expression %q: %v", expr, err)
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("invalid day of month in cron expression %q: %v", expr, err)
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12, cronMonths); err != nil {
+		return nil, fmt.Errorf("invalid month in cron expression %q: %v", expr, err)
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7, cronWeekdays); err != nil {
+		return nil, fmt.Errorf("invalid day of week in cron expression %q: %v", expr, err)
+	}
+	// 7 is Sunday too
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+// parseCronField parses a comma-separated list of *, n or n-m, each
+// optionally with a /step, into a bit set
+func parseCronField(field string, lo, hi int, names []string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		span, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+			step = n
+		}
+
+		var from, to int
+		if span == "*" {
+			from, to = lo, hi
+		} else {
+			fromStr, toStr, isRange := strings.Cut(span, "-")
+			var err error
+			if from, err = parseCronValue(fromStr, lo, hi, names); err != nil {
+				return 0, err
+			}
+			to = from
+			if isRange {
+				if to, err = parseCronValue(toStr, lo, hi, names); err != nil {
+					return 0, err
+				}
+				if to < from {
+					return 0, fmt.Errorf("invalid range %q", span)
+				}
+			} else if hasStep {
+				// n/step runs from n to the end
+				to = hi
+			}
+		}
+		for v := from; v <= to; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// parseCronValue parses a number between lo and hi, or a name of names
+func parseCronValue(s string, lo, hi int, names []string) (int, error) {
+	for i, name := range names {
+		if name != "" && strings.EqualFold(s, name) {
+			return i, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < lo || v > hi {
+		return 0, fmt.Errorf("invalid value %q, expected %d-%d", s, lo, hi)
+	}
+	return v, nil
+}
+
+// matches reports whether the schedule runs in the minute of t, in t's location
+func (c *cronSchedule) matches(t time.Time) bool {
+	return c.minute&(1<<t.Minute()) != 0 && c.hour&(1<<t.Hour()) != 0 &&
+		c.month&(1<<int(t.Month())) != 0 && c.matchesDay(t)
+}
+
+// matchesDay reports whether the schedule runs on the day of t
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<int(t.Weekday())) != 0
+	if c.domAll || c.dowAll {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first minute after t the schedule runs in, false if there
+// is none within cronHorizon
+func (c *cronSchedule) next(t time.Time) (time.Time, bool) {
+	loc := t.Location()
+	limit := t.Add(cronHorizon)
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for !t.After(limit) {
+		switch {
+		case c.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case c.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestParseCron tests the fields, names, steps and macros of cron expressions
+func TestParseCron(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", s, time.UTC)
+		require.NoError(t, err)
+		return tm
+	}
+
+	c, err := parseCron("30 5 * * mon-fri")
+	require.NoError(t, err)
+	assert.True(t, c.matches(at("2026-03-02 05:30")), "Monday")
+	assert.False(t, c.matches(at("2026-03-01 05:30")), "Sunday")
+	assert.False(t, c.matches(at("2026-03-02 05:31")))
+
+	c, err = parseCron("*/15 6-18/6 * jan,jul *")
+	require.NoError(t, err)
+	assert.True(t, c.matches(at("2026-07-10 12:45")))
+	assert.False(t, c.matches(at("2026-07-10 13:45")))
+	assert.False(t, c.matches(at("2026-08-10 12:45")))
+
+	// Either day field matches when both are restricted
+	c, err = parseCron("0 0 1 * 7")
+	require.NoError(t, err)
+	assert.True(t, c.matches(at("2026-03-01 00:00")), "the 1st")
+	assert.True(t, c.matches(at("2026-03-08 00:00")), "a Sunday")
+	assert.False(t, c.matches(at("2026-03-09 00:00")))
+
+	c, err = parseCron("@daily")
+	require.NoError(t, err)
+	assert.True(t, c.matches(at("2026-03-09 00:00")))
+
+	for _, bad := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "* * * * monday"} {
+		_, err := parseCron(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+// TestCronNext tests the search for the next run of cron expressions
+func TestCronNext(t *testing.T) {
+	from := time.Date(2026, 3, 1, 5, 30, 20, 0, time.UTC)
+	for expr, want := range map[string]time.Time{
+		"30 5 * * *":       time.Date(2026, 3, 2, 5, 30, 0, 0, time.UTC),
+		"31 5 * * *":       time.Date(2026, 3, 1, 5, 31, 0, 0, time.UTC),
+		"0 6 * * mon-fri":  time.Date(2026, 3, 2, 6, 0, 0, 0, time.UTC),
+		"0 0 29 2 *":       time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC),
+		"15 22 * dec fri":  time.Date(2026, 12, 4, 22, 15, 0, 0, time.UTC),
+		"@hourly":          time.Date(2026, 3, 1, 6, 0, 0, 0, time.UTC),
+		"0,30 */8 15 * *":  time.Date(2026, 3, 15, 0, 0, 0, 0, time.UTC),
+		"45 23 31 * *":     time.Date(2026, 3, 31, 23, 45, 0, 0, time.UTC),
+		"0 12 * * sat,sun": time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC),
+	} {
+		c, err := parseCron(expr)
+		require.NoError(t, err, expr)
+		next, ok := c.next(from)
+		require.True(t, ok, expr)
+		assert.Equal(t, want, next, expr)
+		assert.True(t, c.matches(next), expr)
+	}
+
+	c, err := parseCron("0 0 30 2 *")
+	require.NoError(t, err)
+	_, ok := c.next(from)
+	assert.False(t, ok, "February 30th")
+
+	// Local time across a DST change
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("no time zone database: %v", err)
+	}
+	c, err = parseCron("30 2 * * *")
+	require.NoError(t, err)
+	next, ok := c.next(time.Date(2026, 3, 28, 12, 0, 0, 0, berlin))
+	require.True(t, ok)
+	assert.Equal(t, time.Date(2026, 3, 30, 2, 30, 0, 0, berlin), next, "2:30 does not exist on March 29th")
+}
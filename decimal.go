@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Values of --decimal-separator, the separators accepted in float and
+// double values to write
+const (
+	decimalAuto  = "auto"  // 3.14 or 3,14; 1,234 is ambiguous
+	decimalPoint = "point" // 3.14 only
+	decimalComma = "comma" // 3,14 or 3.14; 1.234 is ambiguous
+)
+
+// Numbers whose only separator may also separate thousands, like 1,234 or
+// 12.500
+var thousandsGrouped = regexp.MustCompile(`^[+-]?[1-9][0-9]{0,2}[.,][0-9]{3}$`)
+
+// checkDecimalSeparator checks a value of --decimal-separator
+func checkDecimalSeparator(mode string) error {
+	switch mode {
+	case decimalAuto, decimalPoint, decimalComma:
+		return nil
+	}
+	return fmt.Errorf("--decimal-separator must be auto, point or comma, got %q", mode)
+}
+
+// parseDecimal parses a float or double value to write, as typed by
+// operators: with a decimal point or, unless mode is point, a decimal comma.
+// Thousands separators are not accepted, and a value like 1,234 that could
+// have one is rejected as ambiguous, except in the mode where its separator
+// is the decimal one
+func parseDecimal(value string, bitSize int, mode string) (float64, error) {
+	v := strings.TrimSpace(value)
+	points, commas := strings.Count(v, "."), strings.Count(v, ",")
+	switch {
+	case points > 0 && commas > 0:
+		return 0, fmt.Errorf("%q mixes . and ,: use one decimal separator and no thousands separators", value)
+	case points > 1 || commas > 1:
+		return 0, fmt.Errorf("%q has several separators: thousands separators are not accepted", value)
+	case commas == 1 && mode == decimalPoint:
+		return 0, fmt.Errorf("%q has a decimal comma, this service takes a decimal point (--decimal-separator point): write %s", value, strings.Replace(v, ",", ".", 1))
+	case commas == 1 && mode != decimalComma && thousandsGrouped.MatchString(v):
+		return 0, fmt.Errorf("%q is ambiguous: write %s for a decimal or %s for a whole number", value, strings.Replace(v, ",", ".", 1), strings.Replace(v, ",", "", 1))
+	case points == 1 && mode == decimalComma && thousandsGrouped.MatchString(v):
+		return 0, fmt.Errorf("%q is ambiguous: write %s for a decimal or %s for a whole number", value, strings.Replace(v, ".", ",", 1), strings.Replace(v, ".", "", 1))
+	}
+
+	f, err := strconv.ParseFloat(strings.Replace(v, ",", ".", 1), bitSize)
+	if errors.Is(err, strconv.ErrRange) {
+		return 0, fmt.Errorf("%q is out of range of a %d bit float", value, bitSize)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a number", value)
+	}
+	return f, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestParseDecimal tests float values with decimal points and commas in the
+// modes of --decimal-separator
+func TestParseDecimal(t *testing.T) {
+	for _, tc := range []struct {
+		value, mode string
+		want        float64
+		err         string
+	}{
+		{"3.14", decimalAuto, 3.14, ""},
+		{" 3,14 ", decimalAuto, 3.14, ""},
+		{"-0,125", decimalAuto, -0.125, ""},
+		{"1234,5", decimalAuto, 1234.5, ""},
+		{"1.234", decimalAuto, 1.234, ""},
+		{"1e3", decimalAuto, 1000, ""},
+		{"1,234", decimalAuto, 0, `"1,234" is ambiguous: write 1.234 for a decimal or 1234 for a whole number`},
+		{"1.234,5", decimalAuto, 0, `"1.234,5" mixes . and ,`},
+		{"1,234,567", decimalAuto, 0, "several separators"},
+		{"1.2.3", decimalAuto, 0, "several separators"},
+		{"3,14", decimalPoint, 0, "this service takes a decimal point (--decimal-separator point): write 3.14"},
+		{"3.14", decimalPoint, 3.14, ""},
+		{"1,234", decimalComma, 1.234, ""},
+		{"2.5", decimalComma, 2.5, ""},
+		{"1.234", decimalComma, 0, `"1.234" is ambiguous: write 1,234 for a decimal or 1234 for a whole number`},
+		{"warm", decimalAuto, 0, `"warm" is not a number`},
+		{"1e40", decimalAuto, 0, "out of range of a 32 bit float"},
+	} {
+		got, err := parseDecimal(tc.value, 32, tc.mode)
+		if tc.err != "" {
+			assert.ErrorContains(t, err, tc.err, tc.value)
+			continue
+		}
+		if assert.NoError(t, err, tc.value) {
+			assert.InDelta(t, tc.want, got, 1e-4, tc.value)
+		}
+	}
+
+	assert.NoError(t, checkDecimalSeparator("comma"))
+	assert.EqualError(t, checkDecimalSeparator("dot"), `--decimal-separator must be auto, point or comma, got "dot"`)
+}
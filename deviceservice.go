@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// deviceAPI is the HTTP API of a connection to a device without OPC UA
+// sessions, through a backend of pkg/backend like Modbus TCP and
+// EtherNet/IP. Requests open the device connection when needed, so there is
+// no keep-alive or reconnect loop
+type deviceAPI struct {
+	name     string // for logs, e.g. Modbus
+	protocol string // scheme of the backend, e.g. modbus, reported by /api/info
+	endpoint string
+	address  string // host:port of the device
+	example  string // request logged as example usage, e.g. /api/modbus?point=1/holding/0
+	register func(mux *http.ServeMux)
+	close    func()
+}
+
+// setConnection names the connection of a service on port, like
+// startService does for OPC UA connections
+func setConnection(port int, verbose bool) {
+	isVerbose = verbose
+	connectionPort = port
+	if port != 8765 {
+		connectionName = fmt.Sprintf("connection-%d", port)
+	} else {
+		connectionName = "default"
+	}
+}
+
+// run serves the API until SIGINT or SIGTERM, sampling the poll file on
+// the way
+func (d deviceAPI) run(port int) {
+	log.Printf("[%s] Starting %s service for %s on port %d", connectionName, d.name, d.address, port)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	// Sample the points or tags of the poll file
+	if servicePollFile != nil {
+		servicePollFile.start(ctx, d.endpoint)
+	}
+
+	mux := http.NewServeMux()
+	d.registerAll(mux, port)
+	serverAddr := fmt.Sprintf("0.0.0.0:%d", port)
+	server := &http.Server{
+		Addr:    serverAddr,
+		Handler: serviceCORS.middleware(withBasePath(serviceBasePath, serviceAccessLog.middleware(serviceTenants.middleware(serviceUsage.middleware(serviceMaintenance.middleware(servicePermits.middleware(serviceRateLimiter.middleware(mux)))))))),
+	}
+	log.Printf("[%s] %s service running on %s://%s%s", connectionName, d.name, apiScheme(), serverAddr, serviceBasePath)
+	log.Printf("[%s] Example usage: curl %s://%s%s%s", connectionName, apiScheme(), serverAddr, serviceBasePath, d.example)
+	go func() {
+		if err := listenAndServeAPI(ctx, server); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("[%s] HTTP server error: %v", connectionName, err)
+		}
+	}()
+
+	sig := <-sigChan
+	log.Printf("[%s] Received signal %v, shutting down...", connectionName, sig)
+	cancel()
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("[%s] HTTP server shutdown error: %v", connectionName, err)
+	}
+	d.close()
+}
+
+// serveDirect serves the API on a loopback port for --direct, like
+// startDirect does for OPC UA servers
+func (d deviceAPI) serveDirect() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, fmt.Errorf("failed to open loopback listener: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	connectionPort = port
+
+	mux := http.NewServeMux()
+	d.registerAll(mux, port)
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+
+	stopDirect = func() {
+		server.Close()
+		d.close()
+	}
+	return port, nil
+}
+
+// startDeviceDirect prepares logging and the connection name of --direct
+func startDeviceDirect(verbose bool) {
+	isVerbose = verbose
+	connectionName = "direct"
+	if !verbose {
+		log.SetOutput(io.Discard)
+	}
+}
+
+// registerAll registers the protocol's endpoints and those every device
+// connection serves
+func (d deviceAPI) registerAll(mux *http.ServeMux, port int) {
+	d.register(mux)
+
+	// Reads, writes, browsing and streams of any backend
+	mux.HandleFunc("/api/points", handlePointsRequest)
+	mux.HandleFunc("/api/points/browse", handlePointsBrowseRequest)
+	mux.HandleFunc("/api/points/stream", handlePointsStreamRequest)
+
+	// Lines sampled from the poll file
+	mux.HandleFunc("/api/buffer", handleBufferRequest)
+
+	// Recent samples of the polled points, for short trends
+	mux.HandleFunc("/api/recent", handleRecentRequest)
+
+	// Requests, reads, writes and errors of each API client
+	mux.HandleFunc("/api/usage", handleUsageRequest)
+
+	// Time-limited write permits, see --write-permits
+	mux.HandleFunc("/api/permits", handlePermitsRequest)
+	mux.HandleFunc("/api/permits/", handlePermitsRequest)
+
+	// Running and queued writes of /api/points
+	mux.HandleFunc("/api/writes", handleWritesRequest)
+
+	// Four-eyes approval of writes of references marked critical
+	mux.HandleFunc("/api/approvals", handleApprovalsRequest)
+	mux.HandleFunc("/api/approvals/", handleApprovalsRequest)
+
+	// Maintenance window, blocking writes and suppressing alerts
+	mux.HandleFunc("/api/maintenance", handleMaintenanceRequest)
+
+	// Notes of people on the timeline of the connection
+	mux.HandleFunc("/api/annotations", func(w http.ResponseWriter, r *http.Request) {
+		handleAnnotationsRequest(w, r, d.endpoint)
+	})
+
+	// OpenAPI document of this API, see apiOperations
+	mux.HandleFunc("/api/openapi.json", handleOpenAPIRequest)
+
+	mux.HandleFunc("/api/info", func(w http.ResponseWriter, r *http.Request) {
+		info := map[string]interface{}{
+			"connection": connectionName,
+			"port":       port,
+			"endpoint":   d.endpoint,
+			"protocol":   d.protocol,
+			"status":     "connected",
+		}
+		if t := requestTenant(r); t != nil {
+			info["tenant"] = t.Name
+			info["labels"] = t.Labels
+		}
+		if m := serviceMaintenance.status(); m != nil {
+			info["maintenance"] = m
+		}
+		sendJSONResponseGeneric(w, info)
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// stopDirect closes the in-process service started by startDirect, if any
+var stopDirect func()
+
+// startDirect connects to the OPC UA server from the CLI process itself and
+// serves the service API on an ephemeral loopback port, so get/set/browse work
+// without a background service. Returns the port to send requests to
+func startDirect(endpoint, username, password, certfile, keyfile string,
+	gencert bool, appuri string, timeout int, verbose bool) (int, error) {
+	isVerbose = verbose
+	connectionName = "direct"
+
+	// Connection logs would clutter command output, only show them when verbose
+	if !verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	// Single attempt, no jitter or retries: report failures right away
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+	if err := connectOPCUA(ctx, endpoint, username, password, certfile, keyfile, gencert, appuri, timeout); err != nil {
+		return 0, fmt.Errorf("direct connection to %s failed: %v", endpoint, err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		closeOPCUA()
+		return 0, fmt.Errorf("failed to open loopback listener: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	connectionPort = port
+
+	mux := http.NewServeMux()
+	registerHandlers(mux, endpoint, port)
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+
+	stopDirect = func() {
+		server.Close()
+		closeOPCUA()
+	}
+	return port, nil
+}
+
+// closeOPCUA closes the global OPC UA client session
+func closeOPCUA() {
+	clientMutex.Lock()
+	defer clientMutex.Unlock()
+	closeClient(context.Background())
+}
+
+// closeClient closes opcuaClient, if any, and stops its connection state
+// watcher once it has published the close. Callers hold clientMutex
+func closeClient(ctx context.Context) {
+	if opcuaClient == nil {
+		return
+	}
+	opcuaClient.Close(ctx)
+	// Important: Explicitly set to nil to ensure GC and complete cleanup
+	opcuaClient = nil
+	if stopStateWatch != nil {
+		stopStateWatch()
+		stopStateWatch = nil
+	}
+}
+
+// exitWithCode closes a direct session before exiting, so the PLC does not keep
+// an orphaned session until it times out
+func exitWithCode(code int) {
+	if stopDirect != nil {
+		stopDirect()
+	}
+	os.Exit(code)
+}
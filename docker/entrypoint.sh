@@ -11,7 +11,8 @@ echo "opc ua endpoint: $OPCUA_ENDPOINT"
 # Start the plccli service in the background if OPCUA variables are provided
 if [ ! -z "$OPCUA_ENDPOINT" ] && [ ! -z "$OPCUA_USERNAME" ] && [ ! -z "$OPCUA_PASSWORD" ]; then
     echo "Starting PLCCLI service in background..."
-    /usr/bin/plccli --service --endpoint "$OPCUA_ENDPOINT" --username "$OPCUA_USERNAME" --password "$OPCUA_PASSWORD" &
+    # Credentials in the environment, not on the command line where ps shows them
+    PLCCLI_ENDPOINT="$OPCUA_ENDPOINT" PLCCLI_USERNAME="$OPCUA_USERNAME" PLCCLI_PASSWORD="$OPCUA_PASSWORD" /usr/bin/plccli --service &
 
     # Brief delay to ensure the service process has started (not for connection establishment)
     # The service will retry connections indefinitely with exponential backoff and random jitter
@@ -51,7 +51,7 @@ fi
 
 # 3. Verify service HTTP endpoint is responding
 echo -n "Testing service HTTP endpoint ... "
-if ! timeout 2 curl -sf http://localhost:8765/api/info > /dev/null 2>&1; then
+if ! timeout 2 curl -sf "http://localhost:8765${PLCCLI_API_BASE_PATH%/}/api/info" > /dev/null 2>&1; then
     echo "WARN: Service info endpoint not responding (non-critical)"
     # Don't fail on this, just warn
 else
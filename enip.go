@@ -0,0 +1,616 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EtherNet/IP encapsulation commands
+const (
+	enipRegisterSession   = 0x65
+	enipUnregisterSession = 0x66
+	enipSendRRData        = 0x6F
+)
+
+// CIP services
+const (
+	cipReadTag         = 0x4C
+	cipWriteTag        = 0x4D
+	cipUnconnectedSend = 0x52
+)
+
+const (
+	defaultENIPPort        = "44818"
+	defaultENIPMeasurement = "enip"
+	maxENIPTags            = 256 // Per API read
+	enipHeaderSize         = 24
+	cipStructType          = 0x02A0 // Type code of structures, followed by their handle
+	logixStringHandle      = 0x0FCE // Structure handle of the built-in STRING type
+	logixStringSize        = 82     // Characters of a STRING
+)
+
+// cipType is an atomic data type of Logix tags
+type cipType struct {
+	name string
+	code uint16
+	size int
+}
+
+var cipTypes = []cipType{
+	{"BOOL", 0xC1, 1},
+	{"SINT", 0xC2, 1},
+	{"INT", 0xC3, 2},
+	{"DINT", 0xC4, 4},
+	{"LINT", 0xC5, 8},
+	{"USINT", 0xC6, 1},
+	{"UINT", 0xC7, 2},
+	{"UDINT", 0xC8, 4},
+	{"ULINT", 0xC9, 8},
+	{"REAL", 0xCA, 4},
+	{"LREAL", 0xCB, 8},
+	{"BYTE", 0xD1, 1},
+	{"WORD", 0xD2, 2},
+	{"DWORD", 0xD3, 4},
+	{"LWORD", 0xD4, 8},
+}
+
+// cipTypeByCode returns the atomic type of a type code
+func cipTypeByCode(code uint16) (cipType, bool) {
+	for _, t := range cipTypes {
+		if t.code == code {
+			return t, true
+		}
+	}
+	return cipType{}, false
+}
+
+// enipValue is the raw value of a tag: its type code, the structure handle
+// for structures, and the data in little-endian order
+type enipValue struct {
+	typ    uint16
+	handle uint16
+	data   []byte
+}
+
+// enipValueType returns the type of a write of dataType (e.g. DINT, real or
+// STRING) without reading the tag
+func enipValueType(dataType string) (enipValue, error) {
+	name := strings.ToUpper(strings.TrimSpace(dataType))
+	if name == "STRING" {
+		return enipValue{typ: cipStructType, handle: logixStringHandle}, nil
+	}
+	for _, t := range cipTypes {
+		if t.name == name {
+			return enipValue{typ: t.code}, nil
+		}
+	}
+	return enipValue{}, fmt.Errorf("unknown data type %s, expected BOOL, SINT, INT, DINT, LINT, USINT, UINT, UDINT, ULINT, REAL, LREAL, BYTE, WORD, DWORD, LWORD or STRING", dataType)
+}
+
+// typeName returns the Logix name of the value's type
+func (v enipValue) typeName() string {
+	if v.typ == cipStructType {
+		if v.handle == logixStringHandle {
+			return "STRING"
+		}
+		return fmt.Sprintf("STRUCT(0x%04X)", v.handle)
+	}
+	if t, ok := cipTypeByCode(v.typ); ok {
+		return t.name
+	}
+	return fmt.Sprintf("0x%04X", v.typ)
+}
+
+// decode returns the Go value of a tag value
+func (v enipValue) decode() (interface{}, error) {
+	if v.typ == cipStructType {
+		if v.handle != logixStringHandle {
+			return nil, fmt.Errorf("structure tags (handle 0x%04X) cannot be read as a whole, read their members, e.g. Tag.Member", v.handle)
+		}
+		if len(v.data) < 4 {
+			return nil, fmt.Errorf("STRING value with %d bytes", len(v.data))
+		}
+		n := int(int32(binary.LittleEndian.Uint32(v.data)))
+		n = max(0, min(n, len(v.data)-4, logixStringSize))
+		return string(v.data[4 : 4+n]), nil
+	}
+	t, ok := cipTypeByCode(v.typ)
+	if !ok {
+		return nil, fmt.Errorf("unsupported data type 0x%04X", v.typ)
+	}
+	if len(v.data) < t.size {
+		return nil, fmt.Errorf("%s value with %d bytes", t.name, len(v.data))
+	}
+	var raw uint64
+	for i := t.size - 1; i >= 0; i-- {
+		raw = raw<<8 | uint64(v.data[i])
+	}
+	switch t.name {
+	case "BOOL":
+		return raw != 0, nil
+	case "SINT":
+		return int8(raw), nil
+	case "INT":
+		return int16(raw), nil
+	case "DINT":
+		return int32(raw), nil
+	case "LINT":
+		return int64(raw), nil
+	case "USINT", "BYTE":
+		return uint8(raw), nil
+	case "UINT", "WORD":
+		return uint16(raw), nil
+	case "UDINT", "DWORD":
+		return uint32(raw), nil
+	case "REAL":
+		return math.Float32frombits(uint32(raw)), nil
+	case "LREAL":
+		return math.Float64frombits(raw), nil
+	}
+	return raw, nil
+}
+
+// encode returns the data of a value written to a tag of the value's type
+func (v enipValue) encode(value string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	if v.typ == cipStructType {
+		if v.handle != logixStringHandle {
+			return nil, fmt.Errorf("structure tags (handle 0x%04X) cannot be written as a whole, write their members", v.handle)
+		}
+		if len(value) > logixStringSize {
+			return nil, fmt.Errorf("STRING values have at most %d characters, got %d", logixStringSize, len(value))
+		}
+		// LEN, DATA[82] and the padding to the 88 bytes of the structure
+		data := make([]byte, 4+logixStringSize+2)
+		binary.LittleEndian.PutUint32(data, uint32(len(value)))
+		copy(data[4:], value)
+		return data, nil
+	}
+	t, ok := cipTypeByCode(v.typ)
+	if !ok {
+		return nil, fmt.Errorf("unsupported data type 0x%04X", v.typ)
+	}
+	var raw uint64
+	var err error
+	switch t.name {
+	case "BOOL":
+		var on bool
+		if on, err = strconv.ParseBool(value); on {
+			raw = 0xFF
+		}
+	case "SINT", "INT", "DINT", "LINT":
+		var n int64
+		n, err = strconv.ParseInt(value, 0, 8*t.size)
+		raw = uint64(n)
+	case "REAL":
+		var f float64
+		if f, err = parseDecimal(value, 32, *decimalSeparator); err != nil {
+			return nil, fmt.Errorf("invalid %s value: %v", t.name, err)
+		}
+		raw = uint64(math.Float32bits(float32(f)))
+	case "LREAL":
+		var f float64
+		if f, err = parseDecimal(value, 64, *decimalSeparator); err != nil {
+			return nil, fmt.Errorf("invalid %s value: %v", t.name, err)
+		}
+		raw = math.Float64bits(f)
+	default:
+		raw, err = strconv.ParseUint(value, 0, 8*t.size)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s value %q", t.name, value)
+	}
+	data := make([]byte, t.size)
+	for i := range data {
+		data[i] = byte(raw >> (8 * i))
+	}
+	return data, nil
+}
+
+// enipTag is a symbolic Logix tag, e.g. Program:Main.Recipe[2].Setpoint
+type enipTag struct {
+	name string // As given, without surrounding spaces
+	path []byte // CIP request path of the tag
+}
+
+var (
+	enipTagMember = regexp.MustCompile(`^((?i:program):)?[A-Za-z_][A-Za-z0-9_]*(\[[0-9, ]+\])?$`)
+	enipTagIndex  = regexp.MustCompile(`\[([0-9, ]+)\]$`)
+)
+
+// isENIPTag reports whether s names a Logix tag rather than an OPC UA node
+// ID (which has =) or a Modbus point (which has /)
+func isENIPTag(s string) bool {
+	s = strings.TrimSpace(s)
+	return s != "" && !strings.ContainsAny(s, "=/")
+}
+
+// parseENIPTag parses a tag name: members separated by dots, array elements
+// in brackets (Tag[3], Matrix[1,2]) and program tags as Program:Name.Tag
+func parseENIPTag(s string) (enipTag, error) {
+	tag := enipTag{name: strings.TrimSpace(s)}
+	if !isENIPTag(tag.name) {
+		return tag, fmt.Errorf("invalid tag %q, expected e.g. Counter, Program:Main.Recipe[2].Setpoint", s)
+	}
+	for i, member := range strings.Split(tag.name, ".") {
+		if _, err := strconv.Atoi(member); err == nil && i > 0 {
+			return tag, fmt.Errorf("invalid tag %q: bits of integer tags cannot be addressed, read the tag with --bits", s)
+		}
+		if !enipTagMember.MatchString(member) || (i > 0 && strings.Contains(member, ":")) {
+			return tag, fmt.Errorf("invalid tag %q: bad member %q", s, member)
+		}
+		name := member
+		var indexes []string
+		if m := enipTagIndex.FindStringSubmatch(member); m != nil {
+			name = strings.TrimSuffix(member, m[0])
+			indexes = strings.Split(m[1], ",")
+			if len(indexes) > 3 {
+				return tag, fmt.Errorf("invalid tag %q: arrays have at most 3 dimensions", s)
+			}
+		}
+		if len(name) > 40 && !strings.Contains(name, ":") {
+			return tag, fmt.Errorf("invalid tag %q: names have at most 40 characters", s)
+		}
+
+		// ANSI extended symbol segment, padded to an even length
+		tag.path = append(tag.path, 0x91, byte(len(name)))
+		tag.path = append(tag.path, name...)
+		if len(name)%2 == 1 {
+			tag.path = append(tag.path, 0)
+		}
+		for _, index := range indexes {
+			n, err := strconv.ParseUint(strings.TrimSpace(index), 10, 32)
+			if err != nil {
+				return tag, fmt.Errorf("invalid tag %q: bad index %q", s, index)
+			}
+			switch {
+			case n <= 0xFF:
+				tag.path = append(tag.path, 0x28, byte(n))
+			case n <= 0xFFFF:
+				tag.path = binary.LittleEndian.AppendUint16(append(tag.path, 0x29, 0), uint16(n))
+			default:
+				tag.path = binary.LittleEndian.AppendUint32(append(tag.path, 0x2A, 0), uint32(n))
+			}
+		}
+	}
+	return tag, nil
+}
+
+// cipError is an error status of a CIP reply
+type cipError struct {
+	status   byte
+	extended []uint16
+}
+
+var cipStatusNames = map[byte]string{
+	0x04: "unknown tag or bad path",
+	0x05: "path destination unknown",
+	0x06: "reply too large",
+	0x08: "service not supported",
+	0x0F: "privilege violation",
+	0x10: "device state conflict",
+	0x13: "not enough data",
+	0x1E: "embedded service error",
+	0x26: "invalid path size",
+	0xFF: "general error",
+}
+
+var cipExtendedNames = map[uint16]string{
+	0x2104: "offset out of range",
+	0x2105: "array index out of range",
+	0x2107: "data type mismatch",
+}
+
+func (e *cipError) Error() string {
+	msg := fmt.Sprintf("CIP error 0x%02X", e.status)
+	if name, ok := cipStatusNames[e.status]; ok {
+		msg += " (" + name + ")"
+	}
+	for _, ext := range e.extended {
+		if name, ok := cipExtendedNames[ext]; ok {
+			msg += fmt.Sprintf(", 0x%04X (%s)", ext, name)
+		} else {
+			msg += fmt.Sprintf(", 0x%04X", ext)
+		}
+	}
+	return msg
+}
+
+// enipClient talks to a ControlLogix or CompactLogix controller over
+// EtherNet/IP. Requests are sent as unconnected messages routed over the
+// backplane to the controller's slot, over one TCP connection and session
+// that is opened again after errors. Requests are serialized
+type enipClient struct {
+	address string // host:port
+	slot    byte   // Backplane slot of the controller
+	timeout time.Duration
+	mu      sync.Mutex
+	conn    net.Conn
+	session uint32
+	context uint64 // Sender context of the last request
+}
+
+// newENIPClient returns a client of an enip://host[:port][?slot=N] endpoint
+func newENIPClient(endpoint string, timeout time.Duration) (*enipClient, error) {
+	address, slot, err := enipAddress(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &enipClient{address: address, slot: slot, timeout: timeout}, nil
+}
+
+// isENIPEndpoint reports whether an endpoint is an EtherNet/IP controller
+func isENIPEndpoint(endpoint string) bool {
+	return strings.HasPrefix(endpoint, "enip://")
+}
+
+// enipAddress returns host:port and the controller slot of an enip://
+// endpoint. The slot defaults to 0
+func enipAddress(endpoint string) (string, byte, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || !isENIPEndpoint(endpoint) || u.Hostname() == "" {
+		return "", 0, fmt.Errorf("invalid EtherNet/IP endpoint %q, expected enip://host[:port][?slot=N]", endpoint)
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultENIPPort
+	}
+	var slot uint64
+	if s := u.Query().Get("slot"); s != "" {
+		if slot, err = strconv.ParseUint(s, 10, 8); err != nil {
+			return "", 0, fmt.Errorf("invalid slot %q in EtherNet/IP endpoint %q", s, endpoint)
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port), byte(slot), nil
+}
+
+// close ends the session and closes the connection, the next request opens
+// a new one
+func (c *enipClient) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+		c.conn.Write(c.frame(enipUnregisterSession, nil))
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// do sends a CIP request to the controller and returns the reply data.
+// Callers must not hold c.mu
+func (c *enipClient) do(req []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := c.exchange(req)
+	var cipErr *cipError
+	if err != nil && !errors.As(err, &cipErr) {
+		// The stream or session may be broken, start over with a new connection
+		c.conn.Close()
+		c.conn = nil
+	}
+	return resp, err
+}
+
+// connect opens the TCP connection and registers a session. Callers must
+// hold c.mu
+func (c *enipClient) connect() error {
+	conn, err := net.DialTimeout("tcp", c.address, c.timeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to EtherNet/IP device %s: %v", c.address, err)
+	}
+	c.conn, c.session = conn, 0
+	// Protocol version 1, no options
+	data, err := c.roundTrip(enipRegisterSession, []byte{1, 0, 0, 0})
+	if err == nil && len(data) < 4 {
+		err = fmt.Errorf("truncated RegisterSession response")
+	}
+	if err != nil {
+		conn.Close()
+		c.conn = nil
+		return fmt.Errorf("failed to register EtherNet/IP session with %s: %v", c.address, err)
+	}
+	return nil
+}
+
+// frame returns an encapsulation message of the session
+func (c *enipClient) frame(command uint16, data []byte) []byte {
+	frame := make([]byte, enipHeaderSize, enipHeaderSize+len(data))
+	binary.LittleEndian.PutUint16(frame[0:], command)
+	binary.LittleEndian.PutUint16(frame[2:], uint16(len(data)))
+	binary.LittleEndian.PutUint32(frame[4:], c.session)
+	binary.LittleEndian.PutUint64(frame[12:], c.context)
+	return append(frame, data...)
+}
+
+// roundTrip sends an encapsulation message and returns the data of its
+// response. A RegisterSession response sets the session. Callers must hold
+// c.mu
+func (c *enipClient) roundTrip(command uint16, data []byte) ([]byte, error) {
+	c.context++
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := c.conn.Write(c.frame(command, data)); err != nil {
+		return nil, fmt.Errorf("EtherNet/IP request failed: %v", err)
+	}
+	header := make([]byte, enipHeaderSize)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		return nil, fmt.Errorf("EtherNet/IP response failed: %v", err)
+	}
+	resp := make([]byte, binary.LittleEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(c.conn, resp); err != nil {
+		return nil, fmt.Errorf("EtherNet/IP response failed: %v", err)
+	}
+	if got := binary.LittleEndian.Uint16(header[0:]); got != command {
+		return nil, fmt.Errorf("EtherNet/IP response with command 0x%02X to command 0x%02X", got, command)
+	}
+	if status := binary.LittleEndian.Uint32(header[8:]); status != 0 {
+		return nil, fmt.Errorf("EtherNet/IP encapsulation status 0x%04X", status)
+	}
+	if ctx := binary.LittleEndian.Uint64(header[12:]); ctx != c.context {
+		return nil, fmt.Errorf("EtherNet/IP response to request %d, expected %d", ctx, c.context)
+	}
+	if command == enipRegisterSession {
+		c.session = binary.LittleEndian.Uint32(header[4:])
+	}
+	return resp, nil
+}
+
+// exchange sends a CIP request routed to the controller's slot and returns
+// the data of its reply. Callers must hold c.mu
+func (c *enipClient) exchange(req []byte) ([]byte, error) {
+	// Unconnected Send to the Connection Manager (class 6, instance 1) with
+	// the request, routed over the backplane (port 1) to the slot
+	msg := []byte{cipUnconnectedSend, 2, 0x20, 0x06, 0x24, 0x01, 0x0A, 0x05}
+	msg = binary.LittleEndian.AppendUint16(msg, uint16(len(req)))
+	msg = append(msg, req...)
+	if len(req)%2 == 1 {
+		msg = append(msg, 0)
+	}
+	msg = append(msg, 1, 0, 0x01, c.slot)
+
+	// Interface handle, timeout and the common packet format: a null
+	// address item and an unconnected data item
+	data := make([]byte, 16, 16+len(msg))
+	binary.LittleEndian.PutUint16(data[4:], 10)
+	binary.LittleEndian.PutUint16(data[6:], 2)
+	binary.LittleEndian.PutUint16(data[12:], 0xB2)
+	binary.LittleEndian.PutUint16(data[14:], uint16(len(msg)))
+	data = append(data, msg...)
+
+	resp, err := c.roundTrip(enipSendRRData, data)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := unconnectedData(resp)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) < 4 {
+		return nil, fmt.Errorf("truncated CIP reply")
+	}
+	if service := reply[0] &^ 0x80; reply[0]&0x80 == 0 || (service != req[0] && service != cipUnconnectedSend) {
+		return nil, fmt.Errorf("CIP reply with service 0x%02X to service 0x%02X", reply[0], req[0])
+	}
+	extSize := int(reply[3])
+	if len(reply) < 4+2*extSize {
+		return nil, fmt.Errorf("truncated CIP reply")
+	}
+	if reply[2] != 0 {
+		e := &cipError{status: reply[2]}
+		for i := 0; i < extSize; i++ {
+			e.extended = append(e.extended, binary.LittleEndian.Uint16(reply[4+2*i:]))
+		}
+		return nil, e
+	}
+	return reply[4+2*extSize:], nil
+}
+
+// unconnectedData returns the unconnected data item of a SendRRData
+// response
+func unconnectedData(resp []byte) ([]byte, error) {
+	if len(resp) < 8 {
+		return nil, fmt.Errorf("truncated SendRRData response")
+	}
+	count := int(binary.LittleEndian.Uint16(resp[6:]))
+	items := resp[8:]
+	for i := 0; i < count; i++ {
+		if len(items) < 4 {
+			break
+		}
+		typ := binary.LittleEndian.Uint16(items)
+		size := int(binary.LittleEndian.Uint16(items[2:]))
+		if len(items) < 4+size {
+			break
+		}
+		if typ == 0xB2 {
+			return items[4 : 4+size], nil
+		}
+		items = items[4+size:]
+	}
+	return nil, fmt.Errorf("SendRRData response without unconnected data")
+}
+
+// read reads the raw value of a tag
+func (c *enipClient) read(tag enipTag) (enipValue, error) {
+	req := append([]byte{cipReadTag, byte(len(tag.path) / 2)}, tag.path...)
+	req = binary.LittleEndian.AppendUint16(req, 1)
+	data, err := c.do(req)
+	if err != nil {
+		return enipValue{}, err
+	}
+	if len(data) < 2 {
+		return enipValue{}, fmt.Errorf("truncated Read Tag reply")
+	}
+	v := enipValue{typ: binary.LittleEndian.Uint16(data), data: data[2:]}
+	if v.typ == cipStructType {
+		if len(v.data) < 2 {
+			return enipValue{}, fmt.Errorf("truncated Read Tag reply")
+		}
+		v.handle, v.data = binary.LittleEndian.Uint16(v.data), v.data[2:]
+	}
+	return v, nil
+}
+
+// readTags reads tags one request each. Results are in the order of the
+// tags, failures are reported per tag
+func (c *enipClient) readTags(tags []enipTag) []NodeResponse {
+	results := make([]NodeResponse, len(tags))
+	for i, tag := range tags {
+		results[i].NodeID = tag.name
+		v, err := c.read(tag)
+		if err != nil {
+			results[i].Error = fmt.Sprintf("Failed to read tag: %v", err)
+			continue
+		}
+		results[i].DataType = v.typeName()
+		if results[i].Value, err = v.decode(); err != nil {
+			results[i].Error = err.Error()
+		}
+	}
+	return results
+}
+
+// write writes a value to a tag and returns the data type written. Without
+// a data type the tag is read first to learn its type
+func (c *enipClient) write(tag enipTag, value, dataType string) (string, error) {
+	var v enipValue
+	var err error
+	if dataType != "" {
+		v, err = enipValueType(dataType)
+	} else {
+		v, err = c.read(tag)
+	}
+	if err != nil {
+		return "", err
+	}
+	if v.data, err = v.encode(value); err != nil {
+		return "", err
+	}
+
+	req := append([]byte{cipWriteTag, byte(len(tag.path) / 2)}, tag.path...)
+	req = binary.LittleEndian.AppendUint16(req, v.typ)
+	if v.typ == cipStructType {
+		req = binary.LittleEndian.AppendUint16(req, v.handle)
+	}
+	req = binary.LittleEndian.AppendUint16(req, 1)
+	req = append(req, v.data...)
+	if _, err := c.do(req); err != nil {
+		return "", err
+	}
+	return v.typeName(), nil
+}
@@ -0,0 +1,364 @@
+//go:build !minimal && !noenip
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeLogix is an EtherNet/IP server answering Read Tag and Write Tag
+// requests routed to a controller slot
+type fakeLogix struct {
+	mu       sync.Mutex
+	tags     map[string]enipValue
+	slot     byte // Slot of the last routed request
+	sessions int
+}
+
+func startFakeLogix(t *testing.T) (*fakeLogix, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	d := &fakeLogix{tags: map[string]enipValue{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+	return d, "enip://" + listener.Addr().String()
+}
+
+func (d *fakeLogix) set(name string, v enipValue) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tags[name] = v
+}
+
+func (d *fakeLogix) get(name string) enipValue {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.tags[name]
+}
+
+func (d *fakeLogix) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		header := make([]byte, enipHeaderSize)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		data := make([]byte, binary.LittleEndian.Uint16(header[2:]))
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return
+		}
+		var resp []byte
+		switch binary.LittleEndian.Uint16(header) {
+		case enipRegisterSession:
+			d.mu.Lock()
+			d.sessions++
+			d.mu.Unlock()
+			binary.LittleEndian.PutUint32(header[4:], 0x1234)
+			resp = data
+		case enipSendRRData:
+			// Unconnected data item after the null address item
+			msg := data[16:]
+			size := int(binary.LittleEndian.Uint16(msg[8:]))
+			req := msg[10 : 10+size]
+			d.mu.Lock()
+			d.slot = msg[len(msg)-1]
+			d.mu.Unlock()
+			reply := d.handle(req)
+			resp = make([]byte, 16)
+			binary.LittleEndian.PutUint16(resp[6:], 2)
+			binary.LittleEndian.PutUint16(resp[12:], 0xB2)
+			binary.LittleEndian.PutUint16(resp[14:], uint16(len(reply)))
+			resp = append(resp, reply...)
+		default:
+			return
+		}
+		binary.LittleEndian.PutUint16(header[2:], uint16(len(resp)))
+		conn.Write(append(header, resp...))
+	}
+}
+
+// handle answers a Read Tag or Write Tag request
+func (d *fakeLogix) handle(req []byte) []byte {
+	service := req[0]
+	path := req[2 : 2+2*int(req[1])]
+	rest := req[2+len(path):]
+	var name string
+	for len(path) > 0 {
+		switch path[0] {
+		case 0x91:
+			if name != "" {
+				name += "."
+			}
+			n := int(path[1])
+			name += string(path[2 : 2+n])
+			path = path[2+n+n%2:]
+		case 0x28, 0x29, 0x2A:
+			var index uint32
+			switch path[0] {
+			case 0x28:
+				index, path = uint32(path[1]), path[2:]
+			case 0x29:
+				index, path = uint32(binary.LittleEndian.Uint16(path[2:])), path[4:]
+			default:
+				index, path = binary.LittleEndian.Uint32(path[2:]), path[6:]
+			}
+			if strings.HasSuffix(name, "]") {
+				name = strings.TrimSuffix(name, "]") + fmt.Sprintf(",%d]", index)
+			} else {
+				name += fmt.Sprintf("[%d]", index)
+			}
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	v, ok := d.tags[name]
+	if !ok {
+		return []byte{service | 0x80, 0, 0x04, 0}
+	}
+	switch service {
+	case cipReadTag:
+		reply := binary.LittleEndian.AppendUint16([]byte{service | 0x80, 0, 0, 0}, v.typ)
+		if v.typ == cipStructType {
+			reply = binary.LittleEndian.AppendUint16(reply, v.handle)
+		}
+		return append(reply, v.data...)
+	case cipWriteTag:
+		typ := binary.LittleEndian.Uint16(rest)
+		rest = rest[2:]
+		if typ == cipStructType {
+			rest = rest[2:]
+		}
+		if typ != v.typ {
+			return []byte{service | 0x80, 0, 0xFF, 1, 0x07, 0x21}
+		}
+		v.data = append([]byte(nil), rest[2:]...)
+		d.tags[name] = v
+		return []byte{service | 0x80, 0, 0, 0}
+	}
+	return []byte{service | 0x80, 0, 0x08, 0}
+}
+
+// TestENIPTag tests the request paths of tags and rejected tag names
+func TestENIPTag(t *testing.T) {
+	tag, err := parseENIPTag(" Counter ")
+	require.NoError(t, err)
+	assert.Equal(t, "Counter", tag.name)
+	assert.Equal(t, []byte{0x91, 7, 'C', 'o', 'u', 'n', 't', 'e', 'r', 0}, tag.path)
+
+	tag, err = parseENIPTag("Program:Main.Recipe[2].SP")
+	require.NoError(t, err)
+	want := append([]byte{0x91, 12}, "Program:Main"...)
+	want = append(append(want, 0x91, 6), "Recipe"...)
+	want = append(append(want, 0x28, 2, 0x91, 2), "SP"...)
+	assert.Equal(t, want, tag.path)
+
+	tag, err = parseENIPTag("M[1,300,70000]")
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x91, 1, 'M', 0, 0x28, 1, 0x29, 0, 0x2C, 0x01, 0x2A, 0, 0x70, 0x11, 0x01, 0x00}, tag.path)
+
+	for _, bad := range []string{"", "Status.5", "1st", "a..b", "A[1,2,3,4]", "ns=3;s=Temp", "1/holding/0", "Main.Program:X", "Tag[x]"} {
+		_, err := parseENIPTag(bad)
+		assert.Error(t, err, bad)
+	}
+	assert.True(t, isENIPTag("Program:Main.Temp"))
+	assert.False(t, isENIPTag("ns=3;s=Temp"))
+	assert.False(t, isENIPTag("1/coil/0"))
+}
+
+// TestENIPValue tests encoding and decoding values of the Logix types
+func TestENIPValue(t *testing.T) {
+	for _, tc := range []struct {
+		dataType string
+		value    string
+		want     interface{}
+	}{
+		{"BOOL", "true", true},
+		{"sint", "-5", int8(-5)},
+		{"INT", "-1000", int16(-1000)},
+		{"DINT", "-100000", int32(-100000)},
+		{"LINT", "1234567890123", int64(1234567890123)},
+		{"UDINT", "4000000000", uint32(4000000000)},
+		{"REAL", "1.5", float32(1.5)},
+		{"LREAL", "-2.25", -2.25},
+		{"LREAL", "-2,25", -2.25},
+		{"STRING", "Batch 42", "Batch 42"},
+	} {
+		v, err := enipValueType(tc.dataType)
+		require.NoError(t, err, tc.dataType)
+		v.data, err = v.encode(tc.value)
+		require.NoError(t, err, tc.dataType)
+		got, err := v.decode()
+		require.NoError(t, err, tc.dataType)
+		assert.Equal(t, tc.want, got, tc.dataType)
+		assert.Equal(t, strings.ToUpper(tc.dataType), v.typeName())
+	}
+
+	sint, _ := enipValueType("SINT")
+	_, err := sint.encode("300")
+	assert.Error(t, err)
+	_, err = enipValueType("TIMER")
+	assert.Error(t, err)
+	str, _ := enipValueType("STRING")
+	_, err = str.encode(strings.Repeat("x", 83))
+	assert.Error(t, err)
+
+	udt := enipValue{typ: cipStructType, handle: 0x1234, data: make([]byte, 12)}
+	_, err = udt.decode()
+	assert.ErrorContains(t, err, "read their members")
+}
+
+// TestENIPClient tests reads and writes routed to the controller slot,
+// CIP errors and reconnects
+func TestENIPClient(t *testing.T) {
+	device, endpoint := startFakeLogix(t)
+	device.set("Counter", enipValue{typ: 0xC4, data: []byte{0x2A, 0, 0, 0}})
+	device.set("Program:Main.Temp", enipValue{typ: 0xCA, data: []byte{0, 0, 0xC8, 0x41}})
+	device.set("Recipe[2].Name", enipValue{typ: cipStructType, handle: logixStringHandle, data: make([]byte, 88)})
+	device.set("Motor", enipValue{typ: cipStructType, handle: 0x5A5A, data: make([]byte, 8)})
+
+	client, err := newENIPClient(endpoint+"?slot=2", 2*time.Second)
+	require.NoError(t, err)
+	defer client.close()
+
+	var tags []enipTag
+	for _, name := range []string{"Counter", "Program:Main.Temp", "Missing", "Motor"} {
+		tag, err := parseENIPTag(name)
+		require.NoError(t, err)
+		tags = append(tags, tag)
+	}
+	results := client.readTags(tags)
+	assert.Equal(t, int32(42), results[0].Value)
+	assert.Equal(t, "DINT", results[0].DataType)
+	assert.Equal(t, float32(25), results[1].Value)
+	assert.Contains(t, results[2].Error, "unknown tag")
+	assert.Contains(t, results[3].Error, "read their members")
+	assert.Equal(t, byte(2), device.slot)
+
+	// Writes learn the type from the tag, or take it as given
+	counter, _ := parseENIPTag("Counter")
+	dataType, err := client.write(counter, "-7", "")
+	require.NoError(t, err)
+	assert.Equal(t, "DINT", dataType)
+	assert.Equal(t, []byte{0xF9, 0xFF, 0xFF, 0xFF}, device.get("Counter").data)
+	_, err = client.write(counter, "1.5", "REAL")
+	var cipErr *cipError
+	require.ErrorAs(t, err, &cipErr)
+	assert.Contains(t, err.Error(), "data type mismatch")
+
+	name, _ := parseENIPTag("Recipe[2].Name")
+	_, err = client.write(name, "Batch 42", "")
+	require.NoError(t, err)
+	results = client.readTags([]enipTag{name})
+	assert.Equal(t, "Batch 42", results[0].Value)
+	assert.Equal(t, "STRING", results[0].DataType)
+
+	// CIP errors keep the session, broken connections get a new one
+	assert.Equal(t, 1, device.sessions)
+	client.mu.Lock()
+	client.conn.Close()
+	client.mu.Unlock()
+	results = client.readTags([]enipTag{counter})
+	assert.Contains(t, results[0].Error, "Failed to read tag")
+	results = client.readTags([]enipTag{counter})
+	assert.Equal(t, int32(-7), results[0].Value)
+	assert.Equal(t, 2, device.sessions)
+
+	_, _, err = enipAddress("enip://plc?slot=256")
+	assert.Error(t, err)
+	address, slot, err := enipAddress("enip://plc")
+	require.NoError(t, err)
+	assert.Equal(t, "plc:44818", address)
+	assert.Equal(t, byte(0), slot)
+}
+
+// TestENIPAPI tests /api/enip with the client library and the sampling of
+// tags of a poll file
+func TestENIPAPI(t *testing.T) {
+	device, endpoint := startFakeLogix(t)
+	device.set("Speed", enipValue{typ: 0xC3, data: []byte{0x10, 0x00}})
+	client, err := newENIPClient(endpoint, 2*time.Second)
+	require.NoError(t, err)
+	defer client.close()
+	defer func() { serviceENIP, serviceBackend = nil, nil }()
+	b := &enipBackend{client: client}
+	serviceBackend = b
+
+	mux := http.NewServeMux()
+	b.api(endpoint).registerAll(mux, 8765)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	api := newServiceClient(u.Hostname(), port)
+	written, err := api.WriteENIP(ctx, "Speed", "1500", "")
+	require.NoError(t, err)
+	assert.Equal(t, "INT", written.DataType)
+	results, err := api.ReadENIP(ctx, "Speed", "Missing")
+	require.NoError(t, err)
+	assert.Equal(t, 1500.0, results[0].Value)
+	assert.NotNil(t, results[0].SourceTimestamp)
+	assert.NotEmpty(t, results[1].Error)
+	_, err = api.ReadENIP(ctx, "Speed.3")
+	assert.ErrorContains(t, err, "--bits")
+
+	resp, err := http.Get(server.URL + "/api/info")
+	require.NoError(t, err)
+	var info map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&info))
+	resp.Body.Close()
+	assert.Equal(t, "enip", info["protocol"])
+
+	// Poll files sample tags with the enip measurement, and only fit
+	// EtherNet/IP connections
+	path := filepath.Join(t.TempDir(), "polls.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("polls:\n  - node: Speed\n    interval: 1s\n"), 0644))
+	pf, err := loadPollFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "enip", pf.Polls[0].Measurement)
+	assert.NoError(t, pf.checkEndpoint(endpoint))
+	assert.Error(t, pf.checkEndpoint("opc.tcp://plc:4840"))
+	assert.Error(t, pf.checkEndpoint("modbus://meter"))
+	samples := readBackendSample(t.Context(), []string{"Speed"}, false)
+	assert.Equal(t, int16(1500), samples[0].Value)
+
+	// The same tags through the backend API
+	point, err := api.WritePoint(ctx, "Speed", "1200", "INT")
+	require.NoError(t, err)
+	assert.Equal(t, "INT", point.DataType)
+	results, err = api.ReadPoints(ctx, "Speed")
+	require.NoError(t, err)
+	assert.Equal(t, 1200.0, results[0].Value)
+	_, err = api.BrowsePoints(ctx, "", 1)
+	assert.ErrorContains(t, err, "not supported")
+}
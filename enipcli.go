@@ -0,0 +1,96 @@
+//go:build !minimal && !noenip
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"umicli/pkg/plcclient"
+)
+
+// runENIPCommand runs enip get or set against the service of an
+// EtherNet/IP connection, or against the controller itself with --direct
+func runENIPCommand(args []string, port int, influxOpts influxOptions) {
+	if len(args) < 1 || (args[0] != "get" && args[0] != "set") {
+		printUsage()
+		os.Exit(exitUsage)
+	}
+
+	host, port, influxOpts := deviceService(port, influxOpts)
+	if *direct {
+		defer stopDirect()
+	}
+
+	switch args[0] {
+	case "get":
+		tags := args[1:]
+		if len(tags) == 0 {
+			fmt.Fprintf(os.Stderr, "Error: enip get needs at least one tag\n")
+			exitWithCode(exitUsage)
+		}
+		for _, name := range tags {
+			if _, err := parseENIPTag(name); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exitWithCode(exitBadNode)
+			}
+		}
+		bitOpts := deviceBitOptions()
+
+		// The default measurement of OPC UA nodes does not fit Logix tags
+		name := *measurement
+		if name == "opcua_node" {
+			name = defaultENIPMeasurement
+		}
+		if *interval > 0 {
+			pollDeviceValues(func() (string, error) {
+				return getENIPValues(tags, host, port, *outputFormat, name, bitOpts, influxOpts)
+			}, *interval)
+			return
+		}
+		value, err := getENIPValues(tags, host, port, *outputFormat, name, bitOpts, influxOpts)
+		if err != nil {
+			handleConnectionError(err)
+		}
+		fmt.Println(value)
+
+	case "set":
+		if len(args) < 3 || len(args) > 4 {
+			fmt.Println("Error: enip set needs <tag> <value> [type]")
+			printUsage()
+			exitWithCode(exitUsage)
+		}
+		dataType := ""
+		if len(args) == 4 {
+			dataType = args[3]
+		}
+		if _, err := parseENIPTag(args[1]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exitWithCode(exitBadNode)
+		}
+		result, err := setENIPValue(args[1], args[2], dataType, host, port)
+		if err != nil {
+			handleConnectionError(err)
+		}
+		fmt.Println(result)
+	}
+}
+
+// getENIPValues reads Logix tags through the service and formats them like
+// opcua get, with the tag as node_id
+func getENIPValues(tags []string, host string, port int, format string, measurement string, bitOpts bitOptions, influxOpts influxOptions) (string, error) {
+	return getDeviceValues(tags, (*plcclient.HTTPClient).ReadENIP, host, port, format, measurement, bitOpts, influxOpts)
+}
+
+// setENIPValue writes a value to a Logix tag through the service
+func setENIPValue(tag, value, dataType, host string, port int) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout(10*time.Second))
+	defer cancel()
+	result, err := newServiceClient(host, port).WriteENIP(ctx, tag, value, dataType)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Successfully set %s to %v with type %s (via %s:%d)", result.NodeID, result.Value, result.DataType, host, port), nil
+}
@@ -0,0 +1,183 @@
+//go:build !minimal && !noenip
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+
+	"umicli/pkg/backend"
+)
+
+// EtherNet/IP client of a service or direct mode with an enip:// endpoint,
+// nil for other connections
+var serviceENIP *enipClient
+
+// enipAPI is the HTTP API of an EtherNet/IP connection
+func enipAPI(endpoint string, client *enipClient) deviceAPI {
+	return deviceAPI{
+		name:     "EtherNet/IP",
+		protocol: "enip",
+		endpoint: endpoint,
+		address:  client.address,
+		example:  "/api/enip?tag=Program:Main.Counter",
+		register: func(mux *http.ServeMux) {
+			// Reads (GET) and writes (POST) of Logix tags
+			mux.HandleFunc("/api/enip", handleENIPRequest)
+		},
+		close: client.close,
+	}
+}
+
+// handleENIPRequest reads the tags of ?tag=... (GET) or writes {"tag",
+// "value", "dataType"} (POST). Writes without a data type read the tag
+// first to learn it
+func handleENIPRequest(w http.ResponseWriter, r *http.Request) {
+	if serviceENIP == nil {
+		sendJSONResponseGeneric(w, map[string]string{"error": "Not an EtherNet/IP connection, use --endpoint enip://host:44818"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		names := r.URL.Query()["tag"]
+		if len(names) == 0 {
+			sendJSONResponseGeneric(w, map[string]string{"error": "Missing tag parameter"})
+			return
+		}
+		if len(names) > maxENIPTags {
+			sendJSONResponseGeneric(w, map[string]string{"error": fmt.Sprintf("Too many tags, at most %d per read", maxENIPTags)})
+			return
+		}
+		tags := make([]enipTag, len(names))
+		for i, name := range names {
+			tag, err := parseENIPTag(name)
+			if err != nil {
+				sendJSONResponseGeneric(w, map[string]string{"error": err.Error()})
+				return
+			}
+			tags[i] = tag
+		}
+		results := serviceENIP.readTags(tags)
+		sampled := time.Now()
+		stampResults(results, sampled)
+		serviceRecent.record(results, sampled)
+		sendJSONResponseGeneric(w, map[string]interface{}{"results": results})
+
+	case http.MethodPost:
+		var req struct {
+			Tag      string `json:"tag"`
+			Value    string `json:"value"`
+			DataType string `json:"dataType"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendJSONResponseGeneric(w, NodeResponse{Error: fmt.Sprintf("Invalid request body: %v", err)})
+			return
+		}
+		tag, err := parseENIPTag(req.Tag)
+		if err != nil {
+			sendJSONResponseGeneric(w, NodeResponse{NodeID: req.Tag, Error: err.Error(), StatusCode: uint32(ua.StatusBadNodeIDInvalid)})
+			return
+		}
+		dataType, err := serviceENIP.write(tag, req.Value, req.DataType)
+		if err != nil {
+			log.Printf("[%s] EtherNet/IP write of %s failed: %v", connectionName, tag.name, err)
+			sendJSONResponseGeneric(w, NodeResponse{NodeID: tag.name, Error: fmt.Sprintf("Failed to write tag: %v", err)})
+			return
+		}
+		if isVerbose {
+			log.Printf("[%s] Wrote %s to %s", connectionName, strings.TrimSpace(req.Value), tag.name)
+		}
+		sendJSONResponseGeneric(w, NodeResponse{NodeID: tag.name, Value: strings.TrimSpace(req.Value), DataType: dataType})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func init() {
+	includeComponent("enip")
+	backend.Register("enip", "EtherNet/IP", newENIPBackend)
+}
+
+// enipBackend is the backend of enip:// endpoints. Next to /api/points its
+// service serves /api/enip
+type enipBackend struct {
+	client *enipClient
+}
+
+func newENIPBackend(endpoint string, opts backend.Options) (backend.Backend, error) {
+	client, err := newENIPClient(endpoint, opts.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &enipBackend{client: client}, nil
+}
+
+// api makes the client the service's EtherNet/IP client and returns its API
+func (b *enipBackend) api(endpoint string) deviceAPI {
+	serviceENIP = b.client
+	return enipAPI(endpoint, b.client)
+}
+
+// Connect registers a session unless one is open
+func (b *enipBackend) Connect(ctx context.Context) error {
+	b.client.mu.Lock()
+	defer b.client.mu.Unlock()
+	if b.client.conn != nil {
+		return nil
+	}
+	return b.client.connect()
+}
+
+// Read reads tags one request each
+func (b *enipBackend) Read(ctx context.Context, refs []string) ([]NodeResponse, error) {
+	tags := make([]enipTag, len(refs))
+	for i, ref := range refs {
+		tag, err := parseENIPTag(ref)
+		if err != nil {
+			return nil, err
+		}
+		tags[i] = tag
+	}
+	results := b.client.readTags(tags)
+	for i := range results {
+		results[i].RequestedNodeID = refs[i]
+	}
+	return results, nil
+}
+
+// Write writes a tag. Without a data type the tag is read first to learn it
+func (b *enipBackend) Write(ctx context.Context, ref, value, dataType string) (NodeResponse, error) {
+	tag, err := parseENIPTag(ref)
+	if err != nil {
+		return NodeResponse{}, err
+	}
+	written, err := b.client.write(tag, value, dataType)
+	if err != nil {
+		return NodeResponse{}, err
+	}
+	return NodeResponse{NodeID: tag.name, RequestedNodeID: ref, Value: strings.TrimSpace(value), DataType: written}, nil
+}
+
+// Browse is not supported yet, listing the tags of a controller needs the
+// Symbol Object
+func (b *enipBackend) Browse(ctx context.Context, ref string, maxDepth int) ([]BrowseNode, error) {
+	return nil, backend.ErrNotSupported
+}
+
+func (b *enipBackend) Subscribe(ctx context.Context, refs []string, interval time.Duration, fn func([]NodeResponse)) error {
+	return backend.Poll(ctx, b, refs, interval, fn)
+}
+
+func (b *enipBackend) Close() error {
+	b.client.close()
+	return nil
+}
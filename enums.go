@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// enumCache remembers the symbolic names of enumeration data types, so the
+// EnumStrings/EnumValues properties are only read once per data type
+type enumCache struct {
+	mu        sync.Mutex
+	types     map[string]map[int64]string // nil for data types that are no enumeration
+	nodeTypes map[string]*ua.NodeID       // Data type of each node seen
+}
+
+// Global enumeration cache for service mode
+var serviceEnums = newEnumCache()
+
+func newEnumCache() *enumCache {
+	return &enumCache{
+		types:     make(map[string]map[int64]string),
+		nodeTypes: make(map[string]*ua.NodeID),
+	}
+}
+
+// name returns the symbolic name of an enumeration value read from a node
+// Returns an empty name when the node's data type is no enumeration or the
+// value has no name
+func (c *enumCache) name(ctx context.Context, client *opcua.Client, nodeID *ua.NodeID, value interface{}) (string, error) {
+	number, ok := enumNumber(value)
+	if !ok {
+		return "", nil
+	}
+
+	dataTypeID, err := c.nodeDataType(ctx, client, nodeID)
+	if err != nil {
+		return "", err
+	}
+
+	names, err := c.enumNames(ctx, client, dataTypeID)
+	if err != nil {
+		return "", err
+	}
+	return names[number], nil
+}
+
+// nodeDataType returns the DataType attribute of a node
+func (c *enumCache) nodeDataType(ctx context.Context, client *opcua.Client, nodeID *ua.NodeID) (*ua.NodeID, error) {
+	key := nodeID.String()
+	c.mu.Lock()
+	dataTypeID, cached := c.nodeTypes[key]
+	c.mu.Unlock()
+	if cached {
+		return dataTypeID, nil
+	}
+
+	attrs, err := client.Node(nodeID).Attributes(ctx, ua.AttributeIDDataType)
+	if err != nil {
+		return nil, err
+	}
+	if len(attrs) == 0 || attrs[0].Status != ua.StatusOK || attrs[0].Value == nil {
+		return nil, fmt.Errorf("DataType attribute not readable")
+	}
+	dataTypeID = attrs[0].Value.NodeID()
+	if dataTypeID == nil {
+		return nil, fmt.Errorf("DataType attribute is empty")
+	}
+
+	c.mu.Lock()
+	c.nodeTypes[key] = dataTypeID
+	c.mu.Unlock()
+	return dataTypeID, nil
+}
+
+// enumNames returns the value names of an enumeration data type, nil if the
+// data type is no enumeration
+func (c *enumCache) enumNames(ctx context.Context, client *opcua.Client, dataTypeID *ua.NodeID) (map[int64]string, error) {
+	// Built-in scalar types never carry enumeration names
+	if _, builtin := dataTypeNameForID(dataTypeID); builtin {
+		return nil, nil
+	}
+
+	key := dataTypeID.String()
+	c.mu.Lock()
+	names, cached := c.types[key]
+	c.mu.Unlock()
+	if cached {
+		return names, nil
+	}
+
+	names, err := readEnumNames(ctx, client, dataTypeID)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.types[key] = names
+	c.mu.Unlock()
+	return names, nil
+}
+
+// readEnumNames reads the EnumStrings or EnumValues property of a data type
+// EnumStrings names the values 0..n-1, EnumValues lists value/name pairs
+func readEnumNames(ctx context.Context, client *opcua.Client, dataTypeID *ua.NodeID) (map[int64]string, error) {
+	props, err := client.Node(dataTypeID).ReferencedNodes(ctx, id.HasProperty, ua.BrowseDirectionForward, ua.NodeClassAll, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to browse properties of data type %s: %v", dataTypeID, err)
+	}
+
+	for _, prop := range props {
+		browseName, err := prop.BrowseName(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read property name of data type %s: %v", dataTypeID, err)
+		}
+		if browseName.Name != "EnumStrings" && browseName.Name != "EnumValues" {
+			continue
+		}
+
+		value, err := prop.Value(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s of data type %s: %v", browseName.Name, dataTypeID, err)
+		}
+		return parseEnumNames(value.Value()), nil
+	}
+	return nil, nil
+}
+
+// parseEnumNames converts an EnumStrings or EnumValues property value to a
+// value-to-name map
+func parseEnumNames(value interface{}) map[int64]string {
+	names := make(map[int64]string)
+	switch v := value.(type) {
+	case []*ua.LocalizedText:
+		for i, text := range v {
+			if text != nil {
+				names[int64(i)] = text.Text
+			}
+		}
+	case []*ua.ExtensionObject:
+		for _, obj := range v {
+			if obj == nil {
+				continue
+			}
+			if enumValue, ok := obj.Value.(*ua.EnumValueType); ok && enumValue.DisplayName != nil {
+				names[enumValue.Value] = enumValue.DisplayName.Text
+			}
+		}
+	}
+	return names
+}
+
+// enumNumber converts an integer node value to an enumeration value
+func enumNumber(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		if v > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// setResponseEnumName adds the symbolic name of an enumeration value to a read
+// response. Failing lookups leave the numeric value alone
+func setResponseEnumName(ctx context.Context, client *opcua.Client, nodeID *ua.NodeID, response *NodeResponse) {
+	name, err := serviceEnums.name(ctx, client, nodeID, response.Value)
+	if err != nil {
+		if isVerbose {
+			log.Printf("[%s] Enumeration lookup of %v failed: %v", connectionName, nodeID, err)
+		}
+		return
+	}
+	response.EnumName = name
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestParseEnumNames tests decoding EnumStrings and EnumValues properties
+func TestParseEnumNames(t *testing.T) {
+	enumStrings := []*ua.LocalizedText{
+		ua.NewLocalizedText("Stopped"),
+		ua.NewLocalizedText("Starting"),
+		ua.NewLocalizedText("Running"),
+	}
+	assert.Equal(t, map[int64]string{0: "Stopped", 1: "Starting", 2: "Running"}, parseEnumNames(enumStrings))
+
+	enumValues := []*ua.ExtensionObject{
+		{Value: &ua.EnumValueType{Value: 10, DisplayName: ua.NewLocalizedText("Idle")}},
+		{Value: &ua.EnumValueType{Value: 20, DisplayName: ua.NewLocalizedText("Fault")}},
+		nil,
+	}
+	assert.Equal(t, map[int64]string{10: "Idle", 20: "Fault"}, parseEnumNames(enumValues))
+
+	assert.Empty(t, parseEnumNames("not an enumeration"))
+}
+
+// TestEnumNumber tests which node values can be enumeration values
+func TestEnumNumber(t *testing.T) {
+	for _, value := range []interface{}{int32(3), uint16(3), int64(3), uint8(3)} {
+		number, ok := enumNumber(value)
+		assert.True(t, ok, "%T", value)
+		assert.Equal(t, int64(3), number)
+	}
+	for _, value := range []interface{}{3.0, "3", true, uint64(1 << 63)} {
+		_, ok := enumNumber(value)
+		assert.False(t, ok, "%T", value)
+	}
+}
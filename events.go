@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of connection events
+const (
+	eventConnect    = "connect"    // first session after the service started
+	eventDisconnect = "disconnect" // session found dead, reconnecting
+	eventReconnect  = "reconnect"  // new session after a disconnect
+)
+
+// Events kept for clients that resume a stream with Last-Event-ID
+const maxRecentEvents = 100
+
+// How long a --on-disconnect-cmd hook may run
+const eventHookTimeout = time.Minute
+
+// Comment sent on idle event streams so proxies keep them open
+const eventStreamPing = 15 * time.Second
+
+// serviceEvent is a change of the service's connection to the PLC
+type serviceEvent struct {
+	ID          int64     `json:"id"`
+	Type        string    `json:"type"`
+	Time        time.Time `json:"time"`
+	Connection  string    `json:"connection"`
+	Endpoint    string    `json:"endpoint"`
+	Error       string    `json:"error,omitempty"`       // why the session was dropped
+	Attempts    int       `json:"attempts,omitempty"`    // connection attempts it took
+	Downtime    string    `json:"downtime,omitempty"`    // since the disconnect, for reconnects
+	Maintenance bool      `json:"maintenance,omitempty"` // during a maintenance window, see maintenance.go
+}
+
+// eventBus hands connection events to the /api/events streams and runs the
+// disconnect hook, so operators get alerted when a PLC link drops
+type eventBus struct {
+	mu             sync.Mutex
+	endpoint       string
+	hook           string // shell command run on disconnects
+	nextID         int64
+	recent         []serviceEvent
+	subscribers    map[chan serviceEvent]struct{}
+	disconnectedAt time.Time
+	maintenance    *maintenanceMode // marks the events during its windows, nil for none
+}
+
+// Connection events of this service
+var serviceEvents = newEventBus(serviceMaintenance)
+
+func newEventBus(maintenance *maintenanceMode) *eventBus {
+	return &eventBus{subscribers: make(map[chan serviceEvent]struct{}), maintenance: maintenance}
+}
+
+// publish stamps an event and delivers it. Streams too slow to take it miss it
+func (b *eventBus) publish(e serviceEvent) serviceEvent {
+	e.Maintenance = b.maintenance.active()
+	b.mu.Lock()
+	b.nextID++
+	e.ID = b.nextID
+	e.Time = time.Now().UTC()
+	e.Connection = connectionName
+	e.Endpoint = b.endpoint
+	switch e.Type {
+	case eventDisconnect:
+		b.disconnectedAt = e.Time
+	case eventReconnect:
+		if !b.disconnectedAt.IsZero() {
+			e.Downtime = e.Time.Sub(b.disconnectedAt).Round(time.Second).String()
+		}
+	}
+	b.recent = append(b.recent, e)
+	if len(b.recent) > maxRecentEvents {
+		b.recent = b.recent[len(b.recent)-maxRecentEvents:]
+	}
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+	hook := b.hook
+	b.mu.Unlock()
+
+	log.Printf("[%s] Connection event: %s", connectionName, e.Type)
+	if hook != "" && e.Type == eventDisconnect {
+		// Planned work takes PLCs offline, nobody needs to be paged for it
+		if e.Maintenance {
+			log.Printf("[%s] Hook for %s event skipped during maintenance", connectionName, e.Type)
+		} else {
+			go runEventHook(hook, e)
+		}
+	}
+	return e
+}
+
+// subscribe returns a channel of the events after the given ID, starting
+// with the recent ones, and a function to stop the subscription
+func (b *eventBus) subscribe(after int64) (<-chan serviceEvent, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan serviceEvent, maxRecentEvents+16)
+	for _, e := range b.recent {
+		if e.ID > after {
+			ch <- e
+		}
+	}
+	b.subscribers[ch] = struct{}{}
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers, ch)
+	}
+}
+
+// lastID returns the ID of the latest event, 0 before the first one
+func (b *eventBus) lastID() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.nextID
+}
+
+// runEventHook runs a hook command with sh. The event is in the environment
+// as PLCCLI_EVENT, PLCCLI_CONNECTION, PLCCLI_ENDPOINT, PLCCLI_ERROR and, as
+// JSON, PLCCLI_EVENT_JSON
+func runEventHook(command string, e serviceEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), eventHookTimeout)
+	defer cancel()
+
+	data, _ := json.Marshal(e)
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"PLCCLI_EVENT="+e.Type,
+		"PLCCLI_CONNECTION="+e.Connection,
+		"PLCCLI_ENDPOINT="+e.Endpoint,
+		"PLCCLI_ERROR="+e.Error,
+		"PLCCLI_EVENT_JSON="+string(data),
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		log.Printf("[%s] Hook for %s event failed: %v: %s", connectionName, e.Type, err, out)
+		return
+	}
+	if isVerbose {
+		log.Printf("[%s] Hook for %s event ran: %s", connectionName, e.Type, out)
+	}
+}
+
+// handleEventsRequest streams the connection events as server-sent events.
+// A client that reconnects with Last-Event-ID gets the events it missed, as
+// far as they are still kept
+func handleEventsRequest(w http.ResponseWriter, r *http.Request) {
+	streamEvents(w, r, serviceEvents)
+}
+
+// streamPaths are the API paths of server-sent event streams, with those
+// below them like /api/events/connection. Streams stay open while clients
+// listen, see rateLimiter
+var streamPaths = []string{"/api/events", "/api/points/stream"}
+
+// isStream reports whether a request is for an event stream
+func isStream(r *http.Request) bool {
+	for _, p := range streamPaths {
+		if r.URL.Path == p || strings.HasPrefix(r.URL.Path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// streamEvents streams the events of a bus as server-sent events
+func streamEvents(w http.ResponseWriter, r *http.Request, bus *eventBus) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	after := bus.lastID()
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		id, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid Last-Event-ID %q", lastEventID), http.StatusBadRequest)
+			return
+		}
+		after = id
+	}
+	events, stop := bus.subscribe(after)
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ping := time.NewTicker(eventStreamPing)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case e := <-events:
+			data, _ := json.Marshal(e)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestEventBus tests delivering, replaying and timing connection events
+func TestEventBus(t *testing.T) {
+	b := newEventBus(nil)
+	b.endpoint = "opc.tcp://plc:4840"
+
+	connect := b.publish(serviceEvent{Type: eventConnect, Attempts: 1})
+	assert.Equal(t, int64(1), connect.ID)
+	assert.Equal(t, "opc.tcp://plc:4840", connect.Endpoint)
+
+	events, stop := b.subscribe(0)
+	defer stop()
+	assert.Equal(t, eventConnect, (<-events).Type, "recent events are replayed")
+
+	b.publish(serviceEvent{Type: eventDisconnect, Error: "keep-alive failed"})
+	b.publish(serviceEvent{Type: eventReconnect, Attempts: 3})
+	assert.Equal(t, "keep-alive failed", (<-events).Error)
+	reconnect := <-events
+	assert.Equal(t, eventReconnect, reconnect.Type)
+	assert.NotEmpty(t, reconnect.Downtime)
+
+	// A stream resumed after the disconnect only gets the reconnect
+	resumed, stopResumed := b.subscribe(2)
+	defer stopResumed()
+	assert.Equal(t, int64(3), (<-resumed).ID)
+	assert.Empty(t, resumed)
+}
+
+// TestEventHook tests that the disconnect hook gets the event
+func TestEventHook(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "hook.txt")
+	runEventHook(`echo "$PLCCLI_EVENT $PLCCLI_ERROR" > `+out, serviceEvent{Type: eventDisconnect, Error: "keep-alive failed"})
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, "disconnect keep-alive failed\n", string(data))
+}
+
+// TestHandleEventsRequest tests the server-sent event stream
+func TestHandleEventsRequest(t *testing.T) {
+	defer func() { serviceEvents = newEventBus(nil) }()
+	serviceEvents = newEventBus(nil)
+	serviceEvents.publish(serviceEvent{Type: eventConnect, Attempts: 1})
+
+	srv := httptest.NewServer(http.HandlerFunc(handleEventsRequest))
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", "0")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		serviceEvents.publish(serviceEvent{Type: eventDisconnect, Error: "no session"})
+	}()
+
+	lines := bufio.NewScanner(resp.Body)
+	var types []string
+	for len(types) < 2 && lines.Scan() {
+		if data, ok := strings.CutPrefix(lines.Text(), "data: "); ok {
+			var e serviceEvent
+			require.NoError(t, json.Unmarshal([]byte(data), &e))
+			types = append(types, e.Type)
+		}
+	}
+	assert.Equal(t, []string{eventConnect, eventDisconnect}, types)
+
+	rec := httptest.NewRecorder()
+	handleEventsRequest(rec, httptest.NewRequest(http.MethodPost, "/api/events", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
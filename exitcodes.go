@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gopcua/opcua/ua"
+
+	"umicli/pkg/plcclient"
+)
+
+// Exit codes of plccli, one per class of failure, so shell scripts and
+// Ansible tasks can branch on why a command failed. They are part of the CLI,
+// described by exitCodeClasses; do not renumber them
+const (
+	exitFailure       = 1
+	exitUsage         = 2
+	exitConnection    = 3
+	exitBadNode       = 4
+	exitWriteRejected = 5
+	exitTypeError     = 6
+	exitTimeout       = 7
+)
+
+// exitCodeClasses describes the exit codes, for plccli capabilities
+var exitCodeClasses = []capabilityExitCode{
+	{0, "ok", "The command succeeded"},
+	{exitFailure, "failure", "A check did not pass (assert, test, validate) or an error of no other class"},
+	{exitUsage, "usage", "Invalid arguments, flags or configuration files"},
+	{exitConnection, "connection", "The service is not running or the PLC or device cannot be reached"},
+	{exitBadNode, "bad-node", "Invalid or unknown node ID, tag or address"},
+	{exitWriteRejected, "write-rejected", "Write refused by the write policy, limits, permits, approvals, maintenance or access level"},
+	{exitTypeError, "type-error", "The value does not fit the data type"},
+	{exitTimeout, "timeout", "The operation or the connection timed out"},
+}
+
+// Exit codes of the OPC UA status codes the service reports with node errors
+// (plcclient.NodeResponse.StatusCode) and the client library returns
+var exitCodeStatuses = map[ua.StatusCode]int{
+	ua.StatusBadNotConnected:            exitConnection,
+	ua.StatusBadServerNotConnected:      exitConnection,
+	ua.StatusBadConnectionClosed:        exitConnection,
+	ua.StatusBadSecureChannelClosed:     exitConnection,
+	ua.StatusBadCommunicationError:      exitConnection,
+	ua.StatusBadSessionClosed:           exitConnection,
+	ua.StatusBadSessionIDInvalid:        exitConnection,
+	ua.StatusBadTimeout:                 exitTimeout,
+	ua.StatusBadNodeIDUnknown:           exitBadNode,
+	ua.StatusBadNodeIDInvalid:           exitBadNode,
+	ua.StatusBadAttributeIDInvalid:      exitBadNode,
+	ua.StatusBadBrowseNameInvalid:       exitBadNode,
+	ua.StatusBadNotWritable:             exitWriteRejected,
+	ua.StatusBadUserAccessDenied:        exitWriteRejected,
+	ua.StatusBadWriteNotSupported:       exitWriteRejected,
+	ua.StatusBadNotSupported:            exitWriteRejected,
+	ua.StatusBadTypeMismatch:            exitTypeError,
+	ua.StatusBadOutOfRange:              exitTypeError,
+	ua.StatusBadDataEncodingInvalid:     exitTypeError,
+	ua.StatusBadDataEncodingUnsupported: exitTypeError,
+}
+
+// Exit codes of the HTTP statuses of requests the service refuses
+var exitCodeHTTPStatuses = map[int]int{
+	http.StatusForbidden:          exitWriteRejected, // Write permits and read-only tenants
+	http.StatusLocked:             exitWriteRejected, // Maintenance windows
+	http.StatusServiceUnavailable: exitConnection,    // The service has no OPC UA session
+}
+
+// exitCode returns the exit code of the class of an error, by its type and
+// the status codes the service reported, never by its text
+func exitCode(err error) int {
+	var failure *scriptFailure
+	if errors.As(err, &failure) {
+		return exitFailure
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return exitTimeout
+	}
+	var connErr *plcclient.ConnectionError
+	if errors.As(err, &connErr) {
+		var timeout interface{ Timeout() bool }
+		if errors.As(err, &timeout) && timeout.Timeout() {
+			return exitTimeout
+		}
+		return exitConnection
+	}
+	if errors.Is(err, plcclient.ErrInvalidNodeID) {
+		return exitBadNode
+	}
+	var serviceErr *plcclient.ServiceError
+	if errors.As(err, &serviceErr) {
+		if code, ok := exitCodeStatuses[ua.StatusCode(serviceErr.StatusCode)]; ok {
+			return code
+		}
+		if code, ok := exitCodeHTTPStatuses[serviceErr.HTTPStatus]; ok {
+			return code
+		}
+		return exitFailure
+	}
+	var status ua.StatusCode
+	if errors.As(err, &status) {
+		if code, ok := exitCodeStatuses[status]; ok {
+			return code
+		}
+	}
+	return exitFailure
+}
+
+// exitWithError prints an error and exits with the code of its class
+func exitWithError(err error) {
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	exitWithCode(exitCode(err))
+}
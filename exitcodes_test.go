@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+
+	"umicli/pkg/plcclient"
+)
+
+// timeoutError is a net.Error that timed out, like the errors of an
+// http.Client with a Timeout
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "Client.Timeout exceeded while awaiting headers" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// TestExitCode tests the exit codes of the errors the CLI reports
+func TestExitCode(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	for _, tc := range []struct {
+		name string
+		err  error
+		code int
+	}{
+		{"service not running", &plcclient.ConnectionError{Host: "localhost", Port: 8765, Err: &url.Error{Op: "Get", URL: "http://localhost:8765/api/node", Err: refused}}, exitConnection},
+		{"service without session", &plcclient.ServiceError{Message: "OPCUA client not connected", HTTPStatus: http.StatusServiceUnavailable}, exitConnection},
+		{"node read without session", &plcclient.ServiceError{Message: "OPCUA client not connected", StatusCode: uint32(ua.StatusBadNotConnected)}, exitConnection},
+		{"read on a closed connection", &plcclient.ServiceError{Message: "Failed to read node: " + ua.StatusBadConnectionClosed.Error(), StatusCode: uint32(ua.StatusBadConnectionClosed)}, exitConnection},
+		{"service timeout", &plcclient.ConnectionError{Host: "localhost", Port: 8765, Err: &url.Error{Op: "Get", URL: "http://localhost:8765/api/node", Err: timeoutError{}}}, exitTimeout},
+		{"deadline", fmt.Errorf("read: %w", context.DeadlineExceeded), exitTimeout},
+		{"PLC timeout", &plcclient.ServiceError{Message: "Failed to read node: " + ua.StatusBadTimeout.Error(), StatusCode: uint32(ua.StatusBadTimeout)}, exitTimeout},
+		{"node ID syntax", fmt.Errorf("%w format. Expected format: ns=X,Y=Z or ns=X;Y=Z", plcclient.ErrInvalidNodeID), exitBadNode},
+		{"unknown node", &plcclient.ServiceError{Message: "Failed to read node: " + ua.StatusBadNodeIDUnknown.Error(), StatusCode: uint32(ua.StatusBadNodeIDUnknown)}, exitBadNode},
+		{"write policy", &plcclient.ServiceError{Message: "writing ns=3;s=Cmd.SafetyReset is denied by rule ns=3;s=Cmd.SafetyReset of the write policy", StatusCode: uint32(ua.StatusBadUserAccessDenied)}, exitWriteRejected},
+		{"write permit", &plcclient.ServiceError{Message: "Forbidden: writes need an active write permit (--permit)", HTTPStatus: http.StatusForbidden}, exitWriteRejected},
+		{"maintenance", &plcclient.ServiceError{Message: "Locked: the connection is under maintenance: drive replacement", HTTPStatus: http.StatusLocked}, exitWriteRejected},
+		{"access level", &plcclient.ServiceError{Message: "Write operation failed with status: " + ua.StatusBadNotWritable.Error(), StatusCode: uint32(ua.StatusBadNotWritable)}, exitWriteRejected},
+		{"value conversion", &plcclient.ServiceError{Message: `Failed to create variant: "hot" is not a number`, StatusCode: uint32(ua.StatusBadTypeMismatch)}, exitTypeError},
+		{"server type check", ua.StatusBadTypeMismatch, exitTypeError},
+		{"failed assert", fmt.Errorf("start.plc:4: assert ns=3;s=Mode == Auto: %w", &scriptFailure{"timed out after 10s, the value is 1"}), exitFailure},
+		{"failed tests", errors.New("2 of 3 tests did not pass"), exitFailure},
+		{"cancelled write", errors.New("write cancelled, ns=3;s=Setpoint was not changed"), exitFailure},
+		{"service error without status", &plcclient.ServiceError{Message: "Too many points, at most 100 per read"}, exitFailure},
+		// Errors are classified by type, not by words in their text
+		{"write limits file", errors.New("invalid write limits file limits.yaml: yaml: line 3: did not find expected key"), exitFailure},
+		{"data type in text", errors.New("data type is required for writing values"), exitFailure},
+		{"data type in service text", &plcclient.ServiceError{Message: "Failed to determine data type automatically: EOF"}, exitFailure},
+		{"timed out in text", errors.New("job 7 timed out"), exitFailure},
+		{"connection refused in text", errors.New("webhook: connection refused"), exitFailure},
+	} {
+		assert.Equal(t, tc.code, exitCode(tc.err), tc.name)
+	}
+}
+
+// TestServiceErrorStatusCodes tests that failures of the service carry the
+// status codes the exit codes are picked by
+func TestServiceErrorStatusCodes(t *testing.T) {
+	assert.Equal(t, uint32(ua.StatusBadNodeIDUnknown), errorStatus(fmt.Errorf("read: %w", ua.StatusBadNodeIDUnknown)))
+	assert.Equal(t, uint32(ua.StatusBadTimeout), errorStatus(fmt.Errorf("read: %w", context.DeadlineExceeded)))
+	assert.Zero(t, errorStatus(errors.New("unexpected EOF")))
+}
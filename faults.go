@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+)
+
+// faultInjector simulates a misbehaving PLC for testing dashboards and
+// scripts. It only exists in services started with --debug-faults
+type faultInjector struct {
+	mu           sync.Mutex
+	drop         int           // responses still to drop
+	dropped      int           // responses dropped so far
+	readDelay    time.Duration // added before every read
+	rejectWrites int           // writes still to reject as if the session was lost
+	reconnect    chan struct{} // forced reconnects for the keep-alive loop
+}
+
+// faultState is the state of the injector in /api/debug/faults
+type faultState struct {
+	Drop         int    `json:"drop"`
+	Dropped      int    `json:"dropped"`
+	ReadDelay    string `json:"readDelay"`
+	RejectWrites int    `json:"rejectWrites"`
+}
+
+// Fault injection of this service, nil unless --debug-faults is set
+var serviceFaults *faultInjector
+
+func newFaultInjector() *faultInjector {
+	return &faultInjector{reconnect: make(chan struct{}, 1)}
+}
+
+// delayRead waits the injected read delay
+func (f *faultInjector) delayRead(ctx context.Context) error {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	delay := f.readDelay
+	f.mu.Unlock()
+	if delay == 0 {
+		return nil
+	}
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// dropResponse returns a timeout for a response that is to be dropped. The
+// request itself has reached the server, like a response lost on the wire
+func (f *faultInjector) dropResponse() error {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.drop == 0 {
+		return nil
+	}
+	f.drop--
+	f.dropped++
+	log.Printf("[%s] Fault injection: dropped a response, %d left to drop", connectionName, f.drop)
+	return ua.StatusBadTimeout
+}
+
+// rejectWrite returns BadSessionIdInvalid for a write that is to be
+// rejected. The write does not reach the server, like one sent on a session
+// the PLC dropped when it restarted
+func (f *faultInjector) rejectWrite() error {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rejectWrites == 0 {
+		return nil
+	}
+	f.rejectWrites--
+	log.Printf("[%s] Fault injection: rejected a write, %d left to reject", connectionName, f.rejectWrites)
+	return ua.StatusBadSessionIDInvalid
+}
+
+// reconnects returns the channel of forced reconnects, nil without injector
+func (f *faultInjector) reconnects() <-chan struct{} {
+	if f == nil {
+		return nil
+	}
+	return f.reconnect
+}
+
+func (f *faultInjector) state() faultState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return faultState{Drop: f.drop, Dropped: f.dropped, ReadDelay: f.readDelay.String(), RejectWrites: f.rejectWrites}
+}
+
+// readOPCUA sends a read request, subject to the injected faults
+func readOPCUA(ctx context.Context, client *opcua.Client, req *ua.ReadRequest) (*ua.ReadResponse, error) {
+	if err := serviceFaults.delayRead(ctx); err != nil {
+		return nil, err
+	}
+	resp, err := client.Read(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := serviceFaults.dropResponse(); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// writeOPCUA sends a write request, subject to the injected faults. Cached
+// values of the written nodes are dropped. With --retry-session-writes, a
+// write rejected for an invalid session is sent again on a new session
+func writeOPCUA(ctx context.Context, client *opcua.Client, req *ua.WriteRequest) (*ua.WriteResponse, error) {
+	resp, err := writeOPCUAOnce(ctx, client, req)
+	if err != nil && retrySessionWrites && isSessionInvalid(err) {
+		return retryWrite(ctx, client, req, err)
+	}
+	return resp, err
+}
+
+// writeOPCUAOnce is writeOPCUA without the retry, for writes whose values
+// have to be worked out again on the new session
+func writeOPCUAOnce(ctx context.Context, client *opcua.Client, req *ua.WriteRequest) (*ua.WriteResponse, error) {
+	err := serviceFaults.rejectWrite()
+	var resp *ua.WriteResponse
+	if err == nil {
+		resp, err = client.Write(ctx, req)
+	}
+	// Even a failed request may have written the nodes
+	serviceCache.invalidate(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := serviceFaults.dropResponse(); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// handleFaultsRequest shows the injected faults (GET /api/debug/faults),
+// injects faults (POST with {"drop": 3, "readDelay": "2s", "rejectWrites": 1,
+// "reconnect": true})
+// and clears them (DELETE)
+func handleFaultsRequest(w http.ResponseWriter, r *http.Request) {
+	f := serviceFaults
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPost:
+		var req struct {
+			Drop         *int    `json:"drop"`
+			ReadDelay    *string `json:"readDelay"`
+			RejectWrites *int    `json:"rejectWrites"`
+			Reconnect    bool    `json:"reconnect"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": fmt.Sprintf("Failed to parse request: %v", err),
+			})
+			return
+		}
+		var delay time.Duration
+		if req.ReadDelay != nil {
+			d, err := time.ParseDuration(*req.ReadDelay)
+			if err != nil || d < 0 {
+				sendJSONResponseGeneric(w, map[string]interface{}{
+					"error": fmt.Sprintf("invalid readDelay %q", *req.ReadDelay),
+				})
+				return
+			}
+			delay = d
+		}
+		if req.Drop != nil && *req.Drop < 0 {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": "drop must not be negative",
+			})
+			return
+		}
+		if req.RejectWrites != nil && *req.RejectWrites < 0 {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": "rejectWrites must not be negative",
+			})
+			return
+		}
+
+		f.mu.Lock()
+		if req.Drop != nil {
+			f.drop = *req.Drop
+		}
+		if req.ReadDelay != nil {
+			f.readDelay = delay
+		}
+		if req.RejectWrites != nil {
+			f.rejectWrites = *req.RejectWrites
+		}
+		f.mu.Unlock()
+		if req.Reconnect {
+			select {
+			case f.reconnect <- struct{}{}:
+			default: // A reconnect is already pending
+			}
+		}
+		log.Printf("[%s] Fault injection: %+v (reconnect: %v)", connectionName, f.state(), req.Reconnect)
+
+	case http.MethodDelete:
+		f.mu.Lock()
+		f.drop = 0
+		f.readDelay = 0
+		f.rejectWrites = 0
+		f.mu.Unlock()
+		log.Printf("[%s] Fault injection cleared", connectionName)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sendJSONResponseGeneric(w, map[string]interface{}{
+		"faults": f.state(),
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestFaultInjector tests dropping responses and delaying reads
+func TestFaultInjector(t *testing.T) {
+	var f *faultInjector
+	assert.NoError(t, f.dropResponse())
+	assert.NoError(t, f.delayRead(context.Background()))
+	assert.Nil(t, f.reconnects())
+
+	f = newFaultInjector()
+	f.drop = 2
+	assert.Equal(t, ua.StatusBadTimeout, f.dropResponse())
+	assert.Equal(t, ua.StatusBadTimeout, f.dropResponse())
+	assert.NoError(t, f.dropResponse())
+	assert.Equal(t, 2, f.state().Dropped)
+
+	f.readDelay = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, f.delayRead(ctx), context.DeadlineExceeded)
+}
+
+// TestHandleFaultsRequest tests injecting and clearing faults over the API
+func TestHandleFaultsRequest(t *testing.T) {
+	defer func() { serviceFaults = nil }()
+	serviceFaults = newFaultInjector()
+
+	do := func(method, body string) map[string]interface{} {
+		rec := httptest.NewRecorder()
+		handleFaultsRequest(rec, httptest.NewRequest(method, "/api/debug/faults", strings.NewReader(body)))
+		var resp map[string]interface{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return resp
+	}
+
+	resp := do(http.MethodPost, `{"drop": 3, "readDelay": "2s", "reconnect": true}`)
+	assert.Equal(t, map[string]interface{}{"drop": 3.0, "dropped": 0.0, "readDelay": "2s", "rejectWrites": 0.0}, resp["faults"])
+	select {
+	case <-serviceFaults.reconnects():
+	default:
+		t.Fatal("no reconnect requested")
+	}
+
+	assert.Contains(t, do(http.MethodPost, `{"readDelay": "soon"}`), "error")
+	assert.Equal(t, 3.0, do(http.MethodGet, "")["faults"].(map[string]interface{})["drop"])
+
+	resp = do(http.MethodDelete, "")
+	assert.Equal(t, map[string]interface{}{"drop": 0.0, "dropped": 0.0, "readDelay": "0s", "rejectWrites": 0.0}, resp["faults"])
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Header of CSV sink files, one row per field of a line
+var csvSinkHeader = []string{"time", "measurement", "tags", "field", "value"}
+
+// fileRotation is when a file sink starts a new file
+type fileRotation struct {
+	Size  string `yaml:"size"`  // e.g. 50MB, of the file on disk
+	Every string `yaml:"every"` // e.g. 1h
+}
+
+// fileSink writes the lines of a poll file sink to rotated files in a
+// directory, in line protocol or CSV and optionally gzipped, for sites where
+// the data is carried away on a USB stick. The file being written ends in
+// .part and is renamed when it is complete, so collectors copy only the
+// files without it
+type fileSink struct {
+	dir     string
+	prefix  string
+	csv     bool
+	gzip    bool
+	maxSize int64         // 0 for no size limit
+	every   time.Duration // 0 for no time limit
+	now     func() time.Time
+
+	keepAge  time.Duration // Retention, 0 to keep files of any age
+	keepSize int64         // Retention, 0 to keep files of any size
+	pruned   time.Time
+
+	mu      sync.Mutex
+	storage storageStats
+
+	file   *os.File
+	path   string // Final path of the open file, without .part
+	size   *countingWriter
+	gz     *gzip.Writer
+	out    io.Writer
+	opened time.Time
+}
+
+// countingWriter counts the bytes written to the file on disk
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// newFileSink returns the file sink of a poll file sink with dir set
+func newFileSink(sink *pollSink) (*fileSink, error) {
+	f := &fileSink{dir: sink.Dir, prefix: sink.Prefix, gzip: sink.Gzip, now: time.Now}
+	if f.prefix == "" {
+		f.prefix = "plccli"
+	}
+	switch sink.Format {
+	case "", "influx":
+	case "csv":
+		f.csv = true
+	default:
+		return nil, fmt.Errorf("unknown sink format %q, use influx or csv", sink.Format)
+	}
+	if sink.Rotate.Size != "" {
+		size, err := parseByteSize(sink.Rotate.Size)
+		if err != nil {
+			return nil, err
+		}
+		f.maxSize = size
+	}
+	if sink.Rotate.Every != "" {
+		d, err := time.ParseDuration(sink.Rotate.Every)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid rotate interval %q", sink.Rotate.Every)
+		}
+		f.every = d
+	}
+	var err error
+	if f.keepAge, f.keepSize, err = sink.Retention.limits(0); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// parseByteSize parses sizes like 500KB, 50MB or 1GB (powers of 1024)
+func parseByteSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		factor int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	for _, unit := range units {
+		if number, ok := strings.CutSuffix(upper, unit.suffix); ok {
+			n, err := strconv.ParseInt(strings.TrimSpace(number), 10, 64)
+			if err != nil || n <= 0 {
+				break
+			}
+			return n * unit.factor, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid size %q, use e.g. 500KB, 50MB or 1GB", s)
+}
+
+// write appends lines, rotating first when the open file is full or old
+// enough. Without lines only the rotation and retention are checked
+func (f *fileSink) write(lines []string) error {
+	rotated := false
+	if f.file != nil && f.due() {
+		if err := f.close(); err != nil {
+			return err
+		}
+		rotated = true
+	}
+	if rotated || f.now().Sub(f.pruned) >= pruneInterval {
+		if err := f.prune(); err != nil {
+			return fmt.Errorf("failed to delete old files: %v", err)
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+
+	if err := f.writeLines(lines); err != nil {
+		// Start over in a new file, e.g. after the USB stick was replaced
+		f.close()
+		return err
+	}
+	return nil
+}
+
+// writeLines writes lines to the open file
+func (f *fileSink) writeLines(lines []string) error {
+	if f.csv {
+		w := csv.NewWriter(f.out)
+		for _, line := range lines {
+			rows, err := lineProtocolRows(line)
+			if err != nil {
+				continue // Lines come from the poll file, this is not expected
+			}
+			w.WriteAll(rows)
+		}
+		w.Flush()
+		return w.Error()
+	}
+	for _, line := range lines {
+		if _, err := io.WriteString(f.out, line+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// due reports whether the open file is full or old enough to rotate
+func (f *fileSink) due() bool {
+	return (f.maxSize > 0 && f.size.n >= f.maxSize) ||
+		(f.every > 0 && f.now().Sub(f.opened) >= f.every)
+}
+
+// open starts a new file named after the time, e.g.
+// plccli-20260301T080000Z.csv.gz.part
+func (f *fileSink) open() error {
+	if err := os.MkdirAll(f.dir, 0755); err != nil {
+		return err
+	}
+	f.opened = f.now()
+	ext := ".lp"
+	if f.csv {
+		ext = ".csv"
+	}
+	if f.gzip {
+		ext += ".gz"
+	}
+	base := f.prefix + "-" + f.opened.UTC().Format("20060102T150405Z")
+	for i := 0; ; i++ {
+		name := base
+		if i > 0 {
+			name = fmt.Sprintf("%s-%d", base, i)
+		}
+		path := filepath.Join(f.dir, name+ext)
+		if _, err := os.Stat(path); err == nil {
+			continue // Rotated more than once in a second
+		}
+		file, err := os.OpenFile(path+".part", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		f.file, f.path = file, path
+		break
+	}
+
+	f.size = &countingWriter{w: f.file}
+	f.out = f.size
+	if f.gzip {
+		f.gz = gzip.NewWriter(f.size)
+		f.out = f.gz
+	}
+	if f.csv {
+		w := csv.NewWriter(f.out)
+		w.Write(csvSinkHeader)
+		w.Flush()
+	}
+	return nil
+}
+
+// close completes the open file and drops its .part suffix
+func (f *fileSink) close() error {
+	if f.file == nil {
+		return nil
+	}
+	var err error
+	if f.gz != nil {
+		err = f.gz.Close()
+	}
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.path+".part", f.path)
+	}
+	f.file, f.gz, f.out = nil, nil, nil
+	return err
+}
+
+// prune deletes the completed files of the sink older than the retention
+// age and, oldest first, those beyond the retention size. The size includes
+// the file being written, which is never deleted
+func (f *fileSink) prune() error {
+	f.pruned = f.now()
+	entries, err := os.ReadDir(f.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	type sinkFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var files []sinkFile
+	var total int64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, f.prefix+"-") || !isSinkFile(name) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue // Deleted meanwhile
+		}
+		total += info.Size()
+		path := filepath.Join(f.dir, name)
+		if f.file != nil && path == f.path+".part" {
+			continue
+		}
+		files = append(files, sinkFile{path: path, size: info.Size(), modTime: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].modTime.Equal(files[j].modTime) {
+			return files[i].modTime.Before(files[j].modTime)
+		}
+		return files[i].path < files[j].path
+	})
+
+	var deleted, deletedBytes int64
+	for _, file := range files {
+		old := f.keepAge > 0 && f.now().Sub(file.modTime) > f.keepAge
+		over := f.keepSize > 0 && total > f.keepSize
+		if !old && !over {
+			break // Files are sorted oldest first
+		}
+		if err := os.Remove(file.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		total -= file.size
+		deleted++
+		deletedBytes += file.size
+	}
+	if deleted > 0 {
+		log.Printf("[%s] Sink %s: deleted %d files (%d bytes) by the retention", connectionName, f.dir, deleted, deletedBytes)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.storage.Bytes = total
+	f.storage.Evicted += deleted
+	f.storage.EvictedBytes += deletedBytes
+	return nil
+}
+
+// isSinkFile reports whether a file name has the extension of file sink
+// files, complete or not
+func isSinkFile(name string) bool {
+	name = strings.TrimSuffix(name, ".part")
+	name = strings.TrimSuffix(name, ".gz")
+	return strings.HasSuffix(name, ".lp") || strings.HasSuffix(name, ".csv")
+}
+
+func (f *fileSink) stats() storageStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.storage
+}
+
+// lineProtocolRows splits an InfluxDB line into CSV rows, one per field:
+// the time (RFC 3339), measurement, tags as in the line, field and value
+func lineProtocolRows(line string) ([][]string, error) {
+	l, err := parseInfluxLine(line)
+	if err != nil {
+		return nil, err
+	}
+	var rows [][]string
+	for _, field := range l.fields {
+		rows = append(rows, []string{l.time.UTC().Format(time.RFC3339Nano), l.measurement, l.tags, field.name, field.value})
+	}
+	return rows, nil
+}
+
+// influxLine is a parsed InfluxDB line
+type influxLine struct {
+	measurement string
+	tags        string // As in the line, escaped
+	fields      []influxField
+	time        time.Time
+}
+
+// influxField is a field of a line, string values without quotes
+type influxField struct {
+	name   string
+	value  string
+	quoted bool
+}
+
+// parseInfluxLine parses a line in InfluxDB line protocol. Lines without a
+// timestamp get the current time
+func parseInfluxLine(line string) (influxLine, error) {
+	var l influxLine
+	key, rest, ok := cutUnescaped(line, ' ')
+	if !ok {
+		return l, fmt.Errorf("no fields in line %q", line)
+	}
+	measurement, tags, _ := cutUnescaped(key, ',')
+	l.measurement, l.tags = unescapeLineProtocol(measurement), tags
+	fieldSet, timestamp := rest, ""
+	if i := strings.LastIndexByte(rest, ' '); i >= 0 && !strings.HasSuffix(rest, "\"") {
+		fieldSet, timestamp = rest[:i], rest[i+1:]
+	}
+	l.time = time.Now()
+	if timestamp != "" {
+		ns, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return l, fmt.Errorf("invalid timestamp in line %q", line)
+		}
+		l.time = time.Unix(0, ns)
+	}
+
+	for fieldSet != "" {
+		var field string
+		field, fieldSet = splitField(fieldSet)
+		name, value, ok := cutUnescaped(field, '=')
+		if !ok {
+			return l, fmt.Errorf("invalid field %q in line %q", field, line)
+		}
+		f := influxField{name: unescapeLineProtocol(name), value: value}
+		if unquoted, ok := strings.CutPrefix(value, "\""); ok {
+			f.value = strings.ReplaceAll(strings.TrimSuffix(unquoted, "\""), "\\\"", "\"")
+			f.quoted = true
+		}
+		l.fields = append(l.fields, f)
+	}
+	return l, nil
+}
+
+// tag returns the value of a tag of the line, "" if it has none
+func (l influxLine) tag(key string) string {
+	for rest := l.tags; rest != ""; {
+		var tag string
+		tag, rest, _ = cutUnescaped(rest, ',')
+		name, value, _ := cutUnescaped(tag, '=')
+		if unescapeLineProtocol(name) == key {
+			return unescapeLineProtocol(value)
+		}
+	}
+	return ""
+}
+
+// splitField returns the first field of a field set and the rest, keeping
+// commas in quoted string values
+func splitField(fieldSet string) (string, string) {
+	quoted := false
+	for i := 0; i < len(fieldSet); i++ {
+		switch fieldSet[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				return fieldSet[:i], fieldSet[i+1:]
+			}
+		}
+	}
+	return fieldSet, ""
+}
+
+// cutUnescaped cuts s at the first sep not escaped with a backslash
+func cutUnescaped(s string, sep byte) (string, string, bool) {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case sep:
+			return s[:i], s[i+1:], true
+		}
+	}
+	return s, "", false
+}
+
+// unescapeLineProtocol removes the backslashes of escaped characters
+func unescapeLineProtocol(s string) string {
+	return strings.NewReplacer("\\,", ",", "\\=", "=", "\\ ", " ", "\\\"", "\"").Replace(s)
+}
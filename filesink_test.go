@@ -0,0 +1,155 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestFileSinkRotation tests that file sinks rotate by size and time and
+// only complete files lose their .part suffix
+func TestFileSinkRotation(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+	f, err := newFileSink(&pollSink{Dir: dir, Prefix: "line1", Rotate: fileRotation{Size: "1KB", Every: "1h"}})
+	require.NoError(t, err)
+	f.now = func() time.Time { return now }
+
+	files := func() []string {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	line := "boiler,node_id=ns=3;s=Temperature,endpoint=plc value=21.5 1772352000000000000"
+	require.NoError(t, f.write([]string{line}))
+	assert.Equal(t, []string{"line1-20260301T080000Z.lp.part"}, files())
+
+	// Over 1KB, the next write starts a new file in the same second
+	var lines []string
+	for i := 0; i < 20; i++ {
+		lines = append(lines, line)
+	}
+	require.NoError(t, f.write(lines))
+	require.NoError(t, f.write([]string{line}))
+	assert.Equal(t, []string{"line1-20260301T080000Z-1.lp.part", "line1-20260301T080000Z.lp"}, files())
+
+	// An hour later a write without lines completes the file
+	now = now.Add(time.Hour)
+	require.NoError(t, f.write(nil))
+	assert.Equal(t, []string{"line1-20260301T080000Z-1.lp", "line1-20260301T080000Z.lp"}, files())
+	data, err := os.ReadFile(filepath.Join(dir, "line1-20260301T080000Z-1.lp"))
+	require.NoError(t, err)
+	assert.Equal(t, line+"\n", string(data))
+	require.NoError(t, f.close())
+}
+
+// TestFileSinkRetention tests that file sinks delete their oldest complete
+// files by age and size, but not the file being written or other files
+func TestFileSinkRetention(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2026, 3, 10, 8, 0, 0, 0, time.UTC)
+	for name, age := range map[string]time.Duration{
+		"plccli-20260301T080000Z.lp":      9 * 24 * time.Hour,
+		"plccli-20260305T080000Z.lp.gz":   5 * 24 * time.Hour,
+		"plccli-20260308T080000Z.lp.part": 2 * 24 * time.Hour, // Left by a crash
+		"plccli-20260309T080000Z.lp":      24 * time.Hour,
+		"notes.txt":                       30 * 24 * time.Hour,
+	} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, make([]byte, 400), 0644))
+		require.NoError(t, os.Chtimes(path, now.Add(-age), now.Add(-age)))
+	}
+
+	f, err := newFileSink(&pollSink{Dir: dir, Retention: retention{Age: "7d", Size: "500B"}})
+	require.NoError(t, err)
+	f.now = func() time.Time { return now }
+	require.NoError(t, f.write([]string{"boiler value=21.5 1773129600000000000"}))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"notes.txt", "plccli-20260309T080000Z.lp", "plccli-20260310T080000Z.lp.part"}, names,
+		"older than 7d, then the oldest over 500B")
+	stats := f.stats()
+	assert.Equal(t, int64(3), stats.Evicted)
+	assert.Equal(t, int64(1200), stats.EvictedBytes)
+	assert.Equal(t, int64(400), stats.Bytes)
+	require.NoError(t, f.close())
+}
+
+// TestFileSinkCSV tests gzipped CSV files with one row per field
+func TestFileSinkCSV(t *testing.T) {
+	dir := t.TempDir()
+	f, err := newFileSink(&pollSink{Dir: dir, Format: "csv", Gzip: true})
+	require.NoError(t, err)
+	f.now = func() time.Time { return time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC) }
+
+	require.NoError(t, f.write([]string{
+		`boiler,node_id=ns=3;s=Temperature,endpoint=plc value=21.5 1772352000000000000`,
+		`recipe\ name,node_id=ns=3;s=Name,endpoint=plc value=1,string_value="press, \"B\" 2" 1772352001500000000`,
+	}))
+	require.NoError(t, f.close())
+
+	file, err := os.Open(filepath.Join(dir, "plccli-20260301T080000Z.csv.gz"))
+	require.NoError(t, err)
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	require.NoError(t, err)
+	data, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, `time,measurement,tags,field,value
+2026-03-01T08:00:00Z,boiler,"node_id=ns=3;s=Temperature,endpoint=plc",value,21.5
+2026-03-01T08:00:01.5Z,recipe name,"node_id=ns=3;s=Name,endpoint=plc",value,1
+2026-03-01T08:00:01.5Z,recipe name,"node_id=ns=3;s=Name,endpoint=plc",string_value,"press, ""B"" 2"
+`, string(data))
+}
+
+// TestFileSinkConfig tests the file sink settings of poll files
+func TestFileSinkConfig(t *testing.T) {
+	size, err := parseByteSize("50MB")
+	require.NoError(t, err)
+	assert.Equal(t, int64(50<<20), size)
+	for _, bad := range []string{"", "MB", "-1KB", "5 parsecs"} {
+		_, err := parseByteSize(bad)
+		assert.Error(t, err, bad)
+	}
+
+	path := filepath.Join(t.TempDir(), "polls.yaml")
+	for config, valid := range map[string]bool{
+		"sinks:\n  - {dir: /tmp/usb, format: csv, gzip: true, rotate: {size: 50MB, every: 1h}}\n": true,
+		"sinks:\n  - {dir: /tmp/usb, url: http://sink}\n":                                         false,
+		"sinks:\n  - {dir: /tmp/usb, format: parquet}\n":                                          false,
+		"sinks:\n  - {dir: /tmp/usb, rotate: {every: soon}}\n":                                    false,
+		"sinks:\n  - {sqlite: /tmp/h.db, gzip: true}\n":                                           false,
+		"sinks:\n  - {dir: /tmp/usb, retention: {age: 7d, size: 2GB}}\n":                          true,
+		"sinks:\n  - {dir: /tmp/usb, retention: {size: lots}}\n":                                  false,
+		"sinks:\n  - {url: http://sink, retention: 7d}\n":                                         false,
+	} {
+		require.NoError(t, os.WriteFile(path, []byte(config+"polls:\n  - {node: ns=3;s=A, interval: 1s}\n"), 0644))
+		pf, err := loadPollFile(path)
+		if !valid {
+			assert.Error(t, err, config)
+			continue
+		}
+		require.NoError(t, err, config)
+		assert.NotNil(t, pf.Sinks[0].store)
+		assert.Equal(t, "/tmp/usb", pf.Sinks[0].name())
+	}
+}
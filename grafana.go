@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Measurement of the connection event lines Loki sinks get
+const eventMeasurement = "event"
+
+// Default Grafana Live stream of grafanaLive sinks
+const defaultLiveStream = "plccli"
+
+// Path of the Loki push API
+const lokiPushPath = "/loki/api/v1/push"
+
+var (
+	liveStreamPattern = regexp.MustCompile(`^[A-Za-z0-9_.=-]+$`)
+	lokiLabelPattern  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// liveURL returns the push URL of a Grafana Live stream: the lines go to the
+// channels stream/<stream>/<measurement> that panels subscribe to
+func liveURL(base, stream string) (string, error) {
+	if stream == "" {
+		stream = defaultLiveStream
+	}
+	if !liveStreamPattern.MatchString(stream) {
+		return "", fmt.Errorf("invalid Grafana Live stream %q", stream)
+	}
+	if err := checkHTTPURL(base); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(base, "/") + "/api/live/push/" + stream, nil
+}
+
+// lokiURL returns the push URL of a Loki server, base is the server or
+// already the push URL
+func lokiURL(base string, labels map[string]string) (string, error) {
+	if err := checkHTTPURL(base); err != nil {
+		return "", err
+	}
+	for name, value := range labels {
+		if !lokiLabelPattern.MatchString(name) || value == "" {
+			return "", fmt.Errorf("invalid Loki label %s=%q", name, value)
+		}
+	}
+	base = strings.TrimSuffix(base, "/")
+	if strings.HasSuffix(base, lokiPushPath) {
+		return base, nil
+	}
+	return base + lokiPushPath, nil
+}
+
+// checkHTTPURL checks that a sink URL is an absolute http or https URL
+func checkHTTPURL(target string) error {
+	if u, err := url.Parse(target); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid URL %q", target)
+	}
+	return nil
+}
+
+// lokiLines returns the lines of a Loki sink: alarms, annotations and
+// connection events, the low-volume lines worth a log entry
+func lokiLines(lines prioritized) prioritized {
+	var selected prioritized
+	selected[priorityAlarm] = lines[priorityAlarm]
+	for class := range lines {
+		if class == priorityAlarm {
+			continue
+		}
+		for _, line := range lines[class] {
+			if isLogLine(line) {
+				selected[class] = append(selected[class], line)
+			}
+		}
+	}
+	return selected
+}
+
+// isLogLine reports whether a line is an annotation or connection event,
+// which are news every time
+func isLogLine(line string) bool {
+	return strings.HasPrefix(line, annotationMeasurement+",") || strings.HasPrefix(line, eventMeasurement+",")
+}
+
+// eventLine formats a connection event as an InfluxDB line for Loki sinks
+func eventLine(e serviceEvent) string {
+	tags := []influxTag{{"connection", e.Connection}, {"endpoint", e.Endpoint}, {"type", e.Type}}
+	if e.Maintenance {
+		tags = append(tags, maintenanceTag)
+	}
+	tagEscaper := strings.NewReplacer(",", "\\,", "=", "\\=", " ", "\\ ", "\n", "\\n")
+	textEscaper := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+	var b strings.Builder
+	b.WriteString(eventMeasurement)
+	for _, tag := range tags {
+		if tag.Value == "" {
+			continue
+		}
+		b.WriteString(",")
+		b.WriteString(tag.Key)
+		b.WriteString("=")
+		b.WriteString(tagEscaper.Replace(tag.Value))
+	}
+	fmt.Fprintf(&b, " id=%di", e.ID)
+	if e.Error != "" {
+		fmt.Fprintf(&b, ",error=\"%s\"", textEscaper.Replace(e.Error))
+	}
+	if e.Attempts > 0 {
+		fmt.Fprintf(&b, ",attempts=%di", e.Attempts)
+	}
+	if e.Downtime != "" {
+		fmt.Fprintf(&b, ",downtime=\"%s\"", e.Downtime)
+	}
+	fmt.Fprintf(&b, " %d", e.Time.UnixNano())
+	return b.String()
+}
+
+// forwardEvents adds the connection events to the buffer of a Loki sink
+// until ctx is done
+func forwardEvents(ctx context.Context, bus *eventBus, buffer *priorityBuffer) {
+	events, stop := bus.subscribe(bus.lastID())
+	defer stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-events:
+			buffer.add(priorityAlarm, eventLine(e))
+		}
+	}
+}
+
+// lokiStream is a stream of the Loki push API: its labels and the entries,
+// pairs of the time in Unix nanoseconds and the log line
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// lokiPayload returns the JSON body of a Loki push. Each line becomes an
+// entry labelled with the sink's labels, job=plccli, the connection, the
+// measurement and maintenance=true during maintenance; the other tags and the
+// fields form the logfmt log line
+func lokiPayload(lines []string, labels map[string]string) ([]byte, error) {
+	var streams []*lokiStream
+	byLabels := make(map[string]*lokiStream)
+	for _, line := range lines {
+		l, err := parseInfluxLine(line)
+		if err != nil {
+			continue // Lines come from the poll file, this is not expected
+		}
+		tags := l.tagMap()
+		stream := map[string]string{"job": "plccli", "measurement": l.measurement}
+		if connectionName != "" {
+			stream["connection"] = connectionName
+		}
+		for _, name := range []string{"connection", "maintenance"} {
+			if tags[name] != "" {
+				stream[name] = tags[name]
+				delete(tags, name)
+			}
+		}
+		for name, value := range labels {
+			stream[name] = value
+		}
+
+		key, err := json.Marshal(stream) // Sorted keys
+		if err != nil {
+			return nil, err
+		}
+		s := byLabels[string(key)]
+		if s == nil {
+			s = &lokiStream{Stream: stream}
+			byLabels[string(key)] = s
+			streams = append(streams, s)
+		}
+		s.Values = append(s.Values, [2]string{strconv.FormatInt(l.time.UnixNano(), 10), logfmtLine(tags, l.fields)})
+	}
+	return json.Marshal(map[string]interface{}{"streams": streams})
+}
+
+// logfmtLine formats tags, sorted by key, and fields as logfmt
+func logfmtLine(tags map[string]string, fields []influxField) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+logfmtValue(tags[key]))
+	}
+	for _, field := range fields {
+		value := field.value
+		if !field.quoted {
+			value = fmt.Sprint(field.jsonValue())
+		}
+		pairs = append(pairs, field.name+"="+logfmtValue(value))
+	}
+	return strings.Join(pairs, " ")
+}
+
+// logfmtValue quotes values that are empty or hold spaces, quotes or equal
+// signs
+func logfmtValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " =\"\\\t\n") {
+		return strconv.Quote(value)
+	}
+	return value
+}
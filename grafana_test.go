@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestGrafanaLiveSink tests that Grafana Live sinks post line protocol to
+// the push API of their stream
+func TestGrafanaLiveSink(t *testing.T) {
+	var paths []string
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		assert.Equal(t, "Bearer glsa_x", r.Header.Get("Authorization"))
+		paths = append(paths, r.URL.Path)
+		bodies = append(bodies, string(data))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	pf, err := loadPollFile(writePollFile(t, "sinks:\n  - {grafanaLive: "+server.URL+"/, stream: line1, headers: {Authorization: Bearer glsa_x}}\n  - {grafanaLive: "+server.URL+"}\npolls:\n  - {node: ns=1;s=Speed, interval: 1s}\n"))
+	require.NoError(t, err)
+	assert.Equal(t, server.URL+"/api/live/push/line1", pf.Sinks[0].pushURL)
+	assert.Equal(t, server.URL+"/api/live/push/plccli", pf.Sinks[1].pushURL)
+
+	speed := `conveyor,node_id=ns\=1;s\=Speed value=1.5 1772352000000000000`
+	pf.Sinks[0].flush(context.Background(), &http.Client{Timeout: time.Second}, newPriorityBuffer(10),
+		prioritized{priorityProcess: {speed, speed}}, time.Second)
+	assert.Equal(t, []string{"/api/live/push/line1"}, paths)
+	assert.Equal(t, []string{speed + "\n" + speed + "\n"}, bodies, "every sample, not only changes")
+
+	for _, bad := range []string{
+		"sinks:\n  - {grafanaLive: grafana:3000}\npolls:\n  - {node: ns=3;s=A, interval: 1s}\n",
+		"sinks:\n  - {grafanaLive: http://grafana:3000, stream: line/1}\npolls:\n  - {node: ns=3;s=A, interval: 1s}\n",
+		"sinks:\n  - {grafanaLive: http://grafana:3000, gzip: true}\npolls:\n  - {node: ns=3;s=A, interval: 1s}\n",
+		"sinks:\n  - {url: http://sink, stream: line1}\npolls:\n  - {node: ns=3;s=A, interval: 1s}\n",
+		"sinks:\n  - {grafanaLive: http://grafana:3000, loki: http://loki:3100}\npolls:\n  - {node: ns=3;s=A, interval: 1s}\n",
+	} {
+		_, err := loadPollFile(writePollFile(t, bad))
+		assert.Error(t, err, bad)
+	}
+}
+
+// TestLokiSink tests that Loki sinks get alarm changes, annotations and
+// connection events as labelled logfmt entries
+func TestLokiSink(t *testing.T) {
+	defer func(name string, bus *eventBus) { connectionName, serviceEvents = name, bus }(connectionName, serviceEvents)
+	connectionName = "line1"
+	serviceEvents = newEventBus(nil)
+	serviceEvents.endpoint = "opc.tcp://plc:4840"
+
+	var pushes []map[string][]lokiStream
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, lokiPushPath, r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var push map[string][]lokiStream
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&push))
+		pushes = append(pushes, push)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	pf, err := loadPollFile(writePollFile(t, "sinks:\n  - {loki: "+server.URL+", labels: {site: plant1}}\npolls:\n  - {node: ns=1;s=Alarm, interval: 1s, priority: alarm}\n"))
+	require.NoError(t, err)
+	sink := pf.Sinks[0]
+	assert.Equal(t, server.URL+lokiPushPath, sink.pushURL)
+
+	s := newPollScheduler(pf, nil)
+	alarm := `alarms,node_id=ns\=1;s\=Alarm,endpoint=opc.tcp://plc:4840 active=true,text="Motor overload" 1772352000000000000`
+	annotation := `annotation,connection=line1,user=alice text="changed die" 1772352001000000000`
+	var lines prioritized
+	lines[priorityAlarm] = []string{alarm, alarm}
+	lines[priorityProcess] = []string{`boiler,node_id=ns\=1;s\=T value=72.5`, annotation}
+	s.add(lines, false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		forwardEvents(ctx, serviceEvents, s.sinks[0])
+		close(done)
+	}()
+	require.Eventually(t, func() bool {
+		serviceEvents.mu.Lock()
+		defer serviceEvents.mu.Unlock()
+		return len(serviceEvents.subscribers) == 1
+	}, time.Second, time.Millisecond)
+	serviceEvents.publish(serviceEvent{Type: eventDisconnect, Error: "EOF"})
+	require.Eventually(t, func() bool { return s.sinks[0].stats()["lines"] == 4 }, time.Second, time.Millisecond)
+	cancel()
+	<-done
+
+	buffered, _ := s.sinks[0].drain()
+	sink.flush(context.Background(), &http.Client{Timeout: time.Second}, newPriorityBuffer(10), buffered, time.Second)
+	require.Len(t, pushes, 1)
+	streams := pushes[0]["streams"]
+	require.Len(t, streams, 3, "one stream per measurement")
+
+	assert.Equal(t, map[string]string{"job": "plccli", "connection": "line1", "measurement": "alarms", "site": "plant1"}, streams[0].Stream)
+	require.Len(t, streams[0].Values, 1, "the repeated alarm is no change")
+	assert.Equal(t, [2]string{"1772352000000000000", `endpoint=opc.tcp://plc:4840 node_id="ns=1;s=Alarm" active=true text="Motor overload"`}, streams[0].Values[0])
+
+	var measurements []string
+	for _, stream := range streams {
+		measurements = append(measurements, stream.Stream["measurement"])
+	}
+	assert.ElementsMatch(t, []string{"alarms", "event", "annotation"}, measurements)
+	for _, stream := range streams {
+		if stream.Stream["measurement"] == "event" {
+			assert.Equal(t, "endpoint=opc.tcp://plc:4840 type=disconnect id=1 error=EOF", stream.Values[0][1])
+		}
+	}
+
+	for _, bad := range []string{
+		"sinks:\n  - {loki: http://loki:3100, labels: {1site: x}}\npolls:\n  - {node: ns=3;s=A, interval: 1s}\n",
+		"sinks:\n  - {loki: http://loki:3100, retention: {age: 1d}}\npolls:\n  - {node: ns=3;s=A, interval: 1s}\n",
+		"sinks:\n  - {url: http://sink, labels: {site: x}}\npolls:\n  - {node: ns=3;s=A, interval: 1s}\n",
+	} {
+		_, err := loadPollFile(writePollFile(t, bad))
+		assert.Error(t, err, bad)
+	}
+}
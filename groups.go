@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Names of node groups, used as @name on the command line
+var groupNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// groupRegistry holds the named node groups of the service: those of the
+// groups file and those added through the API
+type groupRegistry struct {
+	mu        sync.Mutex
+	groups    map[string]NodeGroup
+	stateFile string // Persisted API groups, "" to keep them in memory only
+}
+
+// Node groups of this service
+var serviceGroups = newGroupRegistry()
+
+func newGroupRegistry() *groupRegistry {
+	return &groupRegistry{groups: make(map[string]NodeGroup)}
+}
+
+// validateNodeGroup checks the name and node IDs of a group and normalizes
+// the node IDs
+func validateNodeGroup(group *NodeGroup) error {
+	if !groupNamePattern.MatchString(group.Name) {
+		return fmt.Errorf("invalid group name %q, use letters, digits, '_', '.' and '-'", group.Name)
+	}
+	if len(group.NodeIDs) == 0 {
+		return fmt.Errorf("group %s needs nodeIds", group.Name)
+	}
+	for i, nodeID := range group.NodeIDs {
+		group.NodeIDs[i] = strings.Replace(nodeID, ",", ";", 1)
+		if err := checkNodeID(group.NodeIDs[i]); err != nil {
+			return fmt.Errorf("invalid node ID %s in group %s: %v", nodeID, group.Name, err)
+		}
+	}
+	return nil
+}
+
+// loadGroupsFile reads the groups of a --groups file:
+//
+//	groups:
+//	  energy-meters:
+//	    - ns=3;s=Meter1.Power
+//	    - ns=3;s=Meter2.Power
+func (reg *groupRegistry) loadGroupsFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read groups file %s: %v", path, err)
+	}
+	var file struct {
+		Groups map[string][]string `yaml:"groups"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("invalid groups file %s: %v", path, err)
+	}
+	if len(file.Groups) == 0 {
+		return fmt.Errorf("invalid groups file %s: no groups", path)
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	for name, nodeIDs := range file.Groups {
+		group := NodeGroup{Name: name, NodeIDs: nodeIDs, File: true}
+		if err := validateNodeGroup(&group); err != nil {
+			return fmt.Errorf("invalid groups file %s: %v", path, err)
+		}
+		reg.groups[name] = group
+	}
+	return nil
+}
+
+// add creates a group or replaces one added through the API. Groups of the
+// groups file cannot be replaced
+func (reg *groupRegistry) add(group NodeGroup) (NodeGroup, error) {
+	group.File = false
+	if err := validateNodeGroup(&group); err != nil {
+		return group, err
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	existing, ok := reg.groups[group.Name]
+	if ok && existing.File {
+		return group, fmt.Errorf("group %s is defined in the groups file", group.Name)
+	}
+	reg.groups[group.Name] = group
+
+	if group.Persist || existing.Persist {
+		if err := reg.save(); err != nil {
+			log.Printf("[%s] Failed to save node groups: %v", connectionName, err)
+		}
+	}
+	return group, nil
+}
+
+// remove removes a group added through the API
+func (reg *groupRegistry) remove(name string) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	group, ok := reg.groups[name]
+	if !ok {
+		return fmt.Errorf("unknown group %s", name)
+	}
+	if group.File {
+		return fmt.Errorf("group %s is defined in the groups file", name)
+	}
+	delete(reg.groups, name)
+
+	if group.Persist {
+		if err := reg.save(); err != nil {
+			log.Printf("[%s] Failed to save node groups: %v", connectionName, err)
+		}
+	}
+	return nil
+}
+
+func (reg *groupRegistry) get(name string) (NodeGroup, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	group, ok := reg.groups[name]
+	return group, ok
+}
+
+// list returns the groups sorted by name
+func (reg *groupRegistry) list() []NodeGroup {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	groups := make([]NodeGroup, 0, len(reg.groups))
+	for _, group := range reg.groups {
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return groups
+}
+
+// save writes the persisted API groups to the state file. Callers must hold reg.mu
+func (reg *groupRegistry) save() error {
+	if reg.stateFile == "" {
+		return nil
+	}
+	groups := []NodeGroup{}
+	for _, group := range reg.groups {
+		if group.Persist && !group.File {
+			groups = append(groups, group)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	data, err := json.MarshalIndent(groups, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode node groups: %v", err)
+	}
+	if err := os.WriteFile(reg.stateFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write node groups %s: %v", reg.stateFile, err)
+	}
+	return nil
+}
+
+// restore adds the groups saved in the state file and saves later changes to
+// it. A missing file restores nothing
+func (reg *groupRegistry) restore(stateFile string) error {
+	data, err := os.ReadFile(stateFile)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read node groups %s: %v", stateFile, err)
+	}
+	var groups []NodeGroup
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &groups); err != nil {
+			return fmt.Errorf("failed to parse node groups %s: %v", stateFile, err)
+		}
+	}
+	for _, group := range groups {
+		if _, err := reg.add(group); err != nil {
+			log.Printf("[%s] Skipping saved node group %s: %v", connectionName, group.Name, err)
+		}
+	}
+
+	reg.mu.Lock()
+	reg.stateFile = stateFile
+	reg.mu.Unlock()
+	return nil
+}
+
+// restoreServiceGroups restores the persisted node groups of this connection
+func restoreServiceGroups() {
+	dir, err := serviceConfigDir("groups")
+	if err != nil {
+		log.Printf("[%s] Node groups are not persisted: %v", connectionName, err)
+		return
+	}
+	if err := serviceGroups.restore(filepath.Join(dir, "groups.json")); err != nil {
+		log.Printf("[%s] Failed to restore node groups: %v", connectionName, err)
+	}
+}
+
+// handleGroupsRequest lists (GET /api/groups), adds (POST /api/groups),
+// shows (GET /api/groups/<name>) and removes (DELETE /api/groups/<name>)
+// node groups
+func handleGroupsRequest(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/groups"), "/")
+
+	switch {
+	case name == "" && r.Method == http.MethodPost:
+		var group NodeGroup
+		if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": fmt.Sprintf("Failed to parse request: %v", err),
+			})
+			return
+		}
+		group, err := serviceGroups.add(group)
+		if err != nil {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": err.Error(),
+			})
+			return
+		}
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"group": group,
+		})
+
+	case name == "" && r.Method == http.MethodGet:
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"groups": serviceGroups.list(),
+		})
+
+	case name != "" && r.Method == http.MethodGet:
+		group, ok := serviceGroups.get(name)
+		if !ok {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": fmt.Sprintf("unknown group %s", name),
+			})
+			return
+		}
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"group": group,
+		})
+
+	case name != "" && r.Method == http.MethodDelete:
+		if err := serviceGroups.remove(name); err != nil {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": err.Error(),
+			})
+			return
+		}
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"removed": name,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// expandNodeGroups replaces the @name arguments of get by the nodes of the
+// service's group of that name
+func expandNodeGroups(nodeIDs []string, host string, port int) ([]string, error) {
+	var expanded []string
+	for _, nodeID := range nodeIDs {
+		name, ok := strings.CutPrefix(nodeID, "@")
+		if !ok {
+			expanded = append(expanded, nodeID)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		group, err := newServiceClient(host, port).Group(ctx, name)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("group @%s: %v", name, err)
+		}
+		expanded = append(expanded, group.NodeIDs...)
+	}
+	return expanded, nil
+}
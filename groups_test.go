@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestGroupRegistry tests groups of the groups file and of the API
+func TestGroupRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "groups.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+groups:
+  energy-meters:
+    - ns=3,s=Meter1.Power
+    - ns=3;s=Meter2.Power
+`), 0644))
+
+	reg := newGroupRegistry()
+	require.NoError(t, reg.loadGroupsFile(path))
+	group, ok := reg.get("energy-meters")
+	require.True(t, ok)
+	assert.Equal(t, []string{"ns=3;s=Meter1.Power", "ns=3;s=Meter2.Power"}, group.NodeIDs)
+	assert.True(t, group.File)
+
+	_, err := reg.add(NodeGroup{Name: "energy-meters", NodeIDs: []string{"i=2258"}})
+	assert.Error(t, err, "file groups cannot be replaced")
+	assert.Error(t, reg.remove("energy-meters"))
+
+	_, err = reg.add(NodeGroup{Name: "line 1", NodeIDs: []string{"i=2258"}})
+	assert.Error(t, err)
+	_, err = reg.add(NodeGroup{Name: "line1"})
+	assert.Error(t, err)
+	_, err = reg.add(NodeGroup{Name: "line1", NodeIDs: []string{"ns=3;i=Speed"}})
+	assert.Error(t, err)
+
+	_, err = reg.add(NodeGroup{Name: "line1", NodeIDs: []string{"ns=3;s=Speed"}})
+	require.NoError(t, err)
+	group, err = reg.add(NodeGroup{Name: "line1", NodeIDs: []string{"ns=3;s=Speed", "ns=3;s=Count"}, File: true})
+	require.NoError(t, err)
+	assert.False(t, group.File, "API groups are never file groups")
+	assert.Len(t, reg.list(), 2)
+	assert.Equal(t, "energy-meters", reg.list()[0].Name)
+
+	require.NoError(t, reg.remove("line1"))
+	assert.Error(t, reg.remove("line1"))
+
+	require.NoError(t, os.WriteFile(path, []byte("groups:\n  bad:\n    - ns=3;i=x\n"), 0644))
+	assert.Error(t, newGroupRegistry().loadGroupsFile(path))
+}
+
+// TestGroupRegistryPersistence tests that only persisted API groups are restored
+func TestGroupRegistryPersistence(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "groups.json")
+
+	reg := newGroupRegistry()
+	require.NoError(t, reg.restore(stateFile))
+	_, err := reg.add(NodeGroup{Name: "energy", NodeIDs: []string{"ns=3;s=Power"}, Persist: true})
+	require.NoError(t, err)
+	_, err = reg.add(NodeGroup{Name: "debug", NodeIDs: []string{"ns=3;s=Debug"}})
+	require.NoError(t, err)
+	_, err = reg.add(NodeGroup{Name: "gone", NodeIDs: []string{"ns=3;s=Old"}, Persist: true})
+	require.NoError(t, err)
+	require.NoError(t, reg.remove("gone"))
+
+	restored := newGroupRegistry()
+	require.NoError(t, restored.restore(stateFile))
+	groups := restored.list()
+	require.Len(t, groups, 1)
+	assert.Equal(t, "energy", groups[0].Name)
+}
+
+// TestExpandNodeGroups tests reading @name arguments through the groups API
+func TestExpandNodeGroups(t *testing.T) {
+	serviceGroups = newGroupRegistry()
+	t.Cleanup(func() { serviceGroups = newGroupRegistry() })
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/groups", handleGroupsRequest)
+	mux.HandleFunc("/api/groups/", handleGroupsRequest)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	handleGroupsRequest(rec, httptest.NewRequest("POST", "/api/groups", strings.NewReader(`{"name": "meters", "nodeIds": ["ns=3;s=M1", "ns=3,s=M2"]}`)))
+	var resp struct {
+		Group NodeGroup `json:"group"`
+		Error string    `json:"error"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Empty(t, resp.Error)
+
+	nodeIDs, err := expandNodeGroups([]string{"i=2258", "@meters", "ns=3;s=M3"}, u.Hostname(), port)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"i=2258", "ns=3;s=M1", "ns=3;s=M2", "ns=3;s=M3"}, nodeIDs)
+
+	_, err = expandNodeGroups([]string{"@unknown"}, u.Hostname(), port)
+	assert.ErrorContains(t, err, "unknown group")
+}
@@ -0,0 +1,343 @@
+//go:build !minimal && !nohistorian
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	includeComponent("historian")
+}
+
+// Schema of SQLite sinks: one row per field of a line. Numeric fields are in
+// value, string fields in text. Like in InfluxDB, a field with the time of
+// one stored before replaces it, e.g. a value sampled again with an
+// unchanged source timestamp
+const historianSchema = `
+CREATE TABLE IF NOT EXISTS samples (
+	time        INTEGER NOT NULL, -- Unix nanoseconds
+	node_id     TEXT NOT NULL,
+	measurement TEXT NOT NULL,
+	tags        TEXT NOT NULL,    -- As in the line
+	field       TEXT NOT NULL,
+	value       REAL,
+	text        TEXT
+);
+CREATE UNIQUE INDEX IF NOT EXISTS samples_node_time ON samples (node_id, time, field, measurement, tags);
+CREATE INDEX IF NOT EXISTS samples_time ON samples (time);
+`
+
+// historian stores the lines of a poll file sink in a SQLite database in WAL
+// mode, so plccli query can read it while the service writes, and deletes
+// samples older than the retention or beyond its size
+type historian struct {
+	path      string
+	retention time.Duration
+	maxSize   int64 // Bytes of data, 0 for no limit
+	db        *sql.DB
+	pruned    time.Time
+	now       func() time.Time
+
+	mu      sync.Mutex
+	storage storageStats
+}
+
+// openHistorian opens or creates the database of a SQLite sink
+func openHistorian(path string, retention time.Duration, maxSize int64) (*historian, error) {
+	db, err := sql.Open("sqlite3", "file:"+url.PathEscape(path)+"?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	// One writer, SQLite serializes writes anyway
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(historianSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create the database: %v", err)
+	}
+	return &historian{path: path, retention: retention, maxSize: maxSize, db: db, now: time.Now}, nil
+}
+
+// write inserts the fields of lines in one transaction, prunes old samples
+// every pruneInterval and the oldest samples beyond the size on every write
+func (h *historian) write(lines []string) error {
+	if len(lines) > 0 {
+		if err := h.insert(lines); err != nil {
+			return err
+		}
+	}
+	if now := h.now(); now.Sub(h.pruned) >= pruneInterval {
+		res, err := h.db.Exec("DELETE FROM samples WHERE time < ?", now.Add(-h.retention).UnixNano())
+		if err != nil {
+			return fmt.Errorf("failed to delete old samples: %v", err)
+		}
+		h.pruned = now
+		if n, _ := res.RowsAffected(); n > 0 {
+			log.Printf("[%s] Sink %s: deleted %d samples older than %v", connectionName, h.path, n, h.retention)
+			h.evicted(n)
+		}
+	}
+
+	size, err := h.dataSize()
+	if err != nil {
+		return err
+	}
+	if h.maxSize > 0 && size > h.maxSize {
+		if size, err = h.shrink(size); err != nil {
+			return fmt.Errorf("failed to delete samples over the size: %v", err)
+		}
+	}
+	h.mu.Lock()
+	h.storage.Bytes = size
+	h.mu.Unlock()
+	return nil
+}
+
+// dataSize returns the bytes of the database in use. Deleted samples free
+// pages for new ones, the file itself does not shrink
+func (h *historian) dataSize() (int64, error) {
+	var pages, free, pageSize int64
+	for pragma, value := range map[string]*int64{"page_count": &pages, "freelist_count": &free, "page_size": &pageSize} {
+		if err := h.db.QueryRow("PRAGMA " + pragma).Scan(value); err != nil {
+			return 0, fmt.Errorf("failed to read the database size: %v", err)
+		}
+	}
+	return (pages - free) * pageSize, nil
+}
+
+// shrink deletes the oldest samples until the data fits in the size and
+// returns the new size
+func (h *historian) shrink(size int64) (int64, error) {
+	var deleted int64
+	for size > h.maxSize {
+		var rows int64
+		if err := h.db.QueryRow("SELECT COUNT(*) FROM samples").Scan(&rows); err != nil {
+			return size, err
+		}
+		if rows == 0 {
+			break // Only the schema is left
+		}
+		// The share of the samples the data is over, and a tenth more so
+		// this does not run on every write
+		n := rows*(size-h.maxSize)/size + rows/10 + 1
+		res, err := h.db.Exec("DELETE FROM samples WHERE rowid IN (SELECT rowid FROM samples ORDER BY time LIMIT ?)", n)
+		if err != nil {
+			return size, err
+		}
+		affected, _ := res.RowsAffected()
+		deleted += affected
+		if size, err = h.dataSize(); err != nil {
+			return size, err
+		}
+	}
+	if deleted > 0 {
+		log.Printf("[%s] Sink %s: deleted the %d oldest samples to stay under %d bytes", connectionName, h.path, deleted, h.maxSize)
+		h.evicted(deleted)
+	}
+	return size, nil
+}
+
+// evicted counts samples deleted by the retention
+func (h *historian) evicted(n int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.storage.Evicted += n
+}
+
+func (h *historian) stats() storageStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.storage
+}
+
+// insert adds the fields of lines to the samples table
+func (h *historian) insert(lines []string) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare("INSERT OR REPLACE INTO samples (time, node_id, measurement, tags, field, value, text) VALUES (?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, line := range lines {
+		l, err := parseInfluxLine(line)
+		if err != nil {
+			continue // Lines come from the poll file, this is not expected
+		}
+		for _, field := range l.fields {
+			var value, text interface{}
+			if field.quoted {
+				text = field.value
+			} else if v, err := strconv.ParseFloat(strings.TrimSuffix(field.value, "i"), 64); err == nil {
+				value = v
+			} else {
+				text = field.value
+			}
+			if _, err := stmt.Exec(l.time.UnixNano(), l.tag("node_id"), l.measurement, l.tags, field.name, value, text); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func (h *historian) close() error {
+	return h.db.Close()
+}
+
+// runQuery reads the samples of a SQLite sink for plccli query
+func runQuery(nodeIDs []string, format string) (string, error) {
+	if queryDB == "" {
+		return "", fmt.Errorf("--db is required, the sqlite file of a poll file sink")
+	}
+	q := historyQuery{limit: queryLimit}
+	now := time.Now()
+	var err error
+	if q.since, err = parseSince(querySince, now); err != nil {
+		return "", fmt.Errorf("--since: %v", err)
+	}
+	if q.until, err = parseSince(queryUntil, now); err != nil {
+		return "", fmt.Errorf("--until: %v", err)
+	}
+	for _, nodeID := range nodeIDs {
+		normalized, err := normalizeNodeID(nodeID)
+		if err != nil {
+			return "", fmt.Errorf("invalid node ID %s: %v", nodeID, err)
+		}
+		q.nodeIDs = append(q.nodeIDs, normalized)
+	}
+
+	samples, err := queryHistory(queryDB, q)
+	if err != nil {
+		return "", err
+	}
+	return formatStoredSamples(samples, format)
+}
+
+// storedSample is a field of a sample stored by a SQLite sink
+type storedSample struct {
+	Time        time.Time   `json:"time"`
+	NodeID      string      `json:"nodeId"`
+	Measurement string      `json:"measurement"`
+	Tags        string      `json:"tags"`
+	Field       string      `json:"field"`
+	Value       interface{} `json:"value"`
+}
+
+// historyQuery selects the samples plccli query reads
+type historyQuery struct {
+	nodeIDs []string  // All nodes when empty
+	since   time.Time // Zero for no lower bound
+	until   time.Time // Zero for no upper bound
+	limit   int       // The latest samples only, 0 for all
+}
+
+// queryHistory reads the samples of a SQLite sink database, oldest first
+func queryHistory(path string, q historyQuery) ([]storedSample, error) {
+	db, err := sql.Open("sqlite3", "file:"+url.PathEscape(path)+"?mode=ro&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	where := []string{"1 = 1"}
+	var args []interface{}
+	if len(q.nodeIDs) > 0 {
+		where = append(where, "node_id IN (?"+strings.Repeat(", ?", len(q.nodeIDs)-1)+")")
+		for _, nodeID := range q.nodeIDs {
+			args = append(args, nodeID)
+		}
+	}
+	if !q.since.IsZero() {
+		where = append(where, "time >= ?")
+		args = append(args, q.since.UnixNano())
+	}
+	if !q.until.IsZero() {
+		where = append(where, "time <= ?")
+		args = append(args, q.until.UnixNano())
+	}
+	limit := math.MaxInt32
+	if q.limit > 0 {
+		limit = q.limit
+	}
+	args = append(args, limit)
+
+	// The latest samples, returned oldest first
+	rows, err := db.Query(`SELECT time, node_id, measurement, tags, field, value, text FROM (
+		SELECT rowid, * FROM samples WHERE `+strings.Join(where, " AND ")+` ORDER BY time DESC, rowid DESC LIMIT ?
+	) ORDER BY time, rowid`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s: %v", path, err)
+	}
+	defer rows.Close()
+
+	var samples []storedSample
+	for rows.Next() {
+		var s storedSample
+		var ns int64
+		var value sql.NullFloat64
+		var text sql.NullString
+		if err := rows.Scan(&ns, &s.NodeID, &s.Measurement, &s.Tags, &s.Field, &value, &text); err != nil {
+			return nil, err
+		}
+		s.Time = time.Unix(0, ns).UTC()
+		if value.Valid {
+			s.Value = value.Float64
+		} else {
+			s.Value = text.String
+		}
+		samples = append(samples, s)
+	}
+	return samples, rows.Err()
+}
+
+// formatStoredSamples formats samples read with plccli query: InfluxDB lines
+// with one field each, JSON, or one tab separated line per sample
+func formatStoredSamples(samples []storedSample, format string) (string, error) {
+	measurementEscaper := strings.NewReplacer(",", "\\,", " ", "\\ ")
+	fieldEscaper := strings.NewReplacer(",", "\\,", "=", "\\=", " ", "\\ ")
+	var lines []string
+	switch format {
+	case "json":
+		if samples == nil {
+			samples = []storedSample{}
+		}
+		data, err := json.MarshalIndent(samples, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	case "influx":
+		for _, s := range samples {
+			key := measurementEscaper.Replace(s.Measurement)
+			if s.Tags != "" {
+				key += "," + s.Tags
+			}
+			value := fmt.Sprintf("%v", s.Value)
+			if text, ok := s.Value.(string); ok {
+				value = "\"" + strings.ReplaceAll(text, "\"", "\\\"") + "\""
+			}
+			lines = append(lines, fmt.Sprintf("%s %s=%s %d", key, fieldEscaper.Replace(s.Field), value, s.Time.UnixNano()))
+		}
+	default:
+		for _, s := range samples {
+			lines = append(lines, fmt.Sprintf("%s\t%s\t%s=%v", s.Time.Format(time.RFC3339Nano), s.NodeID, s.Field, s.Value))
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
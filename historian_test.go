@@ -0,0 +1,106 @@
+//go:build !minimal && !nohistorian
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestHistorian tests storing lines in a SQLite sink, pruning old samples
+// and reading them back like plccli query
+func TestHistorian(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plant data", "history.db")
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	now := time.Date(2026, 3, 10, 8, 0, 0, 0, time.UTC)
+	h, err := openHistorian(path, 7*24*time.Hour, 0)
+	require.NoError(t, err)
+	h.now = func() time.Time { return now }
+
+	old := now.Add(-8 * 24 * time.Hour).UnixNano()
+	require.NoError(t, h.write([]string{
+		"boiler,node_id=ns\\=3;s\\=Temperature,endpoint=plc value=19.5 " + strconv.FormatInt(old, 10),
+		"boiler,node_id=ns\\=3;s\\=Temperature,endpoint=plc value=21.5 " + strconv.FormatInt(now.Add(-2*time.Minute).UnixNano(), 10),
+		"boiler,node_id=ns\\=3;s\\=Temperature,endpoint=plc value=21.7 " + strconv.FormatInt(now.Add(-time.Minute).UnixNano(), 10),
+		`opcua_node,node_id=ns\=3;s\=Recipe,endpoint=plc value=1,string_value="press \"B\"" ` + strconv.FormatInt(now.UnixNano(), 10),
+	}))
+	// Sampled again with the same source timestamp
+	require.NoError(t, h.write([]string{"boiler,node_id=ns\\=3;s\\=Temperature,endpoint=plc value=21.7 " + strconv.FormatInt(now.Add(-time.Minute).UnixNano(), 10)}))
+	require.NoError(t, h.close())
+
+	samples, err := queryHistory(path, historyQuery{})
+	require.NoError(t, err)
+	require.Len(t, samples, 4, "the sample older than the retention was deleted")
+	assert.Equal(t, "ns=3;s=Temperature", samples[0].NodeID)
+	assert.Equal(t, 21.5, samples[0].Value)
+	assert.Equal(t, "press \"B\"", samples[3].Value)
+
+	samples, err = queryHistory(path, historyQuery{nodeIDs: []string{"ns=3;s=Temperature"}, limit: 1})
+	require.NoError(t, err)
+	require.Len(t, samples, 1)
+	assert.Equal(t, 21.7, samples[0].Value, "the latest samples")
+
+	samples, err = queryHistory(path, historyQuery{since: now.Add(-90 * time.Second), until: now.Add(-30 * time.Second)})
+	require.NoError(t, err)
+	require.Len(t, samples, 1)
+
+	out, err := formatStoredSamples(samples, "influx")
+	require.NoError(t, err)
+	assert.Equal(t, "boiler,node_id=ns\\=3;s\\=Temperature,endpoint=plc value=21.7 "+strconv.FormatInt(now.Add(-time.Minute).UnixNano(), 10), out)
+	out, err = formatStoredSamples(samples, "default")
+	require.NoError(t, err)
+	assert.Equal(t, "2026-03-10T07:59:00Z\tns=3;s=Temperature\tvalue=21.7", out)
+	out, err = formatStoredSamples(nil, "json")
+	require.NoError(t, err)
+	assert.Equal(t, "[]", out)
+
+	_, err = queryHistory(filepath.Join(t.TempDir(), "missing.db"), historyQuery{})
+	assert.Error(t, err)
+
+	for retention, want := range map[string]time.Duration{"": defaultRetention, "30d": 30 * 24 * time.Hour, "72h": 72 * time.Hour} {
+		d, err := parseRetention(retention)
+		require.NoError(t, err)
+		assert.Equal(t, want, d)
+	}
+	for _, bad := range []string{"0d", "-1h", "month"} {
+		_, err := parseRetention(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+// TestHistorianSize tests that a SQLite sink deletes the oldest samples when
+// its data is over the retention size
+func TestHistorianSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	now := time.Date(2026, 3, 10, 8, 0, 0, 0, time.UTC)
+	h, err := openHistorian(path, defaultRetention, 256<<10)
+	require.NoError(t, err)
+	h.now = func() time.Time { return now }
+	defer h.close()
+
+	for batch := 0; batch < 20; batch++ {
+		var lines []string
+		for i := 0; i < 500; i++ {
+			ts := now.Add(time.Duration(batch*500+i) * time.Millisecond).UnixNano()
+			lines = append(lines, "boiler,node_id=ns\\=3;s\\=Temperature,endpoint=plc value=21.5 "+strconv.FormatInt(ts, 10))
+		}
+		require.NoError(t, h.write(lines))
+	}
+	stats := h.stats()
+	assert.LessOrEqual(t, stats.Bytes, int64(256<<10))
+	assert.Greater(t, stats.Evicted, int64(0))
+
+	samples, err := queryHistory(path, historyQuery{limit: 1})
+	require.NoError(t, err)
+	require.Len(t, samples, 1)
+	assert.Equal(t, now.Add(9999*time.Millisecond), samples[0].Time, "the latest sample is kept")
+	samples, err = queryHistory(path, historyQuery{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(10000), int64(len(samples))+stats.Evicted)
+}
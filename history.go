@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+)
+
+// Values per history read request of a history export
+const historyPageSize = 1000
+
+// historyExport is the state of a history export job. It is saved after every
+// page of values, so an export interrupted by a service restart resumes where
+// it stopped instead of starting over
+//
+// OPC UA continuation points belong to the server session and are lost with
+// it, so the export resumes from the timestamp of the last exported value.
+// LastCount values with that timestamp were already exported and are skipped
+type historyExport struct {
+	ID        string    `json:"id"` // Name of the state and data files
+	NodeIDs   []string  `json:"nodeIds"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Node      int       `json:"node"`            // Index of the node being exported
+	Last      time.Time `json:"last"`            // Timestamp of the last exported value of the node
+	LastCount int       `json:"lastCount"`       // Exported values of the node with the Last timestamp
+	Samples   int64     `json:"samples"`         // Values exported so far
+	Offset    int64     `json:"offset"`          // Size of the data file when the state was saved
+	Owner     string    `json:"owner,omitempty"` // Identity of the tenant that started it
+}
+
+// newHistoryExport creates the state of a new export
+func newHistoryExport(nodeIDs []string, start, end time.Time) *historyExport {
+	return &historyExport{
+		ID:      "export-" + time.Now().Format("20060102-150405.000000"),
+		NodeIDs: nodeIDs,
+		Start:   start,
+		End:     end,
+	}
+}
+
+func (e *historyExport) statePath(dir string) string {
+	return filepath.Join(dir, e.ID+".json")
+}
+
+func (e *historyExport) dataPath(dir string) string {
+	return filepath.Join(dir, e.ID+".jsonl")
+}
+
+// save writes the export state. The state file is replaced atomically, so a
+// crash leaves either the old or the new state
+func (e *historyExport) save(dir string) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to encode export state: %v", err)
+	}
+	tmp := e.statePath(dir) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write export state %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, e.statePath(dir)); err != nil {
+		return fmt.Errorf("failed to write export state %s: %v", e.statePath(dir), err)
+	}
+	return nil
+}
+
+// loadHistoryExports loads the state of all unfinished exports in dir
+func loadHistoryExports(dir string) ([]*historyExport, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var exports []*historyExport
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read export state %s: %v", path, err)
+		}
+		e := &historyExport{}
+		if err := json.Unmarshal(data, e); err != nil {
+			return nil, fmt.Errorf("failed to parse export state %s: %v", path, err)
+		}
+		exports = append(exports, e)
+	}
+	return exports, nil
+}
+
+// run exports the history of all nodes to the data file, continuing from the
+// saved state. The state file is removed when the export ends; the data file
+// is kept, with the values exported so far if the export failed
+func (e *historyExport) run(ctx context.Context, client *opcua.Client, dir string, j *job) (map[string]interface{}, error) {
+	err := e.export(ctx, client, dir, j)
+	if rmErr := os.Remove(e.statePath(dir)); rmErr != nil && !os.IsNotExist(rmErr) {
+		log.Printf("[%s] Failed to remove export state: %v", connectionName, rmErr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"id":      e.ID,
+		"file":    e.dataPath(dir),
+		"nodes":   len(e.NodeIDs),
+		"samples": e.Samples,
+	}, nil
+}
+
+func (e *historyExport) export(ctx context.Context, client *opcua.Client, dir string, j *job) error {
+	f, err := os.OpenFile(e.dataPath(dir), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open export file: %v", err)
+	}
+	defer f.Close()
+
+	// Drop values written after the state was last saved, they are read again
+	if err := f.Truncate(e.Offset); err != nil {
+		return fmt.Errorf("failed to truncate export file: %v", err)
+	}
+	if _, err := f.Seek(e.Offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek export file: %v", err)
+	}
+	if err := e.save(dir); err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	atomic.StoreInt64(&j.progress, e.Samples)
+
+	for e.Node < len(e.NodeIDs) {
+		if err := e.exportNode(ctx, client, dir, f, w, j); err != nil {
+			return err
+		}
+		e.Node++
+		e.Last = time.Time{}
+		e.LastCount = 0
+		if err := e.checkpoint(dir, f, w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportNode exports the history of the current node page by page
+func (e *historyExport) exportNode(ctx context.Context, client *opcua.Client, dir string, f *os.File, w *bufio.Writer, j *job) error {
+	nodeIDStr := e.NodeIDs[e.Node]
+	nodeID, err := resolveNodeID(nodeIDStr)
+	if err != nil {
+		return fmt.Errorf("invalid node ID %s: %v", nodeIDStr, err)
+	}
+
+	details := &ua.ReadRawModifiedDetails{
+		StartTime:        e.Start,
+		EndTime:          e.End,
+		NumValuesPerNode: historyPageSize,
+	}
+	skip := 0
+	if !e.Last.IsZero() {
+		details.StartTime = e.Last
+		skip = e.LastCount
+	}
+
+	var continuation []byte
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		resp, err := client.HistoryReadRawModified(ctx, []*ua.HistoryReadValueID{
+			{NodeID: nodeID, ContinuationPoint: continuation},
+		}, details)
+		if err != nil {
+			return fmt.Errorf("history read of %s failed: %v", nodeIDStr, err)
+		}
+		if len(resp.Results) != 1 {
+			return fmt.Errorf("history read of %s returned %d results", nodeIDStr, len(resp.Results))
+		}
+		result := resp.Results[0]
+		switch result.StatusCode {
+		case ua.StatusOK, ua.StatusGoodMoreData, ua.StatusGoodNoData:
+		default:
+			return fmt.Errorf("history read of %s failed: %v", nodeIDStr, result.StatusCode)
+		}
+
+		var values []*ua.DataValue
+		if result.HistoryData != nil {
+			if data, ok := result.HistoryData.Value.(*ua.HistoryData); ok {
+				values = data.DataValues
+			}
+		}
+		if skip, err = e.writeValues(w, nodeIDStr, values, skip); err != nil {
+			return err
+		}
+		if err := e.checkpoint(dir, f, w); err != nil {
+			return err
+		}
+		atomic.StoreInt64(&j.progress, e.Samples)
+
+		continuation = result.ContinuationPoint
+		if len(continuation) == 0 {
+			return nil
+		}
+	}
+}
+
+// writeValues writes one line per value and advances the resume position.
+// The first skip values with the Last timestamp were exported before the
+// restart and are left out. Returns the number of values still to skip
+func (e *historyExport) writeValues(w io.Writer, nodeID string, values []*ua.DataValue, skip int) (int, error) {
+	enc := json.NewEncoder(w)
+	for _, dataValue := range values {
+		if dataValue == nil {
+			continue
+		}
+		timestamp := dataValue.SourceTimestamp
+		if timestamp.IsZero() {
+			timestamp = dataValue.ServerTimestamp
+		}
+		if skip > 0 && timestamp.Equal(e.Last) {
+			skip--
+			continue
+		}
+		skip = 0
+
+		line := NodeResponse{NodeID: nodeID}
+		if dataValue.Status != ua.StatusOK {
+			line.Error = fmt.Sprintf("%v", dataValue.Status)
+		} else if dataValue.Value != nil {
+			line.Value = dataValue.Value.Value()
+		}
+		setResponseTimestamps(&line, dataValue)
+		if err := enc.Encode(line); err != nil {
+			return skip, fmt.Errorf("failed to write export file: %v", err)
+		}
+
+		if timestamp.Equal(e.Last) {
+			e.LastCount++
+		} else {
+			e.Last = timestamp
+			e.LastCount = 1
+		}
+		e.Samples++
+	}
+	return skip, nil
+}
+
+// checkpoint flushes the exported values to disk and saves the state
+func (e *historyExport) checkpoint(dir string, f *os.File, w *bufio.Writer) error {
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write export file: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync export file: %v", err)
+	}
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("failed to seek export file: %v", err)
+	}
+	e.Offset = offset
+	return e.save(dir)
+}
+
+// historyExportJob exports the raw history of nodes to a file
+func historyExportJob(client *opcua.Client, e *historyExport, dir string) func(ctx context.Context, j *job) (map[string]interface{}, error) {
+	return func(ctx context.Context, j *job) (map[string]interface{}, error) {
+		serviceJobs.setPhase(j, "exporting", 0)
+		return e.run(ctx, client, dir, j)
+	}
+}
+
+// startHistoryExport saves the state of a new export and starts its job for
+// a tenant, by its identity
+func startHistoryExport(client *opcua.Client, nodeIDs []string, start, end time.Time, owner string) (*job, error) {
+	dir, err := serviceConfigDir("history")
+	if err != nil {
+		return nil, err
+	}
+	e := newHistoryExport(nodeIDs, start, end)
+	e.Owner = owner
+	if err := e.save(dir); err != nil {
+		return nil, err
+	}
+	return serviceJobs.start("history-export", strings.Join(nodeIDs, ","), owner, historyExportJob(client, e, dir)), nil
+}
+
+// resumeHistoryExports restarts the exports that were interrupted by a
+// service restart
+func resumeHistoryExports(client *opcua.Client) {
+	dir, err := serviceConfigDir("history")
+	if err != nil {
+		log.Printf("[%s] Not resuming history exports: %v", connectionName, err)
+		return
+	}
+	exports, err := loadHistoryExports(dir)
+	if err != nil {
+		log.Printf("[%s] Not resuming history exports: %v", connectionName, err)
+		return
+	}
+	for _, e := range exports {
+		j := serviceJobs.start("history-export", strings.Join(e.NodeIDs, ","), e.Owner, historyExportJob(client, e, dir))
+		log.Printf("[%s] Resuming history export %s as job %s (%d values exported)", connectionName, e.ID, j.id, e.Samples)
+	}
+}
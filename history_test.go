@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestHistoryExportState tests saving and loading the state of unfinished exports
+func TestHistoryExportState(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	e := newHistoryExport([]string{"ns=3;s=A", "ns=3;s=B"}, start, start.Add(24*time.Hour))
+	e.Node = 1
+	e.Last = start.Add(time.Hour)
+	e.LastCount = 2
+	e.Samples = 1234
+	e.Offset = 56789
+	require.NoError(t, e.save(dir))
+
+	exports, err := loadHistoryExports(dir)
+	require.NoError(t, err)
+	require.Len(t, exports, 1)
+	assert.Equal(t, e.ID, exports[0].ID)
+	assert.Equal(t, e.NodeIDs, exports[0].NodeIDs)
+	assert.Equal(t, 1, exports[0].Node)
+	assert.True(t, e.Last.Equal(exports[0].Last))
+	assert.Equal(t, 2, exports[0].LastCount)
+	assert.Equal(t, int64(56789), exports[0].Offset)
+
+	exports, err = loadHistoryExports(t.TempDir())
+	require.NoError(t, err)
+	assert.Empty(t, exports)
+}
+
+// TestHistoryExportWriteValues tests that a resumed export skips the values it
+// already exported with the last timestamp
+func TestHistoryExportWriteValues(t *testing.T) {
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	value := func(ts time.Time, v float64) *ua.DataValue {
+		return &ua.DataValue{Value: ua.MustVariant(v), SourceTimestamp: ts}
+	}
+
+	e := &historyExport{}
+	var buf bytes.Buffer
+	skip, err := e.writeValues(&buf, "ns=3;s=A", []*ua.DataValue{value(t0, 1), value(t0.Add(time.Second), 2), value(t0.Add(time.Second), 3)}, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 0, skip)
+	assert.Equal(t, int64(3), e.Samples)
+	assert.True(t, e.Last.Equal(t0.Add(time.Second)))
+	assert.Equal(t, 2, e.LastCount)
+
+	// After a restart the read starts again at the last timestamp
+	buf.Reset()
+	skip, err = e.writeValues(&buf, "ns=3;s=A", []*ua.DataValue{value(t0.Add(time.Second), 2), value(t0.Add(time.Second), 3), value(t0.Add(2*time.Second), 4)}, e.LastCount)
+	require.NoError(t, err)
+	assert.Equal(t, 0, skip)
+	assert.Equal(t, int64(4), e.Samples)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 1)
+	assert.Contains(t, lines[0], `"value":4`)
+	assert.True(t, e.Last.Equal(t0.Add(2*time.Second)))
+	assert.Equal(t, 1, e.LastCount)
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+)
+
+// Finished jobs are kept this long for their results to be fetched
+const jobRetention = time.Hour
+
+// Nodes per read request of a subtree read job
+const subtreeReadChunk = 100
+
+// Job states
+const (
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// jobManager runs long operations (big browses, subtree reads, history
+// exports) in the
+// background, so clients poll for progress instead of holding one HTTP
+// request open until a proxy kills it
+type jobManager struct {
+	mu    sync.Mutex
+	jobs  map[string]*job
+	order []string
+}
+
+type job struct {
+	id       string
+	kind     string
+	target   string
+	started  time.Time
+	finished time.Time
+	state    string
+	err      string
+	phase    string
+	progress int64 // Updated atomically while running
+	total    int64 // Updated atomically while running, 0 if unknown
+	result   map[string]interface{}
+}
+
+// JobInfo is the API representation of a job
+type JobInfo struct {
+	ID       string     `json:"id"`
+	Kind     string     `json:"kind"`   // browse, read-subtree or history-export
+	Target   string     `json:"target"` // Start node, or exported nodes
+	State    string     `json:"state"`  // running, done, failed or cancelled
+	Phase    string     `json:"phase,omitempty"`
+	Progress int64      `json:"progress"`        // Nodes browsed or read, or values exported so far
+	Total    int64      `json:"total,omitempty"` // Nodes to read, when known
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// Global job manager for service mode
+var serviceJobs = newJobManager()
+
+func newJobManager() *jobManager {
+	return &jobManager{jobs: make(map[string]*job)}
+}
+
+// start runs fn in the background as a new job of a tenant, by its identity.
+// The job is registered as an operation, so the tenant can cancel it like
+// any other long operation
+func (m *jobManager) start(kind, target, owner string, fn func(ctx context.Context, j *job) (map[string]interface{}, error)) *job {
+	opID, ctx := serviceOperations.start(context.Background(), "job", target, owner)
+	j := &job{
+		id:      opID,
+		kind:    kind,
+		target:  target,
+		started: time.Now(),
+		state:   jobRunning,
+	}
+
+	m.mu.Lock()
+	m.prune(j.started)
+	m.jobs[j.id] = j
+	m.order = append(m.order, j.id)
+	m.mu.Unlock()
+
+	go func() {
+		result, err := fn(ctx, j)
+		cancelled := ctx.Err() == context.Canceled
+		serviceOperations.done(opID)
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		j.finished = time.Now()
+		switch {
+		case cancelled:
+			j.state = jobCancelled
+			j.err = fmt.Sprintf("job %s was cancelled", j.id)
+		case err != nil:
+			j.state = jobFailed
+			j.err = err.Error()
+		default:
+			j.state = jobDone
+			j.result = result
+		}
+	}()
+	return j
+}
+
+// prune drops jobs that finished more than jobRetention ago. Callers must hold m.mu
+func (m *jobManager) prune(now time.Time) {
+	kept := m.order[:0]
+	for _, jobID := range m.order {
+		j := m.jobs[jobID]
+		if j.state != jobRunning && now.Sub(j.finished) > jobRetention {
+			delete(m.jobs, jobID)
+			continue
+		}
+		kept = append(kept, jobID)
+	}
+	m.order = kept
+}
+
+// get returns the info of a job and its result once done
+func (m *jobManager) get(jobID string) (JobInfo, map[string]interface{}, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[jobID]
+	if !ok {
+		return JobInfo{}, nil, false
+	}
+	return j.info(), j.result, true
+}
+
+// snapshot lists all jobs in start order
+func (m *jobManager) snapshot() []JobInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prune(time.Now())
+	result := make([]JobInfo, 0, len(m.order))
+	for _, jobID := range m.order {
+		result = append(result, m.jobs[jobID].info())
+	}
+	return result
+}
+
+// info returns the API representation of a job. Callers must hold the manager's mutex
+func (j *job) info() JobInfo {
+	info := JobInfo{
+		ID:       j.id,
+		Kind:     j.kind,
+		Target:   j.target,
+		State:    j.state,
+		Phase:    j.phase,
+		Progress: atomic.LoadInt64(&j.progress),
+		Total:    atomic.LoadInt64(&j.total),
+		Started:  j.started,
+		Error:    j.err,
+	}
+	if !j.finished.IsZero() {
+		finished := j.finished
+		info.Finished = &finished
+	}
+	return info
+}
+
+// setPhase starts a new phase of a job and resets its progress
+func (m *jobManager) setPhase(j *job, phase string, total int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j.phase = phase
+	atomic.StoreInt64(&j.progress, 0)
+	atomic.StoreInt64(&j.total, total)
+}
+
+// browseJob browses a subtree. The result has the same format as /api/browse
+func browseJob(client *opcua.Client, nodeID string, maxDepth int) func(ctx context.Context, j *job) (map[string]interface{}, error) {
+	return func(ctx context.Context, j *job) (map[string]interface{}, error) {
+		serviceJobs.setPhase(j, "browsing", 0)
+		nodes, err := doBrowse(ctx, client, nodeID, maxDepth, &j.progress)
+		if err != nil {
+			return nil, fmt.Errorf("browse failed: %v", err)
+		}
+		return map[string]interface{}{"nodes": browseResultNodes(nodes)}, nil
+	}
+}
+
+// readSubtreeJob browses a subtree and reads the values of all variables in
+// it. The result has the same format as /api/nodes
+func readSubtreeJob(client *opcua.Client, nodeID string, maxDepth int) func(ctx context.Context, j *job) (map[string]interface{}, error) {
+	return func(ctx context.Context, j *job) (map[string]interface{}, error) {
+		serviceJobs.setPhase(j, "browsing", 0)
+		nodes, err := doBrowse(ctx, client, nodeID, maxDepth, &j.progress)
+		if err != nil {
+			return nil, fmt.Errorf("browse failed: %v", err)
+		}
+
+		serviceJobs.setPhase(j, "reading", int64(len(nodes)))
+		results := make([]NodeResponse, 0, len(nodes))
+		for start := 0; start < len(nodes); start += subtreeReadChunk {
+			end := start + subtreeReadChunk
+			if end > len(nodes) {
+				end = len(nodes)
+			}
+			chunk, err := readNodeInfos(ctx, client, nodes[start:end])
+			if err != nil {
+				return nil, fmt.Errorf("read failed: %v", err)
+			}
+			results = append(results, chunk...)
+			atomic.StoreInt64(&j.progress, int64(end))
+		}
+		return map[string]interface{}{"results": results}, nil
+	}
+}
+
+// readNodeInfos reads the values of browsed nodes with as few read requests as
+// the server allows
+func readNodeInfos(ctx context.Context, client *opcua.Client, nodes []NodeInfo) ([]NodeResponse, error) {
+	ids := make([]*ua.NodeID, len(nodes))
+	for i, node := range nodes {
+		ids[i] = node.NodeID
+	}
+	dataValues, err := readNodeDataValues(ctx, client, ids)
+	if err != nil {
+		return nil, err
+	}
+	return nodeInfoResults(ctx, client, nodes, dataValues), nil
+}
+
+// nodeInfoResults returns the responses of browsed nodes for the data values
+// read from them
+func nodeInfoResults(ctx context.Context, client *opcua.Client, nodes []NodeInfo, dataValues []*ua.DataValue) []NodeResponse {
+	results := make([]NodeResponse, len(nodes))
+	for i, dataValue := range dataValues {
+		results[i] = NodeResponse{NodeID: nodes[i].NodeID.String()}
+		if dataValue.Status != ua.StatusOK {
+			results[i].Error = fmt.Sprintf("Failed to read node: %v", dataValue.Status)
+			continue
+		}
+		if dataValue.Value != nil {
+			results[i].Value = decodeStructures(ctx, client, nodes[i].NodeID, dataValue.Value.Value())
+		}
+		setResponseTimestamps(&results[i], dataValue)
+	}
+	return results
+}
+
+// handleJobsRequest starts jobs (POST /api/jobs), lists them (GET /api/jobs),
+// reports progress (GET /api/jobs/<id>) and results (GET /api/jobs/<id>/result)
+// and cancels them (DELETE /api/jobs/<id>)
+func handleJobsRequest(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/jobs"), "/")
+	jobID, sub, _ := strings.Cut(path, "/")
+
+	switch {
+	case jobID == "" && r.Method == http.MethodPost:
+		handleJobStart(w, r)
+
+	case jobID == "" && r.Method == http.MethodGet:
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"jobs": serviceJobs.snapshot(),
+		})
+
+	case jobID != "" && sub == "" && r.Method == http.MethodGet:
+		info, _, ok := serviceJobs.get(jobID)
+		if !ok {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": fmt.Sprintf("unknown job %s", jobID),
+			})
+			return
+		}
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"job": info,
+		})
+
+	case jobID != "" && sub == "result" && r.Method == http.MethodGet:
+		info, result, ok := serviceJobs.get(jobID)
+		switch {
+		case !ok:
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": fmt.Sprintf("unknown job %s", jobID),
+			})
+		case info.State == jobRunning:
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": fmt.Sprintf("job %s is still running", jobID),
+			})
+		case info.State != jobDone:
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": info.Error,
+			})
+		default:
+			sendJSONResponseGeneric(w, result)
+		}
+
+	case jobID != "" && sub == "" && r.Method == http.MethodDelete:
+		if err := serviceOperations.cancel(jobID, tenantIdentity(r)); err != nil {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": err.Error(),
+			})
+			return
+		}
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"cancelled": jobID,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleJobStart starts a browse, read-subtree or history-export job
+func handleJobStart(w http.ResponseWriter, r *http.Request) {
+	var jobRequest struct {
+		Kind     string    `json:"kind"`     // browse, read-subtree or history-export
+		NodeID   string    `json:"nodeId"`   // Defaults to the Objects folder
+		MaxDepth *int      `json:"maxDepth"` // Defaults to 10
+		NodeIDs  []string  `json:"nodeIds"`  // Nodes of a history export
+		Start    time.Time `json:"start"`    // History export range
+		End      time.Time `json:"end"`      // Defaults to now
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jobRequest); err != nil {
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"error": fmt.Sprintf("Failed to parse request: %v", err),
+		})
+		return
+	}
+
+	nodeIDStr := jobRequest.NodeID
+	if nodeIDStr == "" {
+		nodeIDStr = "i=84"
+	}
+	nodeIDStr = strings.Replace(nodeIDStr, ",", ";", 1)
+	maxDepth := 10
+	if jobRequest.MaxDepth != nil {
+		maxDepth = *jobRequest.MaxDepth
+	}
+
+	clientMutex.Lock()
+	client := opcuaClient
+	clientMutex.Unlock()
+
+	if client == nil {
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"error": "OPCUA client not connected",
+		})
+		return
+	}
+
+	var j *job
+	switch jobRequest.Kind {
+	case "browse":
+		j = serviceJobs.start("browse", nodeIDStr, tenantIdentity(r), browseJob(client, nodeIDStr, maxDepth))
+	case "read-subtree":
+		j = serviceJobs.start("read-subtree", nodeIDStr, tenantIdentity(r), readSubtreeJob(client, nodeIDStr, maxDepth))
+	case "history-export":
+		end := jobRequest.End
+		if end.IsZero() {
+			end = time.Now()
+		}
+		var err error
+		switch {
+		case len(jobRequest.NodeIDs) == 0:
+			err = fmt.Errorf("history-export needs nodeIds")
+		case !jobRequest.Start.Before(end):
+			err = fmt.Errorf("history-export start %v is not before end %v", jobRequest.Start, end)
+		default:
+			j, err = startHistoryExport(client, jobRequest.NodeIDs, jobRequest.Start, end, tenantIdentity(r))
+		}
+		if err != nil {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": err.Error(),
+			})
+			return
+		}
+	default:
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"error": fmt.Sprintf("Unsupported job kind %q. Use browse, read-subtree or history-export", jobRequest.Kind),
+		})
+		return
+	}
+
+	info, _, _ := serviceJobs.get(j.id)
+	w.Header().Set(operationIDHeader, j.id)
+	sendJSONResponseGeneric(w, map[string]interface{}{
+		"job": info,
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestJobManager tests job progress, results, failures and cancellation
+func TestJobManager(t *testing.T) {
+	m := newJobManager()
+	release := make(chan struct{})
+
+	j := m.start("browse", "ns=3;s=Line1", "", func(ctx context.Context, j *job) (map[string]interface{}, error) {
+		atomic.StoreInt64(&j.progress, 42)
+		<-release
+		return map[string]interface{}{"nodes": []string{"a"}}, nil
+	})
+	require.Eventually(t, func() bool {
+		info, _, _ := m.get(j.id)
+		return info.Progress == 42
+	}, time.Second, time.Millisecond)
+
+	info, result, ok := m.get(j.id)
+	require.True(t, ok)
+	assert.Equal(t, jobRunning, info.State)
+	assert.Nil(t, result)
+	assert.Nil(t, info.Finished)
+
+	close(release)
+	require.Eventually(t, func() bool {
+		info, _, _ := m.get(j.id)
+		return info.State == jobDone
+	}, time.Second, time.Millisecond)
+	_, result, _ = m.get(j.id)
+	assert.Equal(t, []string{"a"}, result["nodes"])
+
+	failed := m.start("browse", "i=84", "", func(ctx context.Context, j *job) (map[string]interface{}, error) {
+		return nil, fmt.Errorf("browse failed")
+	})
+	cancelled := m.start("read-subtree", "i=84", "", func(ctx context.Context, j *job) (map[string]interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	require.NoError(t, serviceOperations.cancel(cancelled.id, ""))
+
+	require.Eventually(t, func() bool {
+		failedInfo, _, _ := m.get(failed.id)
+		cancelledInfo, _, _ := m.get(cancelled.id)
+		return failedInfo.State == jobFailed && cancelledInfo.State == jobCancelled
+	}, time.Second, time.Millisecond)
+	assert.Len(t, m.snapshot(), 3)
+
+	_, _, ok = m.get("j-999")
+	assert.False(t, ok)
+}
+
+// TestJobManagerPrune tests that finished jobs are dropped after the retention time
+func TestJobManagerPrune(t *testing.T) {
+	m := newJobManager()
+	j := m.start("browse", "i=84", "", func(ctx context.Context, j *job) (map[string]interface{}, error) {
+		return nil, nil
+	})
+	require.Eventually(t, func() bool {
+		info, _, _ := m.get(j.id)
+		return info.State == jobDone
+	}, time.Second, time.Millisecond)
+
+	m.mu.Lock()
+	m.prune(time.Now())
+	assert.Len(t, m.order, 1)
+	m.prune(time.Now().Add(jobRetention + time.Minute))
+	assert.Empty(t, m.order)
+	m.mu.Unlock()
+}
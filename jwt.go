@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Clock skew allowed between the identity provider and the gateway when
+// checking exp and nbf
+const jwtLeeway = time.Minute
+
+// Tokens signed with an unknown key fetch the JWKS again, at most this often,
+// so keys the provider rotated in are found without refetching per request
+const jwksRefreshInterval = time.Minute
+
+// jwtAuthenticator validates JWT access tokens of an OIDC provider such as
+// Keycloak or Entra ID locally, with the signing keys of its JWKS, so the
+// provider is not asked per token. Tokens must be issued by the issuer for
+// the audience $PLCCLI_AUTH_AUDIENCE. Their roles (roles, realm_access,
+// resource_access of the audience) or scopes (scope, scp) <prefix>:read and
+// <prefix>:write give read or write access, the prefix is $PLCCLI_AUTH_SCOPE
+// as for introspection
+type jwtAuthenticator struct {
+	issuer   string
+	audience string
+	scope    string
+	jwksURL  string // From the provider's discovery document unless $PLCCLI_AUTH_JWKS_URL is set
+	client   *http.Client
+	now      func() time.Time
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey // By kid
+	fetched time.Time
+}
+
+func newJWTAuthenticator(issuer string, getenv func(string) string) (*jwtAuthenticator, error) {
+	u, err := url.Parse(issuer)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("jwt: needs the issuer URL, e.g. jwt:https://idp/realms/plant")
+	}
+	a := &jwtAuthenticator{
+		issuer:   issuer,
+		audience: getenv("PLCCLI_AUTH_AUDIENCE"),
+		scope:    getenv("PLCCLI_AUTH_SCOPE"),
+		jwksURL:  getenv("PLCCLI_AUTH_JWKS_URL"),
+		client:   &http.Client{Timeout: authHookTimeout},
+		now:      time.Now,
+	}
+	// Without an audience, tokens the provider issued for any other
+	// application would be accepted
+	if a.audience == "" {
+		return nil, fmt.Errorf("jwt: $PLCCLI_AUTH_AUDIENCE is not set")
+	}
+	if a.scope == "" {
+		a.scope = "plccli"
+	}
+	return a, nil
+}
+
+// jwtHeader is the JOSE header of a token
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+func (a *jwtAuthenticator) authenticate(ctx context.Context, token string) (*tenant, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil // Not a JWT, e.g. an opaque token
+	}
+	var header jwtHeader
+	var claims map[string]interface{}
+	if decodeJWTPart(parts[0], &header) != nil || decodeJWTPart(parts[1], &claims) != nil {
+		return nil, nil
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil
+	}
+
+	key, err := a.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil || verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], signature) != nil {
+		return nil, nil
+	}
+
+	now := a.now()
+	if iss, _ := claims["iss"].(string); iss != a.issuer {
+		return nil, nil
+	}
+	if !jwtAudienceContains(claims["aud"], a.audience) {
+		return nil, nil
+	}
+	exp, ok := jwtTime(claims["exp"])
+	if !ok || !now.Before(exp.Add(jwtLeeway)) {
+		return nil, nil
+	}
+	if nbf, ok := jwtTime(claims["nbf"]); ok && now.Add(jwtLeeway).Before(nbf) {
+		return nil, nil
+	}
+
+	t := &tenant{Access: scopeAccess(a.scope, jwtRoles(claims, a.audience)), expires: exp, source: "jwt"}
+	for _, claim := range []string{"preferred_username", "azp", "appid", "client_id", "sub"} {
+		if name, _ := claims[claim].(string); t.Name == "" {
+			t.Name = name
+		}
+	}
+	if t.Access == "" || t.Name == "" {
+		return nil, nil
+	}
+	return t, nil
+}
+
+// decodeJWTPart decodes the base64url JSON of a token's header or claims
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// jwtAudienceContains reports whether the aud claim, a string or a list,
+// holds the audience
+func jwtAudienceContains(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jwtTime returns a NumericDate claim such as exp
+func jwtTime(claim interface{}) (time.Time, bool) {
+	seconds, ok := claim.(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+// jwtRoles collects the roles and scopes of a token: roles (Entra ID app
+// roles), realm_access.roles and resource_access.<audience>.roles (Keycloak
+// realm and client roles), and the space separated scope and scp claims
+func jwtRoles(claims map[string]interface{}, audience string) []string {
+	var roles []string
+	addRoles := func(list interface{}) {
+		items, _ := list.([]interface{})
+		for _, item := range items {
+			if role, ok := item.(string); ok {
+				roles = append(roles, role)
+			}
+		}
+	}
+	addRoles(claims["roles"])
+	if realm, ok := claims["realm_access"].(map[string]interface{}); ok {
+		addRoles(realm["roles"])
+	}
+	if resources, ok := claims["resource_access"].(map[string]interface{}); ok {
+		if client, ok := resources[audience].(map[string]interface{}); ok {
+			addRoles(client["roles"])
+		}
+	}
+	for _, claim := range []string{"scope", "scp"} {
+		if scopes, ok := claims[claim].(string); ok {
+			roles = append(roles, strings.Fields(scopes)...)
+		}
+	}
+	return roles
+}
+
+// verifyJWTSignature checks the signature of a token's header and claims.
+// Only the asymmetric algorithms of OIDC providers are accepted, never none
+// or HMAC, which would let the key be taken for a shared secret
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	hashes := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}
+	if len(alg) != 5 || hashes[alg[2:]] == 0 {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	hash := hashes[alg[2:]]
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+		case "PS":
+			return rsa.VerifyPSS(key, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || len(signature) != 2*size {
+			break
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if ecdsa.Verify(key, digest, r, s) {
+			return nil
+		}
+		return fmt.Errorf("invalid signature")
+	}
+	return fmt.Errorf("algorithm %q does not match the key", alg)
+}
+
+// key returns the signing key with a kid, fetching the JWKS when the key is
+// not known yet. Unknown keys are nil, failures to fetch the JWKS errors
+func (a *jwtAuthenticator) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	lookup := func() crypto.PublicKey {
+		if key, ok := a.keys[kid]; ok {
+			return key
+		}
+		// Providers with a single key may leave out kid
+		if kid == "" && len(a.keys) == 1 {
+			for _, key := range a.keys {
+				return key
+			}
+		}
+		return nil
+	}
+	if key := lookup(); key != nil {
+		return key, nil
+	}
+	if a.keys != nil && a.now().Sub(a.fetched) < jwksRefreshInterval {
+		return nil, nil
+	}
+
+	keys, err := a.fetchKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	a.keys, a.fetched = keys, a.now()
+	return lookup(), nil
+}
+
+// fetchKeys reads the JWKS, finding its URL in the discovery document of the
+// issuer unless it is configured
+func (a *jwtAuthenticator) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	jwksURL := a.jwksURL
+	if jwksURL == "" {
+		var discovery struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := a.getJSON(ctx, strings.TrimSuffix(a.issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, fmt.Errorf("OIDC discovery failed: %v", err)
+		}
+		if discovery.Issuer != a.issuer || discovery.JWKSURI == "" {
+			return nil, fmt.Errorf("OIDC discovery of %s returned issuer %q and jwks_uri %q", a.issuer, discovery.Issuer, discovery.JWKSURI)
+		}
+		jwksURL = discovery.JWKSURI
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := a.getJSON(ctx, jwksURL, &jwks); err != nil {
+		return nil, fmt.Errorf("JWKS fetch failed: %v", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		// Keys of other types, e.g. for encryption, are skipped
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS %s has no RSA or EC signing keys", jwksURL)
+	}
+	return keys, nil
+}
+
+func (a *jwtAuthenticator) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s answered %s: %s", url, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// jsonWebKey is a public key of a JWKS (RFC 7517)
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		data, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(data) == 0 {
+			return nil, fmt.Errorf("invalid key parameter")
+		}
+		return new(big.Int).SetBytes(data), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]struct {
+			curve elliptic.Curve
+			ecdh  ecdh.Curve
+		}{
+			"P-256": {elliptic.P256(), ecdh.P256()},
+			"P-384": {elliptic.P384(), ecdh.P384()},
+			"P-521": {elliptic.P521(), ecdh.P521()},
+		}
+		c, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		// Parsing the uncompressed point checks that it is on the curve
+		size := (c.curve.Params().BitSize + 7) / 8
+		if x.BitLen() > 8*size || y.BitLen() > 8*size {
+			return nil, fmt.Errorf("invalid EC key")
+		}
+		point := append([]byte{4}, x.FillBytes(make([]byte, size))...)
+		point = append(point, y.FillBytes(make([]byte, size))...)
+		if _, err := c.ecdh.NewPublicKey(point); err != nil {
+			return nil, fmt.Errorf("invalid EC key: %v", err)
+		}
+		return &ecdsa.PublicKey{Curve: c.curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
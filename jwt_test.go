@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// signJWT returns a token of the claims signed with an RSA or EC key
+func signJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		require.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		require.NoError(t, err)
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// TestJWTAuthenticator tests validating JWTs of Keycloak and Entra ID style
+// with keys found through OIDC discovery, and mapping their roles to access
+func TestJWTAuthenticator(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+	var issuer string
+	var jwksFetches int
+	down := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/realms/plant/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": issuer, "jwks_uri": issuer + "/certs"})
+		case "/realms/plant/certs":
+			if down {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			jwksFetches++
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+				{"kty": "RSA", "kid": "rsa1", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+				{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+				{"kty": "RSA", "kid": "enc1", "use": "enc", "n": b64(rsaKey.N.Bytes()), "e": "AQAB"},
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	issuer = server.URL + "/realms/plant"
+
+	env := map[string]string{"PLCCLI_AUTH_AUDIENCE": "plccli-line1", "PLCCLI_AUTH_SCOPE": "line1"}
+	_, err = newAuthenticator("jwt:" + issuer)
+	assert.ErrorContains(t, err, "PLCCLI_AUTH_AUDIENCE", "an audience is required")
+	auth, err := newJWTAuthenticator(issuer, func(key string) string { return env[key] })
+	require.NoError(t, err)
+	now := time.Now()
+	exp := float64(now.Add(5 * time.Minute).Unix())
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"iss": issuer, "aud": "plccli-line1", "exp": exp, "iat": float64(now.Unix())}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+
+	ctx := context.Background()
+	// Keycloak: realm and client roles, named by preferred_username
+	keycloak := signJWT(t, "RS256", "rsa1", rsaKey, claims(map[string]interface{}{
+		"preferred_username": "service-account-scada",
+		"realm_access":       map[string]interface{}{"roles": []string{"offline_access"}},
+		"resource_access":    map[string]interface{}{"plccli-line1": map[string]interface{}{"roles": []string{"line1:read", "line1:write"}}},
+	}))
+	scada, err := auth.authenticate(ctx, keycloak)
+	require.NoError(t, err)
+	assert.Equal(t, &tenant{Name: "service-account-scada", Access: "write", expires: time.Unix(int64(exp), 0), source: "jwt"}, scada)
+
+	// Entra ID: app roles, an audience list and the application ID
+	entra := signJWT(t, "ES256", "ec1", ecKey, claims(map[string]interface{}{
+		"aud": []string{"api://other", "plccli-line1"}, "appid": "3f1c", "roles": []string{"line1:read"},
+	}))
+	dashboard, err := auth.authenticate(ctx, entra)
+	require.NoError(t, err)
+	require.NotNil(t, dashboard)
+	assert.Equal(t, "3f1c", dashboard.Name)
+	assert.Equal(t, "read", dashboard.Access)
+
+	rejected := map[string]string{
+		"other audience": signJWT(t, "RS256", "rsa1", rsaKey, claims(map[string]interface{}{"sub": "x", "aud": "grafana", "scope": "line1:read"})),
+		"other issuer":   signJWT(t, "RS256", "rsa1", rsaKey, claims(map[string]interface{}{"sub": "x", "iss": "https://evil", "scope": "line1:read"})),
+		"expired":        signJWT(t, "RS256", "rsa1", rsaKey, claims(map[string]interface{}{"sub": "x", "scope": "line1:read", "exp": float64(now.Add(-2 * time.Minute).Unix())})),
+		"not yet valid":  signJWT(t, "RS256", "rsa1", rsaKey, claims(map[string]interface{}{"sub": "x", "scope": "line1:read", "nbf": float64(now.Add(10 * time.Minute).Unix())})),
+		"no role":        signJWT(t, "RS256", "rsa1", rsaKey, claims(map[string]interface{}{"sub": "x", "scope": "openid billing:write"})),
+		"key mismatch":   signJWT(t, "RS256", "ec1", rsaKey, claims(map[string]interface{}{"sub": "x", "scope": "line1:read"})),
+		"encryption key": signJWT(t, "RS256", "enc1", rsaKey, claims(map[string]interface{}{"sub": "x", "scope": "line1:read"})),
+		"opaque":         "2YotnFZFEjr1zCsicMWpAA",
+	}
+	parts := strings.Split(keycloak, ".")
+	rejected["alg none"] = b64([]byte(`{"alg":"none","kid":"rsa1"}`)) + "." + parts[1] + "."
+	rejected["tampered"] = parts[0] + "." + b64([]byte(`{"iss":"`+issuer+`","aud":"plccli-line1","exp":9999999999,"sub":"x","scope":"line1:write"}`)) + "." + parts[2]
+	for name, token := range rejected {
+		rejected, err := auth.authenticate(ctx, token)
+		require.NoError(t, err, name)
+		assert.Nil(t, rejected, name)
+	}
+
+	// Unknown keys refetch the JWKS, but not more often than the refresh interval
+	assert.Equal(t, 1, jwksFetches)
+	unknown := signJWT(t, "RS256", "rsa2", rsaKey, claims(map[string]interface{}{"sub": "x", "scope": "line1:read"}))
+	auth.authenticate(ctx, unknown)
+	assert.Equal(t, 1, jwksFetches)
+	auth.now = func() time.Time { return now.Add(2 * time.Minute) }
+	auth.authenticate(ctx, unknown)
+	assert.Equal(t, 2, jwksFetches)
+
+	// A provider that is down is a failure, not a rejection
+	down = true
+	auth.now = func() time.Time { return now.Add(4 * time.Minute) }
+	_, err = auth.authenticate(ctx, unknown)
+	assert.ErrorContains(t, err, "JWKS fetch failed")
+
+	// Cached tenants of JWTs expire with their token
+	cache := newAuthCache(time.Hour)
+	cache.now = func() time.Time { return now }
+	_, err = cache.authenticate(ctx, auth, keycloak)
+	require.NoError(t, err)
+	_, ok := cache.get(keycloak)
+	assert.True(t, ok)
+	cache.now = func() time.Time { return now.Add(6 * time.Minute) }
+	_, ok = cache.get(keycloak)
+	assert.False(t, ok, "token expired")
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+var (
+	// How often the service checks that its session is alive, 0 to not check
+	keepAliveInterval = 30 * time.Second
+	// Node read for the keep-alive instead of subscribing, from --keepalive-node
+	keepAliveNode string
+)
+
+// Intervals without a notification after which the session counts as dead
+const keepAliveMisses = 3
+
+// keepAlive checks that the session to the server is alive. By default it
+// subscribes to the server time and expects its data changes, which needs no
+// reads: some servers rate-limit reads or write each one to their audit log.
+// With a node it reads that node every interval instead, for servers without
+// subscriptions
+type keepAlive struct {
+	interval time.Duration
+	node     string
+
+	client *opcua.Client // session the subscription belongs to
+	sub    *opcua.Subscription
+	cancel context.CancelFunc
+
+	mu   sync.Mutex
+	last time.Time // last notification of the subscription
+	err  error     // error the subscription reported
+}
+
+func newKeepAlive(interval time.Duration, node string) *keepAlive {
+	return &keepAlive{interval: interval, node: node}
+}
+
+// check returns an error when the session is dead and needs a reconnect. A
+// new session gets a new subscription, which is checked from the next call on
+func (k *keepAlive) check(ctx context.Context, client *opcua.Client) error {
+	if k.node != "" {
+		return k.read(ctx, client, k.node)
+	}
+	if client != k.client {
+		k.stop()
+		k.client = client
+		if err := k.subscribe(ctx, client); err != nil {
+			if !errors.Is(err, ua.StatusBadServiceUnsupported) && !errors.Is(err, ua.StatusBadTooManySubscriptions) &&
+				!errors.Is(err, ua.StatusBadTooManyMonitoredItems) {
+				return fmt.Errorf("failed to subscribe to the server time: %v", err)
+			}
+			log.Printf("[%s] Server does not allow a keep-alive subscription (%v), reading the server time instead", connectionName, err)
+		}
+		return nil
+	}
+	// Without a subscription the server time is read like a keep-alive node
+	if k.sub == nil {
+		return k.read(ctx, client, fmt.Sprintf("ns=0;i=%d", id.Server_ServerStatus_CurrentTime))
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.err != nil {
+		return k.err
+	}
+	if silence := time.Since(k.last); silence > keepAliveMisses*k.interval {
+		return fmt.Errorf("no notification from the server for %v", silence.Round(time.Second))
+	}
+	return nil
+}
+
+// subscribe subscribes to the server time, sampled once per interval
+func (k *keepAlive) subscribe(ctx context.Context, client *opcua.Client) error {
+	if err := serviceMonitoring.reserve(serviceLimits.get(), 1); err != nil {
+		return err
+	}
+	notifs := make(chan *opcua.PublishNotificationData, 8)
+	sub, err := client.Subscribe(ctx, &opcua.SubscriptionParameters{
+		Interval:          k.interval,
+		MaxKeepAliveCount: keepAliveMisses,
+		LifetimeCount:     3 * keepAliveMisses,
+	}, notifs)
+	if err != nil {
+		serviceMonitoring.release(1)
+		return err
+	}
+
+	item := opcua.NewMonitoredItemCreateRequestWithDefaults(ua.NewNumericNodeID(0, id.Server_ServerStatus_CurrentTime), ua.AttributeIDValue, 1)
+	item.RequestedParameters.SamplingInterval = float64(k.interval / time.Millisecond)
+	resp, err := sub.Monitor(ctx, ua.TimestampsToReturnNeither, item)
+	if err == nil && len(resp.Results) > 0 && resp.Results[0].StatusCode != ua.StatusOK {
+		err = resp.Results[0].StatusCode
+	}
+	if err != nil {
+		sub.Cancel(ctx)
+		serviceMonitoring.release(1)
+		return err
+	}
+
+	subCtx, cancel := context.WithCancel(ctx)
+	k.sub, k.cancel = sub, cancel
+	k.mu.Lock()
+	k.last, k.err = time.Now(), nil
+	k.mu.Unlock()
+	go k.receive(subCtx, notifs)
+	return nil
+}
+
+// receive records the notifications of the subscription until it is stopped
+func (k *keepAlive) receive(ctx context.Context, notifs <-chan *opcua.PublishNotificationData) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-notifs:
+			k.mu.Lock()
+			if n.Error != nil {
+				k.err = fmt.Errorf("subscription failed: %v", n.Error)
+			} else {
+				k.last = time.Now()
+			}
+			k.mu.Unlock()
+		}
+	}
+}
+
+// read reads a node, only a failed request counts as a dead session
+func (k *keepAlive) read(ctx context.Context, client *opcua.Client, node string) error {
+	nodeID, err := resolveNodeID(node)
+	if err != nil {
+		log.Printf("[%s] Keep-alive node %s: %v", connectionName, node, err)
+		return nil
+	}
+	resp, err := client.Read(ctx, &ua.ReadRequest{
+		NodesToRead: []*ua.ReadValueID{{NodeID: nodeID, AttributeID: ua.AttributeIDValue}},
+	})
+	if err != nil {
+		return err
+	}
+	if len(resp.Results) > 0 && resp.Results[0].Status != ua.StatusOK {
+		log.Printf("[%s] Keep-alive node %s: %v", connectionName, node, resp.Results[0].Status)
+	}
+	return nil
+}
+
+// stop cancels the subscription of the previous session. Its server side
+// ends with the session, or after its lifetime when the session is gone
+func (k *keepAlive) stop() {
+	if k.sub == nil {
+		return
+	}
+	k.cancel()
+	if k.client != nil && k.client.State() == opcua.Connected {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		k.sub.Cancel(ctx)
+		cancel()
+	}
+	k.sub, k.cancel = nil, nil
+	serviceMonitoring.release(1)
+}
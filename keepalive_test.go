@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestKeepAlive tests the subscription and the read keep-alive against the
+// simulated PLC
+func TestKeepAlive(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	client := connectMock(t, ctx)
+
+	k := newKeepAlive(500*time.Millisecond, "")
+	defer k.stop()
+	require.NoError(t, k.check(ctx, client))
+	require.NotNil(t, k.sub, "subscribed to the server time")
+	time.Sleep(2500 * time.Millisecond)
+	assert.NoError(t, k.check(ctx, client))
+
+	// A subscription that stopped notifying means a dead session
+	k.mu.Lock()
+	k.last = time.Now().Add(-time.Minute)
+	k.mu.Unlock()
+	k.cancel()
+	assert.Error(t, k.check(ctx, client))
+
+	// A node is read instead
+	reader := newKeepAlive(time.Second, "nsu="+mockNamespaceURI+";s=Counter")
+	assert.NoError(t, reader.check(ctx, client))
+	assert.Nil(t, reader.sub)
+	// Only failed requests count, not a bad node
+	reader.node = "ns=1;s=Missing"
+	assert.NoError(t, reader.check(ctx, client))
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the latency histogram buckets in seconds, the last bucket
+// takes everything above
+var latencyBuckets = []float64{0.25, 0.5, 1, 2, 5, 10, 30, 60, 300, 3600}
+
+// latencyHistogram records how long samples took from their source
+// timestamp to the acknowledgement of a sink: a 2xx response of an HTTP
+// sink, the write of a file or SQLite sink or the drain of /api/buffer. The
+// clocks of PLC and service have to agree for it to be meaningful
+type latencyHistogram struct {
+	mu     sync.Mutex
+	counts []int64 // Per bucket of latencyBuckets, plus one above the last
+	count  int64
+	sum    float64 // Seconds
+	max    float64
+	now    func() time.Time
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{counts: make([]int64, len(latencyBuckets)+1), now: time.Now}
+}
+
+// observe records the latency of acknowledged lines. Lines without a
+// timestamp are skipped, source timestamps ahead of the service's clock
+// count as no latency
+func (h *latencyHistogram) observe(lines []string) {
+	if h == nil || len(lines) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := h.now()
+	for _, line := range lines {
+		t, ok := lineTime(line)
+		if !ok {
+			continue
+		}
+		latency := max(now.Sub(t).Seconds(), 0)
+		bucket := len(latencyBuckets)
+		for i, bound := range latencyBuckets {
+			if latency <= bound {
+				bucket = i
+				break
+			}
+		}
+		h.counts[bucket]++
+		h.count++
+		h.sum += latency
+		h.max = max(h.max, latency)
+	}
+}
+
+// quantile estimates a quantile of the latencies from the buckets,
+// interpolating within the bucket it falls into. Callers must hold h.mu
+func (h *latencyHistogram) quantile(q float64) float64 {
+	if h.count == 0 {
+		return 0
+	}
+	rank := q * float64(h.count)
+	var below int64
+	lower := 0.0
+	for i, n := range h.counts {
+		upper := h.max
+		if i < len(latencyBuckets) {
+			upper = min(latencyBuckets[i], h.max)
+		}
+		if n > 0 && float64(below+n) >= rank {
+			return lower + (upper-lower)*(rank-float64(below))/float64(n)
+		}
+		below += n
+		if i < len(latencyBuckets) {
+			lower = latencyBuckets[i]
+		}
+	}
+	return h.max
+}
+
+// stats returns the count, mean, maximum and estimated quantiles of the
+// latencies in seconds, and the cumulative bucket counts by upper bound like
+// a Prometheus histogram, for /api/stats
+func (h *latencyHistogram) stats() map[string]interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	buckets := make(map[string]int64, len(h.counts))
+	var cumulative int64
+	for i, n := range h.counts {
+		cumulative += n
+		le := "+Inf"
+		if i < len(latencyBuckets) {
+			le = strconv.FormatFloat(latencyBuckets[i], 'g', -1, 64)
+		}
+		buckets[le] = cumulative
+	}
+	stats := map[string]interface{}{
+		"count":   h.count,
+		"max":     h.max,
+		"p50":     h.quantile(0.5),
+		"p95":     h.quantile(0.95),
+		"p99":     h.quantile(0.99),
+		"buckets": buckets,
+	}
+	if h.count > 0 {
+		stats["mean"] = h.sum / float64(h.count)
+	}
+	return stats
+}
+
+// latencyStatsSnapshot returns the latency histograms of the poll file sinks
+// and of /api/buffer, by sink
+func latencyStatsSnapshot() map[string]interface{} {
+	stats := make(map[string]interface{})
+	if s := servicePollFile; s != nil {
+		stats["api"] = s.latency.stats()
+		for _, sink := range s.file.Sinks {
+			if sink.latency != nil {
+				stats[sink.name()] = sink.latency.stats()
+			}
+		}
+	}
+	return stats
+}
+
+// lineTime returns the timestamp of an InfluxDB line in nanoseconds, false
+// for lines without one
+func lineTime(line string) (time.Time, bool) {
+	i := strings.LastIndexByte(line, ' ')
+	if i < 0 || strings.HasSuffix(line, "\"") {
+		return time.Time{}, false
+	}
+	ns, err := strconv.ParseInt(line[i+1:], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ns), true
+}
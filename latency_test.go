@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestLatencyHistogram tests the buckets, quantiles and lines without a
+// timestamp
+func TestLatencyHistogram(t *testing.T) {
+	now := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+	h := newLatencyHistogram()
+	h.now = func() time.Time { return now }
+
+	line := func(age time.Duration) string {
+		return fmt.Sprintf("boiler,node_id=ns\\=3;s\\=Temperature value=21.5 %d", now.Add(-age).UnixNano())
+	}
+	var lines []string
+	for i := 0; i < 8; i++ {
+		lines = append(lines, line(800*time.Millisecond))
+	}
+	lines = append(lines, line(3*time.Second), line(2*time.Hour), line(-time.Second), `note value="no timestamp"`)
+	h.observe(lines)
+
+	stats := h.stats()
+	assert.Equal(t, int64(11), stats["count"])
+	assert.Equal(t, 7200.0, stats["max"])
+	buckets := stats["buckets"].(map[string]int64)
+	assert.Equal(t, int64(1), buckets["0.25"], "ahead of the service's clock")
+	assert.Equal(t, int64(9), buckets["1"])
+	assert.Equal(t, int64(10), buckets["5"])
+	assert.Equal(t, int64(10), buckets["3600"])
+	assert.Equal(t, int64(11), buckets["+Inf"])
+	assert.InDelta(t, 0.78, stats["p50"], 0.01, "interpolated in the 0.5-1s bucket")
+	assert.Greater(t, stats["p99"], 3600.0)
+
+	var empty *latencyHistogram
+	empty.observe(lines)
+	assert.Equal(t, 0.0, newLatencyHistogram().stats()["p95"])
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// Nodes per request when the server does not announce a limit
+const defaultMaxNodesPerRequest = 1000
+
+// operationLimits are the OperationLimits of the connected server: how many
+// nodes a single read, write or browse request may contain. Bigger batches
+// are split into several requests instead of failing with BadTooManyOperations.
+// The subscription limits of its ServerCapabilities are checked before the
+// service subscribes, see monitoringUsage; 0 means the server announced none
+type operationLimits struct {
+	MaxNodesPerRead   int `json:"maxNodesPerRead"`
+	MaxNodesPerWrite  int `json:"maxNodesPerWrite"`
+	MaxNodesPerBrowse int `json:"maxNodesPerBrowse"`
+
+	MaxMonitoredItemsPerCall         int `json:"maxMonitoredItemsPerCall"`
+	MaxSubscriptions                 int `json:"maxSubscriptions"`
+	MaxSubscriptionsPerSession       int `json:"maxSubscriptionsPerSession"`
+	MaxMonitoredItems                int `json:"maxMonitoredItems"`
+	MaxMonitoredItemsPerSubscription int `json:"maxMonitoredItemsPerSubscription"`
+}
+
+// limitsTable holds the operation limits of the current session
+type limitsTable struct {
+	mu     sync.RWMutex
+	limits operationLimits
+}
+
+// Operation limits of the connected server, the defaults until it is connected
+var serviceLimits = &limitsTable{limits: defaultOperationLimits()}
+
+func defaultOperationLimits() operationLimits {
+	return operationLimits{
+		MaxNodesPerRead:   defaultMaxNodesPerRequest,
+		MaxNodesPerWrite:  defaultMaxNodesPerRequest,
+		MaxNodesPerBrowse: defaultMaxNodesPerRequest,
+	}
+}
+
+func (t *limitsTable) get() operationLimits {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.limits
+}
+
+func (t *limitsTable) set(limits operationLimits) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.limits = limits
+}
+
+// readOperationLimits reads the server's MaxNodesPerRead, MaxNodesPerWrite
+// and MaxNodesPerBrowse and its subscription limits. Limits the server does
+// not announce, or announces as 0 (no limit), keep the default
+func readOperationLimits(ctx context.Context, client *opcua.Client) operationLimits {
+	limits := defaultOperationLimits()
+	fields := map[uint32]*int{
+		id.Server_ServerCapabilities_OperationLimits_MaxNodesPerRead:          &limits.MaxNodesPerRead,
+		id.Server_ServerCapabilities_OperationLimits_MaxNodesPerWrite:         &limits.MaxNodesPerWrite,
+		id.Server_ServerCapabilities_OperationLimits_MaxNodesPerBrowse:        &limits.MaxNodesPerBrowse,
+		id.Server_ServerCapabilities_OperationLimits_MaxMonitoredItemsPerCall: &limits.MaxMonitoredItemsPerCall,
+		id.Server_ServerCapabilities_MaxSubscriptions:                         &limits.MaxSubscriptions,
+		id.Server_ServerCapabilities_MaxSubscriptionsPerSession:               &limits.MaxSubscriptionsPerSession,
+		id.Server_ServerCapabilities_MaxMonitoredItems:                        &limits.MaxMonitoredItems,
+		id.Server_ServerCapabilities_MaxMonitoredItemsPerSubscription:         &limits.MaxMonitoredItemsPerSubscription,
+	}
+	req := &ua.ReadRequest{}
+	for nodeID := range fields {
+		req.NodesToRead = append(req.NodesToRead, &ua.ReadValueID{NodeID: ua.NewNumericNodeID(0, nodeID), AttributeID: ua.AttributeIDValue})
+	}
+
+	resp, err := client.Read(ctx, req)
+	if err != nil {
+		log.Printf("[%s] Failed to read the operation limits, using %d nodes per request: %v", connectionName, defaultMaxNodesPerRequest, err)
+		return limits
+	}
+	for i, result := range resp.Results {
+		if i >= len(req.NodesToRead) || result.Status != ua.StatusOK || result.Value == nil {
+			continue
+		}
+		if v, ok := result.Value.Value().(uint32); ok && v > 0 {
+			*fields[req.NodesToRead[i].NodeID.IntID()] = int(v)
+		}
+	}
+	log.Printf("[%s] Operation limits: %d nodes per read, %d per write, %d per browse",
+		connectionName, limits.MaxNodesPerRead, limits.MaxNodesPerWrite, limits.MaxNodesPerBrowse)
+	if limits.MaxMonitoredItemsPerCall > 0 || limits.MaxSubscriptions > 0 || limits.MaxSubscriptionsPerSession > 0 ||
+		limits.MaxMonitoredItems > 0 || limits.MaxMonitoredItemsPerSubscription > 0 {
+		log.Printf("[%s] Subscription limits: %d monitored items per call, %d subscriptions (%d per session), %d monitored items (%d per subscription), 0 is no limit",
+			connectionName, limits.MaxMonitoredItemsPerCall, limits.MaxSubscriptions, limits.MaxSubscriptionsPerSession,
+			limits.MaxMonitoredItems, limits.MaxMonitoredItemsPerSubscription)
+	}
+	return limits
+}
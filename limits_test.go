@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestOperationLimits tests reading the limits at connect time and splitting
+// batches bigger than them
+func TestOperationLimits(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	client := connectMock(t, ctx)
+
+	limits := serviceLimits.get()
+	assert.Equal(t, operationLimits{
+		MaxNodesPerRead:            mockMaxNodesPerRequest,
+		MaxNodesPerWrite:           mockMaxNodesPerRequest,
+		MaxNodesPerBrowse:          mockMaxNodesPerRequest,
+		MaxMonitoredItemsPerCall:   mockMaxMonitoredItemsPerCall,
+		MaxSubscriptionsPerSession: mockMaxSubscriptionsPerSession,
+	}, limits)
+
+	// Twice the limit of nodes, the simulated PLC rejects them in one request.
+	// Reads are of distinct nodes, duplicates would be read once
+	name, err := resolveNodeID("nsu=" + mockNamespaceURI + ";s=Name")
+	require.NoError(t, err)
+	ids := []*ua.NodeID{name}
+	var writes []*ua.WriteValue
+	for len(writes) < 2*mockMaxNodesPerRequest+1 {
+		id, err := resolveNodeID(fmt.Sprintf("nsu=%s;s=Missing%d", mockNamespaceURI, len(writes)))
+		require.NoError(t, err)
+		ids = append(ids, id)
+		writes = append(writes, &ua.WriteValue{
+			NodeID:      name,
+			AttributeID: ua.AttributeIDValue,
+			Value:       &ua.DataValue{EncodingMask: ua.DataValueValue, Value: ua.MustVariant("press-1")},
+		})
+	}
+	values, err := readNodeDataValues(ctx, client, ids)
+	require.NoError(t, err)
+	require.Len(t, values, len(ids))
+	assert.Equal(t, ua.StatusOK, values[0].Status)
+	for _, v := range values[1:] {
+		assert.Equal(t, ua.StatusBadNodeIDUnknown, v.Status)
+	}
+
+	results, err := writeNodeValues(ctx, client, writes)
+	require.NoError(t, err)
+	require.Len(t, results, len(writes))
+	for _, status := range results {
+		assert.Equal(t, ua.StatusOK, status)
+	}
+
+	// Without splitting the request fails, and the simulated PLC drops the
+	// connection. Closing the client while it redials races in gopcua, so
+	// the test waits for it to be back
+	events, stopEvents := connectionEvents.subscribe(connectionEvents.lastID())
+	defer stopEvents()
+	_, err = writeOPCUA(ctx, client, &ua.WriteRequest{NodesToWrite: writes})
+	assert.Error(t, err)
+	for {
+		select {
+		case e := <-events:
+			if e.Type != stateConnected && e.Type != stateSessionRecreated {
+				continue
+			}
+		case <-ctx.Done():
+			t.Fatal("no reconnect after the dropped connection")
+		}
+		break
+	}
+}
+
+// TestReadDuplicateNodes tests that nodes requested several times are read
+// once and get the same value at every position
+func TestReadDuplicateNodes(t *testing.T) {
+	a, b := ua.NewStringNodeID(3, "A"), ua.NewStringNodeID(3, "B")
+	unique, positions := dedupeNodeIDs([]*ua.NodeID{a, b, ua.NewStringNodeID(3, "A"), b})
+	assert.Equal(t, []*ua.NodeID{a, b}, unique)
+	assert.Equal(t, []int{0, 1, 0, 1}, positions)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	client := connectMock(t, ctx)
+
+	// More copies than the simulated PLC takes in one request
+	counter, err := resolveNodeID("nsu=" + mockNamespaceURI + ";s=Counter")
+	require.NoError(t, err)
+	ids := make([]*ua.NodeID, 2*mockMaxNodesPerRequest)
+	for i := range ids {
+		ids[i] = counter
+	}
+	serviceLimits.set(operationLimits{MaxNodesPerRead: len(ids) + 1})
+	values, err := readNodeDataValues(ctx, client, ids)
+	require.NoError(t, err, "duplicates are read in a single request of one node")
+	require.Len(t, values, len(ids))
+	for _, v := range values {
+		assert.Equal(t, values[0].Value.Value(), v.Value.Value())
+	}
+}
@@ -1,246 +1,1387 @@
 package main
+
 import (
-    "flag"
-    "fmt"
-    "hash/fnv"
-    "log"
-    "os"
-    "strconv"
-    "strings"
-    "path/filepath"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"umicli/pkg/backend"
+	"umicli/pkg/plcclient"
 )
 
 // Version information - these will be set during build
 var (
-    buildVersion string = "v0.3.4"
-    buildCommit  string = "unknown"
-    buildTime    string = "unknown"
+	buildVersion string = "v0.3.4"
+	buildCommit  string = "unknown"
+	buildTime    string = "unknown"
 )
 
 // Common flags
 var (
-    version       = flag.Bool("version", false, "Show version information")
-    serviceHost   = flag.String("service-host", "localhost", "Host/IP address of the OPCUA service")
-    endpoint      = flag.String("endpoint", "opc.tcp://192.168.123.252:4840", "OPC UA Endpoint URL")
-    measurement   = flag.String("measurement", "opcua_node", "Measurement name for InfluxDB output")
-    username      = flag.String("username", "", "Username")
-    password      = flag.String("password", "", "Password")
-    certfile      = flag.String("cert", "cert.pem", "Certificate file")
-    keyfile       = flag.String("key", "key.pem", "Private key file")
-    gencert       = flag.Bool("gen-cert", true, "Generate a new certificate")
-    appuri        = flag.String("app-uri", "urn:plccli:client", "Application URI")
-    timeout       = flag.Int("timeout", 300, "All timeouts in seconds")
-    service       = flag.Bool("service", false, "Run as a background service")
-    port          = flag.Int("port", 8765, "Base port for service mode")
-    connection    = flag.String("connection", "default", "Connection name for multiple OPCUA connections")
-    verbose       = flag.Bool("verbose", false, "Enable verbose logging")
-    outputFormat  = flag.String("format", "influx", "Output format: default, json, or influx")
-    securityPolicy = flag.String("security-policy", "Basic256", "Security policy: None, Basic128Rsa15, Basic256, Basic256Sha256")
-    securityMode   = flag.String("security-mode", "SignAndEncrypt", "Security mode: None, Sign, SignAndEncrypt")
-    authMethod     = flag.String("auth-method", "UserName", "Authentication method: UserName, Anonymous")
-    bits           = flag.Bool("bits", false, "Extract all 32 bits individually from uint32 value. Requires --format influx")
-    bitNames       = flag.String("bit-names", "", "Comma-separated names for all 32 bits (must be exactly 32 names)")
+	version           = flag.Bool("version", false, "Show version information")
+	serviceHost       = flag.String("service-host", "localhost", "Host/IP address of the OPCUA service")
+	endpoint          = flag.String("endpoint", "opc.tcp://192.168.123.252:4840", "OPC UA Endpoint URL, modbus://host:port of a Modbus TCP device or enip://host[:port][?slot=N] of a Logix controller")
+	measurement       = flag.String("measurement", "opcua_node", "Measurement name for InfluxDB output")
+	influxMeasurement = flag.String("influx-measurement", "", "Measurement name for InfluxDB output (alias for --measurement, takes precedence)")
+	influxFieldName   = flag.String("influx-field-name", "value", "Field name for values in InfluxDB output")
+	influxTimestamp   = flag.String("influx-timestamp", "now", "InfluxDB line timestamp: now, source (OPC UA SourceTimestamp) or server (ServerTimestamp)")
+	influxTags        = influxTagsFlag{}
+	trackStateNodes   = stringListFlag{}
+	stateInterval     = flag.Duration("state-interval", time.Second, "Sample interval for --track-state nodes in service mode")
+	username          = flag.String("username", "", "Username")
+	password          = flag.String("password", "", "Password (visible in ps, prefer --password-file or $PLCCLI_PASSWORD)")
+	passwordFile      = flag.String("password-file", "", "File with the password, e.g. a Docker secret (default: $PLCCLI_PASSWORD_FILE)")
+	credSource        = flag.String("credentials-source", "", "Fetch the username and password at startup: file:<path>, keyring:<service> or vault:<path>")
+	certfile          = flag.String("cert", "cert.pem", "Certificate file")
+	keyfile           = flag.String("key", "key.pem", "Private key file")
+	gencert           = flag.Bool("gen-cert", true, "Generate a new certificate")
+	appuri            = flag.String("app-uri", "urn:plccli:client", "Application URI")
+	timeout           = flag.Int("timeout", 300, "All timeouts in seconds")
+	service           = flag.Bool("service", false, "Run as a background service")
+	direct            = flag.Bool("direct", false, "Connect to the OPC UA server directly from the CLI, without a running service")
+	port              = flag.Int("port", 8765, "Base port for service mode")
+	connection        = flag.String("connection", "default", "Connection name for multiple OPCUA connections")
+	portsFile         = flag.String("ports-file", "", "YAML file pinning the ports of named connections (default ~/.config/plccli/ports.yaml if it exists)")
+	verbose           = flag.Bool("verbose", false, "Enable verbose logging")
+	outputFormat      = flag.String("format", "influx", "Output format: default, json, or influx")
+	securityPolicy    = flag.String("security-policy", "Basic256", "Security policy: None, Basic128Rsa15, Basic256, Basic256Sha256")
+	securityMode      = flag.String("security-mode", "SignAndEncrypt", "Security mode: None, Sign, SignAndEncrypt")
+	authMethod        = flag.String("auth-method", "UserName", "Authentication method: UserName, Anonymous")
+	bits              = &bitsFlag{}
+	autoType          = flag.Bool("auto-type", false, "Let set determine the data type from the node's DataType attribute")
+	writePriority     = flag.String("write-priority", "high", "Priority of set in the service write queue: high or low (bulk/scripted writes)")
+	attribute         = flag.String("attribute", "Value", "Node attribute to write with set: Value, DisplayName, Description, ...")
+	dataTypeFlag      = flag.String("data-type", "", "Data type for set, instead of the data type argument (e.g. struct)")
+	decimalSeparator  = flag.String("decimal-separator", decimalAuto, "Decimal separator of float and double values to write: auto (3.14 or 3,14), point or comma")
+	valueFile         = flag.String("value-file", "", "Read the value for set from a file instead of the value argument (e.g. a JSON structure)")
+	dryRun            = flag.Bool("dry-run", false, "Show the node, value and data type set would write without writing")
+	confirmWrites     = flag.Bool("confirm", false, "Show the current and new value and ask before set writes")
+	bitNames          = flag.String("bit-names", "", "Comma-separated names for all 32 bits (must be exactly 32 names)")
+	bitNamesFile      = flag.String("bit-names-file", "", "YAML file mapping node IDs to bit names, e.g. \"ns=5;s=alarms\": {7: drive_fault}")
+	interval          = flag.Duration("interval", 0, "Poll get repeatedly at this interval (e.g. 1s) until interrupted")
+	bitEdges          = flag.Bool("bit-edges", false, "With --bits and --interval, emit only rising/falling bit transitions")
+	counterMode       = flag.String("counter", "", "Treat values as production counters and emit: delta or total (handles resets/rollover)")
+	counterMax        = flag.Float64("counter-max", 0, "Counter wrap-around maximum, e.g. 65535 (default: decreases are resets)")
+	transformFlag     = flag.String("transform", "", "Expression computing the output from each read value, e.g. 'value * 0.1 - 40' (value, + - * / %, abs, round, min, max, ...)")
+	transformFile     = flag.String("transform-file", "", "YAML file mapping node IDs to transform expressions, e.g. \"ns=3;s=Oven.TempRaw\": value / 10")
+	counterStateFile  = flag.String("counter-state", "", "File to keep counter state between invocations (for one-shot get)")
+	bitsSummary       = flag.Bool("bits-summary", false, "With --bits, also emit any_alarm, active_count and raw summary fields")
+	batchNode         = flag.String("batch-node", "", "Node ID whose value (batch/lot ID) is added as a tag to all InfluxDB lines of a get")
+	batchTag          = flag.String("batch-tag", "batch", "Tag key for the --batch-node value")
+	opTimeout         = flag.Duration("op-timeout", 0, "Timeout of the service's OPC UA operations for get, set, set-bit and browse (default: 10s, 30s for browse)")
+	warnDuplicates    = flag.Bool("warn-duplicates", false, "Warn on stderr about node IDs given to get more than once (they are read once)")
+	decodeEnums       = flag.Bool("decode-enums", false, "Add the symbolic name of enumeration values to get output (state tag in InfluxDB format)")
+	withMetadata      = flag.Bool("with-metadata", false, "Add the EngineeringUnits and EURange of analog items to get output (unit, eu_low and eu_high tags in InfluxDB format)")
+	async             = flag.Bool("async", false, "Run browse as a service job and poll its progress (for big address spaces)")
+	shifts            = flag.String("shifts", "", "Daily shift calendar, e.g. A=06:00-14:00,B=14:00-22:00,C=22:00-06:00")
+	pollFilePath      = flag.String("poll-file", "", "YAML poll list the service samples itself, buffered for GET /api/buffer and sinks")
+	influxURL         = flag.String("influx-url", "", "InfluxDB URL the service writes the poll file samples to, e.g. http://localhost:8086")
+	influxToken       = flag.String("influx-token", "", "InfluxDB API token (v2) or username:password (v1) for --influx-url")
+	influxOrg         = flag.String("influx-org", "", "InfluxDB v2 organization for --influx-url (without it the v1 write API is used)")
+	influxBucket      = flag.String("influx-bucket", "", "InfluxDB bucket (v1: database) for --influx-url")
+	influxGzip        = flag.Bool("influx-gzip", false, "Gzip the requests to --influx-url, for slow uplinks")
+	influxBatch       = flag.Int("influx-batch", defaultSinkBatchSize, "Lines per request to --influx-url")
+	accessLogPath     = flag.String("access-log", "", "Log every API request of the service as a JSON line to this file (- for stderr)")
+	accessLogRate     = flag.Float64("access-log-sample", 1, "Fraction of successful read requests written to the access log (writes and errors are always logged)")
+	accessLogRedact   = flag.Bool("access-log-redact", false, "Replace written values in the request bodies of the access log")
+	debugFaults       = flag.Bool("debug-faults", false, "Enable fault injection through /api/debug/faults (dropped responses, read delays, forced reconnects) for resilience tests")
+	startJitter       = flag.Duration("connect-jitter", 5*time.Minute, "Upper bound of the random delay before the service's first connection attempt (0 to connect right away)")
+	keepaliveEvery    = flag.Duration("keepalive-interval", 30*time.Second, "How often the service checks its session to the server (0 to not check)")
+	keepaliveNode     = flag.String("keepalive-node", "", "Node the service reads for its keep-alive instead of subscribing to the server time")
+	retryWrites       = flag.Bool("retry-session-writes", false, "Reconnect and retry a write once when the server rejects it for an invalid session (e.g. after a PLC restart)")
+	cacheTTL          = flag.Duration("cache-ttl", 0, "Serve repeated API reads of a node from memory for this long, e.g. 2s (0 to always read the PLC)")
+	recentSize        = flag.Int("recent-size", defaultRecentSize, "Samples of each polled node the service keeps for /api/recent (0 to keep none)")
+	recentMaxAge      = flag.Duration("recent-max-age", 0, "Drop samples kept for /api/recent after this long, e.g. 1h (0 to keep them until overwritten)")
+	freshFlag         = flag.Bool("fresh", false, "Let get bypass the read cache of the service (--cache-ttl)")
+	synchronized      = flag.Bool("synchronized", false, "Let get read all nodes in one request and timestamp them with the time of the read")
+	onDisconnect      = flag.String("on-disconnect-cmd", "", "Shell command the service runs when its PLC session drops, with the event in PLCCLI_* variables")
+	rulesFile         = flag.String("rules", "", "YAML file of rules running a command, webhook or MQTT publish when a node meets a condition, e.g. bit 7 goes 1")
+	mock              = flag.Bool("mock", false, "Serve the service API from a simulated PLC instead of --endpoint, for offline development")
+	groupsFile        = flag.String("groups", "", "YAML file of named node groups that get reads as @name")
+	tenantsFile       = flag.String("tenants", "", "YAML file with the tenants (tokens, access, labels) allowed to use the service")
+	apiAuth           = flag.String("api-auth", "", "Check API tokens with a hook: command:<command>, introspect:<url> (OAuth 2.0 token introspection) or jwt:<issuer> (OIDC JWTs)")
+	apiAuthTTL        = flag.Duration("api-auth-cache-ttl", defaultAuthCacheTTL, "How long the service remembers the answer of --api-auth for a token")
+	policyFile        = flag.String("write-policy", "", "YAML file of the node IDs, prefixes and namespaces the service may write (allow/deny)")
+	limitsFile        = flag.String("write-limits", "", "YAML file of the min, max, step or allowed values of writes per node ID")
+	sensitiveFile     = flag.String("sensitive-nodes", "", "YAML file of the node IDs, prefixes and namespaces whose values are kept out of the logs")
+	approvalTTL       = flag.Duration("approval-timeout", defaultApprovalTimeout, "How long a write of a node marked critical in --write-policy waits for a second person to confirm it")
+	writePermits      = flag.Duration("write-permits", 0, "Require a write permit (plccli permit request) for writes, issued for at most this long (0 for no permits)")
+	rateLimit         = flag.Float64("rate-limit", 0, "Requests per second each client (tenant or host) may send the service (0 for no limit)")
+	globalRate        = flag.Float64("rate-limit-global", 0, "Requests per second all clients together may send the service (0 for no limit)")
+	clientOps         = flag.Int("max-ops", 0, "Requests each client may have running in the service at once (0 for no limit)")
+	globalOps         = flag.Int("max-ops-global", 0, "Requests all clients together may have running in the service at once (0 for no limit)")
+	token             = flag.String("token", "", "Tenant token for services started with --tenants (default: $PLCCLI_TOKEN)")
+	permit            = flag.String("permit", "", "Write permit for services started with --write-permits (default: $PLCCLI_PERMIT)")
+	apiBasePath       = flag.String("api-base-path", "", "Path the service API is served under, e.g. /plccli behind a reverse proxy (default: $PLCCLI_API_BASE_PATH)")
+	apiTLSCert        = flag.String("api-tls-cert", "", "PEM certificate (chain) the service API is served with over HTTPS, reloaded when the file changes")
+	apiTLSKey         = flag.String("api-tls-key", "", "PEM private key of --api-tls-cert")
+	apiTLS            = flag.Bool("api-tls", false, "Call the service API over HTTPS, for services started with --api-tls-cert")
+	apiTLSCA          = flag.String("api-tls-ca", "", "PEM CA certificate(s) to trust for the service API instead of the system's, implies --api-tls (default: $PLCCLI_API_TLS_CA)")
+	corsOrigins       = flag.String("cors-origins", "", "Comma separated origins of browser-based HMIs that may call the service API, * for any")
 )
 
-// Calculate a port number based on connection name
-func getPortForConnection(baseName string, basePort int) int {
-    if baseName == "default" {
-        return basePort
-    }
+// stringListFlag collects repeatable string flags
+type stringListFlag []string
+
+func (f *stringListFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return strings.Join(*f, ",")
+}
 
-    // Create a deterministic port based on the connection name
-    h := fnv.New32a()
-    h.Write([]byte(baseName))
-    hashValue := h.Sum32()
+func (f *stringListFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
 
-    // Use the hash to derive a port in the range 10000-65000
-    return 10000 + int(hashValue%55000)
+func init() {
+	flag.Var(&trackStateNodes, "track-state", "Node ID of an enumerated state (e.g. machine mode) to track durations for in service mode (repeatable)")
+	flag.Var(&influxTags, "influx-tag", "Extra InfluxDB tag as key=value (repeatable)")
+	flag.Var(bits, "bits", "Extract bits individually from uint32 value (all 32, or a selection like --bits=3,7,12-15). Requires --format influx")
+}
+
+// Calculate a port number based on connection name: the port pinned in the
+// ports file, or one derived from the name (see ports.go)
+func getPortForConnection(baseName string, basePort int) int {
+	if baseName == "default" {
+		return basePort
+	}
+	return pinnedPorts.port(baseName)
 }
 
 // Get the service descriptor based on connection name
 func getServiceDescriptor(connectionName string) string {
-    if connectionName == "default" {
-        return "OPCUA service"
-    }
-    return fmt.Sprintf("OPCUA service '%s'", connectionName)
+	if connectionName == "default" {
+		return "OPCUA service"
+	}
+	return fmt.Sprintf("OPCUA service '%s'", connectionName)
+}
+
+// Get the certificate and key files for a connection
+// Non-default connections use connection-specific cert/key files
+func getCertFilesForConnection(certFile, keyFile, connectionName string) (string, string) {
+	if connectionName == "default" {
+		return certFile, keyFile
+	}
+	return strings.TrimSuffix(certFile, ".pem") + "-" + connectionName + ".pem",
+		strings.TrimSuffix(keyFile, ".pem") + "-" + connectionName + ".pem"
 }
 
 // Print help text with consistent formatting
 func printUsage() {
-    fmt.Println("Usage: plccli [flags] opcua get <node-id> [node-id2 node-id3 ...]")
-    fmt.Println("       plccli [flags] opcua set <node-id> <value> <data-type>")
-    fmt.Println("       plccli [flags] opcua browse [node-id] [max-depth]")
-    fmt.Println("\nNode ID format: ns=X;i=NUMBER or ns=X;s=STRING (can use comma or semicolon separator)")
-    fmt.Println("\nAvailable data types for set: boolean, sbyte, byte, int16, uint16, int32, uint32, int64, uint64, float, double, string, dtl")
-    fmt.Println("\nOutput formats (--format flag):")
-    fmt.Println("  default - Human-readable output")
-    fmt.Println("  influx  - InfluxDB Line Protocol format")
-    fmt.Println("\nInfluxDB options:")
-    fmt.Println("  --measurement <name> - Custom measurement name for InfluxDB output (default: opcua_node)")
-    fmt.Println("\nService connection:")
-    fmt.Println("  --service-host <host> - Host/IP address of the OPCUA service (default: localhost)")
-    fmt.Println("  --port <port> - Base port for service mode (default: 8765)")
-    fmt.Println("\nAuthentication options:")
-    fmt.Println("  --auth-method UserName (default) - Use username/password authentication")
-    fmt.Println("  --auth-method Anonymous - Use anonymous authentication (no credentials)")
-    fmt.Println("\nSecurity options:")
-    fmt.Println("  --security-policy None|Basic128Rsa15|Basic256|Basic256Sha256")
-    fmt.Println("  --security-mode None|Sign|SignAndEncrypt")
-    fmt.Println("\nMultiple connections: Use --connection <name> to specify which connection to use")
-    fmt.Println("\nExamples:")
-    fmt.Println("  plccli --service --endpoint opc.tcp://192.168.1.100:4840 --username user --password pass")
-    fmt.Println("  plccli --format influx --measurement temperature opcua get ns=0;i=2258")
-    fmt.Println("  plccli --service-host 192.168.1.50 opcua get ns=0;i=2258")
-    fmt.Println("  plccli opcua set ns=4;i=38 \"2025-03-09T14:30:00\" dtl")
-    fmt.Printf("\nplccli %s (%s, built %s)\n", buildVersion, buildCommit, buildTime)
-    flag.PrintDefaults()
+	fmt.Println("Usage: plccli [flags] opcua get <node-id|@group> [node-id2 node-id3 ...]")
+	fmt.Println("       plccli [flags] opcua set <node-id> <value> <data-type>")
+	fmt.Println("       plccli [flags] opcua set-bit <node-id> <bit-num> <0|1>")
+	fmt.Println("       plccli [flags] opcua browse [node-id] [max-depth]")
+	fmt.Println("       plccli [flags] opcua subscribe --subtree <node-id> [--max-depth 3] [--max-items 100] [--rebrowse 5m]")
+	fmt.Println("       plccli [flags] opcua tui [node-id] [max-depth] [--interval 1s]")
+	fmt.Println("       plccli [flags] opcua watch [--interval 1s] <node-id> [node-id ...]")
+	fmt.Println("       plccli [flags] opcua states")
+	fmt.Println("       plccli [flags] opcua validate [--file nodes.txt] [node-id ...]")
+	fmt.Println("       plccli [flags] opcua assert [--within 5s] <node-id> <operator> <expected>")
+	fmt.Println("       plccli [flags] modbus get <unit> <register-type> <address> [count] [type]")
+	fmt.Println("       plccli [flags] modbus set <unit> <register-type> <address> <value> [type]")
+	fmt.Println("       plccli [flags] enip get <tag> [tag ...]")
+	fmt.Println("       plccli [flags] enip set <tag> <value> [type]")
+	fmt.Println("       plccli [flags] point get <ref> [ref ...]")
+	fmt.Println("       plccli [flags] point set <ref> <value> [type]")
+	fmt.Println("       plccli [flags] point browse [ref] [max-depth]")
+	fmt.Println("       plccli [flags] cancel <op-id>")
+	fmt.Println("       plccli [flags] permit request [--duration 15m] <reason>")
+	fmt.Println("       plccli [flags] permit list")
+	fmt.Println("       plccli [flags] permit revoke <permit-id>")
+	fmt.Println("       plccli [flags] maintenance start [--duration 2h] <reason>")
+	fmt.Println("       plccli [flags] maintenance status")
+	fmt.Println("       plccli [flags] maintenance end")
+	fmt.Println("       plccli [flags] schedules import [--delimiter ';'] <file.csv>")
+	fmt.Println("       plccli [flags] schedules list")
+	fmt.Println("       plccli [flags] schedules clear")
+	fmt.Println("       plccli [flags] shell")
+	fmt.Println("       plccli [flags] run <script.plc|-> [NAME=value ...]")
+	fmt.Println("       plccli [flags] test [--junit report.xml] <suite.yaml> [NAME=value ...]")
+	fmt.Println("       plccli [flags] annotate [--user name] <text>")
+	fmt.Println("       plccli [flags] query --db <file> [--since 24h] [--until 1h] [--limit n] [node-id ...]")
+	fmt.Println("       plccli [flags] capabilities [--format json]")
+	fmt.Println("       plccli [flags] service export-state [file]")
+	fmt.Println("       plccli [flags] service import-state <file>")
+	fmt.Println("       plccli [flags] service run")
+	fmt.Println("\nFlags go before the command, or after it if the command takes them, e.g.")
+	fmt.Println("plccli opcua get --measurement temperature ns=3;s=Temp. See plccli <command> --help, e.g. plccli opcua get --help")
+	fmt.Println("\nNode ID format: ns=X;i=NUMBER or ns=X;s=STRING (can use comma or semicolon separator)")
+	fmt.Println("\nAvailable data types for set: " + strings.Join(setDataTypes, ", "))
+	fmt.Println("\nAttribute options for set:")
+	fmt.Println("  --attribute <name> - Attribute to write (default: Value), e.g. DisplayName or Description")
+	fmt.Println("  --auto-type - Read the node's DataType and convert the value accordingly (data type argument optional)")
+	fmt.Println("  --data-type <type> - Data type instead of the data type argument")
+	fmt.Println("  --value-file <file> - Read the value from a file instead of the value argument")
+	fmt.Println("  Structures (UDTs) are written from JSON with the struct data type, encoded with the node's DataTypeDefinition")
+	fmt.Println("  --decimal-separator auto|point|comma - Decimal separator of float and double values (default auto: 3.14 or 3,14,")
+	fmt.Println("                                         with values like 1,250 rejected as ambiguous)")
+	fmt.Println("  --dry-run - Show the node, converted value and data type that would be written, without writing")
+	fmt.Println("  --confirm - Show the current and new value and ask y/N before writing")
+	fmt.Println("\nModbus TCP (service or --direct with --endpoint modbus://host:502):")
+	fmt.Println("  Register types: coil, discrete, holding, input; coils and holding registers can be set")
+	fmt.Println("  Types of registers: uint16 (default), int16, uint32, int32, float32, uint64, int64, float64,")
+	fmt.Println("  with -swapped for devices sending the low word first, e.g. float32-swapped")
+	fmt.Println("  Points in the API, poll files and node_id tags: unit/register-type/address/type, e.g. 1/holding/100/float32")
+	fmt.Println("\nEtherNet/IP (ControlLogix/CompactLogix, service or --direct with --endpoint enip://host[?slot=0]):")
+	fmt.Println("  Tags: Counter, Recipe[2].Setpoint, Program:Main.Temperature; atomic types and STRING")
+	fmt.Println("  Types for set: BOOL, SINT, INT, DINT, LINT, USINT, UINT, UDINT, ULINT, REAL, LREAL, STRING")
+	fmt.Println("  (default: the tag's type, read first)")
+	fmt.Println("\nProtocol backends (point get|set|browse, service or --direct):")
+	fmt.Println("  Any --endpoint whose scheme has a backend: " + strings.Join(backend.Schemes(), ", "))
+	fmt.Println("  References are in the backend's syntax, e.g. 1/holding/100/float32 or Program:Main.Counter")
+	fmt.Println("\nOutput formats (--format flag):")
+	fmt.Println("  default - Human-readable output")
+	fmt.Println("  influx  - InfluxDB Line Protocol format")
+	fmt.Println("\nInfluxDB options:")
+	fmt.Println("  --measurement <name> - Custom measurement name for InfluxDB output (default: opcua_node)")
+	fmt.Println("  --influx-measurement <name> - Same as --measurement, takes precedence")
+	fmt.Println("  --influx-tag <key=value> - Extra tag on every line, repeatable (e.g. --influx-tag site=plant1)")
+	fmt.Println("  --influx-field-name <name> - Field name for values (default: value)")
+	fmt.Println("  --influx-timestamp now|source|server - Line timestamp: current time (default), OPC UA SourceTimestamp or ServerTimestamp")
+	fmt.Println("\nEnumerations (get):")
+	fmt.Println("  --decode-enums - Read the EnumStrings/EnumValues of enumeration data types and output the")
+	fmt.Println("                   symbolic name with the value, e.g. 3 (Running) or a state=Running InfluxDB tag")
+	fmt.Println("\nUnits and ranges (get, subscribe):")
+	fmt.Println("  --with-metadata - Read the EngineeringUnits and EURange properties of analog items and output the unit")
+	fmt.Println("                    with the value, e.g. 21.5 °C, as unit and euRange in JSON or as unit=°C,eu_low=0,eu_high=100 tags")
+	fmt.Println("\nTimeouts:")
+	fmt.Println("  --op-timeout <duration> - Time the service gives the PLC per request (default 10s, 30s for browse; at most 10m)")
+	fmt.Println("\nNode groups (get):")
+	fmt.Println("  @<name> - Read the nodes of a group of the service instead of listing them, e.g. opcua get @energy-meters")
+	fmt.Println("  --groups <file> - YAML file of groups for the service (groups: {name: [node-id, ...]}); add more with POST /api/groups")
+	fmt.Println("\nRead cache (get):")
+	fmt.Println("  --fresh - Read the PLC even if the service has a cached value (see --cache-ttl)")
+	fmt.Println("\nSynchronized reads (get):")
+	fmt.Println("  --synchronized - Read all nodes in one request, bypassing the cache, and stamp them with one timestamp")
+	fmt.Println("\nDuplicates (get):")
+	fmt.Println("  --warn-duplicates - Warn about node IDs given more than once; the service reads them once either way")
+	fmt.Println("\nPolling options:")
+	fmt.Println("  --interval <duration> - Repeat get at this interval (e.g. 1s) until interrupted")
+	fmt.Println("  --bit-edges - With --bits and --interval, emit only rising/falling bit transitions")
+	fmt.Println("\nBit names (--bits):")
+	fmt.Println("  --bit-names <names> - Comma-separated names for all 32 bits")
+	fmt.Println("  --bit-names-file <file> - YAML file mapping node IDs to bit names, only used bits need a name")
+	fmt.Println("\nCounter options (get):")
+	fmt.Println("  --counter delta|total - Emit monotonic deltas or cumulative totals for production counters")
+	fmt.Println("  --counter-max <n> - Wrap-around maximum of the counter (default: decreases are resets)")
+	fmt.Println("  --counter-state <file> - Keep counter state between one-shot invocations")
+	fmt.Println("  --transform <expr> - Compute the output from each read value before formatting, e.g. 'value * 0.1 - 40'")
+	fmt.Println("                       (value, numbers, + - * / %, parentheses, abs, ceil, floor, max, min, round, sqrt)")
+	fmt.Println("  --transform-file <file> - YAML file mapping node IDs to their own transform expressions")
+	fmt.Println("\nDirect mode:")
+	fmt.Println("  --direct - Connect to --endpoint from the CLI itself (no service needed); uses the same auth/cert flags")
+	fmt.Println("\nState duration tracking (service mode):")
+	fmt.Println("  --track-state <node-id> - Track time spent in each value of a state node (repeatable)")
+	fmt.Println("  --state-interval <duration> - Sample interval for tracked states (default: 1s)")
+	fmt.Println("  Read the accumulated durations with: plccli opcua states")
+	fmt.Println("\nWrite queue:")
+	fmt.Println("  --write-priority high|low - Queue priority of set in the service (default: high)")
+	fmt.Println("                              Low priority writes wait until all queued high priority writes are done")
+	fmt.Println("  Queued writes and running browses have an operation ID (X-Operation-ID header, GET /api/operations)")
+	fmt.Println("  Cancel one with: plccli cancel <op-id>")
+	fmt.Println("\nWrite permits (services started with --write-permits):")
+	fmt.Println("  permit request <reason> - Ask for a time-limited permit to write, logged with the reason;")
+	fmt.Println("                            --duration shortens it (default: the longest the service issues)")
+	fmt.Println("  Pass the permit ID to set, set-bit, modbus set and enip set with --permit or $PLCCLI_PERMIT")
+	fmt.Println("  permit revoke <permit-id> - End a permit before it expires")
+	fmt.Println("\nApprovals (nodes marked critical in --write-policy):")
+	fmt.Println("  approvals request <node-id> <value> <type> <reason> - Ask for a write of a critical node; it runs")
+	fmt.Println("                                                      once another tenant confirms it")
+	fmt.Println("  approvals list - Writes waiting for a confirmation")
+	fmt.Println("  approvals confirm <approval-id> - Confirm a write requested by another tenant and run it")
+	fmt.Println("  approvals reject <approval-id> - Drop a write waiting for a confirmation")
+	fmt.Println("\nMaintenance:")
+	fmt.Println("  maintenance start <reason> - Mark the connection as under maintenance: values are still read but")
+	fmt.Println("                               tagged maintenance=true, writes are rejected and webhook sinks and")
+	fmt.Println("                               --on-disconnect-cmd stay quiet; --duration ends it on its own")
+	fmt.Println("  maintenance status - Show the maintenance window, maintenance end - End it")
+	fmt.Println("\nWrite schedules:")
+	fmt.Println("  schedules import <file.csv> - Replace the recurring writes of the service by the rows of a CSV file")
+	fmt.Println("                                (node, value, type, cron, e.g. ns=3;s=Setpoint,72.5,Float,0 6 * * mon-fri),")
+	fmt.Println("                                saved as CSV from a spreadsheet; run at low priority in local time")
+	fmt.Println("  schedules list - Show them with their next and last runs, schedules clear - Remove them")
+	fmt.Println("\nAnnotations:")
+	fmt.Println("  annotate <text> - Put a note on the timeline of the connection: an annotation line with the")
+	fmt.Println("                    user, connection and --influx-tag tags, sent to the poll file's sinks")
+	fmt.Println("\nAsync jobs:")
+	fmt.Println("  --async - Run browse as a service job, poll its progress and fetch the result when done")
+	fmt.Println("            Avoids long-running HTTP requests that proxies may cut off")
+	fmt.Println("\nBrowse paging:")
+	fmt.Println("  Without --async browses are fetched in pages of 500 nodes, printed as they arrive")
+	fmt.Println("  --max-nodes <n> - Stop after n nodes and print the token to continue with")
+	fmt.Println("  --continuation <token> - Continue a browse stopped at --max-nodes or by an error")
+	fmt.Println("  Complete browses are cached per connection in ~/.cache/plccli until the server's namespace")
+	fmt.Println("  array changes; --refresh - Browse the PLC again and update the cache")
+	fmt.Println("\nTerminal UI:")
+	fmt.Println("  opcua tui [node-id] [max-depth] - Tree of the address space (loaded in pages), the selected")
+	fmt.Println("                                    variable and a watch list read every --interval (default 1s)")
+	fmt.Println("  Keys: arrows/jkhl move and expand, w watch, e or enter write, tab watch list, r reload, q quit")
+	fmt.Println("  opcua watch <node-id> [node-id ...] - Table of values, quality and last change refreshed every")
+	fmt.Println("                                        --interval (default 1s), changed cells highlighted")
+	fmt.Println("\nAcceptance tests:")
+	fmt.Println("  opcua assert <node-id> <operator> <expected> - Exit code 1 unless the value compares (==, !=, <, <=, >, >=);")
+	fmt.Println("                                                 --within <duration> reads every --interval until it does")
+	fmt.Println("  test <suite.yaml> - Run the tests of a YAML suite, steps like in run scripts; --junit <file> - JUnit XML report")
+	fmt.Println("\nGateway migration:")
+	fmt.Println("  service export-state [file] - Save the poll groups of the running service and the client")
+	fmt.Println("                                certificate of the connection (stdout without file)")
+	fmt.Println("  service import-state <file> - Recreate them on a replacement gateway; existing poll groups")
+	fmt.Println("                                and certificate files are kept")
+	fmt.Println("\nBatch context:")
+	fmt.Println("  --batch-node <node-id> - Tag all InfluxDB lines of a get with the current value of this node")
+	fmt.Println("  --batch-tag <key> - Tag key for the batch node value (default: batch)")
+	fmt.Println("\nShift calendar:")
+	fmt.Println("  --shifts <id=HH:MM-HH:MM,...> - Tag InfluxDB lines with the current shift and restart")
+	fmt.Println("                                  counter totals and state durations at each shift boundary")
+	fmt.Println("                                  e.g. --shifts A=06:00-14:00,B=14:00-22:00,C=22:00-06:00")
+	fmt.Println("\nService connection:")
+	fmt.Println("  --service-host <host> - Host/IP address of the OPCUA service (default: localhost)")
+	fmt.Println("  --port <port> - Base port for service mode (default: 8765)")
+	fmt.Println("  --token <token> - Tenant token for services started with --tenants (default: $PLCCLI_TOKEN)")
+	fmt.Println("  --permit <id> - Write permit for services started with --write-permits (default: $PLCCLI_PERMIT)")
+	fmt.Println("  --api-base-path <path> - Path the service API is served under, e.g. /plccli behind nginx (default: $PLCCLI_API_BASE_PATH)")
+	fmt.Println("  --api-tls - Call the service over HTTPS, for services started with --api-tls-cert")
+	fmt.Println("  --api-tls-ca <file> - CA certificate to trust for the service instead of the system's, implies --api-tls")
+	fmt.Println("                        (default: $PLCCLI_API_TLS_CA)")
+	fmt.Println("\nPoll file (service mode):")
+	fmt.Println("  --poll-file <file> - YAML list of nodes with interval, measurement and bit names the service")
+	fmt.Println("                       samples itself; drain the InfluxDB lines with GET /api/buffer or push them to sinks")
+	fmt.Println("  --influx-url <url> - Write the poll file samples straight to InfluxDB, batched and retried")
+	fmt.Println("  --influx-bucket <bucket> - Bucket (v1: database) to write to")
+	fmt.Println("  --influx-org <org> - InfluxDB v2 organization; without it the v1 write API is used")
+	fmt.Println("  --influx-token <token> - API token (v2) or username:password (v1)")
+	fmt.Println("  --influx-gzip - Gzip the requests, e.g. over a 4G uplink")
+	fmt.Println("  --influx-batch <n> - Lines per request (default 5000)")
+	fmt.Println("\nTenants (service mode):")
+	fmt.Println("  --tenants <file> - YAML file of tenants with token, connections, access (read|write) and labels")
+	fmt.Println("                     Requests need the token of a tenant of the connection; labels become InfluxDB tags")
+	fmt.Println("  --api-auth <source> - Check tokens not in --tenants with a central identity provider:")
+	fmt.Println("                        command:<command> (token on stdin, tenant JSON on stdout) or introspect:<url>")
+	fmt.Println("                        (RFC 7662, client from $PLCCLI_AUTH_CLIENT_ID and $PLCCLI_AUTH_CLIENT_SECRET)")
+	fmt.Println("                        or jwt:<issuer> (JWTs checked with the issuer's JWKS, audience $PLCCLI_AUTH_AUDIENCE)")
+	fmt.Println("  --api-auth-cache-ttl <duration> - How long the answer for a token is remembered (default 1m)")
+	fmt.Println("  --rate-limit <n> - Requests per second each client (tenant, or host without tenants) may send; more get 429")
+	fmt.Println("  --rate-limit-global <n> - Requests per second of all clients together")
+	fmt.Println("  --max-ops <n> - Requests each client may have running at once, protecting the PLC session")
+	fmt.Println("  --max-ops-global <n> - Requests all clients together may have running at once")
+	fmt.Println("  --write-policy <file> - YAML allow/deny lists of node IDs, prefixes (ns=3;s=Cmd.*) and namespaces (ns=4)")
+	fmt.Println("                          the service may write; other writes are logged and rejected")
+	fmt.Println("                          Writes of critical nodes need a second tenant to confirm them (plccli approvals)")
+	fmt.Println("  --write-limits <file> - YAML min, max, step or allowed values per node ID or prefix; writes outside them")
+	fmt.Println("                          are logged and rejected before they reach the PLC")
+	fmt.Println("  --approval-timeout <duration> - How long a write of a critical node waits for its confirmation (default 15m)")
+	fmt.Println("  --write-permits <duration> - Writes need a time-limited permit next to the token, issued for at most")
+	fmt.Println("                               this long; request one with: plccli permit request <reason>")
+	fmt.Println("  --access-log <file> - Log API requests (method, path, tenant, status, latency, write bodies) as JSON lines, - for stderr")
+	fmt.Println("  --access-log-sample <0-1> - Fraction of successful reads logged (default 1)")
+	fmt.Println("  --access-log-redact - Replace written values in logged request bodies")
+	fmt.Println("  --sensitive-nodes <file> - YAML node IDs, prefixes and namespaces whose values are redacted in the")
+	fmt.Println("                             service log and access log; the API still reads and writes them")
+	fmt.Println("  --api-tls-cert <file> - Serve the API over HTTPS with this PEM certificate; renewed certificates")
+	fmt.Println("                          (cert-manager, certbot) are picked up without a restart")
+	fmt.Println("  --api-tls-key <file> - Private key of --api-tls-cert")
+	fmt.Println("  --cors-origins <origins> - Comma separated origins of browser-based HMIs that may call the API, * for any")
+	fmt.Println("  --debug-faults - Enable /api/debug/faults to drop responses, delay reads and force reconnects (testing only)")
+	fmt.Println("  --connect-jitter <duration> - Random delay before the first connection attempt, up to this (default 5m, 0 to disable)")
+	fmt.Println("  --keepalive-interval <duration> - How often the session is checked (default 30s, 0 to disable)")
+	fmt.Println("  --keepalive-node <nodeID> - Read this node for the keep-alive instead of subscribing to the server time")
+	fmt.Println("  --retry-session-writes - Reconnect and retry a write once when the PLC rejects it for an invalid session")
+	fmt.Println("  --cache-ttl <duration> - Serve repeated reads of a node from memory for this long (default 0, off); ?fresh=true bypasses it")
+	fmt.Println("  --recent-size <n> - Samples of each node of the poll groups and poll file kept for /api/recent (default 1000, 0 off)")
+	fmt.Println("  --recent-max-age <duration> - Drop samples kept for /api/recent after this long (default 0, until overwritten)")
+	fmt.Println("  --on-disconnect-cmd <command> - Run a shell command when the PLC session drops (event in $PLCCLI_EVENT, $PLCCLI_ERROR, ...)")
+	fmt.Println("  --rules <file> - YAML rules like \"when ns=5;s=alarm_word bit 7 goes 1\" that run a command, post a webhook")
+	fmt.Println("                   or publish to MQTT, evaluated on a subscription to their nodes")
+	fmt.Println("  --mock - Connect the service to a built-in simulated PLC (Temperature, Setpoint, Running, Alarms, Counter, Name) instead of --endpoint")
+	fmt.Println("\nAuthentication options:")
+	fmt.Println("  --auth-method UserName (default) - Use username/password authentication")
+	fmt.Println("  --auth-method Anonymous - Use anonymous authentication (no credentials)")
+	fmt.Println("  --password-file <file> - Read the password from a file instead of --password (visible in ps)")
+	fmt.Println("  --credentials-source <source> - Fetch the username and password when the service starts:")
+	fmt.Println("                                  file:<path> (YAML, mode 0600), keyring:<service> or vault:<path>")
+	fmt.Println("  Flags not given are read from PLCCLI_ENDPOINT, PLCCLI_USERNAME, PLCCLI_PASSWORD, PLCCLI_PASSWORD_FILE,")
+	fmt.Println("  PLCCLI_AUTH_METHOD, PLCCLI_SECURITY_POLICY, PLCCLI_SECURITY_MODE, PLCCLI_CONNECTION, PLCCLI_SERVICE_HOST,")
+	fmt.Println("  PLCCLI_CREDENTIALS_SOURCE, PLCCLI_TOKEN and PLCCLI_INFLUX_TOKEN")
+	fmt.Println("\nSecurity options:")
+	fmt.Println("  --security-policy None|Basic128Rsa15|Basic256|Basic256Sha256")
+	fmt.Println("  --security-mode None|Sign|SignAndEncrypt")
+	fmt.Println("\nMultiple connections: Use --connection <name> to specify which connection to use")
+	fmt.Println("  Named connections get a port hashed from the name in 10000-65000, unless pinned in a ports file:")
+	fmt.Println("  --ports-file <file> - YAML with ports: {line1: 18001, line3: hash} (default ~/.config/plccli/ports.yaml);")
+	fmt.Println("                        services refuse to start on the port of another listed connection")
+	fmt.Println("\nExamples:")
+	fmt.Println("  plccli --service --endpoint opc.tcp://192.168.1.100:4840 --username user --password pass")
+	fmt.Println("  plccli --format influx --measurement temperature opcua get ns=0;i=2258")
+	fmt.Println("  plccli --service-host 192.168.1.50 opcua get ns=0;i=2258")
+	fmt.Println("  plccli --direct --endpoint opc.tcp://192.168.1.100:4840 opcua get ns=0;i=2258")
+	fmt.Println("  plccli --service --mock")
+	fmt.Println("  plccli --connection meter --service --endpoint modbus://192.168.1.60:502")
+	fmt.Println("  plccli --connection meter modbus get 1 holding 100 4 float32")
+	fmt.Println("  plccli --connection press --service --endpoint enip://192.168.1.70?slot=0")
+	fmt.Println("  plccli --connection press enip get Program:Main.Temperature Recipe[2].Setpoint")
+	fmt.Println("  plccli opcua set ns=4;i=38 \"2025-03-09T14:30:00\" dtl")
+	fmt.Println("  plccli --auto-type opcua set ns=3;s=Setpoint 42")
+	fmt.Println("  plccli --attribute Description opcua set ns=3;s=Temperature \"Boiler inlet temperature\"")
+	fmt.Println("  plccli opcua set-bit ns=3;s=ControlWord 4 1")
+	fmt.Println("  plccli --data-type struct --value-file payload.json opcua set ns=3;s=Recipe")
+	fmt.Printf("\nplccli %s (%s, built %s)\n", buildVersion, buildCommit, buildTime)
+	flag.PrintDefaults()
 }
 
 // Handle connection errors consistently
 func handleConnectionError(err error) {
-    if strings.Contains(err.Error(), "connection refused") ||
-        strings.Contains(err.Error(), "cannot connect to service") {
-        serviceDesc := getServiceDescriptor(*connection)
-        fmt.Fprintf(os.Stderr, "Error: %s is not running. Start it with:\n", serviceDesc)
-        fmt.Fprintf(os.Stderr, "  plccli --connection %s --service --endpoint opc.tcp://opc-ua-server-ip:4840\n", *connection)
-        os.Exit(1)
-    }
-    // For other errors
-    fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-    os.Exit(1)
+	var connErr *plcclient.ConnectionError
+	if errors.As(err, &connErr) && errors.Is(err, syscall.ECONNREFUSED) {
+		serviceDesc := getServiceDescriptor(*connection)
+		fmt.Fprintf(os.Stderr, "Error: %s is not running. Start it with:\n", serviceDesc)
+		fmt.Fprintf(os.Stderr, "  plccli --connection %s --service --endpoint opc.tcp://opc-ua-server-ip:4840\n", *connection)
+		fmt.Fprintf(os.Stderr, "Or connect without a service using --direct --endpoint opc.tcp://opc-ua-server-ip:4840\n")
+		exitWithCode(exitConnection)
+	}
+	// For other errors, with the exit code of their class
+	exitWithError(err)
 }
 
 func main() {
-    // Configure logger with timestamps
-    log.SetFlags(log.LstdFlags | log.Lmicroseconds)
-
-    // Parse flags before checking for subcommands
-    flag.Parse()
-
-    // Show version if requested
-    if *version {
-        fmt.Printf("plccli version %s\n", buildVersion)
-        fmt.Printf("Commit: %s\n", buildCommit)
-        fmt.Printf("Built: %s\n", buildTime)
-        fmt.Printf("Copyright Octanis Instruments GmbH 2024\n")
-        os.Exit(0)
-    }
-
-    // Check if we have enough args for a subcommand
-    args := flag.Args()
-
-    // Get the actual port to use based on connection name
-    actualPort := getPortForConnection(*connection, *port)
-
-    // Service mode
-    if *service {
-        serviceDesc := getServiceDescriptor(*connection)
-        fmt.Printf("Starting %s on port %d...\n", serviceDesc, actualPort)
-        fmt.Printf("\nplccli %s (%s, built %s)\n", buildVersion, buildCommit, buildTime)
-
-        // Show connection info
-        authInfo := ""
-        if strings.ToLower(*authMethod) == "anonymous" {
-            authInfo = "with anonymous authentication"
-        } else if *username != "" {
-            authInfo = fmt.Sprintf("with username '%s'", *username)
-        } else {
-            authInfo = "without authentication (anonymous)"
-        }
-        
-        fmt.Printf("Connecting to %s %s\n", *endpoint, authInfo)
-        fmt.Printf("Security: Policy=%s, Mode=%s\n", *securityPolicy, *securityMode)
-
-        // Check if we need separate cert/key files for this connection
-        actualCertFile := *certfile
-        actualKeyFile := *keyfile
-        if *connection != "default" {
-            // For non-default connections, use connection-specific cert/key files
-            actualCertFile = strings.TrimSuffix(*certfile, ".pem") + "-" + *connection + ".pem"
-            actualKeyFile = strings.TrimSuffix(*keyfile, ".pem") + "-" + *connection + ".pem"
-        }
-
-        // Show where certificates will be stored
-        homeDir, _ := os.UserHomeDir()
-        if homeDir != "" {
-            configDir := filepath.Join(homeDir, ".config", "plccli")
-            if !filepath.IsAbs(actualCertFile) {
-                fmt.Printf("Certificates will be stored in: %s\n", configDir)
-            }
-        }
-
-        startService(*endpoint, *username, *password, actualCertFile, actualKeyFile,
-            *gencert, *appuri, *timeout, actualPort, *verbose, 
-            *securityPolicy, *securityMode, *authMethod)
-        return
-    }
-
-    // Client mode - needs subcommand
-    if len(args) < 2 || args[0] != "opcua" {
-        printUsage()
-        os.Exit(1)
-    }
-
-    // Process OPCUA subcommands
-    switch args[1] {
-    case "browse":
-        nodeID := "i=84" // Default to Objects folder
-        if len(args) >= 3 {
-            nodeID = args[2]
-        }
-        
-        maxDepth := 3 // Default depth
-        if len(args) >= 4 {
-            if depth, err := strconv.Atoi(args[3]); err == nil {
-                maxDepth = depth
-            } else {
-                fmt.Printf("Warning: Invalid depth value '%s', using default of %d\n", args[3], maxDepth)
-            }
-        }
-        
-        if err := browseNode(nodeID, maxDepth, *serviceHost, actualPort, *outputFormat); err != nil {
-            handleConnectionError(err)
-        }
-
-    case "get":
-        if len(args) < 3 {
-            fmt.Println("Error: Missing node-id")
-            printUsage()
-            os.Exit(1)
-        }
-
-        // Validate bit expansion flags
-        if *bits && *outputFormat != "influx" {
-            fmt.Fprintf(os.Stderr, "Error: --bits requires --format influx\n")
-            os.Exit(1)
-        }
-
-        nodeIDs := args[2:]
-        value, err := getNodeValues(nodeIDs, *serviceHost, actualPort, *outputFormat, *measurement, *bits, *bitNames)
-        if err != nil {
-            handleConnectionError(err)
-        }
-        fmt.Println(value)
-
-    case "set":
-        if len(args) < 5 {
-            fmt.Println("Error: Missing arguments for set command")
-            printUsage()
-            os.Exit(1)
-        }
-        nodeID := args[2]
-        value := args[3]
-        dataType := args[4]
-
-        result, err := setNodeValue(nodeID, value, dataType, *serviceHost, actualPort, *outputFormat)
-        if err != nil {
-            handleConnectionError(err)
-        }
-        fmt.Println(result)
-        
-    default:
-        fmt.Printf("Unknown command: %s\n\n", args[1])
-        printUsage()
-        os.Exit(1)
-    }
-}
\ No newline at end of file
+	// Configure logger with timestamps
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+
+	// Parse flags before checking for subcommands
+	flag.Parse()
+
+	// Show version if requested
+	if *version {
+		if profile := buildProfile(); profile != "full" {
+			fmt.Printf("plccli version %s (%s build)\n", buildVersion, profile)
+		} else {
+			fmt.Printf("plccli version %s\n", buildVersion)
+		}
+		fmt.Printf("Commit: %s\n", buildCommit)
+		fmt.Printf("Built: %s\n", buildTime)
+		fmt.Printf("Copyright Octanis Instruments GmbH 2024\n")
+		os.Exit(0)
+	}
+
+	// Check if we have enough args for a subcommand
+	args := flag.Args()
+
+	// Allow "--bits 3,7,12-15" as well as "--bits=3,7,12-15"
+	if bits.enabled && len(bits.selected) == 0 && len(args) > 0 && args[0] != "opcua" {
+		if selected, err := parseBitSelection(args[0]); err == nil {
+			bits.selected = selected
+			flag.CommandLine.Parse(args[1:])
+			args = flag.Args()
+		}
+	}
+
+	// Flags after the subcommand, e.g. opcua get --measurement temp <node-id>
+	args = parseCommandFlags(flag.CommandLine, args)
+
+	// Flags not given fall back to PLCCLI_* variables, e.g. PLCCLI_PASSWORD
+	if err := applyEnvFlags(flag.CommandLine, commandLineFlags(flag.CommandLine, commandFlagSet), os.Getenv); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitUsage)
+	}
+	// The service and its clients use the same --api-base-path
+	basePath, err := normalizeBasePath(*apiBasePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: --api-base-path: %v\n", err)
+		os.Exit(exitUsage)
+	}
+	*apiBasePath = basePath
+	clientTLS, err := loadAPIClientTLS(*apiTLS, *apiTLSCA)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: --api-tls-ca: %v\n", err)
+		os.Exit(exitUsage)
+	}
+	apiClientTLS = clientTLS
+	// Only the service and direct mode connect to the PLC
+	if *credSource != "" && (*service || *direct) {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := applyCredentialsSource(ctx, *credSource, username, password)
+		cancel()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --credentials-source: %v\n", err)
+			os.Exit(exitFailure)
+		}
+	}
+
+	if *influxMeasurement != "" {
+		*measurement = *influxMeasurement
+	}
+	if err := checkDecimalSeparator(*decimalSeparator); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitUsage)
+	}
+	if *influxTimestamp != "now" && *influxTimestamp != "source" && *influxTimestamp != "server" {
+		fmt.Fprintf(os.Stderr, "Error: --influx-timestamp must be now, source or server\n")
+		os.Exit(exitUsage)
+	}
+	var shiftCal *shiftCalendar
+	if *shifts != "" {
+		var err error
+		shiftCal, err = parseShiftCalendar(*shifts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --shifts: %v\n", err)
+			os.Exit(exitUsage)
+		}
+		serviceStates.shifts = shiftCal
+	}
+	influxOpts := influxOptions{
+		tags:      influxTags,
+		fieldName: *influxFieldName,
+		timestamp: *influxTimestamp,
+		shifts:    shiftCal,
+		batchNode: *batchNode,
+		batchTag:  *batchTag,
+	}
+	if *batchNode != "" {
+		if _, _, _, err := parseNodeID(*batchNode); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --batch-node: %v\n", err)
+			os.Exit(exitUsage)
+		}
+	}
+
+	// Node groups are served by the service, or by the direct mode's own API
+	if *groupsFile != "" && (*service || *direct) {
+		if err := serviceGroups.loadGroupsFile(*groupsFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --groups: %v\n", err)
+			os.Exit(exitUsage)
+		}
+	}
+
+	// Ports pinned for named connections, for services and clients alike
+	if path := portsFilePath(*portsFile); path != "" {
+		ports, err := loadConnectionPorts(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --ports-file: %v\n", err)
+			os.Exit(exitUsage)
+		}
+		pinnedPorts = ports
+	}
+
+	// Get the actual port to use based on connection name
+	actualPort := getPortForConnection(*connection, *port)
+
+	// Service mode
+	if *service {
+		if collisions := portCollisions(*connection, *port); len(collisions) > 0 {
+			fmt.Fprintf(os.Stderr, "Error: connection %s gets port %d, the port of %s; pin another port for it in the ports file\n",
+				*connection, actualPort, strings.Join(collisions, ", "))
+			os.Exit(exitUsage)
+		}
+		connectJitter = *startJitter
+		if *keepaliveNode != "" {
+			if err := checkNodeID(*keepaliveNode); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: --keepalive-node: %v\n", err)
+				os.Exit(exitUsage)
+			}
+		}
+		keepAliveInterval, keepAliveNode = *keepaliveEvery, *keepaliveNode
+		serviceEvents.hook = *onDisconnect
+		if *rulesFile != "" {
+			if isBackendEndpoint(*endpoint) {
+				fmt.Fprintf(os.Stderr, "Error: --rules subscribes to OPC UA nodes, %s is not an OPC UA endpoint\n", *endpoint)
+				os.Exit(exitUsage)
+			}
+			rules, err := loadRules(*rulesFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: --rules: %v\n", err)
+				os.Exit(exitUsage)
+			}
+			serviceRules = rules
+		}
+		retrySessionWrites = *retryWrites
+		if *cacheTTL < 0 {
+			fmt.Fprintf(os.Stderr, "Error: --cache-ttl must not be negative\n")
+			os.Exit(exitUsage)
+		}
+		serviceCache = newValueCache(*cacheTTL)
+		if *recentSize < 0 || *recentMaxAge < 0 {
+			fmt.Fprintf(os.Stderr, "Error: --recent-size and --recent-max-age must not be negative\n")
+			os.Exit(exitUsage)
+		}
+		serviceBasePath = *apiBasePath
+		serviceRecent = newRecentSamples(*recentSize)
+		serviceRecent.maxAge = *recentMaxAge
+		if *tenantsFile != "" {
+			tenants, err := loadTenants(*tenantsFile, *connection)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: --tenants: %v\n", err)
+				os.Exit(exitUsage)
+			}
+			serviceTenants = tenants
+		}
+		if *apiAuth != "" {
+			auth, err := newAuthenticator(*apiAuth)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: --api-auth: %v\n", err)
+				os.Exit(exitUsage)
+			}
+			if *apiAuthTTL <= 0 {
+				fmt.Fprintf(os.Stderr, "Error: --api-auth-cache-ttl must be positive\n")
+				os.Exit(exitUsage)
+			}
+			if serviceTenants == nil {
+				serviceTenants = &tenantRegistry{}
+			}
+			serviceTenants.auth = auth
+			serviceTenants.cache = newAuthCache(*apiAuthTTL)
+		}
+		if *rateLimit < 0 || *globalRate < 0 || *clientOps < 0 || *globalOps < 0 {
+			fmt.Fprintf(os.Stderr, "Error: --rate-limit, --rate-limit-global, --max-ops and --max-ops-global must not be negative\n")
+			os.Exit(exitUsage)
+		}
+		serviceRateLimiter = newRateLimiter(rateLimits{
+			clientRate: *rateLimit,
+			globalRate: *globalRate,
+			clientOps:  *clientOps,
+			globalOps:  *globalOps,
+		})
+		if *policyFile != "" {
+			policy, err := loadWritePolicy(*policyFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: --write-policy: %v\n", err)
+				os.Exit(exitUsage)
+			}
+			serviceWritePolicy = policy
+			if len(policy.critical) > 0 {
+				if serviceTenants == nil {
+					fmt.Fprintf(os.Stderr, "Error: --write-policy: critical nodes need --tenants or --api-auth, so a second person can confirm their writes\n")
+					os.Exit(exitUsage)
+				}
+				approvals, err := newApprovalRegistry(*approvalTTL)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: --approval-timeout: %v\n", err)
+					os.Exit(exitUsage)
+				}
+				serviceApprovals = approvals
+			}
+		}
+		if *limitsFile != "" {
+			limits, err := loadWriteLimits(*limitsFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: --write-limits: %v\n", err)
+				os.Exit(exitUsage)
+			}
+			serviceWriteLimits = limits
+		}
+		if *sensitiveFile != "" {
+			sensitive, err := loadSensitiveNodes(*sensitiveFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: --sensitive-nodes: %v\n", err)
+				os.Exit(exitUsage)
+			}
+			serviceSensitive = sensitive
+		}
+		if *writePermits != 0 {
+			permits, err := newPermitRegistry(*writePermits)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: --write-permits: %v\n", err)
+				os.Exit(exitUsage)
+			}
+			servicePermits = permits
+		}
+		if *apiTLSCert != "" || *apiTLSKey != "" {
+			reloader, err := newCertReloader(*apiTLSCert, *apiTLSKey)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: --api-tls-cert: %v\n", err)
+				os.Exit(exitUsage)
+			}
+			serviceTLS = reloader
+		}
+		cors, err := newCORSPolicy(*corsOrigins)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --cors-origins: %v\n", err)
+			os.Exit(exitUsage)
+		}
+		serviceCORS = cors
+		if *accessLogPath != "" {
+			accessLog, err := openAccessLog(*accessLogPath, *accessLogRate, *accessLogRedact)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: --access-log: %v\n", err)
+				os.Exit(exitUsage)
+			}
+			serviceAccessLog = accessLog
+		}
+		if *debugFaults {
+			fmt.Fprintf(os.Stderr, "Warning: --debug-faults lets API clients break this service's PLC connection, do not use it in production\n")
+			serviceFaults = newFaultInjector()
+		}
+		if *influxURL != "" && *pollFilePath == "" {
+			fmt.Fprintf(os.Stderr, "Error: --influx-url writes the samples of --poll-file, which is missing\n")
+			os.Exit(exitUsage)
+		}
+		if *pollFilePath != "" {
+			pf, err := loadPollFile(*pollFilePath)
+			if err == nil {
+				err = pf.checkEndpoint(*endpoint)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: --poll-file: %v\n", err)
+				os.Exit(exitUsage)
+			}
+			if *influxURL != "" {
+				sink, err := influxSink(*influxURL, *influxToken, *influxOrg, *influxBucket)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: --influx-url: %v\n", err)
+					os.Exit(exitUsage)
+				}
+				if *influxBatch <= 0 {
+					fmt.Fprintf(os.Stderr, "Error: --influx-batch must be positive\n")
+					os.Exit(exitUsage)
+				}
+				sink.Gzip, sink.Batch = *influxGzip, *influxBatch
+				pf.Sinks = append(pf.Sinks, sink)
+			}
+			read := readPollSample
+			if isBackendEndpoint(*endpoint) {
+				read = readBackendSample
+			}
+			servicePollFile = newPollScheduler(pf, read)
+		}
+		if *mock {
+			mockPLC, err := startMockServer(context.Background())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: --mock: %v\n", err)
+				os.Exit(exitFailure)
+			}
+			*endpoint = mockPLC.endpoint
+			*authMethod = "Anonymous"
+			connectJitter = 0 // Nobody else connects to the simulated PLC
+			fmt.Printf("Mock mode: simulated PLC at %s, variables in namespace %s\n", mockPLC.endpoint, mockNamespaceURI)
+		}
+		serviceDesc := getServiceDescriptor(*connection)
+		fmt.Printf("Starting %s on port %d...\n", serviceDesc, actualPort)
+		fmt.Printf("\nplccli %s (%s, built %s)\n", buildVersion, buildCommit, buildTime)
+
+		// Devices of registered backends (Modbus TCP, EtherNet/IP, ...) have no
+		// sessions, security or certificates
+		if reg, ok := backend.Lookup(*endpoint); ok {
+			fmt.Printf("Connecting to %s device %s\n", reg.Name, *endpoint)
+			startBackendService(*endpoint, *timeout, actualPort, *verbose)
+			return
+		}
+
+		// Show connection info
+		authInfo := ""
+		if strings.ToLower(*authMethod) == "anonymous" {
+			authInfo = "with anonymous authentication"
+		} else if *username != "" {
+			authInfo = fmt.Sprintf("with username '%s'", *username)
+		} else {
+			authInfo = "without authentication (anonymous)"
+		}
+
+		fmt.Printf("Connecting to %s %s\n", *endpoint, authInfo)
+		fmt.Printf("Security: Policy=%s, Mode=%s\n", *securityPolicy, *securityMode)
+
+		// Check if we need separate cert/key files for this connection
+		actualCertFile, actualKeyFile := getCertFilesForConnection(*certfile, *keyfile, *connection)
+
+		// Show where certificates will be stored
+		homeDir, _ := os.UserHomeDir()
+		if homeDir != "" {
+			configDir := filepath.Join(homeDir, ".config", "plccli")
+			if !filepath.IsAbs(actualCertFile) {
+				fmt.Printf("Certificates will be stored in: %s\n", configDir)
+			}
+		}
+
+		startService(*endpoint, *username, *password, actualCertFile, actualKeyFile,
+			*gencert, *appuri, *timeout, actualPort, *verbose,
+			*securityPolicy, *securityMode, *authMethod,
+			trackStateNodes, *stateInterval)
+		return
+	}
+
+	// What this binary supports, for tooling driving it
+	if len(args) >= 1 && args[0] == "capabilities" {
+		result, err := runCapabilities(*outputFormat)
+		if err != nil {
+			exitWithError(err)
+		}
+		fmt.Println(result)
+		return
+	}
+
+	// Read the samples stored by a SQLite sink
+	if len(args) >= 1 && args[0] == "query" {
+		result, err := runQuery(args[1:], *outputFormat)
+		if err != nil {
+			exitWithError(err)
+		}
+		if result != "" {
+			fmt.Println(result)
+		}
+		return
+	}
+
+	// Cancel a queued write or running browse of the service
+	if len(args) >= 1 && args[0] == "cancel" {
+		if len(args) < 2 {
+			fmt.Println("Error: Missing operation ID")
+			printUsage()
+			os.Exit(exitUsage)
+		}
+		result, err := cancelServiceOperation(args[1], *serviceHost, actualPort)
+		if err != nil {
+			handleConnectionError(err)
+		}
+		fmt.Println(result)
+		return
+	}
+
+	// Write permits of a service started with --write-permits
+	if len(args) >= 1 && args[0] == "permit" {
+		result, err := runPermitCommand(args[1:], *serviceHost, actualPort)
+		if err != nil {
+			handleConnectionError(err)
+		}
+		fmt.Println(result)
+		return
+	}
+
+	// Writes of critical nodes confirmed by a second person
+	if len(args) >= 1 && args[0] == "approvals" {
+		result, err := runApprovalsCommand(args[1:], *serviceHost, actualPort)
+		if err != nil {
+			handleConnectionError(err)
+		}
+		fmt.Println(result)
+		return
+	}
+
+	// Recurring writes of the service
+	if len(args) >= 1 && args[0] == "schedules" {
+		result, err := runSchedulesCommand(args[1:], *serviceHost, actualPort)
+		if err != nil {
+			handleConnectionError(err)
+		}
+		fmt.Println(result)
+		return
+	}
+
+	// Interactive commands against the service of a connection
+	if len(args) >= 1 && args[0] == "shell" {
+		session := newShellSession(*serviceHost, *port, *connection, influxOpts, os.Stdout)
+		// Human-readable unless --format is given
+		if commandLineFlags(flag.CommandLine, commandFlagSet)["format"] {
+			session.format = *outputFormat
+		}
+		if err := runShell(session); err != nil {
+			exitWithError(err)
+		}
+		return
+	}
+
+	// Commissioning sequences, stopped by the first failing line
+	if len(args) >= 1 && args[0] == "run" {
+		if len(args) < 2 {
+			fmt.Println("Error: run needs a script file")
+			printUsage()
+			exitWithCode(exitUsage)
+		}
+		session := newShellSession(*serviceHost, *port, *connection, influxOpts, os.Stdout)
+		if commandLineFlags(flag.CommandLine, commandFlagSet)["format"] {
+			session.format = *outputFormat
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		err := runScript(ctx, args[1], args[2:], session)
+		stop()
+		if err != nil {
+			exitWithError(err)
+		}
+		return
+	}
+
+	// Acceptance tests of PLC programs, for CI
+	if len(args) >= 1 && args[0] == "test" {
+		if len(args) < 2 {
+			fmt.Println("Error: test needs a suite file")
+			printUsage()
+			exitWithCode(exitUsage)
+		}
+		session := newShellSession(*serviceHost, *port, *connection, influxOpts, os.Stdout)
+		if *interval > 0 {
+			session.interval = *interval
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		err := runTestSuite(ctx, args[1], args[2:], junitFile, session, os.Stdout)
+		stop()
+		if err != nil {
+			exitWithError(err)
+		}
+		return
+	}
+
+	// Notes of people on the timeline of the connection
+	if len(args) >= 1 && args[0] == "annotate" {
+		result, err := runAnnotate(args[1:], *serviceHost, actualPort, *outputFormat, influxTags)
+		if err != nil {
+			handleConnectionError(err)
+		}
+		fmt.Println(result)
+		return
+	}
+
+	// Maintenance window of the connection
+	if len(args) >= 1 && args[0] == "maintenance" {
+		result, err := runMaintenanceCommand(args[1:], *serviceHost, actualPort)
+		if err != nil {
+			handleConnectionError(err)
+		}
+		fmt.Println(result)
+		return
+	}
+
+	// Move the runtime state of a service to a replacement gateway
+	if len(args) >= 2 && args[0] == "service" {
+		certFile, keyFile := getCertFilesForConnection(*certfile, *keyfile, *connection)
+		switch args[1] {
+		case "export-state":
+			path := ""
+			if len(args) >= 3 {
+				path = args[2]
+			}
+			state, err := exportRuntimeState(*connection, certFile, keyFile, *serviceHost, actualPort)
+			if err != nil {
+				handleConnectionError(err)
+			}
+			if err := writeRuntimeState(state, path); err != nil {
+				exitWithError(err)
+			}
+			return
+		case "import-state":
+			if len(args) < 3 {
+				fmt.Println("Error: Missing state file")
+				printUsage()
+				os.Exit(exitUsage)
+			}
+			state, err := readRuntimeState(args[2])
+			if err != nil {
+				exitWithError(err)
+			}
+			summary, err := importRuntimeState(state, certFile, keyFile, *serviceHost, actualPort)
+			if err != nil {
+				handleConnectionError(err)
+			}
+			fmt.Print(summary)
+			return
+		}
+	}
+
+	// Modbus connections: plccli modbus get|set <unit> <register-type> <address> ...
+	if len(args) >= 1 && args[0] == "modbus" {
+		runModbusCommand(args[1:], actualPort, influxOpts)
+		return
+	}
+
+	// EtherNet/IP connections: plccli enip get|set <tag> ...
+	if len(args) >= 1 && args[0] == "enip" {
+		runENIPCommand(args[1:], actualPort, influxOpts)
+		return
+	}
+
+	// Connections of any backend: plccli point get|set|browse <ref> ...
+	if len(args) >= 1 && args[0] == "point" {
+		runPointCommand(args[1:], actualPort, influxOpts)
+		return
+	}
+
+	// Client mode - needs subcommand
+	if len(args) < 2 || args[0] != "opcua" {
+		printUsage()
+		os.Exit(exitUsage)
+	}
+
+	// Direct mode - connect from this process instead of using the service
+	if *direct {
+		certFile, keyFile := getCertFilesForConnection(*certfile, *keyfile, *connection)
+		directPort, err := startDirect(*endpoint, *username, *password, certFile, keyFile,
+			*gencert, *appuri, *timeout, *verbose)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitConnection)
+		}
+		defer stopDirect()
+		*serviceHost = "127.0.0.1"
+		actualPort = directPort
+		*apiBasePath = ""  // The direct mode server has no base path
+		apiClientTLS = nil // nor TLS
+	}
+
+	// Tag the metrics of a tenant with its labels
+	if *token != "" && *outputFormat == "influx" {
+		var err error
+		if influxOpts, err = influxOpts.withTenantLabels(*serviceHost, actualPort); err != nil {
+			handleConnectionError(err)
+		}
+	}
+
+	// Process OPCUA subcommands
+	switch args[1] {
+	case "browse":
+		nodeID := "i=84" // Default to Objects folder
+		if len(args) >= 3 {
+			nodeID = args[2]
+		}
+
+		maxDepth := 3 // Default depth
+		if len(args) >= 4 {
+			if depth, err := strconv.Atoi(args[3]); err == nil {
+				maxDepth = depth
+			} else {
+				fmt.Printf("Warning: Invalid depth value '%s', using default of %d\n", args[3], maxDepth)
+			}
+		}
+
+		if err := browseNode(nodeID, maxDepth, *async, *serviceHost, actualPort, *outputFormat, browseMaxNodes, browseContinuation, browseRefresh); err != nil {
+			handleConnectionError(err)
+		}
+
+	case "subscribe":
+		if subscribeSubtree == "" || len(args) > 2 {
+			fmt.Println("Error: subscribe needs --subtree <node-id>")
+			printUsage()
+			exitWithCode(exitUsage)
+		}
+		if subscribeMaxItems < 1 {
+			fmt.Fprintf(os.Stderr, "Error: --max-items must be at least 1\n")
+			exitWithCode(exitUsage)
+		}
+
+		if subscribeRebrowse < 0 {
+			fmt.Fprintf(os.Stderr, "Error: --rebrowse must not be negative\n")
+			exitWithCode(exitUsage)
+		}
+
+		pollInterval := *interval
+		if pollInterval <= 0 {
+			pollInterval = defaultSubscribeInterval
+		}
+		readOpts := plcclient.ReadOptions{
+			DecodeEnums:  *decodeEnums,
+			Fresh:        *freshFlag,
+			WithMetadata: *withMetadata,
+		}
+		monitor := &subtreeMonitor{
+			subtree:  subscribeSubtree,
+			maxDepth: subscribeDepth,
+			maxItems: subscribeMaxItems,
+			rebrowse: subscribeRebrowse,
+			host:     *serviceHost,
+			port:     actualPort,
+		}
+		transforms, err := loadValueTransforms(*transformFlag, *transformFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exitWithCode(exitUsage)
+		}
+		monitor.transforms = transforms
+		if err := monitor.run(pollInterval, *outputFormat, *measurement, readOpts, influxOpts); err != nil {
+			handleConnectionError(err)
+		}
+
+	case "tui":
+		nodeID := "i=84" // Objects folder
+		if len(args) >= 3 {
+			nodeID = args[2]
+		}
+		maxDepth := defaultTUIDepth
+		if len(args) >= 4 {
+			depth, err := strconv.Atoi(args[3])
+			if err != nil || depth < 1 {
+				fmt.Fprintf(os.Stderr, "Error: invalid depth %s\n", args[3])
+				exitWithCode(exitUsage)
+			}
+			maxDepth = depth
+		}
+		tuiInterval := *interval
+		if tuiInterval <= 0 {
+			tuiInterval = defaultTUIInterval
+		}
+		if err := runTUI(nodeID, maxDepth, tuiInterval, *serviceHost, actualPort); err != nil {
+			handleConnectionError(err)
+		}
+
+	case "watch":
+		if len(args) < 3 {
+			fmt.Println("Error: Missing node ID")
+			printUsage()
+			exitWithCode(exitUsage)
+		}
+		watchInterval := *interval
+		if watchInterval <= 0 {
+			watchInterval = defaultWatchInterval
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		err := runWatch(ctx, args[2:], watchInterval, *serviceHost, actualPort)
+		stop()
+		if err != nil {
+			handleConnectionError(err)
+		}
+
+	case "states":
+		result, err := getStateDurations(*serviceHost, actualPort, *outputFormat, influxOpts)
+		if err != nil {
+			handleConnectionError(err)
+		}
+		fmt.Println(result)
+
+	case "get":
+		if len(args) < 3 {
+			fmt.Println("Error: Missing node-id")
+			printUsage()
+			exitWithCode(exitUsage)
+		}
+
+		// Validate bit expansion flags
+		if bits.enabled && *outputFormat != "influx" {
+			fmt.Fprintf(os.Stderr, "Error: --bits requires --format influx\n")
+			exitWithCode(exitUsage)
+		}
+
+		if *bitsSummary && !bits.enabled {
+			fmt.Fprintf(os.Stderr, "Error: --bits-summary requires --bits\n")
+			exitWithCode(exitUsage)
+		}
+
+		if *bitEdges && (!bits.enabled || *interval <= 0) {
+			fmt.Fprintf(os.Stderr, "Error: --bit-edges requires --bits and --interval\n")
+			exitWithCode(exitUsage)
+		}
+
+		var nameMap bitNameMap
+		if *bitNamesFile != "" {
+			var err error
+			nameMap, err = loadBitNameMap(*bitNamesFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: --bit-names-file: %v\n", err)
+				exitWithCode(exitUsage)
+			}
+		}
+
+		bitOpts := bitOptions{
+			enabled:  bits.enabled,
+			names:    parseBitNames(*bitNames),
+			nameMap:  nameMap,
+			selected: bits.selected,
+			summary:  *bitsSummary,
+			edges:    *bitEdges,
+		}
+
+		if *counterMode != "" && *counterMode != "delta" && *counterMode != "total" {
+			fmt.Fprintf(os.Stderr, "Error: --counter must be delta or total\n")
+			exitWithCode(exitUsage)
+		}
+		if *counterMode != "" && bits.enabled {
+			fmt.Fprintf(os.Stderr, "Error: --counter cannot be combined with --bits\n")
+			exitWithCode(exitUsage)
+		}
+		if *counterMode != "" && *interval <= 0 && *counterStateFile == "" {
+			fmt.Fprintf(os.Stderr, "Error: --counter requires --interval or --counter-state to keep track of previous values\n")
+			exitWithCode(exitUsage)
+		}
+
+		transforms, err := loadValueTransforms(*transformFlag, *transformFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exitWithCode(exitUsage)
+		}
+		if transforms.enabled() && bits.enabled {
+			fmt.Fprintf(os.Stderr, "Error: --transform cannot be combined with --bits, bits are taken from the raw value\n")
+			exitWithCode(exitUsage)
+		}
+
+		tracker, err := loadCounterTracker(*counterStateFile)
+		if err != nil {
+			exitWithError(err)
+		}
+		counterOpts := counterOptions{
+			mode:      *counterMode,
+			max:       *counterMax,
+			stateFile: *counterStateFile,
+			tracker:   tracker,
+			shifts:    shiftCal,
+		}
+
+		readOpts := plcclient.ReadOptions{
+			DecodeEnums:  *decodeEnums,
+			Fresh:        *freshFlag,
+			Synchronized: *synchronized,
+			WithMetadata: *withMetadata,
+		}
+
+		nodeIDs, err := expandNodeGroups(args[2:], *serviceHost, actualPort)
+		if err != nil {
+			handleConnectionError(err)
+		}
+		if *warnDuplicates {
+			for _, d := range duplicateNodeIDs(nodeIDs) {
+				fmt.Fprintf(os.Stderr, "Warning: %s is given %d times, it is read once\n", d.nodeID, d.count)
+			}
+		}
+		if bitOpts.enabled {
+			bitOpts.widths = nodeBitWidths(nodeIDs, *serviceHost, actualPort)
+		}
+		if *interval > 0 {
+			if err := pollNodeValues(nodeIDs, *serviceHost, actualPort, *outputFormat, *measurement, readOpts, bitOpts, influxOpts, counterOpts, transforms, *interval); err != nil {
+				handleConnectionError(err)
+			}
+			return
+		}
+
+		value, err := getNodeValues(nodeIDs, *serviceHost, actualPort, *outputFormat, *measurement, readOpts, bitOpts, influxOpts, counterOpts, transforms)
+		if err != nil {
+			handleConnectionError(err)
+		}
+		if err := counterOpts.save(); err != nil {
+			exitWithError(err)
+		}
+		fmt.Println(value)
+
+	case "set":
+		// Text attributes like Description imply their data type, and
+		// --auto-type reads it from the node
+		minArgs := 5
+		if *autoType || *dataTypeFlag != "" || defaultAttributeDataType(*attribute) != "" {
+			minArgs = 4
+		}
+		// --value-file replaces the value argument
+		typeArg := 4
+		if *valueFile != "" {
+			minArgs--
+			typeArg = 3
+		}
+		if len(args) < minArgs {
+			fmt.Println("Error: Missing arguments for set command")
+			printUsage()
+			exitWithCode(exitUsage)
+		}
+		if _, err := parseWritePriority(*writePriority); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --write-priority: %v\n", err)
+			exitWithCode(exitUsage)
+		}
+		if *dryRun && *confirmWrites {
+			fmt.Fprintf(os.Stderr, "Error: --dry-run and --confirm cannot be combined\n")
+			exitWithCode(exitUsage)
+		}
+		nodeID := args[2]
+		var value string
+		if *valueFile != "" {
+			data, err := os.ReadFile(*valueFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: --value-file: %v\n", err)
+				exitWithCode(exitUsage)
+			}
+			value = string(data)
+		} else {
+			value = args[3]
+		}
+		dataType := ""
+		if len(args) > typeArg {
+			dataType = args[typeArg] // Explicit type always wins over --auto-type
+		} else if *dataTypeFlag != "" {
+			dataType = *dataTypeFlag
+		} else if *autoType {
+			dataType = "auto"
+		}
+
+		check := writeCheck{dryRun: *dryRun, confirm: *confirmWrites, in: os.Stdin, out: os.Stderr}
+		result, err := setNodeValue(nodeID, value, dataType, *attribute, *writePriority, *serviceHost, actualPort, *outputFormat, influxOpts, check)
+		if err != nil {
+			handleConnectionError(err)
+		}
+		fmt.Println(result)
+
+	case "set-bit":
+		if len(args) < 5 {
+			fmt.Println("Error: Missing arguments for set-bit command")
+			printUsage()
+			exitWithCode(exitUsage)
+		}
+		bitNum, err := strconv.Atoi(args[3])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid bit number %q\n", args[3])
+			exitWithCode(exitUsage)
+		}
+		if args[4] != "0" && args[4] != "1" {
+			fmt.Fprintf(os.Stderr, "Error: bit value must be 0 or 1, got %q\n", args[4])
+			exitWithCode(exitUsage)
+		}
+
+		result, err := setNodeBit(args[2], bitNum, args[4] == "1", *serviceHost, actualPort, *outputFormat, influxOpts)
+		if err != nil {
+			handleConnectionError(err)
+		}
+		fmt.Println(result)
+
+	case "validate":
+		var expectations []nodeExpectation
+		if validateFile != "" {
+			in := os.Stdin
+			if validateFile != "-" {
+				f, err := os.Open(validateFile)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: --file: %v\n", err)
+					exitWithCode(exitUsage)
+				}
+				defer f.Close()
+				in = f
+			}
+			var err error
+			if expectations, err = parseValidateFile(in); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: --file: %v\n", err)
+				exitWithCode(exitUsage)
+			}
+		}
+		for _, nodeID := range args[2:] {
+			expectations = append(expectations, nodeExpectation{nodeID: nodeID})
+		}
+		if len(expectations) == 0 {
+			fmt.Println("Error: Missing --file or node-id")
+			printUsage()
+			exitWithCode(exitUsage)
+		}
+
+		result, ok, err := validateNodes(expectations, *serviceHost, actualPort)
+		if err != nil {
+			handleConnectionError(err)
+		}
+		fmt.Println(result)
+		if !ok {
+			exitWithCode(exitFailure)
+		}
+
+	case "assert":
+		session := newShellSession(*serviceHost, *port, *connection, influxOpts, os.Stdout)
+		session.port = actualPort
+		if *interval > 0 {
+			session.interval = *interval
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		err := runAssert(ctx, args[2:], assertWithin, session)
+		stop()
+		if err != nil {
+			handleConnectionError(err)
+		}
+
+	default:
+		fmt.Printf("Unknown command: %s\n\n", args[1])
+		printUsage()
+		exitWithCode(exitUsage)
+	}
+}
@@ -92,3 +92,14 @@ func TestGetServiceDescriptor(t *testing.T) {
 		})
 	}
 }
+
+// TestGetCertFilesForConnection tests connection-specific certificate file names
+func TestGetCertFilesForConnection(t *testing.T) {
+	cert, key := getCertFilesForConnection("cert.pem", "key.pem", "default")
+	assert.Equal(t, "cert.pem", cert)
+	assert.Equal(t, "key.pem", key)
+
+	cert, key = getCertFilesForConnection("cert.pem", "key.pem", "plc1")
+	assert.Equal(t, "cert-plc1.pem", cert)
+	assert.Equal(t, "key-plc1.pem", key)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maintenanceTag marks the lines sampled during a maintenance window
+var maintenanceTag = influxTag{"maintenance", "true"}
+
+// maintenanceMode is the maintenance window of a connection. While it lasts
+// values are still read but tagged maintenance=true, writes to the PLC are
+// rejected and alerts (webhook sinks, the disconnect hook) are suppressed,
+// so planned work doesn't page anyone
+type maintenanceMode struct {
+	mu      sync.Mutex
+	current *Maintenance
+	now     func() time.Time // replaced in tests
+}
+
+// Maintenance window of this service's connection
+var serviceMaintenance = newMaintenanceMode()
+
+func newMaintenanceMode() *maintenanceMode {
+	return &maintenanceMode{now: time.Now}
+}
+
+// start begins a maintenance window, or replaces the running one. A zero
+// duration lasts until end
+func (m *maintenanceMode) start(reason, tenant string, duration time.Duration) (Maintenance, error) {
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return Maintenance{}, fmt.Errorf("maintenance needs a reason")
+	}
+	if duration < 0 {
+		return Maintenance{}, fmt.Errorf("maintenance duration must not be negative, got %v", duration)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	window := Maintenance{Reason: reason, Tenant: tenant, Since: now}
+	if duration > 0 {
+		until := now.Add(duration)
+		window.Until = &until
+	}
+	m.current = &window
+	return window, nil
+}
+
+// end ends the maintenance window. It fails outside one
+func (m *maintenanceMode) end() (Maintenance, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire()
+	if m.current == nil {
+		return Maintenance{}, fmt.Errorf("the connection is not under maintenance")
+	}
+	window := *m.current
+	m.current = nil
+	return window, nil
+}
+
+// status returns the running maintenance window, nil outside one
+func (m *maintenanceMode) status() *Maintenance {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire()
+	if m.current == nil {
+		return nil
+	}
+	window := *m.current
+	return &window
+}
+
+// active reports whether the connection is under maintenance
+func (m *maintenanceMode) active() bool {
+	return m.status() != nil
+}
+
+// expire ends a window whose time is up. Callers hold mu
+func (m *maintenanceMode) expire() {
+	if m.current != nil && m.current.Until != nil && !m.now().Before(*m.current.Until) {
+		log.Printf("[%s] Maintenance ended after %s: %s", connectionName,
+			m.current.Until.Sub(m.current.Since).Round(time.Second), m.current.Reason)
+		m.current = nil
+	}
+}
+
+// middleware rejects writes to the PLC during a maintenance window with 423
+// Locked. Reads, and everything else, pass
+func (m *maintenanceMode) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPLCWrite(r) {
+			if window := m.status(); window != nil {
+				log.Printf("[%s] Write rejected for %s: under maintenance", connectionName, permitHolder(r))
+				http.Error(w, "Locked: the connection is under maintenance: "+window.Reason, http.StatusLocked)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// maintenanceRequest is the body of POST /api/maintenance
+type maintenanceRequest struct {
+	Reason   string `json:"reason"`
+	Duration string `json:"duration,omitempty"` // Go duration, until ended when empty
+}
+
+// handleMaintenanceRequest shows (GET), starts (POST) and ends (DELETE) the
+// maintenance window of the connection
+func handleMaintenanceRequest(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"maintenance": serviceMaintenance.status(),
+		})
+
+	case http.MethodPost:
+		var req maintenanceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": fmt.Sprintf("Failed to parse request: %v", err),
+			})
+			return
+		}
+		var duration time.Duration
+		if req.Duration != "" {
+			var err error
+			if duration, err = time.ParseDuration(req.Duration); err != nil {
+				sendJSONResponseGeneric(w, map[string]interface{}{
+					"error": fmt.Sprintf("invalid duration %q: %v", req.Duration, err),
+				})
+				return
+			}
+		}
+		window, err := serviceMaintenance.start(req.Reason, tenantName(r), duration)
+		if err != nil {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": err.Error(),
+			})
+			return
+		}
+		until := "ended"
+		if window.Until != nil {
+			until = window.Until.Format(time.RFC3339)
+		}
+		log.Printf("[%s] Maintenance started by %s until %s: %s", connectionName, permitHolder(r), until, window.Reason)
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"maintenance": window,
+		})
+
+	case http.MethodDelete:
+		window, err := serviceMaintenance.end()
+		if err != nil {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": err.Error(),
+			})
+			return
+		}
+		log.Printf("[%s] Maintenance ended by %s after %s: %s", connectionName, permitHolder(r),
+			serviceMaintenance.now().Sub(window.Since).Round(time.Second), window.Reason)
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"ended": window,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// withMaintenance returns the options with the maintenance tag added when
+// the connection info reports a maintenance window
+func (o influxOptions) withMaintenance(info map[string]interface{}) influxOptions {
+	if info["maintenance"] == nil {
+		return o
+	}
+	o.tags = append(append([]influxTag{}, o.tags...), maintenanceTag)
+	return o
+}
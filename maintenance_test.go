@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMaintenanceMode tests starting, expiring and ending maintenance
+// windows
+func TestMaintenanceMode(t *testing.T) {
+	m := newMaintenanceMode()
+	now := time.Date(2026, 10, 16, 6, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return now }
+
+	assert.Nil(t, m.status())
+	_, err := m.start(" ", "acme", 0)
+	assert.Error(t, err, "no reason")
+	_, err = m.start("drive swap", "acme", -time.Hour)
+	assert.Error(t, err)
+	_, err = m.end()
+	assert.Error(t, err, "not under maintenance")
+
+	window, err := m.start("drive swap", "acme", 2*time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(2*time.Hour), *window.Until)
+	assert.Equal(t, &window, m.status())
+	now = now.Add(2 * time.Hour)
+	assert.False(t, m.active(), "expired")
+
+	_, err = m.start("firmware update", "", 0)
+	require.NoError(t, err)
+	now = now.Add(24 * time.Hour)
+	assert.True(t, m.active(), "until ended")
+	window, err = m.end()
+	require.NoError(t, err)
+	assert.Equal(t, "firmware update", window.Reason)
+	assert.False(t, m.active())
+
+	var none *maintenanceMode
+	assert.False(t, none.active())
+}
+
+// TestMaintenanceAPI tests that writes are rejected during maintenance while
+// reads go on, with the client library and the CLI's formatting
+func TestMaintenanceAPI(t *testing.T) {
+	defer func(m *maintenanceMode) { serviceMaintenance = m }(serviceMaintenance)
+	serviceMaintenance = newMaintenanceMode()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/maintenance", handleMaintenanceRequest)
+	mux.HandleFunc("/api/modbus", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			sendJSONResponseGeneric(w, map[string]interface{}{"results": []NodeResponse{{NodeID: "1/holding/100", Value: 1.0}}})
+			return
+		}
+		sendJSONResponse(w, NodeResponse{NodeID: "1/holding/100", Value: "1"})
+	})
+	server := httptest.NewServer(serviceMaintenance.middleware(mux))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	client := newServiceClient(u.Hostname(), port)
+	window, err := client.Maintenance(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, window)
+	assert.Equal(t, "Not under maintenance", formatMaintenance(window, time.Now()))
+	_, err = client.StartMaintenance(ctx, "", 0)
+	assert.ErrorContains(t, err, "reason")
+
+	started, err := client.StartMaintenance(ctx, "replace drive of conveyor 3", 90*time.Minute)
+	require.NoError(t, err)
+	require.NotNil(t, started.Until)
+	assert.WithinDuration(t, time.Now().Add(90*time.Minute), *started.Until, time.Minute)
+	_, err = client.WriteModbus(ctx, "1/holding/100", "1")
+	assert.ErrorContains(t, err, "under maintenance")
+	_, err = client.ReadModbus(ctx, "1/holding/100")
+	assert.NoError(t, err)
+
+	window, err = client.Maintenance(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, window)
+	status := formatMaintenance(window, window.Since.Add(30*time.Minute))
+	assert.Contains(t, status, "1h0m0s left")
+	assert.Contains(t, status, "replace drive of conveyor 3")
+
+	require.NoError(t, client.EndMaintenance(ctx))
+	_, err = client.WriteModbus(ctx, "1/holding/100", "1")
+	assert.NoError(t, err)
+	assert.Error(t, client.EndMaintenance(ctx))
+}
+
+// TestMaintenanceAlerts tests that lines sampled during maintenance are
+// tagged, webhook sinks get none of them and the disconnect hook stays quiet
+func TestMaintenanceAlerts(t *testing.T) {
+	defer func(m *maintenanceMode) { serviceMaintenance = m }(serviceMaintenance)
+	serviceMaintenance = newMaintenanceMode()
+
+	pf := &pollFile{Buffer: 100, Sinks: []*pollSink{{URL: "http://sink"}, {Webhook: "http://hook"}}, Polls: []*pollFileEntry{
+		{Node: "ns=3;s=Temperature", Interval: "1s", Measurement: "boiler"},
+	}}
+	s := newPollScheduler(pf, func(ctx context.Context, nodeIDs []string, synchronized bool) []NodeResponse {
+		return []NodeResponse{{NodeID: nodeIDs[0], Value: 72.5}}
+	})
+	s.endpoint = "opc.tcp://plc:4840"
+
+	_, err := serviceMaintenance.start("boiler inspection", "", 0)
+	require.NoError(t, err)
+	s.sample(context.Background(), pf.Polls)
+	lines, _ := s.buffer.drain()
+	require.Len(t, lines, 1)
+	assert.Contains(t, lines[0], ",maintenance=true ")
+	sinkLines, _ := s.sinks[0].drain()
+	assert.Equal(t, lines, sinkLines[priorityProcess])
+	webhookLines, _ := s.sinks[1].drain()
+	assert.Zero(t, webhookLines.len())
+
+	opts := influxOptions{}.withMaintenance(map[string]interface{}{"maintenance": map[string]interface{}{"reason": "x"}})
+	assert.True(t, strings.HasSuffix(opts.tagSet("ns=3;s=Temperature", "e"), ",maintenance=true"))
+
+	e := newEventBus(serviceMaintenance).publish(serviceEvent{Type: eventDisconnect})
+	assert.True(t, e.Maintenance)
+
+	_, err = serviceMaintenance.end()
+	require.NoError(t, err)
+	s.sample(context.Background(), pf.Polls)
+	lines, _ = s.buffer.drain()
+	assert.NotContains(t, lines[0], "maintenance")
+	webhookLines, _ = s.sinks[1].drain()
+	assert.Equal(t, 1, webhookLines.len())
+	assert.Empty(t, influxOptions{}.withMaintenance(map[string]interface{}{}).tags)
+}
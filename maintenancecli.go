@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Duration of plccli maintenance start, from its --duration flag
+var maintenanceDuration time.Duration
+
+// runMaintenanceCommand runs maintenance start, status or end against the
+// service
+func runMaintenanceCommand(args []string, host string, port int) (string, error) {
+	if len(args) < 1 {
+		return "", fmt.Errorf("missing maintenance command: start, status or end")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client := newServiceClient(host, port)
+
+	switch args[0] {
+	case "start":
+		reason := strings.Join(args[1:], " ")
+		if strings.TrimSpace(reason) == "" {
+			return "", fmt.Errorf("maintenance start needs a reason, e.g. plccli maintenance start \"replace drive of conveyor 3\"")
+		}
+		window, err := client.StartMaintenance(ctx, reason, maintenanceDuration)
+		if err != nil {
+			return "", err
+		}
+		return formatMaintenance(&window, time.Now()) + fmt.Sprintf(" (via %s:%d)", host, port), nil
+
+	case "status":
+		window, err := client.Maintenance(ctx)
+		if err != nil {
+			return "", err
+		}
+		return formatMaintenance(window, time.Now()), nil
+
+	case "end":
+		if err := client.EndMaintenance(ctx); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Maintenance ended (via %s:%d)", host, port), nil
+	}
+	return "", fmt.Errorf("unknown maintenance command %s, expected start, status or end", args[0])
+}
+
+// formatMaintenance describes a maintenance window, or its absence
+func formatMaintenance(window *Maintenance, now time.Time) string {
+	if window == nil {
+		return "Not under maintenance"
+	}
+	line := fmt.Sprintf("Under maintenance since %s", window.Since.Local().Format(time.RFC3339))
+	if window.Until != nil {
+		line += fmt.Sprintf(", %s left", window.Until.Sub(now).Round(time.Second))
+	} else {
+		line += ", until ended"
+	}
+	if window.Tenant != "" {
+		line += ", started by " + window.Tenant
+	}
+	return line + ": " + window.Reason
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+
+	"umicli/pkg/plcclient"
+)
+
+// analogMetadata is the unit and range of an analog item, from its
+// EngineeringUnits and EURange properties. Both are optional
+type analogMetadata struct {
+	unit    string
+	euRange *plcclient.EURange
+}
+
+// metadataCache remembers the metadata of each node read with
+// --with-metadata, so its properties are only browsed and read once
+type metadataCache struct {
+	mu    sync.Mutex
+	nodes map[string]analogMetadata
+}
+
+// Global metadata cache for service mode
+var serviceMetadata = newMetadataCache()
+
+func newMetadataCache() *metadataCache {
+	return &metadataCache{nodes: make(map[string]analogMetadata)}
+}
+
+// get returns the metadata of a node, reading its properties the first time
+func (c *metadataCache) get(ctx context.Context, client *opcua.Client, nodeID *ua.NodeID) (analogMetadata, error) {
+	key := nodeID.String()
+	c.mu.Lock()
+	meta, cached := c.nodes[key]
+	c.mu.Unlock()
+	if cached {
+		return meta, nil
+	}
+
+	meta, err := readAnalogMetadata(ctx, client, nodeID)
+	if err != nil {
+		return analogMetadata{}, err
+	}
+
+	c.mu.Lock()
+	c.nodes[key] = meta
+	c.mu.Unlock()
+	return meta, nil
+}
+
+// readAnalogMetadata reads the EngineeringUnits and EURange properties of a
+// node. Nodes without them, e.g. no AnalogItemType, have empty metadata
+func readAnalogMetadata(ctx context.Context, client *opcua.Client, nodeID *ua.NodeID) (analogMetadata, error) {
+	var meta analogMetadata
+	props, err := client.Node(nodeID).ReferencedNodes(ctx, id.HasProperty, ua.BrowseDirectionForward, ua.NodeClassVariable, true)
+	if err != nil {
+		return meta, fmt.Errorf("failed to browse properties of %s: %v", nodeID, err)
+	}
+
+	for _, prop := range props {
+		browseName, err := prop.BrowseName(ctx)
+		if err != nil {
+			return meta, fmt.Errorf("failed to read property name of %s: %v", nodeID, err)
+		}
+		if browseName.Name != "EngineeringUnits" && browseName.Name != "EURange" {
+			continue
+		}
+
+		value, err := prop.Value(ctx)
+		if err != nil {
+			return meta, fmt.Errorf("failed to read %s of %s: %v", browseName.Name, nodeID, err)
+		}
+		if browseName.Name == "EngineeringUnits" {
+			meta.unit = parseEngineeringUnits(value.Value())
+		} else {
+			meta.euRange = parseEURange(value.Value())
+		}
+	}
+	return meta, nil
+}
+
+// parseEngineeringUnits returns the unit of an EngineeringUnits property
+// value: the display name of its EUInformation, e.g. °C
+func parseEngineeringUnits(value interface{}) string {
+	if eo, ok := value.(*ua.ExtensionObject); ok && eo != nil {
+		value = eo.Value
+	}
+	info, ok := value.(*ua.EUInformation)
+	if !ok || info == nil {
+		return ""
+	}
+	if info.DisplayName != nil && info.DisplayName.Text != "" {
+		return info.DisplayName.Text
+	}
+	if info.Description != nil {
+		return info.Description.Text
+	}
+	return ""
+}
+
+// parseEURange returns the limits of an EURange property value
+func parseEURange(value interface{}) *plcclient.EURange {
+	if eo, ok := value.(*ua.ExtensionObject); ok && eo != nil {
+		value = eo.Value
+	}
+	r, ok := value.(*ua.Range)
+	if !ok || r == nil {
+		return nil
+	}
+	return &plcclient.EURange{Low: r.Low, High: r.High}
+}
+
+// setResponseMetadata adds the unit and range of an analog item to a read
+// response. Failing lookups leave the response alone
+func setResponseMetadata(ctx context.Context, client *opcua.Client, nodeID *ua.NodeID, response *NodeResponse) {
+	meta, err := serviceMetadata.get(ctx, client, nodeID)
+	if err != nil {
+		if isVerbose {
+			log.Printf("[%s] Metadata lookup of %v failed: %v", connectionName, nodeID, err)
+		}
+		return
+	}
+	response.Unit = meta.unit
+	response.EURange = meta.euRange
+}
+
+// metadataTags returns the InfluxDB tags of the unit and range of a read
+// result: unit, eu_low and eu_high
+func metadataTags(result NodeResponse) []influxTag {
+	var tags []influxTag
+	if result.Unit != "" {
+		tags = append(tags, influxTag{"unit", result.Unit})
+	}
+	if result.EURange != nil {
+		tags = append(tags,
+			influxTag{"eu_low", strconv.FormatFloat(result.EURange.Low, 'g', -1, 64)},
+			influxTag{"eu_high", strconv.FormatFloat(result.EURange.High, 'g', -1, 64)})
+	}
+	return tags
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+
+	"umicli/pkg/plcclient"
+)
+
+// TestParseAnalogMetadata tests reading the unit and range from the values
+// of the EngineeringUnits and EURange properties
+func TestParseAnalogMetadata(t *testing.T) {
+	celsius := &ua.EUInformation{
+		NamespaceURI: "http://www.opcfoundation.org/UA/units/un/cefact",
+		UnitID:       4408652,
+		DisplayName:  ua.NewLocalizedText("°C"),
+		Description:  ua.NewLocalizedText("degree Celsius"),
+	}
+	assert.Equal(t, "°C", parseEngineeringUnits(ua.NewExtensionObject(celsius)))
+	assert.Equal(t, "°C", parseEngineeringUnits(celsius))
+	assert.Equal(t, "degree Celsius", parseEngineeringUnits(&ua.EUInformation{Description: ua.NewLocalizedText("degree Celsius")}))
+	assert.Equal(t, "", parseEngineeringUnits("°C"))
+	assert.Equal(t, "", parseEngineeringUnits(nil))
+
+	assert.Equal(t, &plcclient.EURange{Low: -20, High: 150}, parseEURange(ua.NewExtensionObject(&ua.Range{Low: -20, High: 150})))
+	assert.Nil(t, parseEURange(ua.NewExtensionObject(celsius)))
+	assert.Nil(t, parseEURange(nil))
+}
+
+// TestMetadataOutput tests the unit and range in the default output and as
+// InfluxDB tags
+func TestMetadataOutput(t *testing.T) {
+	result := NodeResponse{NodeID: "ns=3;s=Oven.Temp", Value: 21.5, Unit: "°C", EURange: &plcclient.EURange{Low: 0, High: 250.5}}
+	assert.Equal(t, "21.5 °C", formatDefaultValue(result))
+	assert.Equal(t, "21.5", formatDefaultValue(NodeResponse{Value: 21.5}))
+
+	opts := influxOptions{tags: []influxTag{{"site", "plant1"}}}.forResult(result)
+	assert.Equal(t, []influxTag{{"unit", "°C"}, {"eu_low", "0"}, {"eu_high", "250.5"}, {"site", "plant1"}}, opts.tags)
+	lines := formatInfluxLines("opcua_node", "ns=3;s=Oven.Temp", 21.5, "opc.tcp://plc:4840", opts)
+	assert.Contains(t, lines[0], ",unit=°C,eu_low=0,eu_high=250.5,site=plant1 value=21.5 ")
+
+	assert.Empty(t, metadataTags(NodeResponse{Value: 1}))
+}
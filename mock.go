@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/server"
+	"github.com/gopcua/opcua/ua"
+	"github.com/gopcua/opcua/uasc"
+)
+
+// Namespace of the simulated variables of a --mock service
+const mockNamespaceURI = "urn:plccli:mock"
+
+// mockVariable is a variable of the simulated address space
+type mockVariable struct {
+	name        string
+	dataType    uint32 // built-in data type, e.g. id.Double
+	value       interface{}
+	description string
+}
+
+// The simulated address space, the same variables as the integration test
+// servers of pkg/opcuatest so scripts work against both
+var mockVariables = []mockVariable{
+	{"Temperature", id.Double, 21.5, "Simulated temperature, drifts around 21.5"},
+	{"Setpoint", id.Float, float32(0), "Writable setpoint"},
+	{"Running", id.Boolean, true, "Writable run flag"},
+	{"Alarms", id.UInt16, uint16(0x0081), "Alarm word, bits 0 and 7 set"},
+	{"Counter", id.Int32, int32(0), "Incremented every second"},
+	{"Name", id.String, "press-1", "Writable machine name"},
+}
+
+// Nodes per read and write request of the simulated PLC. The embedded
+// server announces 32 for reads, writes and browses get the same limit.
+// Bigger requests fail with BadTooManyOperations like on a PLC
+const mockMaxNodesPerRequest = 32
+
+// Subscription limits the simulated PLC announces, small like on a PLC
+const (
+	mockMaxSubscriptionsPerSession = 2
+	mockMaxMonitoredItemsPerCall   = 16
+)
+
+// mockServer is an in-process OPC UA server on the loopback interface. A
+// --mock service connects to it like to a PLC, so every API request takes
+// the same code path as in production
+type mockServer struct {
+	srv      *server.Server
+	ns       *server.NodeNameSpace
+	endpoint string
+
+	// Values are changed by the simulation while requests read them, the
+	// server's nodes do not lock
+	mu sync.Mutex
+}
+
+// startMockServer starts the simulated PLC on a free loopback port. It runs
+// until the context is cancelled
+func startMockServer(ctx context.Context) (*mockServer, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to find a free port: %v", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	m := &mockServer{endpoint: fmt.Sprintf("opc.tcp://127.0.0.1:%d", port)}
+	m.srv = server.New(
+		server.EndPoint("127.0.0.1", port),
+		server.EnableSecurity("None", ua.MessageSecurityModeNone),
+		server.EnableAuthMode(ua.UserTokenTypeAnonymous),
+		server.ServerName("plccli mock"),
+	)
+	// Handlers registered before Start replace the built-in ones, see read
+	// and write
+	m.srv.RegisterHandler(id.ReadRequest_Encoding_DefaultBinary, m.read)
+	m.srv.RegisterHandler(id.WriteRequest_Encoding_DefaultBinary, m.write)
+
+	m.ns = server.NewNodeNameSpace(m.srv, mockNamespaceURI)
+	for _, v := range mockVariables {
+		m.ns.Objects().AddRef(m.ns.AddNode(mockVariableNode(m.ns.ID(), v)), server.RefTypeIDHasComponent, true)
+	}
+	root, err := m.srv.Namespace(0)
+	if err != nil {
+		return nil, err
+	}
+	root.Objects().AddRef(m.ns.Objects(), server.RefTypeIDOrganizes, true)
+	for _, limit := range []uint32{
+		id.Server_ServerCapabilities_OperationLimits_MaxNodesPerWrite,
+		id.Server_ServerCapabilities_OperationLimits_MaxNodesPerBrowse,
+	} {
+		root.AddNode(server.NewNode(
+			ua.NewNumericNodeID(0, limit),
+			server.Attributes{ua.AttributeIDNodeClass: server.DataValueFromValue(uint32(ua.NodeClassVariable))},
+			nil,
+			func() *ua.DataValue { return mockValue(uint32(mockMaxNodesPerRequest)) },
+		))
+	}
+	for limit, v := range map[uint32]uint32{
+		id.Server_ServerCapabilities_MaxSubscriptionsPerSession:               mockMaxSubscriptionsPerSession,
+		id.Server_ServerCapabilities_OperationLimits_MaxMonitoredItemsPerCall: mockMaxMonitoredItemsPerCall,
+	} {
+		root.AddNode(server.NewNode(
+			ua.NewNumericNodeID(0, limit),
+			server.Attributes{ua.AttributeIDNodeClass: server.DataValueFromValue(uint32(ua.NodeClassVariable))},
+			nil,
+			func() *ua.DataValue { return mockValue(v) },
+		))
+	}
+
+	if err := m.srv.Start(ctx); err != nil {
+		return nil, fmt.Errorf("failed to start the mock server: %v", err)
+	}
+	go func() {
+		<-ctx.Done()
+		m.srv.Close()
+	}()
+	go m.simulate(ctx)
+	return m, nil
+}
+
+// mockVariableNode builds a writable scalar variable
+func mockVariableNode(ns uint16, v mockVariable) *server.Node {
+	access := server.DataValueFromValue(byte(ua.AccessLevelTypeCurrentRead | ua.AccessLevelTypeCurrentWrite))
+	return server.NewNode(
+		ua.NewStringNodeID(ns, v.name),
+		server.Attributes{
+			ua.AttributeIDNodeClass:       server.DataValueFromValue(uint32(ua.NodeClassVariable)),
+			ua.AttributeIDBrowseName:      server.DataValueFromValue(&ua.QualifiedName{NamespaceIndex: ns, Name: v.name}),
+			ua.AttributeIDDisplayName:     server.DataValueFromValue(ua.NewLocalizedText(v.name)),
+			ua.AttributeIDDescription:     server.DataValueFromValue(ua.NewLocalizedText(v.description)),
+			ua.AttributeIDDataType:        server.DataValueFromValue(ua.NewExpandedNodeID(ua.NewNumericNodeID(0, v.dataType), "", 0)),
+			ua.AttributeIDValueRank:       server.DataValueFromValue(int32(-1)),
+			ua.AttributeIDAccessLevel:     access,
+			ua.AttributeIDUserAccessLevel: access,
+		},
+		nil,
+		func() *ua.DataValue { return mockValue(v.value) },
+	)
+}
+
+// mockValue returns a good value with the current time as its timestamps
+func mockValue(v interface{}) *ua.DataValue {
+	now := time.Now()
+	return &ua.DataValue{
+		EncodingMask:    ua.DataValueValue | ua.DataValueSourceTimestamp | ua.DataValueServerTimestamp,
+		Value:           ua.MustVariant(v),
+		SourceTimestamp: now,
+		ServerTimestamp: now,
+	}
+}
+
+// simulate moves the temperature and counts the counter up, so polls and
+// subscriptions see changes. The server time is announced to its subscribers
+// every second, like a server that samples it
+func (m *mockServer) simulate(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	start := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			// A five minute sine of +-2 degrees
+			phase := 2 * math.Pi * now.Sub(start).Seconds() / 300
+			m.set("Temperature", math.Round((21.5+2*math.Sin(phase))*100)/100)
+			// Count on from a written value
+			if counter, ok := m.get("Counter").(int32); ok {
+				m.set("Counter", counter+1)
+			}
+			m.srv.ChangeNotification(ua.NewNumericNodeID(0, id.Server_ServerStatus_CurrentTime))
+		}
+	}
+}
+
+func (m *mockServer) get(name string) interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := m.ns.Node(ua.NewStringNodeID(m.ns.ID(), name))
+	if n == nil {
+		return nil
+	}
+	dv := n.Value()
+	if dv == nil || dv.Value == nil {
+		return nil
+	}
+	return dv.Value.Value()
+}
+
+// set changes a variable and notifies its subscribers
+func (m *mockServer) set(name string, v interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ns.SetAttribute(ua.NewStringNodeID(m.ns.ID(), name), ua.AttributeIDValue, mockValue(v))
+}
+
+// read serves read requests like the built-in handler, but enforces the
+// operation limit and returns the DataType attribute as a NodeID. The server keeps it as an ExpandedNodeID,
+// which clients cannot map to a data type
+func (m *mockServer) read(sc *uasc.SecureChannel, r ua.Request, reqID uint32) (ua.Response, error) {
+	req, ok := r.(*ua.ReadRequest)
+	if !ok {
+		return nil, ua.StatusBadRequestTypeInvalid
+	}
+	if len(req.NodesToRead) > mockMaxNodesPerRequest {
+		return nil, ua.StatusBadTooManyOperations
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	results := make([]*ua.DataValue, len(req.NodesToRead))
+	for i, n := range req.NodesToRead {
+		ns, err := m.srv.Namespace(int(n.NodeID.Namespace()))
+		if err != nil {
+			results[i] = &ua.DataValue{EncodingMask: ua.DataValueStatusCode, Status: ua.StatusBadNodeIDUnknown}
+			continue
+		}
+		dv := ns.Attribute(n.NodeID, n.AttributeID)
+		if n.AttributeID == ua.AttributeIDDataType && dv.Value != nil {
+			if e, ok := dv.Value.Value().(*ua.ExpandedNodeID); ok {
+				dv = server.DataValueFromValue(e.NodeID)
+			}
+		}
+		results[i] = dv
+	}
+	return &ua.ReadResponse{
+		ResponseHeader: mockResponseHeader(req.RequestHeader),
+		Results:        results,
+	}, nil
+}
+
+// write serves write requests like the built-in handler, but enforces the
+// operation limit, answers unknown namespaces instead of crashing and rejects
+// values of the wrong type like a PLC does
+func (m *mockServer) write(sc *uasc.SecureChannel, r ua.Request, reqID uint32) (ua.Response, error) {
+	req, ok := r.(*ua.WriteRequest)
+	if !ok {
+		return nil, ua.StatusBadRequestTypeInvalid
+	}
+	if len(req.NodesToWrite) > mockMaxNodesPerRequest {
+		return nil, ua.StatusBadTooManyOperations
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	results := make([]ua.StatusCode, len(req.NodesToWrite))
+	for i, n := range req.NodesToWrite {
+		ns, err := m.srv.Namespace(int(n.NodeID.Namespace()))
+		if err != nil {
+			results[i] = ua.StatusBadNodeIDUnknown
+			continue
+		}
+		if n.AttributeID == ua.AttributeIDValue {
+			if status := checkMockWrite(ns.Node(n.NodeID), n.Value); status != ua.StatusOK {
+				results[i] = status
+				continue
+			}
+			value := *n.Value
+			value.SourceTimestamp = time.Now()
+			value.ServerTimestamp = value.SourceTimestamp
+			value.EncodingMask |= ua.DataValueSourceTimestamp | ua.DataValueServerTimestamp
+			n.Value = &value
+		}
+		results[i] = ns.SetAttribute(n.NodeID, n.AttributeID, n.Value)
+	}
+	return &ua.WriteResponse{
+		ResponseHeader: mockResponseHeader(req.RequestHeader),
+		Results:        results,
+	}, nil
+}
+
+// checkMockWrite checks that a written value has the type of the variable
+func checkMockWrite(n *server.Node, value *ua.DataValue) ua.StatusCode {
+	if n == nil {
+		return ua.StatusBadNodeIDUnknown
+	}
+	if value == nil || value.Value == nil {
+		return ua.StatusBadTypeMismatch
+	}
+	current := n.Value()
+	if current == nil || current.Value == nil {
+		return ua.StatusBadNotWritable
+	}
+	if current.Value.Type() != value.Value.Type() || current.Value.ArrayLength() != value.Value.ArrayLength() {
+		return ua.StatusBadTypeMismatch
+	}
+	return ua.StatusOK
+}
+
+func mockResponseHeader(req *ua.RequestHeader) *ua.ResponseHeader {
+	return &ua.ResponseHeader{
+		Timestamp:          time.Now(),
+		RequestHandle:      req.RequestHandle,
+		ServiceResult:      ua.StatusOK,
+		ServiceDiagnostics: &ua.DiagnosticInfo{},
+		StringTable:        []string{},
+		AdditionalHeader:   ua.NewExtensionObject(nil),
+	}
+}
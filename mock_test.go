@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// connectMock starts a simulated PLC and connects the service to it until the
+// test ends
+func connectMock(t *testing.T, ctx context.Context) *opcua.Client {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	// The server outlives the test's context so the session closes cleanly
+	serverCtx, stop := context.WithCancel(context.Background())
+	m, err := startMockServer(serverCtx)
+	require.NoError(t, err)
+	require.NoError(t, connectOPCUA(ctx, m.endpoint, "", "", "cert.pem", "key.pem", false, "", 10))
+	t.Cleanup(func() {
+		closeOPCUA()
+		stop()
+		serviceNamespaces = &namespaceTable{}
+		serviceLimits = &limitsTable{limits: defaultOperationLimits()}
+	})
+	return opcuaClient
+}
+
+// TestMockServer tests reading and writing the simulated PLC through the
+// service's connection code
+func TestMockServer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	client := connectMock(t, ctx)
+
+	temperature, err := resolveNodeID("nsu=" + mockNamespaceURI + ";s=Temperature")
+	require.NoError(t, err)
+	name, err := resolveNodeID("nsu=" + mockNamespaceURI + ";s=Name")
+	require.NoError(t, err)
+
+	values, err := readNodeDataValues(ctx, client, []*ua.NodeID{temperature, name})
+	require.NoError(t, err)
+	require.Len(t, values, 2)
+	assert.InDelta(t, 21.5, values[0].Value.Float(), 2)
+	assert.Equal(t, "press-1", values[1].Value.String())
+
+	dataType, err := readNodeDataType(ctx, client, temperature)
+	require.NoError(t, err)
+	assert.Equal(t, "double", dataType)
+
+	write := func(id *ua.NodeID, v interface{}) ua.StatusCode {
+		resp, err := writeOPCUA(ctx, client, &ua.WriteRequest{
+			NodesToWrite: []*ua.WriteValue{{
+				NodeID:      id,
+				AttributeID: ua.AttributeIDValue,
+				Value:       &ua.DataValue{EncodingMask: ua.DataValueValue, Value: ua.MustVariant(v)},
+			}},
+		})
+		require.NoError(t, err)
+		return resp.Results[0]
+	}
+	assert.Equal(t, ua.StatusOK, write(name, "press-2"))
+	assert.Equal(t, ua.StatusBadTypeMismatch, write(name, int32(2)))
+	assert.Equal(t, ua.StatusBadNodeIDUnknown, write(ua.NewStringNodeID(9, "Name"), "press-3"))
+
+	values, err = readNodeDataValues(ctx, client, []*ua.NodeID{name})
+	require.NoError(t, err)
+	assert.Equal(t, "press-2", values[0].Value.String())
+}
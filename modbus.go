@@ -0,0 +1,528 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Modbus function codes
+const (
+	modbusReadCoils      = 0x01
+	modbusReadDiscrete   = 0x02
+	modbusReadHolding    = 0x03
+	modbusReadInput      = 0x04
+	modbusWriteCoil      = 0x05
+	modbusWriteRegister  = 0x06
+	modbusWriteRegisters = 0x10
+)
+
+const (
+	defaultModbusPort        = "502"
+	defaultModbusMeasurement = "modbus"
+	maxModbusReadRegisters   = 125  // Per read request, by the specification
+	maxModbusReadBits        = 2000 // Per read request, by the specification
+	maxModbusPoints          = 256  // Per API read
+)
+
+// modbusTable is one of the four Modbus data tables
+type modbusTable struct {
+	name     string
+	read     byte
+	bits     bool // Coils and discrete inputs hold bits, the others 16-bit registers
+	writable bool
+}
+
+var modbusTables = []modbusTable{
+	{name: "coil", read: modbusReadCoils, bits: true, writable: true},
+	{name: "discrete", read: modbusReadDiscrete, bits: true},
+	{name: "holding", read: modbusReadHolding, writable: true},
+	{name: "input", read: modbusReadInput},
+}
+
+// Other names of the tables, as in the manuals of devices
+var modbusTableAliases = map[string]string{
+	"coils": "coil", "co": "coil",
+	"discrete-input": "discrete", "discrete-inputs": "discrete", "di": "discrete",
+	"holding-register": "holding", "holding-registers": "holding", "hr": "holding",
+	"input-register": "input", "input-registers": "input", "ir": "input",
+}
+
+// parseModbusTable returns the table of a register type name
+func parseModbusTable(name string) (modbusTable, error) {
+	name = strings.ToLower(name)
+	if alias, ok := modbusTableAliases[name]; ok {
+		name = alias
+	}
+	for _, table := range modbusTables {
+		if table.name == name {
+			return table, nil
+		}
+	}
+	return modbusTable{}, fmt.Errorf("register type must be coil, discrete, holding or input, got %q", name)
+}
+
+// Registers of the data types of register tables. Types ending in -swapped
+// have the low word first (CDAB), as many devices send 32 and 64 bit values
+var modbusTypeWidths = map[string]int{
+	"uint16": 1, "int16": 1,
+	"uint32": 2, "int32": 2, "float32": 2,
+	"uint64": 4, "int64": 4, "float64": 4,
+}
+
+// modbusPoint is a value in a Modbus device: unit/table/address/type, e.g.
+// 1/holding/100/float32. It is the node ID of Modbus connections in results,
+// poll files and InfluxDB lines
+type modbusPoint struct {
+	unit     byte
+	table    modbusTable
+	address  uint16
+	dataType string // bool for coils and discrete inputs, uint16 by default for registers
+}
+
+// parseModbusPoint parses unit/table/address[/type]
+func parseModbusPoint(s string) (modbusPoint, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 3 || len(parts) > 4 {
+		return modbusPoint{}, fmt.Errorf("invalid Modbus point %q, expected unit/register-type/address[/type], e.g. 1/holding/100/float32", s)
+	}
+	dataType := ""
+	if len(parts) == 4 {
+		dataType = parts[3]
+	}
+	return newModbusPoint(parts[0], parts[1], parts[2], dataType)
+}
+
+// isModbusPoint reports whether a node of a poll file is a Modbus point
+// rather than an OPC UA node ID, which always has an = in it
+func isModbusPoint(s string) bool {
+	return strings.Contains(s, "/") && !strings.Contains(s, "=")
+}
+
+// newModbusPoint returns the point of a unit, register type, address and
+// data type as given on the command line
+func newModbusPoint(unit, table, address, dataType string) (modbusPoint, error) {
+	var p modbusPoint
+	u, err := strconv.ParseUint(unit, 10, 8)
+	if err != nil {
+		return p, fmt.Errorf("invalid Modbus unit %q, must be 0-255", unit)
+	}
+	p.unit = byte(u)
+	if p.table, err = parseModbusTable(table); err != nil {
+		return p, err
+	}
+	a, err := strconv.ParseUint(address, 10, 16)
+	if err != nil {
+		return p, fmt.Errorf("invalid Modbus address %q, must be 0-65535", address)
+	}
+	p.address = uint16(a)
+
+	p.dataType = strings.ToLower(dataType)
+	switch {
+	case p.table.bits && (p.dataType == "" || p.dataType == "bool"):
+		p.dataType = "bool"
+	case p.table.bits:
+		return p, fmt.Errorf("%s values are bool, not %s", p.table.name, dataType)
+	case p.dataType == "":
+		p.dataType = "uint16"
+	case modbusTypeWidths[strings.TrimSuffix(p.dataType, "-swapped")] == 0:
+		return p, fmt.Errorf("unknown Modbus data type %q, use uint16, int16, uint32, int32, float32, uint64, int64 or float64 (-swapped for the low word first)", dataType)
+	}
+	if int(p.address)+p.width() > 65536 {
+		return p, fmt.Errorf("a %s at %d does not fit below address 65536", p.dataType, p.address)
+	}
+	return p, nil
+}
+
+// String returns the point as parsed by parseModbusPoint
+func (p modbusPoint) String() string {
+	return fmt.Sprintf("%d/%s/%d/%s", p.unit, p.table.name, p.address, p.dataType)
+}
+
+// width returns the number of bits or registers of the point's value
+func (p modbusPoint) width() int {
+	if p.table.bits {
+		return 1
+	}
+	return modbusTypeWidths[strings.TrimSuffix(p.dataType, "-swapped")]
+}
+
+// next returns the point of the same type right after p, for get with a count
+func (p modbusPoint) next() (modbusPoint, bool) {
+	if int(p.address)+2*p.width() > 65536 {
+		return p, false
+	}
+	p.address += uint16(p.width())
+	return p, true
+}
+
+// decode returns the value of register points from their registers, most
+// significant word first unless the type is -swapped
+func (p modbusPoint) decode(registers []uint16) interface{} {
+	words := append([]uint16(nil), registers...)
+	dataType, swapped := strings.CutSuffix(p.dataType, "-swapped")
+	if swapped {
+		for i, j := 0, len(words)-1; i < j; i, j = i+1, j-1 {
+			words[i], words[j] = words[j], words[i]
+		}
+	}
+	var raw uint64
+	for _, w := range words {
+		raw = raw<<16 | uint64(w)
+	}
+	switch dataType {
+	case "int16":
+		return int16(raw)
+	case "uint32":
+		return uint32(raw)
+	case "int32":
+		return int32(raw)
+	case "float32":
+		return math.Float32frombits(uint32(raw))
+	case "uint64":
+		return raw
+	case "int64":
+		return int64(raw)
+	case "float64":
+		return math.Float64frombits(raw)
+	}
+	return uint16(raw)
+}
+
+// encode returns the registers of a value for a register point
+func (p modbusPoint) encode(value string) ([]uint16, error) {
+	dataType, swapped := strings.CutSuffix(p.dataType, "-swapped")
+	value = strings.TrimSpace(value)
+	var raw uint64
+	var err error
+	switch dataType {
+	case "uint16", "uint32", "uint64":
+		raw, err = strconv.ParseUint(value, 0, 16*p.width())
+	case "int16", "int32", "int64":
+		var n int64
+		n, err = strconv.ParseInt(value, 0, 16*p.width())
+		raw = uint64(n) & (1<<(16*p.width()) - 1)
+		if p.width() == 4 {
+			raw = uint64(n)
+		}
+	case "float32":
+		var f float64
+		if f, err = parseDecimal(value, 32, *decimalSeparator); err != nil {
+			return nil, fmt.Errorf("invalid %s value: %v", p.dataType, err)
+		}
+		raw = uint64(math.Float32bits(float32(f)))
+	case "float64":
+		var f float64
+		if f, err = parseDecimal(value, 64, *decimalSeparator); err != nil {
+			return nil, fmt.Errorf("invalid %s value: %v", p.dataType, err)
+		}
+		raw = math.Float64bits(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s value %q", p.dataType, value)
+	}
+	words := make([]uint16, p.width())
+	for i := range words {
+		words[len(words)-1-i] = uint16(raw >> (16 * i))
+	}
+	if swapped {
+		for i, j := 0, len(words)-1; i < j; i, j = i+1, j-1 {
+			words[i], words[j] = words[j], words[i]
+		}
+	}
+	return words, nil
+}
+
+// parseModbusBool parses the value of a coil
+func parseModbusBool(value string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "true", "on":
+		return true, nil
+	case "0", "false", "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid coil value %q, use 0 or 1", value)
+}
+
+// modbusRead is one read request covering neighbouring points of a unit and
+// table
+type modbusRead struct {
+	unit   byte
+	table  modbusTable
+	start  uint16
+	count  int
+	points []int // Positions of the points in the request
+}
+
+// planModbusReads groups points into as few read requests as the
+// specification allows: points of the same unit and table whose values
+// touch or overlap share a request
+func planModbusReads(points []modbusPoint) []modbusRead {
+	var reads []modbusRead
+	open := make(map[string]int) // Last read by unit and table
+	for i, p := range points {
+		key := fmt.Sprintf("%d/%s", p.unit, p.table.name)
+		limit := maxModbusReadRegisters
+		if p.table.bits {
+			limit = maxModbusReadBits
+		}
+		if j, ok := open[key]; ok {
+			r := &reads[j]
+			end := max(int(r.start)+r.count, int(p.address)+p.width())
+			if int(p.address) >= int(r.start) && int(p.address) <= int(r.start)+r.count && end-int(r.start) <= limit {
+				r.count = end - int(r.start)
+				r.points = append(r.points, i)
+				continue
+			}
+		}
+		open[key] = len(reads)
+		reads = append(reads, modbusRead{unit: p.unit, table: p.table, start: p.address, count: p.width(), points: []int{i}})
+	}
+	return reads
+}
+
+// modbusException is an exception response of a device
+type modbusException struct {
+	function byte
+	code     byte
+}
+
+var modbusExceptionNames = map[byte]string{
+	1: "illegal function", 2: "illegal data address", 3: "illegal data value",
+	4: "server device failure", 6: "server device busy",
+	10: "gateway path unavailable", 11: "gateway target device failed to respond",
+}
+
+func (e *modbusException) Error() string {
+	name := modbusExceptionNames[e.code]
+	if name == "" {
+		name = "unknown exception"
+	}
+	return fmt.Sprintf("Modbus exception %d (%s) for function %d", e.code, name, e.function)
+}
+
+// modbusClient talks Modbus TCP to a device or gateway. Requests are sent
+// one at a time on one connection, which is opened again after an error
+type modbusClient struct {
+	address string // host:port
+	timeout time.Duration
+	mu      sync.Mutex
+	conn    net.Conn
+	txID    uint16
+}
+
+// newModbusClient returns a client of a modbus://host[:port] endpoint
+func newModbusClient(endpoint string, timeout time.Duration) (*modbusClient, error) {
+	address, err := modbusAddress(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &modbusClient{address: address, timeout: timeout}, nil
+}
+
+// isModbusEndpoint reports whether an endpoint is a Modbus TCP device
+func isModbusEndpoint(endpoint string) bool {
+	return strings.HasPrefix(endpoint, "modbus://") || strings.HasPrefix(endpoint, "modbus+tcp://")
+}
+
+// modbusAddress returns host:port of a modbus:// endpoint
+func modbusAddress(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || !isModbusEndpoint(endpoint) || u.Hostname() == "" {
+		return "", fmt.Errorf("invalid Modbus endpoint %q, expected modbus://host[:port]", endpoint)
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultModbusPort
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// close closes the connection, the next request opens a new one
+func (c *modbusClient) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// do sends a request PDU to a unit and returns the response PDU without the
+// function code
+func (c *modbusClient) do(unit byte, pdu []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+	resp, err := c.exchange(unit, pdu)
+	var exception *modbusException
+	if err != nil && !errors.As(err, &exception) {
+		// The stream may be out of step, start over with a new connection
+		c.conn.Close()
+		c.conn = nil
+	}
+	return resp, err
+}
+
+// connect opens the connection unless it is open. Callers must hold c.mu
+func (c *modbusClient) connect() error {
+	if c.conn != nil {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", c.address, c.timeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to Modbus device %s: %v", c.address, err)
+	}
+	c.conn = conn
+	return nil
+}
+
+// exchange writes one request and reads its response. Callers must hold c.mu
+func (c *modbusClient) exchange(unit byte, pdu []byte) ([]byte, error) {
+	c.txID++
+	frame := make([]byte, 7, 7+len(pdu))
+	binary.BigEndian.PutUint16(frame[0:], c.txID)
+	binary.BigEndian.PutUint16(frame[4:], uint16(len(pdu)+1))
+	frame[6] = unit
+	frame = append(frame, pdu...)
+
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := c.conn.Write(frame); err != nil {
+		return nil, fmt.Errorf("Modbus request failed: %v", err)
+	}
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		return nil, fmt.Errorf("Modbus response failed: %v", err)
+	}
+	length := int(binary.BigEndian.Uint16(header[4:]))
+	if length < 2 || length > 254 {
+		return nil, fmt.Errorf("invalid Modbus response length %d", length)
+	}
+	resp := make([]byte, length-1)
+	if _, err := io.ReadFull(c.conn, resp); err != nil {
+		return nil, fmt.Errorf("Modbus response failed: %v", err)
+	}
+	if txID := binary.BigEndian.Uint16(header[0:]); txID != c.txID {
+		return nil, fmt.Errorf("Modbus response to transaction %d, expected %d", txID, c.txID)
+	}
+	if resp[0] == pdu[0]|0x80 {
+		if len(resp) < 2 {
+			return nil, fmt.Errorf("truncated Modbus exception response")
+		}
+		return nil, &modbusException{function: pdu[0], code: resp[1]}
+	}
+	if resp[0] != pdu[0] {
+		return nil, fmt.Errorf("Modbus response with function %d to function %d", resp[0], pdu[0])
+	}
+	return resp[1:], nil
+}
+
+// read executes a planned read and returns the bits (as 0/1) or registers
+func (c *modbusClient) read(r modbusRead) ([]uint16, error) {
+	pdu := []byte{r.table.read, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(pdu[1:], r.start)
+	binary.BigEndian.PutUint16(pdu[3:], uint16(r.count))
+	resp, err := c.do(r.unit, pdu)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 1 || int(resp[0]) != len(resp)-1 {
+		return nil, fmt.Errorf("invalid Modbus read response")
+	}
+	data := resp[1:]
+	values := make([]uint16, r.count)
+	if r.table.bits {
+		if len(data) < (r.count+7)/8 {
+			return nil, fmt.Errorf("Modbus read response with %d bytes for %d bits", len(data), r.count)
+		}
+		for i := range values {
+			values[i] = uint16(data[i/8] >> (i % 8) & 1)
+		}
+		return values, nil
+	}
+	if len(data) != 2*r.count {
+		return nil, fmt.Errorf("Modbus read response with %d bytes for %d registers", len(data), r.count)
+	}
+	for i := range values {
+		values[i] = binary.BigEndian.Uint16(data[2*i:])
+	}
+	return values, nil
+}
+
+// readPoints reads the values of points with as few requests as possible.
+// Results are in the order of the points, failed requests are reported per
+// point
+func (c *modbusClient) readPoints(points []modbusPoint) []NodeResponse {
+	results := make([]NodeResponse, len(points))
+	for i, p := range points {
+		results[i].NodeID = p.String()
+	}
+	for _, r := range planModbusReads(points) {
+		values, err := c.read(r)
+		for _, i := range r.points {
+			if err != nil {
+				results[i].Error = fmt.Sprintf("Failed to read point: %v", err)
+				continue
+			}
+			p := points[i]
+			offset := int(p.address - r.start)
+			if p.table.bits {
+				results[i].Value = values[offset] == 1
+			} else {
+				results[i].Value = p.decode(values[offset : offset+p.width()])
+			}
+		}
+	}
+	return results
+}
+
+// write writes a value to a coil or holding register point
+func (c *modbusClient) write(p modbusPoint, value string) error {
+	if !p.table.writable {
+		return fmt.Errorf("%s points are read-only, only coils and holding registers can be written", p.table.name)
+	}
+	var pdu []byte
+	switch {
+	case p.table.bits:
+		on, err := parseModbusBool(value)
+		if err != nil {
+			return err
+		}
+		pdu = []byte{modbusWriteCoil, 0, 0, 0, 0}
+		binary.BigEndian.PutUint16(pdu[1:], p.address)
+		if on {
+			pdu[3] = 0xFF
+		}
+	default:
+		words, err := p.encode(value)
+		if err != nil {
+			return err
+		}
+		if len(words) == 1 {
+			pdu = []byte{modbusWriteRegister, 0, 0, 0, 0}
+			binary.BigEndian.PutUint16(pdu[1:], p.address)
+			binary.BigEndian.PutUint16(pdu[3:], words[0])
+			break
+		}
+		pdu = make([]byte, 6, 6+2*len(words))
+		pdu[0] = modbusWriteRegisters
+		binary.BigEndian.PutUint16(pdu[1:], p.address)
+		binary.BigEndian.PutUint16(pdu[3:], uint16(len(words)))
+		pdu[5] = byte(2 * len(words))
+		for _, w := range words {
+			pdu = binary.BigEndian.AppendUint16(pdu, w)
+		}
+	}
+	_, err := c.do(p.unit, pdu)
+	return err
+}
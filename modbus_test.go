@@ -0,0 +1,332 @@
+//go:build !minimal && !nomodbus
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeModbusDevice is a Modbus TCP server with the four tables of unit 1.
+// Other units answer with a gateway exception
+type fakeModbusDevice struct {
+	mu       sync.Mutex
+	coils    [65536]bool
+	discrete [65536]bool
+	holding  [65536]uint16
+	input    [65536]uint16
+	requests int
+}
+
+func startFakeModbusDevice(t *testing.T) (*fakeModbusDevice, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	d := &fakeModbusDevice{}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+	return d, "modbus://" + listener.Addr().String()
+}
+
+func (d *fakeModbusDevice) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		header := make([]byte, 7)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		pdu := make([]byte, binary.BigEndian.Uint16(header[4:])-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return
+		}
+		resp := d.handle(header[6], pdu)
+		binary.BigEndian.PutUint16(header[4:], uint16(len(resp)+1))
+		conn.Write(append(header, resp...))
+	}
+}
+
+func (d *fakeModbusDevice) handle(unit byte, pdu []byte) []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.requests++
+	fc := pdu[0]
+	if unit != 1 {
+		return []byte{fc | 0x80, 11}
+	}
+	addr := int(binary.BigEndian.Uint16(pdu[1:]))
+	arg := binary.BigEndian.Uint16(pdu[3:])
+	switch fc {
+	case modbusReadCoils, modbusReadDiscrete:
+		bits := d.coils[:]
+		if fc == modbusReadDiscrete {
+			bits = d.discrete[:]
+		}
+		data := make([]byte, (int(arg)+7)/8)
+		for i := 0; i < int(arg); i++ {
+			if bits[addr+i] {
+				data[i/8] |= 1 << (i % 8)
+			}
+		}
+		return append([]byte{fc, byte(len(data))}, data...)
+	case modbusReadHolding, modbusReadInput:
+		registers := d.holding[:]
+		if fc == modbusReadInput {
+			registers = d.input[:]
+		}
+		resp := []byte{fc, byte(2 * arg)}
+		for i := 0; i < int(arg); i++ {
+			resp = binary.BigEndian.AppendUint16(resp, registers[addr+i])
+		}
+		return resp
+	case modbusWriteCoil:
+		d.coils[addr] = arg == 0xFF00
+		return pdu
+	case modbusWriteRegister:
+		d.holding[addr] = arg
+		return pdu
+	case modbusWriteRegisters:
+		for i := 0; i < int(arg); i++ {
+			d.holding[addr+i] = binary.BigEndian.Uint16(pdu[6+2*i:])
+		}
+		return pdu[:5]
+	}
+	return []byte{fc | 0x80, 1}
+}
+
+// TestModbusPoint tests parsing points and the register encoding of the
+// data types, with both word orders
+func TestModbusPoint(t *testing.T) {
+	p, err := parseModbusPoint("1/hr/100/Float32-Swapped")
+	require.NoError(t, err)
+	assert.Equal(t, "1/holding/100/float32-swapped", p.String())
+	assert.Equal(t, 2, p.width())
+
+	p, err = parseModbusPoint("2/coil/7")
+	require.NoError(t, err)
+	assert.Equal(t, "2/coil/7/bool", p.String())
+	p, err = parseModbusPoint("1/input/3")
+	require.NoError(t, err)
+	assert.Equal(t, "1/input/3/uint16", p.String())
+
+	for _, bad := range []string{"1/holding", "256/holding/0", "1/memory/0", "1/holding/70000", "1/coil/0/int16", "1/holding/0/int8", "1/holding/65535/int32"} {
+		_, err := parseModbusPoint(bad)
+		assert.Error(t, err, bad)
+	}
+
+	assert.True(t, isModbusPoint("1/holding/100"))
+	assert.False(t, isModbusPoint("ns=3;s=Line/Speed"))
+
+	for _, tc := range []struct {
+		dataType, value string
+		registers       []uint16
+		decoded         interface{}
+	}{
+		{"uint16", "65535", []uint16{0xFFFF}, uint16(65535)},
+		{"int16", "-2", []uint16{0xFFFE}, int16(-2)},
+		{"int32", "-2", []uint16{0xFFFF, 0xFFFE}, int32(-2)},
+		{"uint32", "0x12345678", []uint16{0x1234, 0x5678}, uint32(0x12345678)},
+		{"float32", "1.5", []uint16{0x3FC0, 0x0000}, float32(1.5)},
+		{"float32-swapped", "1.5", []uint16{0x0000, 0x3FC0}, float32(1.5)},
+		{"float32", "1,5", []uint16{0x3FC0, 0x0000}, float32(1.5)},
+		{"int64", "-1", []uint16{0xFFFF, 0xFFFF, 0xFFFF, 0xFFFF}, int64(-1)},
+		{"float64", "2", []uint16{0x4000, 0, 0, 0}, float64(2)},
+	} {
+		p, err := newModbusPoint("1", "holding", "0", tc.dataType)
+		require.NoError(t, err)
+		registers, err := p.encode(tc.value)
+		require.NoError(t, err, tc.dataType)
+		assert.Equal(t, tc.registers, registers, tc.dataType)
+		assert.Equal(t, tc.decoded, p.decode(tc.registers), tc.dataType)
+	}
+	p, _ = newModbusPoint("1", "holding", "0", "int16")
+	_, err = p.encode("40000")
+	assert.Error(t, err)
+	p, _ = newModbusPoint("1", "holding", "0", "float32")
+	_, err = p.encode("1,500")
+	assert.ErrorContains(t, err, "invalid float32 value: \"1,500\" is ambiguous")
+}
+
+// TestPlanModbusReads tests that neighbouring points share a request within
+// the limits of the specification
+func TestPlanModbusReads(t *testing.T) {
+	var points []modbusPoint
+	for _, s := range []string{"1/holding/0/float32", "1/holding/2", "1/coil/5", "1/holding/3/uint32", "2/holding/4", "1/holding/200", "1/coil/6"} {
+		p, err := parseModbusPoint(s)
+		require.NoError(t, err)
+		points = append(points, p)
+	}
+	reads := planModbusReads(points)
+	require.Len(t, reads, 4)
+	assert.Equal(t, modbusRead{unit: 1, table: points[0].table, start: 0, count: 5, points: []int{0, 1, 3}}, reads[0])
+	assert.Equal(t, []int{2, 6}, reads[1].points)
+	assert.Equal(t, 2, reads[1].count)
+	assert.Equal(t, byte(2), reads[2].unit)
+	assert.Equal(t, uint16(200), reads[3].start)
+
+	// Requests stay within the limits of the specification
+	p, _ := parseModbusPoint("1/input/0")
+	points = nil
+	for i := 0; i < 130; i++ {
+		points = append(points, p)
+		p, _ = p.next()
+	}
+	reads = planModbusReads(points)
+	require.Len(t, reads, 2)
+	assert.Equal(t, maxModbusReadRegisters, reads[0].count)
+}
+
+// TestModbusClient tests writes and merged reads against a device, and that
+// the client recovers from a broken connection
+func TestModbusClient(t *testing.T) {
+	device, endpoint := startFakeModbusDevice(t)
+	client, err := newModbusClient(endpoint, 2*time.Second)
+	require.NoError(t, err)
+	defer client.close()
+
+	write := func(point, value string) error {
+		p, err := parseModbusPoint(point)
+		require.NoError(t, err)
+		return client.write(p, value)
+	}
+	require.NoError(t, write("1/holding/10/float32", "21.5"))
+	require.NoError(t, write("1/holding/12/int16", "-7"))
+	require.NoError(t, write("1/coil/3", "1"))
+	assert.True(t, device.coils[3])
+	device.input[0] = 0x0F0F
+	assert.ErrorContains(t, write("1/input/0", "1"), "read-only")
+	assert.ErrorContains(t, write("1/coil/3", "maybe"), "invalid coil value")
+
+	var points []modbusPoint
+	for _, s := range []string{"1/holding/10/float32", "1/holding/12/int16", "1/coil/3", "1/coil/4", "1/input/0", "9/holding/0"} {
+		p, err := parseModbusPoint(s)
+		require.NoError(t, err)
+		points = append(points, p)
+	}
+	device.requests = 0
+	results := client.readPoints(points)
+	assert.Equal(t, 4, device.requests, "one request per unit and table")
+	require.Len(t, results, 6)
+	assert.Equal(t, float32(21.5), results[0].Value)
+	assert.Equal(t, int16(-7), results[1].Value)
+	assert.Equal(t, true, results[2].Value)
+	assert.Equal(t, false, results[3].Value)
+	assert.Equal(t, uint16(0x0F0F), results[4].Value)
+	assert.Equal(t, "9/holding/0/uint16", results[5].NodeID)
+	assert.Contains(t, results[5].Error, "gateway target device failed to respond")
+
+	// The connection is kept after exceptions and opened again after errors
+	client.conn.Close()
+	results = client.readPoints(points[:1])
+	assert.Contains(t, results[0].Error, "Failed to read point")
+	results = client.readPoints(points[:1])
+	assert.Empty(t, results[0].Error)
+}
+
+// TestModbusAPI tests /api/modbus and the sampling of Modbus points of a
+// poll file
+func TestModbusAPI(t *testing.T) {
+	device, endpoint := startFakeModbusDevice(t)
+	client, err := newModbusClient(endpoint, 2*time.Second)
+	require.NoError(t, err)
+	defer client.close()
+	defer func() { serviceModbus, serviceBackend = nil, nil }()
+	b := &modbusBackend{client: client}
+	serviceBackend = b
+
+	mux := http.NewServeMux()
+	b.api(endpoint).registerAll(mux, 8765)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/api/modbus", "application/json", strings.NewReader(`{"point": "1/holding/5/int32", "value": "-100000"}`))
+	require.NoError(t, err)
+	var written NodeResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&written))
+	resp.Body.Close()
+	assert.Empty(t, written.Error)
+	assert.Equal(t, "1/holding/5/int32", written.NodeID)
+	assert.Equal(t, []uint16{0xFFFE, 0x7960}, device.holding[5:7])
+
+	query := url.Values{"point": {"1/holding/5/int32", "1/hr/6"}}
+	resp, err = http.Get(server.URL + "/api/modbus?" + query.Encode())
+	require.NoError(t, err)
+	var read struct {
+		Results []NodeResponse `json:"results"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&read))
+	resp.Body.Close()
+	require.Len(t, read.Results, 2)
+	assert.Equal(t, -100000.0, read.Results[0].Value)
+	assert.Equal(t, 0x7960*1.0, read.Results[1].Value)
+	assert.NotNil(t, read.Results[0].SourceTimestamp)
+
+	resp, err = http.Get(server.URL + "/api/modbus?point=1/holding")
+	require.NoError(t, err)
+	var failed map[string]string
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&failed))
+	resp.Body.Close()
+	assert.Contains(t, failed["error"], "invalid Modbus point")
+
+	// Poll files sample Modbus points with the modbus measurement
+	path := filepath.Join(t.TempDir(), "polls.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("polls:\n  - node: 1/hr/5/int32\n    interval: 1s\n"), 0644))
+	pf, err := loadPollFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "1/holding/5/int32", pf.Polls[0].Node)
+	assert.Equal(t, "modbus", pf.Polls[0].Measurement)
+	results := readBackendSample(t.Context(), []string{pf.Polls[0].Node}, false)
+	assert.Equal(t, int32(-100000), results[0].Value)
+	assert.NotNil(t, results[0].SourceTimestamp)
+	results = readBackendSample(t.Context(), []string{"1/holding"}, false)
+	assert.Contains(t, results[0].Error, "invalid Modbus point")
+
+	// Types are part of Modbus points, a write through the backend API may
+	// only repeat them
+	_, err = b.Write(t.Context(), "1/holding/5/int32", "7", "float32")
+	assert.ErrorContains(t, err, "part of the point")
+}
+
+// TestModbusGetPoints tests the points of the modbus get arguments
+func TestModbusGetPoints(t *testing.T) {
+	points, err := modbusGetPoints([]string{"1", "holding", "100", "3", "float32"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1/holding/100/float32", "1/holding/102/float32", "1/holding/104/float32"}, points)
+
+	points, err = modbusGetPoints([]string{"1", "coil", "0", "2"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1/coil/0/bool", "1/coil/1/bool"}, points)
+
+	points, err = modbusGetPoints([]string{"1", "input", "7", "int16"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1/input/7/int16"}, points)
+
+	_, err = modbusGetPoints([]string{"1", "holding", "65535", "2"})
+	assert.Error(t, err)
+	_, err = modbusGetPoints([]string{"1", "holding", "0", "2", "int16", "extra"})
+	assert.Error(t, err)
+
+	// Bits of single registers are 16, of wider types 32
+	assert.Equal(t, map[string]int{"1/input/7/int16": 16, "1/holding/8/uint32-swapped": 32},
+		modbusBitWidths([]string{"1/input/7/int16", "1/holding/8/uint32-swapped", "1/holding/10/float32", "1/coil/0/bool"}))
+}
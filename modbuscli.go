@@ -0,0 +1,148 @@
+//go:build !minimal && !nomodbus
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"umicli/pkg/plcclient"
+)
+
+// runModbusCommand runs modbus get or set against the service of a Modbus
+// connection, or against the device itself with --direct
+func runModbusCommand(args []string, port int, influxOpts influxOptions) {
+	if len(args) < 1 || (args[0] != "get" && args[0] != "set") {
+		printUsage()
+		os.Exit(exitUsage)
+	}
+
+	host, port, influxOpts := deviceService(port, influxOpts)
+	if *direct {
+		defer stopDirect()
+	}
+
+	switch args[0] {
+	case "get":
+		points, err := modbusGetPoints(args[1:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exitWithCode(exitBadNode)
+		}
+		bitOpts := deviceBitOptions()
+		bitOpts.widths = modbusBitWidths(points)
+
+		// The default measurement of OPC UA nodes does not fit Modbus points
+		name := *measurement
+		if name == "opcua_node" {
+			name = defaultModbusMeasurement
+		}
+		if *interval > 0 {
+			pollDeviceValues(func() (string, error) {
+				return getModbusValues(points, host, port, *outputFormat, name, bitOpts, influxOpts)
+			}, *interval)
+			return
+		}
+		value, err := getModbusValues(points, host, port, *outputFormat, name, bitOpts, influxOpts)
+		if err != nil {
+			handleConnectionError(err)
+		}
+		fmt.Println(value)
+
+	case "set":
+		if len(args) < 5 || len(args) > 6 {
+			fmt.Println("Error: modbus set needs <unit> <register-type> <address> <value> [type]")
+			printUsage()
+			exitWithCode(exitUsage)
+		}
+		dataType := ""
+		if len(args) == 6 {
+			dataType = args[5]
+		}
+		p, err := newModbusPoint(args[1], args[2], args[3], dataType)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exitWithCode(exitBadNode)
+		}
+		result, err := setModbusValue(p.String(), args[4], host, port)
+		if err != nil {
+			handleConnectionError(err)
+		}
+		fmt.Println(result)
+	}
+}
+
+// modbusGetPoints returns the points of modbus get <unit> <register-type>
+// <address> [count] [type]: count neighbouring values of the type from the
+// address on
+func modbusGetPoints(args []string) ([]string, error) {
+	if len(args) < 3 {
+		return nil, fmt.Errorf("missing unit, register type or address")
+	}
+	count, dataType := 1, ""
+	rest := args[3:]
+	if len(rest) > 0 {
+		if n, err := strconv.Atoi(rest[0]); err == nil {
+			if n < 1 || n > maxModbusPoints {
+				return nil, fmt.Errorf("count must be 1-%d, got %d", maxModbusPoints, n)
+			}
+			count, rest = n, rest[1:]
+		}
+	}
+	if len(rest) > 0 {
+		dataType, rest = rest[0], rest[1:]
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(rest, " "))
+	}
+
+	p, err := newModbusPoint(args[0], args[1], args[2], dataType)
+	if err != nil {
+		return nil, err
+	}
+	points := []string{p.String()}
+	for len(points) < count {
+		var ok bool
+		if p, ok = p.next(); !ok {
+			return nil, fmt.Errorf("%d values from address %s do not fit below address 65536", count, args[2])
+		}
+		points = append(points, p.String())
+	}
+	return points, nil
+}
+
+// modbusBitWidths returns the bits of the data types of Modbus points for
+// --bits, 16 for single registers. Wider types are taken as 32-bit words
+func modbusBitWidths(points []string) map[string]int {
+	widths := make(map[string]int)
+	for _, point := range points {
+		if p, err := parseModbusPoint(point); err == nil {
+			if width := dataTypeBits(strings.TrimSuffix(p.dataType, "-swapped")); width > 0 {
+				widths[point] = width
+			}
+		}
+	}
+	return widths
+}
+
+// getModbusValues reads Modbus points through the service and formats them
+// like opcua get, with the point as node_id
+func getModbusValues(points []string, host string, port int, format string, measurement string, bitOpts bitOptions, influxOpts influxOptions) (string, error) {
+	return getDeviceValues(points, (*plcclient.HTTPClient).ReadModbus, host, port, format, measurement, bitOpts, influxOpts)
+}
+
+// setModbusValue writes a value to a coil or holding register through the
+// service
+func setModbusValue(point, value, host string, port int) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout(10*time.Second))
+	defer cancel()
+	result, err := newServiceClient(host, port).WriteModbus(ctx, point, value)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Successfully set %s to %v (via %s:%d)", result.NodeID, result.Value, host, port), nil
+}
@@ -0,0 +1,179 @@
+//go:build !minimal && !nomodbus
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+
+	"umicli/pkg/backend"
+)
+
+// Modbus client of a service or direct mode with a modbus:// endpoint, nil
+// for OPC UA connections
+var serviceModbus *modbusClient
+
+// modbusAPI is the HTTP API of a Modbus connection
+func modbusAPI(endpoint string, client *modbusClient) deviceAPI {
+	return deviceAPI{
+		name:     "Modbus",
+		protocol: "modbus",
+		endpoint: endpoint,
+		address:  client.address,
+		example:  "/api/modbus?point=1/holding/0",
+		register: func(mux *http.ServeMux) {
+			// Reads (GET) and writes (POST) of Modbus points
+			mux.HandleFunc("/api/modbus", handleModbusRequest)
+		},
+		close: client.close,
+	}
+}
+
+// handleModbusRequest reads the points of ?point=... (GET), merging
+// neighbouring points into one request, or writes {"point", "value"} (POST)
+func handleModbusRequest(w http.ResponseWriter, r *http.Request) {
+	if serviceModbus == nil {
+		sendJSONResponseGeneric(w, map[string]string{"error": "Not a Modbus connection, use --endpoint modbus://host:502"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		names := r.URL.Query()["point"]
+		if len(names) == 0 {
+			sendJSONResponseGeneric(w, map[string]string{"error": "Missing point parameter"})
+			return
+		}
+		if len(names) > maxModbusPoints {
+			sendJSONResponseGeneric(w, map[string]string{"error": fmt.Sprintf("Too many points, at most %d per read", maxModbusPoints)})
+			return
+		}
+		points := make([]modbusPoint, len(names))
+		for i, name := range names {
+			p, err := parseModbusPoint(name)
+			if err != nil {
+				sendJSONResponseGeneric(w, map[string]string{"error": err.Error()})
+				return
+			}
+			points[i] = p
+		}
+		results := serviceModbus.readPoints(points)
+		sampled := time.Now()
+		stampResults(results, sampled)
+		serviceRecent.record(results, sampled)
+		sendJSONResponseGeneric(w, map[string]interface{}{"results": results})
+
+	case http.MethodPost:
+		var req struct {
+			Point string `json:"point"`
+			Value string `json:"value"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendJSONResponseGeneric(w, NodeResponse{Error: fmt.Sprintf("Invalid request body: %v", err)})
+			return
+		}
+		p, err := parseModbusPoint(req.Point)
+		if err != nil {
+			sendJSONResponseGeneric(w, NodeResponse{NodeID: req.Point, Error: err.Error(), StatusCode: uint32(ua.StatusBadNodeIDInvalid)})
+			return
+		}
+		if err := serviceModbus.write(p, req.Value); err != nil {
+			log.Printf("[%s] Modbus write of %s failed: %v", connectionName, p, err)
+			sendJSONResponseGeneric(w, NodeResponse{NodeID: p.String(), Error: fmt.Sprintf("Failed to write point: %v", err)})
+			return
+		}
+		if isVerbose {
+			log.Printf("[%s] Wrote %s to %s", connectionName, strings.TrimSpace(req.Value), p)
+		}
+		sendJSONResponseGeneric(w, NodeResponse{NodeID: p.String(), Value: strings.TrimSpace(req.Value), DataType: p.dataType})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func init() {
+	includeComponent("modbus")
+	backend.Register("modbus", "Modbus TCP", newModbusBackend)
+	backend.Register("modbus+tcp", "Modbus TCP", newModbusBackend)
+}
+
+// modbusBackend is the backend of modbus:// endpoints. Next to /api/points
+// its service serves /api/modbus
+type modbusBackend struct {
+	client *modbusClient
+}
+
+func newModbusBackend(endpoint string, opts backend.Options) (backend.Backend, error) {
+	client, err := newModbusClient(endpoint, opts.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &modbusBackend{client: client}, nil
+}
+
+// api makes the client the service's Modbus client and returns its API
+func (b *modbusBackend) api(endpoint string) deviceAPI {
+	serviceModbus = b.client
+	return modbusAPI(endpoint, b.client)
+}
+
+func (b *modbusBackend) Connect(ctx context.Context) error {
+	b.client.mu.Lock()
+	defer b.client.mu.Unlock()
+	return b.client.connect()
+}
+
+// Read reads points, merging neighbouring points into one request
+func (b *modbusBackend) Read(ctx context.Context, refs []string) ([]NodeResponse, error) {
+	points := make([]modbusPoint, len(refs))
+	for i, ref := range refs {
+		p, err := parseModbusPoint(ref)
+		if err != nil {
+			return nil, err
+		}
+		points[i] = p
+	}
+	results := b.client.readPoints(points)
+	for i := range results {
+		results[i].RequestedNodeID = refs[i]
+	}
+	return results, nil
+}
+
+// Write writes a coil or holding register. The type is part of the point,
+// a data type may only repeat it
+func (b *modbusBackend) Write(ctx context.Context, ref, value, dataType string) (NodeResponse, error) {
+	p, err := parseModbusPoint(ref)
+	if err != nil {
+		return NodeResponse{}, err
+	}
+	if dataType != "" && !strings.EqualFold(dataType, p.dataType) {
+		return NodeResponse{}, fmt.Errorf("the type of Modbus points is part of the point, e.g. unit/table/address/%s", dataType)
+	}
+	if err := b.client.write(p, value); err != nil {
+		return NodeResponse{}, err
+	}
+	return NodeResponse{NodeID: p.String(), RequestedNodeID: ref, Value: strings.TrimSpace(value), DataType: p.dataType}, nil
+}
+
+// Browse is not supported, Modbus devices do not describe their registers
+func (b *modbusBackend) Browse(ctx context.Context, ref string, maxDepth int) ([]BrowseNode, error) {
+	return nil, backend.ErrNotSupported
+}
+
+func (b *modbusBackend) Subscribe(ctx context.Context, refs []string, interval time.Duration, fn func([]NodeResponse)) error {
+	return backend.Poll(ctx, b, refs, interval, fn)
+}
+
+func (b *modbusBackend) Close() error {
+	b.client.close()
+	return nil
+}
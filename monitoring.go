@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+// monitoringUsage counts the subscriptions and monitored items the service
+// holds on its session, so it can refuse to go beyond the server's limits
+// with a clear error instead of a bare BadTooMany status from the PLC
+type monitoringUsage struct {
+	mu            sync.Mutex
+	subscriptions int
+	items         int
+}
+
+// Subscriptions and monitored items of this service
+var serviceMonitoring = &monitoringUsage{}
+
+// reserve counts a new subscription with items monitored items, created in
+// one call, if the limits allow it
+func (u *monitoringUsage) reserve(limits operationLimits, items int) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if limit := limits.MaxMonitoredItemsPerCall; limit > 0 && items > limit {
+		return fmt.Errorf("%d monitored items in one call exceed the server's MaxMonitoredItemsPerCall of %d: %w", items, limit, ua.StatusBadTooManyMonitoredItems)
+	}
+	if limit := limits.MaxMonitoredItemsPerSubscription; limit > 0 && items > limit {
+		return fmt.Errorf("%d monitored items exceed the server's MaxMonitoredItemsPerSubscription of %d: %w", items, limit, ua.StatusBadTooManyMonitoredItems)
+	}
+	if limit := limits.MaxMonitoredItems; limit > 0 && u.items+items > limit {
+		return fmt.Errorf("%d more monitored items exceed the server's MaxMonitoredItems of %d, %d are in use: %w", items, limit, u.items, ua.StatusBadTooManyMonitoredItems)
+	}
+	if limit := limits.MaxSubscriptionsPerSession; limit > 0 && u.subscriptions >= limit {
+		return fmt.Errorf("the server's MaxSubscriptionsPerSession of %d are in use: %w", limit, ua.StatusBadTooManySubscriptions)
+	}
+	// Other clients' subscriptions count as well, only ours are known
+	if limit := limits.MaxSubscriptions; limit > 0 && u.subscriptions >= limit {
+		return fmt.Errorf("the server's MaxSubscriptions of %d are in use: %w", limit, ua.StatusBadTooManySubscriptions)
+	}
+	u.subscriptions++
+	u.items += items
+	return nil
+}
+
+// release uncounts a subscription and its monitored items
+func (u *monitoringUsage) release(items int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.subscriptions--
+	u.items -= items
+}
+
+func (u *monitoringUsage) snapshot() (subscriptions, items int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.subscriptions, u.items
+}
+
+// handleStatsRequest reports the subscriptions and monitored items of the
+// service with the server's limits for them
+func handleStatsRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	subscriptions, items := serviceMonitoring.snapshot()
+	limits := serviceLimits.get()
+	sendJSONResponseGeneric(w, map[string]interface{}{
+		"subscriptions": map[string]int{
+			"used":          subscriptions,
+			"maxPerSession": limits.MaxSubscriptionsPerSession,
+			"maxOnServer":   limits.MaxSubscriptions,
+		},
+		"monitoredItems": map[string]int{
+			"used":               items,
+			"max":                limits.MaxMonitoredItems,
+			"maxPerSubscription": limits.MaxMonitoredItemsPerSubscription,
+			"maxPerCall":         limits.MaxMonitoredItemsPerCall,
+		},
+		"storage":   storageStatsSnapshot(),
+		"bandwidth": bandwidthStatsSnapshot(),
+		"latency":   latencyStatsSnapshot(),
+	})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMonitoringUsage tests refusing subscriptions and monitored items beyond
+// the server's limits
+func TestMonitoringUsage(t *testing.T) {
+	u := &monitoringUsage{}
+	limits := operationLimits{MaxMonitoredItemsPerCall: 10, MaxSubscriptionsPerSession: 2, MaxMonitoredItems: 15}
+
+	err := u.reserve(limits, 11)
+	assert.ErrorIs(t, err, ua.StatusBadTooManyMonitoredItems)
+	assert.ErrorContains(t, err, "MaxMonitoredItemsPerCall of 10")
+
+	require.NoError(t, u.reserve(limits, 10))
+	err = u.reserve(limits, 6)
+	assert.ErrorContains(t, err, "MaxMonitoredItems of 15, 10 are in use")
+	require.NoError(t, u.reserve(limits, 5))
+
+	err = u.reserve(limits, 0)
+	assert.ErrorIs(t, err, ua.StatusBadTooManySubscriptions)
+	assert.ErrorContains(t, err, "MaxSubscriptionsPerSession of 2")
+
+	u.release(10)
+	subscriptions, items := u.snapshot()
+	assert.Equal(t, 1, subscriptions)
+	assert.Equal(t, 5, items)
+
+	// Without announced limits there are none
+	require.NoError(t, (&monitoringUsage{}).reserve(operationLimits{}, 100000))
+}
+
+// TestHandleStatsRequest tests that the keep-alive subscription shows in
+// /api/stats with the limits of the simulated PLC
+func TestHandleStatsRequest(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	client := connectMock(t, ctx)
+	serviceMonitoring = &monitoringUsage{}
+	t.Cleanup(func() { serviceMonitoring = &monitoringUsage{} })
+
+	k := newKeepAlive(time.Second, "")
+	require.NoError(t, k.check(ctx, client))
+
+	stats := func() map[string]map[string]int {
+		rec := httptest.NewRecorder()
+		handleStatsRequest(rec, httptest.NewRequest("GET", "/api/stats", nil))
+		var raw map[string]json.RawMessage
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &raw))
+		assert.Contains(t, raw, "storage")
+		resp := make(map[string]map[string]int)
+		for _, key := range []string{"subscriptions", "monitoredItems"} {
+			var counts map[string]int
+			require.NoError(t, json.Unmarshal(raw[key], &counts))
+			resp[key] = counts
+		}
+		return resp
+	}
+	resp := stats()
+	assert.Equal(t, map[string]int{"used": 1, "maxPerSession": mockMaxSubscriptionsPerSession, "maxOnServer": 0}, resp["subscriptions"])
+	assert.Equal(t, 1, resp["monitoredItems"]["used"])
+	assert.Equal(t, mockMaxMonitoredItemsPerCall, resp["monitoredItems"]["maxPerCall"])
+
+	k.stop()
+	assert.Equal(t, 0, stats()["subscriptions"]["used"])
+}
@@ -0,0 +1,547 @@
+//go:build !minimal && !nocloudiot
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// MQTT 3.1.1 packet types
+const (
+	mqttConnect    = 1
+	mqttConnAck    = 2
+	mqttPublish    = 3
+	mqttPubAck     = 4
+	mqttSubscribe  = 8
+	mqttSubAck     = 9
+	mqttPingReq    = 12
+	mqttPingResp   = 13
+	mqttDisconnect = 14
+)
+
+// How long a publish or subscribe waits for its acknowledgement
+const mqttAckTimeout = 30 * time.Second
+
+// Largest packet accepted from the broker
+const maxMQTTPacket = 1 << 20
+
+// errMQTTClosed is returned by requests on a closed connection
+var errMQTTClosed = errors.New("MQTT connection closed")
+
+// mqttClient is a minimal MQTT 3.1.1 client for the cloud IoT and MQTT
+// sinks: QoS 0 and 1 publishes, QoS 0 subscriptions for the replies of the
+// platform, a will and keep-alive pings. Like the Modbus and EtherNet/IP clients it speaks the
+// protocol itself
+type mqttClient struct {
+	conn      io.ReadWriteCloser
+	onMessage func(topic string, payload []byte)
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	nextID  uint16
+	pending map[uint16]chan []byte // Acknowledgements by packet ID
+	done    chan struct{}          // Closed when the connection ends
+	err     error                  // Why it ended
+}
+
+// mqttLogin is the CONNECT of a client
+type mqttLogin struct {
+	clientID  string
+	username  string
+	password  string
+	keepAlive time.Duration
+
+	// Will the broker publishes with QoS 1 when the connection is lost, none
+	// when willTopic is empty
+	willTopic   string
+	willPayload []byte
+}
+
+// newMQTTClient logs in on conn, a TCP, TLS or WebSocket connection to the
+// broker, and starts reading. Messages on subscribed topics go to onMessage
+func newMQTTClient(ctx context.Context, conn io.ReadWriteCloser, login mqttLogin, onMessage func(topic string, payload []byte)) (*mqttClient, error) {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	var body []byte
+	body = appendMQTTString(body, "MQTT")
+	flags := byte(0x02) // Clean session
+	if login.username != "" {
+		flags |= 0x80
+	}
+	if login.password != "" {
+		flags |= 0x40
+	}
+	if login.willTopic != "" {
+		flags |= 0x04 | 1<<3 // Will, QoS 1
+	}
+	body = append(body, 4, flags)
+	body = binary.BigEndian.AppendUint16(body, uint16(login.keepAlive/time.Second))
+	body = appendMQTTString(body, login.clientID)
+	if login.willTopic != "" {
+		body = appendMQTTString(body, login.willTopic)
+		body = binary.BigEndian.AppendUint16(body, uint16(len(login.willPayload)))
+		body = append(body, login.willPayload...)
+	}
+	if login.username != "" {
+		body = appendMQTTString(body, login.username)
+	}
+	if login.password != "" {
+		body = appendMQTTString(body, login.password)
+	}
+	if _, err := conn.Write(mqttPacket(mqttConnect<<4, body)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send CONNECT: %v", err)
+	}
+
+	r := bufio.NewReader(conn)
+	header, ack, err := readMQTTPacket(r)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("failed to read CONNACK: %v", err)
+	}
+	if header>>4 != mqttConnAck || len(ack) != 2 {
+		conn.Close()
+		return nil, fmt.Errorf("expected CONNACK, got packet type %d", header>>4)
+	}
+	if ack[1] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("connection refused: %s", mqttConnAckReason(ack[1]))
+	}
+
+	c := &mqttClient{
+		conn:      conn,
+		onMessage: onMessage,
+		pending:   make(map[uint16]chan []byte),
+		done:      make(chan struct{}),
+	}
+	go c.read(r)
+	if login.keepAlive > 0 {
+		go c.ping(login.keepAlive / 2)
+	}
+	return c, nil
+}
+
+// mqttConnAckReason describes the return code of a refused CONNACK
+func mqttConnAckReason(code byte) string {
+	switch code {
+	case 1:
+		return "unacceptable protocol version"
+	case 2:
+		return "client ID rejected"
+	case 3:
+		return "server unavailable"
+	case 4:
+		return "bad username or password"
+	case 5:
+		return "not authorized"
+	}
+	return fmt.Sprintf("return code %d", code)
+}
+
+// publish sends a message. With QoS 1 it waits for the broker's PUBACK
+func (c *mqttClient) publish(ctx context.Context, topic string, payload []byte, qos byte) error {
+	body := appendMQTTString(nil, topic)
+	var ack chan []byte
+	if qos > 0 {
+		var id uint16
+		id, ack = c.register()
+		defer c.unregister(id)
+		body = binary.BigEndian.AppendUint16(body, id)
+	}
+	body = append(body, payload...)
+	if err := c.write(mqttPacket(mqttPublish<<4|qos<<1, body)); err != nil {
+		return err
+	}
+	if ack == nil {
+		return nil
+	}
+	_, err := c.wait(ctx, ack)
+	return err
+}
+
+// subscribe subscribes to topic filters with QoS 0
+func (c *mqttClient) subscribe(ctx context.Context, filters ...string) error {
+	id, ack := c.register()
+	defer c.unregister(id)
+	body := binary.BigEndian.AppendUint16(nil, id)
+	for _, filter := range filters {
+		body = append(appendMQTTString(body, filter), 0)
+	}
+	if err := c.write(mqttPacket(mqttSubscribe<<4|0x02, body)); err != nil {
+		return err
+	}
+	codes, err := c.wait(ctx, ack)
+	if err != nil {
+		return err
+	}
+	for i, code := range codes {
+		if code == 0x80 && i < len(filters) {
+			return fmt.Errorf("subscription to %s refused", filters[i])
+		}
+	}
+	return nil
+}
+
+// close disconnects from the broker
+func (c *mqttClient) close() error {
+	c.write([]byte{mqttDisconnect << 4, 0})
+	return c.conn.Close()
+}
+
+// closed returns the error that ended the connection, nil while it is up
+func (c *mqttClient) closed() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// register reserves a packet ID and the channel its acknowledgement comes on
+func (c *mqttClient) register() (uint16, chan []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		c.nextID++
+		if _, used := c.pending[c.nextID]; c.nextID != 0 && !used {
+			break
+		}
+	}
+	ack := make(chan []byte, 1)
+	c.pending[c.nextID] = ack
+	return c.nextID, ack
+}
+
+func (c *mqttClient) unregister(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+}
+
+// wait waits for an acknowledgement, returning the rest of its body
+func (c *mqttClient) wait(ctx context.Context, ack chan []byte) ([]byte, error) {
+	timer := time.NewTimer(mqttAckTimeout)
+	defer timer.Stop()
+	select {
+	case body := <-ack:
+		return body, nil
+	case <-c.done:
+		return nil, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+		return nil, fmt.Errorf("no acknowledgement from the broker within %v", mqttAckTimeout)
+	}
+}
+
+// write sends a packet, one at a time
+func (c *mqttClient) write(packet []byte) error {
+	if err := c.closed(); err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if _, err := c.conn.Write(packet); err != nil {
+		return fmt.Errorf("failed to send to the broker: %v", err)
+	}
+	return nil
+}
+
+// read dispatches the packets of the broker until the connection ends
+func (c *mqttClient) read(r *bufio.Reader) {
+	var err error
+	defer func() {
+		c.mu.Lock()
+		c.err = err
+		if c.err == nil || errors.Is(c.err, net.ErrClosed) || errors.Is(c.err, io.EOF) {
+			c.err = errMQTTClosed
+		}
+		c.mu.Unlock()
+		close(c.done)
+		c.conn.Close()
+	}()
+	for {
+		var header byte
+		var body []byte
+		if header, body, err = readMQTTPacket(r); err != nil {
+			return
+		}
+		switch header >> 4 {
+		case mqttPubAck, mqttSubAck:
+			if len(body) < 2 {
+				err = fmt.Errorf("short acknowledgement")
+				return
+			}
+			c.mu.Lock()
+			ack := c.pending[binary.BigEndian.Uint16(body)]
+			c.mu.Unlock()
+			select {
+			case ack <- body[2:]: // nil for unknown IDs
+			default:
+			}
+		case mqttPublish:
+			topic, rest, ok := cutMQTTString(body)
+			if !ok {
+				err = fmt.Errorf("malformed PUBLISH")
+				return
+			}
+			if qos := header >> 1 & 0x03; qos > 0 {
+				if len(rest) < 2 {
+					err = fmt.Errorf("malformed PUBLISH")
+					return
+				}
+				c.write(mqttPacket(mqttPubAck<<4, rest[:2]))
+				rest = rest[2:]
+			}
+			if c.onMessage != nil {
+				c.onMessage(topic, rest)
+			}
+		case mqttPingResp:
+		default:
+			err = fmt.Errorf("unexpected packet type %d", header>>4)
+			return
+		}
+	}
+}
+
+// ping keeps the connection alive until it ends
+func (c *mqttClient) ping(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.write([]byte{mqttPingReq << 4, 0})
+		}
+	}
+}
+
+// mqttPacket frames a packet: the header byte, the remaining length and the
+// body
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// readMQTTPacket reads the header byte and the body of a packet
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, shift := 0, 0
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return 0, nil, fmt.Errorf("malformed remaining length")
+		}
+	}
+	if n > maxMQTTPacket {
+		return 0, nil, fmt.Errorf("packet of %d bytes exceeds %d", n, maxMQTTPacket)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+// appendMQTTString appends a length-prefixed UTF-8 string
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// cutMQTTString returns the length-prefixed string at the start of b and the
+// rest
+func cutMQTTString(b []byte) (string, []byte, bool) {
+	if len(b) < 2 {
+		return "", nil, false
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, false
+	}
+	return string(b[2 : 2+n]), b[2+n:], true
+}
+
+// webSocketGUID is appended to the key of a WebSocket handshake, RFC 6455
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// webSocketConn carries MQTT in binary WebSocket frames, for brokers that
+// take their credentials in the URL of the handshake (AWS IoT with SigV4)
+type webSocketConn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	pending []byte // Rest of the last data frame
+}
+
+// dialWebSocket upgrades conn, a TLS connection to the host of the URL, to
+// a WebSocket with the mqtt subprotocol
+func dialWebSocket(conn net.Conn, target string) (*webSocketConn, error) {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Protocol", "mqtt")
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("failed to send the WebSocket handshake: %v", err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the WebSocket handshake: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("WebSocket handshake failed with status %s", resp.Status)
+	}
+	sum := sha1.Sum([]byte(key + webSocketGUID))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		return nil, fmt.Errorf("WebSocket handshake with an invalid Sec-WebSocket-Accept")
+	}
+	return &webSocketConn{conn: conn, r: r}, nil
+}
+
+// Write sends p in one masked binary frame
+func (w *webSocketConn) Write(p []byte) (int, error) {
+	frame := []byte{0x82} // FIN, binary
+	switch {
+	case len(p) < 126:
+		frame = append(frame, 0x80|byte(len(p)))
+	case len(p) <= 0xffff:
+		frame = binary.BigEndian.AppendUint16(append(frame, 0x80|126), uint16(len(p)))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, 0x80|127), uint64(len(p)))
+	}
+	mask := make([]byte, 4)
+	rand.Read(mask)
+	frame = append(frame, mask...)
+	for i, b := range p {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := w.conn.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Read returns the payload of data frames, answering pings on the way
+func (w *webSocketConn) Read(p []byte) (int, error) {
+	for len(w.pending) == 0 {
+		opcode, payload, err := w.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		switch opcode {
+		case 0x0, 0x1, 0x2:
+			w.pending = payload
+		case 0x8:
+			return 0, io.EOF
+		case 0x9:
+			w.writeControl(0xA, payload)
+		}
+	}
+	n := copy(p, w.pending)
+	w.pending = w.pending[n:]
+	return n, nil
+}
+
+// readFrame reads the opcode and the unmasked payload of a frame
+func (w *webSocketConn) readFrame() (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(w.r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(w.r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(w.r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > maxMQTTPacket {
+		return 0, nil, fmt.Errorf("WebSocket frame of %d bytes exceeds %d", n, maxMQTTPacket)
+	}
+	var mask [4]byte
+	masked := head[1]&0x80 != 0
+	if masked {
+		if _, err := io.ReadFull(w.r, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(w.r, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return head[0] & 0x0f, payload, nil
+}
+
+// writeControl sends a masked control frame
+func (w *webSocketConn) writeControl(opcode byte, payload []byte) {
+	frame := append([]byte{0x80 | opcode, 0x80 | byte(len(payload))}, 0, 0, 0, 0)
+	w.conn.Write(append(frame, payload...)) // Zero mask
+}
+
+func (w *webSocketConn) Close() error {
+	w.writeControl(0x8, nil)
+	return w.conn.Close()
+}
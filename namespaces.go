@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+// namespaceTable holds the server's namespace array of the current session.
+// Node IDs with a namespace URI (nsu=<uri>;s=...) are resolved against it, so
+// they keep working when a firmware update shifts the namespace indexes
+type namespaceTable struct {
+	mu   sync.RWMutex
+	uris []string
+}
+
+// Namespace array of the connected server
+var serviceNamespaces = &namespaceTable{}
+
+// set replaces the namespace array after a (re)connect and logs URIs whose
+// index changed since the previous session
+func (t *namespaceTable) set(uris []string) {
+	t.mu.Lock()
+	previous := t.uris
+	t.uris = append([]string(nil), uris...)
+	t.mu.Unlock()
+
+	for oldIndex, uri := range previous {
+		for newIndex, current := range uris {
+			if current == uri && newIndex != oldIndex {
+				log.Printf("[%s] Namespace %s moved from index %d to %d", connectionName, uri, oldIndex, newIndex)
+			}
+		}
+	}
+}
+
+// list returns the namespace array, nil before the server is connected
+func (t *namespaceTable) list() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return append([]string(nil), t.uris...)
+}
+
+// index returns the current namespace index of a URI
+func (t *namespaceTable) index(uri string) (uint16, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.uris == nil {
+		return 0, fmt.Errorf("namespace URI %s cannot be resolved before the server is connected", uri)
+	}
+	for i, current := range t.uris {
+		if current == uri {
+			return uint16(i), nil
+		}
+	}
+	return 0, fmt.Errorf("namespace URI %s not found on the server", uri)
+}
+
+// resolveNodeID parses a node ID of the service. A namespace URI is replaced
+// by the index the server currently has for it
+func resolveNodeID(nodeID string) (*ua.NodeID, error) {
+	uri, identifier, ok := splitNamespaceURI(nodeID)
+	if !ok {
+		return ua.ParseNodeID(nodeID)
+	}
+	index, err := serviceNamespaces.index(uri)
+	if err != nil {
+		return nil, err
+	}
+	return ua.ParseNodeID(fmt.Sprintf("ns=%d;%s", index, identifier))
+}
+
+// checkNodeID validates the syntax of a node ID without resolving its
+// namespace URI, for node IDs that are kept and resolved on every use
+func checkNodeID(nodeID string) error {
+	_, identifier, ok := splitNamespaceURI(nodeID)
+	if ok {
+		nodeID = "ns=0;" + identifier
+	}
+	_, err := ua.ParseNodeID(nodeID)
+	return err
+}
+
+// splitNamespaceURI splits nsu=<uri>;<type>=<identifier> into the URI and
+// the identifier part
+func splitNamespaceURI(nodeID string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(nodeID, "nsu=")
+	if !ok {
+		return "", "", false
+	}
+	// The identifier starts at the first ;i=, ;s=, ;g= or ;b=
+	for i := 0; i+2 < len(rest); i++ {
+		if rest[i] == ';' && strings.IndexByte("isgb", rest[i+1]) >= 0 && rest[i+2] == '=' {
+			return rest[:i], rest[i+1:], true
+		}
+	}
+	return rest, "", true
+}
+
+// requestNodeID builds the node ID of an API request's namespace, type and
+// identifier. A namespace that is not an index is a namespace URI
+func requestNodeID(namespace, idType, identifier string) string {
+	if _, err := strconv.ParseUint(namespace, 10, 16); err != nil {
+		return fmt.Sprintf("nsu=%s;%s=%s", namespace, idType, identifier)
+	}
+	return fmt.Sprintf("ns=%s;%s=%s", namespace, idType, identifier)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestResolveNodeID tests resolving namespace URIs with the current namespace
+// array, also after the indexes moved
+func TestResolveNodeID(t *testing.T) {
+	defer func() { serviceNamespaces = &namespaceTable{} }()
+	serviceNamespaces = &namespaceTable{}
+
+	_, err := resolveNodeID("nsu=http://siemens.com/simatic;s=DB1.Var")
+	assert.Error(t, err, "not connected yet")
+
+	serviceNamespaces.set([]string{"http://opcfoundation.org/UA/", "urn:plc", "http://siemens.com/simatic"})
+	id, err := resolveNodeID("nsu=http://siemens.com/simatic;s=DB1.Var")
+	require.NoError(t, err)
+	assert.Equal(t, "ns=2;s=DB1.Var", id.String())
+
+	// A firmware update added a namespace in front
+	serviceNamespaces.set([]string{"http://opcfoundation.org/UA/", "urn:plc", "urn:diag", "http://siemens.com/simatic"})
+	id, err = resolveNodeID("nsu=http://siemens.com/simatic;s=DB1.Var")
+	require.NoError(t, err)
+	assert.Equal(t, "ns=3;s=DB1.Var", id.String())
+
+	_, err = resolveNodeID("nsu=urn:unknown;s=DB1.Var")
+	assert.Error(t, err)
+
+	id, err = resolveNodeID("ns=3;s=Temperature")
+	require.NoError(t, err)
+	assert.Equal(t, "ns=3;s=Temperature", id.String())
+}
+
+// TestSplitNamespaceURI tests URIs with semicolons and identifiers with
+// equals signs
+func TestSplitNamespaceURI(t *testing.T) {
+	uri, identifier, ok := splitNamespaceURI("nsu=urn:a;b;s=x=1")
+	assert.True(t, ok)
+	assert.Equal(t, "urn:a;b", uri)
+	assert.Equal(t, "s=x=1", identifier)
+
+	_, _, ok = splitNamespaceURI("ns=3;s=x")
+	assert.False(t, ok)
+
+	assert.Equal(t, "nsu=urn:plc;s=Var", requestNodeID("urn:plc", "s", "Var"))
+	assert.Equal(t, "ns=3;s=Var", requestNodeID("3", "s", "Var"))
+	assert.NoError(t, checkNodeID("nsu=urn:plc;s=Var"))
+}
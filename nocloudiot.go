@@ -0,0 +1,55 @@
+//go:build minimal || nocloudiot
+
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// azureIoT, awsIoT and mqttBroker take the settings of cloud and MQTT sinks
+// without knowing them, to reject the sinks
+type (
+	azureIoT   struct{}
+	awsIoT     struct{}
+	mqttBroker struct{}
+)
+
+// cloudSink stands in for the cloud sinks of builds without them, which
+// newAzureSink, newAWSSink and newMQTTSink never return
+type cloudSink struct {
+	name        string
+	buffer      *priorityBuffer
+	statusEvery time.Duration
+}
+
+// newAzureSink fails, this build has no cloud sinks
+func newAzureSink(cfg *azureIoT) (*cloudSink, error) {
+	return nil, errNotIncluded("cloudiot")
+}
+
+// newAWSSink fails, this build has no cloud sinks
+func newAWSSink(cfg *awsIoT, getenv func(string) string) (*cloudSink, error) {
+	return nil, errNotIncluded("cloudiot")
+}
+
+// newMQTTSink fails, this build has no MQTT sinks
+func newMQTTSink(cfg *mqttBroker) (*cloudSink, error) {
+	return nil, errNotIncluded("cloudiot")
+}
+
+// The methods pollSink calls, never reached without a cloud sink
+
+func (c *cloudSink) watch(ctx context.Context, bus *eventBus) {}
+
+func (c *cloudSink) close() {}
+
+func (c *cloudSink) send(ctx context.Context, lines []string, budget *sinkBudget) error {
+	return errNotIncluded("cloudiot")
+}
+
+// publishRuleMQTT fails, this build has no MQTT client. Rules with an MQTT
+// action are rejected when the rules file loads
+func publishRuleMQTT(ctx context.Context, m *ruleMQTT, payload []byte) error {
+	return errNotIncluded("cloudiot")
+}
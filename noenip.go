@@ -0,0 +1,27 @@
+//go:build minimal || noenip
+
+package main
+
+import (
+	"net/http"
+
+	"umicli/pkg/backend"
+)
+
+// enip:// endpoints stay known, to fail with errNotIncluded instead of as
+// OPC UA endpoints
+func init() {
+	backend.Register("enip", "EtherNet/IP", func(string, backend.Options) (backend.Backend, error) {
+		return nil, errNotIncluded("enip")
+	})
+}
+
+// runENIPCommand fails, this build has no EtherNet/IP driver
+func runENIPCommand(args []string, port int, influxOpts influxOptions) {
+	exitWithError(errNotIncluded("enip"))
+}
+
+// handleENIPRequest answers that this build has no EtherNet/IP driver
+func handleENIPRequest(w http.ResponseWriter, r *http.Request) {
+	sendJSONResponseGeneric(w, map[string]string{"error": errNotIncluded("enip").Error()})
+}
@@ -0,0 +1,21 @@
+//go:build minimal || nohistorian
+
+package main
+
+import "time"
+
+// historian stands in for the SQLite sink of builds without it, which
+// openHistorian never returns
+type historian struct {
+	lineWriter
+}
+
+// openHistorian fails, this build has no SQLite sinks
+func openHistorian(path string, retention time.Duration, maxSize int64) (*historian, error) {
+	return nil, errNotIncluded("historian")
+}
+
+// runQuery fails, this build has no SQLite sinks to query
+func runQuery(nodeIDs []string, format string) (string, error) {
+	return "", errNotIncluded("historian")
+}
@@ -0,0 +1,29 @@
+//go:build minimal || nomodbus
+
+package main
+
+import (
+	"net/http"
+
+	"umicli/pkg/backend"
+)
+
+// modbus:// endpoints stay known, to fail with errNotIncluded instead of as
+// OPC UA endpoints
+func init() {
+	notIncluded := func(string, backend.Options) (backend.Backend, error) {
+		return nil, errNotIncluded("modbus")
+	}
+	backend.Register("modbus", "Modbus TCP", notIncluded)
+	backend.Register("modbus+tcp", "Modbus TCP", notIncluded)
+}
+
+// runModbusCommand fails, this build has no Modbus driver
+func runModbusCommand(args []string, port int, influxOpts influxOptions) {
+	exitWithError(errNotIncluded("modbus"))
+}
+
+// handleModbusRequest answers that this build has no Modbus driver
+func handleModbusRequest(w http.ResponseWriter, r *http.Request) {
+	sendJSONResponseGeneric(w, map[string]string{"error": errNotIncluded("modbus").Error()})
+}
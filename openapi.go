@@ -0,0 +1,817 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"umicli/pkg/plcclient"
+)
+
+// apiParam is a query, path or header parameter of an API operation
+type apiParam struct {
+	name        string
+	in          string // query, path or header
+	typ         string // string (default), integer or boolean
+	required    bool
+	description string
+}
+
+// apiOperation documents an operation of the service API for
+// /api/openapi.json. The schemas of request and response bodies are generated
+// from the JSON fields of the Go types, TestOpenAPIRoutes checks that every
+// route of registerHandlers is documented and TestOpenAPIResponses that the
+// handlers answer with the documented fields
+type apiOperation struct {
+	id       string // operationId
+	method   string
+	path     string // OpenAPI path, e.g. /api/jobs/{id}
+	summary  string
+	params   []apiParam
+	request  interface{}       // Zero value of the JSON request body type, nil without a body
+	response interface{}       // Zero value of the JSON response type, nil for text only
+	text     string            // Content type of a text response, e.g. text/event-stream
+	headers  map[string]string // Response headers and their description
+	debug    bool              // Only with --debug-faults
+}
+
+// Parameters shared by several operations
+var (
+	timeoutParam = apiParam{name: "timeout", in: "query", description: "Timeout of the OPC UA operation instead of the default, e.g. 30s"}
+	opIDHeader   = map[string]string{operationIDHeader: "ID of the operation, for DELETE /api/operations/{id}"}
+	permitParam  = apiParam{name: permitHeader, in: "header", description: "Active write permit, required by services started with --write-permits"}
+)
+
+// Request and response bodies shared by several operations. Types starting
+// with api are inlined, other named types become components
+type (
+	apiNodeID struct {
+		Namespace  string `json:"namespace"`  // Index or nsu= URI
+		Type       string `json:"type"`       // i, s, g or b
+		Identifier string `json:"identifier"` // e.g. Temperature
+	}
+	apiCancelled struct {
+		Cancelled string `json:"cancelled,omitempty"`
+		Error     string `json:"error,omitempty"`
+	}
+	apiRemoved struct {
+		Removed string `json:"removed,omitempty"`
+		Error   string `json:"error,omitempty"`
+	}
+	apiJob struct {
+		Job   JobInfo `json:"job"`
+		Error string  `json:"error,omitempty"`
+	}
+	apiPoll struct {
+		Poll  PollInfo `json:"poll"`
+		Error string   `json:"error,omitempty"`
+	}
+	apiPermit struct {
+		Permit WritePermit `json:"permit"`
+		Error  string      `json:"error,omitempty"`
+	}
+	apiApproval struct {
+		Approval PendingWrite `json:"approval"`
+		Error    string       `json:"error,omitempty"`
+	}
+	apiMaintenance struct {
+		Maintenance *Maintenance `json:"maintenance"` // null outside a maintenance window
+		Error       string       `json:"error,omitempty"`
+	}
+	apiSchedules struct {
+		Schedules []WriteSchedule `json:"schedules"`
+		Error     string          `json:"error,omitempty"`
+	}
+	apiGroup struct {
+		Group NodeGroup `json:"group"`
+		Error string    `json:"error,omitempty"`
+	}
+	apiFaults struct {
+		Faults faultState `json:"faults"`
+	}
+)
+
+// Operations of the service API, in the order of registerHandlers
+var apiOperations = []apiOperation{
+	{
+		id: "browse", method: http.MethodGet, path: "/api/browse",
+		summary: "Browse the address space below a node",
+		params: []apiParam{
+			{name: "nodeid", in: "query", description: "Start node, defaults to the Objects folder (i=84)"},
+			{name: "maxdepth", in: "query", typ: "integer", description: "Levels below the start node, default 10"},
+			{name: "limit", in: "query", typ: "integer", description: "Page of at most this many nodes (1-10000), the whole subtree without"},
+			{name: "continuation", in: "query", description: "Token of the previous page to continue with, replaces nodeid and maxdepth"},
+			timeoutParam,
+		},
+		response: struct {
+			Nodes        []plcclient.BrowseNode `json:"nodes"`
+			Continuation string                 `json:"continuation,omitempty"` // Of the next page, a page may hold fewer nodes than limit
+			Error        string                 `json:"error,omitempty"`
+		}{},
+		headers: opIDHeader,
+	},
+	{
+		id: "readNode", method: http.MethodGet, path: "/api/node",
+		summary: "Read a node",
+		params: []apiParam{
+			{name: "namespace", in: "query", required: true, description: "Namespace index, or nsu= URI"},
+			{name: "type", in: "query", required: true, description: "Identifier type: i, s, g or b"},
+			{name: "identifier", in: "query", required: true, description: "Identifier of the node"},
+			{name: "nodeID", in: "query", description: "Node ID as the caller wrote it, echoed as requestedNodeID"},
+			{name: "decodeEnums", in: "query", typ: "boolean", description: "Add the symbolic name of enumeration values"},
+			{name: "withMetadata", in: "query", typ: "boolean", description: "Add the unit and range of analog items"},
+			{name: "fresh", in: "query", typ: "boolean", description: "Bypass the read cache (--cache-ttl)"},
+			timeoutParam,
+		},
+		response: NodeResponse{},
+	},
+	{
+		id: "writeNode", method: http.MethodPost, path: "/api/node",
+		summary: "Write a node, queued behind running writes",
+		request: struct {
+			apiNodeID
+			Value     string `json:"value"`               // Converted according to dataType
+			DataType  string `json:"dataType"`            // boolean, int16, float, string, dtl, struct, auto, ...
+			Attribute string `json:"attribute,omitempty"` // Defaults to Value
+			Priority  string `json:"priority,omitempty"`  // high (default) or low
+			DryRun    bool   `json:"dryRun,omitempty"`    // Only convert the value
+			Timeout   string `json:"timeout,omitempty"`   // e.g. 30s
+		}{},
+		params:   []apiParam{permitParam},
+		response: NodeResponse{},
+		headers:  opIDHeader,
+	},
+	{
+		id: "readNodes", method: http.MethodPost, path: "/api/nodes",
+		summary: "Read several nodes in one request",
+		request: struct {
+			Nodes []struct {
+				apiNodeID
+				NodeID string `json:"nodeID,omitempty"`
+			} `json:"nodes"`
+			DecodeEnums  bool   `json:"decodeEnums,omitempty"`
+			WithMetadata bool   `json:"withMetadata,omitempty"`
+			Fresh        bool   `json:"fresh,omitempty"`
+			Synchronized bool   `json:"synchronized,omitempty"` // One read request, all values with its timestamp
+			Timeout      string `json:"timeout,omitempty"`
+		}{},
+		response: struct {
+			Results []NodeResponse `json:"results"`
+			Error   string         `json:"error,omitempty"`
+		}{},
+	},
+	{
+		id: "setBit", method: http.MethodPost, path: "/api/bit",
+		summary: "Set or clear a bit of an integer word with a read-modify-write",
+		request: struct {
+			apiNodeID
+			Bit      int    `json:"bit"`
+			Value    int    `json:"value"` // 0 or 1
+			Priority string `json:"priority,omitempty"`
+			Timeout  string `json:"timeout,omitempty"`
+		}{},
+		params:   []apiParam{permitParam},
+		response: NodeResponse{},
+		headers:  opIDHeader,
+	},
+	{
+		id: "listWrites", method: http.MethodGet, path: "/api/writes",
+		summary: "List the running and queued writes",
+		response: struct {
+			Writes []WriteOpInfo `json:"writes"`
+		}{},
+	},
+	{
+		id: "listOperations", method: http.MethodGet, path: "/api/operations",
+		summary: "List the running browses, jobs and queued writes",
+		response: struct {
+			Operations []OperationInfo `json:"operations"`
+		}{},
+	},
+	{
+		id: "cancelOperation", method: http.MethodDelete, path: "/api/operations/{id}",
+		summary:  "Cancel a queued write, running browse or job",
+		params:   []apiParam{{name: "id", in: "path", required: true}},
+		response: apiCancelled{},
+	},
+	{
+		id: "startJob", method: http.MethodPost, path: "/api/jobs",
+		summary: "Start a browse, subtree read or history export in the background",
+		request: struct {
+			Kind     string    `json:"kind"` // browse, read-subtree or history-export
+			NodeID   string    `json:"nodeId,omitempty"`
+			MaxDepth int       `json:"maxDepth,omitempty"`
+			NodeIDs  []string  `json:"nodeIds,omitempty"`
+			Start    time.Time `json:"start,omitempty"`
+			End      time.Time `json:"end,omitempty"`
+		}{},
+		response: apiJob{},
+		headers:  opIDHeader,
+	},
+	{
+		id: "listJobs", method: http.MethodGet, path: "/api/jobs",
+		summary: "List the jobs",
+		response: struct {
+			Jobs []JobInfo `json:"jobs"`
+		}{},
+	},
+	{
+		id: "getJob", method: http.MethodGet, path: "/api/jobs/{id}",
+		summary:  "Progress of a job",
+		params:   []apiParam{{name: "id", in: "path", required: true}},
+		response: apiJob{},
+	},
+	{
+		id: "getJobResult", method: http.MethodGet, path: "/api/jobs/{id}/result",
+		summary: "Result of a finished job: nodes of a browse, results of a subtree read or the file of a history export",
+		params:  []apiParam{{name: "id", in: "path", required: true}},
+		response: struct {
+			Nodes   []plcclient.BrowseNode `json:"nodes,omitempty"`
+			Results []NodeResponse         `json:"results,omitempty"`
+			plcclient.HistoryExport
+			Error string `json:"error,omitempty"`
+		}{},
+	},
+	{
+		id: "cancelJob", method: http.MethodDelete, path: "/api/jobs/{id}",
+		summary:  "Cancel a running job",
+		params:   []apiParam{{name: "id", in: "path", required: true}},
+		response: apiCancelled{},
+	},
+	{
+		id: "addPoll", method: http.MethodPost, path: "/api/polls",
+		summary:  "Create a poll group sampled by the service",
+		request:  PollConfig{},
+		response: apiPoll{},
+	},
+	{
+		id: "listPolls", method: http.MethodGet, path: "/api/polls",
+		summary: "List the poll groups",
+		response: struct {
+			Polls []PollInfo `json:"polls"`
+		}{},
+	},
+	{
+		id: "getPoll", method: http.MethodGet, path: "/api/polls/{id}",
+		summary:  "Poll group with its latest samples",
+		params:   []apiParam{{name: "id", in: "path", required: true}},
+		response: apiPoll{},
+	},
+	{
+		id: "removePoll", method: http.MethodDelete, path: "/api/polls/{id}",
+		summary:  "Stop a poll group",
+		params:   []apiParam{{name: "id", in: "path", required: true}},
+		response: apiRemoved{},
+	},
+	{
+		id: "drainBuffer", method: http.MethodGet, path: "/api/buffer",
+		summary: "Drain the InfluxDB lines sampled from the poll file",
+		params: []apiParam{
+			{name: "format", in: "query", description: "influx for line protocol as text/plain, for Telegraf's http input"},
+		},
+		response: struct {
+			Lines   []string `json:"lines"`
+			Dropped int64    `json:"dropped"`
+			Error   string   `json:"error,omitempty"`
+		}{},
+		text:    "text/plain",
+		headers: map[string]string{"X-Dropped-Lines": "Lines dropped since the last drain, with format=influx"},
+	},
+	{
+		id: "listStates", method: http.MethodGet, path: "/api/states",
+		summary: "State duration accumulators of the tracked state nodes",
+		response: struct {
+			States []StateDurations `json:"states"`
+		}{},
+	},
+	{
+		id: "addGroup", method: http.MethodPost, path: "/api/groups",
+		summary:  "Create a node group or replace one added before",
+		request:  NodeGroup{},
+		response: apiGroup{},
+	},
+	{
+		id: "listGroups", method: http.MethodGet, path: "/api/groups",
+		summary: "List the node groups",
+		response: struct {
+			Groups []NodeGroup `json:"groups"`
+		}{},
+	},
+	{
+		id: "getGroup", method: http.MethodGet, path: "/api/groups/{name}",
+		summary:  "Node group by name",
+		params:   []apiParam{{name: "name", in: "path", required: true}},
+		response: apiGroup{},
+	},
+	{
+		id: "removeGroup", method: http.MethodDelete, path: "/api/groups/{name}",
+		summary:  "Remove a node group added through the API",
+		params:   []apiParam{{name: "name", in: "path", required: true}},
+		response: apiRemoved{},
+	},
+	{
+		id: "streamEvents", method: http.MethodGet, path: "/api/events",
+		summary: "Connection events (connect, disconnect, reconnect) as server-sent events, data is a JSON serviceEvent",
+		params:  []apiParam{{name: "Last-Event-ID", in: "header", typ: "integer", description: "Resend the events after this ID"}},
+		text:    "text/event-stream",
+	},
+	{
+		id: "streamConnectionEvents", method: http.MethodGet, path: "/api/events/connection",
+		summary: "Connection state changes as server-sent events",
+		params:  []apiParam{{name: "Last-Event-ID", in: "header", typ: "integer", description: "Resend the events after this ID"}},
+		text:    "text/event-stream",
+	},
+	{
+		id: "validateNodes", method: http.MethodPost, path: "/api/validate",
+		summary: "Check that nodes exist and read their data type and access",
+		request: struct {
+			Nodes   []string `json:"nodes"`
+			Timeout string   `json:"timeout,omitempty"`
+		}{},
+		response: struct {
+			Results []plcclient.NodeCheck `json:"results"`
+			Error   string                `json:"error,omitempty"`
+		}{},
+	},
+	{
+		id: "getFaults", method: http.MethodGet, path: "/api/debug/faults",
+		summary:  "Injected faults",
+		response: apiFaults{},
+		debug:    true,
+	},
+	{
+		id: "injectFaults", method: http.MethodPost, path: "/api/debug/faults",
+		summary: "Drop responses, delay reads, reject writes or force a reconnect",
+		request: struct {
+			Drop         int    `json:"drop,omitempty"`
+			ReadDelay    string `json:"readDelay,omitempty"`
+			RejectWrites int    `json:"rejectWrites,omitempty"`
+			Reconnect    bool   `json:"reconnect,omitempty"`
+		}{},
+		response: apiFaults{},
+		debug:    true,
+	},
+	{
+		id: "clearFaults", method: http.MethodDelete, path: "/api/debug/faults",
+		summary:  "Clear the injected faults",
+		response: apiFaults{},
+		debug:    true,
+	},
+	{
+		id: "getRecent", method: http.MethodGet, path: "/api/recent",
+		summary: "Recent samples of a polled node, or without nodeid the nodes with recent samples",
+		params: []apiParam{
+			{name: "nodeid", in: "query"},
+			{name: "since", in: "query", description: "Time (RFC 3339) or age like 10m"},
+		},
+		response: struct {
+			NodeID  string   `json:"nodeId,omitempty"`
+			Samples []Sample `json:"samples,omitempty"`
+			Nodes   []struct {
+				NodeID  string `json:"nodeId"`
+				Samples int    `json:"samples"`
+			} `json:"nodes,omitempty"`
+			Size  int    `json:"size,omitempty"`
+			Error string `json:"error,omitempty"`
+		}{},
+	},
+	{
+		id: "getStats", method: http.MethodGet, path: "/api/stats",
+		summary: "Subscriptions and monitored items against the server's limits, storage, bandwidth and latency of the sinks",
+		response: struct {
+			Subscriptions  map[string]int         `json:"subscriptions"`
+			MonitoredItems map[string]int         `json:"monitoredItems"`
+			Storage        map[string]interface{} `json:"storage"`
+			Bandwidth      map[string]interface{} `json:"bandwidth"`
+			Latency        map[string]interface{} `json:"latency"`
+		}{},
+	},
+	{
+		id: "getUsage", method: http.MethodGet, path: "/api/usage",
+		summary: "Requests, reads, writes, errors and bytes of each API client (tenant or remote host) since the service started",
+		response: struct {
+			Since   time.Time     `json:"since"`
+			Clients []clientUsage `json:"clients"`
+		}{},
+	},
+	{
+		id: "getOpenAPI", method: http.MethodGet, path: "/api/openapi.json",
+		summary:  "This document",
+		response: map[string]interface{}{},
+	},
+	{
+		id: "readModbus", method: http.MethodGet, path: "/api/modbus",
+		summary: "Read points of a Modbus connection, neighbouring points in one request",
+		params: []apiParam{
+			{name: "point", in: "query", required: true, description: "unit/register-type/address[/type], e.g. 1/holding/100/float32; repeatable"},
+		},
+		response: struct {
+			Results []NodeResponse `json:"results"`
+			Error   string         `json:"error,omitempty"`
+		}{},
+	},
+	{
+		id: "writeModbus", method: http.MethodPost, path: "/api/modbus",
+		summary: "Write a coil or holding register point of a Modbus connection",
+		request: struct {
+			Point string `json:"point"` // e.g. 1/holding/100/float32
+			Value string `json:"value"` // Converted according to the point's type, 0 or 1 for coils
+		}{},
+		params:   []apiParam{permitParam},
+		response: NodeResponse{},
+	},
+	{
+		id: "readENIP", method: http.MethodGet, path: "/api/enip",
+		summary: "Read tags of an EtherNet/IP connection to a Logix controller",
+		params: []apiParam{
+			{name: "tag", in: "query", required: true, description: "Tag, e.g. Program:Main.Recipe[2].Setpoint; repeatable"},
+		},
+		response: struct {
+			Results []NodeResponse `json:"results"`
+			Error   string         `json:"error,omitempty"`
+		}{},
+	},
+	{
+		id: "writeENIP", method: http.MethodPost, path: "/api/enip",
+		summary: "Write a tag of an EtherNet/IP connection",
+		request: struct {
+			Tag      string `json:"tag"`
+			Value    string `json:"value"`
+			DataType string `json:"dataType,omitempty"` // BOOL, DINT, REAL, STRING, ...; read from the tag when empty
+		}{},
+		params:   []apiParam{permitParam},
+		response: NodeResponse{},
+	},
+	{
+		id: "readPoints", method: http.MethodGet, path: "/api/points",
+		summary: "Read references of a connection through its protocol backend (Modbus TCP, EtherNet/IP, ...)",
+		params: []apiParam{
+			{name: "ref", in: "query", required: true, description: "Reference in the backend's syntax, e.g. 1/holding/100/float32; repeatable"},
+			{name: "timeout", in: "query", description: "Duration like 5s, default 10s"},
+		},
+		response: struct {
+			Results []NodeResponse `json:"results"`
+			Error   string         `json:"error,omitempty"`
+		}{},
+	},
+	{
+		id: "writePoint", method: http.MethodPost, path: "/api/points",
+		summary: "Write a reference of a connection through its protocol backend",
+		request: struct {
+			Ref      string `json:"ref"`
+			Value    string `json:"value"`
+			DataType string `json:"dataType,omitempty"` // Left to the backend when empty
+			Timeout  string `json:"timeout,omitempty"`  // Duration like 5s, default 10s
+			Priority string `json:"priority,omitempty"` // high (default) or low
+		}{},
+		params:   []apiParam{permitParam},
+		response: NodeResponse{},
+	},
+	{
+		id: "browsePoints", method: http.MethodGet, path: "/api/points/browse",
+		summary: "List the references of a device, for backends that can browse",
+		params: []apiParam{
+			{name: "ref", in: "query", description: "Reference to start from, the root when empty"},
+			{name: "maxdepth", in: "query", typ: "integer", description: "Levels to browse, default 3"},
+		},
+		response: struct {
+			Nodes []BrowseNode `json:"nodes"`
+			Error string       `json:"error,omitempty"`
+		}{},
+	},
+	{
+		id: "streamPoints", method: http.MethodGet, path: "/api/points/stream",
+		summary: "Changed values of references as server-sent values events, data is a JSON array of results",
+		params: []apiParam{
+			{name: "ref", in: "query", required: true, description: "Reference in the backend's syntax; repeatable"},
+			{name: "interval", in: "query", description: "How often values are checked, default 1s, at least 100ms"},
+		},
+		text: "text/event-stream",
+	},
+	{
+		id: "requestPermit", method: http.MethodPost, path: "/api/permits",
+		summary:  "Request a time-limited write permit, logged with its reason",
+		request:  permitRequest{},
+		response: apiPermit{},
+	},
+	{
+		id: "listPermits", method: http.MethodGet, path: "/api/permits",
+		summary: "Active write permits, the earliest to expire first",
+		response: struct {
+			Permits []WritePermit `json:"permits"`
+			Error   string        `json:"error,omitempty"`
+		}{},
+	},
+	{
+		id: "getPermit", method: http.MethodGet, path: "/api/permits/{id}",
+		summary:  "Active write permit",
+		params:   []apiParam{{name: "id", in: "path", required: true}},
+		response: apiPermit{},
+	},
+	{
+		id: "revokePermit", method: http.MethodDelete, path: "/api/permits/{id}",
+		summary: "End a write permit before it expires",
+		params:  []apiParam{{name: "id", in: "path", required: true}},
+		response: struct {
+			Revoked string `json:"revoked,omitempty"`
+			Error   string `json:"error,omitempty"`
+		}{},
+	},
+	{
+		id: "requestApproval", method: http.MethodPost, path: "/api/approvals",
+		summary:  "Ask for a write of a node marked critical in the write policy, checked like a dry run and run once another tenant confirms it",
+		request:  approvalRequest{},
+		response: apiApproval{},
+	},
+	{
+		id: "listApprovals", method: http.MethodGet, path: "/api/approvals",
+		summary: "Writes of critical nodes waiting for a confirmation, the earliest to expire first",
+		response: struct {
+			Approvals []PendingWrite `json:"approvals"`
+			Error     string         `json:"error,omitempty"`
+		}{},
+	},
+	{
+		id: "getApproval", method: http.MethodGet, path: "/api/approvals/{id}",
+		summary:  "Write of a critical node waiting for a confirmation",
+		params:   []apiParam{{name: "id", in: "path", required: true}},
+		response: apiApproval{},
+	},
+	{
+		id: "confirmApproval", method: http.MethodPost, path: "/api/approvals/{id}/confirm",
+		summary: "Confirm a write requested by another tenant and run it",
+		params:  []apiParam{{name: "id", in: "path", required: true}, permitParam},
+		response: struct {
+			Approval PendingWrite `json:"approval"`
+			Result   NodeResponse `json:"result"`
+			Error    string       `json:"error,omitempty"`
+		}{},
+	},
+	{
+		id: "rejectApproval", method: http.MethodDelete, path: "/api/approvals/{id}",
+		summary: "Drop a write waiting for a confirmation",
+		params:  []apiParam{{name: "id", in: "path", required: true}},
+		response: struct {
+			Rejected string `json:"rejected,omitempty"`
+			Error    string `json:"error,omitempty"`
+		}{},
+	},
+	{
+		id: "getMaintenance", method: http.MethodGet, path: "/api/maintenance",
+		summary:  "Maintenance window of the connection",
+		response: apiMaintenance{},
+	},
+	{
+		id: "startMaintenance", method: http.MethodPost, path: "/api/maintenance",
+		summary:  "Mark the connection as under maintenance: values are tagged maintenance=true, writes rejected with 423 and alerts suppressed",
+		request:  maintenanceRequest{},
+		response: apiMaintenance{},
+	},
+	{
+		id: "endMaintenance", method: http.MethodDelete, path: "/api/maintenance",
+		summary: "End the maintenance window",
+		response: struct {
+			Ended Maintenance `json:"ended"`
+			Error string      `json:"error,omitempty"`
+		}{},
+	},
+	{
+		id: "listSchedules", method: http.MethodGet, path: "/api/schedules",
+		summary:  "Recurring writes of the service with their next and last runs",
+		response: apiSchedules{},
+	},
+	{
+		id: "importSchedules", method: http.MethodPut, path: "/api/schedules",
+		summary:  "Replace the recurring writes, run at low priority in the minutes their cron expressions match (local time)",
+		request:  schedulesRequest{},
+		response: apiSchedules{},
+	},
+	{
+		id: "clearSchedules", method: http.MethodDelete, path: "/api/schedules",
+		summary:  "Remove all recurring writes",
+		response: apiSchedules{},
+	},
+	{
+		id: "annotate", method: http.MethodPost, path: "/api/annotations",
+		summary: "Put a note of a person on the timeline of the connection, sent to the poll file's sinks as annotation line",
+		request: annotationRequest{},
+		response: struct {
+			Annotation Annotation `json:"annotation"`
+			Error      string     `json:"error,omitempty"`
+		}{},
+	},
+	{
+		id: "listAnnotations", method: http.MethodGet, path: "/api/annotations",
+		summary: "Recent annotations, oldest first",
+		params:  []apiParam{{name: "since", in: "query", description: "RFC 3339 time or duration back from now, e.g. 1h"}},
+		response: struct {
+			Annotations []Annotation `json:"annotations"`
+			Error       string       `json:"error,omitempty"`
+		}{},
+	},
+	{
+		id: "getInfo", method: http.MethodGet, path: "/api/info",
+		summary: "Connection of this service",
+		response: struct {
+			Connection  string            `json:"connection"`
+			Port        int               `json:"port"`
+			Endpoint    string            `json:"endpoint"`
+			Protocol    string            `json:"protocol,omitempty"` // Scheme of the backend, e.g. modbus or enip
+			Status      string            `json:"status"`
+			Limits      operationLimits   `json:"limits"`
+			Tenant      string            `json:"tenant,omitempty"`
+			Labels      map[string]string `json:"labels,omitempty"`
+			Maintenance *Maintenance      `json:"maintenance,omitempty"`
+			Namespaces  []string          `json:"namespaces,omitempty"` // Namespace array of the OPC UA server
+		}{},
+	},
+}
+
+// openAPIDocument returns the OpenAPI 3 document of the API served under
+// basePath
+func openAPIDocument(basePath string) map[string]interface{} {
+	schemas := &openAPISchemas{components: make(map[string]interface{})}
+	paths := make(map[string]map[string]interface{})
+	for _, op := range apiOperations {
+		if op.debug && serviceFaults == nil {
+			continue
+		}
+		if paths[op.path] == nil {
+			paths[op.path] = make(map[string]interface{})
+		}
+		paths[op.path][strings.ToLower(op.method)] = op.document(schemas)
+	}
+
+	server := basePath
+	if server == "" {
+		server = "/"
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "plccli service API",
+			"version":     buildVersion,
+			"description": "HTTP API of a plccli service connected to an OPC UA server. Most failures are reported with status 200 and an error field",
+		},
+		"servers": []map[string]string{{"url": server}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas.components,
+			"securitySchemes": map[string]interface{}{
+				"tenantToken": map[string]string{"type": "http", "scheme": "bearer", "description": "Token of a tenant, for services started with --tenants or --api-auth"},
+			},
+			"responses": map[string]interface{}{
+				"Unauthorized":    map[string]string{"description": "No token of a tenant of this connection, or a read-only tenant's write"},
+				"TooManyRequests": map[string]interface{}{"description": "Over a rate limit (--rate-limit, --max-ops)", "headers": headerSchemas(map[string]string{"Retry-After": "Seconds to wait"})},
+				"AuthUnavailable": map[string]string{"description": "The --api-auth hook could not check the token"},
+			},
+		},
+		// The token is optional, services without --tenants take any request
+		"security": []map[string][]string{{}, {"tenantToken": {}}},
+	}
+}
+
+// document returns the OpenAPI operation object
+func (op apiOperation) document(schemas *openAPISchemas) map[string]interface{} {
+	doc := map[string]interface{}{
+		"operationId": op.id,
+		"summary":     op.summary,
+	}
+	if len(op.params) > 0 {
+		params := make([]map[string]interface{}, 0, len(op.params))
+		for _, p := range op.params {
+			typ := p.typ
+			if typ == "" {
+				typ = "string"
+			}
+			param := map[string]interface{}{
+				"name":     p.name,
+				"in":       p.in,
+				"required": p.required,
+				"schema":   map[string]string{"type": typ},
+			}
+			if p.description != "" {
+				param["description"] = p.description
+			}
+			params = append(params, param)
+		}
+		doc["parameters"] = params
+	}
+	if op.request != nil {
+		doc["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": schemas.schema(reflect.TypeOf(op.request))}},
+		}
+	}
+
+	content := make(map[string]interface{})
+	if op.response != nil {
+		content["application/json"] = map[string]interface{}{"schema": schemas.schema(reflect.TypeOf(op.response))}
+	}
+	if op.text != "" {
+		content[op.text] = map[string]interface{}{"schema": map[string]string{"type": "string"}}
+	}
+	ok := map[string]interface{}{"description": "OK", "content": content}
+	if len(op.headers) > 0 {
+		ok["headers"] = headerSchemas(op.headers)
+	}
+	doc["responses"] = map[string]interface{}{
+		"200": ok,
+		"401": map[string]string{"$ref": "#/components/responses/Unauthorized"},
+		"429": map[string]string{"$ref": "#/components/responses/TooManyRequests"},
+		"503": map[string]string{"$ref": "#/components/responses/AuthUnavailable"},
+	}
+	return doc
+}
+
+// headerSchemas returns the OpenAPI header objects of response headers
+func headerSchemas(headers map[string]string) map[string]interface{} {
+	objects := make(map[string]interface{}, len(headers))
+	for name, description := range headers {
+		objects[name] = map[string]interface{}{
+			"description": description,
+			"schema":      map[string]string{"type": "string"},
+		}
+	}
+	return objects
+}
+
+// openAPISchemas generates the JSON schemas of Go types from their JSON
+// fields. Named struct types become components referenced with $ref
+type openAPISchemas struct {
+	components map[string]interface{}
+}
+
+// schema returns the schema of a type
+func (s *openAPISchemas) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": s.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" || strings.HasPrefix(t.Name(), "api") {
+			return s.object(t)
+		}
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if _, ok := s.components[name]; !ok {
+			s.components[name] = map[string]interface{}{} // Against recursive types
+			s.components[name] = s.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{} // interface{}: any value
+}
+
+// object returns the schema of a struct with its JSON fields as properties
+func (s *openAPISchemas) object(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	s.fields(t, properties)
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+// fields adds the JSON fields of a struct to properties, with the fields of
+// embedded structs
+func (s *openAPISchemas) fields(t reflect.Type, properties map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			s.fields(f.Type, properties)
+			continue
+		}
+		if !f.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = s.schema(f.Type)
+	}
+}
+
+// handleOpenAPIRequest serves the OpenAPI document of the API
+// (GET /api/openapi.json)
+func handleOpenAPIRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sendJSONResponseGeneric(w, openAPIDocument(serviceBasePath))
+}
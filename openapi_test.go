@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestOpenAPIRoutes tests that every route of registerHandlers is documented
+// and every documented path is served
+func TestOpenAPIRoutes(t *testing.T) {
+	serviceFaults = newFaultInjector()
+	defer func() { serviceFaults = nil }()
+
+	source, err := os.ReadFile("service.go")
+	require.NoError(t, err)
+	routes := regexp.MustCompile(`mux\.HandleFunc\("([^"]+)"`).FindAllStringSubmatch(string(source), -1)
+	require.NotEmpty(t, routes)
+
+	documented := make(map[string]bool)
+	for _, op := range apiOperations {
+		documented[op.path] = true
+	}
+	for _, route := range routes {
+		pattern := route[1]
+		found := documented[pattern]
+		for path := range documented {
+			// /api/jobs/ serves /api/jobs/{id} and /api/jobs/{id}/result
+			found = found || (strings.HasSuffix(pattern, "/") && strings.HasPrefix(path, pattern+"{"))
+		}
+		assert.True(t, found, "route %s is missing in apiOperations", pattern)
+	}
+
+	mux := http.NewServeMux()
+	registerHandlers(mux, "opc.tcp://plc:4840", 8765)
+	for path := range documented {
+		concrete := regexp.MustCompile(`\{[^}]+\}`).ReplaceAllString(path, "x")
+		_, pattern := mux.Handler(httptest.NewRequest(http.MethodGet, concrete, nil))
+		assert.NotEmpty(t, pattern, "documented path %s is not served", path)
+	}
+
+	doc := openAPIDocument("/plccli")
+	assert.Equal(t, "3.0.3", doc["openapi"])
+	assert.Equal(t, []map[string]string{{"url": "/plccli"}}, doc["servers"])
+	paths := doc["paths"].(map[string]map[string]interface{})
+	assert.Contains(t, paths["/api/node"], "get")
+	assert.Contains(t, paths["/api/node"], "post")
+	assert.Contains(t, paths, "/api/debug/faults")
+
+	serviceFaults = nil
+	assert.NotContains(t, openAPIDocument("")["paths"], "/api/debug/faults", "only with --debug-faults")
+}
+
+// TestOpenAPIResponses tests that the handlers that need no PLC answer with
+// the fields of their documented response schema
+func TestOpenAPIResponses(t *testing.T) {
+	serviceFaults = newFaultInjector()
+	defer func() { serviceFaults = nil }()
+
+	mux := http.NewServeMux()
+	registerHandlers(mux, "opc.tcp://plc:4840", 8765)
+	schemas := &openAPISchemas{components: make(map[string]interface{})}
+
+	for _, op := range apiOperations {
+		if op.method != http.MethodGet || op.response == nil || strings.Contains(op.path, "{") ||
+			op.path == "/api/browse" || op.path == "/api/node" || op.path == "/api/openapi.json" {
+			continue
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, op.path, nil))
+		require.Equal(t, http.StatusOK, rec.Code, op.path)
+
+		var body map[string]json.RawMessage
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body), op.path)
+		properties := op.document(schemas)["responses"].(map[string]interface{})["200"].(map[string]interface{})["content"].(map[string]interface{})["application/json"].(map[string]interface{})["schema"].(map[string]interface{})["properties"].(map[string]interface{})
+		for field := range body {
+			assert.Contains(t, properties, field, "%s answers with an undocumented field", op.path)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/openapi.json", nil))
+	var doc struct {
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas map[string]json.RawMessage `json:"schemas"`
+		} `json:"components"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &doc))
+	assert.Contains(t, doc.Paths["/api/polls/{id}"], "delete")
+	assert.Contains(t, doc.Components.Schemas, "NodeResponse")
+	assert.Contains(t, string(doc.Components.Schemas["PollInfo"]), `"interval"`, "fields of embedded structs")
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// operationRegistry keeps track of long-running service operations (browses)
+// so they can be listed and cancelled through the API by the tenant that
+// started them. Queued writes have their own IDs in the write queue
+type operationRegistry struct {
+	mu     sync.Mutex
+	ops    map[string]*operation
+	order  []string
+	nextID int
+}
+
+type operation struct {
+	id      string
+	kind    string
+	target  string
+	started time.Time
+	owner   string // identity of the tenant that started it, "" without tenants
+	cancel  context.CancelFunc
+}
+
+// OperationInfo is the API representation of a running or queued operation
+type OperationInfo struct {
+	ID      string    `json:"id"`
+	Kind    string    `json:"kind"`   // browse, write or bit
+	Target  string    `json:"target"` // Node ID the operation works on
+	Started time.Time `json:"started"`
+	State   string    `json:"state"` // running or queued
+}
+
+// Global operation registry for service mode
+var serviceOperations = newOperationRegistry()
+
+// operationIDHeader carries the operation ID of a long-running request
+const operationIDHeader = "X-Operation-ID"
+
+func newOperationRegistry() *operationRegistry {
+	return &operationRegistry{ops: make(map[string]*operation)}
+}
+
+// start registers an operation of a tenant, by its identity, and returns its
+// ID and a context that is cancelled when the operation is cancelled through
+// the API. Call done when the operation has finished
+func (reg *operationRegistry) start(parent context.Context, kind, target, owner string) (string, context.Context) {
+	ctx, cancel := context.WithCancel(parent)
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.nextID++
+	op := &operation{
+		id:      fmt.Sprintf("%c-%d", kind[0], reg.nextID),
+		kind:    kind,
+		target:  target,
+		started: time.Now(),
+		owner:   owner,
+		cancel:  cancel,
+	}
+	reg.ops[op.id] = op
+	reg.order = append(reg.order, op.id)
+	return op.id, ctx
+}
+
+// done removes a finished operation
+func (reg *operationRegistry) done(opID string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	op, ok := reg.ops[opID]
+	if !ok {
+		return
+	}
+	op.cancel()
+	delete(reg.ops, opID)
+	for i, id := range reg.order {
+		if id == opID {
+			reg.order = append(reg.order[:i], reg.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// cancel cancels the context of a running operation of a tenant, see
+// ownedBy
+func (reg *operationRegistry) cancel(opID, tenant string) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	op, ok := reg.ops[opID]
+	if !ok || !ownedBy(op.owner, tenant) {
+		return fmt.Errorf("unknown operation %s", opID)
+	}
+	op.cancel()
+	return nil
+}
+
+// snapshot lists the running operations of a tenant in start order, see
+// ownedBy
+func (reg *operationRegistry) snapshot(tenant string) []OperationInfo {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	result := make([]OperationInfo, 0, len(reg.order))
+	for _, opID := range reg.order {
+		op := reg.ops[opID]
+		if !ownedBy(op.owner, tenant) {
+			continue
+		}
+		result = append(result, OperationInfo{
+			ID:      op.id,
+			Kind:    op.kind,
+			Target:  op.target,
+			Started: op.started,
+			State:   "running",
+		})
+	}
+	return result
+}
+
+// ownedBy reports whether an operation of owner is one of tenant's, both by
+// the identity of the tenant. Other tenants neither see nor cancel it; ""
+// for tenant, the service's own calls and those without tenants, owns all
+func ownedBy(owner, tenant string) bool {
+	return tenant == "" || owner == tenant
+}
+
+// cancelOperation cancels a queued write or a running operation of a tenant
+// by ID
+func cancelOperation(opID, tenant string) error {
+	if strings.HasPrefix(opID, "w-") {
+		return serviceWrites.cancel(opID, tenant)
+	}
+	return serviceOperations.cancel(opID, tenant)
+}
+
+// handleOperationsRequest lists the operations of the request's tenant on
+// GET /api/operations and cancels one on DELETE /api/operations/<id>
+func handleOperationsRequest(w http.ResponseWriter, r *http.Request) {
+	opID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/operations"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && opID == "":
+		operations := serviceOperations.snapshot(tenantIdentity(r))
+		for _, write := range serviceWrites.snapshot(tenantIdentity(r)) {
+			operations = append(operations, OperationInfo{
+				ID:      write.ID,
+				Kind:    write.Kind,
+				Target:  write.NodeID,
+				Started: write.QueuedAt,
+				State:   write.State,
+			})
+		}
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"operations": operations,
+		})
+
+	case r.Method == http.MethodDelete && opID != "":
+		if err := cancelOperation(opID, tenantIdentity(r)); err != nil {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": err.Error(),
+			})
+			return
+		}
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"cancelled": opID,
+		})
+
+	default:
+		http.Error(w, "Method not allowed, use GET /api/operations or DELETE /api/operations/<id>", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestOperationRegistry tests listing, cancelling and finishing operations,
+// each tenant only its own
+func TestOperationRegistry(t *testing.T) {
+	reg := newOperationRegistry()
+
+	browseID, ctx := reg.start(context.Background(), "browse", "ns=3;s=Line1", "file:acme")
+	otherID, _ := reg.start(context.Background(), "browse", "i=84", "file:globex")
+	assert.Equal(t, "b-1", browseID)
+
+	ops := reg.snapshot("")
+	require.Len(t, ops, 2)
+	assert.Equal(t, "ns=3;s=Line1", ops[0].Target)
+	assert.Equal(t, "running", ops[0].State)
+	ops = reg.snapshot("file:acme")
+	require.Len(t, ops, 1)
+	assert.Equal(t, browseID, ops[0].ID)
+	assert.Empty(t, reg.snapshot("jwt:acme"), "a tenant of another source is someone else")
+
+	assert.EqualError(t, reg.cancel(browseID, "file:globex"), "unknown operation "+browseID)
+	assert.NoError(t, ctx.Err())
+	require.NoError(t, reg.cancel(browseID, "file:acme"))
+	assert.Equal(t, context.Canceled, ctx.Err())
+
+	reg.done(browseID)
+	assert.Error(t, reg.cancel(browseID, ""))
+	ops = reg.snapshot("")
+	require.Len(t, ops, 1)
+	assert.Equal(t, otherID, ops[0].ID)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Duration of plccli permit request, from its --duration flag
+var permitDuration time.Duration
+
+// runPermitCommand runs permit request, list or revoke against the service
+func runPermitCommand(args []string, host string, port int) (string, error) {
+	if len(args) < 1 {
+		return "", fmt.Errorf("missing permit command: request, list or revoke")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client := newServiceClient(host, port)
+
+	switch args[0] {
+	case "request":
+		reason := strings.Join(args[1:], " ")
+		if strings.TrimSpace(reason) == "" {
+			return "", fmt.Errorf("permit request needs a reason, e.g. plccli permit request \"adjust setpoints for batch 42\"")
+		}
+		permit, err := client.RequestPermit(ctx, reason, permitDuration)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s\nWrite permit valid until %s (via %s:%d); pass it with --permit or $PLCCLI_PERMIT",
+			permit.ID, permit.Expires.Local().Format(time.RFC3339), host, port), nil
+
+	case "list":
+		permits, err := client.Permits(ctx)
+		if err != nil {
+			return "", err
+		}
+		return formatPermits(permits, time.Now()), nil
+
+	case "revoke":
+		if len(args) != 2 {
+			return "", fmt.Errorf("permit revoke needs a permit ID")
+		}
+		if err := client.RevokePermit(ctx, args[1]); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Revoked write permit %s (via %s:%d)", args[1], host, port), nil
+	}
+	return "", fmt.Errorf("unknown permit command %s, expected request, list or revoke", args[0])
+}
+
+// formatPermits lists permits one per line with their remaining time
+func formatPermits(permits []WritePermit, now time.Time) string {
+	if len(permits) == 0 {
+		return "No active write permits"
+	}
+	var lines []string
+	for _, p := range permits {
+		line := fmt.Sprintf("%s  %s left", p.ID, p.Expires.Sub(now).Round(time.Second))
+		if p.Tenant != "" {
+			line += "  " + p.Tenant
+		}
+		lines = append(lines, line+"  "+p.Reason)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// permitHeader carries the write permit of a write request
+const permitHeader = "X-Write-Permit"
+
+// permitRegistry holds the write permits of a service started with
+// --write-permits. Writes to the PLC need an active permit of the tenant
+// next to its token, so every remote write is preceded by an explicit,
+// logged request stating why
+type permitRegistry struct {
+	mu          sync.Mutex
+	maxDuration time.Duration // longest permit that is issued
+	permits     map[string]WritePermit
+	now         func() time.Time // replaced in tests
+}
+
+// Write permits of this service, nil when writes need none
+var servicePermits *permitRegistry
+
+// newPermitRegistry creates a registry issuing permits of up to maxDuration
+func newPermitRegistry(maxDuration time.Duration) (*permitRegistry, error) {
+	if maxDuration <= 0 {
+		return nil, fmt.Errorf("the longest permit must be positive, got %v", maxDuration)
+	}
+	return &permitRegistry{
+		maxDuration: maxDuration,
+		permits:     make(map[string]WritePermit),
+		now:         time.Now,
+	}, nil
+}
+
+// issue creates a permit for a tenant. A zero duration issues the longest
+// permit allowed
+func (reg *permitRegistry) issue(tenant, reason string, duration time.Duration) (WritePermit, error) {
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return WritePermit{}, fmt.Errorf("a write permit needs a reason")
+	}
+	if duration == 0 {
+		duration = reg.maxDuration
+	}
+	if duration < 0 || duration > reg.maxDuration {
+		return WritePermit{}, fmt.Errorf("permit duration must be between 0 and %v, got %v", reg.maxDuration, duration)
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return WritePermit{}, fmt.Errorf("failed to create permit ID: %v", err)
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	now := reg.now()
+	reg.expire(now)
+	permit := WritePermit{
+		ID:      hex.EncodeToString(id),
+		Tenant:  tenant,
+		Reason:  reason,
+		Issued:  now.UTC(),
+		Expires: now.Add(duration).UTC(),
+	}
+	reg.permits[permit.ID] = permit
+	return permit, nil
+}
+
+// check returns an error unless id is an active permit of the tenant
+func (reg *permitRegistry) check(id, tenant string) error {
+	if id == "" {
+		return fmt.Errorf("writes need an active write permit (--permit)")
+	}
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	permit, ok := reg.permits[id]
+	if !ok || permit.Tenant != tenant {
+		return fmt.Errorf("unknown write permit %s", id)
+	}
+	if !reg.now().Before(permit.Expires) {
+		delete(reg.permits, id)
+		return fmt.Errorf("write permit %s expired at %s", id, permit.Expires.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// active returns the permits of a tenant that have not expired, the
+// earliest to expire first. Without tenants ("") it returns all of them
+func (reg *permitRegistry) active(tenant string) []WritePermit {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.expire(reg.now())
+	permits := []WritePermit{}
+	for _, permit := range reg.permits {
+		if tenant == "" || permit.Tenant == tenant {
+			permits = append(permits, permit)
+		}
+	}
+	sort.Slice(permits, func(i, j int) bool {
+		return permits[i].Expires.Before(permits[j].Expires)
+	})
+	return permits
+}
+
+// revoke ends a permit of a tenant before it expires
+func (reg *permitRegistry) revoke(id, tenant string) (WritePermit, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	permit, ok := reg.permits[id]
+	if !ok || permit.Tenant != tenant {
+		return WritePermit{}, fmt.Errorf("unknown write permit %s", id)
+	}
+	delete(reg.permits, id)
+	return permit, nil
+}
+
+// expire drops the permits that expired by now. The caller holds mu
+func (reg *permitRegistry) expire(now time.Time) {
+	for id, permit := range reg.permits {
+		if !now.Before(permit.Expires) {
+			delete(reg.permits, id)
+		}
+	}
+}
+
+// isPLCWrite reports whether a request writes to the PLC: node writes, bit
+// writes, Modbus, EtherNet/IP and backend writes, confirmations of
+// approvals, which run the write, and changes of the write schedules, which
+// write later
+func isPLCWrite(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/api/node", "/api/bit", "/api/modbus", "/api/enip", "/api/points":
+		return r.Method == http.MethodPost
+	case "/api/schedules":
+		return r.Method == http.MethodPut || r.Method == http.MethodDelete
+	}
+	return r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/api/approvals/") && strings.HasSuffix(r.URL.Path, "/confirm")
+}
+
+// middleware answers PLC writes without an active permit of the request's
+// tenant, by its identity, with 403 Forbidden. It sits behind the tenant check, which has
+// already made sure the tenant may write. A nil registry lets every request
+// through
+func (reg *permitRegistry) middleware(next http.Handler) http.Handler {
+	if reg == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPLCWrite(r) {
+			if err := reg.check(r.Header.Get(permitHeader), tenantIdentity(r)); err != nil {
+				log.Printf("[%s] Write rejected for %s: %v", connectionName, permitHolder(r), err)
+				http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// permitHolder names who requested or used a permit in the service log
+func permitHolder(r *http.Request) string {
+	if name := tenantName(r); name != "" {
+		return "tenant " + name
+	}
+	return r.RemoteAddr
+}
+
+// permitRequest is the body of POST /api/permits
+type permitRequest struct {
+	Reason   string `json:"reason"`
+	Duration string `json:"duration,omitempty"` // Go duration, the longest permit when empty
+}
+
+// handlePermitsRequest lists (GET /api/permits), requests (POST
+// /api/permits), shows (GET /api/permits/<id>) and revokes (DELETE
+// /api/permits/<id>) write permits. Tenants only see their own permits
+func handlePermitsRequest(w http.ResponseWriter, r *http.Request) {
+	if servicePermits == nil {
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"error": "write permits are not enabled, start the service with --write-permits",
+		})
+		return
+	}
+	permitID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/permits"), "/")
+	tenant := tenantIdentity(r)
+
+	switch {
+	case permitID == "" && r.Method == http.MethodPost:
+		var req permitRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": fmt.Sprintf("Failed to parse request: %v", err),
+			})
+			return
+		}
+		var duration time.Duration
+		if req.Duration != "" {
+			var err error
+			if duration, err = time.ParseDuration(req.Duration); err != nil {
+				sendJSONResponseGeneric(w, map[string]interface{}{
+					"error": fmt.Sprintf("invalid duration %q: %v", req.Duration, err),
+				})
+				return
+			}
+		}
+		permit, err := servicePermits.issue(tenant, req.Reason, duration)
+		if err != nil {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": err.Error(),
+			})
+			return
+		}
+		log.Printf("[%s] Write permit %s issued to %s until %s: %s", connectionName, permit.ID, permitHolder(r),
+			permit.Expires.Format(time.RFC3339), permit.Reason)
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"permit": permit,
+		})
+
+	case permitID == "" && r.Method == http.MethodGet:
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"permits": servicePermits.active(tenant),
+		})
+
+	case permitID != "" && r.Method == http.MethodGet:
+		for _, permit := range servicePermits.active(tenant) {
+			if permit.ID == permitID {
+				sendJSONResponseGeneric(w, map[string]interface{}{
+					"permit": permit,
+				})
+				return
+			}
+		}
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"error": fmt.Sprintf("unknown write permit %s", permitID),
+		})
+
+	case permitID != "" && r.Method == http.MethodDelete:
+		permit, err := servicePermits.revoke(permitID, tenant)
+		if err != nil {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": err.Error(),
+			})
+			return
+		}
+		log.Printf("[%s] Write permit %s revoked by %s", connectionName, permit.ID, permitHolder(r))
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"revoked": permit.ID,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPermitRegistry tests issuing, checking, expiring and revoking permits
+func TestPermitRegistry(t *testing.T) {
+	_, err := newPermitRegistry(0)
+	assert.Error(t, err)
+
+	reg, err := newPermitRegistry(15 * time.Minute)
+	require.NoError(t, err)
+	now := time.Date(2026, 5, 4, 8, 0, 0, 0, time.UTC)
+	reg.now = func() time.Time { return now }
+
+	_, err = reg.issue("acme", " ", 0)
+	assert.Error(t, err, "no reason")
+	_, err = reg.issue("acme", "setpoints", time.Hour)
+	assert.Error(t, err, "longer than allowed")
+
+	permit, err := reg.issue("acme", "setpoints", 0)
+	require.NoError(t, err)
+	assert.Len(t, permit.ID, 32)
+	assert.Equal(t, now.Add(15*time.Minute), permit.Expires)
+	short, err := reg.issue("acme", "jog axis", 5*time.Minute)
+	require.NoError(t, err)
+
+	assert.NoError(t, reg.check(permit.ID, "acme"))
+	assert.Error(t, reg.check(permit.ID, "globex"), "other tenant")
+	assert.Error(t, reg.check("", "acme"))
+	assert.Equal(t, []WritePermit{short, permit}, reg.active("acme"))
+	assert.Empty(t, reg.active("globex"))
+
+	now = now.Add(5 * time.Minute)
+	assert.ErrorContains(t, reg.check(short.ID, "acme"), "expired")
+	assert.Equal(t, []WritePermit{permit}, reg.active("acme"))
+
+	_, err = reg.revoke(permit.ID, "globex")
+	assert.Error(t, err)
+	_, err = reg.revoke(permit.ID, "acme")
+	require.NoError(t, err)
+	assert.Error(t, reg.check(permit.ID, "acme"))
+}
+
+// TestPermitMiddleware tests that writes need an active permit of their
+// tenant while reads and permit requests do not
+func TestPermitMiddleware(t *testing.T) {
+	tenants := &tenantRegistry{tenants: []*tenant{
+		{Name: "acme", Token: "acme-token", Access: "write", source: "file"},
+		{Name: "globex", Token: "globex-token", Access: "write", source: "file"},
+	}}
+	reg, err := newPermitRegistry(time.Hour)
+	require.NoError(t, err)
+	defer func(permits *permitRegistry) { servicePermits = permits }(servicePermits)
+	servicePermits = reg
+
+	written := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/permits", handlePermitsRequest)
+	mux.HandleFunc("/api/permits/", handlePermitsRequest)
+	mux.HandleFunc("/api/node", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			written++
+		}
+	})
+	handler := tenants.middleware(reg.middleware(mux))
+
+	do := func(method, path, token, permit, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		if permit != "" {
+			r.Header.Set(permitHeader, permit)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/api/node", "acme-token", "", "").Code)
+	w := do(http.MethodPost, "/api/node", "acme-token", "", `{}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "write permit")
+
+	w = do(http.MethodPost, "/api/permits", "acme-token", "", `{"reason":"tune PID","duration":"10m"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		Permit WritePermit `json:"permit"`
+		Error  string      `json:"error"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Empty(t, resp.Error)
+	assert.Equal(t, "file:acme", resp.Permit.Tenant)
+	assert.Equal(t, "tune PID", resp.Permit.Reason)
+
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/api/node", "acme-token", resp.Permit.ID, `{}`).Code)
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPost, "/api/node", "globex-token", resp.Permit.ID, `{}`).Code)
+	assert.Equal(t, 1, written)
+
+	assert.Contains(t, do(http.MethodGet, "/api/permits", "acme-token", "", "").Body.String(), resp.Permit.ID)
+	assert.NotContains(t, do(http.MethodGet, "/api/permits", "globex-token", "", "").Body.String(), resp.Permit.ID)
+	assert.Contains(t, do(http.MethodPost, "/api/permits", "acme-token", "", `{"reason":"x","duration":"2h"}`).Body.String(), "error")
+
+	assert.Contains(t, do(http.MethodDelete, "/api/permits/"+resp.Permit.ID, "acme-token", "", "").Body.String(), `"revoked"`)
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPost, "/api/node", "acme-token", resp.Permit.ID, `{}`).Code)
+}
+
+// TestPermitClient tests requesting, using and revoking a permit with the
+// client library
+func TestPermitClient(t *testing.T) {
+	reg, err := newPermitRegistry(time.Hour)
+	require.NoError(t, err)
+	defer func(permits *permitRegistry) { servicePermits = permits }(servicePermits)
+	servicePermits = reg
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/permits", handlePermitsRequest)
+	mux.HandleFunc("/api/permits/", handlePermitsRequest)
+	mux.HandleFunc("/api/modbus", func(w http.ResponseWriter, r *http.Request) {
+		sendJSONResponse(w, NodeResponse{NodeID: "1/holding/100", Value: "1"})
+	})
+	server := httptest.NewServer(reg.middleware(mux))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	client := newServiceClient(u.Hostname(), port)
+	_, err = client.WriteModbus(ctx, "1/holding/100", "1")
+	assert.ErrorContains(t, err, "write permit")
+
+	permit, err := client.RequestPermit(ctx, "commissioning", 20*time.Minute)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(20*time.Minute), permit.Expires, time.Minute)
+	client.WithPermit(permit.ID)
+	_, err = client.WriteModbus(ctx, "1/holding/100", "1")
+	assert.NoError(t, err)
+
+	permits, err := client.Permits(ctx)
+	require.NoError(t, err)
+	require.Len(t, permits, 1)
+	assert.Equal(t, "commissioning", permits[0].Reason)
+	assert.Contains(t, formatPermits(permits, time.Now()), "commissioning")
+
+	require.NoError(t, client.RevokePermit(ctx, permit.ID))
+	_, err = client.WriteModbus(ctx, "1/holding/100", "1")
+	assert.Error(t, err)
+}
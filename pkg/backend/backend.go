@@ -0,0 +1,182 @@
+// Package backend defines the interface of protocol backends and a registry
+// of them by endpoint scheme.
+//
+// The service serves every registered backend like its built-in Modbus TCP
+// and EtherNet/IP connections: reads and writes through /api/points, the
+// poll file, tenants, permits and the other middleware. A backend in its own
+// package registers itself in an init function and is linked in with a blank
+// import in the plccli main package:
+//
+//	func init() {
+//		backend.Register("s7", "Siemens S7", func(endpoint string, opts backend.Options) (backend.Backend, error) {
+//			return newS7(endpoint, opts.Timeout)
+//		})
+//	}
+//
+// OPC UA is not a backend of the registry: its service manages sessions,
+// security, certificates and subscriptions of its own.
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"umicli/pkg/plcclient"
+)
+
+// ErrNotSupported is returned by backends for operations their protocol
+// lacks, e.g. Browse of Modbus devices
+var ErrNotSupported = errors.New("not supported by this backend")
+
+// Backend reads and writes the values of a device. Values are addressed by
+// references in the backend's own syntax, e.g. 1/holding/100/float32 for
+// Modbus or Program:Main.Counter for EtherNet/IP. Implementations must be
+// safe for concurrent use
+type Backend interface {
+	// Connect opens the connection to the device. Backends may connect
+	// lazily, and must reconnect after errors on their own
+	Connect(ctx context.Context) error
+	// Read reads values, one result per reference in order, with
+	// RequestedNodeID set to the reference. Failures of single references
+	// are reported in the Error field, the error is for failed requests
+	Read(ctx context.Context, refs []string) ([]plcclient.NodeResponse, error)
+	// Write writes a value, converted to dataType or to the type of the
+	// value when dataType is empty. The result holds the data type written
+	Write(ctx context.Context, ref, value, dataType string) (plcclient.NodeResponse, error)
+	// Browse lists the values below a reference, the root when empty, down
+	// to maxDepth levels, or returns ErrNotSupported
+	Browse(ctx context.Context, ref string, maxDepth int) ([]plcclient.BrowseNode, error)
+	// Subscribe calls fn with the values of refs when they change, at most
+	// every interval, until ctx is done. Backends without subscriptions
+	// use Poll
+	Subscribe(ctx context.Context, refs []string, interval time.Duration, fn func([]plcclient.NodeResponse)) error
+	// Close closes the connection
+	Close() error
+}
+
+// Options of a backend connection, from the plccli flags
+type Options struct {
+	Timeout time.Duration // of a request, --timeout
+	Verbose bool
+}
+
+// Factory creates the backend of an endpoint. It should check the endpoint
+// but not connect yet
+type Factory func(endpoint string, opts Options) (Backend, error)
+
+// Registration is a registered backend
+type Registration struct {
+	Scheme  string // URL scheme of its endpoints, e.g. modbus
+	Name    string // for logs and usage, e.g. Modbus TCP
+	Factory Factory
+}
+
+var (
+	mu       sync.RWMutex
+	registry = make(map[string]Registration)
+)
+
+// Register adds a backend for endpoints of a URL scheme. It panics if the
+// scheme is taken, like two backends linked in for the same protocol
+func Register(scheme, name string, factory Factory) {
+	scheme = strings.ToLower(scheme)
+	if scheme == "" || factory == nil {
+		panic("backend: Register needs a scheme and a factory")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := registry[scheme]; ok {
+		panic(fmt.Sprintf("backend: scheme %s registered twice", scheme))
+	}
+	registry[scheme] = Registration{Scheme: scheme, Name: name, Factory: factory}
+}
+
+// Lookup returns the backend registered for the scheme of an endpoint
+func Lookup(endpoint string) (Registration, bool) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme == "" {
+		return Registration{}, false
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	reg, ok := registry[strings.ToLower(u.Scheme)]
+	return reg, ok
+}
+
+// Open creates the backend of an endpoint with the factory registered for
+// its scheme
+func Open(endpoint string, opts Options) (Backend, error) {
+	reg, ok := Lookup(endpoint)
+	if !ok {
+		return nil, fmt.Errorf("no backend for endpoint %q, known schemes: %s", endpoint, strings.Join(Schemes(), ", "))
+	}
+	return reg.Factory(endpoint, opts)
+}
+
+// Schemes returns the registered schemes, sorted
+func Schemes() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	schemes := make([]string, 0, len(registry))
+	for scheme := range registry {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Registrations returns the registered backends, sorted by scheme
+func Registrations() []Registration {
+	mu.RLock()
+	defer mu.RUnlock()
+	regs := make([]Registration, 0, len(registry))
+	for _, reg := range registry {
+		regs = append(regs, reg)
+	}
+	sort.Slice(regs, func(i, j int) bool { return regs[i].Scheme < regs[j].Scheme })
+	return regs
+}
+
+// Poll implements Subscribe by reading refs every interval and calling fn
+// with the results whose value or error changed since the last read; the
+// first read passes all of them. Failed reads are tried again at the next
+// interval. It returns when ctx is done
+func Poll(ctx context.Context, b Backend, refs []string, interval time.Duration, fn func([]plcclient.NodeResponse)) error {
+	if interval <= 0 {
+		return fmt.Errorf("interval must be positive, got %v", interval)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := make(map[string]string, len(refs))
+	for {
+		results, err := b.Read(ctx, refs)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == nil {
+			var changed []plcclient.NodeResponse
+			for _, result := range results {
+				key := fmt.Sprintf("%v|%s", result.Value, result.Error)
+				if prev, ok := last[result.RequestedNodeID]; ok && prev == key {
+					continue
+				}
+				last[result.RequestedNodeID] = key
+				changed = append(changed, result)
+			}
+			if len(changed) > 0 {
+				fn(changed)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
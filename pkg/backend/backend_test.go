@@ -0,0 +1,125 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"umicli/pkg/plcclient"
+)
+
+// counterBackend counts up the value of every reference on each read, or
+// fails reads while failing is set
+type counterBackend struct {
+	mu      sync.Mutex
+	reads   int
+	failing bool
+}
+
+func (b *counterBackend) Connect(ctx context.Context) error { return nil }
+
+func (b *counterBackend) Read(ctx context.Context, refs []string) ([]plcclient.NodeResponse, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failing {
+		return nil, fmt.Errorf("device unreachable")
+	}
+	b.reads++
+	results := make([]plcclient.NodeResponse, len(refs))
+	for i, ref := range refs {
+		results[i] = plcclient.NodeResponse{NodeID: ref, RequestedNodeID: ref, Value: b.reads / 2}
+	}
+	return results, nil
+}
+
+func (b *counterBackend) Write(ctx context.Context, ref, value, dataType string) (plcclient.NodeResponse, error) {
+	return plcclient.NodeResponse{}, ErrNotSupported
+}
+
+func (b *counterBackend) Browse(ctx context.Context, ref string, maxDepth int) ([]plcclient.BrowseNode, error) {
+	return nil, ErrNotSupported
+}
+
+func (b *counterBackend) Subscribe(ctx context.Context, refs []string, interval time.Duration, fn func([]plcclient.NodeResponse)) error {
+	return Poll(ctx, b, refs, interval, fn)
+}
+
+func (b *counterBackend) Close() error { return nil }
+
+// TestRegistry tests registering backends and looking them up by the
+// scheme of endpoints
+func TestRegistry(t *testing.T) {
+	Register("Test-Counter", "Counter", func(endpoint string, opts Options) (Backend, error) {
+		return &counterBackend{}, nil
+	})
+
+	reg, ok := Lookup("test-counter://device:1234?x=1")
+	require.True(t, ok)
+	assert.Equal(t, "test-counter", reg.Scheme)
+	assert.Equal(t, "Counter", reg.Name)
+	assert.Contains(t, Schemes(), "test-counter")
+	names := map[string]string{}
+	for _, reg := range Registrations() {
+		names[reg.Scheme] = reg.Name
+	}
+	assert.Equal(t, "Counter", names["test-counter"])
+
+	_, ok = Lookup("opc.tcp://plc:4840")
+	assert.False(t, ok)
+	_, ok = Lookup("device:1234")
+	assert.False(t, ok)
+
+	b, err := Open("TEST-COUNTER://device", Options{Timeout: time.Second})
+	require.NoError(t, err)
+	assert.IsType(t, &counterBackend{}, b)
+	_, err = Open("s7://plc", Options{})
+	assert.ErrorContains(t, err, "test-counter")
+
+	assert.Panics(t, func() {
+		Register("test-counter", "Counter", func(string, Options) (Backend, error) { return nil, nil })
+	})
+	assert.Panics(t, func() { Register("", "None", nil) })
+}
+
+// TestPoll tests that polling passes the first values, then only changed
+// ones, and goes on after failed reads
+func TestPoll(t *testing.T) {
+	b := &counterBackend{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	updates := make(chan []plcclient.NodeResponse, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- b.Subscribe(ctx, []string{"a", "b"}, 10*time.Millisecond, func(results []plcclient.NodeResponse) {
+			updates <- results
+		})
+	}()
+
+	first := <-updates
+	require.Len(t, first, 2)
+	assert.Equal(t, 0, first[0].Value)
+
+	// Reads 2 and 3 have the value 1, the second is no change
+	second := <-updates
+	assert.Equal(t, 1, second[0].Value)
+	b.mu.Lock()
+	b.failing = true
+	b.mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, updates)
+	b.mu.Lock()
+	b.failing = false
+	b.mu.Unlock()
+	third := <-updates
+	assert.Equal(t, 2, third[1].Value)
+
+	cancel()
+	assert.NoError(t, <-done)
+	assert.Error(t, Poll(context.Background(), b, []string{"a"}, 0, nil))
+}
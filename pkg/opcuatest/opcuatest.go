@@ -0,0 +1,329 @@
+// Package opcuatest runs OPC UA test servers in Docker containers and plccli
+// services against them, for end-to-end tests without lab hardware.
+//
+//	func TestRead(t *testing.T) {
+//		server := opcuatest.StartServer(t, opcuatest.Python)
+//		cli := opcuatest.BuildCLI(t, "umicli")
+//		svc := opcuatest.StartService(t, cli, server.Endpoint)
+//		out, err := svc.Run("opcua", "get", opcuatest.Node("Temperature"))
+//		...
+//	}
+//
+// Tests are skipped when Docker is not available. The test servers have the
+// same address space: the variables Temperature (Double, 21.5), Setpoint
+// (Float, 0), Running (Boolean, true), Alarms (UInt16, 0x0081), Counter
+// (Int32, incremented every second) and Name (String, "press-1"), all
+// writable, in the namespace NamespaceURI.
+package opcuatest
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// NamespaceURI is the namespace of the test server variables
+const NamespaceURI = "urn:plccli:test"
+
+// How long to wait for containers and services to come up
+const startTimeout = 2 * time.Minute
+
+//go:embed servers
+var servers embed.FS
+
+// Image is an OPC UA test server image, built from a Dockerfile of this package
+type Image struct {
+	Name string // Name of the directory in servers/
+	Tag  string // Docker image tag
+}
+
+var (
+	// Python is a test server based on asyncua
+	Python = Image{Name: "python", Tag: "plccli-test-python"}
+	// Open62541 is a test server based on open62541
+	Open62541 = Image{Name: "open62541", Tag: "plccli-test-open62541"}
+)
+
+// Images are all test server images, for running a test against each
+var Images = []Image{Python, Open62541}
+
+// Server is a running test server
+type Server struct {
+	Endpoint  string // opc.tcp:// endpoint on the loopback interface
+	Container string // Docker container ID
+}
+
+// Node returns the node ID of a test server variable, with the namespace URI
+func Node(name string) string {
+	return fmt.Sprintf("nsu=%s;s=%s", NamespaceURI, name)
+}
+
+// StartServer builds the image if needed and starts a test server. The
+// container is removed when the test ends
+func StartServer(t testing.TB, image Image) *Server {
+	t.Helper()
+	requireDocker(t)
+
+	dir := t.TempDir()
+	if err := writeContext(dir, image.Name); err != nil {
+		t.Fatalf("opcuatest: %v", err)
+	}
+	if out, err := docker("build", "-q", "-t", image.Tag, dir); err != nil {
+		t.Fatalf("opcuatest: failed to build %s: %v\n%s", image.Tag, err, out)
+	}
+
+	out, err := docker("run", "-d", "--rm", "-p", "127.0.0.1::4840", image.Tag)
+	if err != nil {
+		t.Fatalf("opcuatest: failed to start %s: %v\n%s", image.Tag, err, out)
+	}
+	container := strings.TrimSpace(out)
+	t.Cleanup(func() {
+		if t.Failed() {
+			logs, _ := docker("logs", container)
+			t.Logf("opcuatest: logs of %s:\n%s", image.Tag, logs)
+		}
+		docker("rm", "-f", container)
+	})
+
+	out, err = docker("port", container, "4840/tcp")
+	if err != nil {
+		t.Fatalf("opcuatest: failed to get the port of %s: %v\n%s", image.Tag, err, out)
+	}
+	// Several lines with IPv6, the first one is the requested IPv4 address
+	addr := strings.TrimSpace(strings.SplitN(out, "\n", 2)[0])
+	server := &Server{Endpoint: "opc.tcp://" + addr, Container: container}
+
+	if err := waitForServer(addr, server.Endpoint, startTimeout); err != nil {
+		t.Fatalf("opcuatest: %s did not start: %v", image.Tag, err)
+	}
+	return server
+}
+
+// Stop stops the server, e.g. to test reconnects. The container is gone
+// afterwards, start a new server to continue
+func (s *Server) Stop(t testing.TB) {
+	t.Helper()
+	if out, err := docker("rm", "-f", s.Container); err != nil {
+		t.Fatalf("opcuatest: failed to stop %s: %v\n%s", s.Container, err, out)
+	}
+}
+
+// requireDocker skips the test when no Docker daemon can be reached
+func requireDocker(t testing.TB) {
+	t.Helper()
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("opcuatest: docker not found")
+	}
+	if out, err := docker("info", "--format", "{{.ServerVersion}}"); err != nil {
+		t.Skipf("opcuatest: docker daemon not available: %s", strings.TrimSpace(out))
+	}
+}
+
+func docker(args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "docker", args...).CombinedOutput()
+	return string(out), err
+}
+
+// writeContext writes the Docker build context of an image to a directory
+func writeContext(dir, name string) error {
+	root := "servers/" + name
+	return fs.WalkDir(servers, root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		data, err := servers.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dir, strings.TrimPrefix(path, root+"/")), data, 0644)
+	})
+}
+
+// waitForServer waits until the server answers an OPC UA Hello. Docker accepts
+// connections on published ports before the server inside listens, so a TCP
+// connect alone does not tell that it is up
+func waitForServer(addr, endpoint string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	var err error
+	for time.Now().Before(deadline) {
+		if err = hello(addr, endpoint); err == nil {
+			return nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return err
+}
+
+// hello sends an OPC UA Hello message and expects an Acknowledge
+func hello(addr, endpoint string) error {
+	conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if _, err := conn.Write(helloMessage(endpoint)); err != nil {
+		return err
+	}
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if string(header[:4]) != "ACKF" {
+		return fmt.Errorf("unexpected response %q to hello", header[:4])
+	}
+	return nil
+}
+
+// helloMessage encodes the Hello message of the OPC UA TCP protocol
+func helloMessage(endpoint string) []byte {
+	var body bytes.Buffer
+	for _, v := range []uint32{0, 65536, 65536, 0, 0} { // Version, buffer sizes, no limits
+		binary.Write(&body, binary.LittleEndian, v)
+	}
+	binary.Write(&body, binary.LittleEndian, int32(len(endpoint)))
+	body.WriteString(endpoint)
+
+	var msg bytes.Buffer
+	msg.WriteString("HELF")
+	binary.Write(&msg, binary.LittleEndian, uint32(8+body.Len()))
+	msg.Write(body.Bytes())
+	return msg.Bytes()
+}
+
+// BuildCLI builds plccli from a package path or directory and returns the
+// binary. The module of the package must be available to the go command
+func BuildCLI(t testing.TB, pkg string) string {
+	t.Helper()
+	binary := filepath.Join(t.TempDir(), "plccli")
+	out, err := exec.Command("go", "build", "-o", binary, pkg).CombinedOutput()
+	if err != nil {
+		t.Fatalf("opcuatest: failed to build %s: %v\n%s", pkg, err, out)
+	}
+	return binary
+}
+
+// Service is a plccli service started by StartService
+type Service struct {
+	Binary string
+	Port   int
+	Home   string // HOME of the service, with its certificates and state
+	log    *logBuffer
+}
+
+// logBuffer collects the output of a service while it runs
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// Log returns the output of the service so far
+func (s *Service) Log() string {
+	return s.log.String()
+}
+
+// StartService starts a plccli service for an endpoint on a free port, with
+// anonymous authentication and without the random delay before connecting.
+// Extra flags go before --service. The service is stopped when the test ends
+func StartService(t testing.TB, binary, endpoint string, flags ...string) *Service {
+	t.Helper()
+	port, err := freePort()
+	if err != nil {
+		t.Fatalf("opcuatest: %v", err)
+	}
+	svc := &Service{Binary: binary, Port: port, Home: t.TempDir(), log: &logBuffer{}}
+
+	args := append([]string{"--port", strconv.Itoa(port), "--auth-method", "Anonymous", "--connect-jitter", "0"}, flags...)
+	args = append(args, "--service", "--endpoint", endpoint)
+	cmd := exec.Command(binary, args...)
+	cmd.Env = append(os.Environ(), "HOME="+svc.Home)
+	cmd.Stdout = svc.log
+	cmd.Stderr = svc.log
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("opcuatest: failed to start the service: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Signal(os.Interrupt)
+		done := make(chan struct{})
+		go func() {
+			cmd.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			cmd.Process.Kill()
+		}
+		if t.Failed() {
+			t.Logf("opcuatest: service log:\n%s", svc.Log())
+		}
+	})
+
+	// The API comes up once the service is connected to the server
+	deadline := time.Now().Add(startTimeout)
+	for {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/api/info", port))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return svc
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("opcuatest: service did not start: %v\n%s", err, svc.Log())
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// Run runs a CLI command against the service, e.g. Run("opcua", "get", node).
+// Flags go first: Run("--format", "influx", "opcua", "get", node)
+func (s *Service) Run(args ...string) (string, error) {
+	args = append([]string{"--port", strconv.Itoa(s.Port)}, args...)
+	cmd := exec.Command(s.Binary, args...)
+	cmd.Env = append(os.Environ(), "HOME="+s.Home)
+	out, err := cmd.CombinedOutput()
+	return strings.TrimSpace(string(out)), err
+}
+
+// freePort returns a loopback port nobody listens on
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, fmt.Errorf("failed to find a free port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
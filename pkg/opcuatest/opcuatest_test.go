@@ -0,0 +1,52 @@
+package opcuatest
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestWaitForServer tests the Hello handshake against a fake server
+func TestWaitForServer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	endpoint := "opc.tcp://" + l.Addr().String()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		header := make([]byte, 8)
+		io.ReadFull(conn, header)
+		body := make([]byte, binary.LittleEndian.Uint32(header[4:])-8)
+		io.ReadFull(conn, body)
+		received <- append(header, body...)
+		conn.Write([]byte("ACKF\x1c\x00\x00\x00"))
+	}()
+
+	require.NoError(t, waitForServer(l.Addr().String(), endpoint, 5*time.Second))
+	msg := <-received
+	assert.Equal(t, "HELF", string(msg[:4]))
+	assert.Equal(t, endpoint, string(msg[32:]))
+}
+
+// TestWriteContext tests that the build context of each image is embedded
+func TestWriteContext(t *testing.T) {
+	for _, image := range Images {
+		dir := t.TempDir()
+		require.NoError(t, writeContext(dir, image.Name))
+		_, err := os.Stat(filepath.Join(dir, "Dockerfile"))
+		assert.NoError(t, err, image.Name)
+	}
+}
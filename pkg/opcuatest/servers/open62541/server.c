@@ -0,0 +1,66 @@
+/*
+ * OPC UA test server with the address space of the plccli integration tests.
+ * Keep the nodes in sync with ../python/server.py and opcuatest.go.
+ */
+#include <open62541/server.h>
+#include <open62541/server_config_default.h>
+
+#include <signal.h>
+#include <stdlib.h>
+
+static volatile UA_Boolean running = true;
+static UA_UInt16 ns;
+static UA_Int32 counter = 0;
+
+static void stopHandler(int sig) {
+    running = false;
+}
+
+static void addVariable(UA_Server *server, char *name, const UA_DataType *type, void *value) {
+    UA_VariableAttributes attr = UA_VariableAttributes_default;
+    UA_Variant_setScalarCopy(&attr.value, value, type);
+    attr.dataType = type->typeId;
+    attr.valueRank = UA_VALUERANK_SCALAR;
+    attr.displayName = UA_LOCALIZEDTEXT("en-US", name);
+    attr.accessLevel = UA_ACCESSLEVELMASK_READ | UA_ACCESSLEVELMASK_WRITE;
+    UA_Server_addVariableNode(server, UA_NODEID_STRING(ns, name),
+                              UA_NODEID_NUMERIC(0, UA_NS0ID_OBJECTSFOLDER),
+                              UA_NODEID_NUMERIC(0, UA_NS0ID_ORGANIZES),
+                              UA_QUALIFIEDNAME(ns, name),
+                              UA_NODEID_NUMERIC(0, UA_NS0ID_BASEDATAVARIABLETYPE),
+                              attr, NULL, NULL);
+    UA_VariableAttributes_clear(&attr);
+}
+
+static void tick(UA_Server *server, void *data) {
+    UA_Variant value;
+    counter++;
+    UA_Variant_setScalar(&value, &counter, &UA_TYPES[UA_TYPES_INT32]);
+    UA_Server_writeValue(server, UA_NODEID_STRING(ns, "Counter"), value);
+}
+
+int main(void) {
+    signal(SIGINT, stopHandler);
+    signal(SIGTERM, stopHandler);
+
+    UA_Server *server = UA_Server_new();
+    UA_ServerConfig_setDefault(UA_Server_getConfig(server));
+    ns = UA_Server_addNamespace(server, "urn:plccli:test");
+
+    UA_Double temperature = 21.5;
+    UA_Float setpoint = 0;
+    UA_Boolean run = true;
+    UA_UInt16 alarms = 0x0081;
+    UA_String name = UA_STRING("press-1");
+    addVariable(server, "Temperature", &UA_TYPES[UA_TYPES_DOUBLE], &temperature);
+    addVariable(server, "Setpoint", &UA_TYPES[UA_TYPES_FLOAT], &setpoint);
+    addVariable(server, "Running", &UA_TYPES[UA_TYPES_BOOLEAN], &run);
+    addVariable(server, "Alarms", &UA_TYPES[UA_TYPES_UINT16], &alarms);
+    addVariable(server, "Counter", &UA_TYPES[UA_TYPES_INT32], &counter);
+    addVariable(server, "Name", &UA_TYPES[UA_TYPES_STRING], &name);
+    UA_Server_addRepeatedCallback(server, tick, NULL, 1000, NULL);
+
+    UA_StatusCode status = UA_Server_run(server, &running);
+    UA_Server_delete(server);
+    return status == UA_STATUSCODE_GOOD ? EXIT_SUCCESS : EXIT_FAILURE;
+}
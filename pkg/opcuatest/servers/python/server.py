@@ -0,0 +1,45 @@
+"""OPC UA test server with the address space of the plccli integration tests.
+
+Keep the nodes in sync with ../open62541/server.c and opcuatest.go.
+"""
+import asyncio
+
+from asyncua import Server, ua
+
+NAMESPACE_URI = "urn:plccli:test"
+
+NODES = [
+    ("Temperature", 21.5, ua.VariantType.Double),
+    ("Setpoint", 0.0, ua.VariantType.Float),
+    ("Running", True, ua.VariantType.Boolean),
+    ("Alarms", 0x0081, ua.VariantType.UInt16),
+    ("Counter", 0, ua.VariantType.Int32),
+    ("Name", "press-1", ua.VariantType.String),
+]
+
+
+async def main():
+    server = Server()
+    await server.init()
+    server.set_endpoint("opc.tcp://0.0.0.0:4840/")
+    server.set_security_policy([ua.SecurityPolicyType.NoSecurity])
+    idx = await server.register_namespace(NAMESPACE_URI)
+
+    nodes = {}
+    for name, value, variant_type in NODES:
+        node = await server.nodes.objects.add_variable(
+            ua.NodeId(name, idx), ua.QualifiedName(name, idx), value, varianttype=variant_type
+        )
+        await node.set_writable()
+        nodes[name] = node
+
+    async with server:
+        counter = 0
+        while True:
+            await asyncio.sleep(1)
+            counter += 1
+            await nodes["Counter"].write_value(ua.Variant(counter, ua.VariantType.Int32))
+
+
+if __name__ == "__main__":
+    asyncio.run(main())
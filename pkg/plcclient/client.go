@@ -0,0 +1,1179 @@
+// Package plcclient provides a Go client for the plccli service API.
+//
+// The service (plccli --service) owns the OPC UA connection, including
+// endpoint discovery, certificates, sessions and reconnects. That code stays
+// in the plccli binary: this package does not connect to a PLC itself, it
+// needs a running service. Programs embedding it share the service's
+// connection instead of shelling out to the binary.
+//
+// Subscribe polls the service; it does not create OPC UA monitored items,
+// so a value that changes and changes back between two polls is not seen.
+package plcclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client reads, writes and browses OPC UA nodes through a plccli service.
+// Programs depending only on these can be tested with a fake; the rest of
+// the service API is on HTTPClient
+type Client interface {
+	// Read reads one or more nodes. The results are in the order of the
+	// node IDs, one per node, with RequestedNodeID set to the node ID as
+	// given; per-node failures are reported in the Error field of each result
+	Read(ctx context.Context, nodeIDs ...string) ([]NodeResponse, error)
+	// Write writes a value to a node attribute
+	Write(ctx context.Context, req WriteRequest) (NodeResponse, error)
+	// Browse returns the nodes below nodeID up to maxDepth levels
+	Browse(ctx context.Context, nodeID string, maxDepth int) ([]BrowseNode, error)
+	// Subscribe delivers the values of the nodes every interval until ctx is
+	// done. The values are polled, see HTTPClient.Subscribe
+	Subscribe(ctx context.Context, nodeIDs []string, interval time.Duration) (<-chan NodeResponse, error)
+}
+
+var _ Client = (*HTTPClient)(nil)
+
+// HTTPClient is a Client talking to a plccli service over HTTP. It also
+// covers the rest of the API: jobs, poll groups, node groups, Modbus,
+// EtherNet/IP and backend points, permits, approvals, maintenance,
+// annotations and schedules
+type HTTPClient struct {
+	host      string
+	port      int
+	token     string
+	permit    string
+	basePath  string
+	opTimeout time.Duration
+	scheme    string
+	http      *http.Client
+}
+
+// New creates a client for the service listening on host:port.
+// Request timeouts are taken from the context of each call
+func New(host string, port int) *HTTPClient {
+	return &HTTPClient{
+		host:   host,
+		port:   port,
+		scheme: "http",
+		http:   &http.Client{},
+	}
+}
+
+// WithToken sets the tenant token sent with every request, for services
+// started with --tenants. An empty token sends none
+func (c *HTTPClient) WithToken(token string) *HTTPClient {
+	c.token = token
+	return c
+}
+
+// WithPermit sets the write permit sent with every request, for services
+// started with --write-permits, which reject writes without an active one.
+// An empty permit sends none
+func (c *HTTPClient) WithPermit(permitID string) *HTTPClient {
+	c.permit = permitID
+	return c
+}
+
+// WithBasePath sets the path the service API is served under, e.g. /plccli
+// for a service started with --api-base-path behind a reverse proxy
+func (c *HTTPClient) WithBasePath(path string) *HTTPClient {
+	c.basePath = strings.TrimRight(path, "/")
+	if c.basePath != "" && !strings.HasPrefix(c.basePath, "/") {
+		c.basePath = "/" + c.basePath
+	}
+	return c
+}
+
+// WithTLS calls the service over HTTPS, for a service started with
+// --api-tls-cert. A nil config trusts the system's CAs
+func (c *HTTPClient) WithTLS(config *tls.Config) *HTTPClient {
+	c.scheme = "https"
+	c.http = &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	return c
+}
+
+// WithOpTimeout sets the timeout of the service's OPC UA operations for every
+// request, instead of the service defaults (10s for reads and writes, 30s for
+// browses). The context of each call has to allow for it. 0 keeps the defaults
+func (c *HTTPClient) WithOpTimeout(timeout time.Duration) *HTTPClient {
+	c.opTimeout = timeout
+	return c
+}
+
+// Read reads one or more nodes. A single node is read with the node
+// endpoint, which also decodes Siemens DTL values
+func (c *HTTPClient) Read(ctx context.Context, nodeIDs ...string) ([]NodeResponse, error) {
+	return c.ReadWith(ctx, ReadOptions{}, nodeIDs...)
+}
+
+// ReadWith reads one or more nodes with read options
+func (c *HTTPClient) ReadWith(ctx context.Context, opts ReadOptions, nodeIDs ...string) ([]NodeResponse, error) {
+	if len(nodeIDs) == 0 {
+		return nil, fmt.Errorf("no node IDs provided")
+	}
+
+	if len(nodeIDs) == 1 {
+		namespace, idType, identifier, err := ParseNodeID(nodeIDs[0])
+		if err != nil {
+			return nil, err
+		}
+		path := fmt.Sprintf("/api/node?namespace=%s&type=%s&identifier=%s&nodeID=%s",
+			url.QueryEscape(namespace), url.QueryEscape(idType), url.QueryEscape(identifier), url.QueryEscape(nodeIDs[0]))
+		if opts.DecodeEnums {
+			path += "&decodeEnums=true"
+		}
+		if opts.Fresh {
+			path += "&fresh=true"
+		}
+		if opts.WithMetadata {
+			path += "&withMetadata=true"
+		}
+
+		var nodeResp NodeResponse
+		if err := c.do(ctx, http.MethodGet, path, nil, &nodeResp); err != nil {
+			return nil, err
+		}
+		// Services before the echo do not set it
+		nodeResp.RequestedNodeID = nodeIDs[0]
+		return []NodeResponse{nodeResp}, nil
+	}
+
+	// Build a batch request
+	var requestParams []map[string]string
+	for _, nodeID := range nodeIDs {
+		namespace, idType, identifier, err := ParseNodeID(nodeID)
+		if err != nil {
+			return nil, err
+		}
+		requestParams = append(requestParams, map[string]string{
+			"namespace":  namespace,
+			"type":       idType,
+			"identifier": identifier,
+			"nodeID":     nodeID,
+		})
+	}
+
+	var batchResp struct {
+		Results []NodeResponse `json:"results"`
+		Error   string         `json:"error,omitempty"`
+	}
+	requestBody := map[string]interface{}{"nodes": requestParams}
+	if opts.DecodeEnums {
+		requestBody["decodeEnums"] = true
+	}
+	if opts.Fresh {
+		requestBody["fresh"] = true
+	}
+	if opts.WithMetadata {
+		requestBody["withMetadata"] = true
+	}
+	if opts.Synchronized {
+		requestBody["synchronized"] = true
+	}
+	err := c.do(ctx, http.MethodPost, "/api/nodes", requestBody, &batchResp)
+	if err != nil {
+		return nil, err
+	}
+	if batchResp.Error != "" {
+		return nil, &ServiceError{Message: batchResp.Error}
+	}
+	// Results are matched to the node IDs by position
+	if len(batchResp.Results) != len(nodeIDs) {
+		return nil, fmt.Errorf("service returned %d results for %d nodes", len(batchResp.Results), len(nodeIDs))
+	}
+	for i := range batchResp.Results {
+		batchResp.Results[i].RequestedNodeID = nodeIDs[i]
+	}
+	return batchResp.Results, nil
+}
+
+// Write writes a value to a node attribute
+func (c *HTTPClient) Write(ctx context.Context, req WriteRequest) (NodeResponse, error) {
+	namespace, idType, identifier, err := ParseNodeID(req.NodeID)
+	if err != nil {
+		return NodeResponse{}, err
+	}
+
+	requestBody := map[string]interface{}{
+		"namespace":  namespace,
+		"type":       idType,
+		"identifier": identifier,
+		"value":      req.Value,
+		"dataType":   req.DataType,
+	}
+	if req.Attribute != "" && !strings.EqualFold(req.Attribute, "Value") {
+		requestBody["attribute"] = req.Attribute
+	}
+	if req.Priority != "" {
+		requestBody["priority"] = req.Priority
+	}
+	if req.DryRun {
+		requestBody["dryRun"] = true
+	}
+
+	var nodeResp NodeResponse
+	if err := c.do(ctx, http.MethodPost, "/api/node", requestBody, &nodeResp); err != nil {
+		return NodeResponse{}, err
+	}
+	if err := nodeResp.Err(); err != nil {
+		return nodeResp, err
+	}
+	return nodeResp, nil
+}
+
+// SetBit sets or clears one bit of an integer word node with a
+// read-modify-write in the service. The result holds the written word
+func (c *HTTPClient) SetBit(ctx context.Context, nodeID string, bit int, on bool) (NodeResponse, error) {
+	namespace, idType, identifier, err := ParseNodeID(nodeID)
+	if err != nil {
+		return NodeResponse{}, err
+	}
+
+	value := 0
+	if on {
+		value = 1
+	}
+	requestBody := map[string]interface{}{
+		"namespace":  namespace,
+		"type":       idType,
+		"identifier": identifier,
+		"bit":        bit,
+		"value":      value,
+	}
+
+	var nodeResp NodeResponse
+	if err := c.do(ctx, http.MethodPost, "/api/bit", requestBody, &nodeResp); err != nil {
+		return NodeResponse{}, err
+	}
+	if err := nodeResp.Err(); err != nil {
+		return nodeResp, err
+	}
+	return nodeResp, nil
+}
+
+// Validate checks that nodes exist and reads their data type and access, in
+// the order of the node IDs. All nodes are checked with batched reads
+func (c *HTTPClient) Validate(ctx context.Context, nodeIDs ...string) ([]NodeCheck, error) {
+	var validateResp struct {
+		Results []NodeCheck `json:"results"`
+		Error   string      `json:"error,omitempty"`
+	}
+	requestBody := map[string]interface{}{"nodes": nodeIDs}
+	if err := c.do(ctx, http.MethodPost, "/api/validate", requestBody, &validateResp); err != nil {
+		return nil, err
+	}
+	if validateResp.Error != "" {
+		return nil, &ServiceError{Message: validateResp.Error}
+	}
+	if len(validateResp.Results) != len(nodeIDs) {
+		return nil, fmt.Errorf("service returned %d results for %d nodes", len(validateResp.Results), len(nodeIDs))
+	}
+	return validateResp.Results, nil
+}
+
+// Browse returns the nodes below nodeID up to maxDepth levels
+func (c *HTTPClient) Browse(ctx context.Context, nodeID string, maxDepth int) ([]BrowseNode, error) {
+	path := fmt.Sprintf("/api/browse?nodeid=%s&maxdepth=%d", url.QueryEscape(nodeID), maxDepth)
+
+	var browseResp struct {
+		Nodes []BrowseNode `json:"nodes"`
+		Error string       `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodGet, path, nil, &browseResp); err != nil {
+		return nil, err
+	}
+	if browseResp.Error != "" {
+		return nil, &ServiceError{Message: browseResp.Error}
+	}
+	return browseResp.Nodes, nil
+}
+
+// BrowsePaged returns the next page of a browse of the nodes below nodeID up
+// to maxDepth levels, with at most limit nodes. Pass the Continuation of a
+// page to get the next one, nodeID and maxDepth are then taken from it. A
+// page may hold fewer nodes than limit, even none, before the last one,
+// which has no Continuation
+func (c *HTTPClient) BrowsePaged(ctx context.Context, nodeID string, maxDepth, limit int, continuation string) (BrowsePage, error) {
+	query := url.Values{
+		"nodeid":   {nodeID},
+		"maxdepth": {strconv.Itoa(maxDepth)},
+		"limit":    {strconv.Itoa(limit)},
+	}
+	if continuation != "" {
+		query.Set("continuation", continuation)
+	}
+
+	var browseResp struct {
+		BrowsePage
+		Error string `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/browse?"+query.Encode(), nil, &browseResp); err != nil {
+		return BrowsePage{}, err
+	}
+	if browseResp.Error != "" {
+		return BrowsePage{}, &ServiceError{Message: browseResp.Error}
+	}
+	return browseResp.BrowsePage, nil
+}
+
+// Subscribe delivers the values of the nodes every interval until ctx is
+// done, then closes the channel. The service has no subscription endpoint,
+// so values are polled; failed polls are delivered as results with Error set
+func (c *HTTPClient) Subscribe(ctx context.Context, nodeIDs []string, interval time.Duration) (<-chan NodeResponse, error) {
+	if len(nodeIDs) == 0 {
+		return nil, fmt.Errorf("no node IDs provided")
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("interval must be positive")
+	}
+	for _, nodeID := range nodeIDs {
+		if _, _, _, err := ParseNodeID(nodeID); err != nil {
+			return nil, err
+		}
+	}
+
+	updates := make(chan NodeResponse)
+	go func() {
+		defer close(updates)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			results, err := c.Read(ctx, nodeIDs...)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				results = make([]NodeResponse, len(nodeIDs))
+				for i, nodeID := range nodeIDs {
+					results[i] = NodeResponse{NodeID: nodeID, Error: err.Error()}
+				}
+			}
+			for _, result := range results {
+				select {
+				case updates <- result:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return updates, nil
+}
+
+// Info returns information about the service connection
+func (c *HTTPClient) Info(ctx context.Context) (map[string]interface{}, error) {
+	var info map[string]interface{}
+	if err := c.do(ctx, http.MethodGet, "/api/info", nil, &info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Cancel cancels a queued write, running browse or job by its operation ID.
+// Services return the ID of long operations in the X-Operation-ID header and
+// list them at /api/operations
+func (c *HTTPClient) Cancel(ctx context.Context, opID string) error {
+	if opID == "" {
+		return fmt.Errorf("no operation ID provided")
+	}
+
+	var cancelResp struct {
+		Cancelled string `json:"cancelled"`
+		Error     string `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodDelete, "/api/operations/"+url.PathEscape(opID), nil, &cancelResp); err != nil {
+		return err
+	}
+	if cancelResp.Error != "" {
+		return &ServiceError{Message: cancelResp.Error}
+	}
+	return nil
+}
+
+// StartJob starts an asynchronous browse, subtree read or history export in
+// the service. Poll Job for progress and fetch the result once it is no longer running
+func (c *HTTPClient) StartJob(ctx context.Context, req JobRequest) (Job, error) {
+	requestBody := map[string]interface{}{
+		"kind":     req.Kind,
+		"nodeId":   req.NodeID,
+		"maxDepth": req.MaxDepth,
+	}
+	if len(req.NodeIDs) > 0 {
+		requestBody["nodeIds"] = req.NodeIDs
+	}
+	if !req.Start.IsZero() {
+		requestBody["start"] = req.Start
+	}
+	if !req.End.IsZero() {
+		requestBody["end"] = req.End
+	}
+
+	var jobResp struct {
+		Job   Job    `json:"job"`
+		Error string `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/api/jobs", requestBody, &jobResp); err != nil {
+		return Job{}, err
+	}
+	if jobResp.Error != "" {
+		return Job{}, &ServiceError{Message: jobResp.Error}
+	}
+	return jobResp.Job, nil
+}
+
+// Job returns the progress of a job
+func (c *HTTPClient) Job(ctx context.Context, jobID string) (Job, error) {
+	var jobResp struct {
+		Job   Job    `json:"job"`
+		Error string `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/jobs/"+url.PathEscape(jobID), nil, &jobResp); err != nil {
+		return Job{}, err
+	}
+	if jobResp.Error != "" {
+		return Job{}, &ServiceError{Message: jobResp.Error}
+	}
+	return jobResp.Job, nil
+}
+
+// BrowseJobResult returns the nodes found by a finished browse job
+func (c *HTTPClient) BrowseJobResult(ctx context.Context, jobID string) ([]BrowseNode, error) {
+	var browseResp struct {
+		Nodes []BrowseNode `json:"nodes"`
+		Error string       `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/jobs/"+url.PathEscape(jobID)+"/result", nil, &browseResp); err != nil {
+		return nil, err
+	}
+	if browseResp.Error != "" {
+		return nil, &ServiceError{Message: browseResp.Error}
+	}
+	return browseResp.Nodes, nil
+}
+
+// ReadJobResult returns the values read by a finished read-subtree job
+func (c *HTTPClient) ReadJobResult(ctx context.Context, jobID string) ([]NodeResponse, error) {
+	var readResp struct {
+		Results []NodeResponse `json:"results"`
+		Error   string         `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/jobs/"+url.PathEscape(jobID)+"/result", nil, &readResp); err != nil {
+		return nil, err
+	}
+	if readResp.Error != "" {
+		return nil, &ServiceError{Message: readResp.Error}
+	}
+	return readResp.Results, nil
+}
+
+// HistoryExportJobResult returns the export file of a finished history-export job
+func (c *HTTPClient) HistoryExportJobResult(ctx context.Context, jobID string) (HistoryExport, error) {
+	var exportResp struct {
+		HistoryExport
+		Error string `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/jobs/"+url.PathEscape(jobID)+"/result", nil, &exportResp); err != nil {
+		return HistoryExport{}, err
+	}
+	if exportResp.Error != "" {
+		return HistoryExport{}, &ServiceError{Message: exportResp.Error}
+	}
+	return exportResp.HistoryExport, nil
+}
+
+// Polls lists the poll groups sampled by the service
+func (c *HTTPClient) Polls(ctx context.Context) ([]PollConfig, error) {
+	var pollsResp struct {
+		Polls []PollConfig `json:"polls"`
+		Error string       `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/polls", nil, &pollsResp); err != nil {
+		return nil, err
+	}
+	if pollsResp.Error != "" {
+		return nil, &ServiceError{Message: pollsResp.Error}
+	}
+	return pollsResp.Polls, nil
+}
+
+// AddPoll creates a poll group and returns it with its assigned ID
+func (c *HTTPClient) AddPoll(ctx context.Context, config PollConfig) (PollConfig, error) {
+	var pollResp struct {
+		Poll  PollConfig `json:"poll"`
+		Error string     `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/api/polls", config, &pollResp); err != nil {
+		return PollConfig{}, err
+	}
+	if pollResp.Error != "" {
+		return PollConfig{}, &ServiceError{Message: pollResp.Error}
+	}
+	return pollResp.Poll, nil
+}
+
+// RemovePoll stops a poll group
+func (c *HTTPClient) RemovePoll(ctx context.Context, pollID string) error {
+	if pollID == "" {
+		return fmt.Errorf("no poll group ID provided")
+	}
+
+	var removeResp struct {
+		Error string `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodDelete, "/api/polls/"+url.PathEscape(pollID), nil, &removeResp); err != nil {
+		return err
+	}
+	if removeResp.Error != "" {
+		return &ServiceError{Message: removeResp.Error}
+	}
+	return nil
+}
+
+// Recent returns the samples the service kept of a polled node since a time,
+// oldest first. A zero since returns all of them
+func (c *HTTPClient) Recent(ctx context.Context, nodeID string, since time.Time) ([]Sample, error) {
+	if nodeID == "" {
+		return nil, fmt.Errorf("no node ID provided")
+	}
+
+	query := url.Values{"nodeid": {nodeID}}
+	if !since.IsZero() {
+		query.Set("since", since.Format(time.RFC3339Nano))
+	}
+	var recentResp struct {
+		Samples []Sample `json:"samples"`
+		Error   string   `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/recent?"+query.Encode(), nil, &recentResp); err != nil {
+		return nil, err
+	}
+	if recentResp.Error != "" {
+		return nil, &ServiceError{Message: recentResp.Error}
+	}
+	return recentResp.Samples, nil
+}
+
+// Groups lists the node groups of the service
+func (c *HTTPClient) Groups(ctx context.Context) ([]NodeGroup, error) {
+	var groupsResp struct {
+		Groups []NodeGroup `json:"groups"`
+		Error  string      `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/groups", nil, &groupsResp); err != nil {
+		return nil, err
+	}
+	if groupsResp.Error != "" {
+		return nil, &ServiceError{Message: groupsResp.Error}
+	}
+	return groupsResp.Groups, nil
+}
+
+// Group returns the node group with the given name
+func (c *HTTPClient) Group(ctx context.Context, name string) (NodeGroup, error) {
+	if name == "" {
+		return NodeGroup{}, fmt.Errorf("no group name provided")
+	}
+
+	var groupResp struct {
+		Group NodeGroup `json:"group"`
+		Error string    `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/groups/"+url.PathEscape(name), nil, &groupResp); err != nil {
+		return NodeGroup{}, err
+	}
+	if groupResp.Error != "" {
+		return NodeGroup{}, &ServiceError{Message: groupResp.Error}
+	}
+	return groupResp.Group, nil
+}
+
+// AddGroup creates a node group or replaces one added before
+func (c *HTTPClient) AddGroup(ctx context.Context, group NodeGroup) (NodeGroup, error) {
+	var groupResp struct {
+		Group NodeGroup `json:"group"`
+		Error string    `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/api/groups", group, &groupResp); err != nil {
+		return NodeGroup{}, err
+	}
+	if groupResp.Error != "" {
+		return NodeGroup{}, &ServiceError{Message: groupResp.Error}
+	}
+	return groupResp.Group, nil
+}
+
+// RemoveGroup removes a node group added through the API
+func (c *HTTPClient) RemoveGroup(ctx context.Context, name string) error {
+	if name == "" {
+		return fmt.Errorf("no group name provided")
+	}
+
+	var removeResp struct {
+		Error string `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodDelete, "/api/groups/"+url.PathEscape(name), nil, &removeResp); err != nil {
+		return err
+	}
+	if removeResp.Error != "" {
+		return &ServiceError{Message: removeResp.Error}
+	}
+	return nil
+}
+
+// ReadModbus reads points of a Modbus connection in the order given. A
+// point is unit/register-type/address[/type], e.g. 1/holding/100/float32
+func (c *HTTPClient) ReadModbus(ctx context.Context, points ...string) ([]NodeResponse, error) {
+	if len(points) == 0 {
+		return nil, fmt.Errorf("no Modbus points provided")
+	}
+
+	query := url.Values{"point": points}
+	var readResp struct {
+		Results []NodeResponse `json:"results"`
+		Error   string         `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/modbus?"+query.Encode(), nil, &readResp); err != nil {
+		return nil, err
+	}
+	if readResp.Error != "" {
+		return nil, &ServiceError{Message: readResp.Error}
+	}
+	if len(readResp.Results) != len(points) {
+		return nil, fmt.Errorf("service returned %d results for %d points", len(readResp.Results), len(points))
+	}
+	for i := range readResp.Results {
+		readResp.Results[i].RequestedNodeID = points[i]
+	}
+	return readResp.Results, nil
+}
+
+// WriteModbus writes a value to a coil or holding register point of a
+// Modbus connection. The result holds the point as the service parsed it
+func (c *HTTPClient) WriteModbus(ctx context.Context, point, value string) (NodeResponse, error) {
+	body := map[string]string{"point": point, "value": value}
+	var writeResp NodeResponse
+	if err := c.do(ctx, http.MethodPost, "/api/modbus", body, &writeResp); err != nil {
+		return writeResp, err
+	}
+	if writeResp.Error != "" {
+		return writeResp, &ServiceError{Message: writeResp.Error}
+	}
+	return writeResp, nil
+}
+
+// ReadENIP reads tags of an EtherNet/IP connection to a ControlLogix or
+// CompactLogix controller in the order given, e.g. Program:Main.Recipe[2].Setpoint.
+// Results have the Logix data type, like DINT or REAL
+func (c *HTTPClient) ReadENIP(ctx context.Context, tags ...string) ([]NodeResponse, error) {
+	if len(tags) == 0 {
+		return nil, fmt.Errorf("no tags provided")
+	}
+
+	query := url.Values{"tag": tags}
+	var readResp struct {
+		Results []NodeResponse `json:"results"`
+		Error   string         `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/enip?"+query.Encode(), nil, &readResp); err != nil {
+		return nil, err
+	}
+	if readResp.Error != "" {
+		return nil, &ServiceError{Message: readResp.Error}
+	}
+	if len(readResp.Results) != len(tags) {
+		return nil, fmt.Errorf("service returned %d results for %d tags", len(readResp.Results), len(tags))
+	}
+	for i := range readResp.Results {
+		readResp.Results[i].RequestedNodeID = tags[i]
+	}
+	return readResp.Results, nil
+}
+
+// WriteENIP writes a value to a tag of an EtherNet/IP connection. An empty
+// data type makes the service read the tag's type first. The result holds
+// the data type written
+func (c *HTTPClient) WriteENIP(ctx context.Context, tag, value, dataType string) (NodeResponse, error) {
+	body := map[string]string{"tag": tag, "value": value, "dataType": dataType}
+	var writeResp NodeResponse
+	if err := c.do(ctx, http.MethodPost, "/api/enip", body, &writeResp); err != nil {
+		return writeResp, err
+	}
+	if writeResp.Error != "" {
+		return writeResp, &ServiceError{Message: writeResp.Error}
+	}
+	return writeResp, nil
+}
+
+// ReadPoints reads references of a connection through its protocol
+// backend (Modbus TCP, EtherNet/IP or one linked in), in the backend's
+// syntax, e.g. 1/holding/100/float32 or Program:Main.Counter
+func (c *HTTPClient) ReadPoints(ctx context.Context, refs ...string) ([]NodeResponse, error) {
+	if len(refs) == 0 {
+		return nil, fmt.Errorf("no references provided")
+	}
+
+	query := url.Values{"ref": refs}
+	var readResp struct {
+		Results []NodeResponse `json:"results"`
+		Error   string         `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/points?"+query.Encode(), nil, &readResp); err != nil {
+		return nil, err
+	}
+	if readResp.Error != "" {
+		return nil, &ServiceError{Message: readResp.Error}
+	}
+	if len(readResp.Results) != len(refs) {
+		return nil, fmt.Errorf("service returned %d results for %d references", len(readResp.Results), len(refs))
+	}
+	return readResp.Results, nil
+}
+
+// WritePoint writes a value to a reference of a backend connection. An
+// empty data type leaves the type to the backend. The result holds the data
+// type written
+func (c *HTTPClient) WritePoint(ctx context.Context, ref, value, dataType string) (NodeResponse, error) {
+	body := map[string]string{"ref": ref, "value": value, "dataType": dataType}
+	var writeResp NodeResponse
+	if err := c.do(ctx, http.MethodPost, "/api/points", body, &writeResp); err != nil {
+		return writeResp, err
+	}
+	if writeResp.Error != "" {
+		return writeResp, &ServiceError{Message: writeResp.Error}
+	}
+	return writeResp, nil
+}
+
+// BrowsePoints returns the references below ref, the device's root when
+// empty, up to maxDepth levels. Backends without browsing report an error
+func (c *HTTPClient) BrowsePoints(ctx context.Context, ref string, maxDepth int) ([]BrowseNode, error) {
+	path := fmt.Sprintf("/api/points/browse?ref=%s&maxdepth=%d", url.QueryEscape(ref), maxDepth)
+
+	var browseResp struct {
+		Nodes []BrowseNode `json:"nodes"`
+		Error string       `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodGet, path, nil, &browseResp); err != nil {
+		return nil, err
+	}
+	if browseResp.Error != "" {
+		return nil, &ServiceError{Message: browseResp.Error}
+	}
+	return browseResp.Nodes, nil
+}
+
+// RequestPermit requests a write permit from a service started with
+// --write-permits. The reason is logged by the service; a zero duration asks
+// for the longest permit it issues. Pass the permit ID to WithPermit
+func (c *HTTPClient) RequestPermit(ctx context.Context, reason string, duration time.Duration) (WritePermit, error) {
+	body := map[string]string{"reason": reason}
+	if duration != 0 {
+		body["duration"] = duration.String()
+	}
+	var permitResp struct {
+		Permit WritePermit `json:"permit"`
+		Error  string      `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/api/permits", body, &permitResp); err != nil {
+		return WritePermit{}, err
+	}
+	if permitResp.Error != "" {
+		return WritePermit{}, &ServiceError{Message: permitResp.Error}
+	}
+	return permitResp.Permit, nil
+}
+
+// Permits lists the active write permits of the client's tenant, the
+// earliest to expire first
+func (c *HTTPClient) Permits(ctx context.Context) ([]WritePermit, error) {
+	var permitsResp struct {
+		Permits []WritePermit `json:"permits"`
+		Error   string        `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/permits", nil, &permitsResp); err != nil {
+		return nil, err
+	}
+	if permitsResp.Error != "" {
+		return nil, &ServiceError{Message: permitsResp.Error}
+	}
+	return permitsResp.Permits, nil
+}
+
+// RevokePermit ends a write permit before it expires
+func (c *HTTPClient) RevokePermit(ctx context.Context, permitID string) error {
+	if permitID == "" {
+		return fmt.Errorf("no permit ID provided")
+	}
+
+	var revokeResp struct {
+		Error string `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodDelete, "/api/permits/"+url.PathEscape(permitID), nil, &revokeResp); err != nil {
+		return err
+	}
+	if revokeResp.Error != "" {
+		return &ServiceError{Message: revokeResp.Error}
+	}
+	return nil
+}
+
+// RequestApproval asks a service for a write of a node marked critical in
+// its write policy. NodeID, Value, DataType and Reason are required. The
+// service checks the write like a dry run and keeps it until a tenant other
+// than the client's confirms it with ConfirmApproval, or until it expires
+func (c *HTTPClient) RequestApproval(ctx context.Context, write PendingWrite) (PendingWrite, error) {
+	body := map[string]string{
+		"nodeId":    write.NodeID,
+		"value":     write.Value,
+		"dataType":  write.DataType,
+		"attribute": write.Attribute,
+		"reason":    write.Reason,
+	}
+	var approvalResp struct {
+		Approval PendingWrite `json:"approval"`
+		Error    string       `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/api/approvals", body, &approvalResp); err != nil {
+		return PendingWrite{}, err
+	}
+	if approvalResp.Error != "" {
+		return PendingWrite{}, &ServiceError{Message: approvalResp.Error}
+	}
+	return approvalResp.Approval, nil
+}
+
+// Approvals lists the writes waiting for a confirmation, the earliest to
+// expire first
+func (c *HTTPClient) Approvals(ctx context.Context) ([]PendingWrite, error) {
+	var approvalsResp struct {
+		Approvals []PendingWrite `json:"approvals"`
+		Error     string         `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/approvals", nil, &approvalsResp); err != nil {
+		return nil, err
+	}
+	if approvalsResp.Error != "" {
+		return nil, &ServiceError{Message: approvalsResp.Error}
+	}
+	return approvalsResp.Approvals, nil
+}
+
+// ConfirmApproval confirms a write requested by another tenant. The service
+// runs it right away and returns the result of the write
+func (c *HTTPClient) ConfirmApproval(ctx context.Context, approvalID string) (NodeResponse, error) {
+	if approvalID == "" {
+		return NodeResponse{}, fmt.Errorf("no approval ID provided")
+	}
+
+	var confirmResp struct {
+		Result NodeResponse `json:"result"`
+		Error  string       `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/api/approvals/"+url.PathEscape(approvalID)+"/confirm", nil, &confirmResp); err != nil {
+		return NodeResponse{}, err
+	}
+	if confirmResp.Error != "" {
+		return confirmResp.Result, &ServiceError{Message: confirmResp.Error}
+	}
+	return confirmResp.Result, nil
+}
+
+// RejectApproval drops a write waiting for a confirmation, by the tenant
+// that requested it or another one
+func (c *HTTPClient) RejectApproval(ctx context.Context, approvalID string) error {
+	if approvalID == "" {
+		return fmt.Errorf("no approval ID provided")
+	}
+
+	var rejectResp struct {
+		Error string `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodDelete, "/api/approvals/"+url.PathEscape(approvalID), nil, &rejectResp); err != nil {
+		return err
+	}
+	if rejectResp.Error != "" {
+		return &ServiceError{Message: rejectResp.Error}
+	}
+	return nil
+}
+
+// Maintenance returns the maintenance window of the connection, nil when it
+// is not under maintenance
+func (c *HTTPClient) Maintenance(ctx context.Context) (*Maintenance, error) {
+	var maintenanceResp struct {
+		Maintenance *Maintenance `json:"maintenance"`
+		Error       string       `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/maintenance", nil, &maintenanceResp); err != nil {
+		return nil, err
+	}
+	if maintenanceResp.Error != "" {
+		return nil, &ServiceError{Message: maintenanceResp.Error}
+	}
+	return maintenanceResp.Maintenance, nil
+}
+
+// StartMaintenance marks the connection as under maintenance: values are
+// still read but tagged maintenance=true, writes are rejected and alerts
+// suppressed. A zero duration lasts until EndMaintenance
+func (c *HTTPClient) StartMaintenance(ctx context.Context, reason string, duration time.Duration) (Maintenance, error) {
+	body := map[string]string{"reason": reason}
+	if duration != 0 {
+		body["duration"] = duration.String()
+	}
+	var maintenanceResp struct {
+		Maintenance Maintenance `json:"maintenance"`
+		Error       string      `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/api/maintenance", body, &maintenanceResp); err != nil {
+		return Maintenance{}, err
+	}
+	if maintenanceResp.Error != "" {
+		return Maintenance{}, &ServiceError{Message: maintenanceResp.Error}
+	}
+	return maintenanceResp.Maintenance, nil
+}
+
+// EndMaintenance ends the maintenance window of the connection
+func (c *HTTPClient) EndMaintenance(ctx context.Context) error {
+	var endResp struct {
+		Error string `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodDelete, "/api/maintenance", nil, &endResp); err != nil {
+		return err
+	}
+	if endResp.Error != "" {
+		return &ServiceError{Message: endResp.Error}
+	}
+	return nil
+}
+
+// Annotate adds a note of a person, e.g. "changed die on press 3", to the
+// timeline of the connection. The service stamps it with the time and
+// connection and sends it to the sinks of its poll file like sampled values.
+// Text, User and Tags are taken from the annotation
+func (c *HTTPClient) Annotate(ctx context.Context, annotation Annotation) (Annotation, error) {
+	body := map[string]interface{}{"text": annotation.Text, "user": annotation.User}
+	if len(annotation.Tags) > 0 {
+		body["tags"] = annotation.Tags
+	}
+	var annotationResp struct {
+		Annotation Annotation `json:"annotation"`
+		Error      string     `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/api/annotations", body, &annotationResp); err != nil {
+		return Annotation{}, err
+	}
+	if annotationResp.Error != "" {
+		return Annotation{}, &ServiceError{Message: annotationResp.Error}
+	}
+	return annotationResp.Annotation, nil
+}
+
+// Annotations lists the annotations of the connection the service still
+// keeps, oldest first. A zero since lists all of them
+func (c *HTTPClient) Annotations(ctx context.Context, since time.Duration) ([]Annotation, error) {
+	path := "/api/annotations"
+	if since > 0 {
+		path += "?since=" + url.QueryEscape(since.String())
+	}
+	var annotationsResp struct {
+		Annotations []Annotation `json:"annotations"`
+		Error       string       `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodGet, path, nil, &annotationsResp); err != nil {
+		return nil, err
+	}
+	if annotationsResp.Error != "" {
+		return nil, &ServiceError{Message: annotationsResp.Error}
+	}
+	return annotationsResp.Annotations, nil
+}
+
+// Schedules lists the recurring writes of the service in the order they were
+// imported, with their next and last runs
+func (c *HTTPClient) Schedules(ctx context.Context) ([]WriteSchedule, error) {
+	var schedulesResp struct {
+		Schedules []WriteSchedule `json:"schedules"`
+		Error     string          `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/schedules", nil, &schedulesResp); err != nil {
+		return nil, err
+	}
+	if schedulesResp.Error != "" {
+		return nil, &ServiceError{Message: schedulesResp.Error}
+	}
+	return schedulesResp.Schedules, nil
+}
+
+// ImportSchedules replaces the recurring writes of the service by the given
+// ones. The service checks all of them first and keeps the old ones if any is
+// invalid. Name, NodeID, Value, DataType and Cron are taken from the schedules
+func (c *HTTPClient) ImportSchedules(ctx context.Context, schedules []WriteSchedule) ([]WriteSchedule, error) {
+	body := make([]map[string]string, len(schedules))
+	for i, s := range schedules {
+		body[i] = map[string]string{"nodeId": s.NodeID, "value": s.Value, "dataType": s.DataType, "cron": s.Cron}
+		if s.Name != "" {
+			body[i]["name"] = s.Name
+		}
+	}
+	var schedulesResp struct {
+		Schedules []WriteSchedule `json:"schedules"`
+		Error     string          `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodPut, "/api/schedules", map[string]interface{}{"schedules": body}, &schedulesResp); err != nil {
+		return nil, err
+	}
+	if schedulesResp.Error != "" {
+		return nil, &ServiceError{Message: schedulesResp.Error}
+	}
+	return schedulesResp.Schedules, nil
+}
+
+// ClearSchedules removes all recurring writes of the service
+func (c *HTTPClient) ClearSchedules(ctx context.Context) error {
+	var clearResp struct {
+		Error string `json:"error,omitempty"`
+	}
+	if err := c.do(ctx, http.MethodDelete, "/api/schedules", nil, &clearResp); err != nil {
+		return err
+	}
+	if clearResp.Error != "" {
+		return &ServiceError{Message: clearResp.Error}
+	}
+	return nil
+}
+
+// do sends a request to the service and decodes the JSON response into out
+func (c *HTTPClient) do(ctx context.Context, method, path string, in interface{}, out interface{}) error {
+	var reqBody io.Reader
+	if in != nil {
+		jsonData, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("failed to create request: %v", err)
+		}
+		reqBody = bytes.NewBuffer(jsonData)
+	}
+
+	if c.opTimeout > 0 {
+		separator := "?"
+		if strings.Contains(path, "?") {
+			separator = "&"
+		}
+		path += separator + "timeout=" + url.QueryEscape(c.opTimeout.String())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("%s://%s:%d%s%s", c.scheme, c.host, c.port, c.basePath, path), reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if c.permit != "" {
+		req.Header.Set("X-Write-Permit", c.permit)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return &ConnectionError{Host: c.host, Port: c.port, Err: err}
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading response: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return &ServiceError{Message: string(body), HTTPStatus: resp.StatusCode}
+	}
+
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("error parsing response: %v", err)
+	}
+	return nil
+}
+
+// ParseNodeID extracts namespace, type and identifier from an OPC UA node ID.
+// For nsu=<uri>;Y=Z the namespace is the URI, which the service resolves to
+// the server's current namespace index
+func ParseNodeID(nodeID string) (string, string, string, error) {
+	if uri, ok := strings.CutPrefix(nodeID, "nsu="); ok {
+		return parseNamespaceURINodeID(uri)
+	}
+
+	// Expected formats: ns=X,Y=Z or ns=X;Y=Z
+	var namespace, idType, identifier string
+
+	// Determine which separator is used (comma or semicolon)
+	var parts []string
+	if strings.Contains(nodeID, ",") {
+		parts = strings.Split(nodeID, ",")
+	} else if strings.Contains(nodeID, ";") {
+		parts = strings.Split(nodeID, ";")
+	} else {
+		return "", "", "", fmt.Errorf("%w format. Expected format: ns=X,Y=Z or ns=X;Y=Z", ErrInvalidNodeID)
+	}
+
+	// Extract components
+	if len(parts) == 2 {
+		// Extract namespace
+		nsParts := strings.Split(parts[0], "=")
+		if len(nsParts) == 2 && nsParts[0] == "ns" {
+			namespace = nsParts[1]
+		}
+
+		// Extract type and identifier
+		idParts := strings.Split(parts[1], "=")
+		if len(idParts) == 2 {
+			idType = idParts[0]
+			identifier = idParts[1]
+		}
+	}
+
+	if namespace == "" || idType == "" || identifier == "" {
+		return "", "", "", fmt.Errorf("%w format. Expected format: ns=X,Y=Z or ns=X;Y=Z where Y is 'i' or 's'", ErrInvalidNodeID)
+	}
+
+	// Validate that idType is either 'i' or 's'
+	if idType != "i" && idType != "s" {
+		return "", "", "", fmt.Errorf("%w: unsupported identifier type '%s'. Only 'i' (numeric) and 's' (string) are supported", ErrInvalidNodeID, idType)
+	}
+
+	return namespace, idType, identifier, nil
+}
+
+// parseNamespaceURINodeID splits <uri>;Y=Z, the part of a node ID after nsu=
+func parseNamespaceURINodeID(s string) (string, string, string, error) {
+	for i := 0; i+2 < len(s); i++ {
+		if s[i] == ';' && (s[i+1] == 'i' || s[i+1] == 's') && s[i+2] == '=' && s[i+3:] != "" {
+			if i == 0 {
+				break
+			}
+			return s[:i], s[i+1 : i+2], s[i+3:], nil
+		}
+	}
+	return "", "", "", fmt.Errorf("%w format. Expected format: nsu=<namespace URI>;Y=Z where Y is 'i' or 's'", ErrInvalidNodeID)
+}
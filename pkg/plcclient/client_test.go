@@ -0,0 +1,501 @@
+package plcclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestClient starts a fake service and returns a client for it
+func newTestClient(t *testing.T, handler http.Handler) *HTTPClient {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.NoError(t, err)
+	return New(u.Hostname(), port)
+}
+
+// TestHTTPClientRead tests single and batch reads
+func TestHTTPClientRead(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/node", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		assert.Equal(t, "3", q.Get("namespace"))
+		assert.Equal(t, "s", q.Get("type"))
+		assert.Equal(t, "ns=3;s=Temp", q.Get("nodeID"))
+		json.NewEncoder(w).Encode(NodeResponse{NodeID: "ns=3;s=" + q.Get("identifier"), Value: 21.5})
+	})
+	mux.HandleFunc("/api/nodes", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Nodes []map[string]string `json:"nodes"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		var results []NodeResponse
+		for _, node := range req.Nodes {
+			assert.NotEmpty(t, node["nodeID"])
+			results = append(results, NodeResponse{NodeID: "ns=3;s=" + node["identifier"], Value: 1.0})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+	})
+	client := newTestClient(t, mux)
+
+	results, err := client.Read(context.Background(), "ns=3;s=Temp")
+	require.NoError(t, err)
+	assert.Equal(t, []NodeResponse{{NodeID: "ns=3;s=Temp", RequestedNodeID: "ns=3;s=Temp", Value: 21.5}}, results)
+
+	results, err = client.Read(context.Background(), "ns=3;s=A", "ns=3,s=B")
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.Equal(t, "ns=3;s=A", results[0].NodeID)
+	assert.Equal(t, "ns=3;s=B", results[1].NodeID)
+	assert.Equal(t, "ns=3,s=B", results[1].RequestedNodeID, "node IDs are echoed as given")
+
+	_, err = client.Read(context.Background(), "Temp")
+	assert.Error(t, err)
+
+	// Results that cannot be matched to the node IDs by position
+	short := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": []NodeResponse{{NodeID: "ns=3;s=A"}}})
+	}))
+	_, err = short.Read(context.Background(), "ns=3;s=A", "ns=3;s=B")
+	assert.EqualError(t, err, "service returned 1 results for 2 nodes")
+}
+
+// TestHTTPClientReadWith tests that read options reach the service
+func TestHTTPClientReadWith(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/node", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "true", r.URL.Query().Get("decodeEnums"))
+		assert.Equal(t, "true", r.URL.Query().Get("fresh"))
+		assert.Equal(t, "true", r.URL.Query().Get("withMetadata"))
+		json.NewEncoder(w).Encode(NodeResponse{NodeID: "ns=3;s=Mode", Value: 3, EnumName: "Running"})
+	})
+	mux.HandleFunc("/api/nodes", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			DecodeEnums  bool `json:"decodeEnums"`
+			Fresh        bool `json:"fresh"`
+			Synchronized bool `json:"synchronized"`
+			WithMetadata bool `json:"withMetadata"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.True(t, req.DecodeEnums)
+		assert.True(t, req.Fresh)
+		assert.True(t, req.Synchronized)
+		assert.True(t, req.WithMetadata)
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": []NodeResponse{{}, {}}})
+	})
+	client := newTestClient(t, mux)
+
+	opts := ReadOptions{DecodeEnums: true, Fresh: true, Synchronized: true, WithMetadata: true}
+	results, err := client.ReadWith(context.Background(), opts, "ns=3;s=Mode")
+	require.NoError(t, err)
+	assert.Equal(t, "Running", results[0].EnumName)
+
+	results, err = client.ReadWith(context.Background(), opts, "ns=3;s=A", "ns=3;s=B")
+	require.NoError(t, err)
+	assert.Len(t, results, 2)
+}
+
+// TestHTTPClientModbus tests the point parameters of Modbus reads and the
+// body of Modbus writes
+func TestHTTPClientModbus(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/modbus", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			var req map[string]string
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			if req["value"] == "bad" {
+				json.NewEncoder(w).Encode(NodeResponse{NodeID: req["point"], Error: "invalid value"})
+				return
+			}
+			json.NewEncoder(w).Encode(NodeResponse{NodeID: req["point"], Value: req["value"]})
+			return
+		}
+		var results []NodeResponse
+		for _, point := range r.URL.Query()["point"] {
+			results = append(results, NodeResponse{NodeID: point, Value: 1})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+	})
+	client := newTestClient(t, mux)
+
+	results, err := client.ReadModbus(context.Background(), "1/holding/0/uint16", "1/coil/3/bool")
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.Equal(t, "1/coil/3/bool", results[1].NodeID)
+	assert.Equal(t, "1/coil/3/bool", results[1].RequestedNodeID)
+
+	result, err := client.WriteModbus(context.Background(), "1/holding/0/uint16", "7")
+	require.NoError(t, err)
+	assert.Equal(t, "7", result.Value)
+	_, err = client.WriteModbus(context.Background(), "1/holding/0/uint16", "bad")
+	assert.ErrorContains(t, err, "invalid value")
+}
+
+// TestHTTPClientWrite tests the write request body and error reporting
+func TestHTTPClientWrite(t *testing.T) {
+	var body map[string]interface{}
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body = nil
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		if body["value"] == "bad" {
+			json.NewEncoder(w).Encode(NodeResponse{Error: "write failed"})
+			return
+		}
+		json.NewEncoder(w).Encode(NodeResponse{NodeID: "ns=3;s=Name", Value: body["value"]})
+	}))
+
+	resp, err := client.Write(context.Background(), WriteRequest{NodeID: "ns=3;s=Name", Value: "Pump", DataType: "localizedtext", Attribute: "DisplayName"})
+	require.NoError(t, err)
+	assert.Equal(t, "Pump", resp.Value)
+	assert.Equal(t, "DisplayName", body["attribute"])
+	assert.Equal(t, "localizedtext", body["dataType"])
+
+	_, err = client.Write(context.Background(), WriteRequest{NodeID: "ns=3;s=Name", Value: "bad", DataType: "string", Attribute: "Value"})
+	assert.EqualError(t, err, "service reported error: write failed")
+	assert.NotContains(t, body, "attribute")
+	assert.NotContains(t, body, "dryRun")
+
+	_, err = client.Write(context.Background(), WriteRequest{NodeID: "ns=3;s=Name", Value: "Pump", DataType: "string", DryRun: true})
+	require.NoError(t, err)
+	assert.Equal(t, true, body["dryRun"])
+}
+
+// TestHTTPClientSetBit tests the bit write request
+func TestHTTPClientSetBit(t *testing.T) {
+	var body map[string]interface{}
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/bit", r.URL.Path)
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		json.NewEncoder(w).Encode(NodeResponse{NodeID: "ns=3;s=ControlWord", Value: 17})
+	}))
+
+	resp, err := client.SetBit(context.Background(), "ns=3;s=ControlWord", 4, true)
+	require.NoError(t, err)
+	assert.Equal(t, 17.0, resp.Value)
+	assert.Equal(t, 4.0, body["bit"])
+	assert.Equal(t, 1.0, body["value"])
+	assert.Equal(t, "ControlWord", body["identifier"])
+}
+
+// TestHTTPClientValidate tests checking nodes and a result count mismatch
+func TestHTTPClientValidate(t *testing.T) {
+	var body map[string][]string
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/validate", r.URL.Path)
+		assert.Equal(t, http.MethodPost, r.Method)
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": []NodeCheck{
+			{NodeID: "ns=3;s=Setpoint", Exists: true, NodeClass: "Variable", DataType: "float", Readable: true, Writable: true},
+			{NodeID: "ns=3;s=Missing", Error: "BadNodeIdUnknown"},
+		}})
+	}))
+
+	checks, err := client.Validate(context.Background(), "ns=3;s=Setpoint", "ns=3;s=Missing")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ns=3;s=Setpoint", "ns=3;s=Missing"}, body["nodes"])
+	require.Len(t, checks, 2)
+	assert.True(t, checks[0].Writable)
+	assert.False(t, checks[1].Exists)
+
+	_, err = client.Validate(context.Background(), "ns=3;s=Setpoint")
+	assert.Error(t, err)
+}
+
+// TestHTTPClientCancel tests cancelling an operation and reporting unknown IDs
+func TestHTTPClientCancel(t *testing.T) {
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodDelete, r.Method)
+		if r.URL.Path == "/api/operations/w-3" {
+			json.NewEncoder(w).Encode(map[string]string{"cancelled": "w-3"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"error": "unknown operation"})
+	}))
+
+	assert.NoError(t, client.Cancel(context.Background(), "w-3"))
+	assert.Error(t, client.Cancel(context.Background(), "b-9"))
+	assert.Error(t, client.Cancel(context.Background(), ""))
+}
+
+// TestHTTPClientBasePath tests calling a service under --api-base-path
+func TestHTTPClientBasePath(t *testing.T) {
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/plccli/api/operations/w-3", r.URL.Path)
+		json.NewEncoder(w).Encode(map[string]string{"cancelled": "w-3"})
+	}))
+
+	assert.NoError(t, client.WithBasePath("plccli/").Cancel(context.Background(), "w-3"))
+}
+
+// TestHTTPClientJobs tests starting a job, polling it and fetching its result
+func TestHTTPClientJobs(t *testing.T) {
+	var body map[string]interface{}
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/jobs":
+			assert.Equal(t, http.MethodPost, r.Method)
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			json.NewEncoder(w).Encode(map[string]interface{}{"job": Job{ID: "j-1", State: "running"}})
+		case "/api/jobs/j-1":
+			json.NewEncoder(w).Encode(map[string]interface{}{"job": Job{ID: "j-1", State: "done", Progress: 2}})
+		case "/api/jobs/j-1/result":
+			json.NewEncoder(w).Encode(map[string]interface{}{"nodes": []BrowseNode{{NodeID: "ns=3;s=A"}, {NodeID: "ns=3;s=B"}}})
+		default:
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "unknown job"})
+		}
+	}))
+
+	job, err := client.StartJob(context.Background(), JobRequest{Kind: "browse", NodeID: "ns=3;s=Line1", MaxDepth: 5})
+	require.NoError(t, err)
+	assert.True(t, job.Running())
+	assert.Equal(t, "browse", body["kind"])
+	assert.Equal(t, 5.0, body["maxDepth"])
+
+	job, err = client.Job(context.Background(), "j-1")
+	require.NoError(t, err)
+	assert.False(t, job.Running())
+	assert.Equal(t, int64(2), job.Progress)
+
+	nodes, err := client.BrowseJobResult(context.Background(), "j-1")
+	require.NoError(t, err)
+	assert.Len(t, nodes, 2)
+
+	_, err = client.Job(context.Background(), "j-2")
+	assert.Error(t, err)
+}
+
+// TestHTTPClientHistoryExportJob tests starting a history export and fetching its file
+func TestHTTPClientHistoryExportJob(t *testing.T) {
+	var body map[string]interface{}
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/jobs":
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			json.NewEncoder(w).Encode(map[string]interface{}{"job": Job{ID: "j-1", State: "running"}})
+		case "/api/jobs/j-1/result":
+			json.NewEncoder(w).Encode(HistoryExport{ID: "export-1", File: "/tmp/export-1.jsonl", Nodes: 2, Samples: 1500})
+		}
+	}))
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	_, err := client.StartJob(context.Background(), JobRequest{Kind: "history-export", NodeIDs: []string{"ns=3;s=A", "ns=3;s=B"}, Start: start})
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"ns=3;s=A", "ns=3;s=B"}, body["nodeIds"])
+	assert.Equal(t, "2026-01-01T00:00:00Z", body["start"])
+	assert.NotContains(t, body, "end")
+
+	export, err := client.HistoryExportJobResult(context.Background(), "j-1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1500), export.Samples)
+	assert.Equal(t, "/tmp/export-1.jsonl", export.File)
+}
+
+// TestHTTPClientSubscribe tests that values are delivered until the context is cancelled
+func TestHTTPClientSubscribe(t *testing.T) {
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(NodeResponse{NodeID: "ns=3;s=Temp", Value: 1.0})
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	updates, err := client.Subscribe(ctx, []string{"ns=3;s=Temp"}, 10*time.Millisecond)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		update := <-updates
+		assert.Equal(t, "ns=3;s=Temp", update.NodeID)
+	}
+	cancel()
+	for range updates {
+	}
+
+	_, err = client.Subscribe(context.Background(), []string{"ns=3;s=Temp"}, 0)
+	assert.Error(t, err)
+}
+
+// TestHTTPClientPolls tests listing, creating and removing poll groups
+func TestHTTPClientPolls(t *testing.T) {
+	var created PollConfig
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/polls" && r.Method == http.MethodPost:
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&created))
+			created.ID = "p-1"
+			json.NewEncoder(w).Encode(map[string]interface{}{"poll": created})
+		case r.URL.Path == "/api/polls":
+			json.NewEncoder(w).Encode(map[string]interface{}{"polls": []PollConfig{created}})
+		case r.URL.Path == "/api/polls/p-1" && r.Method == http.MethodDelete:
+			json.NewEncoder(w).Encode(map[string]string{"removed": "p-1"})
+		default:
+			json.NewEncoder(w).Encode(map[string]string{"error": "unknown poll group"})
+		}
+	}))
+
+	poll, err := client.AddPoll(context.Background(), PollConfig{NodeIDs: []string{"ns=3;s=Temp"}, Interval: "5s", Persist: true})
+	require.NoError(t, err)
+	assert.Equal(t, "p-1", poll.ID)
+	assert.True(t, created.Persist)
+
+	polls, err := client.Polls(context.Background())
+	require.NoError(t, err)
+	require.Len(t, polls, 1)
+	assert.Equal(t, "5s", polls[0].Interval)
+
+	assert.NoError(t, client.RemovePoll(context.Background(), "p-1"))
+	assert.Error(t, client.RemovePoll(context.Background(), "p-2"))
+	assert.Error(t, client.RemovePoll(context.Background(), ""))
+}
+
+// TestHTTPClientRecent tests reading the recent samples of a node
+func TestHTTPClientRecent(t *testing.T) {
+	since := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/recent", r.URL.Path)
+		if r.URL.Query().Get("nodeid") != "ns=3;s=Temp" {
+			json.NewEncoder(w).Encode(map[string]string{"error": "no recent samples"})
+			return
+		}
+		assert.Equal(t, "2026-03-01T08:00:00Z", r.URL.Query().Get("since"))
+		json.NewEncoder(w).Encode(map[string]interface{}{"nodeId": "ns=3;s=Temp", "samples": []Sample{
+			{Time: since.Add(time.Second), Value: 21.5},
+			{Time: since.Add(2 * time.Second), Value: 21.7},
+		}})
+	}))
+
+	samples, err := client.Recent(context.Background(), "ns=3;s=Temp", since)
+	require.NoError(t, err)
+	require.Len(t, samples, 2)
+	assert.Equal(t, 21.7, samples[1].Value)
+	assert.True(t, samples[0].Time.Equal(since.Add(time.Second)))
+
+	_, err = client.Recent(context.Background(), "ns=3;s=Other", since)
+	assert.ErrorContains(t, err, "no recent samples")
+	_, err = client.Recent(context.Background(), "", since)
+	assert.Error(t, err)
+}
+
+// TestHTTPClientGroups tests adding, reading and removing node groups
+func TestHTTPClientGroups(t *testing.T) {
+	groups := map[string]NodeGroup{}
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/api/groups/")
+		switch {
+		case r.URL.Path == "/api/groups" && r.Method == http.MethodPost:
+			var group NodeGroup
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&group))
+			groups[group.Name] = group
+			json.NewEncoder(w).Encode(map[string]interface{}{"group": group})
+		case r.URL.Path == "/api/groups":
+			list := []NodeGroup{}
+			for _, group := range groups {
+				list = append(list, group)
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"groups": list})
+		case r.Method == http.MethodDelete:
+			delete(groups, name)
+			json.NewEncoder(w).Encode(map[string]string{"removed": name})
+		default:
+			group, ok := groups[name]
+			if !ok {
+				json.NewEncoder(w).Encode(map[string]string{"error": "unknown group " + name})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"group": group})
+		}
+	}))
+	ctx := context.Background()
+
+	_, err := client.AddGroup(ctx, NodeGroup{Name: "meters", NodeIDs: []string{"ns=3;s=M1"}, Persist: true})
+	require.NoError(t, err)
+	group, err := client.Group(ctx, "meters")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ns=3;s=M1"}, group.NodeIDs)
+	assert.True(t, group.Persist)
+	list, err := client.Groups(ctx)
+	require.NoError(t, err)
+	assert.Len(t, list, 1)
+
+	require.NoError(t, client.RemoveGroup(ctx, "meters"))
+	_, err = client.Group(ctx, "meters")
+	assert.Error(t, err)
+	_, err = client.Group(ctx, "")
+	assert.Error(t, err)
+}
+
+// TestHTTPClientToken tests that the tenant token is sent with every request
+func TestHTTPClientToken(t *testing.T) {
+	var auth string
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		json.NewEncoder(w).Encode(map[string]interface{}{"connection": "default"})
+	}))
+
+	_, err := client.Info(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, auth)
+
+	_, err = client.WithToken("acme-token").Info(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer acme-token", auth)
+}
+
+// TestHTTPClientOpTimeout tests that the operation timeout is sent with every
+// request
+func TestHTTPClientOpTimeout(t *testing.T) {
+	var query url.Values
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		json.NewEncoder(w).Encode(NodeResponse{NodeID: "ns=3;s=Temp"})
+	}))
+
+	_, err := client.Read(context.Background(), "ns=3;s=Temp")
+	require.NoError(t, err)
+	assert.False(t, query.Has("timeout"))
+
+	_, err = client.WithOpTimeout(90*time.Second).Read(context.Background(), "ns=3;s=Temp")
+	require.NoError(t, err)
+	assert.Equal(t, "1m30s", query.Get("timeout"))
+	assert.Equal(t, "Temp", query.Get("identifier"), "added to the existing query")
+}
+
+// TestHTTPClientErrors tests the types of the errors of the client
+func TestHTTPClientErrors(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/node", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(NodeResponse{NodeID: "ns=3;s=Flag", Error: "Invalid boolean value: maybe", StatusCode: 0x80740000})
+	})
+	mux.HandleFunc("/api/bit", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Locked: the connection is under maintenance", http.StatusLocked)
+	})
+	client := newTestClient(t, mux)
+
+	_, err := client.Write(context.Background(), WriteRequest{NodeID: "ns=3;s=Flag", Value: "maybe", DataType: "boolean"})
+	var serviceErr *ServiceError
+	require.ErrorAs(t, err, &serviceErr)
+	assert.Equal(t, uint32(0x80740000), serviceErr.StatusCode)
+	assert.Equal(t, "service reported error: Invalid boolean value: maybe", err.Error())
+
+	_, err = client.SetBit(context.Background(), "ns=3;s=Flags", 2, true)
+	require.ErrorAs(t, err, &serviceErr)
+	assert.Equal(t, http.StatusLocked, serviceErr.HTTPStatus)
+
+	_, err = client.Read(context.Background(), "Flag")
+	assert.ErrorIs(t, err, ErrInvalidNodeID)
+
+	_, err = New("127.0.0.1", 1).Read(context.Background(), "ns=3;s=Flag")
+	var connErr *ConnectionError
+	require.ErrorAs(t, err, &connErr)
+	assert.Equal(t, 1, connErr.Port)
+}
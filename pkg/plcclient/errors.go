@@ -0,0 +1,52 @@
+package plcclient
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidNodeID is wrapped by the errors of node IDs that cannot be parsed
+var ErrInvalidNodeID = errors.New("invalid node ID")
+
+// ServiceError is an error reported by the service, for a node or for the
+// whole request
+type ServiceError struct {
+	Message string
+	// StatusCode is the OPC UA status code of the failure, 0 when the
+	// service did not report one
+	StatusCode uint32
+	// HTTPStatus is the status of a request the service refused, 0 when the
+	// error was reported in the response body
+	HTTPStatus int
+}
+
+func (e *ServiceError) Error() string {
+	if e.HTTPStatus != 0 {
+		return "service error: " + e.Message
+	}
+	return "service reported error: " + e.Message
+}
+
+// ConnectionError is the error of a request that did not reach the service
+type ConnectionError struct {
+	Host string
+	Port int
+	Err  error
+}
+
+func (e *ConnectionError) Error() string {
+	return fmt.Sprintf("cannot connect to OPCUA service on %s:%d: %v (is it running?)", e.Host, e.Port, e.Err)
+}
+
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
+// Err returns the error of a node result as a *ServiceError, nil when the
+// read or write succeeded
+func (r NodeResponse) Err() error {
+	if r.Error == "" {
+		return nil
+	}
+	return &ServiceError{Message: r.Error, StatusCode: r.StatusCode}
+}
@@ -0,0 +1,205 @@
+package plcclient
+
+import "time"
+
+// NodeResponse is the result of reading or writing a single node
+type NodeResponse struct {
+	NodeID          string      `json:"nodeID"`
+	RequestedNodeID string      `json:"requestedNodeID,omitempty"` // The node ID exactly as the caller gave it, for joining results to requests
+	Value           interface{} `json:"value"`
+	SourceTimestamp *time.Time  `json:"sourceTimestamp,omitempty"`
+	ServerTimestamp *time.Time  `json:"serverTimestamp,omitempty"`
+	EnumName        string      `json:"enumName,omitempty"` // Symbolic name of an enumeration value, see ReadOptions
+	Unit            string      `json:"unit,omitempty"`     // EngineeringUnits of an analog item, see ReadOptions
+	EURange         *EURange    `json:"euRange,omitempty"`  // EURange of an analog item, see ReadOptions
+	DataType        string      `json:"dataType,omitempty"` // Data type a dry run converted the value to, see WriteRequest
+	Error           string      `json:"error,omitempty"`
+	StatusCode      uint32      `json:"statusCode,omitempty"` // OPC UA status code of Error, when the service knows it
+}
+
+// ReadOptions controls how the service reads nodes
+type ReadOptions struct {
+	DecodeEnums bool // Add the symbolic name of enumeration values (EnumStrings/EnumValues)
+	Fresh       bool // Read the PLC even if the service has a cached value (--cache-ttl)
+
+	// Add the unit and range of analog items (EngineeringUnits and EURange
+	// properties)
+	WithMetadata bool
+
+	// Read the nodes in a single request, bypassing the cache, and timestamp
+	// them all with the time of the read
+	Synchronized bool
+}
+
+// EURange is the range of values an analog item normally takes
+type EURange struct {
+	Low  float64 `json:"low"`
+	High float64 `json:"high"`
+}
+
+// WriteRequest describes a value to write to a node
+type WriteRequest struct {
+	NodeID    string // ns=X;s=Y or ns=X;i=Y
+	Value     string // Converted by the service according to DataType
+	DataType  string // boolean, int16, float, string, dtl, struct (JSON Value), ... or "auto"
+	Attribute string // Defaults to Value
+	Priority  string // high (default) or low; low priority writes wait for all high priority writes
+	DryRun    bool   // Only convert the value; the result holds it and its DataType, nothing is written
+}
+
+// PollConfig is a group of nodes the service samples at a fixed interval.
+// Groups with Persist set are saved by the service and restored when it restarts
+type PollConfig struct {
+	ID       string   `json:"id"` // Assigned by the service when empty
+	NodeIDs  []string `json:"nodeIds"`
+	Interval string   `json:"interval"` // Go duration, e.g. 5s
+	Persist  bool     `json:"persist,omitempty"`
+	Tenant   string   `json:"tenant,omitempty"` // Owning tenant, set by the service
+
+	// Read all nodes in a single request and timestamp them with the time of
+	// the read, so correlated values line up
+	Synchronized bool `json:"synchronized,omitempty"`
+}
+
+// NodeGroup is a named set of nodes the CLI reads as @name. Groups come
+// from the service's groups file or are added through the API; added groups
+// with Persist set are saved by the service and restored when it restarts
+type NodeGroup struct {
+	Name    string   `json:"name"`
+	NodeIDs []string `json:"nodeIds"`
+	Persist bool     `json:"persist,omitempty"`
+	File    bool     `json:"file,omitempty"` // From the groups file, set by the service
+}
+
+// BrowseNode is a node discovered by Browse
+type BrowseNode struct {
+	NodeID      string `json:"nodeId"`
+	BrowseName  string `json:"browseName"`
+	Path        string `json:"path"`
+	DataType    string `json:"dataType"`
+	Writable    bool   `json:"writable"`
+	Description string `json:"description"`
+}
+
+// BrowsePage is a page of a browse, see BrowsePaged. Continuation is empty
+// on the last page
+type BrowsePage struct {
+	Nodes        []BrowseNode `json:"nodes"`
+	Continuation string       `json:"continuation,omitempty"`
+}
+
+// Sample is a value the service sampled for a poll group or its poll file,
+// see Recent
+type Sample struct {
+	Time  time.Time   `json:"time"` // Source timestamp, or the sample time if the server has none
+	Value interface{} `json:"value"`
+}
+
+// NodeCheck tells whether a node exists and how the service's session may
+// access it, see Validate
+type NodeCheck struct {
+	NodeID    string `json:"nodeID"` // As requested
+	Exists    bool   `json:"exists"`
+	NodeClass string `json:"nodeClass,omitempty"` // Variable, Object, ...
+	DataType  string `json:"dataType,omitempty"`  // Write data type name like float, or the DataType node ID of other types
+	Readable  bool   `json:"readable"`
+	Writable  bool   `json:"writable"`
+	Error     string `json:"error,omitempty"` // Why the node does not exist or its attributes could not be read
+}
+
+// JobRequest describes an asynchronous job to start with StartJob
+type JobRequest struct {
+	Kind     string    // browse, read-subtree or history-export
+	NodeID   string    // Start node, defaults to the Objects folder
+	MaxDepth int       // Levels below NodeID
+	NodeIDs  []string  // Nodes of a history export
+	Start    time.Time // Start of the exported history
+	End      time.Time // End of the exported history, defaults to now
+}
+
+// Job is the progress of an asynchronous job
+type Job struct {
+	ID       string     `json:"id"`
+	Kind     string     `json:"kind"`
+	Target   string     `json:"target"`
+	State    string     `json:"state"` // running, done, failed or cancelled
+	Phase    string     `json:"phase,omitempty"`
+	Progress int64      `json:"progress"`
+	Total    int64      `json:"total,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// HistoryExport is the result of a history-export job
+type HistoryExport struct {
+	ID      string `json:"id"`
+	File    string `json:"file"`    // JSON lines file on the service host, one value per line
+	Nodes   int    `json:"nodes"`   // Exported nodes
+	Samples int64  `json:"samples"` // Exported values
+}
+
+// Running reports whether the job has not finished yet
+func (j Job) Running() bool {
+	return j.State == "running"
+}
+
+// WritePermit is a time-limited permit to write through a service started
+// with --write-permits, see RequestPermit and WithPermit
+type WritePermit struct {
+	ID      string    `json:"id"`
+	Tenant  string    `json:"tenant,omitempty"`
+	Reason  string    `json:"reason"`
+	Issued  time.Time `json:"issued"`
+	Expires time.Time `json:"expires"`
+}
+
+// PendingWrite is a write of a critical node waiting for a second person to
+// confirm it, see RequestApproval and ConfirmApproval
+type PendingWrite struct {
+	ID          string    `json:"id"`
+	NodeID      string    `json:"nodeId"`
+	Value       string    `json:"value"`
+	DataType    string    `json:"dataType"`
+	Attribute   string    `json:"attribute,omitempty"` // Value when empty
+	Reason      string    `json:"reason"`
+	RequestedBy string    `json:"requestedBy"` // Tenant that requested it, with its source, e.g. file:alice
+	Requested   time.Time `json:"requested"`
+	Expires     time.Time `json:"expires"` // Dropped unless confirmed by then
+}
+
+// Maintenance is the maintenance window of a connection, see
+// StartMaintenance. Writes are blocked and alerts suppressed while it lasts
+type Maintenance struct {
+	Reason string     `json:"reason"`
+	Tenant string     `json:"tenant,omitempty"` // who started it
+	Since  time.Time  `json:"since"`
+	Until  *time.Time `json:"until,omitempty"` // nil until ended with EndMaintenance
+}
+
+// Annotation is a note of a person on the timeline of a connection, e.g.
+// "changed die on press 3", see Annotate
+type Annotation struct {
+	Text       string            `json:"text"`
+	User       string            `json:"user,omitempty"`
+	Tenant     string            `json:"tenant,omitempty"`
+	Connection string            `json:"connection"`
+	Endpoint   string            `json:"endpoint,omitempty"`
+	Tags       map[string]string `json:"tags,omitempty"` // Extra tags, e.g. site=plant1
+	Time       time.Time         `json:"time"`
+	Line       string            `json:"line,omitempty"` // As InfluxDB line protocol
+}
+
+// WriteSchedule is a recurring write of the service, e.g. a setpoint for the
+// night shift, see ImportSchedules
+type WriteSchedule struct {
+	Name      string     `json:"name,omitempty"`
+	NodeID    string     `json:"nodeId"`
+	Value     string     `json:"value"`
+	DataType  string     `json:"dataType"`
+	Cron      string     `json:"cron"`                // minute hour day-of-month month day-of-week, in the service's local time
+	Next      *time.Time `json:"next,omitempty"`      // Set by the service
+	LastRun   *time.Time `json:"lastRun,omitempty"`   // Set by the service
+	LastError string     `json:"lastError,omitempty"` // Of the last run, set by the service
+	Tenant    string     `json:"tenant,omitempty"`    // That imported it, set by the service
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"umicli/pkg/plcclient"
+)
+
+// runPointCommand runs point get, set or browse against the service of a
+// backend connection (Modbus TCP, EtherNet/IP or a backend linked in), or
+// against the device itself with --direct. References are in the backend's
+// syntax
+func runPointCommand(args []string, port int, influxOpts influxOptions) {
+	if len(args) < 1 || (args[0] != "get" && args[0] != "set" && args[0] != "browse") {
+		printUsage()
+		os.Exit(exitUsage)
+	}
+
+	host, port, influxOpts := deviceService(port, influxOpts)
+	if *direct {
+		defer stopDirect()
+	}
+
+	switch args[0] {
+	case "get":
+		refs := args[1:]
+		if len(refs) == 0 {
+			fmt.Fprintf(os.Stderr, "Error: point get needs at least one reference\n")
+			exitWithCode(exitUsage)
+		}
+		bitOpts := deviceBitOptions()
+
+		// The default measurement of OPC UA nodes does not fit other
+		// protocols, the points are measured by protocol instead
+		name := *measurement
+		if name == "opcua_node" {
+			name = ""
+		}
+		get := func() (string, error) {
+			return getDeviceValues(refs, (*plcclient.HTTPClient).ReadPoints, host, port, *outputFormat, name, bitOpts, influxOpts)
+		}
+		if *interval > 0 {
+			pollDeviceValues(get, *interval)
+			return
+		}
+		value, err := get()
+		if err != nil {
+			handleConnectionError(err)
+		}
+		fmt.Println(value)
+
+	case "set":
+		if len(args) < 3 || len(args) > 4 {
+			fmt.Println("Error: point set needs <ref> <value> [type]")
+			printUsage()
+			exitWithCode(exitUsage)
+		}
+		dataType := ""
+		if len(args) == 4 {
+			dataType = args[3]
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), callTimeout(10*time.Second))
+		defer cancel()
+		result, err := newServiceClient(host, port).WritePoint(ctx, args[1], args[2], dataType)
+		if err != nil {
+			handleConnectionError(err)
+		}
+		fmt.Printf("Successfully set %s to %v with type %s (via %s:%d)\n", result.NodeID, result.Value, result.DataType, host, port)
+
+	case "browse":
+		if len(args) > 3 {
+			fmt.Println("Error: point browse takes [ref] [max-depth]")
+			printUsage()
+			exitWithCode(exitUsage)
+		}
+		ref, maxDepth := "", 3
+		if len(args) > 1 {
+			ref = args[1]
+		}
+		if len(args) > 2 {
+			n, err := strconv.Atoi(args[2])
+			if err != nil || n < 1 {
+				fmt.Fprintf(os.Stderr, "Error: invalid max depth %q\n", args[2])
+				exitWithCode(exitUsage)
+			}
+			maxDepth = n
+		}
+		out, err := browsePoints(ref, maxDepth, host, port)
+		if err != nil {
+			handleConnectionError(err)
+		}
+		fmt.Print(out)
+	}
+}
+
+// deviceService returns the host and port of the service for the commands
+// of device connections: a loopback service of the device itself with
+// --direct, whose stopDirect the caller defers. The influx options get the
+// labels of the tenant
+func deviceService(port int, influxOpts influxOptions) (string, int, influxOptions) {
+	host := *serviceHost
+	if *direct {
+		directPort, err := startBackendDirect(*endpoint, *timeout, *verbose)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitConnection)
+		}
+		host, port = "127.0.0.1", directPort
+		*apiBasePath = "" // The direct mode server has no base path
+	}
+
+	// Tag the metrics of a tenant with its labels
+	if *token != "" && *outputFormat == "influx" {
+		var err error
+		if influxOpts, err = influxOpts.withTenantLabels(host, port); err != nil {
+			handleConnectionError(err)
+		}
+	}
+	return host, port, influxOpts
+}
+
+// deviceBitOptions returns the bit expansion of the --bits flags for the get
+// commands of device connections, exiting on invalid combinations
+func deviceBitOptions() bitOptions {
+	if bits.enabled && *outputFormat != "influx" {
+		fmt.Fprintf(os.Stderr, "Error: --bits requires --format influx\n")
+		exitWithCode(exitUsage)
+	}
+	if *bitsSummary && !bits.enabled {
+		fmt.Fprintf(os.Stderr, "Error: --bits-summary requires --bits\n")
+		exitWithCode(exitUsage)
+	}
+	var nameMap bitNameMap
+	if *bitNamesFile != "" {
+		var err error
+		if nameMap, err = loadBitNameMap(*bitNamesFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --bit-names-file: %v\n", err)
+			exitWithCode(exitUsage)
+		}
+	}
+	return bitOptions{
+		enabled:  bits.enabled,
+		names:    parseBitNames(*bitNames),
+		nameMap:  nameMap,
+		selected: bits.selected,
+		summary:  *bitsSummary,
+	}
+}
+
+// deviceRead reads references of a device connection with the client
+// library, e.g. (*plcclient.HTTPClient).ReadModbus
+type deviceRead func(c *plcclient.HTTPClient, ctx context.Context, refs ...string) ([]NodeResponse, error)
+
+// getDeviceValues reads references of a device connection through the
+// service and formats them like opcua get, with the reference as node_id.
+// An empty measurement is the protocol of the connection
+func getDeviceValues(refs []string, read deviceRead, host string, port int, format string, measurement string, bitOpts bitOptions, influxOpts influxOptions) (string, error) {
+	if err := validateBitNames(bitOpts.names); err != nil {
+		return "", err
+	}
+	endpoint := "unknown"
+	if info, err := getConnectionInfo(host, port); err == nil {
+		endpoint, _ = info["endpoint"].(string)
+		influxOpts = influxOpts.withMaintenance(info)
+		if measurement == "" {
+			measurement, _ = info["protocol"].(string)
+		}
+	}
+	if measurement == "" {
+		measurement = "point"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout(10*time.Second))
+	defer cancel()
+	results, err := read(newServiceClient(host, port), ctx, refs...)
+	if err != nil {
+		return "", err
+	}
+
+	if format == "influx" {
+		var lines []string
+		for i, result := range results {
+			if result.Error != "" {
+				if len(results) == 1 {
+					return "", result.Err()
+				}
+				continue // Skip references with errors
+			}
+			if bitOpts.enabled {
+				bitLines, err := formatInfluxOutputWithBits(measurement, refs[i], result.Value, endpoint, bitOpts, influxOpts.forResult(result))
+				if err != nil {
+					return "", fmt.Errorf("bit expansion failed for %s: %v", refs[i], err)
+				}
+				lines = append(lines, bitLines...)
+			} else {
+				lines = append(lines, formatInfluxLines(measurement, refs[i], result.Value, endpoint, influxOpts.forResult(result))...)
+			}
+		}
+		return strings.Join(lines, "\n"), nil
+	}
+
+	if len(results) == 1 {
+		if results[0].Error != "" {
+			return "", results[0].Err()
+		}
+		return formatDefaultValue(results[0]), nil
+	}
+	return formatDefaultResults(refs, results), nil
+}
+
+// pollDeviceValues prints the values of get every interval until
+// interrupted. Read errors are reported on stderr and polling continues
+func pollDeviceValues(get func() (string, error), interval time.Duration) {
+	for {
+		value, err := get()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		} else {
+			fmt.Println(value)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// browsePoints lists the references below ref of a backend connection as a
+// table
+func browsePoints(ref string, maxDepth int, host string, port int) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout(120*time.Second))
+	defer cancel()
+	nodes, err := newServiceClient(host, port).BrowsePoints(ctx, ref, maxDepth)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Path\tRef\tDataType\tWritable\tDescription")
+	fmt.Fprintln(w, "----\t---\t--------\t--------\t-----------")
+	for _, node := range nodes {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%s\n", node.Path, node.NodeID, node.DataType, node.Writable,
+			strings.ReplaceAll(node.Description, "\n", " "))
+	}
+	w.Flush()
+	return b.String(), nil
+}
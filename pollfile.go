@@ -0,0 +1,860 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Lines kept per buffer when the poll file does not set buffer
+const defaultPollBufferSize = 10000
+
+// Lines per sink request when the sink does not set batch
+const defaultSinkBatchSize = 5000
+
+// pollFile is the poll configuration loaded with --poll-file:
+//
+//	buffer: 10000
+//	sinks:
+//	  - url: http://influxdb:8086/api/v2/write?org=plant&bucket=plc
+//	    headers: {Authorization: Token 7d3f...}
+//	    interval: 10s
+//	    batch: 5000
+//	  - dir: /media/usb/plc
+//	    format: csv
+//	    gzip: true
+//	    rotate: {size: 50MB, every: 1h}
+//	    retention: {age: 30d, size: 2GB}
+//	  - sqlite: /var/lib/plccli/history.db
+//	    retention: 30d
+//	polls:
+//	  - node: ns=3;s=Temperature
+//	    interval: 5s
+//	    measurement: boiler
+//	    transform: value / 10
+//	  - node: ns=5;s=Alarms
+//	    interval: 1s
+//	    measurement: alarms
+//	    bits: {0: estop, 7: drive_fault}
+type pollFile struct {
+	Buffer int              `yaml:"buffer"` // Lines kept per consumer, oldest are dropped first
+	Sinks  []*pollSink      `yaml:"sinks"`
+	Polls  []*pollFileEntry `yaml:"polls"`
+}
+
+// pollFileEntry is one sampled node of a poll file
+type pollFileEntry struct {
+	Node        string         `yaml:"node"`
+	Interval    string         `yaml:"interval"`
+	Measurement string         `yaml:"measurement"` // Default opcua_node
+	Bits        map[int]string `yaml:"bits"`        // Named bits, each emitted as its own line
+	Priority    string         `yaml:"priority"`    // alarm, process (default) or diagnostic, see parsePriority
+	Transform   string         `yaml:"transform"`   // Expression scaling the value, see parseTransform
+
+	// Read with the other synchronized entries of the interval in a single
+	// request and timestamped with the time of the read
+	Synchronized bool `yaml:"synchronized"`
+
+	transform *transformExpr // Parsed Transform, nil without one
+}
+
+// pollSink receives the buffered lines with an HTTP POST in InfluxDB line
+// protocol, e.g. the InfluxDB write API or a Telegraf http_listener. A sink
+// with dir writes them to rotated files instead (fileSink), one with sqlite
+// to a local database (historian) and one with webhook posts their value
+// changes as signed JSON (webhook.go). Sinks with grafanaLive push the lines
+// to Grafana Live channels, those with loki alarms and events to Loki
+// (grafana.go). Sinks with azureIoT or awsIoT publish them to the cloud IoT
+// platforms over MQTT and report the connection status (cloudiot.go), those
+// with mqtt to a broker as JSON or Sparkplug B (sparkplug.go)
+type pollSink struct {
+	URL       string            `yaml:"url"`
+	Headers   map[string]string `yaml:"headers"`
+	Interval  string            `yaml:"interval"`  // Default 10s
+	Batch     int               `yaml:"batch"`     // Lines per request, default 5000
+	Gzip      bool              `yaml:"gzip"`      // Requests with Content-Encoding: gzip, or gzipped files
+	Bandwidth string            `yaml:"bandwidth"` // Request body bytes per second, e.g. 2KB
+
+	Dir    string       `yaml:"dir"`    // Directory of the files
+	Prefix string       `yaml:"prefix"` // File names start with it, default plccli
+	Format string       `yaml:"format"` // influx (default) or csv
+	Rotate fileRotation `yaml:"rotate"`
+
+	SQLite string `yaml:"sqlite"` // Database file
+
+	// Webhook receiving value changes as signed JSON, see webhook.go
+	Webhook    string `yaml:"webhook"`
+	Secret     string `yaml:"secret"`     // HMAC-SHA256 key of the signature
+	SecretFile string `yaml:"secretFile"` // Or a file with it
+
+	// Grafana server whose Live channels get the lines, see grafana.go
+	GrafanaLive string `yaml:"grafanaLive"`
+	Stream      string `yaml:"stream"` // Stream of the channels, default plccli
+
+	// Loki server getting the alarms, annotations and connection events
+	Loki   string            `yaml:"loki"`
+	Labels map[string]string `yaml:"labels"` // Extra stream labels
+
+	// Cloud IoT platforms getting the lines over MQTT, see cloudiot.go
+	AzureIoT *azureIoT `yaml:"azureIoT"`
+	AWSIoT   *awsIoT   `yaml:"awsIoT"`
+	// Or an MQTT broker
+	MQTT *mqttBroker `yaml:"mqtt"`
+	// How often they report the status with the sink's backlog, default 1m
+	StatusInterval string `yaml:"statusInterval"`
+
+	// Files or samples kept, default everything for dir and 30d for sqlite
+	Retention retention `yaml:"retention"`
+
+	store   lineWriter        // File and database sinks
+	budget  *sinkBudget       // HTTP sinks with bandwidth
+	latency *latencyHistogram // Source timestamp to acknowledgement
+	changes *changeFilter     // Webhook and Loki sinks
+	secret  []byte            // Webhook sinks
+	pushURL string            // Grafana Live and Loki sinks
+	cloud   *cloudSink        // Azure IoT, AWS IoT and MQTT sinks
+}
+
+// lineWriter is a sink that stores the lines itself instead of posting them
+type lineWriter interface {
+	// write stores lines; without lines it only does its housekeeping
+	write(lines []string) error
+	close() error
+	stats() storageStats
+}
+
+// influxSink returns a sink writing to InfluxDB. With an organization the v2
+// write API is used, otherwise the v1 API with the bucket as database. The
+// token is an API token (v2) or username:password (v1)
+func influxSink(baseURL, token, org, bucket string) (*pollSink, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid InfluxDB URL %q", baseURL)
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("an InfluxDB bucket (v1: database) is required")
+	}
+
+	query := url.Values{"precision": {"ns"}}
+	if org != "" {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+		query.Set("org", org)
+		query.Set("bucket", bucket)
+	} else {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/write"
+		query.Set("db", bucket)
+	}
+	u.RawQuery = query.Encode()
+
+	sink := &pollSink{URL: u.String(), Interval: "10s", Batch: defaultSinkBatchSize}
+	if token != "" {
+		sink.Headers = map[string]string{"Authorization": "Token " + token}
+	}
+	return sink, nil
+}
+
+// checkEndpoint checks that the nodes of a poll file fit the connection:
+// Modbus points for modbus:// endpoints, Logix tags for enip:// endpoints and
+// node IDs for OPC UA servers. The references of other backends are theirs
+// to check
+func (pf *pollFile) checkEndpoint(endpoint string) error {
+	if isBackendEndpoint(endpoint) && !isModbusEndpoint(endpoint) && !isENIPEndpoint(endpoint) {
+		return nil
+	}
+	for _, entry := range pf.Polls {
+		var fits bool
+		switch {
+		case isModbusPoint(entry.Node):
+			fits = isModbusEndpoint(endpoint)
+		case isENIPTag(entry.Node):
+			fits = isENIPEndpoint(endpoint)
+		default:
+			fits = !isModbusEndpoint(endpoint) && !isENIPEndpoint(endpoint)
+		}
+		if !fits {
+			return fmt.Errorf("%s cannot be read from %s", entry.Node, endpoint)
+		}
+	}
+	return nil
+}
+
+// loadPollFile reads and validates a poll file
+func loadPollFile(path string) (*pollFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read poll file %s: %v", path, err)
+	}
+	pf := &pollFile{}
+	if err := yaml.Unmarshal(data, pf); err != nil {
+		return nil, fmt.Errorf("invalid poll file %s: %v", path, err)
+	}
+
+	if pf.Buffer == 0 {
+		pf.Buffer = defaultPollBufferSize
+	}
+	if pf.Buffer < 0 {
+		return nil, fmt.Errorf("invalid poll file %s: negative buffer size", path)
+	}
+	if len(pf.Polls) == 0 {
+		return nil, fmt.Errorf("invalid poll file %s: no polls", path)
+	}
+	for i, entry := range pf.Polls {
+		if entry == nil || entry.Node == "" {
+			return nil, fmt.Errorf("invalid poll file %s: poll %d has no node", path, i+1)
+		}
+		measurement := "opcua_node"
+		var node string
+		if isModbusPoint(entry.Node) {
+			// Points of Modbus connections, e.g. 1/holding/100/float32
+			point, err := parseModbusPoint(entry.Node)
+			if err != nil {
+				return nil, fmt.Errorf("invalid poll file %s: %v", path, err)
+			}
+			node, measurement = point.String(), defaultModbusMeasurement
+			if _, err := parsePollInterval(entry.Interval); err != nil {
+				return nil, fmt.Errorf("invalid poll file %s: %s: %v", path, node, err)
+			}
+		} else if isENIPTag(entry.Node) {
+			// Tags of EtherNet/IP connections, e.g. Program:Main.Temperature
+			tag, err := parseENIPTag(entry.Node)
+			if err != nil {
+				return nil, fmt.Errorf("invalid poll file %s: %v", path, err)
+			}
+			node, measurement = tag.name, defaultENIPMeasurement
+			if _, err := parsePollInterval(entry.Interval); err != nil {
+				return nil, fmt.Errorf("invalid poll file %s: %s: %v", path, node, err)
+			}
+		} else {
+			if node, err = normalizeNodeID(entry.Node); err != nil {
+				return nil, fmt.Errorf("invalid poll file %s: %v", path, err)
+			}
+			if _, err := validatePollConfig(&PollConfig{NodeIDs: []string{node}, Interval: entry.Interval}); err != nil {
+				return nil, fmt.Errorf("invalid poll file %s: %s: %v", path, node, err)
+			}
+		}
+		entry.Node = node
+		if entry.Measurement == "" {
+			entry.Measurement = measurement
+		}
+		for bitNum, name := range entry.Bits {
+			if bitNum < 0 || bitNum > 31 {
+				return nil, fmt.Errorf("invalid poll file %s: bit %d of %s out of range (0-31)", path, bitNum, node)
+			}
+			if strings.TrimSpace(name) == "" {
+				return nil, fmt.Errorf("invalid poll file %s: empty name for bit %d of %s", path, bitNum, node)
+			}
+		}
+		if _, err := parsePriority(entry.Priority); err != nil {
+			return nil, fmt.Errorf("invalid poll file %s: %s: %v", path, node, err)
+		}
+		if entry.Transform != "" {
+			if len(entry.Bits) > 0 {
+				return nil, fmt.Errorf("invalid poll file %s: %s: transform cannot be combined with bits", path, node)
+			}
+			if entry.transform, err = parseTransform(entry.Transform); err != nil {
+				return nil, fmt.Errorf("invalid poll file %s: %s: %v", path, node, err)
+			}
+		}
+	}
+	for _, sink := range pf.Sinks {
+		if sink == nil || countSet(sink.URL, sink.Dir, sink.SQLite, sink.Webhook, sink.GrafanaLive, sink.Loki)+countSinks(sink.AzureIoT != nil, sink.AWSIoT != nil, sink.MQTT != nil) != 1 {
+			return nil, fmt.Errorf("invalid poll file %s: a sink needs one of url, webhook, grafanaLive, loki, azureIoT, awsIoT, mqtt, dir or sqlite", path)
+		}
+		if sink.Dir == "" && (sink.Format != "" || sink.Rotate != (fileRotation{})) {
+			return nil, fmt.Errorf("invalid poll file %s: format and rotate are for sinks with dir", path)
+		}
+		if (sink.SQLite != "" || sink.GrafanaLive != "" || sink.AzureIoT != nil || sink.AWSIoT != nil || sink.MQTT != nil) && sink.Gzip {
+			return nil, fmt.Errorf("invalid poll file %s: gzip is for sinks with url, webhook, loki or dir", path)
+		}
+		if sink.GrafanaLive == "" && sink.Stream != "" {
+			return nil, fmt.Errorf("invalid poll file %s: stream is for sinks with grafanaLive", path)
+		}
+		if sink.Loki == "" && len(sink.Labels) > 0 {
+			return nil, fmt.Errorf("invalid poll file %s: labels are for sinks with loki", path)
+		}
+		var statusEvery time.Duration
+		if sink.StatusInterval != "" {
+			if sink.AzureIoT == nil && sink.AWSIoT == nil {
+				return nil, fmt.Errorf("invalid poll file %s: statusInterval is for sinks with azureIoT or awsIoT", path)
+			}
+			d, err := time.ParseDuration(sink.StatusInterval)
+			if err != nil || d < time.Second {
+				return nil, fmt.Errorf("invalid poll file %s: statusInterval must be a duration of at least 1s, got %q", path, sink.StatusInterval)
+			}
+			statusEvery = d
+		}
+		if sink.Webhook == "" && (sink.Secret != "" || sink.SecretFile != "") {
+			return nil, fmt.Errorf("invalid poll file %s: secret and secretFile are for sinks with webhook", path)
+		}
+		if sink.Bandwidth != "" {
+			if sink.Dir != "" || sink.SQLite != "" {
+				return nil, fmt.Errorf("invalid poll file %s: bandwidth is for sinks sending over the network", path)
+			}
+			budget, err := newSinkBudget(sink.Bandwidth)
+			if err != nil {
+				return nil, fmt.Errorf("invalid poll file %s: sink %s: %v", path, sink.redactedURL(), err)
+			}
+			sink.budget = budget
+		}
+		if sink.Dir == "" && sink.SQLite == "" && sink.Retention != (retention{}) {
+			return nil, fmt.Errorf("invalid poll file %s: retention is for sinks with dir or sqlite", path)
+		}
+		switch {
+		case sink.Dir != "":
+			files, err := newFileSink(sink)
+			if err != nil {
+				return nil, fmt.Errorf("invalid poll file %s: sink %s: %v", path, sink.Dir, err)
+			}
+			sink.store = files
+		case sink.SQLite != "":
+			age, size, err := sink.Retention.limits(defaultRetention)
+			if err != nil {
+				return nil, fmt.Errorf("invalid poll file %s: sink %s: %v", path, sink.SQLite, err)
+			}
+			h, err := openHistorian(sink.SQLite, age, size)
+			if err != nil {
+				return nil, fmt.Errorf("invalid poll file %s: sink %s: %v", path, sink.SQLite, err)
+			}
+			sink.store = h
+		case sink.Webhook != "":
+			if u, err := url.Parse(sink.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("invalid poll file %s: invalid webhook URL %q", path, sink.redactedURL())
+			}
+			secret, err := webhookSecret(sink.Secret, sink.SecretFile)
+			if err != nil {
+				return nil, fmt.Errorf("invalid poll file %s: sink %s: %v", path, sink.redactedURL(), err)
+			}
+			sink.secret = secret
+			sink.changes = newChangeFilter()
+		case sink.GrafanaLive != "":
+			pushURL, err := liveURL(sink.GrafanaLive, sink.Stream)
+			if err != nil {
+				return nil, fmt.Errorf("invalid poll file %s: sink %s: %v", path, sink.redactedURL(), err)
+			}
+			sink.pushURL = pushURL
+		case sink.Loki != "":
+			pushURL, err := lokiURL(sink.Loki, sink.Labels)
+			if err != nil {
+				return nil, fmt.Errorf("invalid poll file %s: sink %s: %v", path, sink.redactedURL(), err)
+			}
+			sink.pushURL = pushURL
+			sink.changes = newChangeFilter()
+		case sink.AzureIoT != nil:
+			cloud, err := newAzureSink(sink.AzureIoT)
+			if err != nil {
+				return nil, fmt.Errorf("invalid poll file %s: %v", path, err)
+			}
+			cloud.statusEvery = statusEvery
+			sink.cloud = cloud
+		case sink.AWSIoT != nil:
+			cloud, err := newAWSSink(sink.AWSIoT, os.Getenv)
+			if err != nil {
+				return nil, fmt.Errorf("invalid poll file %s: %v", path, err)
+			}
+			cloud.statusEvery = statusEvery
+			sink.cloud = cloud
+		case sink.MQTT != nil:
+			cloud, err := newMQTTSink(sink.MQTT)
+			if err != nil {
+				return nil, fmt.Errorf("invalid poll file %s: %v", path, err)
+			}
+			sink.cloud = cloud
+		}
+		if sink.Interval == "" {
+			sink.Interval = "10s"
+		}
+		if d, err := time.ParseDuration(sink.Interval); err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid poll file %s: invalid sink interval %q", path, sink.Interval)
+		}
+		if sink.Batch == 0 {
+			sink.Batch = defaultSinkBatchSize
+		}
+		if sink.Batch < 0 {
+			return nil, fmt.Errorf("invalid poll file %s: negative sink batch size", path)
+		}
+	}
+	return pf, nil
+}
+
+// lineBuffer keeps InfluxDB lines until a consumer drains them. When full,
+// the oldest lines are dropped and counted
+type lineBuffer struct {
+	mu      sync.Mutex
+	lines   []string
+	max     int
+	dropped int64 // Since the last drain
+	evicted int64 // Since the service started
+}
+
+// add appends lines, dropping the oldest ones beyond the buffer size
+func (b *lineBuffer) add(lines ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lines = append(b.lines, lines...)
+	if over := len(b.lines) - b.max; over > 0 {
+		b.lines = append([]string(nil), b.lines[over:]...)
+		b.dropped += int64(over)
+		b.evicted += int64(over)
+	}
+}
+
+// stats returns the lines buffered and dropped since the service started
+func (b *lineBuffer) stats() map[string]int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return map[string]int64{"lines": int64(len(b.lines)), "evicted": b.evicted}
+}
+
+// drain returns and removes all buffered lines and the number of lines
+// dropped since the last drain
+func (b *lineBuffer) drain() ([]string, int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	lines, dropped := b.lines, b.dropped
+	b.lines, b.dropped = nil, 0
+	return lines, dropped
+}
+
+// pollScheduler samples the nodes of a poll file and buffers their lines for
+// GET /api/buffer and each sink
+type pollScheduler struct {
+	file     *pollFile
+	endpoint string
+	read     sampleReader
+	buffer   *lineBuffer       // Drained through the API
+	sinks    []*priorityBuffer // One per sink
+	latency  *latencyHistogram // Of the lines drained through the API
+}
+
+// Poll file scheduler of the service, nil without --poll-file
+var servicePollFile *pollScheduler
+
+func newPollScheduler(pf *pollFile, read sampleReader) *pollScheduler {
+	s := &pollScheduler{
+		file:    pf,
+		read:    read,
+		buffer:  &lineBuffer{max: pf.Buffer},
+		latency: newLatencyHistogram(),
+	}
+	for _, sink := range pf.Sinks {
+		buffer := newPriorityBuffer(pf.Buffer)
+		s.sinks = append(s.sinks, buffer)
+		sink.latency = newLatencyHistogram()
+		if sink.cloud != nil {
+			sink.cloud.buffer = buffer
+		}
+	}
+	return s
+}
+
+// start samples the nodes, grouped by interval so nodes sharing an interval
+// are read in one request, and pushes to the sinks until ctx is done.
+// Synchronized entries of an interval form a group of their own
+func (s *pollScheduler) start(ctx context.Context, endpoint string) {
+	s.endpoint = endpoint
+
+	type groupKey struct {
+		interval     string
+		synchronized bool
+	}
+	groups := make(map[groupKey][]*pollFileEntry)
+	for _, entry := range s.file.Polls {
+		key := groupKey{entry.Interval, entry.Synchronized}
+		groups[key] = append(groups[key], entry)
+	}
+	for key, entries := range groups {
+		d, _ := time.ParseDuration(key.interval)
+		go s.run(ctx, d, entries)
+	}
+	for i, sink := range s.file.Sinks {
+		d, _ := time.ParseDuration(sink.Interval)
+		go s.push(ctx, d, sink, s.sinks[i])
+		if sink.Loki != "" {
+			go forwardEvents(ctx, serviceEvents, s.sinks[i])
+		}
+		if sink.cloud != nil {
+			go sink.cloud.watch(ctx, serviceEvents)
+		}
+	}
+	log.Printf("[%s] Sampling %d nodes of the poll file in %d interval groups", connectionName, len(s.file.Polls), len(groups))
+}
+
+// run samples one interval group until ctx is done
+func (s *pollScheduler) run(ctx context.Context, interval time.Duration, entries []*pollFileEntry) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.sample(ctx, entries)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sample reads the nodes of a group once and buffers their lines. Lines use
+// the source timestamp of the value, the sample time if the server has none
+// and the time of the read for synchronized groups. During maintenance they
+// are tagged maintenance=true and webhook sinks get none
+func (s *pollScheduler) sample(ctx context.Context, entries []*pollFileEntry) {
+	nodeIDs := make([]string, len(entries))
+	for i, entry := range entries {
+		nodeIDs[i] = entry.Node
+	}
+	results := s.read(ctx, nodeIDs, entries[0].Synchronized)
+	if ctx.Err() != nil {
+		return
+	}
+	serviceRecent.record(results, time.Now())
+	maintenance := serviceMaintenance.active()
+
+	var lines prioritized
+	for i, result := range results {
+		if i >= len(entries) {
+			break
+		}
+		entry := entries[i]
+		if result.Error != "" {
+			if isVerbose {
+				log.Printf("[%s] Poll file read of %s failed: %s", connectionName, entry.Node, result.Error)
+			}
+			continue
+		}
+		influxOpts := influxOptions{timestamp: "source"}.forResult(result)
+		if maintenance {
+			influxOpts.tags = append(influxOpts.tags, maintenanceTag)
+		}
+		var entryLines []string
+		if len(entry.Bits) > 0 {
+			bitLines, err := formatInfluxOutputWithBits(entry.Measurement, entry.Node, result.Value, s.endpoint, entry.bitOptions(), influxOpts)
+			if err != nil {
+				log.Printf("[%s] Poll file bits of %s: %v", connectionName, entry.Node, err)
+				continue
+			}
+			entryLines = bitLines
+		} else {
+			value := result.Value
+			if entry.transform != nil {
+				var err error
+				if value, err = entry.transform.apply(value); err != nil {
+					log.Printf("[%s] Poll file transform of %s: %v", connectionName, entry.Node, err)
+					continue
+				}
+			}
+			entryLines = formatInfluxLines(entry.Measurement, entry.Node, value, s.endpoint, influxOpts)
+		}
+		class, _ := parsePriority(entry.Priority) // Checked by loadPollFile
+		lines[class] = append(lines[class], entryLines...)
+	}
+	s.add(lines, maintenance)
+}
+
+// add buffers lines for the API and each sink. During maintenance webhook
+// sinks get none, they notify people. Loki sinks only get alarms and
+// annotations
+func (s *pollScheduler) add(lines prioritized, maintenance bool) {
+	if lines.len() == 0 {
+		return
+	}
+	s.buffer.add(lines.flatten()...)
+	for i, sink := range s.sinks {
+		if maintenance && s.file.Sinks[i].Webhook != "" {
+			continue
+		}
+		sinkLines := lines
+		if s.file.Sinks[i].Loki != "" {
+			sinkLines = lokiLines(lines)
+		}
+		for class, classLines := range sinkLines {
+			sink.add(class, classLines...)
+		}
+	}
+}
+
+// bitOptions emits only the named bits of an entry
+func (e *pollFileEntry) bitOptions() bitOptions {
+	selected := make([]int, 0, len(e.Bits))
+	for bitNum := range e.Bits {
+		selected = append(selected, bitNum)
+	}
+	sort.Ints(selected)
+	return bitOptions{
+		enabled:  true,
+		nameMap:  bitNameMap{e.Node: e.Bits},
+		selected: selected,
+	}
+}
+
+// push sends the lines buffered for a sink every interval until ctx is done,
+// alarms first. Lines of failed pushes are kept for the next attempt
+func (s *pollScheduler) push(ctx context.Context, interval time.Duration, sink *pollSink, buffer *priorityBuffer) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	client := &http.Client{Timeout: 30 * time.Second}
+	for {
+		select {
+		case <-ctx.Done():
+			if sink.store != nil {
+				lines, _ := buffer.drain()
+				sink.store.write(lines.flatten())
+				if err := sink.store.close(); err != nil {
+					log.Printf("[%s] Sink %s: %v", connectionName, sink.name(), err)
+				}
+			}
+			if sink.cloud != nil {
+				sink.cloud.close()
+			}
+			return
+		case <-ticker.C:
+		}
+
+		lines, dropped := buffer.drain()
+		if dropped > 0 {
+			log.Printf("[%s] Sink %s: dropped %d lines, buffer full", connectionName, sink.name(), dropped)
+		}
+		if sink.budget != nil {
+			var wait prioritized
+			lines, wait = sink.budget.plan(lines)
+			buffer.requeue(wait)
+		}
+		if sink.store != nil {
+			if err := sink.store.write(lines.flatten()); err != nil {
+				log.Printf("[%s] Sink %s: %v, retrying in %v", connectionName, sink.name(), err, interval)
+				buffer.requeue(lines)
+				continue
+			}
+			sink.latency.observe(lines.flatten())
+			continue
+		}
+		sink.flush(ctx, client, buffer, lines, interval)
+	}
+}
+
+// flush sends lines in batches. When a batch fails, it and the remaining
+// lines go back to the buffer for the next push. Batches the sink rejects as
+// invalid are dropped, retrying them would block the buffer forever. Webhook
+// and Loki sinks only get the lines that change a value
+func (sink *pollSink) flush(ctx context.Context, client *http.Client, buffer *priorityBuffer, classes prioritized, interval time.Duration) {
+	batch := sink.Batch
+	if batch <= 0 {
+		batch = defaultSinkBatchSize
+	}
+	if sink.changes != nil {
+		for class := range classes {
+			classes[class] = sink.changes.filter(classes[class])
+		}
+	}
+	lines := classes.flatten()
+	for sent := 0; sent < len(lines); {
+		n := min(batch, len(lines)-sent)
+		err := sink.send(ctx, client, lines[sent:sent+n])
+		var rejected *sinkRejectedError
+		switch {
+		case err == nil:
+			sink.latency.observe(lines[sent : sent+n])
+			sink.changes.ack(lines[sent : sent+n])
+		case errors.As(err, &rejected):
+			log.Printf("[%s] Sink %s: dropped %d lines: %v", connectionName, sink.name(), n, err)
+		default:
+			log.Printf("[%s] Sink %s: %v, retrying in %v", connectionName, sink.name(), err, interval)
+			buffer.requeue(classes.after(sent))
+			return
+		}
+		sent += n
+	}
+}
+
+// sinkRejectedError is a push the sink refused for good, e.g. invalid lines
+type sinkRejectedError struct {
+	status string
+	body   string
+}
+
+func (e *sinkRejectedError) Error() string {
+	return fmt.Sprintf("rejected with status %s: %s", e.status, e.body)
+}
+
+// name returns the directory, database or cloud device of a sink or its
+// redacted URL, for log messages
+func (sink *pollSink) name() string {
+	switch {
+	case sink.Dir != "":
+		return sink.Dir
+	case sink.SQLite != "":
+		return sink.SQLite
+	case sink.cloud != nil:
+		return sink.cloud.name
+	}
+	return sink.redactedURL()
+}
+
+// countSet returns how many of the values are not empty
+func countSet(values ...string) int {
+	n := 0
+	for _, value := range values {
+		if value != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// countSinks returns how many of the sink kinds are configured
+func countSinks(configured ...bool) int {
+	n := 0
+	for _, ok := range configured {
+		if ok {
+			n++
+		}
+	}
+	return n
+}
+
+// redactedURL returns the URL of an HTTP sink without credentials for log
+// messages
+func (sink *pollSink) redactedURL() string {
+	target := sink.URL
+	switch {
+	case sink.Webhook != "":
+		target = sink.Webhook
+	case sink.GrafanaLive != "":
+		target = sink.GrafanaLive
+	case sink.Loki != "":
+		target = sink.Loki
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return "<invalid url>"
+	}
+	return u.Redacted()
+}
+
+// send posts lines to the sink, gzipped if the sink says so. Webhook sinks
+// get them as signed JSON, Loki sinks as streams of log entries and cloud IoT
+// sinks as JSON messages over MQTT. Client
+// errors other than rate limiting are returned as *sinkRejectedError
+func (sink *pollSink) send(ctx context.Context, client *http.Client, lines []string) error {
+	if sink.cloud != nil {
+		return sink.cloud.send(ctx, lines, sink.budget)
+	}
+	target, contentType := sink.URL, "text/plain; charset=utf-8"
+	var payload []byte
+	var err error
+	switch {
+	case sink.Webhook != "":
+		if payload, err = webhookPayload(lines); err != nil {
+			return fmt.Errorf("failed to encode notifications: %v", err)
+		}
+		target, contentType = sink.Webhook, "application/json"
+	case sink.Loki != "":
+		if payload, err = lokiPayload(lines, sink.Labels); err != nil {
+			return fmt.Errorf("failed to encode log entries: %v", err)
+		}
+		target, contentType = sink.pushURL, "application/json"
+	case sink.GrafanaLive != "":
+		target = sink.pushURL
+	}
+	body := &bytes.Buffer{}
+	var w io.Writer = body
+	var gz *gzip.Writer
+	if sink.Gzip {
+		gz = gzip.NewWriter(body)
+		w = gz
+	}
+	if payload != nil {
+		w.Write(payload)
+	} else {
+		for _, line := range lines {
+			io.WriteString(w, line+"\n")
+		}
+	}
+	if gz != nil {
+		gz.Close()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if len(sink.secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(webhookTimestampHeader, timestamp)
+		req.Header.Set(webhookSignatureHeader, signWebhook(sink.secret, timestamp, payload))
+	}
+	if gz != nil {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	for key, value := range sink.Headers {
+		req.Header.Set(key, value)
+	}
+	bodyBytes := body.Len()
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if sink.budget != nil {
+		sink.budget.spent(linesSize(lines), bodyBytes)
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusRequestTimeout {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &sinkRejectedError{status: resp.Status, body: strings.TrimSpace(string(msg))}
+	}
+	return fmt.Errorf("push failed with status %s", resp.Status)
+}
+
+// handleBufferRequest drains the lines sampled from the poll file
+// (GET /api/buffer). JSON by default, InfluxDB line protocol with
+// ?format=influx for Telegraf's http input
+func handleBufferRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if servicePollFile == nil {
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"error": "No poll file loaded. Start the service with --poll-file <file>",
+		})
+		return
+	}
+
+	lines, dropped := servicePollFile.buffer.drain()
+	servicePollFile.latency.observe(lines)
+	if dropped > 0 {
+		log.Printf("[%s] Buffer: dropped %d lines since the last drain", connectionName, dropped)
+	}
+	if r.URL.Query().Get("format") == "influx" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Dropped-Lines", fmt.Sprintf("%d", dropped))
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+		return
+	}
+	if lines == nil {
+		lines = []string{}
+	}
+	sendJSONResponseGeneric(w, map[string]interface{}{
+		"lines":   lines,
+		"dropped": dropped,
+	})
+}
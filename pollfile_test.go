@@ -0,0 +1,205 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePollFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "polls.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+// TestLoadPollFile tests defaults and validation of poll files
+func TestLoadPollFile(t *testing.T) {
+	pf, err := loadPollFile(writePollFile(t, `
+sinks:
+  - url: http://localhost:8086/write
+polls:
+  - node: ns=3,s=Temperature
+    interval: 5s
+  - node: ns=5;s=Alarms
+    interval: 1s
+    measurement: alarms
+    bits: {0: estop, 7: drive_fault}
+`))
+	require.NoError(t, err)
+	assert.Equal(t, defaultPollBufferSize, pf.Buffer)
+	assert.Equal(t, "10s", pf.Sinks[0].Interval)
+	assert.Equal(t, "ns=3;s=Temperature", pf.Polls[0].Node)
+	assert.Equal(t, "opcua_node", pf.Polls[0].Measurement)
+
+	for _, bad := range []string{
+		"polls: []\n",
+		"polls:\n  - interval: 1s\n",
+		"polls:\n  - {node: ns=3;s=A, interval: 10ms}\n",
+		"polls:\n  - {node: ns=3;s=A, interval: 1s, bits: {32: x}}\n",
+		"sinks:\n  - {interval: 1s}\npolls:\n  - {node: ns=3;s=A, interval: 1s}\n",
+		"sinks:\n  - {url: http://sink, rotate: {every: 1h}}\npolls:\n  - {node: ns=3;s=A, interval: 1s}\n",
+		"sinks:\n  - {dir: /tmp/usb, bandwidth: 2KB}\npolls:\n  - {node: ns=3;s=A, interval: 1s}\n",
+		"polls:\n  - {node: ns=3;s=A, interval: 1s, priority: urgent}\n",
+		"sinks:\n  - {webhook: ftp://cloud/ingest}\npolls:\n  - {node: ns=3;s=A, interval: 1s}\n",
+		"sinks:\n  - {url: http://sink, secret: s3cret}\npolls:\n  - {node: ns=3;s=A, interval: 1s}\n",
+		"polls:\n  - {node: ns=3;s=A, interval: 1s, transform: value *}\n",
+		"polls:\n  - {node: ns=3;s=A, interval: 1s, transform: value / 10, bits: {0: x}}\n",
+	} {
+		_, err := loadPollFile(writePollFile(t, bad))
+		assert.Error(t, err, bad)
+	}
+}
+
+// TestLineBuffer tests dropping the oldest lines
+func TestLineBuffer(t *testing.T) {
+	b := &lineBuffer{max: 3}
+	b.add("a", "b")
+	b.add("c", "d")
+	lines, dropped := b.drain()
+	assert.Equal(t, []string{"b", "c", "d"}, lines)
+	assert.Equal(t, int64(1), dropped)
+}
+
+// TestPollSchedulerSample tests that samples become InfluxDB lines with the
+// entry's measurement and named bits, in the API buffer and each sink buffer
+func TestPollSchedulerSample(t *testing.T) {
+	pf := &pollFile{Buffer: 100, Sinks: []*pollSink{{URL: "http://sink"}}, Polls: []*pollFileEntry{
+		{Node: "ns=3;s=Temperature", Interval: "1s", Measurement: "boiler"},
+		{Node: "ns=5;s=Alarms", Interval: "1s", Measurement: "alarms", Bits: map[int]string{7: "drive_fault"}},
+		{Node: "ns=5;s=Broken", Interval: "1s", Measurement: "x"},
+		{Node: "ns=3;s=Level", Interval: "1s", Measurement: "tank", transform: mustParseTransform(t, "value * 100 / 4000")},
+	}}
+	s := newPollScheduler(pf, func(ctx context.Context, nodeIDs []string, synchronized bool) []NodeResponse {
+		return []NodeResponse{
+			{NodeID: nodeIDs[0], Value: 72.5},
+			{NodeID: nodeIDs[1], Value: uint32(0x80)},
+			{NodeID: nodeIDs[2], Error: "BadNodeIdUnknown"},
+			{NodeID: nodeIDs[3], Value: uint16(3000)},
+		}
+	})
+	s.endpoint = "opc.tcp://plc:4840"
+	s.sample(context.Background(), pf.Polls)
+
+	lines, _ := s.buffer.drain()
+	require.Len(t, lines, 3)
+	assert.True(t, strings.HasPrefix(lines[0], `boiler,node_id=ns\=3;s\=Temperature,endpoint=opc.tcp://plc:4840 value=72.5 `), lines[0])
+	assert.Contains(t, lines[1], "alarms,")
+	assert.Contains(t, lines[1], ",bit=7,bit_name=drive_fault value=1 ")
+	assert.Contains(t, lines[2], "tank,")
+	assert.Contains(t, lines[2], " value=75 ", "transformed")
+
+	sinkLines, _ := s.sinks[0].drain()
+	assert.Equal(t, lines, sinkLines[priorityProcess])
+}
+
+// TestPollSinkSend tests pushing lines with the configured headers, plain
+// and gzipped
+func TestPollSinkSend(t *testing.T) {
+	var body, auth string
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reader io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			require.NoError(t, err)
+			reader = gz
+		}
+		data, _ := io.ReadAll(reader)
+		body = string(data)
+		auth = r.Header.Get("Authorization")
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	sink := &pollSink{URL: server.URL, Headers: map[string]string{"Authorization": "Token abc"}}
+	client := &http.Client{Timeout: time.Second}
+	require.NoError(t, sink.send(context.Background(), client, []string{"a value=1 1", "b value=2 2"}))
+	assert.Equal(t, "a value=1 1\nb value=2 2\n", body)
+	assert.Equal(t, "Token abc", auth)
+
+	body = ""
+	sink.Gzip = true
+	require.NoError(t, sink.send(context.Background(), client, []string{"a value=1 1"}))
+	assert.Equal(t, "a value=1 1\n", body)
+
+	status = http.StatusInternalServerError
+	assert.Error(t, sink.send(context.Background(), client, []string{"a value=1 1"}))
+}
+
+// TestHandleBufferRequest tests draining the buffer as JSON and line protocol
+func TestHandleBufferRequest(t *testing.T) {
+	defer func(s *pollScheduler) { servicePollFile = s }(servicePollFile)
+	servicePollFile = nil
+
+	w := httptest.NewRecorder()
+	handleBufferRequest(w, httptest.NewRequest(http.MethodGet, "/api/buffer", nil))
+	assert.Contains(t, w.Body.String(), "--poll-file")
+
+	servicePollFile = newPollScheduler(&pollFile{Buffer: 10}, nil)
+	servicePollFile.buffer.add("a value=1 1", "b value=2 2")
+	w = httptest.NewRecorder()
+	handleBufferRequest(w, httptest.NewRequest(http.MethodGet, "/api/buffer?format=influx", nil))
+	assert.Equal(t, "a value=1 1\nb value=2 2\n", w.Body.String())
+
+	w = httptest.NewRecorder()
+	handleBufferRequest(w, httptest.NewRequest(http.MethodGet, "/api/buffer", nil))
+	assert.JSONEq(t, `{"lines":[],"dropped":0}`, w.Body.String())
+}
+
+// TestInfluxSink tests the write URLs of InfluxDB v1 and v2
+func TestInfluxSink(t *testing.T) {
+	sink, err := influxSink("http://influxdb:8086/", "7d3f", "plant", "plc")
+	require.NoError(t, err)
+	assert.Equal(t, "http://influxdb:8086/api/v2/write?bucket=plc&org=plant&precision=ns", sink.URL)
+	assert.Equal(t, "Token 7d3f", sink.Headers["Authorization"])
+
+	sink, err = influxSink("http://influxdb:8086", "", "", "plc")
+	require.NoError(t, err)
+	assert.Equal(t, "http://influxdb:8086/write?db=plc&precision=ns", sink.URL)
+	assert.Empty(t, sink.Headers)
+
+	_, err = influxSink("influxdb:8086", "", "", "plc")
+	assert.Error(t, err)
+	_, err = influxSink("http://influxdb:8086", "", "plant", "")
+	assert.Error(t, err)
+}
+
+// TestPollSinkFlush tests batching, keeping lines of failed pushes and
+// dropping lines the sink rejects
+func TestPollSinkFlush(t *testing.T) {
+	var requests []string
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		requests = append(requests, string(data))
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	sink := &pollSink{URL: server.URL, Batch: 2}
+	buffer := newPriorityBuffer(10)
+	client := &http.Client{Timeout: time.Second}
+
+	sink.flush(context.Background(), client, buffer, prioritized{priorityProcess: {"a", "b", "c"}}, time.Second)
+	assert.Equal(t, []string{"a\nb\n", "c\n"}, requests)
+
+	status = http.StatusServiceUnavailable
+	sink.flush(context.Background(), client, buffer, prioritized{priorityAlarm: {"d"}, priorityProcess: {"e", "f"}}, time.Second)
+	lines, _ := buffer.drain()
+	assert.Equal(t, prioritized{priorityAlarm: {"d"}, priorityProcess: {"e", "f"}}, lines, "back in their classes")
+
+	status = http.StatusBadRequest
+	sink.flush(context.Background(), client, buffer, prioritized{priorityProcess: {"g"}}, time.Second)
+	lines, _ = buffer.drain()
+	assert.Zero(t, lines.len())
+}
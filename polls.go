@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Shortest poll interval, protects the PLC from tight polling loops
+const minPollInterval = 100 * time.Millisecond
+
+// PollInfo is the API representation of a poll group with its latest values
+type PollInfo struct {
+	PollConfig
+	Sampled *time.Time     `json:"sampled,omitempty"`
+	Results []NodeResponse `json:"results,omitempty"`
+}
+
+// pollManager runs the poll groups created through the API
+type pollManager struct {
+	mu        sync.Mutex
+	groups    map[string]*pollGroup
+	order     []string
+	nextID    int
+	stateFile string // Persisted groups, "" to keep them in memory only
+	read      sampleReader
+}
+
+// sampleReader reads one sample of nodes, synchronized in a single read
+// request if asked to. Read errors are reported per node
+type sampleReader func(ctx context.Context, nodeIDs []string, synchronized bool) []NodeResponse
+
+type pollGroup struct {
+	config   PollConfig
+	interval time.Duration
+	cancel   context.CancelFunc
+	sampled  time.Time
+	results  []NodeResponse
+}
+
+// Global poll manager for service mode
+var servicePolls = newPollManager(readPollSample)
+
+func newPollManager(read sampleReader) *pollManager {
+	return &pollManager{
+		groups: make(map[string]*pollGroup),
+		read:   read,
+	}
+}
+
+// validatePollConfig checks the node IDs and interval of a poll group and
+// returns the parsed interval
+func validatePollConfig(config *PollConfig) (time.Duration, error) {
+	if len(config.NodeIDs) == 0 {
+		return 0, fmt.Errorf("poll group needs nodeIds")
+	}
+	for i, nodeID := range config.NodeIDs {
+		config.NodeIDs[i] = strings.Replace(nodeID, ",", ";", 1)
+		if err := checkNodeID(config.NodeIDs[i]); err != nil {
+			return 0, fmt.Errorf("invalid node ID %s: %v", nodeID, err)
+		}
+	}
+	return parsePollInterval(config.Interval)
+}
+
+// parsePollInterval parses the sampling interval of a poll group or poll
+// file entry
+func parsePollInterval(s string) (time.Duration, error) {
+	interval, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid interval %q: %v", s, err)
+	}
+	if interval < minPollInterval {
+		return 0, fmt.Errorf("interval %v is shorter than %v", interval, minPollInterval)
+	}
+	return interval, nil
+}
+
+// add starts sampling a new poll group. An empty ID is assigned automatically
+func (m *pollManager) add(config PollConfig) (PollConfig, error) {
+	interval, err := validatePollConfig(&config)
+	if err != nil {
+		return config, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if config.ID == "" {
+		for config.ID == "" || m.groups[config.ID] != nil {
+			m.nextID++
+			config.ID = fmt.Sprintf("p-%d", m.nextID)
+		}
+	} else if m.groups[config.ID] != nil {
+		return config, fmt.Errorf("poll group %s already exists", config.ID)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	g := &pollGroup{config: config, interval: interval, cancel: cancel}
+	m.groups[config.ID] = g
+	m.order = append(m.order, config.ID)
+	go m.run(ctx, g)
+
+	if config.Persist {
+		if err := m.save(); err != nil {
+			log.Printf("[%s] Failed to save poll groups: %v", connectionName, err)
+		}
+	}
+	return config, nil
+}
+
+// remove stops a poll group
+func (m *pollManager) remove(pollID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g, ok := m.groups[pollID]
+	if !ok {
+		return fmt.Errorf("unknown poll group %s", pollID)
+	}
+	g.cancel()
+	delete(m.groups, pollID)
+	for i, id := range m.order {
+		if id == pollID {
+			m.order = append(m.order[:i], m.order[i+1:]...)
+			break
+		}
+	}
+
+	if g.config.Persist {
+		if err := m.save(); err != nil {
+			log.Printf("[%s] Failed to save poll groups: %v", connectionName, err)
+		}
+	}
+	return nil
+}
+
+// run samples a poll group until it is removed
+func (m *pollManager) run(ctx context.Context, g *pollGroup) {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+
+	for {
+		results := m.read(ctx, g.config.NodeIDs, g.config.Synchronized)
+		if ctx.Err() != nil {
+			return
+		}
+		sampled := time.Now()
+		m.mu.Lock()
+		g.sampled = sampled
+		g.results = results
+		m.mu.Unlock()
+		serviceRecent.record(results, sampled)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// get returns a poll group with its latest values
+func (m *pollManager) get(pollID string) (PollInfo, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g, ok := m.groups[pollID]
+	if !ok {
+		return PollInfo{}, false
+	}
+	return g.info(), true
+}
+
+// snapshot lists all poll groups in creation order
+func (m *pollManager) snapshot() []PollInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := make([]PollInfo, 0, len(m.order))
+	for _, pollID := range m.order {
+		result = append(result, m.groups[pollID].info())
+	}
+	return result
+}
+
+// info returns the API representation of a poll group. Callers must hold the manager's mutex
+func (g *pollGroup) info() PollInfo {
+	info := PollInfo{PollConfig: g.config, Results: g.results}
+	if !g.sampled.IsZero() {
+		sampled := g.sampled
+		info.Sampled = &sampled
+	}
+	return info
+}
+
+// save writes the persisted poll groups to the state file. Callers must hold m.mu
+func (m *pollManager) save() error {
+	if m.stateFile == "" {
+		return nil
+	}
+	configs := []PollConfig{}
+	for _, pollID := range m.order {
+		if g := m.groups[pollID]; g.config.Persist {
+			configs = append(configs, g.config)
+		}
+	}
+	data, err := json.MarshalIndent(configs, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode poll groups: %v", err)
+	}
+	if err := os.WriteFile(m.stateFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write poll groups %s: %v", m.stateFile, err)
+	}
+	return nil
+}
+
+// restore starts the poll groups saved in the state file and saves later
+// changes to it. A missing file restores nothing
+func (m *pollManager) restore(stateFile string) error {
+	data, err := os.ReadFile(stateFile)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read poll groups %s: %v", stateFile, err)
+	}
+	var configs []PollConfig
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &configs); err != nil {
+			return fmt.Errorf("failed to parse poll groups %s: %v", stateFile, err)
+		}
+	}
+	for _, config := range configs {
+		if _, err := m.add(config); err != nil {
+			log.Printf("[%s] Skipping saved poll group %s: %v", connectionName, config.ID, err)
+		}
+	}
+
+	m.mu.Lock()
+	m.stateFile = stateFile
+	m.mu.Unlock()
+	return nil
+}
+
+// restoreServicePolls restores the persisted poll groups of this connection
+func restoreServicePolls() {
+	dir, err := serviceConfigDir("polls")
+	if err != nil {
+		log.Printf("[%s] Poll groups are not persisted: %v", connectionName, err)
+		return
+	}
+	if err := servicePolls.restore(filepath.Join(dir, "polls.json")); err != nil {
+		log.Printf("[%s] Failed to restore poll groups: %v", connectionName, err)
+		return
+	}
+	if groups := servicePolls.snapshot(); len(groups) > 0 {
+		log.Printf("[%s] Restored %d poll groups", connectionName, len(groups))
+	}
+}
+
+// readPollSample reads the values of a poll group with the current
+// connection, synchronized in a single read request with one timestamp if
+// asked to
+func readPollSample(ctx context.Context, nodeIDs []string, synchronized bool) []NodeResponse {
+	clientMutex.Lock()
+	client := opcuaClient
+	clientMutex.Unlock()
+
+	fail := func(msg string) []NodeResponse {
+		results := make([]NodeResponse, len(nodeIDs))
+		for i, nodeID := range nodeIDs {
+			results[i] = NodeResponse{NodeID: nodeID, RequestedNodeID: nodeID, Error: msg}
+		}
+		return results
+	}
+	if client == nil {
+		return fail("OPCUA client not connected")
+	}
+
+	nodes := make([]NodeInfo, len(nodeIDs))
+	for i, nodeID := range nodeIDs {
+		id, err := resolveNodeID(nodeID)
+		if err != nil {
+			return fail(fmt.Sprintf("Invalid node ID: %v", err))
+		}
+		nodes[i] = NodeInfo{NodeID: id}
+	}
+
+	readCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	read := readNodeInfos
+	if synchronized {
+		read = readSynchronizedNodeInfos
+	}
+	results, err := read(readCtx, client, nodes)
+	if err != nil {
+		return fail(fmt.Sprintf("Failed to read nodes: %v", err))
+	}
+	for i := range results {
+		results[i].RequestedNodeID = nodeIDs[i]
+	}
+	return results
+}
+
+// handlePollsRequest creates poll groups (POST /api/polls), lists them
+// (GET /api/polls), returns one with its latest values (GET /api/polls/<id>)
+// and removes one (DELETE /api/polls/<id>). With tenants, each tenant only
+// sees its own poll groups
+func handlePollsRequest(w http.ResponseWriter, r *http.Request) {
+	pollID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/polls"), "/")
+	tenant := tenantName(r)
+
+	switch {
+	case pollID == "" && r.Method == http.MethodPost:
+		var config PollConfig
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": fmt.Sprintf("Failed to parse request: %v", err),
+			})
+			return
+		}
+		config.Tenant = tenant
+		config, err := servicePolls.add(config)
+		if err != nil {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": err.Error(),
+			})
+			return
+		}
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"poll": config,
+		})
+
+	case pollID == "" && r.Method == http.MethodGet:
+		polls := []PollInfo{}
+		for _, info := range servicePolls.snapshot() {
+			if tenant == "" || info.Tenant == tenant {
+				polls = append(polls, info)
+			}
+		}
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"polls": polls,
+		})
+
+	case pollID != "" && r.Method == http.MethodGet:
+		info, ok := servicePolls.get(pollID)
+		if !ok || (tenant != "" && info.Tenant != tenant) {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": fmt.Sprintf("unknown poll group %s", pollID),
+			})
+			return
+		}
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"poll": info,
+		})
+
+	case pollID != "" && r.Method == http.MethodDelete:
+		if info, ok := servicePolls.get(pollID); ok && tenant != "" && info.Tenant != tenant {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": fmt.Sprintf("unknown poll group %s", pollID),
+			})
+			return
+		}
+		if err := servicePolls.remove(pollID); err != nil {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": err.Error(),
+			})
+			return
+		}
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"removed": pollID,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
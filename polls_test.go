@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fakePollRead(ctx context.Context, nodeIDs []string, synchronized bool) []NodeResponse {
+	results := make([]NodeResponse, len(nodeIDs))
+	for i, nodeID := range nodeIDs {
+		results[i] = NodeResponse{NodeID: nodeID, Value: 1.0}
+	}
+	return results
+}
+
+// TestPollManager tests sampling, listing and removing poll groups
+func TestPollManager(t *testing.T) {
+	m := newPollManager(fakePollRead)
+
+	config, err := m.add(PollConfig{NodeIDs: []string{"ns=3,s=Temp"}, Interval: "1s"})
+	require.NoError(t, err)
+	assert.Equal(t, "p-1", config.ID)
+	assert.Equal(t, []string{"ns=3;s=Temp"}, config.NodeIDs)
+
+	require.Eventually(t, func() bool {
+		info, _ := m.get("p-1")
+		return len(info.Results) == 1
+	}, time.Second, time.Millisecond)
+	info, ok := m.get("p-1")
+	require.True(t, ok)
+	assert.NotNil(t, info.Sampled)
+	assert.Equal(t, 1.0, info.Results[0].Value)
+
+	_, err = m.add(PollConfig{ID: "p-1", NodeIDs: []string{"i=2258"}, Interval: "1s"})
+	assert.Error(t, err)
+	_, err = m.add(PollConfig{NodeIDs: []string{"i=2258"}, Interval: "10ms"})
+	assert.Error(t, err)
+	_, err = m.add(PollConfig{Interval: "1s"})
+	assert.Error(t, err)
+
+	require.NoError(t, m.remove("p-1"))
+	assert.Empty(t, m.snapshot())
+	assert.Error(t, m.remove("p-1"))
+}
+
+// TestPollManagerPersistence tests that only persisted groups are restored
+func TestPollManagerPersistence(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "polls.json")
+
+	m := newPollManager(fakePollRead)
+	require.NoError(t, m.restore(stateFile))
+	_, err := m.add(PollConfig{ID: "energy", NodeIDs: []string{"ns=3;s=Power"}, Interval: "5s", Persist: true})
+	require.NoError(t, err)
+	_, err = m.add(PollConfig{NodeIDs: []string{"ns=3;s=Debug"}, Interval: "5s"})
+	require.NoError(t, err)
+	_, err = m.add(PollConfig{ID: "gone", NodeIDs: []string{"ns=3;s=Old"}, Interval: "5s", Persist: true})
+	require.NoError(t, err)
+	require.NoError(t, m.remove("gone"))
+
+	restored := newPollManager(fakePollRead)
+	require.NoError(t, restored.restore(stateFile))
+	polls := restored.snapshot()
+	require.Len(t, polls, 1)
+	assert.Equal(t, "energy", polls[0].ID)
+	assert.Equal(t, "5s", polls[0].Interval)
+
+	// New groups get IDs that do not collide with restored ones
+	config, err := restored.add(PollConfig{NodeIDs: []string{"i=2258"}, Interval: "1s"})
+	require.NoError(t, err)
+	assert.Equal(t, "p-1", config.ID)
+
+	for _, info := range append(m.snapshot(), restored.snapshot()...) {
+		m.remove(info.ID)
+		restored.remove(info.ID)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// connectionPorts pins the API ports of named connections, instead of the
+// ports hashed from their names, e.g. to ports a site firewall lets through.
+// Services and clients read the same file, so both sides agree. Connections
+// listed with hash keep their hashed port and are checked for collisions:
+//
+//	ports:
+//	  line1: 18001
+//	  line2: 18002
+//	  line3: hash
+type connectionPorts map[string]int // 0 for hash
+
+// Ports of --ports-file, nil when every named connection hashes its port
+var pinnedPorts connectionPorts
+
+// portsFilePath returns the ports file to read: --ports-file, else
+// ~/.config/plccli/ports.yaml when it exists, else none
+func portsFilePath(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	path := filepath.Join(home, ".config", "plccli", "ports.yaml")
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// loadConnectionPorts reads a ports file. Two of its connections on the
+// same port, pinned or hashed, are an error
+func loadConnectionPorts(path string) (connectionPorts, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ports file %s: %v", path, err)
+	}
+	var file struct {
+		Ports map[string]string `yaml:"ports"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid ports file %s: %v", path, err)
+	}
+
+	ports := make(connectionPorts, len(file.Ports))
+	for name, value := range file.Ports {
+		if name == "default" {
+			return nil, fmt.Errorf("invalid ports file %s: the default connection uses --port", path)
+		}
+		if value == "hash" {
+			ports[name] = 0
+			continue
+		}
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid ports file %s: port %q of %s is not hash or between 1 and 65535", path, value, name)
+		}
+		ports[name] = port
+	}
+
+	byPort := make(map[int]string)
+	for _, name := range ports.names() {
+		port := ports.port(name)
+		if other, taken := byPort[port]; taken {
+			return nil, fmt.Errorf("invalid ports file %s: %s and %s both get port %d, pin one of them to another port", path, other, name, port)
+		}
+		byPort[port] = name
+	}
+	return ports, nil
+}
+
+// port returns the port of a named connection: pinned, or else hashed
+func (p connectionPorts) port(name string) int {
+	if port := p[name]; port != 0 {
+		return port
+	}
+	return hashedPort(name)
+}
+
+// names returns the connections of the ports file, sorted
+func (p connectionPorts) names() []string {
+	names := make([]string, 0, len(p))
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// hashedPort derives a port in the range 10000-65000 from a connection name
+func hashedPort(name string) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return 10000 + int(h.Sum32()%55000)
+}
+
+// portCollisions returns the connections of the ports file and the default
+// connection on basePort that get the same port as connection, checked when
+// its service starts
+func portCollisions(connection string, basePort int) []string {
+	port := getPortForConnection(connection, basePort)
+	var collisions []string
+	for _, name := range append([]string{"default"}, pinnedPorts.names()...) {
+		if name != connection && getPortForConnection(name, basePort) == port {
+			collisions = append(collisions, name)
+		}
+	}
+	return collisions
+}
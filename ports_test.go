@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// collidingNames returns two connection names whose hashed ports collide
+func collidingNames(t *testing.T) (string, string) {
+	byPort := make(map[int]string)
+	for i := 0; i < 100000; i++ {
+		name := fmt.Sprintf("line%d", i)
+		if other, ok := byPort[hashedPort(name)]; ok {
+			return other, name
+		}
+		byPort[hashedPort(name)] = name
+	}
+	t.Fatal("no colliding names")
+	return "", ""
+}
+
+// TestLoadConnectionPorts tests reading a ports file
+func TestLoadConnectionPorts(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "ports.yaml")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+		return path
+	}
+
+	ports, err := loadConnectionPorts(write("ports:\n  line1: 18001\n  line2: hash\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 18001, ports.port("line1"))
+	assert.Equal(t, hashedPort("line2"), ports.port("line2"))
+	assert.Equal(t, hashedPort("line9"), ports.port("line9"), "connections not listed are hashed")
+	assert.Equal(t, []string{"line1", "line2"}, ports.names())
+
+	a, b := collidingNames(t)
+	for content, want := range map[string]string{
+		"ports:\n  line1: 18001\n  line2: 18001\n":                               "line1 and line2 both get port 18001",
+		fmt.Sprintf("ports:\n  %s: hash\n  %s: hash\n", a, b):                    "both get port",
+		fmt.Sprintf("ports:\n  line1: %d\n  line2: hash\n", hashedPort("line2")): "line1 and line2 both get port",
+		"ports:\n  line1: 70000\n":                                               `port "70000" of line1 is not hash or between 1 and 65535`,
+		"ports:\n  line1: auto\n":                                                `port "auto" of line1`,
+		"ports:\n  default: 9000\n":                                              "the default connection uses --port",
+		"ports: [line1]\n":                                                       "invalid ports file",
+	} {
+		_, err := loadConnectionPorts(write(content))
+		assert.ErrorContains(t, err, want, content)
+	}
+	ports, err = loadConnectionPorts(write(fmt.Sprintf("ports:\n  %s: hash\n  %s: 18002\n", a, b)))
+	require.NoError(t, err, "pinning one of two colliding names")
+	assert.NotEqual(t, ports.port(a), ports.port(b))
+
+	_, err = loadConnectionPorts(filepath.Join(dir, "missing.yaml"))
+	assert.ErrorContains(t, err, "failed to read ports file")
+	assert.Equal(t, "explicit.yaml", portsFilePath("explicit.yaml"))
+}
+
+// TestPortCollisions tests the check of a service's port against the
+// connections of the ports file and the default connection
+func TestPortCollisions(t *testing.T) {
+	t.Cleanup(func() { pinnedPorts = nil })
+	a, b := collidingNames(t)
+
+	pinnedPorts = connectionPorts{"line1": 18001, a: 0}
+	assert.Equal(t, 18001, getPortForConnection("line1", 8765))
+	assert.Equal(t, 8765, getPortForConnection("default", 8765))
+	assert.Empty(t, portCollisions("line1", 8765))
+	assert.Equal(t, []string{a}, portCollisions(b, 8765), "a hashed name colliding with a listed one")
+	assert.Empty(t, portCollisions(a, 8765))
+
+	pinnedPorts = connectionPorts{"line1": 8765}
+	assert.Equal(t, []string{"line1"}, portCollisions("default", 8765))
+	assert.Equal(t, []string{"default"}, portCollisions("line1", 8765))
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Priority classes of poll file entries, most important first. Sinks send
+// the lines of a class before those of the next one, so alarms get through
+// first after an outage of the uplink and within a bandwidth budget
+const (
+	priorityAlarm = iota
+	priorityProcess
+	priorityDiagnostic
+	numPriorities
+)
+
+// Names of the priority classes in poll files
+var priorityNames = [numPriorities]string{"alarm", "process", "diagnostic"}
+
+// parsePriority returns the class of a poll file entry's priority, process
+// without one. high and low, of poll files before the classes, are process
+// and diagnostic
+func parsePriority(name string) (int, error) {
+	switch name {
+	case "", "high":
+		return priorityProcess, nil
+	case "low":
+		return priorityDiagnostic, nil
+	}
+	for class, className := range priorityNames {
+		if name == className {
+			return class, nil
+		}
+	}
+	return 0, fmt.Errorf("priority must be alarm, process or diagnostic, got %q", name)
+}
+
+// prioritized are lines by priority class
+type prioritized [numPriorities][]string
+
+// flatten returns the lines of all classes, most important first
+func (p prioritized) flatten() []string {
+	var lines []string
+	for _, class := range p {
+		lines = append(lines, class...)
+	}
+	return lines
+}
+
+// len returns the number of lines of all classes
+func (p prioritized) len() int {
+	n := 0
+	for _, class := range p {
+		n += len(class)
+	}
+	return n
+}
+
+// after returns the lines after the first n of flatten, by class
+func (p prioritized) after(n int) prioritized {
+	var rest prioritized
+	for class, lines := range p {
+		skip := min(n, len(lines))
+		rest[class] = lines[skip:]
+		n -= skip
+	}
+	return rest
+}
+
+// priorityBuffer keeps the lines of a sink by priority class until the sink
+// takes them. When full, the oldest lines of the least important class are
+// dropped first, so a long outage does not cost the alarms
+type priorityBuffer struct {
+	mu      sync.Mutex
+	lines   prioritized
+	max     int
+	dropped int64                // Since the last drain
+	evicted [numPriorities]int64 // Since the service started
+}
+
+func newPriorityBuffer(max int) *priorityBuffer {
+	return &priorityBuffer{max: max}
+}
+
+// add appends lines of a class, dropping lines beyond the buffer size
+func (b *priorityBuffer) add(class int, lines ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lines[class] = append(b.lines[class], lines...)
+	b.evict()
+}
+
+// evict drops the lines beyond the buffer size, the oldest of the least
+// important class first. Callers must hold b.mu
+func (b *priorityBuffer) evict() {
+	over := b.lines.len() - b.max
+	for class := numPriorities - 1; class >= 0 && over > 0; class-- {
+		n := min(over, len(b.lines[class]))
+		if n == 0 {
+			continue
+		}
+		b.lines[class] = append([]string(nil), b.lines[class][n:]...)
+		b.dropped += int64(n)
+		b.evicted[class] += int64(n)
+		over -= n
+	}
+}
+
+// drain returns and removes all buffered lines and the number of lines
+// dropped since the last drain
+func (b *priorityBuffer) drain() (prioritized, int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	lines, dropped := b.lines, b.dropped
+	b.lines, b.dropped = prioritized{}, 0
+	return lines, dropped
+}
+
+// requeue puts lines a sink failed to take back in front of the newer lines
+// of their class
+func (b *priorityBuffer) requeue(lines prioritized) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for class := range b.lines {
+		b.lines[class] = append(append([]string(nil), lines[class]...), b.lines[class]...)
+	}
+	b.evict()
+}
+
+// oldest returns the timestamp of the oldest buffered line, false when the
+// buffer is empty. Lines of a class are in the order they were sampled, so
+// only the first of each class is looked at
+func (b *priorityBuffer) oldest() (time.Time, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var oldest time.Time
+	found := false
+	for _, lines := range b.lines {
+		if len(lines) == 0 {
+			continue
+		}
+		l, err := parseInfluxLine(lines[0])
+		if err != nil {
+			continue
+		}
+		if !found || l.time.Before(oldest) {
+			oldest, found = l.time, true
+		}
+	}
+	return oldest, found
+}
+
+// stats returns the lines buffered and dropped since the service started,
+// with the drops of each class
+func (b *priorityBuffer) stats() map[string]int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stats := map[string]int64{"lines": int64(b.lines.len())}
+	for class, name := range priorityNames {
+		stats["evicted"] += b.evicted[class]
+		if b.evicted[class] > 0 {
+			stats["evicted"+strings.ToUpper(name[:1])+name[1:]] = b.evicted[class]
+		}
+	}
+	return stats
+}
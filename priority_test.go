@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPriorityBuffer tests that alarms drain first and that a full buffer
+// drops diagnostic lines before process values and alarms
+func TestPriorityBuffer(t *testing.T) {
+	b := newPriorityBuffer(4)
+	b.add(priorityDiagnostic, "d1", "d2")
+	b.add(priorityProcess, "p1", "p2")
+	b.add(priorityAlarm, "a1")
+	b.add(priorityProcess, "p3")
+
+	lines, dropped := b.drain()
+	assert.Equal(t, []string{"a1", "p1", "p2", "p3"}, lines.flatten())
+	assert.Equal(t, int64(2), dropped)
+
+	// A failed push goes back in front of the newer lines of its class
+	b.add(priorityAlarm, "a2")
+	b.add(priorityProcess, "p4")
+	b.requeue(lines.after(1))
+	lines, dropped = b.drain()
+	assert.Equal(t, prioritized{priorityAlarm: {"a2"}, priorityProcess: {"p2", "p3", "p4"}}, lines)
+	assert.Equal(t, int64(1), dropped, "the oldest process value")
+
+	assert.Equal(t, map[string]int64{"lines": 0, "evicted": 3, "evictedProcess": 1, "evictedDiagnostic": 2}, b.stats())
+
+	for name, want := range map[string]int{"": priorityProcess, "alarm": priorityAlarm, "high": priorityProcess, "low": priorityDiagnostic, "diagnostic": priorityDiagnostic} {
+		class, err := parsePriority(name)
+		require.NoError(t, err, name)
+		assert.Equal(t, want, class, name)
+	}
+	_, err := parsePriority("urgent")
+	assert.Error(t, err)
+}
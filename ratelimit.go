@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Per-client state unused this long is forgotten
+const rateLimitIdle = 5 * time.Minute
+
+// rateLimits are the limits of the service API, 0 for no limit
+type rateLimits struct {
+	clientRate float64 // Requests per second of each client
+	globalRate float64 // Requests per second of all clients
+	clientOps  int     // Concurrent requests of each client
+	globalOps  int     // Concurrent requests of all clients
+}
+
+// rateLimiter protects the PLC session from clients sending too many
+// requests, e.g. a script reading in a tight loop. Clients are tenants, or
+// remote hosts without tenants. Requests over a limit get 429 Too Many
+// Requests. Event streams (streamPaths) only count against the request
+// rates, they hold no OPC UA operation while open
+type rateLimiter struct {
+	mu        sync.Mutex
+	limits    rateLimits
+	global    tokenBucket
+	globalOps int
+	clients   map[string]*clientLimits
+	swept     time.Time
+	now       func() time.Time
+}
+
+// clientLimits is the state of one client
+type clientLimits struct {
+	bucket  tokenBucket
+	ops     int
+	used    time.Time
+	limited bool // Over a limit, logged once until it is not anymore
+}
+
+// tokenBucket allows rate requests per second with bursts of up to a second
+// of requests
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Rate limiter of this service, nil without limits
+var serviceRateLimiter *rateLimiter
+
+// newRateLimiter returns a limiter, nil if there are no limits
+func newRateLimiter(limits rateLimits) *rateLimiter {
+	if limits == (rateLimits{}) {
+		return nil
+	}
+	return &rateLimiter{limits: limits, clients: make(map[string]*clientLimits), now: time.Now}
+}
+
+// refill adds the tokens since the last refill and returns whether one is
+// left, and otherwise how long until the next one. It takes none, see take
+func (b *tokenBucket) refill(rate float64, now time.Time) (bool, time.Duration) {
+	burst := math.Max(rate, 1)
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// take takes the token refill found left
+func (b *tokenBucket) take() {
+	b.tokens--
+}
+
+// acquire admits a request of a client. It returns a release function for
+// admitted requests, otherwise why the request was refused and when to retry
+func (rl *rateLimiter) acquire(client string, stream bool) (func(), string, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := rl.now()
+	rl.sweep(now)
+
+	c := rl.clients[client]
+	if c == nil {
+		c = &clientLimits{}
+		rl.clients[client] = c
+	}
+	c.used = now
+
+	reason, retry := rl.check(c, stream, now)
+	if reason != "" {
+		if !c.limited {
+			log.Printf("[%s] Rate limiting %s: %s", connectionName, client, reason)
+		}
+		c.limited = true
+		return nil, reason, retry
+	}
+	if c.limited {
+		log.Printf("[%s] %s is within the rate limits again", connectionName, client)
+	}
+	c.limited = false
+	if stream {
+		return func() {}, "", 0
+	}
+
+	c.ops++
+	rl.globalOps++
+	return func() {
+		rl.mu.Lock()
+		defer rl.mu.Unlock()
+		c.ops--
+		rl.globalOps--
+	}, "", 0
+}
+
+// check returns why a request is over a limit, "" if it is not. Tokens are
+// only taken from the buckets when the request is within all limits, so a
+// request the service refuses does not use up its client's rate
+func (rl *rateLimiter) check(c *clientLimits, stream bool, now time.Time) (string, time.Duration) {
+	if !stream {
+		if rl.limits.clientOps > 0 && c.ops >= rl.limits.clientOps {
+			return fmt.Sprintf("%d concurrent requests per client", rl.limits.clientOps), time.Second
+		}
+		if rl.limits.globalOps > 0 && rl.globalOps >= rl.limits.globalOps {
+			return fmt.Sprintf("%d concurrent requests of all clients", rl.limits.globalOps), time.Second
+		}
+	}
+	if rl.limits.clientRate > 0 {
+		if ok, retry := c.bucket.refill(rl.limits.clientRate, now); !ok {
+			return fmt.Sprintf("%g requests/s per client", rl.limits.clientRate), retry
+		}
+	}
+	if rl.limits.globalRate > 0 {
+		if ok, retry := rl.global.refill(rl.limits.globalRate, now); !ok {
+			return fmt.Sprintf("%g requests/s of all clients", rl.limits.globalRate), retry
+		}
+	}
+	if rl.limits.clientRate > 0 {
+		c.bucket.take()
+	}
+	if rl.limits.globalRate > 0 {
+		rl.global.take()
+	}
+	return "", 0
+}
+
+// sweep forgets clients without requests for a while, at most once a minute
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.swept) < time.Minute {
+		return
+	}
+	rl.swept = now
+	for client, c := range rl.clients {
+		if c.ops == 0 && now.Sub(c.used) > rateLimitIdle {
+			delete(rl.clients, client)
+		}
+	}
+}
+
+// middleware answers requests over a limit with 429 Too Many Requests and a
+// Retry-After header. It sits behind the tenant check so tenants are limited
+// by name. A nil limiter lets every request through
+func (rl *rateLimiter) middleware(next http.Handler) http.Handler {
+	if rl == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		release, reason, retry := rl.acquire(requestClient(r), isStream(r))
+		if release == nil {
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(retry.Seconds()))))
+			http.Error(w, "Too Many Requests: over the limit of "+reason, http.StatusTooManyRequests)
+			return
+		}
+		defer release()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRateLimiter tests the request rates and concurrent requests of
+// clients and of the service
+func TestRateLimiter(t *testing.T) {
+	assert.Nil(t, newRateLimiter(rateLimits{}))
+
+	now := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+	rl := newRateLimiter(rateLimits{clientRate: 2, globalRate: 3})
+	rl.now = func() time.Time { return now }
+
+	admit := func(client string) bool {
+		release, _, _ := rl.acquire(client, false)
+		if release != nil {
+			release()
+		}
+		return release != nil
+	}
+	assert.True(t, admit("10.0.0.1"))
+	assert.True(t, admit("10.0.0.1"))
+	_, reason, retry := rl.acquire("10.0.0.1", false)
+	assert.Equal(t, "2 requests/s per client", reason)
+	assert.Equal(t, 500*time.Millisecond, retry)
+
+	assert.True(t, admit("10.0.0.2"))
+	assert.False(t, admit("10.0.0.3"), "all clients together are over 3 requests/s")
+
+	now = now.Add(time.Second)
+	assert.True(t, admit("10.0.0.1"))
+
+	// Requests refused by the service's rate take no token of their client
+	rl = newRateLimiter(rateLimits{clientRate: 2, globalRate: 1})
+	rl.now = func() time.Time { return now }
+	assert.True(t, admit("10.0.0.1"))
+	for range 3 {
+		_, reason, _ = rl.acquire("10.0.0.2", false)
+		assert.Equal(t, "1 requests/s of all clients", reason)
+	}
+	now = now.Add(time.Second)
+	assert.True(t, admit("10.0.0.2"))
+
+	// Concurrent requests
+	rl = newRateLimiter(rateLimits{clientOps: 1, globalOps: 2})
+	first, _, _ := rl.acquire("a", false)
+	require.NotNil(t, first)
+	_, reason, _ = rl.acquire("a", false)
+	assert.Equal(t, "1 concurrent requests per client", reason)
+	stream, _, _ := rl.acquire("a", true)
+	assert.NotNil(t, stream, "event streams hold no operation")
+	second, _, _ := rl.acquire("b", false)
+	require.NotNil(t, second)
+	_, reason, _ = rl.acquire("c", false)
+	assert.Equal(t, "2 concurrent requests of all clients", reason)
+	first()
+	third, _, _ := rl.acquire("a", false)
+	assert.NotNil(t, third)
+}
+
+// TestRateLimiterMiddleware tests the 429 responses and that tenants are
+// limited by name
+func TestRateLimiterMiddleware(t *testing.T) {
+	rl := newRateLimiter(rateLimits{clientRate: 1})
+	handler := rl.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	get := func(remote string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/api/node", nil)
+		r.RemoteAddr = remote
+		handler.ServeHTTP(rec, r)
+		return rec
+	}
+	assert.Equal(t, http.StatusOK, get("10.0.0.1:50000").Code)
+	rec := get("10.0.0.1:50001")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code, "the host is the client, not the connection")
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+	assert.Contains(t, rec.Body.String(), "1 requests/s per client")
+	assert.Equal(t, http.StatusOK, get("10.0.0.2:50000").Code)
+
+	// Every stream of the API counts as one, also those of backends
+	for _, op := range apiOperations {
+		if op.text == "text/event-stream" {
+			assert.True(t, isStream(httptest.NewRequest(op.method, op.path, nil)), op.path)
+		}
+	}
+	assert.False(t, isStream(httptest.NewRequest("GET", "/api/points", nil)))
+	assert.False(t, isStream(httptest.NewRequest("GET", "/api/eventsx", nil)))
+
+	r := httptest.NewRequest("GET", "/api/node", nil)
+	assert.Equal(t, "192.0.2.1", requestClient(r))
+	r = r.WithContext(context.WithValue(r.Context(), tenantContextKey{}, &tenant{Name: "acme"}))
+	assert.Equal(t, "tenant acme", requestClient(r))
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Samples kept per node unless --recent-size says otherwise
+const defaultRecentSize = 1000
+
+// recentSamples keeps the latest samples of each node the service samples
+// (poll groups and the poll file) in a ring buffer, for short trends in UIs
+// without a database
+type recentSamples struct {
+	mu      sync.Mutex
+	size    int           // Samples per node, 0 to keep none
+	maxAge  time.Duration // Age of the samples kept, 0 for any age
+	nodes   map[string]*sampleRing
+	evicted int64 // Samples overwritten or too old, since the service started
+	pruned  time.Time
+}
+
+// sampleRing holds the samples of one node, oldest first from start
+type sampleRing struct {
+	samples []Sample
+	start   int
+}
+
+// Recent samples of this service
+var serviceRecent = newRecentSamples(defaultRecentSize)
+
+func newRecentSamples(size int) *recentSamples {
+	return &recentSamples{size: size, nodes: make(map[string]*sampleRing)}
+}
+
+// record adds the values of a sample. A value keeps its source timestamp, or
+// the sample time if the server has none; a value with the timestamp of the
+// previous one is the same value sampled again and is skipped
+func (rs *recentSamples) record(results []NodeResponse, sampled time.Time) {
+	if rs.size <= 0 {
+		return
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for _, result := range results {
+		if result.Error != "" {
+			continue
+		}
+		nodeID := result.RequestedNodeID
+		if nodeID == "" {
+			nodeID = result.NodeID
+		}
+		nodeID = strings.Replace(nodeID, ",", ";", 1)
+		t := sampled
+		if result.SourceTimestamp != nil && !result.SourceTimestamp.IsZero() {
+			t = *result.SourceTimestamp
+		}
+
+		ring := rs.nodes[nodeID]
+		if ring == nil {
+			ring = &sampleRing{}
+			rs.nodes[nodeID] = ring
+		}
+		if ring.add(Sample{Time: t, Value: result.Value}, rs.size) {
+			rs.evicted++
+		}
+	}
+	if rs.maxAge > 0 && sampled.Sub(rs.pruned) >= time.Minute {
+		rs.prune(sampled)
+	}
+}
+
+// add appends a sample, overwriting the oldest one when the ring is full.
+// It reports whether a sample was overwritten
+func (ring *sampleRing) add(sample Sample, size int) bool {
+	if n := len(ring.samples); n > 0 {
+		last := ring.samples[(ring.start+n-1)%n]
+		if !sample.Time.After(last.Time) {
+			return false
+		}
+	}
+	if len(ring.samples) < size {
+		ring.samples = append(ring.samples, sample)
+		return false
+	}
+	ring.samples[ring.start] = sample
+	ring.start = (ring.start + 1) % len(ring.samples)
+	return true
+}
+
+// prune drops samples older than maxAge, and nodes without samples left,
+// e.g. of deleted poll groups. Callers must hold rs.mu
+func (rs *recentSamples) prune(now time.Time) {
+	rs.pruned = now
+	for nodeID, ring := range rs.nodes {
+		var kept []Sample
+		for i := range ring.samples {
+			sample := ring.samples[(ring.start+i)%len(ring.samples)]
+			if now.Sub(sample.Time) <= rs.maxAge {
+				kept = append(kept, sample)
+			}
+		}
+		rs.evicted += int64(len(ring.samples) - len(kept))
+		if len(kept) == 0 {
+			delete(rs.nodes, nodeID)
+			continue
+		}
+		ring.samples, ring.start = kept, 0
+	}
+}
+
+// since returns the samples of a node newer than a time, oldest first
+func (rs *recentSamples) since(nodeID string, since time.Time) ([]Sample, bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	ring, ok := rs.nodes[strings.Replace(nodeID, ",", ";", 1)]
+	if !ok {
+		return nil, false
+	}
+	samples := []Sample{}
+	for i := range ring.samples {
+		sample := ring.samples[(ring.start+i)%len(ring.samples)]
+		if sample.Time.After(since) {
+			samples = append(samples, sample)
+		}
+	}
+	return samples, true
+}
+
+// stats returns the samples kept and evicted, for /api/stats
+func (rs *recentSamples) stats() map[string]int64 {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	var samples int64
+	for _, ring := range rs.nodes {
+		samples += int64(len(ring.samples))
+	}
+	return map[string]int64{"samples": samples, "evicted": rs.evicted}
+}
+
+// counts returns the number of samples kept per node
+func (rs *recentSamples) counts() map[string]int {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	counts := make(map[string]int, len(rs.nodes))
+	for nodeID, ring := range rs.nodes {
+		counts[nodeID] = len(ring.samples)
+	}
+	return counts
+}
+
+// parseSince parses the since parameter of /api/recent and the times of
+// plccli query: an RFC 3339 time or a duration back from now, e.g. 10m
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return time.Time{}, fmt.Errorf("invalid time %q, use an RFC 3339 time or a duration like 10m", s)
+	}
+	return now.Add(-d), nil
+}
+
+// handleRecentRequest returns the recent samples of a node
+// (GET /api/recent?nodeid=X&since=10m) or, without nodeid, the nodes with
+// recent samples and how many are kept
+func handleRecentRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed, use GET for recent samples", http.StatusMethodNotAllowed)
+		return
+	}
+
+	nodeID := r.URL.Query().Get("nodeid")
+	if nodeID == "" {
+		counts := serviceRecent.counts()
+		nodes := make([]map[string]interface{}, 0, len(counts))
+		for id, count := range counts {
+			nodes = append(nodes, map[string]interface{}{"nodeId": id, "samples": count})
+		}
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i]["nodeId"].(string) < nodes[j]["nodeId"].(string) })
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"nodes": nodes,
+			"size":  serviceRecent.size,
+		})
+		return
+	}
+
+	since, err := parseSince(r.URL.Query().Get("since"), time.Now())
+	if err != nil {
+		sendJSONResponseGeneric(w, map[string]interface{}{"error": "since: " + err.Error()})
+		return
+	}
+	samples, ok := serviceRecent.since(nodeID, since)
+	if !ok {
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"error": fmt.Sprintf("no recent samples of %s, only nodes of poll groups and the poll file are kept", nodeID),
+		})
+		return
+	}
+	sendJSONResponseGeneric(w, map[string]interface{}{
+		"nodeId":  nodeID,
+		"samples": samples,
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRecentSamples tests the ring buffers of recent samples and
+// /api/recent
+func TestRecentSamples(t *testing.T) {
+	serviceRecent = newRecentSamples(3)
+	t.Cleanup(func() { serviceRecent = newRecentSamples(defaultRecentSize) })
+
+	start := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		source := start.Add(time.Duration(i) * time.Second)
+		serviceRecent.record([]NodeResponse{
+			{NodeID: "ns=3;s=Temp", RequestedNodeID: "ns=3,s=Temp", Value: float64(20 + i), SourceTimestamp: &source},
+			{NodeID: "ns=3;s=Count", Value: float64(i)},
+			{NodeID: "ns=3;s=Broken", Error: "BadNodeIdUnknown"},
+		}, start.Add(time.Duration(i)*time.Minute))
+	}
+	// Sampled again with an unchanged source timestamp
+	source := start.Add(4 * time.Second)
+	serviceRecent.record([]NodeResponse{{NodeID: "ns=3;s=Temp", RequestedNodeID: "ns=3,s=Temp", Value: 24.0, SourceTimestamp: &source}}, start.Add(time.Hour))
+
+	samples, ok := serviceRecent.since("ns=3,s=Temp", time.Time{})
+	require.True(t, ok)
+	require.Len(t, samples, 3, "the oldest samples are overwritten")
+	assert.Equal(t, []interface{}{22.0, 23.0, 24.0}, []interface{}{samples[0].Value, samples[1].Value, samples[2].Value})
+
+	samples, _ = serviceRecent.since("ns=3;s=Count", start.Add(3*time.Minute))
+	require.Len(t, samples, 1)
+	assert.Equal(t, start.Add(4*time.Minute), samples[0].Time, "the sample time without a source timestamp")
+	_, ok = serviceRecent.since("ns=3;s=Broken", time.Time{})
+	assert.False(t, ok)
+
+	get := func(query string) map[string]interface{} {
+		rec := httptest.NewRecorder()
+		handleRecentRequest(rec, httptest.NewRequest("GET", "/api/recent"+query, nil))
+		var resp map[string]interface{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return resp
+	}
+	resp := get("?nodeid=ns%3D3%3Bs%3DTemp&since=2026-03-01T08:00:03Z")
+	assert.Len(t, resp["samples"], 1)
+	resp = get("?nodeid=ns%3D3%3Bs%3DTemp&since=1h")
+	assert.Empty(t, resp["samples"])
+	assert.NotNil(t, resp["samples"], "no samples is an empty list")
+	assert.Contains(t, get("?nodeid=ns%3D3%3Bs%3DTemp&since=yesterday")["error"], "since: invalid time")
+	assert.Contains(t, get("?nodeid=ns%3D3%3Bs%3DOther")["error"], "no recent samples")
+
+	resp = get("")
+	assert.Equal(t, 3.0, resp["size"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"nodeId": "ns=3;s=Count", "samples": 3.0},
+		map[string]interface{}{"nodeId": "ns=3;s=Temp", "samples": 3.0},
+	}, resp["nodes"])
+
+	off := newRecentSamples(0)
+	off.record([]NodeResponse{{NodeID: "ns=3;s=Temp", Value: 1.0}}, start)
+	assert.Empty(t, off.counts())
+}
+
+// TestRecentSamplesMaxAge tests that samples older than --recent-max-age
+// are dropped and counted with the overwritten ones
+func TestRecentSamplesMaxAge(t *testing.T) {
+	rs := newRecentSamples(2)
+	rs.maxAge = 10 * time.Minute
+	start := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		rs.record([]NodeResponse{{NodeID: "ns=3;s=Temp", Value: float64(i)}, {NodeID: "ns=3;s=Gone", Value: 1.0}}, start.Add(time.Duration(i)*time.Minute))
+	}
+	assert.Equal(t, map[string]int64{"samples": 4, "evicted": 2}, rs.stats())
+
+	rs.record([]NodeResponse{{NodeID: "ns=3;s=Temp", Value: 3.0}}, start.Add(12*time.Minute))
+	assert.Equal(t, map[string]int{"ns=3;s=Temp": 2, "ns=3;s=Gone": 1}, rs.counts())
+	rs.record(nil, start.Add(13*time.Minute))
+	assert.Equal(t, map[string]int{"ns=3;s=Temp": 1}, rs.counts(), "nodes without samples left are dropped")
+	assert.Equal(t, map[string]int64{"samples": 1, "evicted": 6}, rs.stats())
+	samples, _ := rs.since("ns=3;s=Temp", time.Time{})
+	assert.Equal(t, []Sample{{Time: start.Add(12 * time.Minute), Value: 3.0}}, samples)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Age of the samples a SQLite sink keeps when the poll file does not set
+// retention
+const defaultRetention = 30 * 24 * time.Hour
+
+// How often a SQLite sink deletes samples older than its retention
+const pruneInterval = 10 * time.Minute
+
+// parseRetention parses the retention of a SQLite sink: a duration like 72h
+// or a number of days like 30d
+func parseRetention(s string) (time.Duration, error) {
+	if s == "" {
+		return defaultRetention, nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err == nil && n > 0 {
+			return time.Duration(n) * 24 * time.Hour, nil
+		}
+	} else if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return d, nil
+	}
+	return 0, fmt.Errorf("invalid retention %q, use e.g. 30d or 72h", s)
+}
+
+// retention limits what a file or SQLite sink keeps on disk, so a gateway
+// running for months does not fill its eMMC. The oldest files or samples are
+// deleted when they are older than age or the sink is over size:
+//
+//	retention: 30d
+//	retention: {age: 30d, size: 2GB}
+type retention struct {
+	Age  string `yaml:"age"`  // e.g. 30d or 72h
+	Size string `yaml:"size"` // e.g. 2GB, see parseByteSize
+}
+
+// UnmarshalYAML accepts a plain age as well as age and size
+func (r *retention) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		r.Age = node.Value
+		return nil
+	}
+	type plain retention
+	return node.Decode((*plain)(r))
+}
+
+// limits parses the retention, with defaultAge if it sets no age. A size of
+// 0 is no limit
+func (r retention) limits(defaultAge time.Duration) (time.Duration, int64, error) {
+	age := defaultAge
+	if r.Age != "" {
+		var err error
+		if age, err = parseRetention(r.Age); err != nil {
+			return 0, 0, err
+		}
+	}
+	var size int64
+	if r.Size != "" {
+		var err error
+		if size, err = parseByteSize(r.Size); err != nil {
+			return 0, 0, fmt.Errorf("invalid retention size: %v", err)
+		}
+	}
+	return age, size, nil
+}
+
+// storageStats are the disk use of a file or SQLite sink and what its
+// retention deleted since the service started, for /api/stats
+type storageStats struct {
+	Bytes        int64 `json:"bytes"`                  // Files of the sink, or the data in the database
+	Evicted      int64 `json:"evicted"`                // Files or samples deleted
+	EvictedBytes int64 `json:"evictedBytes,omitempty"` // Size of the deleted files
+}
+
+// storageStatsSnapshot returns the disk use and evictions of the sinks and
+// the in-memory buffers of the service
+func storageStatsSnapshot() map[string]interface{} {
+	stats := map[string]interface{}{
+		"recent": serviceRecent.stats(),
+	}
+	if s := servicePollFile; s != nil {
+		sinks := make(map[string]interface{})
+		buffers := map[string]interface{}{"api": s.buffer.stats()}
+		for i, sink := range s.file.Sinks {
+			if sink.store != nil {
+				sinks[sink.name()] = sink.store.stats()
+			}
+			buffers[sink.name()] = s.sinks[i].stats()
+		}
+		stats["sinks"] = sinks
+		stats["buffers"] = buffers
+	}
+	return stats
+}
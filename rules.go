@@ -0,0 +1,586 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+	"gopkg.in/yaml.v3"
+)
+
+// Sampling and publishing interval of the rules subscription, default of
+// the rules file's interval
+const defaultRuleInterval = time.Second
+
+// How often the rules engine looks for a new session to subscribe on, and
+// how long it waits after a failed subscription before it tries again
+const (
+	ruleCheckInterval = 5 * time.Second
+	ruleRetryInterval = time.Minute
+)
+
+// How long a command, webhook or MQTT publish of a rule may take
+const ruleActionTimeout = time.Minute
+
+// Conditions of rules, see parseRuleCondition
+const (
+	ruleBit     = "bit"
+	ruleAbove   = "above"
+	ruleBelow   = "below"
+	ruleEquals  = "equals"
+	ruleChanges = "changes"
+)
+
+// ruleCondition is the when of a rule
+type ruleCondition struct {
+	kind      string
+	bit       int     // Bit number of bit conditions
+	set       bool    // Whether the bit goes 1 or 0
+	threshold float64 // Of above, below and equals
+}
+
+// valueRule runs actions when the value of a node meets a condition, e.g.
+// a page when bit 7 of an alarm word goes 1
+type valueRule struct {
+	Name       string    `yaml:"name"`
+	Node       string    `yaml:"node"`
+	When       string    `yaml:"when"`
+	Command    string    `yaml:"command"`    // Run with sh, the firing in PLCCLI_* variables
+	Webhook    string    `yaml:"webhook"`    // Gets the firing as JSON
+	Secret     string    `yaml:"secret"`     // HMAC-SHA256 key of the webhook signature
+	SecretFile string    `yaml:"secretFile"` // Or a file with it
+	MQTT       *ruleMQTT `yaml:"mqtt"`       // Publishes the firing as JSON
+
+	cond   ruleCondition
+	handle uint32 // Client handle of the node's monitored item
+	secret []byte
+
+	// Last value, guarded by the engine's mu
+	seen  bool
+	last  interface{}
+	holds bool
+}
+
+// ruleMQTT is the broker and topic a rule publishes to, see rulesmqtt.go
+type ruleMQTT struct {
+	Broker   string `yaml:"broker"` // mqtt://host[:1883] or mqtts://host[:8883]
+	Topic    string `yaml:"topic"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	QoS      byte   `yaml:"qos"` // 0, or 1 to wait for the broker's PUBACK
+}
+
+// ruleFiring is a rule whose condition was met, the JSON of its webhook and
+// MQTT publish and $PLCCLI_RULE_JSON of its command
+type ruleFiring struct {
+	Rule       string      `json:"rule"`
+	Connection string      `json:"connection"`
+	NodeID     string      `json:"nodeId"`
+	When       string      `json:"when"`
+	Value      interface{} `json:"value"`
+	Previous   interface{} `json:"previous"`
+	Time       time.Time   `json:"time"` // Source timestamp
+}
+
+// ruleEngine evaluates the rules of --rules on the data changes of an OPC
+// UA subscription to their nodes, for alarming at the edge without a SCADA
+// system. Like the keep-alive it subscribes again on every new session; the
+// last values are kept, so a condition met while the session was down fires
+// once the new subscription delivers the value
+type ruleEngine struct {
+	interval time.Duration
+	rules    []*valueRule
+	nodes    []string // Subscribed nodes, the client handle is the index
+
+	client  *opcua.Client // Session the subscription belongs to
+	sub     *opcua.Subscription
+	cancel  context.CancelFunc
+	retryAt time.Time
+
+	mu     sync.Mutex
+	failed error // Error the subscription reported
+}
+
+// Rules of this service, nil without --rules
+var serviceRules *ruleEngine
+
+// loadRules reads a rules file:
+//
+//	interval: 500ms
+//	rules:
+//	  - name: door_open
+//	    node: ns=5;s=alarm_word
+//	    when: bit 7 goes 1
+//	    command: /usr/local/bin/page-oncall
+//	  - name: oven_hot
+//	    node: ns=3;s=Oven.Temp
+//	    when: above 250
+//	    webhook: https://alerts.example.com/plc
+//	    mqtt: {broker: "mqtts://broker:8883", topic: plant/alarms, qos: 1}
+func loadRules(path string) (*ruleEngine, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules file %s: %v", path, err)
+	}
+	var file struct {
+		Interval string       `yaml:"interval"`
+		Rules    []*valueRule `yaml:"rules"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid rules file %s: %v", path, err)
+	}
+	if len(file.Rules) == 0 {
+		return nil, fmt.Errorf("invalid rules file %s: no rules", path)
+	}
+
+	e := &ruleEngine{interval: defaultRuleInterval, rules: file.Rules}
+	if file.Interval != "" {
+		e.interval, err = time.ParseDuration(file.Interval)
+		if err != nil || e.interval <= 0 {
+			return nil, fmt.Errorf("invalid rules file %s: interval %q is not a positive duration", path, file.Interval)
+		}
+	}
+
+	names := make(map[string]bool)
+	handles := make(map[string]uint32)
+	for i, r := range e.rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule%d", i+1)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("invalid rules file %s: two rules are named %s", path, r.Name)
+		}
+		names[r.Name] = true
+		if err := r.check(); err != nil {
+			return nil, fmt.Errorf("invalid rules file %s: rule %s: %v", path, r.Name, err)
+		}
+
+		// Rules of the same node share its monitored item
+		if err := checkNodeID(r.Node); err != nil {
+			return nil, fmt.Errorf("invalid rules file %s: rule %s: %v", path, r.Name, err)
+		}
+		key, err := bitNameKey(r.Node)
+		if err != nil {
+			key = r.Node // Namespace URIs are resolved when subscribing
+		}
+		handle, ok := handles[key]
+		if !ok {
+			handle = uint32(len(e.nodes))
+			handles[key] = handle
+			e.nodes = append(e.nodes, r.Node)
+		}
+		r.handle = handle
+	}
+	return e, nil
+}
+
+// check parses the condition of a rule and validates its actions
+func (r *valueRule) check() error {
+	if r.Node == "" {
+		return fmt.Errorf("node is missing")
+	}
+	cond, err := parseRuleCondition(r.When)
+	if err != nil {
+		return err
+	}
+	r.cond = cond
+
+	if r.Command == "" && r.Webhook == "" && r.MQTT == nil {
+		return fmt.Errorf("no action, set command, webhook or mqtt")
+	}
+	if r.Webhook != "" {
+		if u, err := url.Parse(r.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid webhook URL %q", r.Webhook)
+		}
+		if r.secret, err = webhookSecret(r.Secret, r.SecretFile); err != nil {
+			return err
+		}
+	} else if r.Secret != "" || r.SecretFile != "" {
+		return fmt.Errorf("secret and secretFile sign webhooks, the rule has none")
+	}
+	if r.MQTT != nil {
+		if !findComponent("cloudiot").Included {
+			return fmt.Errorf("mqtt: %v", errNotIncluded("cloudiot"))
+		}
+		if err := r.MQTT.check(); err != nil {
+			return fmt.Errorf("mqtt: %v", err)
+		}
+	}
+	return nil
+}
+
+// check validates the broker and topic of an MQTT action
+func (m *ruleMQTT) check() error {
+	u, err := url.Parse(m.Broker)
+	if err != nil || (u.Scheme != "mqtt" && u.Scheme != "mqtts") || u.Hostname() == "" {
+		return fmt.Errorf("broker %q is not mqtt://host[:port] or mqtts://host[:port]", m.Broker)
+	}
+	if m.Topic == "" {
+		return fmt.Errorf("topic is missing")
+	}
+	if m.QoS > 1 {
+		return fmt.Errorf("qos %d is not 0 or 1", m.QoS)
+	}
+	return nil
+}
+
+// parseRuleCondition parses the when of a rule: "bit N goes 1", "bit N goes
+// 0", "above X", "below X", "equals X" or "changes"
+func parseRuleCondition(text string) (ruleCondition, error) {
+	fields := strings.Fields(strings.ToLower(text))
+	if len(fields) == 0 {
+		return ruleCondition{}, fmt.Errorf("when is missing")
+	}
+	switch kind := fields[0]; kind {
+	case ruleBit:
+		if len(fields) != 4 || fields[2] != "goes" || (fields[3] != "0" && fields[3] != "1") {
+			break
+		}
+		bit, err := strconv.Atoi(fields[1])
+		if err != nil || bit < 0 || bit > 63 {
+			return ruleCondition{}, fmt.Errorf("invalid when %q: bit %s is not between 0 and 63", text, fields[1])
+		}
+		return ruleCondition{kind: kind, bit: bit, set: fields[3] == "1"}, nil
+	case ruleAbove, ruleBelow, ruleEquals:
+		if len(fields) != 2 {
+			break
+		}
+		threshold, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return ruleCondition{}, fmt.Errorf("invalid when %q: %s is not a number", text, fields[1])
+		}
+		return ruleCondition{kind: kind, threshold: threshold}, nil
+	case ruleChanges:
+		if len(fields) == 1 {
+			return ruleCondition{kind: kind}, nil
+		}
+	}
+	return ruleCondition{}, fmt.Errorf("invalid when %q, expected bit N goes 1, bit N goes 0, above X, below X, equals X or changes", text)
+}
+
+// test reports whether a value meets a condition other than changes
+func (c ruleCondition) test(value interface{}) (bool, error) {
+	if c.kind == ruleBit {
+		n, ok := ruleInteger(value)
+		if !ok {
+			return false, fmt.Errorf("bit %d needs an integer or boolean value, got %T", c.bit, value)
+		}
+		return (n>>uint(c.bit))&1 == 1 == c.set, nil
+	}
+	v, ok := ruleNumber(value)
+	if !ok {
+		return false, fmt.Errorf("%s %v needs a number, got %T", c.kind, c.threshold, value)
+	}
+	switch c.kind {
+	case ruleAbove:
+		return v > c.threshold, nil
+	case ruleBelow:
+		return v < c.threshold, nil
+	}
+	return v == c.threshold, nil
+}
+
+// ruleInteger converts an integer or boolean value to the bits of a bit
+// condition. Negative values are taken in two's complement
+func ruleInteger(value interface{}) (uint64, bool) {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case uint64:
+		return v, true
+	}
+	n, ok := enumNumber(value)
+	return uint64(n), ok
+}
+
+// ruleNumber converts a numeric or boolean value to float64
+func ruleNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case bool, uint64:
+		n, _ := ruleInteger(v)
+		return float64(n), true
+	}
+	n, ok := enumNumber(value)
+	return float64(n), ok
+}
+
+// observe records a value of the rule's node and reports whether the rule
+// fires: for changes when it differs from the last value, else when the
+// condition is met and was not met by the last value. The first value after
+// the start only sets the state, conditions already met then do not fire
+func (r *valueRule) observe(value interface{}) (fire bool, previous interface{}, err error) {
+	previous, seen := r.last, r.seen
+	r.last, r.seen = value, true
+	if r.cond.kind == ruleChanges {
+		return seen && fmt.Sprint(previous) != fmt.Sprint(value), previous, nil
+	}
+	holds, err := r.cond.test(value)
+	if err != nil {
+		return false, previous, err
+	}
+	was := r.holds
+	r.holds = holds
+	return seen && !was && holds, previous, nil
+}
+
+// run subscribes to the nodes of the rules on the service's session, and
+// again on every new one, until ctx ends
+func (e *ruleEngine) run(ctx context.Context) {
+	ticker := time.NewTicker(ruleCheckInterval)
+	defer ticker.Stop()
+	defer e.stop()
+	for {
+		clientMutex.Lock()
+		client := opcuaClient
+		clientMutex.Unlock()
+		if client != nil {
+			e.check(ctx, client)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check subscribes on a new session, or again when the subscription failed
+func (e *ruleEngine) check(ctx context.Context, client *opcua.Client) {
+	e.mu.Lock()
+	failed := e.failed
+	e.mu.Unlock()
+	if client == e.client && failed == nil && (e.sub != nil || time.Now().Before(e.retryAt)) {
+		return
+	}
+	if failed != nil {
+		log.Printf("[%s] Rules subscription failed (%v), subscribing again", connectionName, failed)
+	}
+	e.stop()
+	e.client = client
+	if err := e.subscribe(ctx, client); err != nil {
+		e.retryAt = time.Now().Add(ruleRetryInterval)
+		log.Printf("[%s] Failed to subscribe to the nodes of the rules, retrying in %v: %v", connectionName, ruleRetryInterval, err)
+	}
+}
+
+// subscribe creates a monitored item for every node of the rules
+func (e *ruleEngine) subscribe(ctx context.Context, client *opcua.Client) error {
+	items := make([]*ua.MonitoredItemCreateRequest, len(e.nodes))
+	for i, node := range e.nodes {
+		nodeID, err := resolveNodeID(node)
+		if err != nil {
+			return fmt.Errorf("node %s: %v", node, err)
+		}
+		items[i] = opcua.NewMonitoredItemCreateRequestWithDefaults(nodeID, ua.AttributeIDValue, uint32(i))
+		items[i].RequestedParameters.SamplingInterval = float64(e.interval / time.Millisecond)
+	}
+
+	if err := serviceMonitoring.reserve(serviceLimits.get(), len(items)); err != nil {
+		return err
+	}
+	notifs := make(chan *opcua.PublishNotificationData, 64)
+	sub, err := client.Subscribe(ctx, &opcua.SubscriptionParameters{Interval: e.interval}, notifs)
+	if err != nil {
+		serviceMonitoring.release(len(items))
+		return err
+	}
+	resp, err := sub.Monitor(ctx, ua.TimestampsToReturnSource, items...)
+	if err != nil {
+		sub.Cancel(ctx)
+		serviceMonitoring.release(len(items))
+		return err
+	}
+	// A node the server does not know leaves its rules idle, not the others
+	for i, result := range resp.Results {
+		if result.StatusCode != ua.StatusOK && i < len(e.nodes) {
+			log.Printf("[%s] Rules of node %s stay idle: %v", connectionName, e.nodes[i], result.StatusCode)
+		}
+	}
+
+	subCtx, cancel := context.WithCancel(ctx)
+	e.sub, e.cancel = sub, cancel
+	e.mu.Lock()
+	e.failed = nil
+	e.mu.Unlock()
+	go e.receive(subCtx, notifs)
+	if isVerbose {
+		log.Printf("[%s] Rules subscribed to %d nodes", connectionName, len(e.nodes))
+	}
+	return nil
+}
+
+// receive evaluates the data changes of the subscription until it is stopped
+func (e *ruleEngine) receive(ctx context.Context, notifs <-chan *opcua.PublishNotificationData) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-notifs:
+			if n.Error != nil {
+				e.mu.Lock()
+				e.failed = n.Error
+				e.mu.Unlock()
+				continue
+			}
+			changes, ok := n.Value.(*ua.DataChangeNotification)
+			if !ok {
+				continue
+			}
+			for _, item := range changes.MonitoredItems {
+				e.update(item.ClientHandle, item.Value)
+			}
+		}
+	}
+}
+
+// update evaluates the rules of a node on a new value. Values of bad or
+// uncertain quality are no reason to alarm and are skipped
+func (e *ruleEngine) update(handle uint32, dv *ua.DataValue) {
+	if dv == nil || dv.Status != ua.StatusOK || dv.Value == nil {
+		return
+	}
+	value := dv.Value.Value()
+	sampled := dv.SourceTimestamp
+	if sampled.IsZero() {
+		sampled = time.Now()
+	}
+
+	for _, r := range e.rules {
+		if r.handle != handle {
+			continue
+		}
+		e.mu.Lock()
+		fire, previous, err := r.observe(value)
+		e.mu.Unlock()
+		if err != nil {
+			if isVerbose {
+				log.Printf("[%s] Rule %s: %v", connectionName, r.Name, err)
+			}
+			continue
+		}
+		if fire {
+			go e.fire(r, ruleFiring{
+				Rule:       r.Name,
+				Connection: connectionName,
+				NodeID:     r.Node,
+				When:       r.When,
+				Value:      value,
+				Previous:   previous,
+				Time:       sampled.UTC(),
+			})
+		}
+	}
+}
+
+// fire runs the actions of a rule. Like the disconnect hook, rules stay
+// quiet during maintenance windows
+func (e *ruleEngine) fire(r *valueRule, f ruleFiring) {
+	logged := serviceSensitive.loggedValueOf(f.NodeID, f.Value)
+	if serviceMaintenance.active() {
+		log.Printf("[%s] Rule %s met (%s = %v), actions skipped during maintenance", connectionName, r.Name, f.NodeID, logged)
+		return
+	}
+	log.Printf("[%s] Rule %s fired: %s = %v (%s)", connectionName, r.Name, f.NodeID, logged, r.When)
+
+	payload, err := json.Marshal(f)
+	if err != nil {
+		log.Printf("[%s] Rule %s: %v", connectionName, r.Name, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ruleActionTimeout)
+	defer cancel()
+	if r.Command != "" {
+		if out, err := runRuleCommand(ctx, r.Command, f, payload); err != nil {
+			log.Printf("[%s] Command of rule %s failed: %v: %s", connectionName, r.Name, err, out)
+		} else if isVerbose {
+			log.Printf("[%s] Command of rule %s ran: %s", connectionName, r.Name, out)
+		}
+	}
+	if r.Webhook != "" {
+		if err := postRuleWebhook(ctx, r.Webhook, r.secret, payload); err != nil {
+			log.Printf("[%s] Webhook of rule %s failed: %v", connectionName, r.Name, err)
+		}
+	}
+	if r.MQTT != nil {
+		if err := publishRuleMQTT(ctx, r.MQTT, payload); err != nil {
+			log.Printf("[%s] MQTT publish of rule %s failed: %v", connectionName, r.Name, err)
+		}
+	}
+}
+
+// runRuleCommand runs the command of a rule with sh. The firing is in the
+// environment as PLCCLI_RULE, PLCCLI_CONNECTION, PLCCLI_NODE, PLCCLI_VALUE,
+// PLCCLI_PREVIOUS and, as JSON, PLCCLI_RULE_JSON
+func runRuleCommand(ctx context.Context, command string, f ruleFiring, payload []byte) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"PLCCLI_RULE="+f.Rule,
+		"PLCCLI_CONNECTION="+f.Connection,
+		"PLCCLI_NODE="+f.NodeID,
+		"PLCCLI_VALUE="+fmt.Sprint(f.Value),
+		"PLCCLI_PREVIOUS="+fmt.Sprint(f.Previous),
+		"PLCCLI_RULE_JSON="+string(payload),
+	)
+	return cmd.CombinedOutput()
+}
+
+// postRuleWebhook posts the firing of a rule, signed like the webhook sinks
+// when the rule has a secret
+func postRuleWebhook(ctx context.Context, target string, secret, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(webhookTimestampHeader, timestamp)
+		req.Header.Set(webhookSignatureHeader, signWebhook(secret, timestamp, payload))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// stop cancels the subscription of the previous session
+func (e *ruleEngine) stop() {
+	if e.sub == nil {
+		return
+	}
+	e.cancel()
+	if e.client != nil && e.client.State() == opcua.Connected {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		e.sub.Cancel(ctx)
+		cancel()
+	}
+	e.sub, e.cancel = nil, nil
+	serviceMonitoring.release(len(e.nodes))
+}
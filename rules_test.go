@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestParseRuleCondition tests the when of rules
+func TestParseRuleCondition(t *testing.T) {
+	cond, err := parseRuleCondition("bit 7 goes 1")
+	require.NoError(t, err)
+	assert.Equal(t, ruleCondition{kind: ruleBit, bit: 7, set: true}, cond)
+	cond, err = parseRuleCondition("Bit 0 goes 0")
+	require.NoError(t, err)
+	assert.Equal(t, ruleCondition{kind: ruleBit}, cond)
+	cond, err = parseRuleCondition("above -12.5")
+	require.NoError(t, err)
+	assert.Equal(t, ruleCondition{kind: ruleAbove, threshold: -12.5}, cond)
+	cond, err = parseRuleCondition("changes")
+	require.NoError(t, err)
+	assert.Equal(t, ruleCondition{kind: ruleChanges}, cond)
+
+	for when, msg := range map[string]string{
+		"":              "when is missing",
+		"bit 64 goes 1": "not between 0 and 63",
+		"bit 3 goes 2":  "expected bit N goes 1",
+		"below hot":     "hot is not a number",
+		"equals":        "expected bit N goes 1",
+		"changes a lot": "expected bit N goes 1",
+	} {
+		_, err := parseRuleCondition(when)
+		assert.ErrorContains(t, err, msg, when)
+	}
+}
+
+// TestRuleObserve tests that rules fire on the edges of their conditions,
+// not on the first value or while the condition stays met
+func TestRuleObserve(t *testing.T) {
+	observe := func(when string, values ...interface{}) []bool {
+		cond, err := parseRuleCondition(when)
+		require.NoError(t, err)
+		r := &valueRule{cond: cond}
+		var fired []bool
+		for _, v := range values {
+			fire, _, err := r.observe(v)
+			require.NoError(t, err)
+			fired = append(fired, fire)
+		}
+		return fired
+	}
+
+	assert.Equal(t, []bool{false, true, false, false, true},
+		observe("bit 7 goes 1", uint16(0x01), uint16(0x81), uint16(0x83), uint16(0x03), uint16(0x80)))
+	assert.Equal(t, []bool{false, false, false, true}, observe("bit 7 goes 1", uint16(0x80), uint16(0x81), uint16(0x01), uint16(0x80)), "met at the start")
+	assert.Equal(t, []bool{false, true, false}, observe("bit 0 goes 0", true, false, false))
+	assert.Equal(t, []bool{false, true}, observe("bit 63 goes 1", int64(0), int64(-1)))
+	assert.Equal(t, []bool{false, true, false, false, true}, observe("above 80", 20.0, 81.5, 90.0, 79.0, float32(85)))
+	assert.Equal(t, []bool{false, true, false}, observe("below 10", int32(12), int32(9), uint64(3)))
+	assert.Equal(t, []bool{false, true, false, false, true}, observe("equals 3", uint8(1), uint8(3), int16(3), uint8(0), 3.0))
+	assert.Equal(t, []bool{false, false, true, true}, observe("changes", "idle", "idle", "running", "idle"))
+
+	cond, _ := parseRuleCondition("bit 1 goes 1")
+	r := &valueRule{cond: cond}
+	_, _, err := r.observe(1.5)
+	assert.ErrorContains(t, err, "needs an integer or boolean")
+	_, previous, err := (&valueRule{cond: ruleCondition{kind: ruleAbove}, last: 1.0, seen: true}).observe(2.0)
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, previous)
+}
+
+// TestLoadRules tests reading rules files and their errors
+func TestLoadRules(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "rules.yaml")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+		return path
+	}
+
+	e, err := loadRules(write(`
+interval: 250ms
+rules:
+  - name: door_open
+    node: ns=5;s=alarm_word
+    when: bit 7 goes 1
+    command: echo door
+  - node: ns=5;s=alarm_word
+    when: bit 0 goes 0
+    webhook: https://alerts.example.com/plc
+    secret: s3cret
+  - node: ns=3;s=Oven.Temp
+    when: above 250
+    command: echo hot
+`))
+	require.NoError(t, err)
+	assert.Equal(t, 250*time.Millisecond, e.interval)
+	require.Len(t, e.rules, 3)
+	assert.Equal(t, "rule2", e.rules[1].Name)
+	assert.Equal(t, []string{"ns=5;s=alarm_word", "ns=3;s=Oven.Temp"}, e.nodes, "rules of a node share its item")
+	assert.Equal(t, uint32(0), e.rules[1].handle)
+	assert.Equal(t, uint32(1), e.rules[2].handle)
+	assert.Equal(t, []byte("s3cret"), e.rules[1].secret)
+
+	for content, msg := range map[string]string{
+		"rules: []": "no rules",
+		"interval: soon\nrules: [{node: ns=1;i=1, when: changes, command: x}]":                                                "not a positive duration",
+		"rules: [{node: ns=1;i=1, when: changes}]":                                                                            "no action",
+		"rules: [{when: changes, command: x}]":                                                                                "node is missing",
+		"rules: [{node: 'ns=1;i=abc', when: changes, command: x}]":                                                            "rule rule1",
+		"rules: [{node: ns=1;i=1, when: hot, command: x}]":                                                                    "invalid when",
+		"rules: [{node: ns=1;i=1, when: changes, webhook: 'ftp://x'}]":                                                        "invalid webhook URL",
+		"rules: [{node: ns=1;i=1, when: changes, command: x, secret: s}]":                                                     "secret and secretFile sign webhooks",
+		"rules: [{name: a, node: ns=1;i=1, when: changes, command: x}, {name: a, node: ns=1;i=2, when: changes, command: x}]": "two rules are named a",
+	} {
+		_, err := loadRules(write(content))
+		assert.ErrorContains(t, err, msg, content)
+	}
+
+	// MQTT actions need the MQTT client of the cloudiot component
+	_, err = loadRules(write("rules: [{node: ns=1;i=1, when: changes, mqtt: {broker: 'http://broker', topic: t}}]"))
+	if findComponent("cloudiot").Included {
+		assert.ErrorContains(t, err, "is not mqtt://host[:port]")
+	} else {
+		assert.ErrorContains(t, err, "cloudiot is not included")
+	}
+}
+
+// TestRuleEngine tests that a rule on the alarm word of the simulated PLC
+// runs its command and webhook when a bit goes 1
+func TestRuleEngine(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	client := connectMock(t, ctx)
+
+	bodies := make(chan []byte, 4)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, signWebhook([]byte("s3cret"), r.Header.Get(webhookTimestampHeader), body), r.Header.Get(webhookSignatureHeader))
+		bodies <- body
+	}))
+	defer webhook.Close()
+
+	dir := t.TempDir()
+	out := filepath.Join(dir, "fired")
+	rulesPath := filepath.Join(dir, "rules.yaml")
+	node := "nsu=" + mockNamespaceURI + ";s=Alarms"
+	require.NoError(t, os.WriteFile(rulesPath, []byte(`
+interval: 100ms
+rules:
+  - name: motor_fault
+    node: "`+node+`"
+    when: bit 1 goes 1
+    command: echo "$PLCCLI_RULE $PLCCLI_PREVIOUS $PLCCLI_VALUE" >> `+out+`
+    webhook: `+webhook.URL+`
+    secret: s3cret
+`), 0644))
+	e, err := loadRules(rulesPath)
+	require.NoError(t, err)
+	defer e.stop()
+	e.check(ctx, client)
+	require.NotNil(t, e.sub)
+
+	alarms, err := resolveNodeID(node)
+	require.NoError(t, err)
+	time.Sleep(500 * time.Millisecond) // The initial value only sets the state
+	_, err = writeOPCUA(ctx, client, &ua.WriteRequest{
+		NodesToWrite: []*ua.WriteValue{{
+			NodeID:      alarms,
+			AttributeID: ua.AttributeIDValue,
+			Value:       &ua.DataValue{EncodingMask: ua.DataValueValue, Value: ua.MustVariant(uint16(0x83))},
+		}},
+	})
+	require.NoError(t, err)
+
+	select {
+	case body := <-bodies:
+		var f ruleFiring
+		require.NoError(t, json.Unmarshal(body, &f))
+		assert.Equal(t, "motor_fault", f.Rule)
+		assert.Equal(t, node, f.NodeID)
+		assert.Equal(t, float64(0x83), f.Value)
+		assert.Equal(t, float64(0x81), f.Previous)
+	case <-ctx.Done():
+		t.Fatal("the webhook was not called")
+	}
+	assert.Eventually(t, func() bool {
+		data, _ := os.ReadFile(out)
+		return strings.TrimSpace(string(data)) == "motor_fault 129 131"
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// A new session gets a new subscription
+	sub := e.sub
+	e.check(ctx, client)
+	assert.Same(t, sub, e.sub, "same session")
+	e.mu.Lock()
+	e.failed = ua.StatusBadTimeout
+	e.mu.Unlock()
+	e.check(ctx, client)
+	assert.NotSame(t, sub, e.sub, "after a failure")
+}
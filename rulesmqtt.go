@@ -0,0 +1,36 @@
+//go:build !minimal && !nocloudiot
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// publishRuleMQTT publishes the firing of a rule on a connection of its
+// own, alarms are too rare to keep one open. The client ID is random so
+// rules firing at once do not take over each other's connection
+func publishRuleMQTT(ctx context.Context, m *ruleMQTT, payload []byte) error {
+	dial, err := mqttDialer(m.Broker, "")
+	if err != nil {
+		return err
+	}
+	conn, err := dial(ctx)
+	if err != nil {
+		return err
+	}
+
+	id := make([]byte, 4)
+	rand.Read(id)
+	client, err := newMQTTClient(ctx, conn, mqttLogin{
+		clientID: "plccli-" + connectionName + "-" + hex.EncodeToString(id),
+		username: m.Username,
+		password: m.Password,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+	return client.publish(ctx, m.Topic, payload, m.QoS)
+}
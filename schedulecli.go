@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Delimiter of plccli schedules import, from its --delimiter flag
+var scheduleDelimiter string
+
+// runSchedulesCommand runs schedules import, list or clear against the service
+func runSchedulesCommand(args []string, host string, port int) (string, error) {
+	if len(args) < 1 {
+		return "", fmt.Errorf("missing schedules command: import, list or clear")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client := newServiceClient(host, port)
+
+	switch args[0] {
+	case "import":
+		if len(args) != 2 {
+			return "", fmt.Errorf("schedules import needs a CSV file of node, value, type and cron columns")
+		}
+		var delimiter rune
+		if scheduleDelimiter != "" {
+			d := strings.ReplaceAll(scheduleDelimiter, `\t`, "\t")
+			if utf8.RuneCountInString(d) != 1 {
+				return "", fmt.Errorf("invalid --delimiter %q, expected one character", scheduleDelimiter)
+			}
+			delimiter, _ = utf8.DecodeRuneInString(d)
+		}
+		f, err := os.Open(args[1])
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		schedules, err := parseScheduleCSV(f, args[1], delimiter)
+		if err != nil {
+			return "", err
+		}
+		if len(schedules) == 0 {
+			return "", fmt.Errorf("no schedules in %s, remove them with plccli schedules clear", args[1])
+		}
+		imported, err := client.ImportSchedules(ctx, schedules)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Imported %d write schedules (via %s:%d)\n%s", len(imported), host, port, formatSchedules(imported)), nil
+
+	case "list":
+		schedules, err := client.Schedules(ctx)
+		if err != nil {
+			return "", err
+		}
+		return formatSchedules(schedules), nil
+
+	case "clear":
+		if err := client.ClearSchedules(ctx); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Removed all write schedules (via %s:%d)", host, port), nil
+	}
+	return "", fmt.Errorf("unknown schedules command %s, expected import, list or clear", args[0])
+}
+
+// formatSchedules lists schedules one per line with their next and last runs
+func formatSchedules(schedules []WriteSchedule) string {
+	if len(schedules) == 0 {
+		return "No write schedules"
+	}
+	var lines []string
+	for _, s := range schedules {
+		line := fmt.Sprintf("%-20s %s = %s (%s)", s.Cron, s.NodeID, s.Value, s.DataType)
+		if s.Name != "" {
+			line += "  " + s.Name
+		}
+		if s.Next != nil {
+			line += "  next " + s.Next.Local().Format(time.RFC3339)
+		} else {
+			line += "  never"
+		}
+		if s.LastRun != nil {
+			line += "  last " + s.LastRun.Local().Format(time.RFC3339)
+			if s.LastError != "" {
+				line += " failed: " + s.LastError
+			}
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
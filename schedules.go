@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"umicli/pkg/plcclient"
+)
+
+// Data types of scheduled writes, those of opcua set
+var scheduleDataTypes = map[string]bool{
+	"auto": true, "boolean": true, "sbyte": true, "byte": true, "int16": true, "uint16": true,
+	"int32": true, "uint32": true, "int64": true, "uint64": true, "float": true, "double": true,
+	"string": true, "localizedtext": true, "dtl": true, "struct": true,
+}
+
+// Column names of schedule CSV files, by the field they fill
+var scheduleColumns = map[string]string{
+	"node": "node", "nodeid": "node", "node id": "node",
+	"value": "value",
+	"type":  "type", "datatype": "type", "data type": "type",
+	"cron": "cron", "schedule": "cron",
+	"name": "name", "description": "name",
+}
+
+// scheduleRegistry holds the recurring writes of the service. Each tenant
+// imports its own as a whole, usually from a planner's spreadsheet; they are
+// saved across restarts and written by run in the minutes their cron
+// expressions match
+type scheduleRegistry struct {
+	mu        sync.Mutex
+	schedules []*writeSchedule
+	stateFile string                                                      // "" to keep them in memory only
+	write     func(ctx context.Context, s WriteSchedule, t *tenant) error // replaced in tests
+}
+
+// writeSchedule is a schedule with its parsed cron expression and the
+// tenant it is written for
+type writeSchedule struct {
+	WriteSchedule
+	cron   *cronSchedule
+	tenant *tenant // Name, source and access as of the import, nil without tenants
+}
+
+// savedSchedule is a schedule in the state file with the source and access
+// of its tenant, as tenants of --api-auth are only known while their answer
+// is cached
+type savedSchedule struct {
+	WriteSchedule
+	Source string `json:"source,omitempty"`
+	Access string `json:"access,omitempty"`
+}
+
+// Recurring writes of this service
+var serviceSchedules = newScheduleRegistry()
+
+func newScheduleRegistry() *scheduleRegistry {
+	return &scheduleRegistry{write: scheduleWrite}
+}
+
+// validateSchedule checks a schedule, normalizes its node ID and data type
+// and parses its cron expression
+func validateSchedule(s *WriteSchedule) (*cronSchedule, error) {
+	s.NodeID = strings.TrimSpace(s.NodeID)
+	if !strings.HasPrefix(s.NodeID, "nsu=") {
+		s.NodeID = strings.Replace(s.NodeID, ",", ";", 1)
+		// Written like ns=X;Y=Z, also for namespace 0
+		if !strings.HasPrefix(s.NodeID, "ns=") {
+			s.NodeID = "ns=0;" + s.NodeID
+		}
+	}
+	if err := checkNodeID(s.NodeID); err != nil {
+		return nil, fmt.Errorf("invalid node ID %q: %v", s.NodeID, err)
+	}
+	s.DataType = strings.ToLower(strings.TrimSpace(s.DataType))
+	if !scheduleDataTypes[s.DataType] {
+		return nil, fmt.Errorf("unsupported data type %q for %s", s.DataType, s.NodeID)
+	}
+	if s.DataType == "float" || s.DataType == "double" {
+		if _, err := parseDecimal(s.Value, 64, *decimalSeparator); err != nil {
+			return nil, fmt.Errorf("invalid %s value: %v", s.DataType, err)
+		}
+	}
+	return parseCron(s.Cron)
+}
+
+// replace replaces the schedules of a tenant, all of them without tenants
+// (nil), and returns the tenant's new ones. The tenant's name and access are
+// kept with them. Nothing changes if one of them is invalid
+func (reg *scheduleRegistry) replace(schedules []WriteSchedule, t *tenant) ([]WriteSchedule, error) {
+	var owner *tenant
+	if t != nil {
+		owner = &tenant{Name: t.Name, Access: t.Access, source: t.source}
+	}
+	parsed := make([]*writeSchedule, len(schedules))
+	for i, s := range schedules {
+		s.Next, s.LastRun, s.LastError = nil, nil, ""
+		s.Tenant = ""
+		if owner != nil {
+			s.Tenant = owner.Name
+		}
+		cron, err := validateSchedule(&s)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %d: %v", i+1, err)
+		}
+		parsed[i] = &writeSchedule{WriteSchedule: s, cron: cron, tenant: owner}
+	}
+
+	reg.mu.Lock()
+	var kept []*writeSchedule
+	for _, s := range reg.schedules {
+		if !s.belongsTo(t) {
+			kept = append(kept, s)
+		}
+	}
+	reg.schedules = append(kept, parsed...)
+	if err := reg.save(); err != nil {
+		log.Printf("[%s] Failed to save write schedules: %v", connectionName, err)
+	}
+	reg.mu.Unlock()
+	return reg.list(time.Now(), t), nil
+}
+
+// belongsTo reports whether a schedule was imported by a tenant, told apart
+// by its identity. Without tenants (nil) every schedule does
+func (s *writeSchedule) belongsTo(t *tenant) bool {
+	return t == nil || (s.tenant != nil && s.tenant.identity() == t.identity())
+}
+
+// list returns the schedules of a tenant, all of them without tenants (nil),
+// in import order with their next run after now
+func (reg *scheduleRegistry) list(now time.Time, t *tenant) []WriteSchedule {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	schedules := make([]WriteSchedule, 0, len(reg.schedules))
+	for _, s := range reg.schedules {
+		if !s.belongsTo(t) {
+			continue
+		}
+		info := s.WriteSchedule
+		if next, ok := s.cron.next(now); ok {
+			info.Next = &next
+		}
+		schedules = append(schedules, info)
+	}
+	return schedules
+}
+
+// runDue writes the values of the schedules that match the minute of now,
+// one after the other in import order. During a maintenance window they are
+// skipped
+func (reg *scheduleRegistry) runDue(ctx context.Context, now time.Time) {
+	reg.mu.Lock()
+	var due []*writeSchedule
+	for _, s := range reg.schedules {
+		if s.cron.matches(now) {
+			due = append(due, s)
+		}
+	}
+	reg.mu.Unlock()
+
+	for _, s := range due {
+		var err error
+		if window := serviceMaintenance.status(); window != nil {
+			err = fmt.Errorf("skipped, under maintenance: %s", window.Reason)
+		} else {
+			err = reg.write(ctx, s.WriteSchedule, s.tenant)
+		}
+		value := serviceSensitive.loggedValueOf(s.NodeID, s.Value)
+		if err != nil {
+			log.Printf("[%s] Scheduled write of %s = %v failed: %v", connectionName, s.NodeID, value, err)
+		} else if isVerbose {
+			log.Printf("[%s] Scheduled write of %s = %v", connectionName, s.NodeID, value)
+		}
+
+		reg.mu.Lock()
+		ran := now
+		s.LastRun = &ran
+		s.LastError = ""
+		if err != nil {
+			s.LastError = err.Error()
+		}
+		reg.mu.Unlock()
+	}
+}
+
+// run runs the due schedules at the start of every minute until ctx is done.
+// Minutes the service was not running are not caught up
+func (reg *scheduleRegistry) run(ctx context.Context) {
+	for {
+		now := time.Now()
+		minute := now.Truncate(time.Minute).Add(time.Minute)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(minute.Sub(now)):
+		}
+		reg.runDue(ctx, minute)
+	}
+}
+
+// scheduleWrite writes the value of a schedule like POST /api/node, at low
+// priority, see performWrite. With tenants, it is written for the tenant
+// that imported it, t, which needs write access: as of the import for
+// tenants of --api-auth, as in the tenants file for the others
+func scheduleWrite(ctx context.Context, s WriteSchedule, t *tenant) error {
+	namespace, idType, identifier, err := plcclient.ParseNodeID(s.NodeID)
+	if err != nil {
+		return err
+	}
+	caller := writeCaller{by: "write schedule " + s.Cron}
+	if serviceTenants != nil {
+		if t != nil && t.source == "file" {
+			t = &tenant{Name: t.Name, source: t.source}
+			if file := serviceTenants.fromFile(t.Name); file != nil {
+				t.Access = file.Access
+			}
+		}
+		switch {
+		case t == nil:
+			return errors.New("imported without a tenant, import it again with a tenant token")
+		case t.Access == "":
+			return fmt.Errorf("tenant %s is no longer known", t.Name)
+		case t.Access != "write":
+			return fmt.Errorf("tenant %s has read-only access", t.Name)
+		}
+		caller = writeCaller{tenant: t, by: "tenant " + t.Name}
+	}
+	_, err = performWrite(ctx, caller, nodeWrite{
+		Namespace: namespace, Type: idType, Identifier: identifier,
+		Value: s.Value, DataType: s.DataType, Priority: writePriorityLow,
+	})
+	return err
+}
+
+// save writes the schedules to the state file. Callers must hold reg.mu
+func (reg *scheduleRegistry) save() error {
+	if reg.stateFile == "" {
+		return nil
+	}
+	schedules := make([]savedSchedule, len(reg.schedules))
+	for i, s := range reg.schedules {
+		schedules[i] = savedSchedule{WriteSchedule: WriteSchedule{Name: s.Name, NodeID: s.NodeID, Value: s.Value, DataType: s.DataType, Cron: s.Cron, Tenant: s.Tenant}}
+		if s.tenant != nil {
+			schedules[i].Source, schedules[i].Access = s.tenant.source, s.tenant.Access
+		}
+	}
+	data, err := json.MarshalIndent(schedules, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode write schedules: %v", err)
+	}
+	if err := os.WriteFile(reg.stateFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write write schedules %s: %v", reg.stateFile, err)
+	}
+	return nil
+}
+
+// restore loads the schedules saved in the state file and saves later
+// imports to it. A missing file restores nothing
+func (reg *scheduleRegistry) restore(stateFile string) error {
+	data, err := os.ReadFile(stateFile)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read write schedules %s: %v", stateFile, err)
+	}
+	var saved []savedSchedule
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &saved); err != nil {
+			return fmt.Errorf("failed to parse write schedules %s: %v", stateFile, err)
+		}
+	}
+	schedules := make([]*writeSchedule, len(saved))
+	for i, s := range saved {
+		cron, err := validateSchedule(&s.WriteSchedule)
+		if err != nil {
+			return fmt.Errorf("invalid write schedules %s: schedule %d: %v", stateFile, i+1, err)
+		}
+		schedules[i] = &writeSchedule{WriteSchedule: s.WriteSchedule, cron: cron, tenant: restoredTenant(s)}
+	}
+
+	reg.mu.Lock()
+	reg.schedules = schedules
+	reg.stateFile = stateFile
+	reg.mu.Unlock()
+	return nil
+}
+
+// restoredTenant returns the tenant of a saved schedule. Schedules saved
+// without a source were imported by tenants of the tenants file
+func restoredTenant(s savedSchedule) *tenant {
+	if s.Tenant == "" {
+		return nil
+	}
+	if s.Source == "" {
+		s.Source = "file"
+	}
+	return &tenant{Name: s.Tenant, Access: s.Access, source: s.Source}
+}
+
+// startServiceSchedules restores the saved write schedules of this
+// connection and runs them until ctx is done
+func startServiceSchedules(ctx context.Context) {
+	dir, err := serviceConfigDir("schedules")
+	if err != nil {
+		log.Printf("[%s] Write schedules are not persisted: %v", connectionName, err)
+	} else if err := serviceSchedules.restore(filepath.Join(dir, "schedules.json")); err != nil {
+		log.Printf("[%s] Failed to restore write schedules: %v", connectionName, err)
+	}
+	go serviceSchedules.run(ctx)
+}
+
+// schedulesRequest is the body of PUT /api/schedules
+type schedulesRequest struct {
+	Schedules []WriteSchedule `json:"schedules"` // name, nodeId, value, dataType and cron of each
+}
+
+// handleSchedulesRequest lists (GET), replaces (PUT) and removes (DELETE) the
+// write schedules of the request's tenant, all of the service's without
+// tenants. Changes are PLC writes for permits and maintenance, see isPLCWrite
+func handleSchedulesRequest(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"schedules": serviceSchedules.list(time.Now(), requestTenant(r)),
+		})
+
+	case http.MethodPut:
+		var req schedulesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": fmt.Sprintf("Failed to parse request: %v", err),
+			})
+			return
+		}
+		schedules, err := serviceSchedules.replace(req.Schedules, requestTenant(r))
+		if err != nil {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": err.Error(),
+			})
+			return
+		}
+		log.Printf("[%s] %d write schedules imported by %s", connectionName, len(schedules), permitHolder(r))
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"schedules": schedules,
+		})
+
+	case http.MethodDelete:
+		serviceSchedules.replace(nil, requestTenant(r))
+		log.Printf("[%s] Write schedules cleared by %s", connectionName, permitHolder(r))
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"schedules": []WriteSchedule{},
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// parseScheduleCSV reads write schedules from a CSV file as spreadsheets
+// save it: node, value, type and cron columns, in this order or named in a
+// header row (extra columns like notes are ignored, a name or description
+// column names the schedule). The delimiter is taken from the header row
+// when 0: ';' as Excel writes it in many locales, tab or ','. Empty rows and
+// rows starting with # are skipped. Float and double values may have a
+// decimal comma, see parseDecimal
+func parseScheduleCSV(r io.Reader, file string, delimiter rune) ([]WriteSchedule, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", file, err)
+	}
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+
+	var firstLine string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			firstLine = line
+			break
+		}
+	}
+	header := isScheduleHeader(firstLine)
+	columns := map[string]int{"node": 0, "value": 1, "type": 2, "cron": 3}
+	if delimiter == 0 {
+		delimiter = ','
+		if header {
+			switch {
+			case strings.Contains(firstLine, ";"):
+				delimiter = ';'
+			case strings.Contains(firstLine, "\t"):
+				delimiter = '\t'
+			}
+		}
+	}
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.Comma = delimiter
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.TrimLeadingSpace = true
+
+	var schedules []WriteSchedule
+	for first := true; ; first = false {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV file %s: %v", file, err)
+		}
+		line, _ := reader.FieldPos(0)
+		if first && header {
+			columns = map[string]int{}
+			for i, cell := range record {
+				if field, ok := scheduleColumns[strings.ToLower(strings.TrimSpace(cell))]; ok {
+					columns[field] = i
+				}
+			}
+			for _, field := range []string{"node", "value", "type", "cron"} {
+				if _, ok := columns[field]; !ok {
+					return nil, fmt.Errorf("%s:%d: missing %s column", file, line, field)
+				}
+			}
+			continue
+		}
+		if strings.TrimSpace(strings.Join(record, "")) == "" {
+			continue
+		}
+
+		for _, field := range []string{"node", "value", "type", "cron"} {
+			if columns[field] >= len(record) {
+				return nil, fmt.Errorf("%s:%d: expected node, value, type and cron, got %d columns (wrong delimiter? see --delimiter)", file, line, len(record))
+			}
+		}
+		cell := func(field string) string {
+			i, ok := columns[field]
+			if !ok || i >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[i])
+		}
+		s := WriteSchedule{Name: cell("name"), NodeID: cell("node"), Value: cell("value"), DataType: cell("type"), Cron: cell("cron")}
+		if _, err := validateSchedule(&s); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, line, err)
+		}
+		schedules = append(schedules, s)
+	}
+	return schedules, nil
+}
+
+// isScheduleHeader reports whether the first line of a schedule CSV file is
+// a header row, with column names instead of a schedule
+func isScheduleHeader(firstLine string) bool {
+	cells := strings.FieldsFunc(firstLine, func(r rune) bool { return r == ',' || r == ';' || r == '\t' })
+	for _, cell := range cells {
+		if _, ok := scheduleColumns[strings.ToLower(strings.Trim(strings.TrimSpace(cell), `"`))]; ok {
+			return true
+		}
+	}
+	return false
+}
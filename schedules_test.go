@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestParseScheduleCSV tests CSV files as spreadsheets save them
+func TestParseScheduleCSV(t *testing.T) {
+	// Plain rows in the default order, with a comment and a quoted list
+	schedules, err := parseScheduleCSV(strings.NewReader(`# Setpoints of line 1
+ns=3;s=Line1.Setpoint,72.5,Float,0 6 * * mon-fri
+"ns=3,s=Line1.Enable",true,Boolean,"0 6,18 * * *"
+`), "line1.csv", 0)
+	require.NoError(t, err)
+	require.Len(t, schedules, 2)
+	assert.Equal(t, WriteSchedule{NodeID: "ns=3;s=Line1.Setpoint", Value: "72.5", DataType: "float", Cron: "0 6 * * mon-fri"}, schedules[0])
+	assert.Equal(t, "ns=3;s=Line1.Enable", schedules[1].NodeID)
+	assert.Equal(t, "0 6,18 * * *", schedules[1].Cron)
+
+	// Excel in a German locale: BOM, semicolons, CRLF, decimal commas,
+	// columns in another order, extra and empty rows and columns
+	schedules, err = parseScheduleCSV(strings.NewReader("\xef\xbb\xbfCron;Node ID;Data type;Value;Name;Notes\r\n"+
+		"30 5 * * 1-5;\"ns=3;s=Oven.Temp\";Double;180,5;Preheat oven;ask Jan\r\n"+
+		";;;;;\r\n"+
+		"0 22 * * *;\"nsu=urn:plc;s=Oven.Temp\";double;120;;\r\n"), "oven.csv", 0)
+	require.NoError(t, err)
+	require.Len(t, schedules, 2)
+	assert.Equal(t, WriteSchedule{Name: "Preheat oven", NodeID: "ns=3;s=Oven.Temp", Value: "180,5", DataType: "double", Cron: "30 5 * * 1-5"}, schedules[0], "the service parses decimal commas")
+	assert.Equal(t, "nsu=urn:plc;s=Oven.Temp", schedules[1].NodeID)
+
+	// Tab-separated, or an explicit delimiter
+	schedules, err = parseScheduleCSV(strings.NewReader("node\tvalue\ttype\tcron\nns=3;s=A\t1\tInt16\t@hourly\n"), "a.tsv", 0)
+	require.NoError(t, err)
+	assert.Len(t, schedules, 1)
+	schedules, err = parseScheduleCSV(strings.NewReader("\"ns=3;s=A\";1;Int16;@hourly\ni=2258;1;Int16;@hourly\n"), "a.csv", ';')
+	require.NoError(t, err)
+	require.Len(t, schedules, 2)
+	assert.Equal(t, "ns=0;i=2258", schedules[1].NodeID)
+
+	for content, want := range map[string]string{
+		"ns=3;s=A,1,Int16,@hourly\nns=3;s=B,1,Int16,61 * * * *\n": "b.csv:2: invalid minute",
+		"ns=3;s=A,1,Int17,@hourly\n":                              "b.csv:1: unsupported data type",
+		"ns=3;i=A,1,Int16,@hourly\n":                              "b.csv:1: invalid node ID",
+		"ns=3;s=A,\"1,234\",Float,@hourly\n":                      "b.csv:1: invalid float value: \"1,234\" is ambiguous",
+		"\"ns=3;s=A\";1;Int16;@hourly\n":                          "b.csv:1: expected node, value, type and cron, got 1 columns",
+		"node;value;type\nns=3;s=A;1;Int16\n":                     "b.csv:1: missing cron column",
+	} {
+		_, err := parseScheduleCSV(strings.NewReader(content), "b.csv", 0)
+		assert.ErrorContains(t, err, want, content)
+	}
+}
+
+// TestScheduleRegistry tests the runs, persistence and API of write schedules
+func TestScheduleRegistry(t *testing.T) {
+	defer func(m *maintenanceMode) { serviceMaintenance = m }(serviceMaintenance)
+	serviceMaintenance = newMaintenanceMode()
+	defer func(reg *scheduleRegistry) { serviceSchedules = reg }(serviceSchedules)
+	serviceSchedules = newScheduleRegistry()
+	var written []string
+	serviceSchedules.write = func(ctx context.Context, s WriteSchedule, _ *tenant) error {
+		written = append(written, s.NodeID+"="+s.Value)
+		if s.Value == "fail" {
+			return errors.New("BadTypeMismatch")
+		}
+		return nil
+	}
+	stateFile := filepath.Join(t.TempDir(), "schedules.json")
+	require.NoError(t, serviceSchedules.restore(stateFile))
+
+	server := httptest.NewServer(http.HandlerFunc(handleSchedulesRequest))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.NoError(t, err)
+	ctx := context.Background()
+	client := newServiceClient(u.Hostname(), port)
+
+	_, err = client.ImportSchedules(ctx, []WriteSchedule{{NodeID: "ns=3;s=A", Value: "1", DataType: "Int16", Cron: "0 6 * * *"}, {NodeID: "ns=3;s=B", Value: "1", DataType: "Int16", Cron: "0 25 * * *"}})
+	assert.ErrorContains(t, err, "schedule 2: invalid hour")
+	imported, err := client.ImportSchedules(ctx, []WriteSchedule{
+		{Name: "morning", NodeID: "ns=3;s=A", Value: "1", DataType: "Int16", Cron: "0 6 * * *"},
+		{NodeID: "ns=3;s=B", Value: "fail", DataType: "String", Cron: "0 6 * * *"},
+		{NodeID: "ns=3;s=C", Value: "0", DataType: "Boolean", Cron: "0 18 * * *"},
+	})
+	require.NoError(t, err)
+	require.Len(t, imported, 3)
+	require.NotNil(t, imported[0].Next)
+	assert.Equal(t, 6, imported[0].Next.Local().Hour())
+	assert.Equal(t, "int16", imported[0].DataType)
+
+	// Due schedules run in import order, failures are kept
+	six := time.Date(2026, 3, 2, 6, 0, 0, 0, time.Local)
+	serviceSchedules.runDue(ctx, six)
+	assert.Equal(t, []string{"ns=3;s=A=1", "ns=3;s=B=fail"}, written)
+	schedules, err := client.Schedules(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, schedules[0].LastRun)
+	assert.True(t, six.Equal(*schedules[0].LastRun))
+	assert.Empty(t, schedules[0].LastError)
+	assert.Equal(t, "BadTypeMismatch", schedules[1].LastError)
+	assert.Nil(t, schedules[2].LastRun)
+	listing := formatSchedules(schedules)
+	assert.Contains(t, listing, "ns=3;s=A = 1 (int16)  morning  next ")
+	assert.Contains(t, listing, "failed: BadTypeMismatch")
+
+	// Nothing is written during maintenance
+	_, err = serviceMaintenance.start("die change", "", 0)
+	require.NoError(t, err)
+	serviceSchedules.runDue(ctx, six.Add(24*time.Hour))
+	assert.Len(t, written, 2)
+	assert.Contains(t, serviceSchedules.list(six, nil)[0].LastError, "under maintenance: die change")
+	serviceMaintenance.end()
+
+	// Imports survive a restart
+	restored := newScheduleRegistry()
+	require.NoError(t, restored.restore(stateFile))
+	list := restored.list(six, nil)
+	require.Len(t, list, 3)
+	assert.Equal(t, "morning", list[0].Name)
+	assert.Nil(t, list[1].LastRun, "runs are not saved")
+
+	require.NoError(t, client.ClearSchedules(ctx))
+	schedules, err = client.Schedules(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, schedules)
+	assert.Equal(t, "No write schedules", formatSchedules(schedules))
+	data, err := os.ReadFile(stateFile)
+	require.NoError(t, err)
+	assert.JSONEq(t, "[]", string(data))
+}
+
+// TestScheduleWrite tests that scheduled writes go through the node write
+// handler
+func TestScheduleWrite(t *testing.T) {
+	clientMutex.Lock()
+	saved := opcuaClient
+	opcuaClient = nil
+	clientMutex.Unlock()
+	defer func() {
+		clientMutex.Lock()
+		opcuaClient = saved
+		clientMutex.Unlock()
+	}()
+
+	err := scheduleWrite(context.Background(), WriteSchedule{NodeID: "ns=3;s=A", Value: "1", DataType: "int16", Cron: "@hourly"}, nil)
+	assert.ErrorContains(t, err, "not connected")
+	assert.Empty(t, serviceWrites.snapshot(""))
+}
+
+// TestSchedulePermits tests that schedule changes need a write permit and
+// are refused during maintenance, that tenants only see and change their own
+// schedules, and that schedules are written for the tenant that imported
+// them while it still has write access
+func TestSchedulePermits(t *testing.T) {
+	defer func(m *maintenanceMode) { serviceMaintenance = m }(serviceMaintenance)
+	serviceMaintenance = newMaintenanceMode()
+	defer func(reg *scheduleRegistry) { serviceSchedules = reg }(serviceSchedules)
+	serviceSchedules = newScheduleRegistry()
+	defer func(reg *tenantRegistry) { serviceTenants = reg }(serviceTenants)
+	serviceTenants = &tenantRegistry{tenants: []*tenant{
+		{Name: "acme", Token: "acme-token", Access: "write", source: "file"},
+		{Name: "globex", Token: "globex-token", Access: "write", source: "file"},
+	}}
+	permits, err := newPermitRegistry(time.Hour)
+	require.NoError(t, err)
+	permit, err := permits.issue("file:acme", "shift plan", time.Hour)
+	require.NoError(t, err)
+	handler := serviceTenants.middleware(serviceMaintenance.middleware(permits.middleware(http.HandlerFunc(handleSchedulesRequest))))
+
+	doAs := func(token, method, permit, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/api/schedules", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		if permit != "" {
+			r.Header.Set(permitHeader, permit)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	do := func(method, permit, body string) *httptest.ResponseRecorder {
+		return doAs("acme-token", method, permit, body)
+	}
+	body := `{"schedules": [{"nodeId": "ns=3;s=A", "value": "1", "dataType": "int16", "cron": "@hourly", "tenant": "globex"}]}`
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPut, "", body).Code)
+	assert.Equal(t, http.StatusForbidden, do(http.MethodDelete, "", "").Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "", "").Code, "listing needs no permit")
+	assert.Equal(t, http.StatusOK, do(http.MethodPut, permit.ID, body).Code)
+	schedules := serviceSchedules.list(time.Now(), nil)
+	require.Len(t, schedules, 1)
+	assert.Equal(t, "acme", schedules[0].Tenant, "the importing tenant, not the one in the body")
+
+	_, err = serviceMaintenance.start("die change", "", 0)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusLocked, do(http.MethodDelete, permit.ID, "").Code)
+	serviceMaintenance.end()
+
+	// Another tenant neither sees nor replaces nor removes them
+	serviceTenants.tenants[1].Access = "read"
+	w := doAs("globex-token", http.MethodGet, "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"schedules": []}`, w.Body.String())
+	serviceTenants.tenants[1].Access = "write"
+	globexPermit, err := permits.issue("file:globex", "shift plan", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, doAs("globex-token", http.MethodPut, globexPermit.ID, body).Code)
+	assert.Equal(t, http.StatusOK, doAs("globex-token", http.MethodDelete, globexPermit.ID, "").Code)
+	schedules = serviceSchedules.list(time.Now(), nil)
+	require.Len(t, schedules, 1)
+	assert.Equal(t, "acme", schedules[0].Tenant)
+
+	// The tenant's access is checked again when the schedule fires: in the
+	// tenants file for its tenants, as of the import for the others
+	serviceSchedules.mu.Lock()
+	schedule, owner := serviceSchedules.schedules[0].WriteSchedule, serviceSchedules.schedules[0].tenant
+	serviceSchedules.mu.Unlock()
+	serviceTenants.tenants[0].Access = "read"
+	assert.ErrorContains(t, scheduleWrite(context.Background(), schedule, owner), "tenant acme has read-only access")
+	assert.ErrorContains(t, scheduleWrite(context.Background(), schedule, &tenant{Name: "initech", Access: "write", source: "file"}), "tenant initech is no longer known")
+	assert.ErrorContains(t, scheduleWrite(context.Background(), schedule, &tenant{Name: "hooli", Access: "read", source: "jwt"}), "tenant hooli has read-only access")
+	assert.ErrorContains(t, scheduleWrite(context.Background(), schedule, nil), "imported without a tenant")
+	assert.Empty(t, serviceWrites.snapshot(""))
+
+	// The access of tenants of --api-auth is saved with their schedules
+	stateFile := filepath.Join(t.TempDir(), "schedules.json")
+	require.NoError(t, serviceSchedules.restore(stateFile))
+	_, err = serviceSchedules.replace([]WriteSchedule{{NodeID: "ns=3;s=A", Value: "1", DataType: "int16", Cron: "@hourly"}}, &tenant{Name: "hooli", Access: "write", source: "jwt"})
+	require.NoError(t, err)
+	restored := newScheduleRegistry()
+	require.NoError(t, restored.restore(stateFile))
+	require.Len(t, restored.schedules, 1)
+	assert.Equal(t, &tenant{Name: "hooli", Access: "write", source: "jwt"}, restored.schedules[0].tenant)
+}
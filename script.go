@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"umicli/pkg/plcclient"
+)
+
+// How long wait <node-id> <op> <value> waits without within
+const defaultScriptWait = 10 * time.Second
+
+// Variables of scripts, $NAME or ${NAME}
+var (
+	scriptVariableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	scriptVariable     = regexp.MustCompile(`\$(?:\{([A-Za-z_][A-Za-z0-9_]*)\}|([A-Za-z_][A-Za-z0-9_]*))`)
+)
+
+// Comparisons of assert and wait
+var scriptOperators = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+// scriptFailure is an assert or wait whose comparison does not hold, as
+// opposed to errors of commands or the connection
+type scriptFailure struct {
+	msg string
+}
+
+func (f *scriptFailure) Error() string {
+	return f.msg
+}
+
+// scriptStep is a command line of a script
+type scriptStep struct {
+	line  int
+	words []string
+}
+
+// plcScript is a script of plccli run: the commands of plccli shell plus
+// let, wait, assert and echo, run in order until one fails
+type plcScript struct {
+	name    string // File name, in errors
+	steps   []scriptStep
+	vars    map[string]string
+	session *shellSession
+}
+
+// parseScript reads a script and checks its commands, operators, durations
+// and variables before anything is run, so a typo at the end does not stop
+// a sequence half way. vars are defined before the first line
+func parseScript(name string, r io.Reader, vars map[string]string, session *shellSession) (*plcScript, error) {
+	s := &plcScript{name: name, vars: map[string]string{}, session: session}
+	defined := map[string]bool{}
+	for k, v := range vars {
+		s.vars[k] = v
+		defined[k] = true
+	}
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		words, err := splitShellLine(scanner.Text())
+		if err == nil && (len(words) == 0 || strings.HasPrefix(words[0], "#")) {
+			continue
+		}
+		if err == nil {
+			err = checkScriptStep(words, defined)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, n, err)
+		}
+		s.steps = append(s.steps, scriptStep{line: n, words: words})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read script %s: %v", name, err)
+	}
+	return s, nil
+}
+
+// checkScriptStep checks the words of a command line and adds the variables
+// it defines
+func checkScriptStep(words []string, defined map[string]bool) error {
+	for _, word := range words {
+		for _, m := range scriptVariable.FindAllStringSubmatch(word, -1) {
+			if name := m[1] + m[2]; !defined[name] {
+				return fmt.Errorf("variable %s is not defined", name)
+			}
+		}
+	}
+
+	switch args := words[1:]; words[0] {
+	case "let":
+		if len(args) != 3 || args[1] != "=" || !scriptVariableName.MatchString(args[0]) {
+			return fmt.Errorf("usage: let <name> = <value>")
+		}
+		defined[args[0]] = true
+	case "get":
+		if len(args) == 3 && args[1] == "as" {
+			if !scriptVariableName.MatchString(args[2]) {
+				return fmt.Errorf("invalid variable name %s", args[2])
+			}
+			defined[args[2]] = true
+		}
+	case "wait":
+		if len(args) == 1 {
+			return checkScriptDuration(args[0])
+		}
+		if len(args) == 5 && args[3] == "within" {
+			if err := checkScriptDuration(args[4]); err != nil {
+				return err
+			}
+			args = args[:3]
+		}
+		if len(args) != 3 {
+			return fmt.Errorf("usage: wait <duration> or wait <node-id> <op> <value> [within <duration>]")
+		}
+		return checkScriptOperator(args[1])
+	case "assert":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: assert <node-id> <op> <value>")
+		}
+		return checkScriptOperator(args[1])
+	case "echo", "set", "browse", "use", "format", "interval", "exit", "quit":
+	case "monitor":
+		return fmt.Errorf("monitor runs until ctrl-c, use wait or assert in scripts")
+	default:
+		return fmt.Errorf("unknown command %s", words[0])
+	}
+	return nil
+}
+
+// checkScriptDuration checks a duration of wait, unless it is a variable
+func checkScriptDuration(text string) error {
+	if strings.Contains(text, "$") {
+		return nil
+	}
+	if d, err := time.ParseDuration(text); err != nil || d < 0 {
+		return fmt.Errorf("invalid duration %s", text)
+	}
+	return nil
+}
+
+// checkScriptOperator checks a comparison of assert and wait
+func checkScriptOperator(op string) error {
+	for _, o := range scriptOperators {
+		if op == o {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown comparison %s, use one of %s", op, strings.Join(scriptOperators, " "))
+}
+
+// run runs the steps in order. The first failing step ends the script with
+// its file and line
+func (s *plcScript) run(ctx context.Context) error {
+	for _, step := range s.steps {
+		words := make([]string, len(step.words))
+		for i, word := range step.words {
+			words[i] = scriptVariable.ReplaceAllStringFunc(word, func(v string) string {
+				m := scriptVariable.FindStringSubmatch(v)
+				return s.vars[m[1]+m[2]]
+			})
+		}
+		exit, err := s.step(ctx, words)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s: %w", s.name, step.line, strings.Join(step.words, " "), err)
+		}
+		if exit {
+			return nil
+		}
+	}
+	return nil
+}
+
+// step runs a command line with the variables replaced. It returns true to
+// end the script
+func (s *plcScript) step(ctx context.Context, words []string) (bool, error) {
+	out, args := s.session.out, words[1:]
+	switch words[0] {
+	case "let":
+		s.vars[args[0]] = args[2]
+		return false, nil
+
+	case "echo":
+		fmt.Fprintln(out, strings.Join(args, " "))
+		return false, nil
+
+	case "get":
+		if len(args) != 3 || args[1] != "as" {
+			break
+		}
+		v, err := s.read(ctx, args[0])
+		if err != nil {
+			return false, err
+		}
+		s.vars[args[2]] = fmt.Sprint(v.Value)
+		return false, nil
+
+	case "wait":
+		if len(args) == 1 {
+			d, err := time.ParseDuration(args[0])
+			if err != nil || d < 0 {
+				return false, fmt.Errorf("invalid duration %s", args[0])
+			}
+			select {
+			case <-time.After(d):
+				return false, nil
+			case <-ctx.Done():
+				return false, ctx.Err()
+			}
+		}
+		within := defaultScriptWait
+		if len(args) == 5 {
+			d, err := time.ParseDuration(args[4])
+			if err != nil || d < 0 {
+				return false, fmt.Errorf("invalid duration %s", args[4])
+			}
+			within = d
+		}
+		return false, s.wait(ctx, args[0], args[1], args[2], within)
+
+	case "assert":
+		v, err := s.read(ctx, args[0])
+		if err != nil {
+			return false, err
+		}
+		ok, err := compareScriptValue(v, args[1], args[2])
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return false, &scriptFailure{fmt.Sprintf("failed, the value is %s", scriptValueText(v))}
+		}
+		fmt.Fprintf(out, "ok %s %s %s (%s)\n", args[0], args[1], args[2], scriptValueText(v))
+		return false, nil
+	}
+
+	result, err := s.session.command(words[0], args)
+	if err == errShellExit {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if result != "" {
+		fmt.Fprintln(out, result)
+	}
+	return false, nil
+}
+
+// read reads a node through the service, with the names of enumeration
+// values and bypassing the read cache
+func (s *plcScript) read(ctx context.Context, nodeID string) (plcclient.NodeResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, callTimeout(10*time.Second))
+	defer cancel()
+	results, err := newServiceClient(s.session.host, s.session.port).ReadWith(ctx, plcclient.ReadOptions{DecodeEnums: true, Fresh: true}, nodeID)
+	if err != nil {
+		return plcclient.NodeResponse{}, err
+	}
+	if err := results[0].Err(); err != nil {
+		return results[0], err
+	}
+	return results[0], nil
+}
+
+// wait reads a node every interval of the session until the comparison
+// holds, for at most within
+func (s *plcScript) wait(ctx context.Context, nodeID, op, expected string, within time.Duration) error {
+	start := time.Now()
+	deadline := time.NewTimer(within)
+	defer deadline.Stop()
+	for {
+		v, err := s.read(ctx, nodeID)
+		if err != nil {
+			return err
+		}
+		ok, err := compareScriptValue(v, op, expected)
+		if err != nil {
+			return err
+		}
+		if ok {
+			fmt.Fprintf(s.session.out, "ok %s %s %s after %s (%s)\n", nodeID, op, expected, time.Since(start).Round(time.Millisecond), scriptValueText(v))
+			return nil
+		}
+		select {
+		case <-time.After(s.session.interval):
+		case <-deadline.C:
+			return &scriptFailure{fmt.Sprintf("timed out after %s, the value is %s", within, scriptValueText(v))}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// compareScriptValue compares a value read with the value of a script.
+// Numbers compare as numbers, with a decimal point or comma; other values
+// and enumeration names only compare with == and !=
+func compareScriptValue(v plcclient.NodeResponse, op, expected string) (bool, error) {
+	if actual, ok := v.Value.(float64); ok {
+		if want, err := parseDecimal(expected, 64, *decimalSeparator); err == nil {
+			switch op {
+			case "==":
+				return actual == want, nil
+			case "!=":
+				return actual != want, nil
+			case "<":
+				return actual < want, nil
+			case "<=":
+				return actual <= want, nil
+			case ">":
+				return actual > want, nil
+			case ">=":
+				return actual >= want, nil
+			}
+		}
+	}
+
+	equal := fmt.Sprint(v.Value) == expected || v.EnumName != "" && v.EnumName == expected
+	if b, ok := v.Value.(bool); ok {
+		if want, err := strconv.ParseBool(expected); err == nil {
+			equal = b == want
+		}
+	}
+	switch op {
+	case "==":
+		return equal, nil
+	case "!=":
+		return !equal, nil
+	}
+	return false, fmt.Errorf("%s compares numbers, the value is %s", op, scriptValueText(v))
+}
+
+// scriptValueText is a value read, with the name of an enumeration value
+func scriptValueText(v plcclient.NodeResponse) string {
+	if v.EnumName != "" {
+		return fmt.Sprintf("%v (%s)", v.Value, v.EnumName)
+	}
+	return fmt.Sprint(v.Value)
+}
+
+// runScript runs plccli run: the script at path, - for stdin, with the
+// variables of NAME=value arguments
+func runScript(ctx context.Context, path string, assignments []string, session *shellSession) error {
+	vars, err := scriptVariables(assignments)
+	if err != nil {
+		return err
+	}
+
+	r := io.Reader(os.Stdin)
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open script: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	script, err := parseScript(path, r, vars, session)
+	if err != nil {
+		return err
+	}
+	return script.run(ctx)
+}
+
+// scriptVariables returns the variables of NAME=value arguments
+func scriptVariables(assignments []string) (map[string]string, error) {
+	vars := map[string]string{}
+	for _, a := range assignments {
+		name, value, ok := strings.Cut(a, "=")
+		if !ok || !scriptVariableName.MatchString(name) {
+			return nil, fmt.Errorf("invalid variable %q, use NAME=value", a)
+		}
+		vars[name] = value
+	}
+	return vars, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"umicli/pkg/plcclient"
+)
+
+// TestParseScript tests that scripts are checked before anything runs
+func TestParseScript(t *testing.T) {
+	s, err := parseScript("start.plc", strings.NewReader(strings.Join([]string{
+		"# Start line 1",
+		"let SPEED = 72,5",
+		"",
+		"set ns=3;s=Speed $SPEED",
+		"get ns=3;s=Speed as ACTUAL",
+		`echo "speed ${ACTUAL} of $TARGET"`,
+		"wait 2s",
+		"wait ns=3;s=Mode == Running within 30s",
+		"assert ns=3;s=Speed >= $SPEED",
+	}, "\n")), map[string]string{"TARGET": "80"}, nil)
+	require.NoError(t, err)
+	require.Len(t, s.steps, 7)
+	assert.Equal(t, 4, s.steps[1].line)
+	assert.Equal(t, []string{"echo", "speed ${ACTUAL} of $TARGET"}, s.steps[3].words)
+
+	for script, msg := range map[string]string{
+		"get ns=3;s=A\nfrobnicate":        "x.plc:2: unknown command frobnicate",
+		"set ns=3;s=A $SPEED":             "x.plc:1: variable SPEED is not defined",
+		"assert ns=3;s=A => 1":            "x.plc:1: unknown comparison =>, use one of == != <= >= < >",
+		"wait 2 seconds":                  "x.plc:1: usage: wait <duration> or wait <node-id> <op> <value> [within <duration>]",
+		"wait ns=3;s=A == 1 within a day": "x.plc:1: usage: wait <duration> or wait <node-id> <op> <value> [within <duration>]",
+		"wait ns=3;s=A == 1 within soon":  "x.plc:1: invalid duration soon",
+		"let 1X = 2":                      "x.plc:1: usage: let <name> = <value>",
+		"monitor ns=3;s=A":                "x.plc:1: monitor runs until ctrl-c, use wait or assert in scripts",
+		`echo "open`:                      `x.plc:1: missing closing "`,
+	} {
+		_, err := parseScript("x.plc", strings.NewReader(script), nil, nil)
+		assert.EqualError(t, err, msg, script)
+	}
+}
+
+// TestCompareScriptValue tests the comparisons of assert and wait
+func TestCompareScriptValue(t *testing.T) {
+	for _, tc := range []struct {
+		value    plcclient.NodeResponse
+		op, want string
+		ok       bool
+	}{
+		{plcclient.NodeResponse{Value: 72.5}, ">=", "72,5", true},
+		{plcclient.NodeResponse{Value: 72.5}, "<", "72.5", false},
+		{plcclient.NodeResponse{Value: 72.5}, "!=", "70", true},
+		{plcclient.NodeResponse{Value: 3.0, EnumName: "Running"}, "==", "Running", true},
+		{plcclient.NodeResponse{Value: 3.0, EnumName: "Running"}, "==", "3", true},
+		{plcclient.NodeResponse{Value: 3.0, EnumName: "Running"}, "!=", "Stopped", true},
+		{plcclient.NodeResponse{Value: true}, "==", "1", true},
+		{plcclient.NodeResponse{Value: false}, "==", "true", false},
+		{plcclient.NodeResponse{Value: "press-1"}, "==", "press-1", true},
+	} {
+		ok, err := compareScriptValue(tc.value, tc.op, tc.want)
+		require.NoError(t, err)
+		assert.Equal(t, tc.ok, ok, "%v %s %s", tc.value.Value, tc.op, tc.want)
+	}
+	_, err := compareScriptValue(plcclient.NodeResponse{Value: "press-1"}, ">", "2")
+	assert.EqualError(t, err, "> compares numbers, the value is press-1")
+}
+
+// TestRunScript tests a commissioning sequence against the service of a
+// simulated PLC, and that it stops at the first failing line
+func TestRunScript(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	connectMock(t, ctx)
+	mux := http.NewServeMux()
+	registerHandlers(mux, "opc.tcp://mock", 8765)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "setpoint.plc")
+	require.NoError(t, os.WriteFile(path, []byte(strings.Join([]string{
+		"# Write the setpoint and verify it",
+		"let NODE = nsu=" + mockNamespaceURI + ";s=Setpoint",
+		"interval 20ms",
+		"set $NODE $SETPOINT",
+		"wait 10ms",
+		"wait $NODE == $SETPOINT within 2s",
+		"get $NODE as ACTUAL",
+		"echo setpoint is $ACTUAL",
+		"assert $NODE < 30",
+		"assert $NODE > 30",
+		"echo not reached",
+	}, "\n")), 0644))
+
+	var out bytes.Buffer
+	session := newShellSession(u.Hostname(), port, "default", influxOptions{fieldName: "value", timestamp: "now"}, &out)
+	err = runScript(ctx, path, []string{"SETPOINT=23,5"}, session)
+	setpoint := "nsu=" + mockNamespaceURI + ";s=Setpoint"
+	assert.EqualError(t, err, path+":10: assert $NODE > 30: failed, the value is 23.5")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 5, out.String())
+	assert.Equal(t, "Interval 20ms", lines[0])
+	assert.Contains(t, lines[1], "Successfully set "+setpoint+" to 23,5")
+	assert.True(t, strings.HasPrefix(lines[2], "ok "+setpoint+" == 23,5 after "), lines[2])
+	assert.Equal(t, "setpoint is 23.5", lines[3])
+	assert.Equal(t, "ok "+setpoint+" < 30 (23.5)", lines[4])
+
+	assert.EqualError(t, runScript(ctx, path, []string{"1=2"}, session), `invalid variable "1=2", use NAME=value`)
+	assert.ErrorContains(t, runScript(ctx, path, nil, session), ":4: variable SETPOINT is not defined")
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// credentials are the OPC UA username and password from a secrets store
+type credentials struct {
+	Username string `yaml:"username" json:"username"`
+	Password string `yaml:"password" json:"password"`
+}
+
+// credentialProvider fetches the credentials of the service at startup, so
+// they need not be stored in unit files. username is the one given with
+// --username, "" if none
+type credentialProvider interface {
+	fetch(ctx context.Context, username string) (credentials, error)
+}
+
+// newCredentialProvider returns the provider of a --credentials-source:
+//
+//	file:/etc/plccli/line1.yaml   YAML with username and password, mode 0600
+//	keyring:plccli                OS keyring entry of the service for --username
+//	vault:secret/data/plc/line1   HashiCorp Vault KV secret, $VAULT_ADDR and $VAULT_TOKEN
+func newCredentialProvider(source string) (credentialProvider, error) {
+	kind, arg, _ := strings.Cut(source, ":")
+	switch kind {
+	case "file":
+		if arg == "" {
+			return nil, fmt.Errorf("file: needs a path, e.g. file:/etc/plccli/credentials.yaml")
+		}
+		return fileCredentials{path: arg}, nil
+	case "keyring":
+		if arg == "" {
+			arg = "plccli"
+		}
+		return keyringCredentials{service: arg, goos: runtime.GOOS, run: runCommand}, nil
+	case "vault":
+		if arg == "" {
+			return nil, fmt.Errorf("vault: needs a secret path, e.g. vault:secret/data/plc/line1")
+		}
+		return newVaultCredentials(arg, os.Getenv)
+	}
+	return nil, fmt.Errorf("unknown credentials source %q, use file:<path>, keyring:<service> or vault:<path>", source)
+}
+
+// applyCredentialsSource fills the username and password not given with
+// flags or environment variables from the credentials source
+func applyCredentialsSource(ctx context.Context, source string, username, password *string) error {
+	provider, err := newCredentialProvider(source)
+	if err != nil {
+		return err
+	}
+	creds, err := provider.fetch(ctx, *username)
+	if err != nil {
+		return err
+	}
+	if creds.Password == "" {
+		return fmt.Errorf("%s has no password", source)
+	}
+	if *username == "" {
+		*username = creds.Username
+	}
+	if *password == "" {
+		*password = creds.Password
+	}
+	return nil
+}
+
+// fileCredentials reads a YAML file only its owner may read
+type fileCredentials struct {
+	path string
+}
+
+func (f fileCredentials) fetch(ctx context.Context, username string) (credentials, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return credentials{}, fmt.Errorf("failed to read the credentials file: %v", err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return credentials{}, fmt.Errorf("credentials file %s is readable by others (mode %v), chmod 600 it", f.path, info.Mode().Perm())
+	}
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return credentials{}, fmt.Errorf("failed to read the credentials file: %v", err)
+	}
+	var creds credentials
+	if err := yaml.Unmarshal(data, &creds); err != nil {
+		return credentials{}, fmt.Errorf("invalid credentials file %s: %v", f.path, err)
+	}
+	return creds, nil
+}
+
+// keyringCredentials reads the password of --username from the OS keyring:
+// the Secret Service (secret-tool) on Linux, the login keychain (security)
+// on macOS
+type keyringCredentials struct {
+	service string
+	goos    string
+	run     func(ctx context.Context, name string, args ...string) ([]byte, error)
+}
+
+func (k keyringCredentials) fetch(ctx context.Context, username string) (credentials, error) {
+	if username == "" {
+		return credentials{}, fmt.Errorf("keyring: needs --username, the account of the keyring entry")
+	}
+	var out []byte
+	var err error
+	switch k.goos {
+	case "linux":
+		out, err = k.run(ctx, "secret-tool", "lookup", "service", k.service, "username", username)
+	case "darwin":
+		out, err = k.run(ctx, "security", "find-generic-password", "-s", k.service, "-a", username, "-w")
+	default:
+		return credentials{}, fmt.Errorf("keyring: not supported on %s", k.goos)
+	}
+	if err != nil {
+		return credentials{}, fmt.Errorf("keyring: no password of %s for service %s: %v", username, k.service, err)
+	}
+	return credentials{Username: username, Password: strings.TrimRight(string(out), "\r\n")}, nil
+}
+
+// runCommand runs a command and returns its output, with its error output
+// in the error
+func runCommand(ctx context.Context, name string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil && stderr.Len() > 0 {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out, err
+}
+
+// vaultCredentials reads a secret with username and password from the KV
+// secrets engine (v1 or v2) of HashiCorp Vault with a token
+type vaultCredentials struct {
+	addr      string
+	token     string
+	namespace string
+	path      string
+	client    *http.Client
+}
+
+// newVaultCredentials returns the provider of a Vault secret. The token is
+// $VAULT_TOKEN or the one vault login stored in ~/.vault-token
+func newVaultCredentials(path string, getenv func(string) string) (*vaultCredentials, error) {
+	v := &vaultCredentials{
+		addr:      strings.TrimSuffix(getenv("VAULT_ADDR"), "/"),
+		token:     getenv("VAULT_TOKEN"),
+		namespace: getenv("VAULT_NAMESPACE"),
+		path:      strings.Trim(path, "/"),
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+	if v.addr == "" {
+		return nil, fmt.Errorf("vault: $VAULT_ADDR is not set")
+	}
+	if v.token == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			data, _ := os.ReadFile(filepath.Join(home, ".vault-token"))
+			v.token = strings.TrimSpace(string(data))
+		}
+	}
+	if v.token == "" {
+		return nil, fmt.Errorf("vault: $VAULT_TOKEN is not set")
+	}
+	return v, nil
+}
+
+func (v *vaultCredentials) fetch(ctx context.Context, username string) (credentials, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.addr+"/v1/"+v.path, nil)
+	if err != nil {
+		return credentials{}, fmt.Errorf("vault: %v", err)
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return credentials{}, fmt.Errorf("vault: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		return credentials{}, fmt.Errorf("vault: reading %s failed with status %s", v.path, resp.Status)
+	}
+
+	// KV v2 nests the secret in data.data, v1 has it in data
+	var secret struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return credentials{}, fmt.Errorf("vault: invalid response: %v", err)
+	}
+	var v2 struct {
+		Data *credentials `json:"data"`
+	}
+	var creds credentials
+	if err := json.Unmarshal(secret.Data, &v2); err == nil && v2.Data != nil {
+		creds = *v2.Data
+	} else if err := json.Unmarshal(secret.Data, &creds); err != nil {
+		return credentials{}, fmt.Errorf("vault: invalid secret %s: %v", v.path, err)
+	}
+	return creds, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestFileCredentials tests credentials files and that files others may
+// read are refused
+func TestFileCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "line1.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("username: operator\npassword: s3cret\n"), 0600))
+
+	username, password := "", ""
+	require.NoError(t, applyCredentialsSource(context.Background(), "file:"+path, &username, &password))
+	assert.Equal(t, "operator", username)
+	assert.Equal(t, "s3cret", password)
+
+	username, password = "admin", "from-flag"
+	require.NoError(t, applyCredentialsSource(context.Background(), "file:"+path, &username, &password))
+	assert.Equal(t, "admin", username, "flags take precedence")
+	assert.Equal(t, "from-flag", password)
+
+	require.NoError(t, os.Chmod(path, 0644))
+	_, err := fileCredentials{path: path}.fetch(context.Background(), "")
+	assert.ErrorContains(t, err, "chmod 600")
+
+	for _, bad := range []string{"file:", "vault:", "ldap:x", "secret"} {
+		_, err := newCredentialProvider(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+// TestKeyringCredentials tests the keyring commands of Linux and macOS
+func TestKeyringCredentials(t *testing.T) {
+	var command string
+	run := func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		command = name + " " + strings.Join(args, " ")
+		return []byte("s3cret\n"), nil
+	}
+	k := keyringCredentials{service: "plccli", goos: "linux", run: run}
+	creds, err := k.fetch(context.Background(), "operator")
+	require.NoError(t, err)
+	assert.Equal(t, credentials{Username: "operator", Password: "s3cret"}, creds)
+	assert.Equal(t, "secret-tool lookup service plccli username operator", command)
+
+	k.goos = "darwin"
+	_, err = k.fetch(context.Background(), "operator")
+	require.NoError(t, err)
+	assert.Equal(t, "security find-generic-password -s plccli -a operator -w", command)
+
+	_, err = k.fetch(context.Background(), "")
+	assert.ErrorContains(t, err, "--username")
+	k.goos = "plan9"
+	_, err = k.fetch(context.Background(), "operator")
+	assert.Error(t, err)
+}
+
+// TestVaultCredentials tests reading KV v1 and v2 secrets with a token
+func TestVaultCredentials(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "hvs.test" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/plc/line1":
+			fmt.Fprint(w, `{"data": {"data": {"username": "operator", "password": "s3cret"}, "metadata": {"version": 3}}}`)
+		case "/v1/kv/plc/line2":
+			fmt.Fprint(w, `{"data": {"username": "service", "password": "hunter2"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	env := map[string]string{"VAULT_ADDR": server.URL + "/", "VAULT_TOKEN": "hvs.test"}
+	v, err := newVaultCredentials("secret/data/plc/line1", func(key string) string { return env[key] })
+	require.NoError(t, err)
+	creds, err := v.fetch(context.Background(), "")
+	require.NoError(t, err)
+	assert.Equal(t, credentials{Username: "operator", Password: "s3cret"}, creds)
+
+	v.path = "kv/plc/line2"
+	creds, err = v.fetch(context.Background(), "")
+	require.NoError(t, err)
+	assert.Equal(t, credentials{Username: "service", Password: "hunter2"}, creds)
+
+	v.path = "secret/data/plc/missing"
+	_, err = v.fetch(context.Background(), "")
+	assert.ErrorContains(t, err, "404")
+
+	_, err = newVaultCredentials("secret/data/plc/line1", func(string) string { return "" })
+	assert.ErrorContains(t, err, "VAULT_ADDR")
+}
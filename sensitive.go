@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/gopcua/opcua/ua"
+	"gopkg.in/yaml.v3"
+)
+
+// Shown instead of a value that must not be logged
+const redactedValue = "(redacted)"
+
+// sensitiveNodes are the nodes whose values the service keeps out of its
+// logs and the access log, from --sensitive-nodes, e.g. recipe parameters
+// that are trade secrets. Reads and writes through the API are unaffected
+type sensitiveNodes []nodeRule
+
+// Sensitive nodes of this service, nil when all values may be logged
+var serviceSensitive sensitiveNodes
+
+// loadSensitiveNodes reads a --sensitive-nodes file:
+//
+//	sensitive:
+//	  - ns=3;s=Recipe.*
+//	  - nsu=urn:plc:recipes
+func loadSensitiveNodes(path string) (sensitiveNodes, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sensitive nodes file %s: %v", path, err)
+	}
+	var file struct {
+		Sensitive []string `yaml:"sensitive"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid sensitive nodes file %s: %v", path, err)
+	}
+	if len(file.Sensitive) == 0 {
+		return nil, fmt.Errorf("invalid sensitive nodes file %s: no sensitive rules", path)
+	}
+
+	var nodes sensitiveNodes
+	for _, text := range file.Sensitive {
+		rule, err := parseNodeRule(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sensitive nodes file %s: %v", path, err)
+		}
+		nodes = append(nodes, rule)
+	}
+	return nodes, nil
+}
+
+// matches reports whether a resolved node ID is sensitive
+func (nodes sensitiveNodes) matches(id *ua.NodeID) bool {
+	for _, rule := range nodes {
+		if rule.matches(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesString reports whether the node of a node ID of the API, or the
+// reference of a backend connection, is sensitive. A node ID that does not
+// resolve counts as sensitive while there are rules, as it might name a
+// sensitive node once the server knows it
+func (nodes sensitiveNodes) matchesString(nodeID string) bool {
+	if len(nodes) == 0 {
+		return false
+	}
+	if serviceBackend != nil {
+		for _, rule := range nodes {
+			if rule.matchesRef(nodeID) {
+				return true
+			}
+		}
+		return false
+	}
+	id, err := resolveNodeID(nodeID)
+	if err != nil {
+		return true
+	}
+	return nodes.matches(id)
+}
+
+// loggedValue returns a value of a node for the service log
+func (nodes sensitiveNodes) loggedValue(id *ua.NodeID, value interface{}) interface{} {
+	if nodes.matches(id) {
+		return redactedValue
+	}
+	return value
+}
+
+// loggedValueOf returns a value of a node ID of the API for the service log
+func (nodes sensitiveNodes) loggedValueOf(nodeID string, value interface{}) interface{} {
+	if nodes.matchesString(nodeID) {
+		return redactedValue
+	}
+	return value
+}
+
+// redactSensitive replaces the values of sensitive nodes in a request
+// document for the access log. A node is named by nodeId or by namespace,
+// type and identifier, next to the value it writes
+func (nodes sensitiveNodes) redactSensitive(doc interface{}) interface{} {
+	if len(nodes) == 0 {
+		return doc
+	}
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		nodeID, _ := v["nodeId"].(string)
+		if nodeID == "" {
+			namespace, _ := v["namespace"].(string)
+			idType, _ := v["type"].(string)
+			identifier, _ := v["identifier"].(string)
+			if namespace != "" && identifier != "" {
+				nodeID = requestNodeID(namespace, idType, identifier)
+			}
+		}
+		for key, field := range v {
+			switch {
+			case (key == "value" || key == "values") && nodeID != "" && nodes.matchesString(nodeID):
+				v[key] = redactedValue
+			default:
+				v[key] = nodes.redactSensitive(field)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = nodes.redactSensitive(v[i])
+		}
+	}
+	return doc
+}
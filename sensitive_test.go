@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLoadSensitiveNodes tests reading a sensitive nodes file
+func TestLoadSensitiveNodes(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sensitive.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("sensitive:\n  - ns=3;s=Recipe.*\n  - ns=5\n"), 0644))
+	nodes, err := loadSensitiveNodes(path)
+	require.NoError(t, err)
+	assert.True(t, nodes.matches(ua.NewStringNodeID(3, "Recipe.Ratio")))
+	assert.True(t, nodes.matches(ua.NewNumericNodeID(5, 1001)))
+	assert.False(t, nodes.matches(ua.NewStringNodeID(3, "Line1.Speed")))
+	assert.True(t, nodes.matchesString("ns=3;s=Recipe.Ratio"))
+	assert.True(t, nodes.matchesString("nsu=urn:unknown;s=Recipe.Ratio"), "a node ID that does not resolve might be sensitive")
+	assert.False(t, sensitiveNodes(nil).matchesString("nsu=urn:unknown;s=Recipe.Ratio"))
+	assert.Equal(t, redactedValue, nodes.loggedValueOf("ns=3;s=Recipe.Ratio", "0.42"))
+	assert.Equal(t, "1200", nodes.loggedValueOf("ns=3;s=Line1.Speed", "1200"))
+
+	empty := filepath.Join(dir, "empty.yaml")
+	require.NoError(t, os.WriteFile(empty, []byte("sensitive: []\n"), 0644))
+	_, err = loadSensitiveNodes(empty)
+	assert.ErrorContains(t, err, "no sensitive rules")
+	invalid := filepath.Join(dir, "invalid.yaml")
+	require.NoError(t, os.WriteFile(invalid, []byte("sensitive:\n  - Recipe.*\n"), 0644))
+	_, err = loadSensitiveNodes(invalid)
+	assert.ErrorContains(t, err, "needs a namespace")
+}
+
+// TestSensitiveNodesRedacted tests that values of sensitive nodes stay out
+// of the access log, write limit errors and the service log
+func TestSensitiveNodesRedacted(t *testing.T) {
+	rule, err := parseNodeRule("ns=3;s=Recipe.*")
+	require.NoError(t, err)
+	serviceSensitive = sensitiveNodes{rule}
+	t.Cleanup(func() { serviceSensitive = nil })
+
+	l := &accessLogger{}
+	for _, tc := range []struct {
+		body, logged string
+	}{
+		{`{"namespace":"3","type":"s","identifier":"Recipe.Ratio","value":"0.42","dataType":"float"}`,
+			`{"namespace":"3","type":"s","identifier":"Recipe.Ratio","value":"(redacted)","dataType":"float"}`},
+		{`{"namespace":"3","type":"s","identifier":"Line1.Speed","value":"1200","dataType":"int32"}`,
+			`{"namespace":"3","type":"s","identifier":"Line1.Speed","value":"1200","dataType":"int32"}`},
+		{`{"schedules":[{"nodeId":"ns=3;s=Recipe.Ratio","value":"0.42"},{"nodeId":"ns=3;s=Mode","value":"2"}]}`,
+			`{"schedules":[{"nodeId":"ns=3;s=Recipe.Ratio","value":"(redacted)"},{"nodeId":"ns=3;s=Mode","value":"2"}]}`},
+		{`ns=3;s=Recipe.Ratio 0.42`, `"(redacted)"`},
+	} {
+		assert.JSONEq(t, tc.logged, string(l.logBody([]byte(tc.body))), tc.body)
+	}
+
+	limits := writeLimits{{rule: rule, max: new(float64)}}
+	err = limits.check(ua.NewStringNodeID(3, "Recipe.Ratio"), 0.42, nil)
+	assert.EqualError(t, err, "writing (redacted) to ns=3;s=Recipe.Ratio is not allowed, it is above the maximum 0 of the write limits")
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	reg, err := newApprovalRegistry(time.Minute)
+	require.NoError(t, err)
+	_, err = reg.request(PendingWrite{NodeID: "ns=3;s=Recipe.Ratio", Value: "0.42", DataType: "float", Reason: "trial", RequestedBy: "alice"})
+	require.NoError(t, err)
+	reg.now = func() time.Time { return time.Now().Add(time.Hour) }
+	assert.Empty(t, reg.list())
+	assert.Contains(t, out.String(), "expired unconfirmed: (redacted) to ns=3;s=Recipe.Ratio")
+	assert.NotContains(t, out.String(), "0.42")
+}
@@ -1,1057 +1,1882 @@
 package main
 
 import (
-    "path/filepath"
 	"context"
 	"crypto/rsa"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
+
 	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
 	uatest "github.com/gopcua/opcua/tests/python"
 	"github.com/gopcua/opcua/ua"
 )
 
-var (
-	// Global client for service mode
-	opcuaClient *opcua.Client
-	clientMutex sync.Mutex
-	isVerbose   bool
-	
-	// Store the connection info for diagnostics
-	connectionName string
-	connectionPort int
-)
+var (
+	// Global client for service mode
+	opcuaClient *opcua.Client
+	clientMutex sync.Mutex
+	isVerbose   bool
+
+	// Stops the connection state watcher of opcuaClient and waits for it,
+	// guarded by clientMutex
+	stopStateWatch func()
+
+	// Serializes the read-modify-writes of set-bit
+	bitWriteMutex sync.Mutex
+
+	// Store the connection info for diagnostics
+	connectionName string
+	connectionPort int
+
+	// Upper bound of the random delay before the first connection attempt
+	connectJitter = 300 * time.Second
+)
+
+func startService(endpoint, username, password, certfile, keyfile string,
+	gencert bool, appuri string, timeout, port int, verbose bool,
+	securityPolicy, securityMode, authMethod string,
+	stateNodes []string, stateInterval time.Duration) {
+	isVerbose = verbose
+	connectionPort = port
+
+	// Extract connection name from port if available
+	if port != 8765 {
+		connectionName = fmt.Sprintf("connection-%d", port)
+	} else {
+		connectionName = "default"
+	}
+
+	log.Printf("Starting OPCUA service for connection '%s' on port %d", connectionName, port)
+
+	// Configure context with signal handling for graceful shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Setup signal handling for graceful shutdown
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-sigChan
+		log.Printf("[%s] Received signal %v, shutting down...", connectionName, sig)
+		cancel()
+		// Give time for connections to close gracefully
+		time.Sleep(1 * time.Second)
+		os.Exit(0)
+	}()
+
+	// Connect to OPCUA server with infinite retries
+	serviceEvents.endpoint = endpoint
+	connectionEvents.endpoint = endpoint
+	connectWithRetry(ctx, endpoint, username, password, certfile, keyfile, gencert, appuri, timeout)
+
+	// Continue history exports interrupted by a restart
+	clientMutex.Lock()
+	resumeClient := opcuaClient
+	clientMutex.Unlock()
+	if resumeClient != nil {
+		resumeHistoryExports(resumeClient)
+	}
+
+	// Restart the poll groups saved through the API
+	restoreServicePolls()
+	restoreServiceGroups()
+
+	// Run the recurring writes saved by plccli schedules import
+	startServiceSchedules(ctx)
+
+	// Sample the nodes of the poll file
+	if servicePollFile != nil {
+		servicePollFile.start(ctx, endpoint)
+	}
+
+	// Track state durations of enumerated state nodes
+	if len(stateNodes) > 0 {
+		go trackStates(ctx, stateNodes, stateInterval)
+	}
+
+	// Evaluate the rules of --rules on a subscription to their nodes
+	if serviceRules != nil {
+		go serviceRules.run(ctx)
+	}
+
+	// Set up HTTP server for API
+	mux := http.NewServeMux()
+	registerHandlers(mux, endpoint, port)
+
+	// Start the server
+	serverAddr := fmt.Sprintf("0.0.0.0:%d", port)
+	server := &http.Server{
+		Addr:    serverAddr,
+		Handler: serviceCORS.middleware(withBasePath(serviceBasePath, serviceAccessLog.middleware(serviceTenants.middleware(serviceUsage.middleware(serviceMaintenance.middleware(servicePermits.middleware(serviceRateLimiter.middleware(mux)))))))),
+	}
+
+	log.Printf("[%s] OPCUA service running on %s://%s%s", connectionName, apiScheme(), serverAddr, serviceBasePath)
+	log.Printf("[%s] Example usage: curl %s://%s%s/api/node?namespace=0&type=i&identifier=2258", connectionName, apiScheme(), serverAddr, serviceBasePath)
+
+	// Start HTTP server in a goroutine
+	go func() {
+		if err := listenAndServeAPI(ctx, server); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("[%s] HTTP server error: %v", connectionName, err)
+		}
+	}()
+
+	// Check the session every keep-alive interval, reconnect when it is dead
+	keepalive := newKeepAlive(keepAliveInterval, keepAliveNode)
+	defer keepalive.stop()
+	var keepaliveTicks <-chan time.Time
+	if keepAliveInterval > 0 {
+		ticker := time.NewTicker(keepAliveInterval)
+		defer ticker.Stop()
+		keepaliveTicks = ticker.C
+	}
+
+	for {
+		select {
+		case <-keepaliveTicks:
+			clientMutex.Lock()
+			client := opcuaClient
+			clientMutex.Unlock()
+
+			if client == nil {
+				log.Printf("[%s] Client is nil, attempting reconnection", connectionName)
+				serviceEvents.publish(serviceEvent{Type: eventDisconnect, Error: "no session"})
+				reconnectOPCUA(ctx, endpoint, username, password, certfile, keyfile, gencert, appuri, timeout)
+				continue
+			}
+
+			if err := keepalive.check(ctx, client); err != nil {
+				log.Printf("[%s] Keep-alive failed: %v", connectionName, err)
+				serviceEvents.publish(serviceEvent{Type: eventDisconnect, Error: fmt.Sprintf("keep-alive failed: %v", err)})
+				reconnectOPCUA(ctx, endpoint, username, password, certfile, keyfile, gencert, appuri, timeout)
+			} else if isVerbose {
+				log.Printf("[%s] Keep-alive successful", connectionName)
+			}
+
+		case err := <-sessionReconnects:
+			log.Printf("[%s] Write found the session invalid (%v), reconnecting", connectionName, err)
+			serviceEvents.publish(serviceEvent{Type: eventDisconnect, Error: fmt.Sprintf("write rejected: %v", err)})
+			reconnectOPCUA(ctx, endpoint, username, password, certfile, keyfile, gencert, appuri, timeout)
+
+		case <-serviceFaults.reconnects():
+			log.Printf("[%s] Fault injection: forcing a reconnect", connectionName)
+			serviceEvents.publish(serviceEvent{Type: eventDisconnect, Error: "forced by fault injection"})
+			reconnectOPCUA(ctx, endpoint, username, password, certfile, keyfile, gencert, appuri, timeout)
+
+		case <-ctx.Done():
+			// Shutdown gracefully
+			log.Printf("[%s] Shutting down service...", connectionName)
+
+			// Close OPCUA connection
+			clientMutex.Lock()
+			closeClient(context.Background())
+			clientMutex.Unlock()
+
+			// Shutdown HTTP server
+			shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer shutdownCancel()
+
+			if err := server.Shutdown(shutdownCtx); err != nil {
+				log.Printf("[%s] HTTP server shutdown error: %v", connectionName, err)
+			}
+
+			return
+		}
+	}
+}
+
+// registerHandlers registers the HTTP API endpoints on a mux
+func registerHandlers(mux *http.ServeMux, endpoint string, port int) {
+	mux.HandleFunc("/api/browse", func(w http.ResponseWriter, r *http.Request) {
+		handleBrowseRequest(w, r)
+	})
+
+	mux.HandleFunc("/api/node", func(w http.ResponseWriter, r *http.Request) {
+		// Route based on HTTP method
+		if r.Method == http.MethodGet {
+			handleNodeRequest(w, r) // Existing handler for GET
+		} else if r.Method == http.MethodPost {
+			handleNodeWriteRequest(w, r) // Writes run through the write queue
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// Add new endpoint for batch node operations
+	mux.HandleFunc("/api/nodes", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			handleBatchNodeRequest(w, r)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// Read-modify-write of a single bit in a word
+	mux.HandleFunc("/api/bit", queuedWrite("bit", handleBitWriteRequest))
+
+	// Running and queued writes
+	mux.HandleFunc("/api/writes", handleWritesRequest)
+
+	// Long-running operations; DELETE /api/operations/<id> cancels one
+	mux.HandleFunc("/api/operations", handleOperationsRequest)
+	mux.HandleFunc("/api/operations/", handleOperationsRequest)
+
+	// Asynchronous jobs for big browses and subtree reads
+	mux.HandleFunc("/api/jobs", handleJobsRequest)
+	mux.HandleFunc("/api/jobs/", handleJobsRequest)
+
+	// Poll groups sampled by the service
+	mux.HandleFunc("/api/polls", handlePollsRequest)
+	mux.HandleFunc("/api/polls/", handlePollsRequest)
+
+	// Lines sampled from the poll file
+	mux.HandleFunc("/api/buffer", handleBufferRequest)
+
+	// Requests, reads, writes and errors of each API client
+	mux.HandleFunc("/api/usage", handleUsageRequest)
+
+	// State duration accumulators
+	mux.HandleFunc("/api/states", handleStatesRequest)
+
+	// Named node groups, read by the CLI as @name
+	mux.HandleFunc("/api/groups", handleGroupsRequest)
+	mux.HandleFunc("/api/groups/", handleGroupsRequest)
+
+	// Connection events as server-sent events
+	mux.HandleFunc("/api/events", handleEventsRequest)
+	mux.HandleFunc("/api/events/connection", handleConnectionEventsRequest)
+
+	// Existence, data type and access of nodes, for vetting configurations
+	mux.HandleFunc("/api/validate", handleValidateRequest)
+
+	// Fault injection for resilience tests, only with --debug-faults
+	if serviceFaults != nil {
+		mux.HandleFunc("/api/debug/faults", handleFaultsRequest)
+	}
+
+	// Recent samples of the polled nodes, for short trends
+	mux.HandleFunc("/api/recent", handleRecentRequest)
+
+	// Subscriptions and monitored items against the server's limits
+	mux.HandleFunc("/api/stats", handleStatsRequest)
+
+	// Reads and writes of Modbus points, only for Modbus connections
+	mux.HandleFunc("/api/modbus", handleModbusRequest)
+
+	// Reads and writes of Logix tags, only for EtherNet/IP connections
+	mux.HandleFunc("/api/enip", handleENIPRequest)
+
+	// Reads, writes, browsing and streams of backend devices, only for
+	// connections of a registered backend
+	mux.HandleFunc("/api/points", handlePointsRequest)
+	mux.HandleFunc("/api/points/browse", handlePointsBrowseRequest)
+	mux.HandleFunc("/api/points/stream", handlePointsStreamRequest)
+
+	// Time-limited write permits, see --write-permits
+	mux.HandleFunc("/api/permits", handlePermitsRequest)
+	mux.HandleFunc("/api/permits/", handlePermitsRequest)
+
+	// Writes of critical nodes waiting for a second person, see --write-policy
+	mux.HandleFunc("/api/approvals", handleApprovalsRequest)
+	mux.HandleFunc("/api/approvals/", handleApprovalsRequest)
+
+	// Maintenance window, blocking writes and suppressing alerts
+	mux.HandleFunc("/api/maintenance", handleMaintenanceRequest)
+
+	// Recurring writes, imported from CSV with plccli schedules import
+	mux.HandleFunc("/api/schedules", handleSchedulesRequest)
+
+	// Notes of people on the timeline of the connection
+	mux.HandleFunc("/api/annotations", func(w http.ResponseWriter, r *http.Request) {
+		handleAnnotationsRequest(w, r, endpoint)
+	})
+
+	// OpenAPI document of this API, see apiOperations
+	mux.HandleFunc("/api/openapi.json", handleOpenAPIRequest)
+
+	// Add info endpoint to identify this connection
+	mux.HandleFunc("/api/info", func(w http.ResponseWriter, r *http.Request) {
+		info := map[string]interface{}{
+			"connection": connectionName,
+			"port":       port,
+			"endpoint":   endpoint,
+			"status":     "connected",
+			"limits":     serviceLimits.get(),
+		}
+		// Tenants see their name and the labels to tag their metrics with
+		if t := requestTenant(r); t != nil {
+			info["tenant"] = t.Name
+			info["labels"] = t.Labels
+		}
+		if m := serviceMaintenance.status(); m != nil {
+			info["maintenance"] = m
+		}
+		// Clients key their browse caches by it, see browsecache.go
+		if namespaces := serviceNamespaces.list(); namespaces != nil {
+			info["namespaces"] = namespaces
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	})
+}
+
+func connectOPCUA(ctx context.Context, endpoint, username, password, certfile, keyfile string,
+	gencert bool, appuri string, timeout int) error {
+	log.Printf("[%s] Connecting to OPCUA server at %s...", connectionName, endpoint)
+
+	timeoutDuration := time.Duration(timeout) * time.Second
+
+	// Determine the certificate directory based on user's home directory
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		log.Printf("[%s] Warning: Could not get user home directory: %v. Using current directory.", connectionName, err)
+		homeDir = "."
+	} else {
+		// Create ~/.config/plccli directory if it doesn't exist
+		configDir := filepath.Join(homeDir, ".config")
+		if _, err := os.Stat(configDir); err != nil {
+			if os.IsNotExist(err) {
+				if err := os.Mkdir(configDir, 0755); err != nil {
+					log.Printf("[%s] Warning: Could not create %s directory: %v. Using current directory.", connectionName, configDir, err)
+					homeDir = "."
+				}
+			} else {
+				log.Printf("[%s] Warning: Error checking %s directory: %v. Using current directory.", connectionName, configDir, err)
+				homeDir = "."
+			}
+		}
+
+		plcConfigDir := filepath.Join(configDir, "plccli")
+		if _, err := os.Stat(plcConfigDir); err != nil {
+			if os.IsNotExist(err) {
+				if err := os.Mkdir(plcConfigDir, 0755); err != nil {
+					log.Printf("[%s] Warning: Could not create %s directory: %v. Using current directory.", connectionName, plcConfigDir, err)
+					homeDir = "."
+				} else {
+					homeDir = plcConfigDir
+				}
+			} else {
+				log.Printf("[%s] Warning: Error checking %s directory: %v. Using current directory.", connectionName, plcConfigDir, err)
+				homeDir = "."
+			}
+		} else {
+			homeDir = plcConfigDir
+		}
+	}
+
+	// Update certificate and key file paths to use the home directory
+	if !filepath.IsAbs(certfile) {
+		certfile = filepath.Join(homeDir, filepath.Base(certfile))
+	}
+	if !filepath.IsAbs(keyfile) {
+		keyfile = filepath.Join(homeDir, filepath.Base(keyfile))
+	}
+
+	log.Printf("[%s] Using certificate path: %s", connectionName, certfile)
+	log.Printf("[%s] Using key path: %s", connectionName, keyfile)
+
+	// Get endpoints first to determine if we need certificates
+	log.Printf("[%s] Getting endpoints...", connectionName)
+	endpointCtx, cancel := context.WithTimeout(ctx, timeoutDuration)
+	defer cancel()
+
+	endpoints, err := opcua.GetEndpoints(endpointCtx, endpoint)
+	if err != nil {
+		return fmt.Errorf("failed to get endpoints: %v", err)
+	}
+	log.Printf("[%s] Found %d endpoints", connectionName, len(endpoints))
+
+	// Add detailed endpoint logging
+	log.Printf("[%s] Available endpoints:", connectionName)
+	for i, e := range endpoints {
+		log.Printf("[%s]   [%d] SecurityPolicy=%s, SecurityMode=%s, TokenTypes=%v",
+			connectionName, i,
+			e.SecurityPolicyURI,
+			e.SecurityMode,
+			getTokenTypes(e.UserIdentityTokens))
+	}
+
+	// Determine security policy and mode from available endpoints
+	var serverEndpoint *ua.EndpointDescription
+	var useAnonymous bool
+
+	// First check if server supports anonymous authentication with no security
+	for _, e := range endpoints {
+		if e.SecurityPolicyURI == ua.SecurityPolicyURINone &&
+			e.SecurityMode == ua.MessageSecurityModeNone {
+			// Check if it supports anonymous authentication
+			for _, t := range e.UserIdentityTokens {
+				if t.TokenType == ua.UserTokenTypeAnonymous {
+					serverEndpoint = e
+					useAnonymous = true
+					break
+				}
+			}
+			if serverEndpoint != nil {
+				break
+			}
+		}
+	}
+
+	// If no anonymous endpoint was found, look for username authentication
+	if serverEndpoint == nil && username != "" {
+		// Try to find an endpoint that supports username authentication
+		for _, e := range endpoints {
+			// Prefer Basic256 with SignAndEncrypt if available
+			if e.SecurityPolicyURI == ua.SecurityPolicyURIBasic256 &&
+				e.SecurityMode == ua.MessageSecurityModeSignAndEncrypt {
+				for _, t := range e.UserIdentityTokens {
+					if t.TokenType == ua.UserTokenTypeUserName {
+						serverEndpoint = e
+						break
+					}
+				}
+				if serverEndpoint != nil {
+					break
+				}
+			}
+		}
+
+		// If no preferred endpoint found, try any security policy that supports username
+		if serverEndpoint == nil {
+			for _, e := range endpoints {
+				for _, t := range e.UserIdentityTokens {
+					if t.TokenType == ua.UserTokenTypeUserName {
+						serverEndpoint = e
+						break
+					}
+				}
+				if serverEndpoint != nil {
+					break
+				}
+			}
+		}
+	}
+
+	// If still no endpoint found, try to use anonymous authentication as fallback
+	if serverEndpoint == nil {
+		for _, e := range endpoints {
+			for _, t := range e.UserIdentityTokens {
+				if t.TokenType == ua.UserTokenTypeAnonymous {
+					serverEndpoint = e
+					useAnonymous = true
+					break
+				}
+			}
+			if serverEndpoint != nil {
+				break
+			}
+		}
+	}
+
+	if serverEndpoint == nil {
+		return fmt.Errorf("no compatible endpoint found")
+	}
+
+	log.Printf("[%s] Selected endpoint: %s with %s/%s",
+		connectionName, serverEndpoint.EndpointURL,
+		serverEndpoint.SecurityPolicyURI,
+		serverEndpoint.SecurityMode)
+
+	// Determine if we need certificates
+	needCertificates := serverEndpoint.SecurityPolicyURI != ua.SecurityPolicyURINone &&
+		serverEndpoint.SecurityMode != ua.MessageSecurityModeNone
+
+	// Generate or load certificates if needed
+	var cert []byte
+	var privateKey *rsa.PrivateKey
+
+	if needCertificates {
+		if gencert {
+			log.Printf("[%s] Checking for existing certificate", connectionName)
+			// Skip regenerating cert if it exists
+			if _, err := os.Stat(certfile); os.IsNotExist(err) {
+				log.Printf("[%s] Certificate doesn't exist, generating...", connectionName)
+				certPEM, keyPEM, err := uatest.GenerateCert(appuri, 2048, 24*time.Hour)
+				if err != nil {
+					return fmt.Errorf("failed to generate cert: %v", err)
+				}
+				if err := os.WriteFile(certfile, certPEM, 0644); err != nil {
+					return fmt.Errorf("failed to write %s: %v", certfile, err)
+				}
+				if err := os.WriteFile(keyfile, keyPEM, 0644); err != nil {
+					return fmt.Errorf("failed to write %s: %v", keyfile, err)
+				}
+				log.Printf("[%s] Generated %s and %s", connectionName, certfile, keyfile)
+			} else {
+				log.Printf("[%s] Using existing certificate", connectionName)
+			}
+		}
+
+		// Load certificate
+		log.Printf("[%s] Loading certificate...", connectionName)
+		c, err := tls.LoadX509KeyPair(certfile, keyfile)
+		if err != nil {
+			return fmt.Errorf("failed to load certificate: %v", err)
+		}
+		cert = c.Certificate[0]
+		if pk, ok := c.PrivateKey.(*rsa.PrivateKey); ok {
+			privateKey = pk
+		} else {
+			return fmt.Errorf("invalid private key type")
+		}
+	}
+
+	// Build client options with more aggressive timeouts for reconnection
+	opts := []opcua.Option{
+		opcua.DialTimeout(timeoutDuration),
+		opcua.RequestTimeout(timeoutDuration),
+		opcua.SessionTimeout(timeoutDuration * 2), // Longer session timeout
+		opcua.AutoReconnect(true),
+	}
+
+	// State changes go to /api/events/connection
+	states := make(chan opcua.ConnState, 16)
+	opts = append(opts, opcua.StateChangedCh(states))
+
+	// Add security options
+	if useAnonymous {
+		log.Printf("[%s] Using anonymous authentication", connectionName)
+		opts = append(opts, opcua.SecurityFromEndpoint(serverEndpoint, ua.UserTokenTypeAnonymous))
+	} else {
+		log.Printf("[%s] Using username authentication", connectionName)
+		opts = append(opts,
+			opcua.AuthUsername(username, password),
+			opcua.SecurityFromEndpoint(serverEndpoint, ua.UserTokenTypeUserName))
+	}
+
+	// Add certificate options if needed
+	if needCertificates {
+		opts = append(opts,
+			opcua.Certificate(cert),
+			opcua.PrivateKey(privateKey))
+	}
+
+	// Create client
+	log.Printf("[%s] Creating client...", connectionName)
+	client, err := opcua.NewClient(endpoint, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to create client: %v", err)
+	}
+	stopStates, watched := make(chan struct{}), make(chan struct{})
+	go func(s *connStates) {
+		defer close(watched)
+		s.watch(client, states, stopStates)
+	}(serviceConnStates)
+
+	// Connect
+	log.Printf("[%s] Connecting to server...", connectionName)
+	connectCtx, cancel := context.WithTimeout(ctx, timeoutDuration)
+	defer cancel()
+
+	if err := client.Connect(connectCtx); err != nil {
+		close(stopStates)
+		<-watched
+		return fmt.Errorf("failed to connect: %v", err)
+	}
+
+	log.Printf("[%s] Successfully connected to OPCUA server", connectionName)
+
+	// Namespace URIs in node IDs resolve against the array of this session
+	serviceNamespaces.set(client.Namespaces())
+
+	// Batches are split to the server's limits instead of being rejected
+	serviceLimits.set(readOperationLimits(connectCtx, client))
+
+	// Store client globally
+	clientMutex.Lock()
+	opcuaClient = client
+	stopStateWatch = func() {
+		close(stopStates)
+		<-watched
+	}
+	clientMutex.Unlock()
+
+	return nil
+}
+
+// connectWithRetry attempts to connect with infinite retries and exponential backoff with jitter
+func connectWithRetry(ctx context.Context, endpoint, username, password, certfile, keyfile string,
+	gencert bool, appuri string, timeout int) {
+	// Seed random number generator with current time
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	// Add initial random jitter (0-300 seconds = 5 minutes by default) to desynchronize containers that start simultaneously
+	// With ~19 containers and connection attempts taking up to 5 minutes, this spreads the load significantly
+	var initialJitter time.Duration
+	if seconds := int(connectJitter / time.Second); seconds > 0 {
+		initialJitter = time.Duration(rnd.Intn(seconds)) * time.Second
+	}
+	log.Printf("[%s] Adding initial jitter of %v to desynchronize startup", connectionName, initialJitter)
+
+	select {
+	case <-time.After(initialJitter):
+		// Continue to connection attempts
+	case <-ctx.Done():
+		log.Printf("[%s] Context cancelled during initial jitter", connectionName)
+		return
+	}
+
+	attempt := 0
+	for {
+		// Check if context is cancelled
+		if ctx.Err() != nil {
+			log.Printf("[%s] Context cancelled, stopping connection attempts", connectionName)
+			return
+		}
+
+		attempt++
+		log.Printf("[%s] Initial connection attempt %d...", connectionName, attempt)
+
+		// Create a fresh context for each attempt
+		connectTimeout := time.Duration(timeout) * time.Second
+		connectCtx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+
+		err := connectOPCUA(connectCtx, endpoint, username, password, certfile, keyfile, gencert, appuri, timeout)
+		cancel()
+
+		if err == nil {
+			log.Printf("[%s] Successfully connected on attempt %d", connectionName, attempt)
+			serviceEvents.publish(serviceEvent{Type: eventConnect, Attempts: attempt})
+			return
+		}
+
+		log.Printf("[%s] Connection attempt %d failed: %v", connectionName, attempt, err)
+
+		// Calculate exponential backoff, capped at 180 seconds (3 minutes)
+		// Given that connection attempts can take up to 5 minutes, we want reasonable spacing
+		backoffExponent := attempt - 1
+		if backoffExponent > 7 {
+			backoffExponent = 7 // Cap at 2^7 = 128 seconds
+		}
+		baseBackoff := time.Duration(1<<uint(backoffExponent)) * time.Second
+		if baseBackoff > 180*time.Second {
+			baseBackoff = 180 * time.Second
+		}
+
+		// Add random jitter (±50%) to prevent synchronized retry storms
+		jitterPercent := 0.5 + rnd.Float64() // Random value between 0.5 and 1.5 (±50% around 1.0)
+		backoffTime := time.Duration(float64(baseBackoff) * jitterPercent)
+
+		log.Printf("[%s] Waiting %v (base: %v + jitter) before retry attempt %d...",
+			connectionName, backoffTime, baseBackoff, attempt+1)
+
+		// Sleep with context awareness
+		select {
+		case <-time.After(backoffTime):
+			// Continue to next attempt
+		case <-ctx.Done():
+			log.Printf("[%s] Context cancelled during backoff, stopping connection attempts", connectionName)
+			return
+		}
+	}
+}
+
+func reconnectOPCUA(ctx context.Context, endpoint, username, password, certfile, keyfile string,
+	gencert bool, appuri string, timeout int) {
+	log.Printf("[%s] Attempting to reconnect...", connectionName)
+
+	// At the start of reconnectOPCUA
+	if ctx.Err() != nil {
+		log.Printf("[%s] Context already cancelled, skipping reconnection", connectionName)
+		return
+	}
+
+	// Force close existing connection if any
+	clientMutex.Lock()
+	if opcuaClient != nil {
+		log.Printf("[%s] Closing existing connection...", connectionName)
+		// Ensure the connection is fully closed, ignore errors
+		closeClient(ctx)
+	}
+	clientMutex.Unlock()
+	// Namespace indexes of the new session may differ
+	serviceCache.clear()
+
+	// Add a small delay to ensure server-side cleanup
+	time.Sleep(2 * time.Second)
+
+	// Seed random number generator for jitter
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	// Infinite retry loop with exponential backoff and jitter
+	attempt := 0
+	for {
+		if ctx.Err() != nil {
+			log.Printf("[%s] Context cancelled, stopping reconnection attempts", connectionName)
+			return
+		}
+
+		attempt++
+		log.Printf("[%s] Reconnection attempt %d...", connectionName, attempt)
+
+		// Create a fresh context for each attempt
+		reconnectTimeout := time.Duration(timeout) * time.Second
+		reconnectCtx, cancel := context.WithTimeout(context.Background(), reconnectTimeout)
+
+		// Complete new connection attempt
+		err := connectOPCUA(reconnectCtx, endpoint, username, password, certfile, keyfile, gencert, appuri, timeout)
+		cancel()
+
+		if err == nil {
+			log.Printf("[%s] Reconnection successful on attempt %d", connectionName, attempt)
+			serviceEvents.publish(serviceEvent{Type: eventReconnect, Attempts: attempt})
+			return
+		}
+
+		log.Printf("[%s] Reconnection attempt %d failed: %v", connectionName, attempt, err)
+
+		// Calculate exponential backoff with jitter, capped at 180 seconds
+		backoffExponent := attempt - 1
+		if backoffExponent > 7 {
+			backoffExponent = 7 // Cap at 2^7 = 128 seconds
+		}
+		baseBackoff := time.Duration(1<<uint(backoffExponent)) * time.Second
+		if baseBackoff > 180*time.Second {
+			baseBackoff = 180 * time.Second
+		}
+
+		// Add random jitter (±50%)
+		jitterPercent := 0.5 + rnd.Float64()
+		backoffTime := time.Duration(float64(baseBackoff) * jitterPercent)
+
+		log.Printf("[%s] Waiting %v (base: %v + jitter) before reconnection attempt %d...",
+			connectionName, backoffTime, baseBackoff, attempt+1)
+
+		// Sleep with context awareness
+		select {
+		case <-time.After(backoffTime):
+			// Continue to next attempt
+		case <-ctx.Done():
+			log.Printf("[%s] Context cancelled during reconnection backoff", connectionName)
+			return
+		}
+	}
+}
+
+func handleNodeRequest(w http.ResponseWriter, r *http.Request) {
+	// Get node ID components separately
+	namespace := r.URL.Query().Get("namespace")
+	idType := r.URL.Query().Get("type")
+	identifier := r.URL.Query().Get("identifier")
+	decodeEnums, _ := strconv.ParseBool(r.URL.Query().Get("decodeEnums"))
+	withMetadata, _ := strconv.ParseBool(r.URL.Query().Get("withMetadata"))
+
+	if namespace == "" || idType == "" || identifier == "" {
+		http.Error(w, "Missing required parameters: namespace, type, and identifier", http.StatusBadRequest)
+		return
+	}
+
+	// Echo the node ID as the caller wrote it on every response
+	requested := r.URL.Query().Get("nodeID")
+	if requested == "" {
+		requested = requestNodeID(namespace, idType, identifier)
+	}
+	respond := func(response NodeResponse) {
+		response.RequestedNodeID = requested
+		sendJSONResponse(w, response)
+	}
+
+	// Try both semicolon and comma formats to build the node ID
+	var id *ua.NodeID
+	var err error
+	var nodeIDStr string
+
+	// First try with semicolon (standard format)
+	nodeIDStr = requestNodeID(namespace, idType, identifier)
+	if isVerbose {
+		log.Printf("[%s] Trying to parse node ID: %s", connectionName, nodeIDStr)
+	}
+
+	id, err = resolveNodeID(nodeIDStr)
+	if err != nil && strings.HasPrefix(nodeIDStr, "nsu=") {
+		respond(NodeResponse{
+			NodeID:     nodeIDStr,
+			Error:      fmt.Sprintf("Invalid node ID: %v", err),
+			StatusCode: uint32(ua.StatusBadNodeIDInvalid),
+		})
+		return
+	}
+	if err != nil {
+		// If semicolon format fails, try comma format
+		nodeIDStr = fmt.Sprintf("ns=%s,%s=%s", namespace, idType, identifier)
+		if isVerbose {
+			log.Printf("[%s] Semicolon format failed, trying comma format: %s", connectionName, nodeIDStr)
+		}
+
+		id, err = ua.ParseNodeID(nodeIDStr)
+		if err != nil {
+			respond(NodeResponse{
+				NodeID:     nodeIDStr,
+				Error:      fmt.Sprintf("Invalid node ID, tried both semicolon and comma formats: %v", err),
+				StatusCode: uint32(ua.StatusBadNodeIDInvalid),
+			})
+			return
+		}
+	}
+
+	clientMutex.Lock()
+	client := opcuaClient
+	clientMutex.Unlock()
+
+	if client == nil {
+		http.Error(w, "OPCUA client not connected", http.StatusServiceUnavailable)
+		return
+	}
+
+	timeout, err := requestTimeout(r, "", defaultReadTimeout)
+	if err != nil {
+		respond(NodeResponse{NodeID: nodeIDStr, Error: err.Error()})
+		return
+	}
+
+	// Read the node value
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if isVerbose {
+		log.Printf("[%s] Reading node: %v", connectionName, id)
+	}
+
+	dataValue, err := readCachedDataValue(ctx, client, id, freshRead(r, false))
+
+	if err != nil {
+		// Check if this might be a DTL node (error indicates ExtensionObject decode failure)
+		if strings.Contains(err.Error(), "extension object") || strings.Contains(err.Error(), "data type id") {
+			// Try reading as DTL
+			dtlValue, dtlErr := readDTLFields(ctx, client, id)
+			if dtlErr == nil {
+				respond(NodeResponse{
+					NodeID: nodeIDStr,
+					Value:  dtlValue,
+				})
+				return
+			}
+		}
+
+		respond(NodeResponse{
+			NodeID:     nodeIDStr,
+			Error:      fmt.Sprintf("Failed to read node: %v", err),
+			StatusCode: errorStatus(err),
+		})
+		return
+	}
+
+	// Return the value with its timestamps
+	response := NodeResponse{
+		NodeID: nodeIDStr,
+		Value:  decodeStructures(ctx, client, id, dataValue.Value.Value()),
+	}
+	setResponseTimestamps(&response, dataValue)
+	if decodeEnums {
+		setResponseEnumName(ctx, client, id, &response)
+	}
+	if withMetadata {
+		setResponseMetadata(ctx, client, id, &response)
+	}
+	respond(response)
+}
+
+func handleBatchNodeRequest(w http.ResponseWriter, r *http.Request) {
+	// Parse the request body
+	var batchRequest struct {
+		Nodes        []map[string]string `json:"nodes"`
+		DecodeEnums  bool                `json:"decodeEnums,omitempty"`  // Add symbolic names of enumeration values
+		WithMetadata bool                `json:"withMetadata,omitempty"` // Add units and ranges of analog items
+		Timeout      string              `json:"timeout,omitempty"`      // Instead of defaultReadTimeout, e.g. 30s
+		Fresh        bool                `json:"fresh,omitempty"`        // Bypass the read cache
+		Synchronized bool                `json:"synchronized,omitempty"` // One read request, one timestamp
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&batchRequest)
+	if err != nil {
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"error": fmt.Sprintf("Failed to parse request: %v", err),
+		})
+		return
+	}
+
+	// Validate request
+	if len(batchRequest.Nodes) == 0 {
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"error": "No nodes specified in request",
+		})
+		return
+	}
+
+	clientMutex.Lock()
+	client := opcuaClient
+	clientMutex.Unlock()
+
+	if client == nil {
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"error": "OPCUA client not connected",
+		})
+		return
+	}
+
+	timeout, err := requestTimeout(r, batchRequest.Timeout, defaultReadTimeout)
+	if err != nil {
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Resolve all node IDs first, invalid ones are answered right away
+	results := make([]NodeResponse, len(batchRequest.Nodes))
+	var ids []*ua.NodeID
+	var positions []int
+	for i, nodeParams := range batchRequest.Nodes {
+		namespace := nodeParams["namespace"]
+		idType := nodeParams["type"]
+		identifier := nodeParams["identifier"]
+
+		// Echo the node ID as the caller wrote it, by default as built from its parts
+		results[i].RequestedNodeID = nodeParams["nodeID"]
+
+		// Validate parameters
+		if namespace == "" || idType == "" || identifier == "" {
+			results[i].NodeID = fmt.Sprintf("ns=%s;%s=%s", namespace, idType, identifier)
+			results[i].Error = "Missing required node parameters"
+			continue
+		}
+
+		// Create the node ID
+		nodeIDStr := requestNodeID(namespace, idType, identifier)
+		results[i].NodeID = nodeIDStr
+		if results[i].RequestedNodeID == "" {
+			results[i].RequestedNodeID = nodeIDStr
+		}
+		id, err := resolveNodeID(nodeIDStr)
+		if err != nil {
+			results[i].Error = fmt.Sprintf("Invalid node ID: %v", err)
+			results[i].StatusCode = uint32(ua.StatusBadNodeIDInvalid)
+			continue
+		}
+		ids = append(ids, id)
+		positions = append(positions, i)
+	}
+
+	// Read all valid nodes in as few requests as the server allows, cached
+	// values are served from memory. Synchronized reads take a single request
+	// and stamp the values with its time
+	var dataValues []*ua.DataValue
+	var sampled time.Time
+	if batchRequest.Synchronized {
+		dataValues, sampled, err = readSynchronizedDataValues(ctx, client, ids)
+	} else {
+		dataValues, err = readCachedDataValues(ctx, client, ids, freshRead(r, batchRequest.Fresh))
+	}
+	for j, id := range ids {
+		response := &results[positions[j]]
+		if err != nil {
+			response.Error = fmt.Sprintf("Failed to read node: %v", err)
+			response.StatusCode = errorStatus(err)
+			continue
+		}
+		dataValue := dataValues[j]
+		if dataValue.Status != ua.StatusOK {
+			response.Error = fmt.Sprintf("Failed to read node: %v", dataValue.Status)
+			response.StatusCode = uint32(dataValue.Status)
+			continue
+		}
+		if dataValue.Value != nil {
+			response.Value = decodeStructures(ctx, client, id, dataValue.Value.Value())
+		}
+		setResponseTimestamps(response, dataValue)
+		if batchRequest.Synchronized {
+			stampResults(results[positions[j]:positions[j]+1], sampled)
+		}
+		if batchRequest.DecodeEnums {
+			setResponseEnumName(ctx, client, id, response)
+		}
+		if batchRequest.WithMetadata {
+			setResponseMetadata(ctx, client, id, response)
+		}
+	}
+
+	// Send the combined response
+	sendJSONResponseGeneric(w, map[string]interface{}{
+		"results": results,
+	})
+}
+
+// handleNodeWriteRequest writes the value or another attribute of a node
+// (POST /api/node), see performWrite. The ID of the write in the write queue
+// is returned in the X-Operation-ID header
+func handleNodeWriteRequest(w http.ResponseWriter, r *http.Request) {
+	// Only accept POST requests for writes
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed, use POST for write operations", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Parse the request body
+	var writeRequest nodeWrite
+	err := json.NewDecoder(r.Body).Decode(&writeRequest)
+	if err != nil {
+		sendJSONResponse(w, NodeResponse{
+			Error: fmt.Sprintf("Failed to parse request: %v", err),
+		})
+		return
+	}
+	if writeRequest.Timeout == "" {
+		writeRequest.Timeout = r.URL.Query().Get("timeout")
+	}
+
+	caller := requestCaller(r)
+	caller.queued = func(id string) {
+		w.Header().Set(operationIDHeader, id)
+	}
+	resp, _ := performWrite(r.Context(), caller, writeRequest)
+	sendJSONResponse(w, resp)
+}
+
+// nodeWrite is a write of POST /api/node. Confirmed approvals and write
+// schedules are written the same way
+type nodeWrite struct {
+	Namespace  string `json:"namespace"`
+	Type       string `json:"type"`
+	Identifier string `json:"identifier"`
+	Value      string `json:"value"`               // Always as string, we'll convert
+	DataType   string `json:"dataType"`            // REQUIRED
+	Attribute  string `json:"attribute,omitempty"` // Defaults to Value
+	Timeout    string `json:"timeout,omitempty"`   // Instead of defaultReadTimeout, e.g. 30s
+	Priority   string `json:"priority,omitempty"`  // In the write queue, high when empty
+	DryRun     bool   `json:"dryRun,omitempty"`    // Convert the value but do not write it
+}
+
+// writeCaller is who a write is made for
+type writeCaller struct {
+	tenant *tenant         // nil without tenants
+	by     string          // Names the caller in the log, see permitHolder
+	queued func(id string) // Gets the ID of the write in the write queue, may be nil
+}
+
+// owner returns the identity of the caller's tenant, "" without tenants
+func (c writeCaller) owner() string {
+	if c.tenant == nil {
+		return ""
+	}
+	return c.tenant.identity()
+}
+
+// requestCaller returns the caller of a write request
+func requestCaller(r *http.Request) writeCaller {
+	return writeCaller{tenant: requestTenant(r), by: permitHolder(r)}
+}
+
+// writeFailed returns the response of a failed write with its error
+func writeFailed(resp NodeResponse) (NodeResponse, error) {
+	return resp, errors.New(resp.Error)
+}
+
+// performWrite converts and writes a value through the write queue, the
+// write policy, the approvals of critical nodes and the write limits. ctx
+// carries the confirmed approval of a write, see approvedContextKey. The
+// response is also returned on errors, with the error and status code
+func performWrite(ctx context.Context, caller writeCaller, req nodeWrite) (NodeResponse, error) {
+	// Dry runs write nothing, they need not wait for other writes
+	if req.DryRun {
+		return writeNode(ctx, caller, req)
+	}
+	priority, err := parseWritePriority(req.Priority)
+	if err != nil {
+		return writeFailed(NodeResponse{Error: err.Error()})
+	}
+
+	nodeID := fmt.Sprintf("ns=%s;%s=%s", req.Namespace, req.Type, req.Identifier)
+	var resp NodeResponse
+	var writeErr error
+	err = serviceWrites.do(nodeID, "write", priority, caller.owner(), caller.queued, func() {
+		resp, writeErr = writeNode(ctx, caller, req)
+	})
+	if err != nil {
+		return writeFailed(NodeResponse{NodeID: nodeID, Error: err.Error()})
+	}
+	return resp, writeErr
+}
+
+// writeNode is performWrite once it is the write's turn in the queue
+func writeNode(ctx context.Context, caller writeCaller, writeRequest nodeWrite) (NodeResponse, error) {
+	// Validate required fields
+	if writeRequest.Namespace == "" || writeRequest.Type == "" || writeRequest.Identifier == "" {
+		return writeFailed(NodeResponse{
+			Error: "Missing required fields: namespace, type, and identifier are required",
+		})
+	}
+
+	if writeRequest.DataType == "" {
+		writeRequest.DataType = defaultAttributeDataType(writeRequest.Attribute)
+	}
+	if writeRequest.DataType == "" {
+		return writeFailed(NodeResponse{
+			Error: "Data type is required for writing values",
+		})
+	}
+
+	// Resolve the attribute to write (Value unless specified)
+	attributeID, err := parseAttributeID(writeRequest.Attribute)
+	if err != nil {
+		return writeFailed(NodeResponse{
+			Error: err.Error(),
+		})
+	}
+
+	// Try both semicolon and comma formats for the node ID
+	var id *ua.NodeID
+	var nodeIDStr string
+
+	// First try with semicolon (standard format)
+	nodeIDStr = requestNodeID(writeRequest.Namespace, writeRequest.Type, writeRequest.Identifier)
+	if isVerbose {
+		log.Printf("[%s] Trying to parse node ID: %s", connectionName, nodeIDStr)
+	}
+
+	id, err = resolveNodeID(nodeIDStr)
+	if err != nil && strings.HasPrefix(nodeIDStr, "nsu=") {
+		return writeFailed(NodeResponse{
+			NodeID:     nodeIDStr,
+			Error:      fmt.Sprintf("Invalid node ID: %v", err),
+			StatusCode: uint32(ua.StatusBadNodeIDInvalid),
+		})
+	}
+	if err != nil {
+		// If semicolon format fails, try comma format
+		nodeIDStr = fmt.Sprintf("ns=%s,%s=%s", writeRequest.Namespace, writeRequest.Type, writeRequest.Identifier)
+		if isVerbose {
+			log.Printf("[%s] Semicolon format failed, trying comma format: %s", connectionName, nodeIDStr)
+		}
+
+		id, err = ua.ParseNodeID(nodeIDStr)
+		if err != nil {
+			return writeFailed(NodeResponse{
+				NodeID:     nodeIDStr,
+				Error:      fmt.Sprintf("Invalid node ID, tried both semicolon and comma formats: %v", err),
+				StatusCode: uint32(ua.StatusBadNodeIDInvalid),
+			})
+		}
+	}
+
+	if err := serviceWritePolicy.check(id); err != nil {
+		return writeRejected(caller.by, nodeIDStr, err)
+	}
+	if !writeRequest.DryRun {
+		if err := checkApproved(ctx, id); err != nil {
+			return writeRejected(caller.by, nodeIDStr, err)
+		}
+	}
+
+	// Get the client
+	clientMutex.Lock()
+	client := opcuaClient
+	clientMutex.Unlock()
+
+	if client == nil {
+		return writeFailed(NodeResponse{
+			NodeID:     nodeIDStr,
+			Error:      "OPCUA client not connected",
+			StatusCode: uint32(ua.StatusBadNotConnected),
+		})
+	}
+
+	timeout, err := parseTimeout(writeRequest.Timeout, defaultReadTimeout)
+	if err != nil {
+		return writeFailed(NodeResponse{
+			NodeID: nodeIDStr,
+			Error:  err.Error(),
+		})
+	}
+
+	// Create context with timeout. A write that has started is not cancelled
+	// with the request
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+	defer cancel()
+
+	// Resolve the data type from the node itself when requested
+	if strings.EqualFold(writeRequest.DataType, "auto") {
+		if attributeID != ua.AttributeIDValue {
+			return writeFailed(NodeResponse{
+				NodeID: nodeIDStr,
+				Error:  "Automatic data type selection is only supported for the Value attribute",
+			})
+		}
+		dataType, err := readNodeDataType(ctx, client, id)
+		if err != nil {
+			return writeFailed(NodeResponse{
+				NodeID:     nodeIDStr,
+				Error:      fmt.Sprintf("Failed to determine data type automatically: %v. Specify the data type explicitly", err),
+				StatusCode: errorStatus(err),
+			})
+		}
+		if isVerbose {
+			log.Printf("[%s] Resolved data type of %v: %s", connectionName, id, dataType)
+		}
+		writeRequest.DataType = dataType
+	}
+
+	// Convert the value to the appropriate type based on explicit dataType
+	var variant *ua.Variant
+
+	switch strings.ToLower(writeRequest.DataType) {
+	case "boolean":
+		boolValue, err := strconv.ParseBool(writeRequest.Value)
+		if err != nil {
+			return writeFailed(NodeResponse{
+				NodeID:     nodeIDStr,
+				Error:      fmt.Sprintf("Invalid boolean value: %v", err),
+				StatusCode: uint32(ua.StatusBadTypeMismatch),
+			})
+		}
+		variant, err = ua.NewVariant(boolValue)
+
+	case "sbyte":
+		intValue, err := strconv.ParseInt(writeRequest.Value, 10, 8)
+		if err != nil {
+			return writeFailed(NodeResponse{
+				NodeID:     nodeIDStr,
+				Error:      fmt.Sprintf("Invalid sbyte value: %v", err),
+				StatusCode: uint32(ua.StatusBadTypeMismatch),
+			})
+		}
+		variant, err = ua.NewVariant(int8(intValue))
+
+	case "byte":
+		uintValue, err := strconv.ParseUint(writeRequest.Value, 10, 8)
+		if err != nil {
+			return writeFailed(NodeResponse{
+				NodeID:     nodeIDStr,
+				Error:      fmt.Sprintf("Invalid byte value: %v", err),
+				StatusCode: uint32(ua.StatusBadTypeMismatch),
+			})
+		}
+		variant, err = ua.NewVariant(uint8(uintValue))
+
+	case "int16":
+		intValue, err := strconv.ParseInt(writeRequest.Value, 10, 16)
+		if err != nil {
+			return writeFailed(NodeResponse{
+				NodeID:     nodeIDStr,
+				Error:      fmt.Sprintf("Invalid int16 value: %v", err),
+				StatusCode: uint32(ua.StatusBadTypeMismatch),
+			})
+		}
+		variant, err = ua.NewVariant(int16(intValue))
+
+	case "uint16":
+		uintValue, err := strconv.ParseUint(writeRequest.Value, 10, 16)
+		if err != nil {
+			return writeFailed(NodeResponse{
+				NodeID:     nodeIDStr,
+				Error:      fmt.Sprintf("Invalid uint16 value: %v", err),
+				StatusCode: uint32(ua.StatusBadTypeMismatch),
+			})
+		}
+		variant, err = ua.NewVariant(uint16(uintValue))
+
+	case "int32":
+		intValue, err := strconv.ParseInt(writeRequest.Value, 10, 32)
+		if err != nil {
+			return writeFailed(NodeResponse{
+				NodeID:     nodeIDStr,
+				Error:      fmt.Sprintf("Invalid int32 value: %v", err),
+				StatusCode: uint32(ua.StatusBadTypeMismatch),
+			})
+		}
+		variant, err = ua.NewVariant(int32(intValue))
+
+	case "uint32":
+		uintValue, err := strconv.ParseUint(writeRequest.Value, 10, 32)
+		if err != nil {
+			return writeFailed(NodeResponse{
+				NodeID:     nodeIDStr,
+				Error:      fmt.Sprintf("Invalid uint32 value: %v", err),
+				StatusCode: uint32(ua.StatusBadTypeMismatch),
+			})
+		}
+		variant, err = ua.NewVariant(uint32(uintValue))
+
+	case "int64":
+		intValue, err := strconv.ParseInt(writeRequest.Value, 10, 64)
+		if err != nil {
+			return writeFailed(NodeResponse{
+				NodeID:     nodeIDStr,
+				Error:      fmt.Sprintf("Invalid int64 value: %v", err),
+				StatusCode: uint32(ua.StatusBadTypeMismatch),
+			})
+		}
+		variant, err = ua.NewVariant(intValue)
+
+	case "uint64":
+		uintValue, err := strconv.ParseUint(writeRequest.Value, 10, 64)
+		if err != nil {
+			return writeFailed(NodeResponse{
+				NodeID:     nodeIDStr,
+				Error:      fmt.Sprintf("Invalid uint64 value: %v", err),
+				StatusCode: uint32(ua.StatusBadTypeMismatch),
+			})
+		}
+		variant, err = ua.NewVariant(uintValue)
+
+	case "float":
+		floatValue, err := parseDecimal(writeRequest.Value, 32, *decimalSeparator)
+		if err != nil {
+			return writeFailed(NodeResponse{
+				NodeID:     nodeIDStr,
+				Error:      fmt.Sprintf("Invalid float value: %v", err),
+				StatusCode: uint32(ua.StatusBadTypeMismatch),
+			})
+		}
+		variant, err = ua.NewVariant(float32(floatValue))
+
+	case "double":
+		doubleValue, err := parseDecimal(writeRequest.Value, 64, *decimalSeparator)
+		if err != nil {
+			return writeFailed(NodeResponse{
+				NodeID:     nodeIDStr,
+				Error:      fmt.Sprintf("Invalid double value: %v", err),
+				StatusCode: uint32(ua.StatusBadTypeMismatch),
+			})
+		}
+		variant, err = ua.NewVariant(doubleValue)
+
+	case "string":
+		variant, err = ua.NewVariant(writeRequest.Value)
+
+	case "localizedtext":
+		variant, err = ua.NewVariant(ua.NewLocalizedText(writeRequest.Value))
+
+	case "dtl":
+		if attributeID != ua.AttributeIDValue {
+			return writeFailed(NodeResponse{
+				NodeID: nodeIDStr,
+				Error:  "DTL can only be written to the Value attribute",
+			})
+		}
+		year, month, day, weekday, hour, minute, second, nanosecond, err := parseDTL(writeRequest.Value)
+		if err != nil {
+			return writeFailed(NodeResponse{
+				NodeID:     nodeIDStr,
+				Error:      fmt.Sprintf("Invalid DTL format: %v", err),
+				StatusCode: uint32(ua.StatusBadTypeMismatch),
+			})
+		}
+		if writeRequest.DryRun {
+			return NodeResponse{
+				NodeID:   nodeIDStr,
+				Value:    writeRequest.Value,
+				DataType: "dtl",
+			}, nil
+		}
+
+		// Write DTL by setting individual child fields
+		err = writeDTLFields(ctx, client, id, year, month, day, weekday, hour, minute, second, nanosecond)
+		if err != nil {
+			return writeFailed(NodeResponse{
+				NodeID:     nodeIDStr,
+				Error:      fmt.Sprintf("Failed to write DTL: %v", err),
+				StatusCode: errorStatus(err),
+			})
+		}
+
+		// DTL write succeeded, return success
+		return NodeResponse{
+			NodeID: nodeIDStr,
+			Value:  writeRequest.Value,
+		}, nil
+
+	case "struct":
+		if attributeID != ua.AttributeIDValue {
+			return writeFailed(NodeResponse{
+				NodeID: nodeIDStr,
+				Error:  "Structures can only be written to the Value attribute",
+			})
+		}
+		// The JSON document is encoded with the node's DataTypeDefinition
+		variant, err = encodeStructures(ctx, client, id, writeRequest.Value)
+		if err != nil {
+			return writeFailed(NodeResponse{
+				NodeID:     nodeIDStr,
+				Error:      fmt.Sprintf("Invalid structure value: %v", err),
+				StatusCode: uint32(ua.StatusBadTypeMismatch),
+			})
+		}
+
+	default:
+		return writeFailed(NodeResponse{
+			NodeID:     nodeIDStr,
+			Error:      fmt.Sprintf("Unsupported data type: %s. Use one of: %s", writeRequest.DataType, strings.Join(setDataTypes, ", ")),
+			StatusCode: uint32(ua.StatusBadTypeMismatch),
+		})
+	}
+
+	if err != nil {
+		return writeFailed(NodeResponse{
+			NodeID:     nodeIDStr,
+			Error:      fmt.Sprintf("Failed to create variant: %v", err),
+			StatusCode: uint32(ua.StatusBadTypeMismatch),
+		})
+	}
+
+	// Limits apply to dry runs too, so they show what would be rejected
+	if attributeID == ua.AttributeIDValue {
+		err := serviceWriteLimits.check(id, variant.Value(), func() string {
+			name, _ := serviceEnums.name(ctx, client, id, variant.Value())
+			return name
+		})
+		if err != nil {
+			return writeRejected(caller.by, nodeIDStr, err)
+		}
+	}
+
+	// A dry run reports the converted value instead of writing it
+	if writeRequest.DryRun {
+		value := variant.Value()
+		switch v := value.(type) {
+		case *ua.LocalizedText:
+			value = v.Text
+		case *ua.ExtensionObject:
+			value = writeRequest.Value // The JSON document it was encoded from
+		}
+		return NodeResponse{
+			NodeID:   nodeIDStr,
+			Value:    value,
+			DataType: strings.ToLower(writeRequest.DataType),
+		}, nil
+	}
+
+	if isVerbose {
+		log.Printf("[%s] Writing %s attribute of node: %v", connectionName, attributeName(attributeID), id)
+	}
 
-func startService(endpoint, username, password, certfile, keyfile string, 
-                 gencert bool, appuri string, timeout, port int, verbose bool,
-                 securityPolicy, securityMode, authMethod string) {
-	isVerbose = verbose
-	connectionPort = port
-	
-	// Extract connection name from port if available
-	if port != 8765 {
-		connectionName = fmt.Sprintf("connection-%d", port)
-	} else {
-		connectionName = "default"
+	// Create a proper write request following the example
+	req := &ua.WriteRequest{
+		NodesToWrite: []*ua.WriteValue{
+			{
+				NodeID:      id,
+				AttributeID: attributeID,
+				Value: &ua.DataValue{
+					EncodingMask: ua.DataValueValue,
+					Value:        variant,
+				},
+			},
+		},
 	}
-	
-	log.Printf("Starting OPCUA service for connection '%s' on port %d", connectionName, port)
-	
-	// Configure context with signal handling for graceful shutdown
-	ctx, cancel := context.WithCancel(context.Background())
+
+	// Execute the write operation
+	resp, err := writeOPCUA(ctx, client, req)
+	if err != nil {
+		return writeFailed(NodeResponse{
+			NodeID:     nodeIDStr,
+			Error:      fmt.Sprintf("Failed to write value: %v", err),
+			StatusCode: errorStatus(err),
+		})
+	}
+
+	// Check write result
+	if resp.Results[0] != ua.StatusOK {
+		return writeFailed(NodeResponse{
+			NodeID:     nodeIDStr,
+			Error:      fmt.Sprintf("Write operation failed with status: %v", resp.Results[0]),
+			StatusCode: uint32(resp.Results[0]),
+		})
+	}
+
+	// Return success response
+	return NodeResponse{
+		NodeID: nodeIDStr,
+		Value:  writeRequest.Value,
+	}, nil
+}
+
+// handleBitWriteRequest sets or clears a single bit of an integer word with a
+// read-modify-write. The bit write mutex is held for the whole operation so
+// concurrent bit writes through this service cannot overwrite each other. The
+// client mutex is not, so a retried write can wait for a new session
+func handleBitWriteRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed, use POST for write operations", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var bitRequest struct {
+		Namespace  string `json:"namespace"`
+		Type       string `json:"type"`
+		Identifier string `json:"identifier"`
+		Bit        int    `json:"bit"`
+		Value      int    `json:"value"`             // 0 or 1
+		Timeout    string `json:"timeout,omitempty"` // Instead of defaultReadTimeout, e.g. 30s
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&bitRequest); err != nil {
+		sendJSONResponse(w, NodeResponse{
+			Error: fmt.Sprintf("Failed to parse request: %v", err),
+		})
+		return
+	}
+
+	if bitRequest.Namespace == "" || bitRequest.Type == "" || bitRequest.Identifier == "" {
+		sendJSONResponse(w, NodeResponse{
+			Error: "Missing required fields: namespace, type, and identifier are required",
+		})
+		return
+	}
+
+	nodeIDStr := requestNodeID(bitRequest.Namespace, bitRequest.Type, bitRequest.Identifier)
+	id, err := resolveNodeID(nodeIDStr)
+	if err != nil {
+		sendJSONResponse(w, NodeResponse{
+			NodeID:     nodeIDStr,
+			Error:      fmt.Sprintf("Invalid node ID: %v", err),
+			StatusCode: uint32(ua.StatusBadNodeIDInvalid),
+		})
+		return
+	}
+
+	if !allowWrite(w, r, id, nodeIDStr) || !allowWithoutApproval(w, r, id, nodeIDStr) {
+		return
+	}
+
+	if bitRequest.Value != 0 && bitRequest.Value != 1 {
+		sendJSONResponse(w, NodeResponse{
+			NodeID: nodeIDStr,
+			Error:  fmt.Sprintf("Bit value must be 0 or 1, got %d", bitRequest.Value),
+		})
+		return
+	}
+
+	// Hold the bit write mutex across read and write
+	bitWriteMutex.Lock()
+	defer bitWriteMutex.Unlock()
+
+	clientMutex.Lock()
+	client := opcuaClient
+	clientMutex.Unlock()
+	if client == nil {
+		sendJSONResponse(w, NodeResponse{
+			NodeID:     nodeIDStr,
+			Error:      "OPCUA client not connected",
+			StatusCode: uint32(ua.StatusBadNotConnected),
+		})
+		return
+	}
+
+	timeout, err := requestTimeout(r, bitRequest.Timeout, defaultReadTimeout)
+	if err != nil {
+		sendJSONResponse(w, NodeResponse{
+			NodeID: nodeIDStr,
+			Error:  err.Error(),
+		})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
-	
-	// Setup signal handling for graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	
-	go func() {
-		sig := <-sigChan
-		log.Printf("[%s] Received signal %v, shutting down...", connectionName, sig)
-		cancel()
-		// Give time for connections to close gracefully
-		time.Sleep(1 * time.Second)
-		os.Exit(0)
-	}()
-	
-	// Connect to OPCUA server with infinite retries
-	connectWithRetry(ctx, endpoint, username, password, certfile, keyfile, gencert, appuri, timeout)
 
-    http.HandleFunc("/api/browse", func(w http.ResponseWriter, r *http.Request) {
-        handleBrowseRequest(w, r)
-    })
-	
-	// Set up HTTP server for API
-	http.HandleFunc("/api/node", func(w http.ResponseWriter, r *http.Request) {
-		// Route based on HTTP method
-		if r.Method == http.MethodGet {
-			handleNodeRequest(w, r) // Existing handler for GET
-		} else if r.Method == http.MethodPost {
-			handleNodeWriteRequest(w, r) // New handler for POST
-		} else {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	// With --retry-session-writes, a write rejected for an invalid session
+	// reads the word again on the new session: the other bits may have
+	// changed, e.g. after a PLC restart
+	var word interface{}
+	var resp *ua.WriteResponse
+	for retried := false; ; retried = true {
+		dataValue, err := readNodeDataValue(ctx, client, id)
+		if err != nil {
+			sendJSONResponse(w, NodeResponse{
+				NodeID:     nodeIDStr,
+				Error:      fmt.Sprintf("Failed to read node: %v", err),
+				StatusCode: errorStatus(err),
+			})
+			return
 		}
-	})
-	
-	// Add new endpoint for batch node operations
-	http.HandleFunc("/api/nodes", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodPost {
-			handleBatchNodeRequest(w, r)
-		} else {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+
+		word, err = setWordBit(dataValue.Value.Value(), bitRequest.Bit, bitRequest.Value == 1)
+		if err != nil {
+			sendJSONResponse(w, NodeResponse{
+				NodeID:     nodeIDStr,
+				Error:      err.Error(),
+				StatusCode: uint32(ua.StatusBadTypeMismatch),
+			})
+			return
 		}
-	})
-	
-	// Add info endpoint to identify this connection
-	http.HandleFunc("/api/info", func(w http.ResponseWriter, r *http.Request) {
-		info := map[string]interface{}{
-			"connection": connectionName,
-			"port":       port,
-			"endpoint":   endpoint,
-			"status":     "connected",
+
+		variant, err := ua.NewVariant(word)
+		if err != nil {
+			sendJSONResponse(w, NodeResponse{
+				NodeID:     nodeIDStr,
+				Error:      fmt.Sprintf("Failed to create variant: %v", err),
+				StatusCode: uint32(ua.StatusBadTypeMismatch),
+			})
+			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(info)
-	})
-	
-	// Start the server
-	serverAddr := fmt.Sprintf("0.0.0.0:%d", port)
-	server := &http.Server{
-		Addr: serverAddr,
-	}
-	
-	log.Printf("[%s] OPCUA service running on http://%s", connectionName, serverAddr)
-	log.Printf("[%s] Example usage: curl http://%s/api/node?namespace=0&type=i&identifier=2258", connectionName, serverAddr)
-	
-	// Start HTTP server in a goroutine
-	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("[%s] HTTP server error: %v", connectionName, err)
+
+		if !allowWriteValue(w, r, id, nodeIDStr, word, func() string {
+			name, _ := serviceEnums.name(ctx, client, id, word)
+			return name
+		}) {
+			return
 		}
-	}()
-	
-	// Keep connection alive with periodic reads
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
-	
-	for {
-		select {
-		case <-ticker.C:
-            clientMutex.Lock()
-            client := opcuaClient
-            clientMutex.Unlock()
-            
-            if client == nil {
-                log.Printf("[%s] Client is nil, attempting reconnection", connectionName)
-                reconnectOPCUA(ctx, endpoint, username, password, certfile, keyfile, gencert, appuri, timeout)
-                continue
-            }
-            
-            // Try keep-alive
-            timeNode := client.Node(ua.NewNumericNodeID(0, 2258))
-            _, err := timeNode.Value(ctx)
-            if err != nil {
-                log.Printf("[%s] Keep-alive failed: %v", connectionName, err)
-                reconnectOPCUA(ctx, endpoint, username, password, certfile, keyfile, gencert, appuri, timeout)
-            } else if isVerbose {
-                log.Printf("[%s] Keep-alive successful", connectionName)
-            }
-			
-		case <-ctx.Done():
-			// Shutdown gracefully
-			log.Printf("[%s] Shutting down service...", connectionName)
-			
-			// Close OPCUA connection
-			clientMutex.Lock()
-			if opcuaClient != nil {
-				opcuaClient.Close(context.Background())
-				opcuaClient = nil
-			}
-			clientMutex.Unlock()
-			
-			// Shutdown HTTP server
-			shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
-			defer shutdownCancel()
-			
-			if err := server.Shutdown(shutdownCtx); err != nil {
-				log.Printf("[%s] HTTP server shutdown error: %v", connectionName, err)
+
+		if isVerbose {
+			log.Printf("[%s] Setting bit %d of node %v to %d: %v -> %v", connectionName, bitRequest.Bit, id, bitRequest.Value,
+				serviceSensitive.loggedValue(id, dataValue.Value.Value()), serviceSensitive.loggedValue(id, word))
+		}
+
+		resp, err = writeOPCUAOnce(ctx, client, &ua.WriteRequest{
+			NodesToWrite: []*ua.WriteValue{
+				{
+					NodeID:      id,
+					AttributeID: ua.AttributeIDValue,
+					Value: &ua.DataValue{
+						EncodingMask: ua.DataValueValue,
+						Value:        variant,
+					},
+				},
+			},
+		})
+		if err != nil && !retried && retrySessionWrites && isSessionInvalid(err) {
+			log.Printf("[%s] Bit write of %v rejected (%v), reading the word again on a new session", connectionName, id, err)
+			if client, err = renewSession(ctx, client, err); err == nil {
+				continue
 			}
-			
+		}
+		if err != nil {
+			sendJSONResponse(w, NodeResponse{
+				NodeID:     nodeIDStr,
+				Error:      fmt.Sprintf("Failed to write value: %v", err),
+				StatusCode: errorStatus(err),
+			})
 			return
 		}
+		break
+	}
+	if resp.Results[0] != ua.StatusOK {
+		sendJSONResponse(w, NodeResponse{
+			NodeID:     nodeIDStr,
+			Error:      fmt.Sprintf("Write operation failed with status: %v", resp.Results[0]),
+			StatusCode: uint32(resp.Results[0]),
+		})
+		return
+	}
+
+	// Return the word that was written
+	sendJSONResponse(w, NodeResponse{
+		NodeID: nodeIDStr,
+		Value:  word,
+	})
+}
+
+// readNodeDataValue reads the Value attribute of a node including its source
+// and server timestamps. A bad status code is returned as error
+func readNodeDataValue(ctx context.Context, client *opcua.Client, nodeID *ua.NodeID) (*ua.DataValue, error) {
+	req := &ua.ReadRequest{
+		NodesToRead: []*ua.ReadValueID{
+			{NodeID: nodeID, AttributeID: ua.AttributeIDValue},
+		},
+		TimestampsToReturn: ua.TimestampsToReturnBoth,
+	}
+
+	resp, err := readOPCUA(ctx, client, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Results) == 0 {
+		return nil, ua.StatusBadUnexpectedError
+	}
+	if resp.Results[0].Status != ua.StatusOK {
+		return nil, resp.Results[0].Status
+	}
+	return resp.Results[0], nil
+}
+
+// readNodeDataValues reads the Value attribute of many nodes with as few read
+// requests as the server's MaxNodesPerRead allows. The data values are in the
+// order of the node IDs, bad status codes are left for the caller per node
+func readNodeDataValues(ctx context.Context, client *opcua.Client, nodeIDs []*ua.NodeID) ([]*ua.DataValue, error) {
+	if len(nodeIDs) == 0 {
+		return nil, nil
+	}
+
+	// Read nodes that appear several times once, generated node lists often repeat them
+	unique, positions := dedupeNodeIDs(nodeIDs)
+	if duplicates := len(nodeIDs) - len(unique); duplicates > 0 && isVerbose {
+		log.Printf("[%s] Read of %d nodes has %d duplicates, reading %d nodes", connectionName, len(nodeIDs), duplicates, len(unique))
+	}
+	reads := make([]*ua.ReadValueID, len(unique))
+	for i, nodeID := range unique {
+		reads[i] = &ua.ReadValueID{NodeID: nodeID, AttributeID: ua.AttributeIDValue}
+	}
+	dataValues, err := readValueIDs(ctx, client, reads)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fan the values out to every occurrence
+	results := make([]*ua.DataValue, len(nodeIDs))
+	for i, position := range positions {
+		results[i] = dataValues[position]
+	}
+	return results, nil
+}
+
+// readValueIDs reads node attributes with as few read requests as the
+// server's MaxNodesPerRead allows. The data values are in the order of the
+// reads, bad status codes are left for the caller per attribute
+func readValueIDs(ctx context.Context, client *opcua.Client, reads []*ua.ReadValueID) ([]*ua.DataValue, error) {
+	chunk := serviceLimits.get().MaxNodesPerRead
+
+	dataValues := make([]*ua.DataValue, 0, len(reads))
+	for start := 0; start < len(reads); start += chunk {
+		end := min(start+chunk, len(reads))
+		req := &ua.ReadRequest{
+			NodesToRead:        reads[start:end],
+			TimestampsToReturn: ua.TimestampsToReturnBoth,
+		}
+
+		resp, err := readOPCUA(ctx, client, req)
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Results) != end-start {
+			return nil, fmt.Errorf("expected %d results, got %d", end-start, len(resp.Results))
+		}
+		dataValues = append(dataValues, resp.Results...)
 	}
+	return dataValues, nil
 }
-func connectOPCUA(ctx context.Context, endpoint, username, password, certfile, keyfile string, 
-                 gencert bool, appuri string, timeout int) error {
-    log.Printf("[%s] Connecting to OPCUA server at %s...", connectionName, endpoint)
-    
-    timeoutDuration := time.Duration(timeout) * time.Second
-    
-    // Determine the certificate directory based on user's home directory
-    homeDir, err := os.UserHomeDir()
-    if err != nil {
-        log.Printf("[%s] Warning: Could not get user home directory: %v. Using current directory.", connectionName, err)
-        homeDir = "."
-    } else {
-        // Create ~/.config/plccli directory if it doesn't exist
-        configDir := filepath.Join(homeDir, ".config")
-        if _, err := os.Stat(configDir); err != nil {
-            if os.IsNotExist(err) {
-                if err := os.Mkdir(configDir, 0755); err != nil {
-                    log.Printf("[%s] Warning: Could not create %s directory: %v. Using current directory.", connectionName, configDir, err)
-                    homeDir = "."
-                }
-            } else {
-                log.Printf("[%s] Warning: Error checking %s directory: %v. Using current directory.", connectionName, configDir, err)
-                homeDir = "."
-            }
-        }
-        
-        plcConfigDir := filepath.Join(configDir, "plccli")
-        if _, err := os.Stat(plcConfigDir); err != nil {
-            if os.IsNotExist(err) {
-                if err := os.Mkdir(plcConfigDir, 0755); err != nil {
-                    log.Printf("[%s] Warning: Could not create %s directory: %v. Using current directory.", connectionName, plcConfigDir, err)
-                    homeDir = "."
-                } else {
-                    homeDir = plcConfigDir
-                }
-            } else {
-                log.Printf("[%s] Warning: Error checking %s directory: %v. Using current directory.", connectionName, plcConfigDir, err)
-                homeDir = "."
-            }
-        } else {
-            homeDir = plcConfigDir
-        }
-    }
-    
-    // Update certificate and key file paths to use the home directory
-    if !filepath.IsAbs(certfile) {
-        certfile = filepath.Join(homeDir, filepath.Base(certfile))
-    }
-    if !filepath.IsAbs(keyfile) {
-        keyfile = filepath.Join(homeDir, filepath.Base(keyfile))
-    }
-    
-    log.Printf("[%s] Using certificate path: %s", connectionName, certfile)
-    log.Printf("[%s] Using key path: %s", connectionName, keyfile)
-    
-    // Get endpoints first to determine if we need certificates
-    log.Printf("[%s] Getting endpoints...", connectionName)
-    endpointCtx, cancel := context.WithTimeout(ctx, timeoutDuration)
-    defer cancel()
-    
-    endpoints, err := opcua.GetEndpoints(endpointCtx, endpoint)
-    if err != nil {
-        return fmt.Errorf("failed to get endpoints: %v", err)
-    }
-    log.Printf("[%s] Found %d endpoints", connectionName, len(endpoints))
-
-
-    // Add detailed endpoint logging
-    log.Printf("[%s] Available endpoints:", connectionName)
-    for i, e := range endpoints {
-        log.Printf("[%s]   [%d] SecurityPolicy=%s, SecurityMode=%s, TokenTypes=%v", 
-            connectionName, i, 
-            e.SecurityPolicyURI, 
-            e.SecurityMode,
-            getTokenTypes(e.UserIdentityTokens))
-    }
-
-    
-    // Determine security policy and mode from available endpoints
-    var serverEndpoint *ua.EndpointDescription
-    var useAnonymous bool
-    
-    // First check if server supports anonymous authentication with no security
-    for _, e := range endpoints {
-        if e.SecurityPolicyURI == ua.SecurityPolicyURINone && 
-           e.SecurityMode == ua.MessageSecurityModeNone {
-            // Check if it supports anonymous authentication
-            for _, t := range e.UserIdentityTokens {
-                if t.TokenType == ua.UserTokenTypeAnonymous {
-                    serverEndpoint = e
-                    useAnonymous = true
-                    break
-                }
-            }
-            if serverEndpoint != nil {
-                break
-            }
-        }
-    }
-    
-    // If no anonymous endpoint was found, look for username authentication
-    if serverEndpoint == nil && username != "" {
-        // Try to find an endpoint that supports username authentication
-        for _, e := range endpoints {
-            // Prefer Basic256 with SignAndEncrypt if available
-            if e.SecurityPolicyURI == ua.SecurityPolicyURIBasic256 && 
-               e.SecurityMode == ua.MessageSecurityModeSignAndEncrypt {
-                for _, t := range e.UserIdentityTokens {
-                    if t.TokenType == ua.UserTokenTypeUserName {
-                        serverEndpoint = e
-                        break
-                    }
-                }
-                if serverEndpoint != nil {
-                    break
-                }
-            }
-        }
-        
-        // If no preferred endpoint found, try any security policy that supports username
-        if serverEndpoint == nil {
-            for _, e := range endpoints {
-                for _, t := range e.UserIdentityTokens {
-                    if t.TokenType == ua.UserTokenTypeUserName {
-                        serverEndpoint = e
-                        break
-                    }
-                }
-                if serverEndpoint != nil {
-                    break
-                }
-            }
-        }
-    }
-    
-    // If still no endpoint found, try to use anonymous authentication as fallback
-    if serverEndpoint == nil {
-        for _, e := range endpoints {
-            for _, t := range e.UserIdentityTokens {
-                if t.TokenType == ua.UserTokenTypeAnonymous {
-                    serverEndpoint = e
-                    useAnonymous = true
-                    break
-                }
-            }
-            if serverEndpoint != nil {
-                break
-            }
-        }
-    }
-    
-    if serverEndpoint == nil {
-        return fmt.Errorf("no compatible endpoint found")
-    }
-    
-    log.Printf("[%s] Selected endpoint: %s with %s/%s", 
-        connectionName, serverEndpoint.EndpointURL, 
-        serverEndpoint.SecurityPolicyURI, 
-        serverEndpoint.SecurityMode)
-    
-    // Determine if we need certificates
-    needCertificates := serverEndpoint.SecurityPolicyURI != ua.SecurityPolicyURINone &&
-                       serverEndpoint.SecurityMode != ua.MessageSecurityModeNone
-    
-    // Generate or load certificates if needed
-    var cert []byte
-    var privateKey *rsa.PrivateKey
-    
-    if needCertificates {
-        if gencert {
-            log.Printf("[%s] Checking for existing certificate", connectionName)
-            // Skip regenerating cert if it exists
-            if _, err := os.Stat(certfile); os.IsNotExist(err) {
-                log.Printf("[%s] Certificate doesn't exist, generating...", connectionName)
-                certPEM, keyPEM, err := uatest.GenerateCert(appuri, 2048, 24*time.Hour)
-                if err != nil {
-                    return fmt.Errorf("failed to generate cert: %v", err)
-                }
-                if err := os.WriteFile(certfile, certPEM, 0644); err != nil {
-                    return fmt.Errorf("failed to write %s: %v", certfile, err)
-                }
-                if err := os.WriteFile(keyfile, keyPEM, 0644); err != nil {
-                    return fmt.Errorf("failed to write %s: %v", keyfile, err)
-                }
-                log.Printf("[%s] Generated %s and %s", connectionName, certfile, keyfile)
-            } else {
-                log.Printf("[%s] Using existing certificate", connectionName)
-            }
-        }
-        
-        // Load certificate
-        log.Printf("[%s] Loading certificate...", connectionName)
-        c, err := tls.LoadX509KeyPair(certfile, keyfile)
-        if err != nil {
-            return fmt.Errorf("failed to load certificate: %v", err)
-        }
-        cert = c.Certificate[0]
-        if pk, ok := c.PrivateKey.(*rsa.PrivateKey); ok {
-            privateKey = pk
-        } else {
-            return fmt.Errorf("invalid private key type")
-        }
-    }
-    
-    // Build client options with more aggressive timeouts for reconnection
-    opts := []opcua.Option{
-        opcua.DialTimeout(timeoutDuration),
-        opcua.RequestTimeout(timeoutDuration),
-        opcua.SessionTimeout(timeoutDuration * 2), // Longer session timeout
-        opcua.AutoReconnect(true), 
-    }
-    
-    // Add security options
-    if useAnonymous {
-        log.Printf("[%s] Using anonymous authentication", connectionName)
-        opts = append(opts, opcua.SecurityFromEndpoint(serverEndpoint, ua.UserTokenTypeAnonymous))
-    } else {
-        log.Printf("[%s] Using username authentication", connectionName)
-        opts = append(opts, 
-            opcua.AuthUsername(username, password),
-            opcua.SecurityFromEndpoint(serverEndpoint, ua.UserTokenTypeUserName))
-    }
-    
-    // Add certificate options if needed
-    if needCertificates {
-        opts = append(opts,
-            opcua.Certificate(cert),
-            opcua.PrivateKey(privateKey))
-    }
-    
-    // Create client
-    log.Printf("[%s] Creating client...", connectionName)
-    client, err := opcua.NewClient(endpoint, opts...)
-    if err != nil {
-        return fmt.Errorf("failed to create client: %v", err)
-    }
-    
-    // Connect
-    log.Printf("[%s] Connecting to server...", connectionName)
-    connectCtx, cancel := context.WithTimeout(ctx, timeoutDuration)
-    defer cancel()
-    
-    if err := client.Connect(connectCtx); err != nil {
-        return fmt.Errorf("failed to connect: %v", err)
-    }
-    
-    log.Printf("[%s] Successfully connected to OPCUA server", connectionName)
-    
-    // Store client globally
-    clientMutex.Lock()
-    opcuaClient = client
-    clientMutex.Unlock()
-    
-    return nil
+
+// dedupeNodeIDs returns the distinct node IDs in order of their first
+// occurrence and, for each node ID, the position of its distinct node ID
+func dedupeNodeIDs(nodeIDs []*ua.NodeID) ([]*ua.NodeID, []int) {
+	var unique []*ua.NodeID
+	positions := make([]int, len(nodeIDs))
+	seen := make(map[string]int, len(nodeIDs))
+	for i, nodeID := range nodeIDs {
+		key := nodeID.String()
+		position, ok := seen[key]
+		if !ok {
+			position = len(unique)
+			seen[key] = position
+			unique = append(unique, nodeID)
+		}
+		positions[i] = position
+	}
+	return unique, positions
 }
 
+// writeNodeValues writes many values with as few write requests as the
+// server's MaxNodesPerWrite allows. The status codes are in the order of the
+// values
+func writeNodeValues(ctx context.Context, client *opcua.Client, values []*ua.WriteValue) ([]ua.StatusCode, error) {
+	chunk := serviceLimits.get().MaxNodesPerWrite
 
-// connectWithRetry attempts to connect with infinite retries and exponential backoff with jitter
-func connectWithRetry(ctx context.Context, endpoint, username, password, certfile, keyfile string,
-                      gencert bool, appuri string, timeout int) {
-    // Seed random number generator with current time
-    rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
-
-    // Add initial random jitter (0-300 seconds = 5 minutes) to desynchronize containers that start simultaneously
-    // With ~19 containers and connection attempts taking up to 5 minutes, this spreads the load significantly
-    initialJitter := time.Duration(rnd.Intn(300)) * time.Second
-    log.Printf("[%s] Adding initial jitter of %v to desynchronize startup", connectionName, initialJitter)
-
-    select {
-    case <-time.After(initialJitter):
-        // Continue to connection attempts
-    case <-ctx.Done():
-        log.Printf("[%s] Context cancelled during initial jitter", connectionName)
-        return
-    }
-
-    attempt := 0
-    for {
-        // Check if context is cancelled
-        if ctx.Err() != nil {
-            log.Printf("[%s] Context cancelled, stopping connection attempts", connectionName)
-            return
-        }
-
-        attempt++
-        log.Printf("[%s] Initial connection attempt %d...", connectionName, attempt)
-
-        // Create a fresh context for each attempt
-        connectTimeout := time.Duration(timeout) * time.Second
-        connectCtx, cancel := context.WithTimeout(context.Background(), connectTimeout)
-
-        err := connectOPCUA(connectCtx, endpoint, username, password, certfile, keyfile, gencert, appuri, timeout)
-        cancel()
-
-        if err == nil {
-            log.Printf("[%s] Successfully connected on attempt %d", connectionName, attempt)
-            return
-        }
-
-        log.Printf("[%s] Connection attempt %d failed: %v", connectionName, attempt, err)
-
-        // Calculate exponential backoff, capped at 180 seconds (3 minutes)
-        // Given that connection attempts can take up to 5 minutes, we want reasonable spacing
-        backoffExponent := attempt - 1
-        if backoffExponent > 7 {
-            backoffExponent = 7  // Cap at 2^7 = 128 seconds
-        }
-        baseBackoff := time.Duration(1<<uint(backoffExponent)) * time.Second
-        if baseBackoff > 180*time.Second {
-            baseBackoff = 180 * time.Second
-        }
-
-        // Add random jitter (±50%) to prevent synchronized retry storms
-        jitterPercent := 0.5 + rnd.Float64()  // Random value between 0.5 and 1.5 (±50% around 1.0)
-        backoffTime := time.Duration(float64(baseBackoff) * jitterPercent)
-
-        log.Printf("[%s] Waiting %v (base: %v + jitter) before retry attempt %d...",
-            connectionName, backoffTime, baseBackoff, attempt+1)
-
-        // Sleep with context awareness
-        select {
-        case <-time.After(backoffTime):
-            // Continue to next attempt
-        case <-ctx.Done():
-            log.Printf("[%s] Context cancelled during backoff, stopping connection attempts", connectionName)
-            return
-        }
-    }
+	results := make([]ua.StatusCode, 0, len(values))
+	for start := 0; start < len(values); start += chunk {
+		end := min(start+chunk, len(values))
+		resp, err := writeOPCUA(ctx, client, &ua.WriteRequest{NodesToWrite: values[start:end]})
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Results) != end-start {
+			return nil, fmt.Errorf("expected %d results, got %d", end-start, len(resp.Results))
+		}
+		results = append(results, resp.Results...)
+	}
+	return results, nil
 }
 
-func reconnectOPCUA(ctx context.Context, endpoint, username, password, certfile, keyfile string,
-                   gencert bool, appuri string, timeout int) {
-    log.Printf("[%s] Attempting to reconnect...", connectionName)
-
-    // At the start of reconnectOPCUA
-    if ctx.Err() != nil {
-        log.Printf("[%s] Context already cancelled, skipping reconnection", connectionName)
-        return
-    }
-
-    // Force close existing connection if any
-    clientMutex.Lock()
-    if opcuaClient != nil {
-        log.Printf("[%s] Closing existing connection...", connectionName)
-        // Ensure the connection is fully closed, ignore errors
-        opcuaClient.Close(ctx)
-        // Important: Explicitly set to nil to ensure GC and complete cleanup
-        opcuaClient = nil
-    }
-    clientMutex.Unlock()
-
-    // Add a small delay to ensure server-side cleanup
-    time.Sleep(2 * time.Second)
-
-    // Seed random number generator for jitter
-    rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
-
-    // Infinite retry loop with exponential backoff and jitter
-    attempt := 0
-    for {
-        if ctx.Err() != nil {
-            log.Printf("[%s] Context cancelled, stopping reconnection attempts", connectionName)
-            return
-        }
-
-        attempt++
-        log.Printf("[%s] Reconnection attempt %d...", connectionName, attempt)
-
-        // Create a fresh context for each attempt
-        reconnectTimeout := time.Duration(timeout) * time.Second
-        reconnectCtx, cancel := context.WithTimeout(context.Background(), reconnectTimeout)
-
-        // Complete new connection attempt
-        err := connectOPCUA(reconnectCtx, endpoint, username, password, certfile, keyfile, gencert, appuri, timeout)
-        cancel()
-
-        if err == nil {
-            log.Printf("[%s] Reconnection successful on attempt %d", connectionName, attempt)
-            return
-        }
-
-        log.Printf("[%s] Reconnection attempt %d failed: %v", connectionName, attempt, err)
-
-        // Calculate exponential backoff with jitter, capped at 180 seconds
-        backoffExponent := attempt - 1
-        if backoffExponent > 7 {
-            backoffExponent = 7  // Cap at 2^7 = 128 seconds
-        }
-        baseBackoff := time.Duration(1<<uint(backoffExponent)) * time.Second
-        if baseBackoff > 180*time.Second {
-            baseBackoff = 180 * time.Second
-        }
-
-        // Add random jitter (±50%)
-        jitterPercent := 0.5 + rnd.Float64()
-        backoffTime := time.Duration(float64(baseBackoff) * jitterPercent)
-
-        log.Printf("[%s] Waiting %v (base: %v + jitter) before reconnection attempt %d...",
-            connectionName, backoffTime, baseBackoff, attempt+1)
-
-        // Sleep with context awareness
-        select {
-        case <-time.After(backoffTime):
-            // Continue to next attempt
-        case <-ctx.Done():
-            log.Printf("[%s] Context cancelled during reconnection backoff", connectionName)
-            return
-        }
-    }
+// setResponseTimestamps copies the timestamps the server supplied into a response
+func setResponseTimestamps(response *NodeResponse, dataValue *ua.DataValue) {
+	if !dataValue.SourceTimestamp.IsZero() {
+		sourceTimestamp := dataValue.SourceTimestamp
+		response.SourceTimestamp = &sourceTimestamp
+	}
+	if !dataValue.ServerTimestamp.IsZero() {
+		serverTimestamp := dataValue.ServerTimestamp
+		response.ServerTimestamp = &serverTimestamp
+	}
 }
 
-func handleNodeRequest(w http.ResponseWriter, r *http.Request) {
-    // Get node ID components separately
-    namespace := r.URL.Query().Get("namespace")
-    idType := r.URL.Query().Get("type")
-    identifier := r.URL.Query().Get("identifier")
-    
-    if namespace == "" || idType == "" || identifier == "" {
-        http.Error(w, "Missing required parameters: namespace, type, and identifier", http.StatusBadRequest)
-        return
-    }
-    
-    // Try both semicolon and comma formats to build the node ID
-    var id *ua.NodeID
-    var err error
-    var nodeIDStr string
-    
-    // First try with semicolon (standard format)
-    nodeIDStr = fmt.Sprintf("ns=%s;%s=%s", namespace, idType, identifier)
-    if isVerbose {
-        log.Printf("[%s] Trying to parse node ID: %s", connectionName, nodeIDStr)
-    }
-    
-    id, err = ua.ParseNodeID(nodeIDStr)
-    if err != nil {
-        // If semicolon format fails, try comma format
-        nodeIDStr = fmt.Sprintf("ns=%s,%s=%s", namespace, idType, identifier)
-        if isVerbose {
-            log.Printf("[%s] Semicolon format failed, trying comma format: %s", connectionName, nodeIDStr)
-        }
-        
-        id, err = ua.ParseNodeID(nodeIDStr)
-        if err != nil {
-            sendJSONResponse(w, NodeResponse{
-                NodeID: nodeIDStr,
-                Error:  fmt.Sprintf("Invalid node ID, tried both semicolon and comma formats: %v", err),
-            })
-            return
-        }
-    }
-    
-    clientMutex.Lock()
-    client := opcuaClient
-    clientMutex.Unlock()
-    
-    if client == nil {
-        http.Error(w, "OPCUA client not connected", http.StatusServiceUnavailable)
-        return
-    }
-    
-    // Read the node value
-    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-    defer cancel()
-    
-    if isVerbose {
-        log.Printf("[%s] Reading node: %v", connectionName, id)
-    }
-    
-    node := client.Node(id)
-    value, err := node.Value(ctx)
-
-    if err != nil {
-        // Check if this might be a DTL node (error indicates ExtensionObject decode failure)
-        if strings.Contains(err.Error(), "extension object") || strings.Contains(err.Error(), "data type id") {
-            // Try reading as DTL
-            dtlValue, dtlErr := readDTLFields(ctx, client, id)
-            if dtlErr == nil {
-                sendJSONResponse(w, NodeResponse{
-                    NodeID: nodeIDStr,
-                    Value:  dtlValue,
-                })
-                return
-            }
-        }
-
-        sendJSONResponse(w, NodeResponse{
-            NodeID: nodeIDStr,
-            Error:  fmt.Sprintf("Failed to read node: %v", err),
-        })
-        return
-    }
-
-    // Return the value
-    sendJSONResponse(w, NodeResponse{
-        NodeID: nodeIDStr,
-        Value:  value.Value(),
-    })
+// serviceConfigDir returns the directory below ~/.config/plccli where this
+// connection keeps the state of a feature, and creates it if needed
+func serviceConfigDir(feature string) (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("could not get user home directory: %v", err)
+	}
+	dir := filepath.Join(homeDir, ".config", "plccli", feature, connectionName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("could not create %s: %v", dir, err)
+	}
+	return dir, nil
 }
 
-func handleBatchNodeRequest(w http.ResponseWriter, r *http.Request) {
-    // Parse the request body
-    var batchRequest struct {
-        Nodes []map[string]string `json:"nodes"`
-    }
-    
-    err := json.NewDecoder(r.Body).Decode(&batchRequest)
-    if err != nil {
-        sendJSONResponseGeneric(w, map[string]interface{}{
-            "error": fmt.Sprintf("Failed to parse request: %v", err),
-        })
-        return
-    }
-    
-    // Validate request
-    if len(batchRequest.Nodes) == 0 {
-        sendJSONResponseGeneric(w, map[string]interface{}{
-            "error": "No nodes specified in request",
-        })
-        return
-    }
-    
-    clientMutex.Lock()
-    client := opcuaClient
-    clientMutex.Unlock()
-    
-    if client == nil {
-        sendJSONResponseGeneric(w, map[string]interface{}{
-            "error": "OPCUA client not connected",
-        })
-        return
-    }
-    
-    // Create context with timeout
-    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-    defer cancel()
-    
-    // Process each node
-    var results []NodeResponse
-    
-    for _, nodeParams := range batchRequest.Nodes {
-        namespace := nodeParams["namespace"]
-        idType := nodeParams["type"]
-        identifier := nodeParams["identifier"]
-        
-        // Validate parameters
-        if namespace == "" || idType == "" || identifier == "" {
-            results = append(results, NodeResponse{
-                NodeID: fmt.Sprintf("ns=%s;%s=%s", namespace, idType, identifier),
-                Error:  "Missing required node parameters",
-            })
-            continue
-        }
-        
-        // Create the node ID
-        nodeIDStr := fmt.Sprintf("ns=%s;%s=%s", namespace, idType, identifier)
-        id, err := ua.ParseNodeID(nodeIDStr)
-        if err != nil {
-            results = append(results, NodeResponse{
-                NodeID: nodeIDStr,
-                Error:  fmt.Sprintf("Invalid node ID: %v", err),
-            })
-            continue
-        }
-        
-        // Read the node value
-        node := client.Node(id)
-        value, err := node.Value(ctx)
-        
-        if err != nil {
-            results = append(results, NodeResponse{
-                NodeID: nodeIDStr,
-                Error:  fmt.Sprintf("Failed to read node: %v", err),
-            })
-        } else {
-            results = append(results, NodeResponse{
-                NodeID: nodeIDStr,
-                Value:  value.Value(),
-            })
-        }
-    }
-    
-    // Send the combined response
-    sendJSONResponseGeneric(w, map[string]interface{}{
-        "results": results,
-    })
+// Default timeouts of the OPC UA operations of an API request
+const (
+	defaultReadTimeout   = 10 * time.Second // reads and writes
+	defaultBrowseTimeout = 30 * time.Second
+)
+
+// Longest timeout an API request may ask for
+const maxRequestTimeout = 10 * time.Minute
+
+// requestTimeout returns the timeout of an API request's OPC UA operations:
+// the timeout field of its body, else its timeout query parameter, else the
+// default. Timeouts are durations like 30s or 500ms, or plain seconds
+func requestTimeout(r *http.Request, bodyTimeout string, def time.Duration) (time.Duration, error) {
+	if bodyTimeout == "" {
+		bodyTimeout = r.URL.Query().Get("timeout")
+	}
+	return parseTimeout(bodyTimeout, def)
 }
 
-func handleNodeWriteRequest(w http.ResponseWriter, r *http.Request) {
-    // Only accept POST requests for writes
-    if r.Method != http.MethodPost {
-        http.Error(w, "Method not allowed, use POST for write operations", http.StatusMethodNotAllowed)
-        return
-    }
-    
-    // Parse the request body
-    var writeRequest struct {
-        Namespace  string      `json:"namespace"`
-        Type       string      `json:"type"`
-        Identifier string      `json:"identifier"`
-        Value      string      `json:"value"`  // Always as string, we'll convert
-        DataType   string      `json:"dataType"` // REQUIRED
-    }
-    
-    err := json.NewDecoder(r.Body).Decode(&writeRequest)
-    if err != nil {
-        sendJSONResponse(w, NodeResponse{
-            Error: fmt.Sprintf("Failed to parse request: %v", err),
-        })
-        return
-    }
-    
-    // Validate required fields
-    if writeRequest.Namespace == "" || writeRequest.Type == "" || writeRequest.Identifier == "" {
-        sendJSONResponse(w, NodeResponse{
-            Error: "Missing required fields: namespace, type, and identifier are required",
-        })
-        return
-    }
-    
-    if writeRequest.DataType == "" {
-        sendJSONResponse(w, NodeResponse{
-            Error: "Data type is required for writing values",
-        })
-        return
-    }
-    
-    // Try both semicolon and comma formats for the node ID
-    var id *ua.NodeID
-    var nodeIDStr string
-    
-    // First try with semicolon (standard format)
-    nodeIDStr = fmt.Sprintf("ns=%s;%s=%s", writeRequest.Namespace, writeRequest.Type, writeRequest.Identifier)
-    if isVerbose {
-        log.Printf("[%s] Trying to parse node ID: %s", connectionName, nodeIDStr)
-    }
-    
-    id, err = ua.ParseNodeID(nodeIDStr)
-    if err != nil {
-        // If semicolon format fails, try comma format
-        nodeIDStr = fmt.Sprintf("ns=%s,%s=%s", writeRequest.Namespace, writeRequest.Type, writeRequest.Identifier)
-        if isVerbose {
-            log.Printf("[%s] Semicolon format failed, trying comma format: %s", connectionName, nodeIDStr)
-        }
-        
-        id, err = ua.ParseNodeID(nodeIDStr)
-        if err != nil {
-            sendJSONResponse(w, NodeResponse{
-                NodeID: nodeIDStr,
-                Error:  fmt.Sprintf("Invalid node ID, tried both semicolon and comma formats: %v", err),
-            })
-            return
-        }
-    }
-    
-    // Get the client
-    clientMutex.Lock()
-    client := opcuaClient
-    clientMutex.Unlock()
-    
-    if client == nil {
-        sendJSONResponse(w, NodeResponse{
-            NodeID: nodeIDStr,
-            Error:  "OPCUA client not connected",
-        })
-        return
-    }
-    
-    // Create context with timeout
-    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-    defer cancel()
-	
-    // Convert the value to the appropriate type based on explicit dataType
-    var variant *ua.Variant
-    
-    switch strings.ToLower(writeRequest.DataType) {
-    case "boolean":
-        boolValue, err := strconv.ParseBool(writeRequest.Value)
-        if err != nil {
-            sendJSONResponse(w, NodeResponse{
-                NodeID: nodeIDStr,
-                Error:  fmt.Sprintf("Invalid boolean value: %v", err),
-            })
-            return
-        }
-        variant, err = ua.NewVariant(boolValue)
-        
-    case "sbyte":
-        intValue, err := strconv.ParseInt(writeRequest.Value, 10, 8)
-        if err != nil {
-            sendJSONResponse(w, NodeResponse{
-                NodeID: nodeIDStr,
-                Error:  fmt.Sprintf("Invalid sbyte value: %v", err),
-            })
-            return
-        }
-        variant, err = ua.NewVariant(int8(intValue))
-        
-    case "byte":
-        uintValue, err := strconv.ParseUint(writeRequest.Value, 10, 8)
-        if err != nil {
-            sendJSONResponse(w, NodeResponse{
-                NodeID: nodeIDStr,
-                Error:  fmt.Sprintf("Invalid byte value: %v", err),
-            })
-            return
-        }
-        variant, err = ua.NewVariant(uint8(uintValue))
-        
-    case "int16":
-        intValue, err := strconv.ParseInt(writeRequest.Value, 10, 16)
-        if err != nil {
-            sendJSONResponse(w, NodeResponse{
-                NodeID: nodeIDStr,
-                Error:  fmt.Sprintf("Invalid int16 value: %v", err),
-            })
-            return
-        }
-        variant, err = ua.NewVariant(int16(intValue))
-        
-    case "uint16":
-        uintValue, err := strconv.ParseUint(writeRequest.Value, 10, 16)
-        if err != nil {
-            sendJSONResponse(w, NodeResponse{
-                NodeID: nodeIDStr,
-                Error:  fmt.Sprintf("Invalid uint16 value: %v", err),
-            })
-            return
-        }
-        variant, err = ua.NewVariant(uint16(uintValue))
-        
-    case "int32":
-        intValue, err := strconv.ParseInt(writeRequest.Value, 10, 32)
-        if err != nil {
-            sendJSONResponse(w, NodeResponse{
-                NodeID: nodeIDStr,
-                Error:  fmt.Sprintf("Invalid int32 value: %v", err),
-            })
-            return
-        }
-        variant, err = ua.NewVariant(int32(intValue))
-        
-    case "uint32":
-        uintValue, err := strconv.ParseUint(writeRequest.Value, 10, 32)
-        if err != nil {
-            sendJSONResponse(w, NodeResponse{
-                NodeID: nodeIDStr,
-                Error:  fmt.Sprintf("Invalid uint32 value: %v", err),
-            })
-            return
-        }
-        variant, err = ua.NewVariant(uint32(uintValue))
-        
-    case "int64":
-        intValue, err := strconv.ParseInt(writeRequest.Value, 10, 64)
-        if err != nil {
-            sendJSONResponse(w, NodeResponse{
-                NodeID: nodeIDStr,
-                Error:  fmt.Sprintf("Invalid int64 value: %v", err),
-            })
-            return
-        }
-        variant, err = ua.NewVariant(intValue)
-        
-    case "uint64":
-        uintValue, err := strconv.ParseUint(writeRequest.Value, 10, 64)
-        if err != nil {
-            sendJSONResponse(w, NodeResponse{
-                NodeID: nodeIDStr,
-                Error:  fmt.Sprintf("Invalid uint64 value: %v", err),
-            })
-            return
-        }
-        variant, err = ua.NewVariant(uintValue)
-        
-    case "float":
-        floatValue, err := strconv.ParseFloat(writeRequest.Value, 32)
-        if err != nil {
-            sendJSONResponse(w, NodeResponse{
-                NodeID: nodeIDStr,
-                Error:  fmt.Sprintf("Invalid float value: %v", err),
-            })
-            return
-        }
-        variant, err = ua.NewVariant(float32(floatValue))
-        
-    case "double":
-        doubleValue, err := strconv.ParseFloat(writeRequest.Value, 64)
-        if err != nil {
-            sendJSONResponse(w, NodeResponse{
-                NodeID: nodeIDStr,
-                Error:  fmt.Sprintf("Invalid double value: %v", err),
-            })
-            return
-        }
-        variant, err = ua.NewVariant(doubleValue)
-        
-    case "string":
-        variant, err = ua.NewVariant(writeRequest.Value)
-
-    case "dtl":
-        year, month, day, weekday, hour, minute, second, nanosecond, err := parseDTL(writeRequest.Value)
-        if err != nil {
-            sendJSONResponse(w, NodeResponse{
-                NodeID: nodeIDStr,
-                Error:  fmt.Sprintf("Invalid DTL format: %v", err),
-            })
-            return
-        }
-
-        // Write DTL by setting individual child fields
-        err = writeDTLFields(ctx, client, id, year, month, day, weekday, hour, minute, second, nanosecond)
-        if err != nil {
-            sendJSONResponse(w, NodeResponse{
-                NodeID: nodeIDStr,
-                Error:  fmt.Sprintf("Failed to write DTL: %v", err),
-            })
-            return
-        }
-
-        // DTL write succeeded, return success
-        sendJSONResponse(w, NodeResponse{
-            NodeID: nodeIDStr,
-            Value:  writeRequest.Value,
-        })
-        return
-
-    default:
-        sendJSONResponse(w, NodeResponse{
-            NodeID: nodeIDStr,
-            Error:  fmt.Sprintf("Unsupported data type: %s. Use one of: boolean, sbyte, byte, int16, uint16, int32, uint32, int64, uint64, float, double, string, dtl", writeRequest.DataType),
-        })
-        return
-    }
-    
-    if err != nil {
-        sendJSONResponse(w, NodeResponse{
-            NodeID: nodeIDStr,
-            Error:  fmt.Sprintf("Failed to create variant: %v", err),
-        })
-        return
-    }
-    
-    // Create a proper write request following the example
-    req := &ua.WriteRequest{
-        NodesToWrite: []*ua.WriteValue{
-            {
-                NodeID:      id,
-                AttributeID: ua.AttributeIDValue,
-                Value: &ua.DataValue{
-                    EncodingMask: ua.DataValueValue,
-                    Value:        variant,
-                },
-            },
-        },
-    }
-    
-    // Execute the write operation
-    resp, err := client.Write(ctx, req)
-    if err != nil {
-        sendJSONResponse(w, NodeResponse{
-            NodeID: nodeIDStr,
-            Error:  fmt.Sprintf("Failed to write value: %v", err),
-        })
-        return
-    }
-    
-    // Check write result
-    if resp.Results[0] != ua.StatusOK {
-        sendJSONResponse(w, NodeResponse{
-            NodeID: nodeIDStr,
-            Error:  fmt.Sprintf("Write operation failed with status: %v", resp.Results[0]),
-        })
-        return
-    }
-    
-    // Return success response
-    sendJSONResponse(w, NodeResponse{
-        NodeID: nodeIDStr,
-        Value:  writeRequest.Value,
-    })
+// parseTimeout parses the timeout of a request, def when it is empty
+func parseTimeout(value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if seconds, convErr := strconv.ParseFloat(value, 64); convErr == nil {
+		timeout, err = time.Duration(seconds*float64(time.Second)), nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout %q: use a duration like 30s", value)
+	}
+	if timeout <= 0 || timeout > maxRequestTimeout {
+		return 0, fmt.Errorf("timeout %v must be greater than 0 and at most %v", timeout, maxRequestTimeout)
+	}
+	return timeout, nil
+}
+
+// errorStatus returns the OPC UA status code of a failed read or write for
+// NodeResponse.StatusCode, 0 when the error carries none
+func errorStatus(err error) uint32 {
+	var code ua.StatusCode
+	if errors.As(err, &code) {
+		return uint32(code)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return uint32(ua.StatusBadTimeout)
+	}
+	return 0
 }
 
 func sendJSONResponse(w http.ResponseWriter, response NodeResponse) {
@@ -1061,89 +1886,229 @@ func sendJSONResponse(w http.ResponseWriter, response NodeResponse) {
 
 // Generic JSON response function
 func sendJSONResponseGeneric(w http.ResponseWriter, response interface{}) {
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(response)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
 
-
 func handleBrowseRequest(w http.ResponseWriter, r *http.Request) {
-    // Get parameters
-    nodeIDStr := r.URL.Query().Get("nodeid")
-    if nodeIDStr == "" {
-        nodeIDStr = "i=84" // Default to Objects folder
-    }
-
-    nodeIDStr = strings.Replace(nodeIDStr, ",", ";", 1)
-
-    maxDepthStr := r.URL.Query().Get("maxdepth")
-    maxDepth := 10 // Default
-    if maxDepthStr != "" {
-        if depth, err := strconv.Atoi(maxDepthStr); err == nil {
-            maxDepth = depth
-        }
-    }
-    
-    clientMutex.Lock()
-    client := opcuaClient
-    clientMutex.Unlock()
-    
-    if client == nil {
-        http.Error(w, "OPCUA client not connected", http.StatusServiceUnavailable)
-        return
-    }
-    
-    // Create context with timeout
-    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-    defer cancel()
-    
-    // Perform browse operation
-    nodes, err := doBrowse(ctx, client, nodeIDStr, maxDepth)
-    if err != nil {
-        sendJSONResponseGeneric(w, map[string]interface{}{
-            "error": fmt.Sprintf("Browse failed: %v", err),
-        })
-        return
-    }
-    
-    // Convert NodeInfo to JSON-friendly format
-    result := make([]map[string]interface{}, len(nodes))
-    for i, node := range nodes {
-        result[i] = map[string]interface{}{
-            "nodeId":      node.NodeID.String(),
-            "browseName":  node.BrowseName,
-            "path":        node.Path,
-            "dataType":    node.DataType,
-            "writable":    node.Writable,
-            "description": node.Description,
-        }
-    }
-    
-    // Send response
-    sendJSONResponseGeneric(w, map[string]interface{}{
-        "nodes": result,
-    })
-}
+	// Get parameters
+	nodeIDStr := r.URL.Query().Get("nodeid")
+	if nodeIDStr == "" {
+		nodeIDStr = "i=84" // Default to Objects folder
+	}
+
+	nodeIDStr = strings.Replace(nodeIDStr, ",", ";", 1)
+
+	maxDepthStr := r.URL.Query().Get("maxdepth")
+	maxDepth := 10 // Default
+	if maxDepthStr != "" {
+		if depth, err := strconv.Atoi(maxDepthStr); err == nil {
+			maxDepth = depth
+		}
+	}
+
+	// Pages of limit variables; the continuation token of a page replaces
+	// nodeid and maxdepth of the next
+	limit := 0
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		n, err := strconv.Atoi(limitStr)
+		if err != nil || n < 1 || n > maxBrowsePage {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": fmt.Sprintf("invalid limit %q, must be 1-%d", limitStr, maxBrowsePage),
+			})
+			return
+		}
+		limit = n
+	}
+	cursor := newBrowseCursor(nodeIDStr, maxDepth)
+	if token := r.URL.Query().Get("continuation"); token != "" {
+		var err error
+		if cursor, err = parseBrowseToken(token); err != nil {
+			sendJSONResponseGeneric(w, map[string]interface{}{
+				"error": err.Error(),
+			})
+			return
+		}
+		nodeIDStr = cursor.Start
+	}
+
+	clientMutex.Lock()
+	client := opcuaClient
+	clientMutex.Unlock()
+
+	if client == nil {
+		http.Error(w, "OPCUA client not connected", http.StatusServiceUnavailable)
+		return
+	}
+
+	timeout, err := requestTimeout(r, "", defaultBrowseTimeout)
+	if err != nil {
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Create context with timeout
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Register the browse so it can be cancelled with DELETE /api/operations/<id>
+	opID, ctx := serviceOperations.start(ctx, "browse", nodeIDStr, tenantIdentity(r))
+	defer serviceOperations.done(opID)
+	w.Header().Set(operationIDHeader, opID)
+
+	// Perform browse operation, one page of it with limit, resumed from the
+	// position of a continuation token
+	nodes, err := browsePage(ctx, client, cursor, limit, nil)
+	if err != nil {
+		if ctx.Err() == context.Canceled {
+			err = fmt.Errorf("browse %s was cancelled", opID)
+		}
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"error": fmt.Sprintf("Browse failed: %v", err),
+		})
+		return
+	}
 
+	// Send response
+	response := map[string]interface{}{
+		"nodes": browseResultNodes(nodes),
+	}
+	if !cursor.done() {
+		response["continuation"] = cursor.token()
+	}
+	sendJSONResponseGeneric(w, response)
+}
 
+// browseResultNodes converts NodeInfo to the JSON-friendly browse format
+func browseResultNodes(nodes []NodeInfo) []map[string]interface{} {
+	result := make([]map[string]interface{}, len(nodes))
+	for i, node := range nodes {
+		result[i] = map[string]interface{}{
+			"nodeId":      node.NodeID.String(),
+			"browseName":  node.BrowseName,
+			"path":        node.Path,
+			"dataType":    node.DataType,
+			"writable":    node.Writable,
+			"description": node.Description,
+		}
+	}
+	return result
+}
 
 // Helper function to add at the end of the file
 func getTokenTypes(tokens []*ua.UserTokenPolicy) []string {
-    var types []string
-    for _, t := range tokens {
-        switch t.TokenType {
-        case ua.UserTokenTypeAnonymous:
-            types = append(types, "Anonymous")
-        case ua.UserTokenTypeUserName:
-            types = append(types, "Username")
-        case ua.UserTokenTypeCertificate:
-            types = append(types, "Certificate")
-        case ua.UserTokenTypeIssuedToken:
-            types = append(types, "IssuedToken")
-        default:
-            types = append(types, fmt.Sprintf("Unknown(%d)", t.TokenType))
-        }
-    }
-    return types
+	var types []string
+	for _, t := range tokens {
+		switch t.TokenType {
+		case ua.UserTokenTypeAnonymous:
+			types = append(types, "Anonymous")
+		case ua.UserTokenTypeUserName:
+			types = append(types, "Username")
+		case ua.UserTokenTypeCertificate:
+			types = append(types, "Certificate")
+		case ua.UserTokenTypeIssuedToken:
+			types = append(types, "IssuedToken")
+		default:
+			types = append(types, fmt.Sprintf("Unknown(%d)", t.TokenType))
+		}
+	}
+	return types
+}
+
+// parseAttributeID resolves an attribute name like "Value", "DisplayName" or
+// "Description" (case-insensitive) to its OPC UA attribute ID
+// An empty name selects the Value attribute
+func parseAttributeID(name string) (ua.AttributeID, error) {
+	if name == "" {
+		return ua.AttributeIDValue, nil
+	}
+	for attr := ua.AttributeIDNodeID; attr <= ua.AttributeIDAccessLevelEx; attr++ {
+		if strings.EqualFold(name, attributeName(attr)) {
+			return attr, nil
+		}
+	}
+	return ua.AttributeIDInvalid, fmt.Errorf("unknown attribute: %s. Use e.g. Value, DisplayName, Description, WriteMask, AccessLevel", name)
+}
+
+// attributeName returns the short name of an attribute ID, e.g. "DisplayName"
+func attributeName(attr ua.AttributeID) string {
+	return strings.TrimPrefix(attr.String(), "AttributeID")
+}
+
+// defaultAttributeDataType returns the data type implied by an attribute, so
+// text attributes like Description can be written without an explicit type
+func defaultAttributeDataType(attribute string) string {
+	attr, err := parseAttributeID(attribute)
+	if err != nil {
+		return ""
+	}
+	switch attr {
+	case ua.AttributeIDDisplayName, ua.AttributeIDDescription, ua.AttributeIDInverseName:
+		return "localizedtext"
+	}
+	return ""
+}
+
+// readNodeDataType reads the DataType attribute of a node and returns the
+// matching write data type name (e.g. "int16")
+func readNodeDataType(ctx context.Context, client *opcua.Client, nodeID *ua.NodeID) (string, error) {
+	attrs, err := client.Node(nodeID).Attributes(ctx, ua.AttributeIDDataType)
+	if err != nil {
+		return "", err
+	}
+	if len(attrs) == 0 || attrs[0].Status != ua.StatusOK {
+		return "", fmt.Errorf("DataType attribute not readable")
+	}
+
+	dataTypeID := attrs[0].Value.NodeID()
+	if dataTypeID == nil {
+		return "", fmt.Errorf("DataType attribute is empty")
+	}
+
+	dataType, ok := dataTypeNameForID(dataTypeID)
+	if !ok {
+		return "", fmt.Errorf("unsupported data type %s", dataTypeID)
+	}
+	return dataType, nil
+}
+
+// dataTypeNameForID maps a built-in OPC UA data type node ID to the data type
+// names accepted by write requests
+func dataTypeNameForID(dataTypeID *ua.NodeID) (string, bool) {
+	if dataTypeID.Namespace() != 0 {
+		return "", false
+	}
+	switch dataTypeID.IntID() {
+	case id.Boolean:
+		return "boolean", true
+	case id.SByte:
+		return "sbyte", true
+	case id.Byte:
+		return "byte", true
+	case id.Int16:
+		return "int16", true
+	case id.UInt16:
+		return "uint16", true
+	case id.Int32:
+		return "int32", true
+	case id.UInt32:
+		return "uint32", true
+	case id.Int64:
+		return "int64", true
+	case id.UInt64:
+		return "uint64", true
+	case id.Float:
+		return "float", true
+	case id.Double:
+		return "double", true
+	case id.String:
+		return "string", true
+	case id.LocalizedText:
+		return "localizedtext", true
+	}
+	return "", false
 }
 
 // parseDTL parses ISO 8601 datetime string to custom OPC_DTL components
@@ -1260,17 +2225,13 @@ func writeDTLFields(ctx context.Context, client *opcua.Client, parentID *ua.Node
 	}
 
 	// Execute the batch write operation
-	req := &ua.WriteRequest{
-		NodesToWrite: writeValues,
-	}
-
-	resp, err := client.Write(ctx, req)
+	results, err := writeNodeValues(ctx, client, writeValues)
 	if err != nil {
 		return fmt.Errorf("failed to write DTL fields: %v", err)
 	}
 
 	// Check all write results
-	for i, status := range resp.Results {
+	for i, status := range results {
 		if status != ua.StatusOK {
 			fieldNames := []string{"YEAR", "MONTH", "DAY", "WEEKDAY", "HOUR", "MINUTE", "SECOND", "NANOSECOND"}
 			return fmt.Errorf("failed to write %s field: %v", fieldNames[i], status)
@@ -1299,7 +2260,7 @@ func readDTLFields(ctx context.Context, client *opcua.Client, parentID *ua.NodeI
 		},
 	}
 
-	resp, err := client.Read(ctx, req)
+	resp, err := readOPCUA(ctx, client, req)
 	if err != nil {
 		return "", fmt.Errorf("failed to read DTL fields: %v", err)
 	}
@@ -1329,4 +2290,4 @@ func mustVariant(v *ua.Variant, err error) *ua.Variant {
 		panic(err)
 	}
 	return v
-}
\ No newline at end of file
+}
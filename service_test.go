@@ -1,9 +1,16 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/gopcua/opcua/id"
 	"github.com/gopcua/opcua/ua"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -233,3 +240,248 @@ func TestBooleanEndToEndParsing(t *testing.T) {
 		})
 	}
 }
+
+// TestParseAttributeID tests resolving attribute names for generalized writes
+func TestParseAttributeID(t *testing.T) {
+	tests := []struct {
+		name    string
+		attr    string
+		want    ua.AttributeID
+		wantErr bool
+	}{
+		{name: "empty defaults to Value", attr: "", want: ua.AttributeIDValue},
+		{name: "Value", attr: "Value", want: ua.AttributeIDValue},
+		{name: "DisplayName", attr: "DisplayName", want: ua.AttributeIDDisplayName},
+		{name: "case insensitive", attr: "description", want: ua.AttributeIDDescription},
+		{name: "AccessLevel", attr: "AccessLevel", want: ua.AttributeIDAccessLevel},
+		{name: "unknown attribute", attr: "Colour", wantErr: true},
+		{name: "Invalid is not writable", attr: "Invalid", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAttributeID(tt.attr)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// TestDefaultAttributeDataType tests that text attributes imply localizedtext
+func TestDefaultAttributeDataType(t *testing.T) {
+	assert.Equal(t, "localizedtext", defaultAttributeDataType("Description"))
+	assert.Equal(t, "localizedtext", defaultAttributeDataType("displayname"))
+	assert.Equal(t, "", defaultAttributeDataType("Value"))
+	assert.Equal(t, "", defaultAttributeDataType(""))
+	assert.Equal(t, "", defaultAttributeDataType("WriteMask"))
+}
+
+// TestDataTypeNameForID tests mapping DataType attributes to write data types for --auto-type
+func TestDataTypeNameForID(t *testing.T) {
+	tests := []struct {
+		name   string
+		nodeID *ua.NodeID
+		want   string
+		wantOK bool
+	}{
+		{name: "Boolean", nodeID: ua.NewNumericNodeID(0, id.Boolean), want: "boolean", wantOK: true},
+		{name: "Int16", nodeID: ua.NewNumericNodeID(0, id.Int16), want: "int16", wantOK: true},
+		{name: "Int32", nodeID: ua.NewNumericNodeID(0, id.Int32), want: "int32", wantOK: true},
+		{name: "UInt32", nodeID: ua.NewNumericNodeID(0, id.UInt32), want: "uint32", wantOK: true},
+		{name: "Float", nodeID: ua.NewNumericNodeID(0, id.Float), want: "float", wantOK: true},
+		{name: "Double", nodeID: ua.NewNumericNodeID(0, id.Double), want: "double", wantOK: true},
+		{name: "String", nodeID: ua.NewNumericNodeID(0, id.String), want: "string", wantOK: true},
+		{name: "DateTime is not writable by name", nodeID: ua.NewNumericNodeID(0, id.DateTime), wantOK: false},
+		{name: "custom struct type", nodeID: ua.NewNumericNodeID(3, 3002), wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := dataTypeNameForID(tt.nodeID)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// TestSetResponseTimestamps tests that only supplied timestamps are returned
+func TestSetResponseTimestamps(t *testing.T) {
+	source := time.Date(2025, 3, 9, 14, 30, 0, 0, time.UTC)
+
+	var response NodeResponse
+	setResponseTimestamps(&response, &ua.DataValue{SourceTimestamp: source})
+	require.NotNil(t, response.SourceTimestamp)
+	assert.Equal(t, source, *response.SourceTimestamp)
+	assert.Nil(t, response.ServerTimestamp, "zero server timestamp should be omitted")
+}
+
+// TestRequestedNodeID tests that read results echo the node IDs as requested
+func TestRequestedNodeID(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	connectMock(t, ctx)
+
+	rec := httptest.NewRecorder()
+	handleNodeRequest(rec, httptest.NewRequest("GET", "/api/node?namespace="+url.QueryEscape(mockNamespaceURI)+"&type=s&identifier=Name", nil))
+	var single NodeResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &single))
+	assert.Equal(t, "nsu="+mockNamespaceURI+";s=Name", single.RequestedNodeID)
+
+	body := `{"nodes": [
+		{"namespace": "` + mockNamespaceURI + `", "type": "s", "identifier": "Name", "nodeID": "nsu=` + mockNamespaceURI + `;s=Name"},
+		{"namespace": "2", "type": "s", "identifier": "Counter", "nodeID": "ns=2,s=Counter"},
+		{"namespace": "0", "type": "i", "identifier": "2258"},
+		{"namespace": "", "type": "s", "identifier": "Missing", "nodeID": "s=Missing"}
+	]}`
+	rec = httptest.NewRecorder()
+	handleBatchNodeRequest(rec, httptest.NewRequest("POST", "/api/nodes", strings.NewReader(body)))
+	var batch struct {
+		Results []NodeResponse `json:"results"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &batch))
+	require.Len(t, batch.Results, 4)
+	assert.Equal(t, "nsu="+mockNamespaceURI+";s=Name", batch.Results[0].RequestedNodeID)
+	assert.Equal(t, "ns=2,s=Counter", batch.Results[1].RequestedNodeID)
+	assert.Equal(t, "ns=2;s=Counter", batch.Results[1].NodeID)
+	assert.Equal(t, "ns=0;i=2258", batch.Results[2].RequestedNodeID, "built from the parts without nodeID")
+	assert.Equal(t, "s=Missing", batch.Results[3].RequestedNodeID)
+	assert.NotEmpty(t, batch.Results[3].Error)
+}
+
+// TestBatchNodeRequest tests that a batch with good nodes, invalid node
+// parameters and nodes the PLC does not know is read in one read request per
+// MaxNodesPerRead nodes, with the results in the order of the request
+func TestBatchNodeRequest(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	connectMock(t, ctx)
+	defer func() { serviceFaults = nil }()
+
+	node := func(identifier string) string {
+		return `{"namespace": "` + mockNamespaceURI + `", "type": "s", "identifier": "` + identifier + `"}`
+	}
+	body := `{"fresh": true, "nodes": [` + strings.Join([]string{
+		node("Name"),
+		`{"namespace": "", "type": "s", "identifier": "Name"}`,
+		node("Missing"),
+		node("Temperature"),
+		node("Running"),
+	}, ",") + `]}`
+	read := func() []NodeResponse {
+		rec := httptest.NewRecorder()
+		handleBatchNodeRequest(rec, httptest.NewRequest("POST", "/api/nodes", strings.NewReader(body)))
+		var batch struct {
+			Results []NodeResponse `json:"results"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &batch))
+		require.Len(t, batch.Results, 5)
+		return batch.Results
+	}
+	check := func(results []NodeResponse) {
+		assert.Equal(t, "nsu="+mockNamespaceURI+";s=Name", results[0].RequestedNodeID)
+		assert.Equal(t, "press-1", results[0].Value)
+		assert.Empty(t, results[0].Error)
+		assert.Equal(t, "Missing required node parameters", results[1].Error)
+		assert.Equal(t, "nsu="+mockNamespaceURI+";s=Missing", results[2].RequestedNodeID)
+		assert.Equal(t, uint32(ua.StatusBadNodeIDUnknown), results[2].StatusCode)
+		assert.Contains(t, results[2].Error, "Failed to read node")
+		assert.Nil(t, results[2].Value)
+		assert.InDelta(t, 21.5, results[3].Value, 2)
+		assert.Empty(t, results[3].Error)
+		assert.Equal(t, true, results[4].Value)
+	}
+	check(read())
+
+	// Every response dropped fails the whole request, which has all nodes:
+	// the good ones and the one the PLC does not know fail together
+	serviceFaults = newFaultInjector()
+	serviceFaults.drop = 10
+	results := read()
+	assert.Equal(t, 1, serviceFaults.state().Dropped, "one read request")
+	for _, i := range []int{0, 2, 3, 4} {
+		assert.Equal(t, uint32(ua.StatusBadTimeout), results[i].StatusCode, i)
+	}
+	assert.Equal(t, "Missing required node parameters", results[1].Error)
+
+	serviceFaults = nil
+
+	// Above MaxNodesPerRead the batch is split, the order is kept
+	limits := serviceLimits.get()
+	limits.MaxNodesPerRead = 2
+	serviceLimits.set(limits)
+	check(read())
+}
+
+// TestRequestTimeout tests the timeout parameter of API requests
+func TestRequestTimeout(t *testing.T) {
+	timeout := func(query, body string) (time.Duration, error) {
+		return requestTimeout(httptest.NewRequest("GET", "/api/node?"+query, nil), body, defaultReadTimeout)
+	}
+
+	d, err := timeout("", "")
+	require.NoError(t, err)
+	assert.Equal(t, defaultReadTimeout, d)
+
+	d, err = timeout("timeout=2m", "")
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Minute, d)
+
+	d, err = timeout("timeout=2m", "500ms")
+	require.NoError(t, err)
+	assert.Equal(t, 500*time.Millisecond, d, "the body wins")
+
+	d, err = timeout("timeout=1.5", "")
+	require.NoError(t, err)
+	assert.Equal(t, 1500*time.Millisecond, d, "plain seconds")
+
+	for _, invalid := range []string{"soon", "0", "-1s", "1h"} {
+		_, err = timeout("timeout="+invalid, "")
+		assert.Error(t, err, invalid)
+	}
+}
+
+// TestWriteDryRun tests that a dry run converts the value without writing it
+func TestWriteDryRun(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	client := connectMock(t, ctx)
+
+	write := func(body string) NodeResponse {
+		rec := httptest.NewRecorder()
+		handleNodeWriteRequest(rec, httptest.NewRequest("POST", "/api/node", strings.NewReader(body)))
+		var resp NodeResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return resp
+	}
+	node := `"namespace": "` + mockNamespaceURI + `", "type": "s", "identifier": "Setpoint"`
+
+	resp := write(`{` + node + `, "value": "22.25", "dataType": "auto", "dryRun": true}`)
+	require.Empty(t, resp.Error)
+	assert.Equal(t, 22.25, resp.Value)
+	assert.Equal(t, "float", resp.DataType, "the resolved data type")
+
+	resp = write(`{` + node + `, "value": "New text", "dataType": "localizedtext", "attribute": "Description", "dryRun": true}`)
+	require.Empty(t, resp.Error)
+	assert.Equal(t, "New text", resp.Value)
+
+	resp = write(`{` + node + `, "value": "warm", "dataType": "float", "dryRun": true}`)
+	assert.Contains(t, resp.Error, "Invalid float value")
+	assert.Equal(t, exitTypeError, exitCode(resp.Err()))
+
+	// Decimal commas as European operators type them
+	resp = write(`{` + node + `, "value": "22,75", "dataType": "float", "dryRun": true}`)
+	require.Empty(t, resp.Error)
+	assert.Equal(t, 22.75, resp.Value)
+	resp = write(`{` + node + `, "value": "1,250", "dataType": "float", "dryRun": true}`)
+	assert.Equal(t, `Invalid float value: "1,250" is ambiguous: write 1.250 for a decimal or 1250 for a whole number`, resp.Error)
+
+	setpoint, err := resolveNodeID("nsu=" + mockNamespaceURI + ";s=Setpoint")
+	require.NoError(t, err)
+	values, err := readNodeDataValues(ctx, client, []*ua.NodeID{setpoint})
+	require.NoError(t, err)
+	assert.NotEqual(t, float32(22.25), values[0].Value.Value(), "nothing was written")
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+)
+
+// Retry writes the server rejected because their session was invalidated,
+// from --retry-session-writes
+var retrySessionWrites bool
+
+// Reconnects asked for by writes that found the session invalid, handled by
+// the keep-alive loop of the service. A pending reconnect covers all writes
+var sessionReconnects = make(chan error, 1)
+
+// isSessionInvalid reports whether a request was rejected because the
+// server no longer knows its session, e.g. after a PLC restart. The server
+// has not carried out such a request, so it can be sent again
+func isSessionInvalid(err error) bool {
+	return errors.Is(err, ua.StatusBadSessionIDInvalid) || errors.Is(err, ua.StatusBadSessionClosed)
+}
+
+// renewSession has the service reconnect and waits for the new session, at
+// most until the context of the request ends
+func renewSession(ctx context.Context, old *opcua.Client, cause error) (*opcua.Client, error) {
+	select {
+	case sessionReconnects <- cause:
+	default: // A reconnect is already pending
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		clientMutex.Lock()
+		client := opcuaClient
+		clientMutex.Unlock()
+		if client != nil && client != old {
+			return client, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%v, no new session before the timeout", cause)
+		case <-ticker.C:
+		}
+	}
+}
+
+// retryWrite sends a write that failed with an invalid session once more on
+// a new session
+func retryWrite(ctx context.Context, client *opcua.Client, req *ua.WriteRequest, cause error) (*ua.WriteResponse, error) {
+	log.Printf("[%s] Write of %d nodes rejected (%v), retrying on a new session", connectionName, len(req.NodesToWrite), cause)
+	client, err := renewSession(ctx, client, cause)
+	if err != nil {
+		return nil, err
+	}
+	return writeOPCUAOnce(ctx, client, req)
+}
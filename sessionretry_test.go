@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRetrySessionWrites tests that a write rejected for an invalid session
+// is sent again after the service reconnected, and only with the option
+func TestRetrySessionWrites(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	t.Setenv("HOME", t.TempDir())
+	serverCtx, stop := context.WithCancel(context.Background())
+	m, err := startMockServer(serverCtx)
+	require.NoError(t, err)
+	require.NoError(t, connectOPCUA(ctx, m.endpoint, "", "", "cert.pem", "key.pem", false, "", 10))
+	serviceFaults = newFaultInjector()
+	t.Cleanup(func() {
+		closeOPCUA()
+		stop()
+		serviceFaults = nil
+		retrySessionWrites = false
+		serviceNamespaces = &namespaceTable{}
+		serviceLimits = &limitsTable{limits: defaultOperationLimits()}
+	})
+
+	name, err := resolveNodeID("nsu=" + mockNamespaceURI + ";s=Name")
+	require.NoError(t, err)
+	write := func(v string) error {
+		clientMutex.Lock()
+		client := opcuaClient
+		clientMutex.Unlock()
+		_, err := writeOPCUA(ctx, client, &ua.WriteRequest{NodesToWrite: []*ua.WriteValue{{
+			NodeID:      name,
+			AttributeID: ua.AttributeIDValue,
+			Value:       &ua.DataValue{EncodingMask: ua.DataValueValue, Value: ua.MustVariant(v)},
+		}}})
+		return err
+	}
+
+	// Without the option the rejection reaches the caller
+	serviceFaults.rejectWrites = 1
+	assert.ErrorIs(t, write("press-2"), ua.StatusBadSessionIDInvalid)
+
+	// The keep-alive loop of the service does the reconnect
+	retrySessionWrites = true
+	go func() {
+		select {
+		case <-sessionReconnects:
+			reconnectOPCUA(ctx, m.endpoint, "", "", "cert.pem", "key.pem", false, "", 10)
+		case <-ctx.Done():
+		}
+	}()
+	clientMutex.Lock()
+	before := opcuaClient
+	clientMutex.Unlock()
+	serviceFaults.rejectWrites = 1
+	require.NoError(t, write("press-3"))
+	assert.Equal(t, "press-3", m.get("Name"))
+	clientMutex.Lock()
+	assert.NotSame(t, before, opcuaClient, "the write was sent on a new session")
+	clientMutex.Unlock()
+
+	// A bit write waits for the new session without holding the client, which
+	// the reconnect has to replace, and reads the word again on it: the PLC
+	// set bit 10 while the session was down
+	go func() {
+		select {
+		case <-sessionReconnects:
+			m.set("Alarms", uint16(0x0481))
+			reconnectOPCUA(ctx, m.endpoint, "", "", "cert.pem", "key.pem", false, "", 10)
+		case <-ctx.Done():
+		}
+	}()
+	serviceFaults.rejectWrites = 1
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleBitWriteRequest(rec, httptest.NewRequest("POST", "/api/bit",
+			strings.NewReader(`{"namespace": "`+mockNamespaceURI+`", "type": "s", "identifier": "Alarms", "bit": 1, "value": 1, "timeout": "10s"}`)))
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		t.Fatal("the bit write did not return")
+	}
+	var resp NodeResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Empty(t, resp.Error)
+	assert.Equal(t, uint16(0x0483), m.get("Alarms"), "bit 10 kept")
+	assert.Equal(t, float64(0x0483), resp.Value)
+
+	// Other errors are not retried
+	assert.False(t, isSessionInvalid(ua.StatusBadTimeout))
+	assert.True(t, isSessionInvalid(ua.StatusBadSessionClosed))
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"umicli/pkg/plcclient"
+)
+
+// Commands of plccli shell, for help and completion
+var shellCommands = []struct{ name, args, about string }{
+	{"get", "<node-id|@group> [node-id ...]", "Read the values of nodes"},
+	{"set", "<node-id> <value> [data-type]", "Write a value, of the node's data type unless given"},
+	{"browse", "[node-id] [max-depth]", "Browse the node tree (Objects folder, 3 levels deep by default)"},
+	{"monitor", "<node-id> [node-id ...]", "Show a table of values refreshed every interval until ctrl-c"},
+	{"use", "[connection]", "Show or switch the connection of the commands"},
+	{"format", "[default|influx|json]", "Show or set the output format"},
+	{"interval", "[duration]", "Show or set the refresh interval of monitor"},
+	{"history", "", "List the commands entered"},
+	{"help", "", "List the commands"},
+	{"exit", "", "Leave the shell, like ctrl-d"},
+}
+
+// Lines of history kept in the history file
+const shellHistorySize = 1000
+
+// shellSession is plccli shell: commands read from a prompt or a script run
+// against the service of the selected connection, without starting plccli
+// and typing the flags for each
+type shellSession struct {
+	host       string
+	basePort   int // --port, the port of the default connection
+	connection string
+	port       int
+	format     string
+	interval   time.Duration // of monitor
+	influxOpts influxOptions
+
+	history     []string
+	historyFile string   // Empty to not keep the history
+	completions []string // Node IDs of the browse cache, loaded on the first tab
+	out         io.Writer
+}
+
+func newShellSession(host string, basePort int, connection string, influxOpts influxOptions, out io.Writer) *shellSession {
+	return &shellSession{
+		host:       host,
+		basePort:   basePort,
+		connection: connection,
+		port:       getPortForConnection(connection, basePort),
+		format:     "default",
+		interval:   defaultWatchInterval,
+		influxOpts: influxOpts,
+		out:        out,
+	}
+}
+
+// runShell runs plccli shell: with a line editor on a terminal, otherwise
+// the commands of stdin, one per line
+func runShell(s *shellSession) error {
+	// Ctrl-c ends monitor or clears the line, not the shell
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return s.script(os.Stdin)
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		s.historyFile = filepath.Join(home, ".config", "plccli", "shell_history")
+		if data, err := os.ReadFile(s.historyFile); err == nil {
+			s.history = strings.Split(strings.TrimSpace(string(data)), "\n")
+		}
+	}
+	fmt.Fprintf(s.out, "plccli %s shell, connection %s (%s:%d). Type help for the commands, ctrl-d to leave.\n", buildVersion, s.connection, s.host, s.port)
+
+	keys := make(chan string)
+	go readTUIKeys(os.Stdin, keys)
+	for {
+		// Raw mode only while editing, commands print as usual
+		restore, err := rawTerminal()
+		if err != nil {
+			return err
+		}
+		line, ok := s.readLine(keys)
+		restore()
+		if !ok {
+			return nil
+		}
+		s.remember(line)
+		if s.exec(line) {
+			return nil
+		}
+	}
+}
+
+// script runs the commands of r, one per line, until its end or exit
+func (s *shellSession) script(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if s.exec(scanner.Text()) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// prompt is the prompt of the line editor, with the connection
+func (s *shellSession) prompt() string {
+	return "plccli " + s.connection + "> "
+}
+
+// readLine edits a line with the keys of a raw terminal. It returns false
+// on ctrl-d on an empty line or when the keys end
+func (s *shellSession) readLine(keys <-chan string) (string, bool) {
+	e := &lineEditor{prompt: s.prompt(), history: s.history, pos: len(s.history), complete: s.complete}
+	io.WriteString(s.out, e.render())
+	for k := range keys {
+		line, done, ok := e.key(k)
+		if e.listing != nil {
+			// Completions of an ambiguous word below the line
+			fmt.Fprintf(s.out, "\r\n%s\r\n", strings.Join(e.listing, "  "))
+			e.listing = nil
+		}
+		if !ok {
+			io.WriteString(s.out, "\r\n")
+			return "", false
+		}
+		io.WriteString(s.out, e.render())
+		if done {
+			io.WriteString(s.out, "\r\n")
+			return line, true
+		}
+	}
+	return "", false
+}
+
+// remember adds a line to the history and its file
+func (s *shellSession) remember(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || len(s.history) > 0 && s.history[len(s.history)-1] == line {
+		return
+	}
+	s.history = append(s.history, line)
+	if len(s.history) > shellHistorySize {
+		s.history = s.history[len(s.history)-shellHistorySize:]
+	}
+	if s.historyFile != "" {
+		os.MkdirAll(filepath.Dir(s.historyFile), 0700)
+		os.WriteFile(s.historyFile, []byte(strings.Join(s.history, "\n")+"\n"), 0600)
+	}
+}
+
+// complete returns the completions of the word at the cursor: commands for
+// the first word, node IDs of the browse cache for the others
+func (s *shellSession) complete(word string, first bool) []string {
+	var candidates []string
+	if first {
+		for _, c := range shellCommands {
+			candidates = append(candidates, c.name)
+		}
+	} else {
+		if s.completions == nil {
+			s.completions = s.cachedNodeIDs()
+		}
+		candidates = s.completions
+	}
+	var matches []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, word) {
+			matches = append(matches, c)
+		}
+	}
+	return matches
+}
+
+// cachedNodeIDs returns the node IDs of the browse cache of the connection,
+// written like get takes them
+func (s *shellSession) cachedNodeIDs() []string {
+	nodeIDs := []string{}
+	cache := loadBrowseCache(s.host, s.port)
+	if cache == nil {
+		return nodeIDs
+	}
+	for _, entry := range cache.Entries {
+		for _, n := range entry.Nodes {
+			nodeIDs = append(nodeIDs, tuiNodeID(n.NodeID))
+		}
+	}
+	slices.Sort(nodeIDs)
+	return slices.Compact(nodeIDs)
+}
+
+// exec runs a command line and prints its result or error. It returns true
+// to leave the shell
+func (s *shellSession) exec(line string) bool {
+	args, err := splitShellLine(line)
+	if err != nil {
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+		return false
+	}
+	if len(args) == 0 || strings.HasPrefix(args[0], "#") {
+		return false
+	}
+	result, err := s.command(args[0], args[1:])
+	switch {
+	case err == errShellExit:
+		return true
+	case err != nil:
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+	case result != "":
+		fmt.Fprintln(s.out, result)
+	}
+	return false
+}
+
+// errShellExit is returned by the exit command
+var errShellExit = errors.New("exit")
+
+// command runs a command of the shell
+func (s *shellSession) command(name string, args []string) (string, error) {
+	switch name {
+	case "get":
+		if len(args) == 0 {
+			return "", fmt.Errorf("usage: get <node-id|@group> [node-id ...]")
+		}
+		nodeIDs, err := expandNodeGroups(args, s.host, s.port)
+		if err != nil {
+			return "", err
+		}
+		return getNodeValues(nodeIDs, s.host, s.port, s.format, *measurement, plcclient.ReadOptions{DecodeEnums: *decodeEnums}, bitOptions{}, s.influxOpts, counterOptions{}, valueTransforms{})
+
+	case "set":
+		if len(args) < 2 || len(args) > 3 {
+			return "", fmt.Errorf("usage: set <node-id> <value> [data-type]")
+		}
+		dataType := "auto"
+		if len(args) == 3 {
+			dataType = args[2]
+		}
+		return setNodeValue(args[0], args[1], dataType, "Value", "high", s.host, s.port, s.format, s.influxOpts, writeCheck{})
+
+	case "browse":
+		nodeID, maxDepth := "i=84", 3
+		if len(args) >= 1 {
+			nodeID = args[0]
+		}
+		if len(args) >= 2 {
+			depth, err := strconv.Atoi(args[1])
+			if err != nil || depth < 1 {
+				return "", fmt.Errorf("invalid depth %s", args[1])
+			}
+			maxDepth = depth
+		}
+		// Complete browses go to the browse cache, complete from it again
+		s.completions = nil
+		return "", browseNode(nodeID, maxDepth, false, s.host, s.port, s.format, 0, "", false)
+
+	case "monitor":
+		if len(args) == 0 {
+			return "", fmt.Errorf("usage: monitor <node-id> [node-id ...]")
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		return "", runWatch(ctx, args, s.interval, s.host, s.port)
+
+	case "use":
+		if len(args) == 1 {
+			s.connection = args[0]
+			s.port = getPortForConnection(s.connection, s.basePort)
+			s.completions = nil
+		}
+		return fmt.Sprintf("Connection %s (%s:%d)", s.connection, s.host, s.port), nil
+
+	case "format":
+		if len(args) == 1 {
+			if !slices.ContainsFunc(outputFormats, func(f capabilityFormat) bool { return f.Name == args[0] }) {
+				return "", fmt.Errorf("unknown format %s, use default, influx or json", args[0])
+			}
+			s.format = args[0]
+		}
+		return "Format " + s.format, nil
+
+	case "interval":
+		if len(args) == 1 {
+			d, err := time.ParseDuration(args[0])
+			if err != nil || d <= 0 {
+				return "", fmt.Errorf("invalid interval %s", args[0])
+			}
+			s.interval = d
+		}
+		return "Interval " + s.interval.String(), nil
+
+	case "history":
+		var lines []string
+		for i, line := range s.history {
+			lines = append(lines, fmt.Sprintf("%4d  %s", i+1, line))
+		}
+		return strings.Join(lines, "\n"), nil
+
+	case "help":
+		var lines []string
+		for _, c := range shellCommands {
+			lines = append(lines, fmt.Sprintf("  %-42s %s", strings.TrimSpace(c.name+" "+c.args), c.about))
+		}
+		return "Commands:\n" + strings.Join(lines, "\n") + "\nTab completes commands and the node IDs of earlier complete browses, ↑↓ go through the history.", nil
+
+	case "exit", "quit":
+		return "", errShellExit
+	}
+	return "", fmt.Errorf("unknown command %s, type help for the commands", name)
+}
+
+// splitShellLine splits a command line into words at spaces. Words may be
+// quoted with " or ', e.g. set ns=3;s=Label "Line 1"
+func splitShellLine(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	for _, r := range line {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("missing closing %c", quote)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// lineEditor edits the line of the shell prompt: moving the cursor,
+// history and tab completion
+type lineEditor struct {
+	prompt   string
+	line     []rune
+	cursor   int
+	history  []string
+	pos      int    // In the history, len(history) for the new line
+	draft    string // The new line while going through the history
+	complete func(word string, first bool) []string
+	tabbed   bool     // The last key was a tab without a unique completion
+	listing  []string // Completions to list below the line
+}
+
+// key handles a key. It returns the line when done (enter), and false on
+// ctrl-d on an empty line
+func (e *lineEditor) key(k string) (string, bool, bool) {
+	tabbed := e.tabbed
+	e.tabbed = false
+	switch k {
+	case "enter":
+		return string(e.line), true, true
+	case "ctrl-d":
+		if len(e.line) == 0 {
+			return "", false, false
+		}
+	case "ctrl-c":
+		e.line, e.cursor = nil, 0
+	case "left":
+		e.cursor = max(e.cursor-1, 0)
+	case "right":
+		e.cursor = min(e.cursor+1, len(e.line))
+	case "home":
+		e.cursor = 0
+	case "end":
+		e.cursor = len(e.line)
+	case "backspace":
+		if e.cursor > 0 {
+			e.line = append(e.line[:e.cursor-1], e.line[e.cursor:]...)
+			e.cursor--
+		}
+	case "delete":
+		if e.cursor < len(e.line) {
+			e.line = append(e.line[:e.cursor], e.line[e.cursor+1:]...)
+		}
+	case "up", "down":
+		pos := e.pos - 1
+		if k == "down" {
+			pos = e.pos + 1
+		}
+		if pos < 0 || pos > len(e.history) {
+			break
+		}
+		if e.pos == len(e.history) {
+			e.draft = string(e.line)
+		}
+		e.pos = pos
+		e.line = []rune(e.draft)
+		if pos < len(e.history) {
+			e.line = []rune(e.history[pos])
+		}
+		e.cursor = len(e.line)
+	case "tab":
+		e.tab(tabbed)
+	default:
+		if utf8.RuneCountInString(k) == 1 {
+			e.line = append(e.line[:e.cursor], append([]rune(k), e.line[e.cursor:]...)...)
+			e.cursor++
+		}
+	}
+	return "", false, true
+}
+
+// tab completes the word before the cursor as far as its completions agree,
+// and lists them on a second tab
+func (e *lineEditor) tab(again bool) {
+	start := e.cursor
+	for start > 0 && e.line[start-1] != ' ' {
+		start--
+	}
+	word := string(e.line[start:e.cursor])
+	first := strings.TrimSpace(string(e.line[:start])) == ""
+	matches := e.complete(word, first)
+	if len(matches) == 0 {
+		return
+	}
+	prefix := matches[0]
+	for _, m := range matches[1:] {
+		for !strings.HasPrefix(m, prefix) {
+			_, size := utf8.DecodeLastRuneInString(prefix)
+			prefix = prefix[:len(prefix)-size]
+		}
+	}
+	if len(matches) == 1 {
+		prefix += " "
+	}
+	if prefix != word {
+		insert := []rune(strings.TrimPrefix(prefix, word))
+		e.line = append(e.line[:e.cursor], append(insert, e.line[e.cursor:]...)...)
+		e.cursor += len(insert)
+		return
+	}
+	if again {
+		e.listing = matches
+		return
+	}
+	e.tabbed = true
+}
+
+// render redraws the prompt line and puts the cursor in place
+func (e *lineEditor) render() string {
+	out := "\r" + e.prompt + string(e.line) + "\x1b[K"
+	if back := len(e.line) - e.cursor; back > 0 {
+		out += fmt.Sprintf("\x1b[%dD", back)
+	}
+	return out
+}
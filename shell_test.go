@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSplitShellLine tests the words of shell command lines
+func TestSplitShellLine(t *testing.T) {
+	words, err := splitShellLine(`  set ns=3;s=Label "Line 1"  string`)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"set", "ns=3;s=Label", "Line 1", "string"}, words)
+	words, err = splitShellLine(`set ns=3;s=Label '' string`)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"set", "ns=3;s=Label", "", "string"}, words, "empty values")
+	_, err = splitShellLine(`set ns=3;s=Label "Line 1`)
+	assert.EqualError(t, err, `missing closing "`)
+}
+
+// TestLineEditor tests editing, history and completion at the shell prompt
+func TestLineEditor(t *testing.T) {
+	nodeIDs := []string{"ns=3;s=Line1.Count", "ns=3;s=Line1.Speed", "ns=3;s=Oven.Temp"}
+	e := &lineEditor{prompt: "> ", history: []string{"get ns=3;s=A", "browse"}, pos: 2, complete: func(word string, first bool) []string {
+		var matches []string
+		candidates := nodeIDs
+		if first {
+			candidates = []string{"get", "set", "help", "history"}
+		}
+		for _, c := range candidates {
+			if strings.HasPrefix(c, word) {
+				matches = append(matches, c)
+			}
+		}
+		return matches
+	}}
+	keys := func(keys ...string) string {
+		for _, k := range keys {
+			line, done, ok := e.key(k)
+			require.True(t, ok)
+			if done {
+				return line
+			}
+		}
+		return ""
+	}
+
+	keys("g", "tab", "n", "s", "tab")
+	assert.Equal(t, "get ns=3;s=", string(e.line), "the common prefix")
+	keys("tab")
+	assert.Nil(t, e.listing)
+	keys("tab")
+	assert.Equal(t, nodeIDs, e.listing, "listed on the second tab")
+	e.listing = nil
+	assert.Equal(t, "get ns=3;s=Line1.Speed ", keys("L", "tab", "S", "tab", "enter"))
+
+	// History, with the new line kept
+	e = &lineEditor{prompt: "> ", history: e.history, pos: 2, complete: e.complete}
+	keys("s", "e", "up")
+	assert.Equal(t, "browse", string(e.line))
+	keys("up", "up")
+	assert.Equal(t, "get ns=3;s=A", string(e.line))
+	keys("down", "down")
+	assert.Equal(t, "se", string(e.line))
+
+	// Editing in the middle of the line
+	assert.Equal(t, "set ns=3;s=B 2,5", keys("ctrl-c", "h", "tab", "home", "delete", "delete", "delete", "delete", "s", "e", "t", " ", "end",
+		"n", "s", "=", "3", ";", "s", "=", "B", " ", "2", "5", "left", ",", "right", "enter"))
+	assert.Equal(t, "\r> set ns=3;s=B 2,5\x1b[K", e.render())
+	e.cursor = 3
+	assert.Equal(t, "\r> set ns=3;s=B 2,5\x1b[K\x1b[13D", e.render())
+
+	e = &lineEditor{complete: e.complete}
+	_, _, ok := e.key("ctrl-d")
+	assert.False(t, ok, "ctrl-d on an empty line leaves")
+}
+
+// TestShellScript tests the commands of plccli shell against the service of
+// a simulated PLC
+func TestShellScript(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	connectMock(t, ctx)
+	mux := http.NewServeMux()
+	registerHandlers(mux, "opc.tcp://mock", 8765)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	s := newShellSession(u.Hostname(), port, "default", influxOptions{fieldName: "value", timestamp: "now"}, &out)
+	setpoint := "nsu=" + mockNamespaceURI + ";s=Setpoint"
+	require.NoError(t, s.script(strings.NewReader(strings.Join([]string{
+		"# Commissioning of line 1",
+		"",
+		"set " + setpoint + " 23,5",
+		"get " + setpoint,
+		"format influx",
+		"get " + setpoint,
+		"format csv",
+		"interval 2s",
+		"frobnicate",
+		"use line2",
+		"exit",
+		"get " + setpoint,
+	}, "\n"))))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 8, out.String())
+	assert.Contains(t, lines[0], "Successfully set "+setpoint+" to 23,5 with type auto")
+	assert.Contains(t, lines[1], "23.5")
+	assert.Equal(t, "Format influx", lines[2])
+	assert.True(t, strings.HasPrefix(lines[3], "opcua_node,"), lines[3])
+	assert.Contains(t, lines[3], "value=23.5")
+	assert.Equal(t, "Error: unknown format csv, use default, influx or json", lines[4])
+	assert.Equal(t, "Interval 2s", lines[5])
+	assert.Equal(t, "Error: unknown command frobnicate, type help for the commands", lines[6])
+	assert.Equal(t, "Connection line2 (127.0.0.1:"+strconv.Itoa(getPortForConnection("line2", port))+")", lines[7])
+	assert.Equal(t, "plccli line2> ", s.prompt())
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// shift is one entry of a daily shift calendar, e.g. C=22:00-06:00
+type shift struct {
+	id    string
+	start time.Duration // Offset from midnight
+	end   time.Duration // Offset from midnight, before start if the shift crosses midnight
+}
+
+// shiftCalendar assigns points in time to shifts, repeating every day in local time
+type shiftCalendar struct {
+	shifts []shift
+}
+
+// parseShiftCalendar parses a comma-separated list of id=HH:MM-HH:MM shifts
+func parseShiftCalendar(spec string) (*shiftCalendar, error) {
+	calendar := &shiftCalendar{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		id, span, ok := strings.Cut(entry, "=")
+		id = strings.TrimSpace(id)
+		if !ok || id == "" {
+			return nil, fmt.Errorf("invalid shift %q, expected id=HH:MM-HH:MM", entry)
+		}
+		startStr, endStr, ok := strings.Cut(span, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid shift %q, expected id=HH:MM-HH:MM", entry)
+		}
+		start, err := parseClock(startStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid start of shift %s: %v", id, err)
+		}
+		end, err := parseClock(endStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid end of shift %s: %v", id, err)
+		}
+		if start == end {
+			return nil, fmt.Errorf("shift %s has no duration", id)
+		}
+
+		calendar.shifts = append(calendar.shifts, shift{id: id, start: start, end: end})
+	}
+
+	if len(calendar.shifts) == 0 {
+		return nil, fmt.Errorf("no shifts defined")
+	}
+	return calendar, nil
+}
+
+// parseClock parses a HH:MM time of day into an offset from midnight
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a HH:MM time", strings.TrimSpace(s))
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// at returns the shift containing t and the time that shift started
+// Returns an empty ID and zero time outside of all shifts or for a nil calendar
+func (c *shiftCalendar) at(t time.Time) (string, time.Time) {
+	if c == nil {
+		return "", time.Time{}
+	}
+
+	// A shift containing t started either today or, when crossing midnight, yesterday
+	for _, dayOffset := range []int{0, -1} {
+		y, m, d := t.AddDate(0, 0, dayOffset).Date()
+		for _, s := range c.shifts {
+			start := clockOn(y, m, d, s.start, t.Location())
+			end := clockOn(y, m, d, s.end, t.Location())
+			if s.end < s.start {
+				end = clockOn(y, m, d+1, s.end, t.Location())
+			}
+			if !t.Before(start) && t.Before(end) {
+				return s.id, start
+			}
+		}
+	}
+	return "", time.Time{}
+}
+
+// clockOn returns the given time of day on a date
+func clockOn(y int, m time.Month, d int, offset time.Duration, loc *time.Location) time.Time {
+	return time.Date(y, m, d, int(offset/time.Hour), int(offset%time.Hour/time.Minute), 0, 0, loc)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestParseShiftCalendar tests parsing of shift calendar definitions
+func TestParseShiftCalendar(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    []shift
+		wantErr bool
+	}{
+		{
+			name: "three shifts",
+			spec: "A=06:00-14:00, B=14:00-22:00,C=22:00-06:00",
+			want: []shift{
+				{id: "A", start: 6 * time.Hour, end: 14 * time.Hour},
+				{id: "B", start: 14 * time.Hour, end: 22 * time.Hour},
+				{id: "C", start: 22 * time.Hour, end: 6 * time.Hour},
+			},
+		},
+		{
+			name: "minutes",
+			spec: "Early=05:30-13:45",
+			want: []shift{{id: "Early", start: 5*time.Hour + 30*time.Minute, end: 13*time.Hour + 45*time.Minute}},
+		},
+		{name: "missing id", spec: "=06:00-14:00", wantErr: true},
+		{name: "missing end", spec: "A=06:00", wantErr: true},
+		{name: "invalid time", spec: "A=6am-14:00", wantErr: true},
+		{name: "zero length", spec: "A=06:00-06:00", wantErr: true},
+		{name: "empty", spec: " , ", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calendar, err := parseShiftCalendar(tt.spec)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, calendar.shifts)
+		})
+	}
+}
+
+// TestShiftCalendarAt tests shift lookup including shifts crossing midnight
+func TestShiftCalendarAt(t *testing.T) {
+	calendar, err := parseShiftCalendar("A=06:00-14:00,B=14:00-22:00,C=22:00-06:00")
+	require.NoError(t, err)
+
+	day := func(d, h, m int) time.Time {
+		return time.Date(2025, 3, d, h, m, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		at        time.Time
+		wantID    string
+		wantStart time.Time
+	}{
+		{day(10, 6, 0), "A", day(10, 6, 0)},
+		{day(10, 13, 59), "A", day(10, 6, 0)},
+		{day(10, 14, 0), "B", day(10, 14, 0)},
+		{day(10, 23, 0), "C", day(10, 22, 0)},
+		{day(11, 3, 0), "C", day(10, 22, 0)},
+		{day(11, 5, 59), "C", day(10, 22, 0)},
+	}
+
+	for _, tt := range tests {
+		id, start := calendar.at(tt.at)
+		assert.Equal(t, tt.wantID, id, "shift at %v", tt.at)
+		assert.Equal(t, tt.wantStart, start, "shift start at %v", tt.at)
+	}
+
+	// Gaps and nil calendars have no shift
+	partial, err := parseShiftCalendar("Day=08:00-16:00")
+	require.NoError(t, err)
+	id, start := partial.at(day(10, 20, 0))
+	assert.Empty(t, id)
+	assert.True(t, start.IsZero())
+
+	var none *shiftCalendar
+	id, _ = none.at(day(10, 20, 0))
+	assert.Empty(t, id)
+}
+
+// TestShiftBoundaryResets tests that counter totals and state durations restart with a new shift
+func TestShiftBoundaryResets(t *testing.T) {
+	calendar, err := parseShiftCalendar("A=06:00-14:00,B=14:00-22:00")
+	require.NoError(t, err)
+	at := func(h, m int) time.Time {
+		return time.Date(2025, 3, 10, h, m, 0, 0, time.UTC)
+	}
+
+	counters := newCounterTracker()
+	_, shiftA := calendar.at(at(13, 0))
+	_, shiftB := calendar.at(at(14, 5))
+	counters.update("ns=3;s=Count", 100, 0, shiftA)
+	_, total := counters.update("ns=3;s=Count", 150, 0, shiftA)
+	assert.Equal(t, 150.0, total)
+	delta, total := counters.update("ns=3;s=Count", 160, 0, shiftB)
+	assert.Equal(t, 10.0, delta)
+	assert.Equal(t, 10.0, total, "total restarts at the shift boundary")
+
+	states := newStateTracker()
+	states.shifts = calendar
+	states.observe("ns=3;s=Mode", "Run", at(13, 0))
+	states.observe("ns=3;s=Mode", "Stop", at(13, 30))
+	snapshot := states.snapshot(at(14, 10))
+	require.Len(t, snapshot, 1)
+	assert.Equal(t, "B", snapshot[0].Shift)
+	assert.Equal(t, "Stop", snapshot[0].Current)
+	assert.Equal(t, map[string]float64{"Stop": 600}, snapshot[0].Durations)
+
+	opts := influxOptions{shifts: calendar, at: at(14, 10)}
+	assert.Equal(t, ",node_id=ns\\=3;s\\=Mode,endpoint=e,shift=B", opts.tagSet("ns=3;s=Mode", "e"))
+}
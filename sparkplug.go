@@ -0,0 +1,357 @@
+//go:build !minimal && !nocloudiot
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sparkplug B data types of the metrics of an edge node
+const (
+	sparkplugInt64   = 4
+	sparkplugUInt64  = 8
+	sparkplugDouble  = 10
+	sparkplugBoolean = 11
+	sparkplugString  = 12
+)
+
+// sparkplugRebirth is the node control metric a host application sets in an
+// NCMD to have the node publish its NBIRTH again
+const sparkplugRebirth = "Node Control/Rebirth"
+
+// mqttSparkplug is the Sparkplug B edge node of an MQTT sink
+type mqttSparkplug struct {
+	Group string `yaml:"group"` // Group ID
+	Node  string `yaml:"node"`  // Edge node ID
+}
+
+// sparkplugValue is the value of a metric: integers, booleans and the bits
+// of doubles in number, strings in text
+type sparkplugValue struct {
+	datatype uint32
+	number   uint64
+	text     string
+}
+
+// sparkplugMetric is a metric of the node, named after the lines it comes
+// from, and its last value
+type sparkplugMetric struct {
+	name  string
+	alias uint64
+	value sparkplugValue
+	time  time.Time
+}
+
+// sparkplugUpdate is a value of a metric from a line
+type sparkplugUpdate struct {
+	metric *sparkplugMetric
+	value  sparkplugValue
+	time   time.Time
+	birth  bool // Declared with this value in the NBIRTH
+}
+
+// sparkplugNode publishes the lines of an MQTT sink as the metrics of a
+// Sparkplug B edge node: an NBIRTH declaring every metric with its alias and
+// datatype, then NDATA by alias. A metric not declared yet, or one whose
+// datatype changes, is declared in a new NBIRTH. Callers hold the mu of the
+// cloudSink
+type sparkplugNode struct {
+	group    string
+	node     string
+	connects int    // Connections so far, for bdSeq
+	bdSeq    uint64 // Birth/death sequence number of the connection
+	seq      uint64 // Sequence number of the last message
+	metrics  map[string]*sparkplugMetric
+	order    []*sparkplugMetric // By alias
+}
+
+func newSparkplugNode(cfg *mqttSparkplug) (*sparkplugNode, error) {
+	if cfg.Group == "" || cfg.Node == "" {
+		return nil, fmt.Errorf("sparkplug needs group and node")
+	}
+	for _, id := range []string{cfg.Group, cfg.Node} {
+		if strings.ContainsAny(id, "/+#") {
+			return nil, fmt.Errorf("sparkplug group and node must not contain /, + or #: %s", id)
+		}
+	}
+	return &sparkplugNode{group: cfg.Group, node: cfg.Node, metrics: make(map[string]*sparkplugMetric)}, nil
+}
+
+// topic returns the topic of a message type of the node, e.g. NBIRTH
+func (n *sparkplugNode) topic(messageType string) string {
+	return "spBv1.0/" + n.group + "/" + messageType + "/" + n.node
+}
+
+// will returns the NDEATH the broker publishes when the next connection is
+// lost, with the bdSeq of that connection
+func (n *sparkplugNode) will(now time.Time) (string, []byte) {
+	n.bdSeq = uint64(n.connects % 256)
+	n.connects++
+	payload := appendProtoVarint(nil, 1, uint64(now.UnixMilli()))
+	payload = appendProtoBytes(payload, 2, encodeSparkplugMetric("bdSeq", 0, sparkplugValue{datatype: sparkplugUInt64, number: n.bdSeq}, time.Time{}))
+	return n.topic("NDEATH"), payload
+}
+
+// birth publishes the NBIRTH of the node: bdSeq, the rebirth control and
+// every metric with its alias, datatype and last value
+func (n *sparkplugNode) birth(ctx context.Context, client *mqttClient) error {
+	n.seq = 0
+	now := time.Now()
+	payload := appendProtoVarint(nil, 1, uint64(now.UnixMilli()))
+	payload = appendProtoBytes(payload, 2, encodeSparkplugMetric("bdSeq", 0, sparkplugValue{datatype: sparkplugUInt64, number: n.bdSeq}, time.Time{}))
+	payload = appendProtoBytes(payload, 2, encodeSparkplugMetric(sparkplugRebirth, 0, sparkplugValue{datatype: sparkplugBoolean}, time.Time{}))
+	for _, m := range n.order {
+		payload = appendProtoBytes(payload, 2, encodeSparkplugMetric(m.name, m.alias, m.value, m.time))
+	}
+	payload = appendProtoVarint(payload, 3, n.seq)
+	return client.publish(ctx, n.topic("NBIRTH"), payload, 0)
+}
+
+// publish publishes lines as NDATA with QoS 0, as Sparkplug has it, split to
+// fit maxMessage. Metrics the lines declare first go in an NBIRTH before.
+// Values of a metric in an earlier datatype than its last are dropped
+func (n *sparkplugNode) publish(ctx context.Context, client *mqttClient, lines []string, maxMessage int, budget *sinkBudget) error {
+	var updates []sparkplugUpdate
+	rebirth := false
+	for _, line := range lines {
+		l, err := parseInfluxLine(line)
+		if err != nil {
+			continue // Lines come from the poll file, this is not expected
+		}
+		for _, field := range l.fields {
+			value, ok := sparkplugValueOf(field)
+			if !ok {
+				continue
+			}
+			name := sparkplugMetricName(l, field.name)
+			m := n.metrics[name]
+			if m == nil {
+				m = &sparkplugMetric{name: name, alias: uint64(len(n.order) + 1)}
+				n.metrics[name] = m
+				n.order = append(n.order, m)
+			}
+			update := sparkplugUpdate{metric: m, value: value, time: l.time}
+			if m.value.datatype != value.datatype {
+				m.value, m.time = value, l.time
+				update.birth, rebirth = true, true
+			}
+			updates = append(updates, update)
+		}
+	}
+	if rebirth {
+		if err := n.birth(ctx, client); err != nil {
+			return err
+		}
+	}
+
+	data := updates[:0]
+	for _, u := range updates {
+		if u.birth || u.value.datatype != u.metric.value.datatype {
+			continue
+		}
+		u.metric.value, u.metric.time = u.value, u.time
+		data = append(data, u)
+	}
+	sent, err := n.publishData(ctx, client, data, maxMessage)
+	if budget != nil && sent > 0 {
+		budget.spent(linesSize(lines), sent)
+	}
+	return err
+}
+
+// publishData publishes updates in one NDATA, or in halves when too large,
+// and returns the bytes published
+func (n *sparkplugNode) publishData(ctx context.Context, client *mqttClient, updates []sparkplugUpdate, maxMessage int) (int, error) {
+	if len(updates) == 0 {
+		return 0, nil
+	}
+	seq := (n.seq + 1) % 256
+	payload := appendProtoVarint(nil, 1, uint64(time.Now().UnixMilli()))
+	for _, u := range updates {
+		payload = appendProtoBytes(payload, 2, encodeSparkplugMetric("", u.metric.alias, u.value, u.time))
+	}
+	payload = appendProtoVarint(payload, 3, seq)
+	if len(payload) > maxMessage {
+		if len(updates) == 1 {
+			return 0, &sinkRejectedError{status: "message too large", body: fmt.Sprintf("%d bytes, at most %d", len(payload), maxMessage)}
+		}
+		half := len(updates) / 2
+		sent, err := n.publishData(ctx, client, updates[:half], maxMessage)
+		if err != nil {
+			return sent, err
+		}
+		rest, err := n.publishData(ctx, client, updates[half:], maxMessage)
+		return sent + rest, err
+	}
+	if err := client.publish(ctx, n.topic("NDATA"), payload, 0); err != nil {
+		return 0, err
+	}
+	n.seq = seq
+	return len(payload), nil
+}
+
+// sparkplugMetricName names the metric of a field of a line after its
+// measurement and node ID, and the structure field and bit of the line and
+// the field when there are: conveyor/ns=1;s=Speed, alarms/ns=1;s=Word/Door
+// or conveyor/ns=1;s=State/string_value
+func sparkplugMetricName(l influxLine, field string) string {
+	parts := []string{l.measurement, l.tag("node_id")}
+	for _, tag := range []string{"field", "bit_name"} {
+		if value := l.tag(tag); value != "" {
+			parts = append(parts, value)
+		}
+	}
+	if field != "value" {
+		parts = append(parts, field)
+	}
+	return strings.Join(parts, "/")
+}
+
+// sparkplugValueOf returns the Sparkplug value of a field of a line: strings,
+// booleans, integers of i and u fields and doubles of the other numbers, as
+// InfluxDB types them
+func sparkplugValueOf(f influxField) (sparkplugValue, bool) {
+	if f.quoted {
+		return sparkplugValue{datatype: sparkplugString, text: f.value}, true
+	}
+	switch f.value {
+	case "t", "T", "true", "True", "TRUE":
+		return sparkplugValue{datatype: sparkplugBoolean, number: 1}, true
+	case "f", "F", "false", "False", "FALSE":
+		return sparkplugValue{datatype: sparkplugBoolean}, true
+	}
+	if digits, ok := strings.CutSuffix(f.value, "i"); ok {
+		n, err := strconv.ParseInt(digits, 10, 64)
+		return sparkplugValue{datatype: sparkplugInt64, number: uint64(n)}, err == nil
+	}
+	if digits, ok := strings.CutSuffix(f.value, "u"); ok {
+		n, err := strconv.ParseUint(digits, 10, 64)
+		return sparkplugValue{datatype: sparkplugUInt64, number: n}, err == nil
+	}
+	v, err := strconv.ParseFloat(f.value, 64)
+	return sparkplugValue{datatype: sparkplugDouble, number: math.Float64bits(v)}, err == nil
+}
+
+// encodeSparkplugMetric encodes a Metric of a Sparkplug B payload. NDATA
+// metrics have an alias and no name, the metrics of births a name and the
+// alias of the lines' metrics
+func encodeSparkplugMetric(name string, alias uint64, value sparkplugValue, t time.Time) []byte {
+	var b []byte
+	if name != "" {
+		b = appendProtoBytes(b, 1, []byte(name))
+	}
+	if alias != 0 {
+		b = appendProtoVarint(b, 2, alias)
+	}
+	if !t.IsZero() {
+		b = appendProtoVarint(b, 3, uint64(t.UnixMilli()))
+	}
+	b = appendProtoVarint(b, 4, uint64(value.datatype))
+	switch value.datatype {
+	case sparkplugString:
+		b = appendProtoBytes(b, 15, []byte(value.text))
+	case sparkplugBoolean:
+		b = appendProtoVarint(b, 14, value.number)
+	case sparkplugDouble:
+		b = appendProtoFixed64(b, 13, value.number)
+	default:
+		b = appendProtoVarint(b, 11, value.number) // long_value
+	}
+	return b
+}
+
+// sparkplugRebirthRequested reports whether an NCMD payload sets the rebirth
+// control of the node
+func sparkplugRebirthRequested(payload []byte) bool {
+	for rest := payload; len(rest) > 0; {
+		field, _, metric, next, ok := cutProtoField(rest)
+		if !ok {
+			return false
+		}
+		rest = next
+		if field != 2 {
+			continue
+		}
+		var name string
+		var set bool
+		for rest := metric; len(rest) > 0; {
+			field, value, data, next, ok := cutProtoField(rest)
+			if !ok {
+				return false
+			}
+			rest = next
+			switch field {
+			case 1:
+				name = string(data)
+			case 14:
+				set = value != 0
+			}
+		}
+		if name == sparkplugRebirth && set {
+			return true
+		}
+	}
+	return false
+}
+
+// Protocol Buffers encoding of the Sparkplug B payloads, like the MQTT client
+// done here rather than with a library
+
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendProtoFixed64(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|1)
+	return binary.LittleEndian.AppendUint64(b, v)
+}
+
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// cutProtoField returns the number of the first field of a message, its
+// value for varint and fixed fields or its bytes for length-delimited ones,
+// and the rest of the message
+func cutProtoField(b []byte) (field, value uint64, data, rest []byte, ok bool) {
+	key, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, 0, nil, nil, false
+	}
+	b = b[n:]
+	switch key & 7 {
+	case 0:
+		if value, n = binary.Uvarint(b); n <= 0 {
+			return 0, 0, nil, nil, false
+		}
+		b = b[n:]
+	case 1:
+		if len(b) < 8 {
+			return 0, 0, nil, nil, false
+		}
+		value, b = binary.LittleEndian.Uint64(b), b[8:]
+	case 2:
+		size, n := binary.Uvarint(b)
+		if n <= 0 || size > uint64(len(b)-n) {
+			return 0, 0, nil, nil, false
+		}
+		data, b = b[n:n+int(size)], b[n+int(size):]
+	case 5:
+		if len(b) < 4 {
+			return 0, 0, nil, nil, false
+		}
+		value, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+	default:
+		return 0, 0, nil, nil, false
+	}
+	return key >> 3, value, data, b, true
+}
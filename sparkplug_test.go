@@ -0,0 +1,232 @@
+//go:build !minimal && !nocloudiot
+
+package main
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sparkplugTestMetric is a Metric of a decoded Sparkplug B payload, numbers
+// and booleans in value
+type sparkplugTestMetric struct {
+	name     string
+	alias    uint64
+	time     uint64
+	datatype uint64
+	value    uint64
+	text     string
+}
+
+// decodeSparkplug decodes the seq and metrics of a payload
+func decodeSparkplug(t *testing.T, payload []byte) (uint64, []sparkplugTestMetric) {
+	t.Helper()
+	var seq uint64
+	var metrics []sparkplugTestMetric
+	for rest := payload; len(rest) > 0; {
+		field, value, data, next, ok := cutProtoField(rest)
+		require.True(t, ok, "malformed payload")
+		rest = next
+		switch field {
+		case 2:
+			var m sparkplugTestMetric
+			for rest := data; len(rest) > 0; {
+				field, value, data, next, ok := cutProtoField(rest)
+				require.True(t, ok, "malformed metric")
+				rest = next
+				switch field {
+				case 1:
+					m.name = string(data)
+				case 2:
+					m.alias = value
+				case 3:
+					m.time = value
+				case 4:
+					m.datatype = value
+				case 11, 13, 14:
+					m.value = value
+				case 15:
+					m.text = string(data)
+				}
+			}
+			metrics = append(metrics, m)
+		case 3:
+			seq = value
+		}
+	}
+	return seq, metrics
+}
+
+// TestSparkplugMetrics tests the names and values of the metrics of lines
+func TestSparkplugMetrics(t *testing.T) {
+	for _, tc := range []struct {
+		line  string
+		names []string
+	}{
+		{`conveyor,node_id=ns\=1;s\=Speed,endpoint=opc.tcp://plc:4840 value=1.5 1772352000000000000`, []string{"conveyor/ns=1;s=Speed"}},
+		{`conveyor,node_id=ns\=1;s\=State value=1,string_value="Running" 1772352000000000000`, []string{"conveyor/ns=1;s=State", "conveyor/ns=1;s=State/string_value"}},
+		{`alarms,node_id=ns\=1;s\=Word,bit=3,bit_name=Door\ Open value=1 1772352000000000000`, []string{"alarms/ns=1;s=Word/Door Open"}},
+		{`motor,node_id=ns\=2;s\=Drive,field=Motor.Speed value=7 1772352000000000000`, []string{"motor/ns=2;s=Drive/Motor.Speed"}},
+	} {
+		l, err := parseInfluxLine(tc.line)
+		require.NoError(t, err)
+		var names []string
+		for _, f := range l.fields {
+			names = append(names, sparkplugMetricName(l, f.name))
+		}
+		assert.Equal(t, tc.names, names, tc.line)
+	}
+
+	for _, tc := range []struct {
+		field influxField
+		value sparkplugValue
+		ok    bool
+	}{
+		{influxField{value: "1.5"}, sparkplugValue{datatype: sparkplugDouble, number: math.Float64bits(1.5)}, true},
+		{influxField{value: "1"}, sparkplugValue{datatype: sparkplugDouble, number: math.Float64bits(1)}, true},
+		{influxField{value: "-3i"}, sparkplugValue{datatype: sparkplugInt64, number: math.MaxUint64 - 2}, true},
+		{influxField{value: "42u"}, sparkplugValue{datatype: sparkplugUInt64, number: 42}, true},
+		{influxField{value: "true"}, sparkplugValue{datatype: sparkplugBoolean, number: 1}, true},
+		{influxField{value: "F"}, sparkplugValue{datatype: sparkplugBoolean}, true},
+		{influxField{value: "Running", quoted: true}, sparkplugValue{datatype: sparkplugString, text: "Running"}, true},
+		{influxField{value: "x1i"}, sparkplugValue{datatype: sparkplugInt64}, false},
+	} {
+		value, ok := sparkplugValueOf(tc.field)
+		assert.Equal(t, tc.ok, ok, tc.field.value)
+		if tc.ok {
+			assert.Equal(t, tc.value, value, tc.field.value)
+		}
+	}
+
+	rebirth := appendProtoBytes(nil, 2, encodeSparkplugMetric(sparkplugRebirth, 0, sparkplugValue{datatype: sparkplugBoolean, number: 1}, time.Time{}))
+	assert.True(t, sparkplugRebirthRequested(rebirth))
+	other := appendProtoBytes(nil, 2, encodeSparkplugMetric("Node Control/Reboot", 0, sparkplugValue{datatype: sparkplugBoolean, number: 1}, time.Time{}))
+	assert.False(t, sparkplugRebirthRequested(other))
+	assert.False(t, sparkplugRebirthRequested(rebirth[:len(rebirth)-1]), "truncated")
+}
+
+// TestMQTTSparkplugSink tests the NDEATH will, the NBIRTH declaring the
+// metrics with their aliases, NDATA by alias and the births of new metrics
+// and of rebirth commands
+func TestMQTTSparkplugSink(t *testing.T) {
+	defer func(name string) { connectionName = name }(connectionName)
+	connectionName = "line1"
+
+	passwordFile := filepath.Join(t.TempDir(), "mqtt.password")
+	require.NoError(t, os.WriteFile(passwordFile, []byte("s3cret\n"), 0600))
+	pf, err := loadPollFile(writePollFile(t, "sinks:\n  - mqtt: {broker: mqtt://broker, username: edge, passwordFile: "+passwordFile+", sparkplug: {group: Plant1, node: Line1}}\npolls:\n  - {node: ns=1;s=Speed, interval: 1s}\n"))
+	require.NoError(t, err)
+	sink := pf.Sinks[0]
+	require.NotNil(t, sink.cloud)
+	assert.Equal(t, "mqtt mqtt://broker spBv1.0/Plant1/NDATA/Line1", sink.name())
+
+	broker := newFakeBroker()
+	sink.cloud.dial = broker.dial
+	defer sink.cloud.close()
+	speed := `conveyor,node_id=ns\=1;s\=Speed value=1.5 1772352000000000000`
+	faster := `conveyor,node_id=ns\=1;s\=Speed value=2.5 1772352001000000000`
+	require.NoError(t, sink.send(context.Background(), nil, []string{speed, faster}))
+
+	broker.mu.Lock()
+	require.Len(t, broker.logins, 1)
+	login := string(broker.logins[0])
+	broker.mu.Unlock()
+	assert.Contains(t, login, "plccli-line1")
+	assert.Contains(t, login, "spBv1.0/Plant1/NDEATH/Line1")
+	assert.Contains(t, login, "s3cret")
+
+	require.Eventually(t, func() bool {
+		return len(broker.published("spBv1.0/Plant1/NBIRTH/Line1")) == 2 && len(broker.published("spBv1.0/Plant1/NDATA/Line1")) == 1
+	}, time.Second, time.Millisecond)
+	births := broker.published("spBv1.0/Plant1/NBIRTH/Line1")
+	seq, metrics := decodeSparkplug(t, births[0])
+	assert.Equal(t, uint64(0), seq)
+	assert.Equal(t, []sparkplugTestMetric{
+		{name: "bdSeq", datatype: sparkplugUInt64},
+		{name: sparkplugRebirth, datatype: sparkplugBoolean},
+	}, metrics, "connected before any line")
+	seq, metrics = decodeSparkplug(t, births[1])
+	assert.Equal(t, uint64(0), seq)
+	require.Len(t, metrics, 3)
+	assert.Equal(t, sparkplugTestMetric{
+		name: "conveyor/ns=1;s=Speed", alias: 1, time: 1772352000000, datatype: sparkplugDouble, value: math.Float64bits(1.5),
+	}, metrics[2], "first value in the birth")
+	seq, metrics = decodeSparkplug(t, broker.published("spBv1.0/Plant1/NDATA/Line1")[0])
+	assert.Equal(t, uint64(1), seq)
+	assert.Equal(t, []sparkplugTestMetric{
+		{alias: 1, time: 1772352001000, datatype: sparkplugDouble, value: math.Float64bits(2.5)},
+	}, metrics, "later values by alias")
+
+	// Known metrics go in NDATA alone, a new one is born first
+	require.NoError(t, sink.send(context.Background(), nil, []string{faster}))
+	state := `conveyor,node_id=ns\=1;s\=State value=1,string_value="Running" 1772352002000000000`
+	require.NoError(t, sink.send(context.Background(), nil, []string{state}))
+	require.Eventually(t, func() bool {
+		return len(broker.published("spBv1.0/Plant1/NBIRTH/Line1")) == 3 && len(broker.published("spBv1.0/Plant1/NDATA/Line1")) == 2
+	}, time.Second, time.Millisecond)
+	seq, _ = decodeSparkplug(t, broker.published("spBv1.0/Plant1/NDATA/Line1")[1])
+	assert.Equal(t, uint64(2), seq)
+	_, metrics = decodeSparkplug(t, broker.published("spBv1.0/Plant1/NBIRTH/Line1")[2])
+	require.Len(t, metrics, 5)
+	assert.Equal(t, sparkplugTestMetric{
+		name: "conveyor/ns=1;s=Speed", alias: 1, time: 1772352001000, datatype: sparkplugDouble, value: math.Float64bits(2.5),
+	}, metrics[2], "last value")
+	assert.Equal(t, sparkplugTestMetric{
+		name: "conveyor/ns=1;s=State/string_value", alias: 3, time: 1772352002000, datatype: sparkplugString, text: "Running",
+	}, metrics[4])
+
+	// A host application asks for a rebirth
+	sink.cloud.reply("spBv1.0/Plant1/NCMD/Line1",
+		appendProtoBytes(nil, 2, encodeSparkplugMetric(sparkplugRebirth, 0, sparkplugValue{datatype: sparkplugBoolean, number: 1}, time.Time{})))
+	require.Eventually(t, func() bool {
+		return len(broker.published("spBv1.0/Plant1/NBIRTH/Line1")) == 4
+	}, time.Second, time.Millisecond)
+
+	// A new connection has the next bdSeq
+	sink.cloud.close()
+	require.NoError(t, sink.send(context.Background(), nil, []string{faster}))
+	require.Eventually(t, func() bool {
+		return len(broker.published("spBv1.0/Plant1/NBIRTH/Line1")) == 5
+	}, time.Second, time.Millisecond)
+	_, metrics = decodeSparkplug(t, broker.published("spBv1.0/Plant1/NBIRTH/Line1")[4])
+	assert.Equal(t, sparkplugTestMetric{name: "bdSeq", datatype: sparkplugUInt64, value: 1}, metrics[0])
+	assert.Len(t, metrics, 5, "metrics declared again")
+}
+
+// TestMQTTSink tests JSON messages to a broker and the settings of MQTT sinks
+func TestMQTTSink(t *testing.T) {
+	defer func(name string) { connectionName = name }(connectionName)
+	connectionName = "line1"
+
+	pf, err := loadPollFile(writePollFile(t, "sinks:\n  - mqtt: {broker: mqtt://broker}\npolls:\n  - {node: ns=1;s=Speed, interval: 1s}\n"))
+	require.NoError(t, err)
+	cloud := pf.Sinks[0].cloud
+	broker := newFakeBroker()
+	cloud.dial = broker.dial
+	defer cloud.close()
+	require.NoError(t, cloud.send(context.Background(), []string{`conveyor,node_id=ns\=1;s\=Speed value=1.5 1772352000000000000`}, nil))
+	assert.Len(t, broker.published("plccli/line1/values"), 1, "QoS 1")
+
+	for _, bad := range []string{
+		"sinks:\n  - mqtt: {topic: plant/values}\npolls:\n  - {node: ns=3;s=A, interval: 1s}\n",
+		"sinks:\n  - mqtt: {broker: http://broker}\npolls:\n  - {node: ns=3;s=A, interval: 1s}\n",
+		"sinks:\n  - mqtt: {broker: mqtt://broker, ca: /etc/ssl/ca.pem}\npolls:\n  - {node: ns=3;s=A, interval: 1s}\n",
+		"sinks:\n  - mqtt: {broker: mqtts://broker, ca: /nonexistent/ca.pem}\npolls:\n  - {node: ns=3;s=A, interval: 1s}\n",
+		"sinks:\n  - mqtt: {broker: mqtt://broker, topic: plant/values, sparkplug: {group: Plant1, node: Line1}}\npolls:\n  - {node: ns=3;s=A, interval: 1s}\n",
+		"sinks:\n  - mqtt: {broker: mqtt://broker, sparkplug: {group: Plant1}}\npolls:\n  - {node: ns=3;s=A, interval: 1s}\n",
+		"sinks:\n  - mqtt: {broker: mqtt://broker, sparkplug: {group: Plant/1, node: Line1}}\npolls:\n  - {node: ns=3;s=A, interval: 1s}\n",
+		"sinks:\n  - mqtt: {broker: mqtt://broker}\n    gzip: true\npolls:\n  - {node: ns=3;s=A, interval: 1s}\n",
+		"sinks:\n  - mqtt: {broker: mqtt://broker}\n    statusInterval: 10s\npolls:\n  - {node: ns=3;s=A, interval: 1s}\n",
+		"sinks:\n  - mqtt: {broker: mqtt://broker}\n    awsIoT: {endpoint: a1b2c3-ats.iot.eu-central-1.amazonaws.com, thing: line1}\npolls:\n  - {node: ns=3;s=A, interval: 1s}\n",
+	} {
+		_, err := loadPollFile(writePollFile(t, bad))
+		assert.Error(t, err, bad)
+	}
+}
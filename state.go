@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Version of the runtime state document
+const runtimeStateVersion = 1
+
+// runtimeState is the collection setup of a connection, exported with
+// `plccli service export-state` and transplanted to a replacement gateway
+// with `plccli service import-state`
+type runtimeState struct {
+	Version     int             `json:"version"`
+	Connection  string          `json:"connection"`
+	Exported    time.Time       `json:"exported"`
+	Polls       []PollConfig    `json:"polls"`
+	Groups      []NodeGroup     `json:"groups,omitempty"`      // Added through the API, not those of the groups file
+	Schedules   []WriteSchedule `json:"schedules,omitempty"`   // Without their runs
+	Certificate string          `json:"certificate,omitempty"` // PEM client certificate the PLC trusts
+	PrivateKey  string          `json:"privateKey,omitempty"`  // PEM private key of the certificate
+}
+
+// certificatePath resolves a certificate or key file like the service does:
+// relative names live in ~/.config/plccli
+func certificatePath(file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return file
+	}
+	return filepath.Join(homeDir, ".config", "plccli", filepath.Base(file))
+}
+
+// exportRuntimeState collects the poll groups, node groups and write
+// schedules of the running service and the client certificate of the
+// connection
+func exportRuntimeState(connection, certFile, keyFile, host string, port int) (runtimeState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client := newServiceClient(host, port)
+
+	polls, err := client.Polls(ctx)
+	if err != nil {
+		return runtimeState{}, err
+	}
+	groups, err := client.Groups(ctx)
+	if err != nil {
+		return runtimeState{}, err
+	}
+	schedules, err := client.Schedules(ctx)
+	if err != nil {
+		return runtimeState{}, err
+	}
+	state := runtimeState{
+		Version:    runtimeStateVersion,
+		Connection: connection,
+		Exported:   time.Now().UTC(),
+		Polls:      polls,
+	}
+	for _, group := range groups {
+		if !group.File {
+			state.Groups = append(state.Groups, group)
+		}
+	}
+	for _, s := range schedules {
+		state.Schedules = append(state.Schedules, WriteSchedule{Name: s.Name, NodeID: s.NodeID, Value: s.Value, DataType: s.DataType, Cron: s.Cron})
+	}
+
+	// A service that never connected with security has no certificate yet
+	cert, err := os.ReadFile(certificatePath(certFile))
+	if err != nil && !os.IsNotExist(err) {
+		return runtimeState{}, fmt.Errorf("failed to read certificate: %v", err)
+	}
+	key, err := os.ReadFile(certificatePath(keyFile))
+	if err != nil && !os.IsNotExist(err) {
+		return runtimeState{}, fmt.Errorf("failed to read private key: %v", err)
+	}
+	state.Certificate = string(cert)
+	state.PrivateKey = string(key)
+	return state, nil
+}
+
+// importRuntimeState creates the poll groups, node groups and write
+// schedules of an exported state in the running service and installs the
+// client certificate. Poll and node groups that already exist are skipped,
+// and so are the schedules when the service has some. Existing certificate
+// files are never overwritten
+func importRuntimeState(state runtimeState, certFile, keyFile, host string, port int) (string, error) {
+	if state.Version != runtimeStateVersion {
+		return "", fmt.Errorf("unsupported state version %d", state.Version)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client := newServiceClient(host, port)
+
+	existing, err := client.Polls(ctx)
+	if err != nil {
+		return "", err
+	}
+	exists := make(map[string]bool, len(existing))
+	for _, poll := range existing {
+		exists[poll.ID] = true
+	}
+
+	var summary []string
+	for _, poll := range state.Polls {
+		if exists[poll.ID] {
+			summary = append(summary, fmt.Sprintf("Skipped poll group %s: already exists", poll.ID))
+			continue
+		}
+		if _, err := client.AddPoll(ctx, poll); err != nil {
+			return "", fmt.Errorf("failed to create poll group %s: %v", poll.ID, err)
+		}
+		summary = append(summary, fmt.Sprintf("Created poll group %s", poll.ID))
+	}
+
+	groups, err := client.Groups(ctx)
+	if err != nil {
+		return "", err
+	}
+	groupExists := make(map[string]bool, len(groups))
+	for _, group := range groups {
+		groupExists[group.Name] = true
+	}
+	for _, group := range state.Groups {
+		if groupExists[group.Name] {
+			summary = append(summary, fmt.Sprintf("Skipped node group %s: already exists", group.Name))
+			continue
+		}
+		if _, err := client.AddGroup(ctx, group); err != nil {
+			return "", fmt.Errorf("failed to create node group %s: %v", group.Name, err)
+		}
+		summary = append(summary, fmt.Sprintf("Created node group %s", group.Name))
+	}
+
+	if len(state.Schedules) > 0 {
+		// An import replaces the tenant's schedules, so existing ones are kept instead
+		schedules, err := client.Schedules(ctx)
+		if err != nil {
+			return "", err
+		}
+		if len(schedules) > 0 {
+			summary = append(summary, fmt.Sprintf("Skipped %d write schedules: the service already has %d", len(state.Schedules), len(schedules)))
+		} else {
+			if _, err := client.ImportSchedules(ctx, state.Schedules); err != nil {
+				return "", fmt.Errorf("failed to import write schedules: %v", err)
+			}
+			summary = append(summary, fmt.Sprintf("Imported %d write schedules", len(state.Schedules)))
+		}
+	}
+
+	installed := false
+	for _, file := range []struct {
+		path, data string
+		perm       os.FileMode
+	}{
+		{certificatePath(certFile), state.Certificate, 0644},
+		{certificatePath(keyFile), state.PrivateKey, 0600},
+	} {
+		if file.data == "" {
+			continue
+		}
+		done, err := installStateFile(file.path, []byte(file.data), file.perm)
+		if err != nil {
+			return "", err
+		}
+		if done {
+			summary = append(summary, fmt.Sprintf("Installed %s", file.path))
+			installed = true
+		}
+	}
+	if installed {
+		summary = append(summary, "Restart the service to use the imported certificate")
+	}
+
+	var b bytes.Buffer
+	for _, line := range summary {
+		b.WriteString(line + "\n")
+	}
+	return b.String(), nil
+}
+
+// installStateFile writes an imported file unless it already exists. An
+// existing file with other content is an error rather than being overwritten
+func installStateFile(path string, data []byte, perm os.FileMode) (bool, error) {
+	current, err := os.ReadFile(path)
+	if err == nil {
+		if bytes.Equal(current, data) {
+			return false, nil
+		}
+		return false, fmt.Errorf("refusing to overwrite %s, move it away first", path)
+	}
+	if !os.IsNotExist(err) {
+		return false, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return false, fmt.Errorf("failed to create %s: %v", filepath.Dir(path), err)
+	}
+	if err := os.WriteFile(path, data, perm); err != nil {
+		return false, fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return true, nil
+}
+
+// writeRuntimeState writes an exported state to a file, or stdout for "" or "-"
+func writeRuntimeState(state runtimeState, path string) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %v", err)
+	}
+	if path == "" || path == "-" {
+		fmt.Println(string(data))
+		return nil
+	}
+	// The file holds the private key of the connection
+	if err := os.WriteFile(path, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return nil
+}
+
+// readRuntimeState reads an exported state file
+func readRuntimeState(path string) (runtimeState, error) {
+	var state runtimeState
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return state, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return state, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+// stateTracker accumulates how long enumerated state nodes (e.g. machine mode)
+// remain in each state
+type stateTracker struct {
+	mu     sync.Mutex
+	nodes  map[string]*stateAccumulator
+	order  []string
+	shifts *shiftCalendar // Optional; durations restart at each shift boundary
+}
+
+type stateAccumulator struct {
+	current    string
+	since      time.Time
+	durations  map[string]time.Duration
+	shift      string
+	shiftStart time.Time
+}
+
+// StateDurations is the API representation of one tracked state node
+type StateDurations struct {
+	NodeID    string             `json:"nodeID"`
+	Current   string             `json:"current"`
+	Since     time.Time          `json:"since"`
+	Shift     string             `json:"shift,omitempty"`
+	Durations map[string]float64 `json:"durations"` // Seconds per state, including the current one
+}
+
+// Global state tracker for service mode
+var serviceStates = newStateTracker()
+
+func newStateTracker() *stateTracker {
+	return &stateTracker{nodes: make(map[string]*stateAccumulator)}
+}
+
+// observe records the state of a node at the given time. Time since the
+// previous observation is credited to the previous state
+func (t *stateTracker) observe(nodeID, state string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	acc, ok := t.nodes[nodeID]
+	if !ok {
+		acc = &stateAccumulator{
+			current:   state,
+			since:     now,
+			durations: make(map[string]time.Duration),
+		}
+		acc.shift, acc.shiftStart = t.shifts.at(now)
+		t.nodes[nodeID] = acc
+		t.order = append(t.order, nodeID)
+		return
+	}
+
+	t.rollShift(acc, now)
+	acc.durations[acc.current] += now.Sub(acc.since)
+	acc.current = state
+	acc.since = now
+}
+
+// snapshot returns the accumulated durations of all nodes up to now
+func (t *stateTracker) snapshot(now time.Time) []StateDurations {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result := make([]StateDurations, 0, len(t.order))
+	for _, nodeID := range t.order {
+		acc := t.nodes[nodeID]
+		t.rollShift(acc, now)
+		durations := make(map[string]float64, len(acc.durations)+1)
+		for state, d := range acc.durations {
+			durations[state] = d.Seconds()
+		}
+		// Include the time spent in the current state so far
+		durations[acc.current] += now.Sub(acc.since).Seconds()
+
+		result = append(result, StateDurations{
+			NodeID:    nodeID,
+			Current:   acc.current,
+			Since:     acc.since,
+			Shift:     acc.shift,
+			Durations: durations,
+		})
+	}
+	return result
+}
+
+// rollShift restarts the durations of a node when a new shift has begun
+// The current state carries over, counted from the shift start
+func (t *stateTracker) rollShift(acc *stateAccumulator, now time.Time) {
+	shiftID, shiftStart := t.shifts.at(now)
+	if shiftStart.Equal(acc.shiftStart) {
+		return
+	}
+
+	acc.durations = make(map[string]time.Duration)
+	if acc.since.Before(shiftStart) {
+		acc.since = shiftStart
+	}
+	acc.shift = shiftID
+	acc.shiftStart = shiftStart
+}
+
+// trackStates samples the state nodes every interval until the context is cancelled
+func trackStates(ctx context.Context, nodeIDs []string, interval time.Duration) {
+	ids := make([]*ua.NodeID, 0, len(nodeIDs))
+	for _, nodeID := range nodeIDs {
+		id, err := resolveNodeID(nodeID)
+		if err != nil {
+			log.Printf("[%s] Not tracking state of %s: %v", connectionName, nodeID, err)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	log.Printf("[%s] Tracking state durations of %d nodes every %v", connectionName, len(ids), interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			clientMutex.Lock()
+			client := opcuaClient
+			clientMutex.Unlock()
+			if client == nil {
+				continue
+			}
+
+			readCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			for _, id := range ids {
+				dataValue, err := readNodeDataValue(readCtx, client, id)
+				if err != nil {
+					// Keep accumulating the last known state until the read recovers
+					if isVerbose {
+						log.Printf("[%s] State read of %v failed: %v", connectionName, id, err)
+					}
+					continue
+				}
+				serviceStates.observe(id.String(), fmt.Sprintf("%v", dataValue.Value.Value()), time.Now())
+			}
+			cancel()
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handleStatesRequest returns the accumulated state durations
+func handleStatesRequest(w http.ResponseWriter, r *http.Request) {
+	sendJSONResponseGeneric(w, map[string]interface{}{
+		"states": serviceStates.snapshot(time.Now()),
+	})
+}
+
+// sortedStates returns the state names of a snapshot in a stable order
+func sortedStates(durations map[string]float64) []string {
+	states := make([]string, 0, len(durations))
+	for state := range durations {
+		states = append(states, state)
+	}
+	sort.Strings(states)
+	return states
+}
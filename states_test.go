@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestStateTrackerSnapshot tests that time is credited to the state it was spent in
+func TestStateTrackerSnapshot(t *testing.T) {
+	start := time.Date(2025, 3, 1, 6, 0, 0, 0, time.UTC)
+	tracker := newStateTracker()
+
+	tracker.observe("ns=3;s=Mode", "1", start)
+	tracker.observe("ns=3;s=Mode", "1", start.Add(10*time.Second))
+	tracker.observe("ns=3;s=Mode", "2", start.Add(30*time.Second))
+	tracker.observe("ns=3;s=Mode", "1", start.Add(45*time.Second))
+	tracker.observe("ns=3;s=Other", "Idle", start.Add(40*time.Second))
+
+	states := tracker.snapshot(start.Add(60 * time.Second))
+	require.Len(t, states, 2)
+
+	assert.Equal(t, "ns=3;s=Mode", states[0].NodeID)
+	assert.Equal(t, "1", states[0].Current)
+	assert.Equal(t, start.Add(45*time.Second), states[0].Since)
+	assert.Equal(t, map[string]float64{"1": 45, "2": 15}, states[0].Durations)
+
+	assert.Equal(t, "ns=3;s=Other", states[1].NodeID)
+	assert.Equal(t, map[string]float64{"Idle": 20}, states[1].Durations)
+}
+
+// TestFormatStateDurations tests influx output of state durations
+func TestFormatStateDurations(t *testing.T) {
+	states := []StateDurations{
+		{
+			NodeID:    "ns=3;s=Mode",
+			Current:   "Auto Run",
+			Durations: map[string]float64{"Auto Run": 12.5, "Manual": 3},
+		},
+	}
+	opts := influxOptions{at: time.Unix(0, 1000)}
+
+	result := formatStateDurations(states, "influx", "opc.tcp://plc:4840", opts)
+	assert.Equal(t,
+		"opcua_state,node_id=ns\\=3;s\\=Mode,endpoint=opc.tcp://plc:4840,state=Auto\\ Run duration_s=12.500,active=1 1000\n"+
+			"opcua_state,node_id=ns\\=3;s\\=Mode,endpoint=opc.tcp://plc:4840,state=Manual duration_s=3.000,active=0 1000",
+		result)
+}
@@ -0,0 +1,658 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// rawStructure keeps the binary body of an extension object of a custom
+// structure type, so it can be decoded with the DataTypeDefinition read from
+// the server. gopcua drops the bodies of types it does not know
+type rawStructure struct {
+	body []byte
+}
+
+// Decode implements ua.BinaryDecoder. The body buffer holds exactly one object
+func (s *rawStructure) Decode(b []byte) (int, error) {
+	s.body = append([]byte(nil), b...)
+	return len(b), nil
+}
+
+// Encode implements ua.BinaryEncoder for writing encoded structures
+func (s *rawStructure) Encode() ([]byte, error) {
+	return s.body, nil
+}
+
+// structCache remembers the definitions of custom data types, so each
+// DataTypeDefinition is only read once
+type structCache struct {
+	mu          sync.Mutex
+	definitions map[string]interface{} // *ua.StructureDefinition, *ua.EnumDefinition or nil per data type
+	encodings   map[string]*ua.NodeID  // Data type of each registered binary encoding
+}
+
+// Global structure cache for service mode
+var serviceStructs = newStructCache()
+
+func newStructCache() *structCache {
+	return &structCache{
+		definitions: make(map[string]interface{}),
+		encodings:   make(map[string]*ua.NodeID),
+	}
+}
+
+// decodeStructures replaces custom structure values read from a node by their
+// fields. The first read of a new structure type has no body to decode, so the
+// node is read again once the type is registered. Values that cannot be
+// decoded are returned unchanged
+func decodeStructures(ctx context.Context, client *opcua.Client, nodeID *ua.NodeID, value interface{}) interface{} {
+	decoded, reread, err := serviceStructs.decodeValue(ctx, client, value)
+	if reread && err == nil {
+		var dataValue *ua.DataValue
+		dataValue, err = readNodeDataValue(ctx, client, nodeID)
+		if err == nil && dataValue.Value != nil {
+			decoded, _, err = serviceStructs.decodeValue(ctx, client, dataValue.Value.Value())
+		}
+	}
+	if err != nil {
+		if isVerbose {
+			log.Printf("[%s] Structure decoding of %v failed: %v", connectionName, nodeID, err)
+		}
+		return value
+	}
+	return decoded
+}
+
+// decodeValue decodes a structure or array of structures. reread is set when
+// a structure type was registered and the value must be read again
+func (c *structCache) decodeValue(ctx context.Context, client *opcua.Client, value interface{}) (interface{}, bool, error) {
+	switch v := value.(type) {
+	case *ua.ExtensionObject:
+		return c.decodeObject(ctx, client, v)
+	case []*ua.ExtensionObject:
+		result := make([]interface{}, len(v))
+		reread := false
+		for i, obj := range v {
+			decoded, again, err := c.decodeObject(ctx, client, obj)
+			if err != nil {
+				return value, false, err
+			}
+			result[i] = decoded
+			reread = reread || again
+		}
+		return result, reread, nil
+	}
+	return value, false, nil
+}
+
+func (c *structCache) decodeObject(ctx context.Context, client *opcua.Client, obj *ua.ExtensionObject) (interface{}, bool, error) {
+	if obj == nil || obj.TypeID == nil || obj.TypeID.NodeID == nil {
+		return obj, false, nil
+	}
+	encodingID := obj.TypeID.NodeID
+
+	switch body := obj.Value.(type) {
+	case *rawStructure:
+		c.mu.Lock()
+		dataTypeID := c.encodings[encodingID.String()]
+		c.mu.Unlock()
+		if dataTypeID == nil {
+			return obj, false, fmt.Errorf("encoding %s is not registered", encodingID)
+		}
+		def, err := c.definition(ctx, client, dataTypeID)
+		if err != nil {
+			return obj, false, err
+		}
+		structure, ok := def.(*ua.StructureDefinition)
+		if !ok {
+			return obj, false, fmt.Errorf("data type %s is no structure", dataTypeID)
+		}
+		buf := ua.NewBuffer(body.body)
+		fields, err := c.decodeStructure(ctx, client, buf, structure)
+		return fields, false, err
+
+	case nil:
+		if obj.EncodingMask != ua.ExtensionObjectBinary {
+			return obj, false, nil
+		}
+		return obj, true, c.register(ctx, client, encodingID)
+	}
+
+	// Types gopcua knows are left alone
+	return obj, false, nil
+}
+
+// register looks up the structure type of a binary encoding and registers it
+// with gopcua, so the bodies of its values are kept
+func (c *structCache) register(ctx context.Context, client *opcua.Client, encodingID *ua.NodeID) error {
+	if encodingID.Namespace() == 0 {
+		return fmt.Errorf("unsupported standard type encoding %s", encodingID)
+	}
+
+	dataTypes, err := client.Node(encodingID).ReferencedNodes(ctx, id.HasEncoding, ua.BrowseDirectionInverse, ua.NodeClassDataType, false)
+	if err != nil {
+		return fmt.Errorf("failed to browse data type of encoding %s: %v", encodingID, err)
+	}
+	if len(dataTypes) == 0 {
+		return fmt.Errorf("no data type found for encoding %s", encodingID)
+	}
+	dataTypeID := dataTypes[0].ID
+
+	def, err := c.definition(ctx, client, dataTypeID)
+	if err != nil {
+		return err
+	}
+	if _, ok := def.(*ua.StructureDefinition); !ok {
+		return fmt.Errorf("data type %s has no structure definition", dataTypeID)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, registered := c.encodings[encodingID.String()]; !registered {
+		ua.RegisterExtensionObject(encodingID, new(rawStructure))
+		c.encodings[encodingID.String()] = dataTypeID
+	}
+	return nil
+}
+
+// definition returns the DataTypeDefinition of a data type, nil if the server
+// has none (simple types, servers before OPC UA 1.04)
+func (c *structCache) definition(ctx context.Context, client *opcua.Client, dataTypeID *ua.NodeID) (interface{}, error) {
+	key := dataTypeID.String()
+	c.mu.Lock()
+	def, cached := c.definitions[key]
+	c.mu.Unlock()
+	if cached {
+		return def, nil
+	}
+
+	attrs, err := client.Node(dataTypeID).Attributes(ctx, ua.AttributeIDDataTypeDefinition)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read definition of data type %s: %v", dataTypeID, err)
+	}
+	def = nil
+	if len(attrs) > 0 && attrs[0].Status == ua.StatusOK && attrs[0].Value != nil {
+		if obj, ok := attrs[0].Value.Value().(*ua.ExtensionObject); ok && obj != nil {
+			switch d := obj.Value.(type) {
+			case *ua.StructureDefinition:
+				def = d
+			case *ua.EnumDefinition:
+				def = d
+			}
+		}
+	}
+
+	c.mu.Lock()
+	c.definitions[key] = def
+	c.mu.Unlock()
+	return def, nil
+}
+
+// decodeStructure decodes the fields of a structure body in definition order
+func (c *structCache) decodeStructure(ctx context.Context, client *opcua.Client, buf *ua.Buffer, def *ua.StructureDefinition) (map[string]interface{}, error) {
+	fields := make(map[string]interface{}, len(def.Fields))
+
+	switch def.StructureType {
+	case ua.StructureTypeStructure, ua.StructureTypeStructureWithOptionalFields:
+		// Optional fields are present when their bit in the leading mask is set
+		var mask uint32
+		if def.StructureType == ua.StructureTypeStructureWithOptionalFields {
+			mask = buf.ReadUint32()
+		}
+		optional := 0
+		for _, field := range def.Fields {
+			if field.IsOptional {
+				present := mask&(1<<uint(optional)) != 0
+				optional++
+				if !present {
+					continue
+				}
+			}
+			value, err := c.decodeField(ctx, client, buf, field)
+			if err != nil {
+				return nil, err
+			}
+			fields[field.Name] = value
+		}
+
+	case ua.StructureTypeUnion:
+		// The switch field selects the one field that is encoded, 0 means none
+		selected := buf.ReadUint32()
+		if selected > uint32(len(def.Fields)) {
+			return nil, fmt.Errorf("union switch %d out of range", selected)
+		}
+		if selected > 0 {
+			field := def.Fields[selected-1]
+			value, err := c.decodeField(ctx, client, buf, field)
+			if err != nil {
+				return nil, err
+			}
+			fields[field.Name] = value
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported structure type %d", def.StructureType)
+	}
+
+	if err := buf.Error(); err != nil {
+		return nil, fmt.Errorf("structure body too short: %v", err)
+	}
+	return fields, nil
+}
+
+// decodeField decodes a scalar or one-dimensional array field
+func (c *structCache) decodeField(ctx context.Context, client *opcua.Client, buf *ua.Buffer, field *ua.StructureField) (interface{}, error) {
+	switch {
+	case field.ValueRank == -1:
+		return c.decodeScalar(ctx, client, buf, field.DataType)
+	case field.ValueRank == 1:
+		n := buf.ReadInt32()
+		if n < 0 {
+			return nil, nil
+		}
+		if int(n) > buf.Len() {
+			return nil, fmt.Errorf("field %s: array length %d exceeds structure body", field.Name, n)
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			value, err := c.decodeScalar(ctx, client, buf, field.DataType)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = value
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("field %s: unsupported value rank %d", field.Name, field.ValueRank)
+}
+
+// decodeScalar decodes one value of a built-in type, an enumeration or a
+// nested structure
+func (c *structCache) decodeScalar(ctx context.Context, client *opcua.Client, buf *ua.Buffer, dataTypeID *ua.NodeID) (interface{}, error) {
+	if dataTypeID.Namespace() == 0 {
+		switch dataTypeID.IntID() {
+		case id.Boolean:
+			return buf.ReadBool(), nil
+		case id.SByte:
+			return buf.ReadInt8(), nil
+		case id.Byte:
+			return buf.ReadByte(), nil
+		case id.Int16:
+			return buf.ReadInt16(), nil
+		case id.UInt16:
+			return buf.ReadUint16(), nil
+		case id.Int32:
+			return buf.ReadInt32(), nil
+		case id.UInt32:
+			return buf.ReadUint32(), nil
+		case id.Int64:
+			return buf.ReadInt64(), nil
+		case id.UInt64:
+			return buf.ReadUint64(), nil
+		case id.Float:
+			return buf.ReadFloat32(), nil
+		case id.Double, id.Duration:
+			return buf.ReadFloat64(), nil
+		case id.String:
+			return buf.ReadString(), nil
+		case id.DateTime, id.UtcTime:
+			return buf.ReadTime(), nil
+		case id.ByteString:
+			return buf.ReadBytes(), nil
+		case id.LocalizedText:
+			text := new(ua.LocalizedText)
+			buf.ReadStruct(text)
+			return text.Text, nil
+		case id.NodeID:
+			nodeID := new(ua.NodeID)
+			buf.ReadStruct(nodeID)
+			return nodeID.String(), nil
+		}
+		return nil, fmt.Errorf("unsupported field data type %s", dataTypeID)
+	}
+
+	def, err := c.definition(ctx, client, dataTypeID)
+	if err != nil {
+		return nil, err
+	}
+	switch d := def.(type) {
+	case *ua.StructureDefinition:
+		return c.decodeStructure(ctx, client, buf, d)
+	case *ua.EnumDefinition:
+		return buf.ReadInt32(), nil
+	}
+	return nil, fmt.Errorf("data type %s has no DataTypeDefinition", dataTypeID)
+}
+
+// encodeStructures encodes a JSON document as a value of the node's structure
+// data type, ready to be written in one operation. A JSON object encodes one
+// structure, a JSON array an array of structures
+func encodeStructures(ctx context.Context, client *opcua.Client, nodeID *ua.NodeID, doc string) (*ua.Variant, error) {
+	dec := json.NewDecoder(strings.NewReader(doc))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	dataTypeID, err := serviceEnums.nodeDataType(ctx, client, nodeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data type: %v", err)
+	}
+	def, err := serviceStructs.definition(ctx, client, dataTypeID)
+	if err != nil {
+		return nil, err
+	}
+	structure, ok := def.(*ua.StructureDefinition)
+	if !ok {
+		return nil, fmt.Errorf("data type %s of the node is no structure", dataTypeID)
+	}
+	if structure.DefaultEncodingID == nil {
+		return nil, fmt.Errorf("data type %s has no default binary encoding", dataTypeID)
+	}
+
+	encode := func(v interface{}) (*ua.ExtensionObject, error) {
+		fields, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected a JSON object, got %T", v)
+		}
+		buf := ua.NewBuffer(nil)
+		if err := serviceStructs.encodeStructure(ctx, client, buf, structure, fields); err != nil {
+			return nil, err
+		}
+		return &ua.ExtensionObject{
+			EncodingMask: ua.ExtensionObjectBinary,
+			TypeID:       ua.NewExpandedNodeID(structure.DefaultEncodingID, "", 0),
+			Value:        &rawStructure{body: buf.Bytes()},
+		}, nil
+	}
+
+	if values, ok := value.([]interface{}); ok {
+		objs := make([]*ua.ExtensionObject, len(values))
+		for i, v := range values {
+			if objs[i], err = encode(v); err != nil {
+				return nil, fmt.Errorf("element %d: %v", i, err)
+			}
+		}
+		return ua.NewVariant(objs)
+	}
+	obj, err := encode(value)
+	if err != nil {
+		return nil, err
+	}
+	return ua.NewVariant(obj)
+}
+
+// encodeStructure encodes the fields of a structure in definition order, the
+// reverse of decodeStructure. Unknown and missing fields are errors, so typos
+// do not silently write zero values
+func (c *structCache) encodeStructure(ctx context.Context, client *opcua.Client, buf *ua.Buffer, def *ua.StructureDefinition, fields map[string]interface{}) error {
+	known := make(map[string]bool, len(def.Fields))
+	for _, field := range def.Fields {
+		known[field.Name] = true
+	}
+	for name := range fields {
+		if !known[name] {
+			return fmt.Errorf("unknown field %s", name)
+		}
+	}
+
+	switch def.StructureType {
+	case ua.StructureTypeStructure, ua.StructureTypeStructureWithOptionalFields:
+		// Optional fields are present when they are in the JSON document
+		if def.StructureType == ua.StructureTypeStructureWithOptionalFields {
+			var mask uint32
+			optional := 0
+			for _, field := range def.Fields {
+				if field.IsOptional {
+					if _, present := fields[field.Name]; present {
+						mask |= 1 << uint(optional)
+					}
+					optional++
+				}
+			}
+			buf.WriteUint32(mask)
+		}
+		for _, field := range def.Fields {
+			value, present := fields[field.Name]
+			if !present {
+				if field.IsOptional {
+					continue
+				}
+				return fmt.Errorf("missing field %s", field.Name)
+			}
+			if err := c.encodeField(ctx, client, buf, field, value); err != nil {
+				return err
+			}
+		}
+
+	case ua.StructureTypeUnion:
+		// The one field in the JSON document selects the union member, none writes an empty union
+		if len(fields) > 1 {
+			return fmt.Errorf("union takes one field, got %d", len(fields))
+		}
+		if len(fields) == 0 {
+			buf.WriteUint32(0)
+			break
+		}
+		for i, field := range def.Fields {
+			if value, present := fields[field.Name]; present {
+				buf.WriteUint32(uint32(i + 1))
+				if err := c.encodeField(ctx, client, buf, field, value); err != nil {
+					return err
+				}
+			}
+		}
+
+	default:
+		return fmt.Errorf("unsupported structure type %d", def.StructureType)
+	}
+	return buf.Error()
+}
+
+// encodeField encodes a scalar or one-dimensional array field
+func (c *structCache) encodeField(ctx context.Context, client *opcua.Client, buf *ua.Buffer, field *ua.StructureField, value interface{}) error {
+	switch field.ValueRank {
+	case -1:
+		if err := c.encodeScalar(ctx, client, buf, field.DataType, value); err != nil {
+			return fmt.Errorf("field %s: %v", field.Name, err)
+		}
+		return nil
+	case 1:
+		if value == nil {
+			buf.WriteInt32(-1)
+			return nil
+		}
+		values, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("field %s: expected a JSON array, got %T", field.Name, value)
+		}
+		buf.WriteInt32(int32(len(values)))
+		for i, v := range values {
+			if err := c.encodeScalar(ctx, client, buf, field.DataType, v); err != nil {
+				return fmt.Errorf("field %s[%d]: %v", field.Name, i, err)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("field %s: unsupported value rank %d", field.Name, field.ValueRank)
+}
+
+// encodeScalar encodes one JSON value as a built-in type, an enumeration or a
+// nested structure
+func (c *structCache) encodeScalar(ctx context.Context, client *opcua.Client, buf *ua.Buffer, dataTypeID *ua.NodeID, value interface{}) error {
+	if dataTypeID.Namespace() == 0 {
+		switch dataTypeID.IntID() {
+		case id.Boolean:
+			v, ok := value.(bool)
+			if !ok {
+				return fmt.Errorf("expected a boolean, got %v", value)
+			}
+			buf.WriteBool(v)
+		case id.SByte:
+			v, err := jsonInt(value, 8)
+			buf.WriteInt8(int8(v))
+			return err
+		case id.Byte:
+			v, err := jsonUint(value, 8)
+			buf.WriteUint8(uint8(v))
+			return err
+		case id.Int16:
+			v, err := jsonInt(value, 16)
+			buf.WriteInt16(int16(v))
+			return err
+		case id.UInt16:
+			v, err := jsonUint(value, 16)
+			buf.WriteUint16(uint16(v))
+			return err
+		case id.Int32:
+			v, err := jsonInt(value, 32)
+			buf.WriteInt32(int32(v))
+			return err
+		case id.UInt32:
+			v, err := jsonUint(value, 32)
+			buf.WriteUint32(uint32(v))
+			return err
+		case id.Int64:
+			v, err := jsonInt(value, 64)
+			buf.WriteInt64(v)
+			return err
+		case id.UInt64:
+			v, err := jsonUint(value, 64)
+			buf.WriteUint64(v)
+			return err
+		case id.Float:
+			v, err := jsonFloat(value, 32)
+			buf.WriteFloat32(float32(v))
+			return err
+		case id.Double, id.Duration:
+			v, err := jsonFloat(value, 64)
+			buf.WriteFloat64(v)
+			return err
+		case id.String:
+			v, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("expected a string, got %v", value)
+			}
+			buf.WriteString(v)
+		case id.DateTime, id.UtcTime:
+			v, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("expected an RFC 3339 time, got %v", value)
+			}
+			t, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				return fmt.Errorf("expected an RFC 3339 time: %v", err)
+			}
+			buf.WriteTime(t)
+		case id.ByteString:
+			// encoding/json writes byte slices as base64, so read values round-trip
+			v, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("expected a base64 string, got %v", value)
+			}
+			b, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				return fmt.Errorf("expected a base64 string: %v", err)
+			}
+			buf.WriteByteString(b)
+		case id.LocalizedText:
+			v, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("expected a string, got %v", value)
+			}
+			buf.WriteStruct(ua.NewLocalizedText(v))
+		case id.NodeID:
+			v, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("expected a node ID, got %v", value)
+			}
+			nodeID, err := ua.ParseNodeID(v)
+			if err != nil {
+				return err
+			}
+			buf.WriteStruct(nodeID)
+		default:
+			return fmt.Errorf("unsupported field data type %s", dataTypeID)
+		}
+		return nil
+	}
+
+	def, err := c.definition(ctx, client, dataTypeID)
+	if err != nil {
+		return err
+	}
+	switch d := def.(type) {
+	case *ua.StructureDefinition:
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("expected a JSON object, got %T", value)
+		}
+		return c.encodeStructure(ctx, client, buf, d, fields)
+	case *ua.EnumDefinition:
+		// Enumerations take their number or the name of a value
+		if name, ok := value.(string); ok {
+			for _, field := range d.Fields {
+				if field.Name == name {
+					buf.WriteInt32(int32(field.Value))
+					return nil
+				}
+			}
+			return fmt.Errorf("unknown enumeration value %s", name)
+		}
+		v, err := jsonInt(value, 32)
+		buf.WriteInt32(int32(v))
+		return err
+	}
+	return fmt.Errorf("data type %s has no DataTypeDefinition", dataTypeID)
+}
+
+// jsonInt converts a JSON number to a signed integer of the given size
+func jsonInt(value interface{}, bits int) (int64, error) {
+	n, ok := value.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("expected an integer, got %v", value)
+	}
+	v, err := strconv.ParseInt(n.String(), 10, bits)
+	if err != nil {
+		return 0, fmt.Errorf("invalid int%d %s", bits, n)
+	}
+	return v, nil
+}
+
+// jsonUint converts a JSON number to an unsigned integer of the given size
+func jsonUint(value interface{}, bits int) (uint64, error) {
+	n, ok := value.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("expected an integer, got %v", value)
+	}
+	v, err := strconv.ParseUint(n.String(), 10, bits)
+	if err != nil {
+		return 0, fmt.Errorf("invalid uint%d %s", bits, n)
+	}
+	return v, nil
+}
+
+// jsonFloat converts a JSON number to a float of the given size
+func jsonFloat(value interface{}, bits int) (float64, error) {
+	n, ok := value.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("expected a number, got %v", value)
+	}
+	v, err := strconv.ParseFloat(n.String(), bits)
+	if err != nil {
+		return 0, fmt.Errorf("invalid float %s", n)
+	}
+	return v, nil
+}
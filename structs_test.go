@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDecodeStructure tests decoding a structure body with built-in, array,
+// enumeration and nested structure fields
+func TestDecodeStructure(t *testing.T) {
+	c := newStructCache()
+	modeType := ua.NewStringNodeID(3, "Mode")
+	axisType := ua.NewStringNodeID(3, "Axis")
+	c.definitions[modeType.String()] = &ua.EnumDefinition{}
+	c.definitions[axisType.String()] = &ua.StructureDefinition{
+		Fields: []*ua.StructureField{
+			{Name: "Position", DataType: ua.NewNumericNodeID(0, id.Double), ValueRank: -1},
+		},
+	}
+
+	def := &ua.StructureDefinition{
+		StructureType: ua.StructureTypeStructure,
+		Fields: []*ua.StructureField{
+			{Name: "Running", DataType: ua.NewNumericNodeID(0, id.Boolean), ValueRank: -1},
+			{Name: "Speed", DataType: ua.NewNumericNodeID(0, id.Float), ValueRank: -1},
+			{Name: "Name", DataType: ua.NewNumericNodeID(0, id.String), ValueRank: -1},
+			{Name: "Counts", DataType: ua.NewNumericNodeID(0, id.Int16), ValueRank: 1},
+			{Name: "Mode", DataType: modeType, ValueRank: -1},
+			{Name: "Axis", DataType: axisType, ValueRank: -1},
+		},
+	}
+
+	body := ua.NewBuffer(nil)
+	body.WriteBool(true)
+	body.WriteFloat32(12.5)
+	body.WriteString("Press3")
+	body.WriteInt32(2)
+	body.WriteInt16(7)
+	body.WriteInt16(-1)
+	body.WriteInt32(2)
+	body.WriteFloat64(101.25)
+
+	fields, err := c.decodeStructure(context.Background(), nil, ua.NewBuffer(body.Bytes()), def)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"Running": true,
+		"Speed":   float32(12.5),
+		"Name":    "Press3",
+		"Counts":  []interface{}{int16(7), int16(-1)},
+		"Mode":    int32(2),
+		"Axis":    map[string]interface{}{"Position": 101.25},
+	}, fields)
+
+	// A truncated body is an error, not a partial structure
+	_, err = c.decodeStructure(context.Background(), nil, ua.NewBuffer(body.Bytes()[:10]), def)
+	assert.Error(t, err)
+}
+
+// TestDecodeStructureOptionalFields tests optional fields and unions
+func TestDecodeStructureOptionalFields(t *testing.T) {
+	c := newStructCache()
+	int32Type := ua.NewNumericNodeID(0, id.Int32)
+	fields := []*ua.StructureField{
+		{Name: "A", DataType: int32Type, ValueRank: -1},
+		{Name: "B", DataType: int32Type, ValueRank: -1, IsOptional: true},
+		{Name: "C", DataType: int32Type, ValueRank: -1, IsOptional: true},
+	}
+
+	body := ua.NewBuffer(nil)
+	body.WriteUint32(0x2) // Only C is present
+	body.WriteInt32(1)
+	body.WriteInt32(3)
+	decoded, err := c.decodeStructure(context.Background(), nil, ua.NewBuffer(body.Bytes()),
+		&ua.StructureDefinition{StructureType: ua.StructureTypeStructureWithOptionalFields, Fields: fields})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"A": int32(1), "C": int32(3)}, decoded)
+
+	body = ua.NewBuffer(nil)
+	body.WriteUint32(2) // Second field selected
+	body.WriteInt32(42)
+	decoded, err = c.decodeStructure(context.Background(), nil, ua.NewBuffer(body.Bytes()),
+		&ua.StructureDefinition{StructureType: ua.StructureTypeUnion, Fields: fields})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"B": int32(42)}, decoded)
+}
+
+// TestDecodeValueLeavesOtherValues tests that non-structure values pass through
+func TestDecodeValueLeavesOtherValues(t *testing.T) {
+	c := newStructCache()
+	value, reread, err := c.decodeValue(context.Background(), nil, 42.0)
+	require.NoError(t, err)
+	assert.False(t, reread)
+	assert.Equal(t, 42.0, value)
+}
+
+// TestEncodeStructure tests that an encoded JSON document decodes to the same
+// fields, with enumeration names and optional fields
+func TestEncodeStructure(t *testing.T) {
+	c := newStructCache()
+	modeType := ua.NewStringNodeID(3, "Mode")
+	axisType := ua.NewStringNodeID(3, "Axis")
+	c.definitions[modeType.String()] = &ua.EnumDefinition{Fields: []*ua.EnumField{{Value: 2, Name: "Auto"}}}
+	c.definitions[axisType.String()] = &ua.StructureDefinition{
+		Fields: []*ua.StructureField{
+			{Name: "Position", DataType: ua.NewNumericNodeID(0, id.Double), ValueRank: -1},
+		},
+	}
+	def := &ua.StructureDefinition{
+		StructureType: ua.StructureTypeStructureWithOptionalFields,
+		Fields: []*ua.StructureField{
+			{Name: "Speed", DataType: ua.NewNumericNodeID(0, id.Float), ValueRank: -1},
+			{Name: "Counts", DataType: ua.NewNumericNodeID(0, id.Int16), ValueRank: 1},
+			{Name: "Mode", DataType: modeType, ValueRank: -1},
+			{Name: "Axis", DataType: axisType, ValueRank: -1},
+			{Name: "Note", DataType: ua.NewNumericNodeID(0, id.String), ValueRank: -1, IsOptional: true},
+		},
+	}
+
+	fields := map[string]interface{}{
+		"Speed":  json.Number("12.5"),
+		"Counts": []interface{}{json.Number("7"), json.Number("-1")},
+		"Mode":   "Auto",
+		"Axis":   map[string]interface{}{"Position": json.Number("101.25")},
+	}
+	buf := ua.NewBuffer(nil)
+	require.NoError(t, c.encodeStructure(context.Background(), nil, buf, def, fields))
+
+	decoded, err := c.decodeStructure(context.Background(), nil, ua.NewBuffer(buf.Bytes()), def)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"Speed":  float32(12.5),
+		"Counts": []interface{}{int16(7), int16(-1)},
+		"Mode":   int32(2),
+		"Axis":   map[string]interface{}{"Position": 101.25},
+	}, decoded)
+
+	// Typos and out of range values are rejected instead of writing zeros
+	for _, bad := range []map[string]interface{}{
+		{"Speed": json.Number("1"), "Counts": nil, "Mode": "Auto", "Axis": map[string]interface{}{"Position": json.Number("0")}, "Spede": json.Number("1")},
+		{"Speed": json.Number("1"), "Counts": nil, "Mode": "Auto"},
+		{"Speed": json.Number("1"), "Counts": []interface{}{json.Number("40000")}, "Mode": "Auto", "Axis": map[string]interface{}{"Position": json.Number("0")}},
+		{"Speed": json.Number("1"), "Counts": nil, "Mode": "Manual", "Axis": map[string]interface{}{"Position": json.Number("0")}},
+	} {
+		assert.Error(t, c.encodeStructure(context.Background(), nil, ua.NewBuffer(nil), def, bad))
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"umicli/pkg/plcclient"
+)
+
+// Default cap on the variables opcua subscribe monitors, keeps an
+// accidental subscribe on a big folder from flooding the PLC with reads
+const defaultSubscribeItems = 100
+
+// Interval of opcua subscribe without --interval
+const defaultSubscribeInterval = time.Second
+
+// Flags of opcua subscribe
+var (
+	subscribeSubtree  string
+	subscribeDepth    int
+	subscribeMaxItems int
+	subscribeRebrowse time.Duration
+)
+
+// subtreeVariables browses the variables below a node through the service
+// and returns at most maxItems of their node IDs, in browse order, and how
+// many there are. Variables reachable on several paths are monitored once
+func subtreeVariables(nodeID string, maxDepth, maxItems int, host string, port int) ([]string, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout(120*time.Second))
+	nodes, err := newServiceClient(host, port).Browse(ctx, nodeID, maxDepth)
+	cancel()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var nodeIDs []string
+	seen := make(map[string]bool)
+	for _, node := range nodes {
+		id := node.NodeID
+		// Browse prints namespace 0 without ns=, get needs it
+		if !strings.HasPrefix(id, "ns=") && !strings.HasPrefix(id, "nsu=") {
+			id = "ns=0;" + id
+		}
+		if !seen[id] {
+			seen[id] = true
+			nodeIDs = append(nodeIDs, id)
+		}
+	}
+	if len(nodeIDs) == 0 {
+		return nil, 0, fmt.Errorf("no variables below %s within %d levels", nodeID, maxDepth)
+	}
+	total := len(nodeIDs)
+	if total > maxItems {
+		nodeIDs = nodeIDs[:maxItems]
+	}
+	return nodeIDs, total, nil
+}
+
+// diffNodeIDs returns the node IDs of next missing in prev and those of prev
+// missing in next
+func diffNodeIDs(prev, next []string) (added, removed []string) {
+	inPrev := make(map[string]bool, len(prev))
+	for _, id := range prev {
+		inPrev[id] = true
+	}
+	inNext := make(map[string]bool, len(next))
+	for _, id := range next {
+		inNext[id] = true
+		if !inPrev[id] {
+			added = append(added, id)
+		}
+	}
+	for _, id := range prev {
+		if !inNext[id] {
+			removed = append(removed, id)
+		}
+	}
+	return added, removed
+}
+
+// subtreeMonitor polls the variables below a node and, with a re-browse
+// interval, keeps them in line with the address space, e.g. when a modular
+// machine gets a station added
+type subtreeMonitor struct {
+	subtree  string
+	maxDepth int
+	maxItems int
+	rebrowse time.Duration // 0 to browse once
+	host     string
+	port     int
+	nodeIDs  []string // Monitored variables
+	found    int      // Variables below the node, more than nodeIDs when capped
+
+	transforms valueTransforms // Of --transform and --transform-file
+}
+
+// browse browses the subtree and monitors the variables found from then on.
+// Changes to the monitored variables are reported on stderr, and with the
+// influx format as an opcua_subscribe line
+func (m *subtreeMonitor) browse(format string, influxOpts influxOptions) error {
+	nodeIDs, total, err := subtreeVariables(m.subtree, m.maxDepth, m.maxItems, m.host, m.port)
+	if err != nil {
+		return err
+	}
+	// Warn again only when the number of variables changed
+	if total > m.maxItems && total != m.found {
+		fmt.Fprintf(os.Stderr, "Warning: %d variables below %s, subscribing to the first %d (--max-items)\n", total, m.subtree, m.maxItems)
+	}
+
+	first := m.nodeIDs == nil
+	added, removed := diffNodeIDs(m.nodeIDs, nodeIDs)
+	m.nodeIDs = nodeIDs
+	m.found = total
+	switch {
+	case first:
+		fmt.Fprintf(os.Stderr, "Subscribed to %d variables below %s\n", len(nodeIDs), m.subtree)
+	case len(added) > 0 || len(removed) > 0:
+		fmt.Fprintf(os.Stderr, "Re-browsed %s: %d variables, added %d [%s], removed %d [%s]\n",
+			m.subtree, len(nodeIDs), len(added), strings.Join(added, " "), len(removed), strings.Join(removed, " "))
+	}
+
+	if format == "influx" {
+		endpoint := "unknown"
+		if info, err := getConnectionInfo(m.host, m.port); err == nil {
+			endpoint, _ = info["endpoint"].(string)
+		}
+		fmt.Printf("opcua_subscribe%s items=%di,found=%di,added=%di,removed=%di %d\n",
+			influxOpts.tagSet(m.subtree, endpoint), len(nodeIDs), total, len(added), len(removed), influxOpts.lineTimestamp())
+	}
+	return nil
+}
+
+// run prints the values of the monitored variables every interval like get
+// --interval, re-browsing the subtree every rebrowse interval. It only
+// returns if the first browse fails
+func (m *subtreeMonitor) run(interval time.Duration, format, measurement string, readOpts plcclient.ReadOptions, influxOpts influxOptions) error {
+	if err := m.browse(format, influxOpts); err != nil {
+		return err
+	}
+	browsed := time.Now()
+	for {
+		if m.rebrowse > 0 && time.Since(browsed) >= m.rebrowse {
+			// Keep monitoring the known variables when the browse fails
+			if err := m.browse(format, influxOpts); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: re-browse of %s: %v\n", m.subtree, err)
+			}
+			browsed = time.Now()
+		}
+
+		value, err := getNodeValues(m.nodeIDs, m.host, m.port, format, measurement, readOpts, bitOptions{}, influxOpts, counterOptions{}, m.transforms)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		} else {
+			fmt.Println(value)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSubtreeVariables tests collecting the variables to subscribe to from a
+// browse of the service
+func TestSubtreeVariables(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/browse", r.URL.Path)
+		assert.Equal(t, "ns=3;s=Line1", r.URL.Query().Get("nodeid"))
+		if r.URL.Query().Get("maxdepth") == "0" {
+			w.Write([]byte(`{"nodes": []}`))
+			return
+		}
+		w.Write([]byte(`{"nodes": [
+			{"nodeId": "ns=3;s=Line1.Speed"},
+			{"nodeId": "i=2258"},
+			{"nodeId": "ns=3;s=Line1.Speed"},
+			{"nodeId": "ns=3;s=Line1.Count"}
+		]}`))
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.NoError(t, err)
+
+	nodeIDs, total, err := subtreeVariables("ns=3;s=Line1", 3, 10, u.Hostname(), port)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ns=3;s=Line1.Speed", "ns=0;i=2258", "ns=3;s=Line1.Count"}, nodeIDs)
+	assert.Equal(t, 3, total)
+
+	nodeIDs, total, err = subtreeVariables("ns=3;s=Line1", 3, 2, u.Hostname(), port)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ns=3;s=Line1.Speed", "ns=0;i=2258"}, nodeIDs, "capped at max items")
+	assert.Equal(t, 3, total)
+
+	_, _, err = subtreeVariables("ns=3;s=Line1", 0, 10, u.Hostname(), port)
+	assert.ErrorContains(t, err, "no variables")
+}
+
+// TestSubtreeMonitorRebrowse tests following variables added to and removed
+// from the subtree
+func TestSubtreeMonitorRebrowse(t *testing.T) {
+	nodes := `[{"nodeId": "ns=3;s=Station1.Speed"}, {"nodeId": "ns=3;s=Station2.Speed"}]`
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/browse", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"nodes": ` + nodes + `}`))
+	})
+	mux.HandleFunc("/api/info", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"endpoint": "opc.tcp://plc:4840"}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.NoError(t, err)
+
+	m := &subtreeMonitor{subtree: "ns=3;s=Line1", maxDepth: 3, maxItems: 10, host: u.Hostname(), port: port}
+	require.NoError(t, m.browse("default", influxOptions{}))
+	assert.Equal(t, []string{"ns=3;s=Station1.Speed", "ns=3;s=Station2.Speed"}, m.nodeIDs)
+
+	// A station was added and one taken out
+	nodes = `[{"nodeId": "ns=3;s=Station1.Speed"}, {"nodeId": "ns=3;s=Station3.Speed"}]`
+	require.NoError(t, m.browse("default", influxOptions{}))
+	assert.Equal(t, []string{"ns=3;s=Station1.Speed", "ns=3;s=Station3.Speed"}, m.nodeIDs)
+
+	// A failed browse keeps the monitored variables
+	nodes = `[]`
+	assert.Error(t, m.browse("default", influxOptions{}))
+	assert.Len(t, m.nodeIDs, 2)
+}
+
+// TestDiffNodeIDs tests the reconciliation of monitored variables
+func TestDiffNodeIDs(t *testing.T) {
+	added, removed := diffNodeIDs([]string{"a", "b", "c"}, []string{"c", "d", "a"})
+	assert.Equal(t, []string{"d"}, added)
+	assert.Equal(t, []string{"b"}, removed)
+
+	added, removed = diffNodeIDs(nil, []string{"a"})
+	assert.Equal(t, []string{"a"}, added)
+	assert.Empty(t, removed)
+}
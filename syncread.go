@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+)
+
+// readSynchronizedDataValues reads the Value attribute of nodes in a single
+// read request, so the PLC samples them together, and returns the time of
+// the read: the server's timestamp of the response, the local time if it
+// sends none. Reads of more nodes than the server's MaxNodesPerRead fail
+// instead of being split, which would spread the samples over several
+// requests. Bad status codes are left for the caller per node
+func readSynchronizedDataValues(ctx context.Context, client *opcua.Client, nodeIDs []*ua.NodeID) ([]*ua.DataValue, time.Time, error) {
+	unique, positions := dedupeNodeIDs(nodeIDs)
+	if limit := serviceLimits.get().MaxNodesPerRead; len(unique) > limit {
+		return nil, time.Time{}, fmt.Errorf("a synchronized read of %d nodes exceeds the server's MaxNodesPerRead of %d", len(unique), limit)
+	}
+	reads := make([]*ua.ReadValueID, len(unique))
+	for i, nodeID := range unique {
+		reads[i] = &ua.ReadValueID{NodeID: nodeID, AttributeID: ua.AttributeIDValue}
+	}
+	resp, err := readOPCUA(ctx, client, &ua.ReadRequest{NodesToRead: reads, TimestampsToReturn: ua.TimestampsToReturnBoth})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if len(resp.Results) != len(reads) {
+		return nil, time.Time{}, fmt.Errorf("expected %d results, got %d", len(reads), len(resp.Results))
+	}
+	sampled := time.Now()
+	if resp.ResponseHeader != nil && !resp.ResponseHeader.Timestamp.IsZero() {
+		sampled = resp.ResponseHeader.Timestamp
+	}
+
+	dataValues := make([]*ua.DataValue, len(nodeIDs))
+	for i, position := range positions {
+		dataValues[i] = resp.Results[position]
+	}
+	return dataValues, sampled, nil
+}
+
+// readSynchronizedNodeInfos is readNodeInfos in a single read request, with
+// the time of the read as the timestamps of all values
+func readSynchronizedNodeInfos(ctx context.Context, client *opcua.Client, nodes []NodeInfo) ([]NodeResponse, error) {
+	ids := make([]*ua.NodeID, len(nodes))
+	for i, node := range nodes {
+		ids[i] = node.NodeID
+	}
+	dataValues, sampled, err := readSynchronizedDataValues(ctx, client, ids)
+	if err != nil {
+		return nil, err
+	}
+	results := nodeInfoResults(ctx, client, nodes, dataValues)
+	stampResults(results, sampled)
+	return results, nil
+}
+
+// stampResults sets the source and server timestamps of the values read to
+// the time of a synchronized read, so correlated values line up in a
+// database instead of carrying the PLC's per-node timestamps
+func stampResults(results []NodeResponse, sampled time.Time) {
+	for i := range results {
+		if results[i].Error != "" {
+			continue
+		}
+		sourceTimestamp, serverTimestamp := sampled, sampled
+		results[i].SourceTimestamp = &sourceTimestamp
+		results[i].ServerTimestamp = &serverTimestamp
+	}
+}
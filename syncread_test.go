@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSynchronizedRead tests that the values of a synchronized read share
+// one timestamp and that reads beyond MaxNodesPerRead fail instead of being
+// split
+func TestSynchronizedRead(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	connectMock(t, ctx)
+
+	nodeIDs := []string{"nsu=" + mockNamespaceURI + ";s=Temperature", "nsu=" + mockNamespaceURI + ";s=Counter", "nsu=" + mockNamespaceURI + ";s=Missing"}
+	results := readPollSample(ctx, nodeIDs, true)
+	require.Len(t, results, 3)
+	require.Empty(t, results[0].Error)
+	require.Empty(t, results[1].Error)
+	assert.NotEmpty(t, results[2].Error)
+	require.NotNil(t, results[0].SourceTimestamp)
+	assert.Equal(t, *results[0].SourceTimestamp, *results[1].SourceTimestamp)
+	assert.Equal(t, *results[0].SourceTimestamp, *results[1].ServerTimestamp)
+	assert.Nil(t, results[2].SourceTimestamp)
+
+	var many []string
+	for i := 0; i <= mockMaxNodesPerRequest; i++ {
+		many = append(many, fmt.Sprintf("nsu=%s;s=Missing%d", mockNamespaceURI, i))
+	}
+	results = readPollSample(ctx, many, true)
+	assert.Contains(t, results[0].Error, "MaxNodesPerRead")
+	results = readPollSample(ctx, many, false)
+	assert.NotContains(t, results[0].Error, "MaxNodesPerRead", "split into several requests")
+}
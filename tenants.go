@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// tenant is a customer of a shared gateway. Its token gives access to the
+// services of its connections, its labels are added as tags to the InfluxDB
+// output of the CLI
+type tenant struct {
+	Name        string            `yaml:"-"`
+	Token       string            `yaml:"token"`
+	Connections []string          `yaml:"connections"`
+	Access      string            `yaml:"access"` // read (default) or write
+	Labels      map[string]string `yaml:"labels"`
+
+	expires time.Time // Expiry of the token, for tenants of JWTs
+	source  string    // Where the tenant is from: file, command, introspect or jwt
+}
+
+// identity names a tenant with its source, e.g. file:alice or jwt:alice, so
+// a name an identity provider returns cannot pass for a tenant of the
+// tenants file. Approvals and write permits belong to identities
+func (t *tenant) identity() string {
+	return t.source + ":" + t.Name
+}
+
+// tenantRegistry holds the tenants of the service's connection, from the
+// tenants file and, for other tokens, an --auth hook
+type tenantRegistry struct {
+	tenants []*tenant
+	auth    authenticator
+	cache   *authCache // Answers of auth
+}
+
+// Tenants of this service, nil when the API is open to everyone
+var serviceTenants *tenantRegistry
+
+type tenantContextKey struct{}
+
+// loadTenants reads a tenants file and keeps the tenants of one connection:
+//
+//	tenants:
+//	  acme:
+//	    token: 9f2c...
+//	    connections: [line1, line2]
+//	    access: write
+//	    labels: {customer: acme}
+func loadTenants(path, connection string) (*tenantRegistry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenants file %s: %v", path, err)
+	}
+	var file struct {
+		Tenants map[string]*tenant `yaml:"tenants"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid tenants file %s: %v", path, err)
+	}
+
+	names := make([]string, 0, len(file.Tenants))
+	for name := range file.Tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	reg := &tenantRegistry{}
+	tokens := make(map[string]string)
+	for _, name := range names {
+		t := file.Tenants[name]
+		if t == nil || t.Token == "" {
+			return nil, fmt.Errorf("invalid tenants file %s: tenant %s has no token", path, name)
+		}
+		if other, dup := tokens[t.Token]; dup {
+			return nil, fmt.Errorf("invalid tenants file %s: tenants %s and %s share a token", path, other, name)
+		}
+		tokens[t.Token] = name
+		switch t.Access {
+		case "":
+			t.Access = "read"
+		case "read", "write":
+		default:
+			return nil, fmt.Errorf("invalid tenants file %s: access of tenant %s must be read or write", path, name)
+		}
+		t.Name = name
+		t.source = "file"
+
+		for _, c := range t.Connections {
+			if c == connection {
+				reg.tenants = append(reg.tenants, t)
+				break
+			}
+		}
+	}
+	if len(reg.tenants) == 0 {
+		return nil, fmt.Errorf("no tenant in %s has access to connection %s", path, connection)
+	}
+	return reg, nil
+}
+
+// lookup returns the tenant of a token, nil for unknown tokens. Tokens of
+// the auth hook are only known while their answer is cached
+func (reg *tenantRegistry) lookup(token string) *tenant {
+	for _, t := range reg.tenants {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+			return t
+		}
+	}
+	if reg.cache != nil {
+		t, _ := reg.cache.get(token)
+		return t
+	}
+	return nil
+}
+
+// authenticate returns the tenant of a token from the tenants file or the
+// auth hook, nil for unknown tokens. The error is a hook that failed
+func (reg *tenantRegistry) authenticate(ctx context.Context, token string) (*tenant, error) {
+	if t := reg.lookup(token); t != nil || reg.auth == nil || token == "" {
+		return t, nil
+	}
+	return reg.cache.authenticate(ctx, reg.auth, token)
+}
+
+// middleware rejects requests without the bearer token of one of the tenants
+// and requests of read-only tenants that change something. The tenant is
+// passed on in the request context. A nil registry lets every request through
+func (reg *tenantRegistry) middleware(next http.Handler) http.Handler {
+	if reg == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		var t *tenant
+		if ok {
+			var err error
+			if t, err = reg.authenticate(r.Context(), token); err != nil {
+				log.Printf("[%s] Auth: %v", connectionName, err)
+				http.Error(w, "Service Unavailable: the token could not be checked", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		if t == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized: a tenant token is required (--token)", http.StatusUnauthorized)
+			return
+		}
+		if t.Access != "write" && !isReadRequest(r) {
+			http.Error(w, fmt.Sprintf("Forbidden: tenant %s has read-only access", t.Name), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantContextKey{}, t)))
+	})
+}
+
+// fromFile returns the tenant of a name in the tenants file, nil when the
+// file does not have it
+func (reg *tenantRegistry) fromFile(name string) *tenant {
+	for _, t := range reg.tenants {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// isReadRequest reports whether a request only reads. Batch reads, node
+// validation and jobs (browses, subtree reads, history exports) use POST
+// without changing anything
+func isReadRequest(r *http.Request) bool {
+	if r.Method == http.MethodGet {
+		return true
+	}
+	return r.Method == http.MethodPost && (r.URL.Path == "/api/nodes" || r.URL.Path == "/api/validate" || r.URL.Path == "/api/jobs")
+}
+
+// requestTenant returns the tenant of a request, nil without tenants
+func requestTenant(r *http.Request) *tenant {
+	t, _ := r.Context().Value(tenantContextKey{}).(*tenant)
+	return t
+}
+
+// tenantName returns the name of a request's tenant, "" without tenants
+func tenantName(r *http.Request) string {
+	if t := requestTenant(r); t != nil {
+		return t.Name
+	}
+	return ""
+}
+
+// tenantIdentity returns the identity of a request's tenant, "" without
+// tenants
+func tenantIdentity(r *http.Request) string {
+	if t := requestTenant(r); t != nil {
+		return t.identity()
+	}
+	return ""
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTenantsFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "tenants.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+// TestLoadTenants tests that only the tenants of the connection are kept
+func TestLoadTenants(t *testing.T) {
+	path := writeTenantsFile(t, `
+tenants:
+  acme:
+    token: acme-token
+    connections: [line1, line2]
+    access: write
+    labels: {customer: acme}
+  globex:
+    token: globex-token
+    connections: [line2]
+`)
+
+	reg, err := loadTenants(path, "line2")
+	require.NoError(t, err)
+	require.Len(t, reg.tenants, 2)
+	assert.Equal(t, "acme", reg.lookup("acme-token").Name)
+	assert.Equal(t, "file:acme", reg.lookup("acme-token").identity(), "qualified by its source")
+	assert.Equal(t, "read", reg.lookup("globex-token").Access)
+	assert.Nil(t, reg.lookup("other"))
+
+	reg, err = loadTenants(path, "line1")
+	require.NoError(t, err)
+	assert.Nil(t, reg.lookup("globex-token"))
+
+	_, err = loadTenants(path, "line3")
+	assert.Error(t, err)
+
+	for _, bad := range []string{
+		"tenants:\n  a: {connections: [line1]}\n",
+		"tenants:\n  a: {token: x, connections: [line1]}\n  b: {token: x, connections: [line1]}\n",
+		"tenants:\n  a: {token: x, connections: [line1], access: admin}\n",
+	} {
+		_, err := loadTenants(writeTenantsFile(t, bad), "line1")
+		assert.Error(t, err, bad)
+	}
+}
+
+// TestTenantMiddleware tests token checks, read-only access and poll group
+// visibility per tenant
+func TestTenantMiddleware(t *testing.T) {
+	reg := &tenantRegistry{tenants: []*tenant{
+		{Name: "acme", Token: "acme-token", Access: "write"},
+		{Name: "globex", Token: "globex-token", Access: "read"},
+	}}
+	defer func(polls *pollManager) { servicePolls = polls }(servicePolls)
+	servicePolls = newPollManager(fakePollRead)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/polls", handlePollsRequest)
+	mux.HandleFunc("/api/polls/", handlePollsRequest)
+	handler := reg.middleware(mux)
+
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/api/polls", "", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/api/polls", "wrong", "").Code)
+
+	// Read-only tenants cannot create poll groups
+	body := `{"id":"energy","nodeIds":["ns=3;s=Power"],"interval":"1s"}`
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPost, "/api/polls", "globex-token", body).Code)
+
+	w := do(http.MethodPost, "/api/polls", "acme-token", body)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"tenant":"acme"`)
+	t.Cleanup(func() { servicePolls.remove("energy") })
+
+	assert.Contains(t, do(http.MethodGet, "/api/polls", "acme-token", "").Body.String(), `"energy"`)
+	assert.NotContains(t, do(http.MethodGet, "/api/polls", "globex-token", "").Body.String(), `"energy"`)
+	assert.Contains(t, do(http.MethodGet, "/api/polls/energy", "globex-token", "").Body.String(), "unknown poll group")
+}
+
+func TestTenantMiddlewareWithoutTenants(t *testing.T) {
+	var reg *tenantRegistry
+	called := false
+	handler := reg.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		assert.Nil(t, requestTenant(r))
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/node", nil))
+	assert.True(t, called)
+}
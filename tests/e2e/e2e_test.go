@@ -0,0 +1,118 @@
+//go:build integration
+
+// End-to-end tests of CLI, service and OPC UA server, run against each test
+// server image of pkg/opcuatest:
+//
+//	go test -tags integration ./tests/e2e/
+package e2e
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"umicli/pkg/opcuatest"
+	"umicli/pkg/plcclient"
+)
+
+// forEachServer runs a test against a service for each test server image
+func forEachServer(t *testing.T, test func(t *testing.T, svc *opcuatest.Service)) {
+	cli := opcuatest.BuildCLI(t, "umicli")
+	for _, image := range opcuatest.Images {
+		t.Run(image.Name, func(t *testing.T) {
+			server := opcuatest.StartServer(t, image)
+			test(t, opcuatest.StartService(t, cli, server.Endpoint))
+		})
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	forEachServer(t, func(t *testing.T, svc *opcuatest.Service) {
+		out, err := svc.Run("opcua", "get", opcuatest.Node("Temperature"))
+		require.NoError(t, err, out)
+		assert.Contains(t, out, "21.5")
+
+		out, err = svc.Run("opcua", "set", opcuatest.Node("Setpoint"), "42.5", "float")
+		require.NoError(t, err, out)
+		out, err = svc.Run("opcua", "get", opcuatest.Node("Setpoint"))
+		require.NoError(t, err, out)
+		assert.Contains(t, out, "42.5")
+
+		out, err = svc.Run("opcua", "set", opcuatest.Node("Name"), "press-2", "string")
+		require.NoError(t, err, out)
+		out, err = svc.Run("--format", "influx", "opcua", "get", opcuatest.Node("Name"), opcuatest.Node("Running"))
+		require.NoError(t, err, out)
+		assert.Contains(t, out, "press-2")
+		assert.Equal(t, 2, len(strings.Split(out, "\n")), out)
+	})
+}
+
+func TestBits(t *testing.T) {
+	forEachServer(t, func(t *testing.T, svc *opcuatest.Service) {
+		out, err := svc.Run("opcua", "set-bit", opcuatest.Node("Alarms"), "1", "1")
+		require.NoError(t, err, out)
+
+		results, err := plcclient.New("127.0.0.1", svc.Port).Read(context.Background(), opcuatest.Node("Alarms"))
+		require.NoError(t, err)
+		require.Empty(t, results[0].Error)
+		assert.EqualValues(t, 0x0083, results[0].Value)
+	})
+}
+
+func TestSubscribe(t *testing.T) {
+	forEachServer(t, func(t *testing.T, svc *opcuatest.Service) {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		updates, err := plcclient.New("127.0.0.1", svc.Port).Subscribe(ctx, []string{opcuatest.Node("Counter")}, 500*time.Millisecond)
+		require.NoError(t, err)
+
+		// The servers increment the counter every second
+		var values []float64
+		for update := range updates {
+			require.Empty(t, update.Error)
+			v, err := strconv.ParseFloat(strings.TrimSpace(toString(update.Value)), 64)
+			require.NoError(t, err)
+			if len(values) == 0 || v != values[len(values)-1] {
+				values = append(values, v)
+			}
+			if len(values) == 3 {
+				break
+			}
+		}
+		require.Len(t, values, 3)
+		assert.Less(t, values[0], values[2])
+	})
+}
+
+func TestPollGroup(t *testing.T) {
+	forEachServer(t, func(t *testing.T, svc *opcuatest.Service) {
+		ctx := context.Background()
+		client := plcclient.New("127.0.0.1", svc.Port)
+		poll, err := client.AddPoll(ctx, plcclient.PollConfig{
+			NodeIDs:  []string{opcuatest.Node("Temperature"), opcuatest.Node("Counter")},
+			Interval: "200ms",
+		})
+		require.NoError(t, err)
+
+		polls, err := client.Polls(ctx)
+		require.NoError(t, err)
+		require.Len(t, polls, 1)
+		assert.Equal(t, poll.ID, polls[0].ID)
+		require.NoError(t, client.RemovePoll(ctx, poll.ID))
+	})
+}
+
+func toString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return ""
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Flags of opcua assert and plccli test
+var (
+	assertWithin time.Duration // Wait up to this long for the comparison to hold, 0 to read once
+	junitFile    string        // JUnit XML report of plccli test
+)
+
+// runAssert runs opcua assert: reads a node and compares it like assert of
+// scripts, or like wait with --within. It prints the value when the
+// comparison holds and returns a *scriptFailure when it does not
+func runAssert(ctx context.Context, args []string, within time.Duration, session *shellSession) error {
+	if len(args) != 3 {
+		return fmt.Errorf("opcua assert needs <node-id> <operator> <expected>")
+	}
+	if err := checkScriptOperator(args[1]); err != nil {
+		return err
+	}
+	words := []string{"assert", args[0], args[1], args[2]}
+	if within > 0 {
+		words = []string{"wait", args[0], args[1], args[2], "within", within.String()}
+	}
+	s := &plcScript{session: session}
+	_, err := s.step(ctx, words)
+	var failure *scriptFailure
+	if errors.As(err, &failure) {
+		return &scriptFailure{fmt.Sprintf("%s %s %s %s", args[0], args[1], args[2], failure.msg)}
+	}
+	return err
+}
+
+// testSuite is a YAML file of plccli test: tests of script steps, run in
+// order and independent of each other
+//
+//	name: Line 1 acceptance
+//	variables:
+//	  TARGET: 72.5
+//	tests:
+//	  - name: Conveyor starts
+//	    steps:
+//	      - set ns=3;s=Cmd.Start true
+//	      - wait ns=3;s=State == Running within 10s
+//	      - assert ns=3;s=Speed >= $TARGET
+type testSuite struct {
+	Name      string            `yaml:"name"`
+	Variables map[string]string `yaml:"variables"`
+	Tests     []struct {
+		Name  string      `yaml:"name"`
+		Steps []yaml.Node `yaml:"steps"`
+	} `yaml:"tests"`
+
+	scripts []*plcScript // Of the tests, checked on load
+}
+
+// testResult is the outcome of a test of a suite
+type testResult struct {
+	name     string
+	duration time.Duration
+	output   string
+	err      error // nil when the test passed
+}
+
+// failed reports whether a test failed a comparison, as opposed to an error
+func (r testResult) failed() bool {
+	var failure *scriptFailure
+	return errors.As(r.err, &failure)
+}
+
+// loadTestSuite reads a test suite and checks the steps of all tests, with
+// the variables of the file overridden by those of vars
+func loadTestSuite(path string, vars map[string]string, session *shellSession) (*testSuite, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read test suite %s: %v", path, err)
+	}
+	var suite testSuite
+	if err := yaml.Unmarshal(data, &suite); err != nil {
+		return nil, fmt.Errorf("invalid test suite %s: %v", path, err)
+	}
+	if len(suite.Tests) == 0 {
+		return nil, fmt.Errorf("invalid test suite %s: no tests", path)
+	}
+	if suite.Name == "" {
+		suite.Name = path
+	}
+
+	all := map[string]string{}
+	for k, v := range suite.Variables {
+		all[k] = v
+	}
+	for k, v := range vars {
+		all[k] = v
+	}
+	for i, test := range suite.Tests {
+		if test.Name == "" {
+			return nil, fmt.Errorf("invalid test suite %s: test %d has no name", path, i+1)
+		}
+		if len(test.Steps) == 0 {
+			return nil, fmt.Errorf("invalid test suite %s: test %q has no steps", path, test.Name)
+		}
+		// Each step at its line of the file, so errors point to the file
+		// like those of scripts
+		lines := make([]string, test.Steps[len(test.Steps)-1].Line)
+		for _, step := range test.Steps {
+			if step.Kind != yaml.ScalarNode || strings.Contains(step.Value, "\n") || step.Line <= 0 || step.Line > len(lines) || lines[step.Line-1] != "" {
+				return nil, fmt.Errorf("invalid test suite %s:%d: steps of test %q must be lines of text, each on its own line", path, step.Line, test.Name)
+			}
+			lines[step.Line-1] = step.Value
+		}
+		script, err := parseScript(path, strings.NewReader(strings.Join(lines, "\n")), all, session)
+		if err != nil {
+			return nil, fmt.Errorf("invalid test suite %v", err)
+		}
+		suite.scripts = append(suite.scripts, script)
+	}
+	return &suite, nil
+}
+
+// run runs the tests in order and prints a line per test to out, with the
+// output of tests that did not pass
+func (suite *testSuite) run(ctx context.Context, out io.Writer) []testResult {
+	var results []testResult
+	for i, script := range suite.scripts {
+		var output bytes.Buffer
+		session := *script.session
+		session.out = &output
+		script.session = &session
+
+		start := time.Now()
+		err := script.run(ctx)
+		result := testResult{name: suite.Tests[i].Name, duration: time.Since(start), output: output.String(), err: err}
+		results = append(results, result)
+
+		status := "PASS"
+		if err != nil {
+			status = "ERROR"
+			if result.failed() {
+				status = "FAIL"
+			}
+		}
+		fmt.Fprintf(out, "--- %s: %s (%.2fs)\n", status, result.name, result.duration.Seconds())
+		if err != nil {
+			for _, line := range strings.Split(strings.TrimRight(result.output, "\n"), "\n") {
+				if line != "" {
+					fmt.Fprintf(out, "    %s\n", line)
+				}
+			}
+			fmt.Fprintf(out, "    %v\n", err)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return results
+}
+
+// JUnit XML report, as read by CI servers
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Errors    int             `xml:"errors,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitProblem `xml:"failure,omitempty"`
+	Error     *junitProblem `xml:"error,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJUnit writes the results of a suite started at start as JUnit XML
+func writeJUnit(w io.Writer, suiteName string, start time.Time, results []testResult) error {
+	suite := junitTestSuite{Name: suiteName, Tests: len(results), Timestamp: start.Format("2006-01-02T15:04:05")}
+	var total time.Duration
+	for _, r := range results {
+		total += r.duration
+		c := junitTestCase{Name: r.name, Classname: suiteName, Time: fmt.Sprintf("%.3f", r.duration.Seconds()), SystemOut: r.output}
+		if r.err != nil {
+			problem := &junitProblem{Message: r.err.Error(), Text: r.err.Error()}
+			if r.failed() {
+				c.Failure = problem
+				suite.Failures++
+			} else {
+				c.Error = problem
+				suite.Errors++
+			}
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+	suite.Time = fmt.Sprintf("%.3f", total.Seconds())
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(junitTestSuites{Suites: []junitTestSuite{suite}}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// runTestSuite runs plccli test: the tests of a suite file with the
+// variables of NAME=value arguments, a summary on out and a JUnit report in
+// junitPath unless it is empty. It fails when a test did not pass
+func runTestSuite(ctx context.Context, path string, assignments []string, junitPath string, session *shellSession, out io.Writer) error {
+	vars, err := scriptVariables(assignments)
+	if err != nil {
+		return err
+	}
+	suite, err := loadTestSuite(path, vars, session)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	results := suite.run(ctx, out)
+	passed := 0
+	for _, r := range results {
+		if r.err == nil {
+			passed++
+		}
+	}
+	fmt.Fprintf(out, "%s: %d of %d tests passed\n", suite.Name, passed, len(suite.Tests))
+
+	if junitPath != "" {
+		f, err := os.Create(junitPath)
+		if err != nil {
+			return fmt.Errorf("failed to write JUnit report: %v", err)
+		}
+		err = writeJUnit(f, suite.Name, start, results)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write JUnit report: %v", err)
+		}
+	}
+	if passed < len(suite.Tests) {
+		return fmt.Errorf("%d of %d tests did not pass", len(suite.Tests)-passed, len(suite.Tests))
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockShellSession starts the service of a simulated PLC and returns a
+// session of plccli shell against it, writing to out
+func mockShellSession(t *testing.T, ctx context.Context, out *bytes.Buffer) *shellSession {
+	t.Helper()
+	connectMock(t, ctx)
+	mux := http.NewServeMux()
+	registerHandlers(mux, "opc.tcp://mock", 8765)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.NoError(t, err)
+	session := newShellSession(u.Hostname(), port, "default", influxOptions{fieldName: "value", timestamp: "now"}, out)
+	session.interval = 20 * time.Millisecond
+	return session
+}
+
+// TestRunAssert tests opcua assert against a simulated PLC
+func TestRunAssert(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var out bytes.Buffer
+	session := mockShellSession(t, ctx, &out)
+	running := "nsu=" + mockNamespaceURI + ";s=Running"
+	counter := "nsu=" + mockNamespaceURI + ";s=Counter"
+
+	require.NoError(t, runAssert(ctx, []string{running, "==", "true"}, 0, session))
+	assert.Equal(t, "ok "+running+" == true (true)\n", out.String())
+
+	err := runAssert(ctx, []string{running, "==", "false"}, 0, session)
+	assert.IsType(t, &scriptFailure{}, err)
+	assert.EqualError(t, err, running+" == false failed, the value is true")
+
+	// The counter of the simulated PLC goes up every second
+	out.Reset()
+	require.NoError(t, runAssert(ctx, []string{counter, ">=", "1"}, 5*time.Second, session))
+	assert.Contains(t, out.String(), "ok "+counter+" >= 1 after ")
+	err = runAssert(ctx, []string{counter, "<", "0"}, 50*time.Millisecond, session)
+	assert.IsType(t, &scriptFailure{}, err)
+	assert.ErrorContains(t, err, counter+" < 0 timed out after 50ms, the value is ")
+
+	// Errors are not failures
+	err = runAssert(ctx, []string{"nsu=" + mockNamespaceURI + ";s=Missing", "==", "1"}, 0, session)
+	assert.Error(t, err)
+	assert.NotErrorAs(t, err, new(*scriptFailure))
+	assert.EqualError(t, runAssert(ctx, []string{running, "=", "true"}, 0, session), "unknown comparison =, use one of == != <= >= < >")
+}
+
+// TestTestSuite tests a suite of passing, failing and erroring tests and its
+// JUnit report
+func TestTestSuite(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	session := mockShellSession(t, ctx, &bytes.Buffer{})
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "line1.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`name: Line 1 acceptance
+variables:
+  NS: nsu=`+mockNamespaceURI+`
+  SETPOINT: "10"
+tests:
+  - name: Setpoint is written
+    steps:
+      - set ${NS};s=Setpoint $SETPOINT
+      - assert ${NS};s=Setpoint == $SETPOINT
+  - name: Machine is stopped
+    steps:
+      - assert ${NS};s=Running == false
+  - name: Missing node
+    steps:
+      - get ${NS};s=Missing
+`), 0644))
+
+	var out bytes.Buffer
+	report := filepath.Join(dir, "report.xml")
+	err := runTestSuite(ctx, path, []string{"SETPOINT=12,5"}, report, session, &out)
+	assert.EqualError(t, err, "2 of 3 tests did not pass")
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 6, out.String())
+	assert.True(t, strings.HasPrefix(lines[0], "--- PASS: Setpoint is written ("), lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], "--- FAIL: Machine is stopped ("), lines[1])
+	assert.Equal(t, "    "+path+":12: assert ${NS};s=Running == false: failed, the value is true", lines[2])
+	assert.True(t, strings.HasPrefix(lines[3], "--- ERROR: Missing node ("), lines[3])
+	assert.Equal(t, "Line 1 acceptance: 1 of 3 tests passed", lines[5])
+
+	data, err := os.ReadFile(report)
+	require.NoError(t, err)
+	var junit junitTestSuites
+	require.NoError(t, xml.Unmarshal(data, &junit))
+	require.Len(t, junit.Suites, 1)
+	suite := junit.Suites[0]
+	assert.Equal(t, "Line 1 acceptance", suite.Name)
+	assert.Equal(t, []int{3, 1, 1}, []int{suite.Tests, suite.Failures, suite.Errors})
+	require.Len(t, suite.Cases, 3)
+	assert.Nil(t, suite.Cases[0].Failure)
+	assert.Contains(t, suite.Cases[0].SystemOut, "to 12,5")
+	assert.Contains(t, suite.Cases[1].Failure.Message, "failed, the value is true")
+	assert.NotNil(t, suite.Cases[2].Error)
+
+	// Suites are checked before anything runs
+	require.NoError(t, os.WriteFile(path, []byte("tests:\n  - name: Typo\n    steps:\n      - sett ns=3;s=A 1\n"), 0644))
+	assert.EqualError(t, runTestSuite(ctx, path, nil, "", session, &out), "invalid test suite "+path+":4: unknown command sett")
+	require.NoError(t, os.WriteFile(path, []byte("tests:\n  - name: Flow\n    steps: [wait 1s, wait 2s]\n"), 0644))
+	assert.ErrorContains(t, runTestSuite(ctx, path, nil, "", session, &out), "each on its own line")
+}
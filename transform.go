@@ -0,0 +1,334 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// transformExpr is a parsed --transform expression computing the output
+// value of a node from its read value, e.g. "value * 0.1 - 40" to scale a
+// raw register. Expressions have numbers, value, + - * / %, parentheses and
+// the functions of transformFuncs
+type transformExpr struct {
+	text string
+	eval func(value float64) float64
+}
+
+// Functions of transform expressions with their number of arguments
+var transformFuncs = map[string]struct {
+	min, max int
+	call     func(args []float64) float64
+}{
+	"abs":   {1, 1, func(a []float64) float64 { return math.Abs(a[0]) }},
+	"floor": {1, 1, func(a []float64) float64 { return math.Floor(a[0]) }},
+	"ceil":  {1, 1, func(a []float64) float64 { return math.Ceil(a[0]) }},
+	"sqrt":  {1, 1, func(a []float64) float64 { return math.Sqrt(a[0]) }},
+	"min":   {2, 2, func(a []float64) float64 { return math.Min(a[0], a[1]) }},
+	"max":   {2, 2, func(a []float64) float64 { return math.Max(a[0], a[1]) }},
+	// round(x) to a whole number, round(x, n) to n decimals
+	"round": {1, 2, func(a []float64) float64 {
+		if len(a) == 1 {
+			return math.Round(a[0])
+		}
+		scale := math.Pow(10, math.Round(a[1]))
+		return math.Round(a[0]*scale) / scale
+	}},
+}
+
+// transformParser is a recursive descent parser of transform expressions
+type transformParser struct {
+	text string
+	pos  int
+}
+
+// parseTransform parses a transform expression
+func parseTransform(text string) (*transformExpr, error) {
+	p := &transformParser{text: text}
+	eval, err := p.parseSum()
+	if err == nil && p.peek() != 0 {
+		err = p.errorf("unexpected %q", p.peek())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid transform %q: %v", text, err)
+	}
+	return &transformExpr{text: strings.TrimSpace(text), eval: eval}, nil
+}
+
+// peek returns the next character after blanks, 0 at the end
+func (p *transformParser) peek() rune {
+	for p.pos < len(p.text) && p.text[p.pos] == ' ' {
+		p.pos++
+	}
+	if p.pos == len(p.text) {
+		return 0
+	}
+	return rune(p.text[p.pos])
+}
+
+func (p *transformParser) errorf(format string, args ...interface{}) error {
+	if p.peek() == 0 {
+		return fmt.Errorf("unexpected end")
+	}
+	return fmt.Errorf("at position %d: %s", p.pos+1, fmt.Sprintf(format, args...))
+}
+
+// parseSum parses terms joined by + and -
+func (p *transformParser) parseSum() (func(float64) float64, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		if op == '+' {
+			left = func(v float64) float64 { return l(v) + right(v) }
+		} else {
+			left = func(v float64) float64 { return l(v) - right(v) }
+		}
+	}
+}
+
+// parseProduct parses factors joined by *, / and %
+func (p *transformParser) parseProduct() (func(float64) float64, error) {
+	left, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' && op != '%' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		switch op {
+		case '*':
+			left = func(v float64) float64 { return l(v) * right(v) }
+		case '/':
+			left = func(v float64) float64 { return l(v) / right(v) }
+		default:
+			left = func(v float64) float64 { return math.Mod(l(v), right(v)) }
+		}
+	}
+}
+
+// parseFactor parses a number, value, a function call, a parenthesized
+// expression or a negation of one
+func (p *transformParser) parseFactor() (func(float64) float64, error) {
+	c := p.peek()
+	switch {
+	case c == '-':
+		p.pos++
+		operand, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		return func(v float64) float64 { return -operand(v) }, nil
+
+	case c == '(':
+		p.pos++
+		inner, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, p.errorf("expected )")
+		}
+		p.pos++
+		return inner, nil
+
+	case c == '.' || unicode.IsDigit(c):
+		start := p.pos
+		for p.pos < len(p.text) && (p.text[p.pos] == '.' || unicode.IsDigit(rune(p.text[p.pos])) ||
+			p.text[p.pos] == 'e' || p.text[p.pos] == 'E' ||
+			(p.pos > start && (p.text[p.pos] == '-' || p.text[p.pos] == '+') && (p.text[p.pos-1] == 'e' || p.text[p.pos-1] == 'E'))) {
+			p.pos++
+		}
+		n, err := strconv.ParseFloat(p.text[start:p.pos], 64)
+		if err != nil {
+			p.pos = start
+			return nil, p.errorf("invalid number %s", p.text[start:])
+		}
+		return func(float64) float64 { return n }, nil
+
+	case unicode.IsLetter(c):
+		start := p.pos
+		for p.pos < len(p.text) && (unicode.IsLetter(rune(p.text[p.pos])) || unicode.IsDigit(rune(p.text[p.pos]))) {
+			p.pos++
+		}
+		name := p.text[start:p.pos]
+		if name == "value" {
+			return func(v float64) float64 { return v }, nil
+		}
+		fn, ok := transformFuncs[name]
+		if !ok {
+			p.pos = start
+			return nil, p.errorf("unknown name %s, expected value or a function (abs, ceil, floor, max, min, round, sqrt)", name)
+		}
+		if p.peek() != '(' {
+			return nil, p.errorf("expected ( after %s", name)
+		}
+		p.pos++
+		var args []func(float64) float64
+		for {
+			arg, err := p.parseSum()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if p.peek() != ',' {
+				break
+			}
+			p.pos++
+		}
+		if p.peek() != ')' {
+			return nil, p.errorf("expected ) or ,")
+		}
+		p.pos++
+		if len(args) < fn.min || len(args) > fn.max {
+			return nil, fmt.Errorf("%s takes %d to %d arguments, got %d", name, fn.min, fn.max, len(args))
+		}
+		return func(v float64) float64 {
+			values := make([]float64, len(args))
+			for i, arg := range args {
+				values[i] = arg(v)
+			}
+			return fn.call(values)
+		}, nil
+	}
+	return nil, p.errorf("unexpected %q", c)
+}
+
+// apply computes the output value of a read value. Only numbers can be
+// transformed; results that are not numbers, e.g. of a division by zero,
+// are errors
+func (e *transformExpr) apply(value interface{}) (interface{}, error) {
+	var v float64
+	switch n := value.(type) {
+	case float64:
+		v = n
+	case float32:
+		v = float64(n)
+	case int:
+		v = float64(n)
+	case int8:
+		v = float64(n)
+	case int16:
+		v = float64(n)
+	case int32:
+		v = float64(n)
+	case int64:
+		v = float64(n)
+	case uint:
+		v = float64(n)
+	case uint8:
+		v = float64(n)
+	case uint16:
+		v = float64(n)
+	case uint32:
+		v = float64(n)
+	case uint64:
+		v = float64(n)
+	default:
+		return nil, fmt.Errorf("transform %s needs a number, got %T %v", e.text, value, value)
+	}
+	result := e.eval(v)
+	if math.IsNaN(result) || math.IsInf(result, 0) {
+		return nil, fmt.Errorf("transform %s of %v is not a number (%v)", e.text, v, result)
+	}
+	return result, nil
+}
+
+// valueTransforms are the expressions of --transform and --transform-file
+// applied to read values before they are formatted
+type valueTransforms struct {
+	all   *transformExpr            // --transform, for nodes without their own
+	nodes map[string]*transformExpr // --transform-file, by bitNameKey
+}
+
+// loadTransformFile reads a YAML (or JSON) file mapping node IDs to
+// transform expressions, e.g.
+//
+//	"ns=3;s=Oven.TempRaw": value / 10
+//	"ns=3;s=Tank.Level": round(value * 100 / 4095, 1)
+func loadTransformFile(path string) (map[string]*transformExpr, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read transform file: %v", err)
+	}
+	var raw map[string]string
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid transform file %s: %v", path, err)
+	}
+	nodes := make(map[string]*transformExpr, len(raw))
+	for nodeID, text := range raw {
+		key, err := bitNameKey(nodeID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid transform file %s: %v", path, err)
+		}
+		expr, err := parseTransform(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid transform file %s: %s: %v", path, nodeID, err)
+		}
+		nodes[key] = expr
+	}
+	return nodes, nil
+}
+
+// loadValueTransforms parses the expression of --transform and reads the
+// --transform-file, either may be empty
+func loadValueTransforms(all, file string) (valueTransforms, error) {
+	var t valueTransforms
+	if strings.TrimSpace(all) != "" {
+		expr, err := parseTransform(all)
+		if err != nil {
+			return t, fmt.Errorf("--transform: %v", err)
+		}
+		t.all = expr
+	}
+	if file != "" {
+		nodes, err := loadTransformFile(file)
+		if err != nil {
+			return t, fmt.Errorf("--transform-file: %v", err)
+		}
+		t.nodes = nodes
+	}
+	return t, nil
+}
+
+// enabled reports whether any value is transformed
+func (t valueTransforms) enabled() bool {
+	return t.all != nil || len(t.nodes) > 0
+}
+
+// apply transforms the value of a node with its own expression or the one
+// for all nodes. Values pass through unchanged without either
+func (t valueTransforms) apply(nodeID string, value interface{}) (interface{}, error) {
+	expr := t.all
+	if key, err := bitNameKey(nodeID); err == nil && t.nodes[key] != nil {
+		expr = t.nodes[key]
+	}
+	if expr == nil {
+		return value, nil
+	}
+	return expr.apply(value)
+}
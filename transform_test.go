@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustParseTransform(t *testing.T, text string) *transformExpr {
+	expr, err := parseTransform(text)
+	require.NoError(t, err)
+	return expr
+}
+
+// TestTransform tests evaluating transform expressions of read values
+func TestTransform(t *testing.T) {
+	for _, tc := range []struct {
+		expr   string
+		value  interface{}
+		result float64
+	}{
+		{"value * 0.1 - 40", float64(653), 25.3},
+		{"value/10", int16(-125), -12.5},
+		{"(value - 32) * 5 / 9", float32(212), 100},
+		{"-value + 1", uint32(3), -2},
+		{"value - -2", 1.0, 3},
+		{"value % 1000", uint64(12345), 345},
+		{"round(value * 100 / 4095, 1)", 2000.0, 48.8},
+		{"round(value)", 2.5, 3},
+		{"max(min(value, 100), 0)", 140.0, 100},
+		{"abs(value) + floor(1.9) + ceil(0.1) + sqrt(16)", -1.0, 7},
+		{"1.5e3 + value", 0.0, 1500},
+		{"2e-1 * value", 10.0, 2},
+		{" 42 ", 7.0, 42},
+	} {
+		result, err := mustParseTransform(t, tc.expr).apply(tc.value)
+		require.NoError(t, err, tc.expr)
+		assert.InDelta(t, tc.result, result, 1e-9, tc.expr)
+	}
+
+	for expr, msg := range map[string]string{
+		"":               "unexpected end",
+		"value *":        "unexpected end",
+		"value 10":       `at position 7: unexpected '1'`,
+		"val * 2":        "unknown name val",
+		"round":          "unexpected end",
+		"min(value)":     "min takes 2 to 2 arguments, got 1",
+		"(value + 1":     "unexpected end",
+		"value + 1)":     `at position 10: unexpected ')'`,
+		"1.2.3 * value":  "invalid number 1.2.3",
+		"value # 2":      `unexpected '#'`,
+		"round(1, 2, 3)": "round takes 1 to 2 arguments, got 3",
+	} {
+		_, err := parseTransform(expr)
+		assert.ErrorContains(t, err, msg, expr)
+	}
+
+	_, err := mustParseTransform(t, "value / 0").apply(1.0)
+	assert.EqualError(t, err, "transform value / 0 of 1 is not a number (+Inf)")
+	_, err = mustParseTransform(t, "value / 10").apply("RUNNING")
+	assert.EqualError(t, err, "transform value / 10 needs a number, got string RUNNING")
+	_, err = mustParseTransform(t, "value / 10").apply(true)
+	assert.Error(t, err)
+}
+
+// TestValueTransforms tests the expressions for all nodes and per node
+func TestValueTransforms(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transforms.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+"ns=3;s=Oven.TempRaw": value / 10
+"ns=3,s=Tank.Level": round(value * 100 / 4095, 1)
+`), 0644))
+	transforms, err := loadValueTransforms("value * 2", path)
+	require.NoError(t, err)
+	assert.True(t, transforms.enabled())
+
+	value, err := transforms.apply("ns=3;s=Oven.TempRaw", 2315.0)
+	require.NoError(t, err)
+	assert.Equal(t, 231.5, value)
+	value, err = transforms.apply("ns=3;s=Tank.Level", 4095.0)
+	require.NoError(t, err)
+	assert.Equal(t, 100.0, value, "keys match in both spellings")
+	value, err = transforms.apply("ns=3;s=Speed", 21.0)
+	require.NoError(t, err)
+	assert.Equal(t, 42.0, value, "the expression for all other nodes")
+
+	none, err := loadValueTransforms("", "")
+	require.NoError(t, err)
+	assert.False(t, none.enabled())
+	value, err = none.apply("ns=3;s=Mode", "Auto")
+	require.NoError(t, err)
+	assert.Equal(t, "Auto", value)
+
+	_, err = loadValueTransforms("value +", "")
+	assert.ErrorContains(t, err, "--transform: invalid transform")
+	require.NoError(t, os.WriteFile(path, []byte(`"ns=3;s=Oven.TempRaw": value //`), 0644))
+	_, err = loadValueTransforms("", path)
+	assert.ErrorContains(t, err, "--transform-file: invalid transform file")
+}
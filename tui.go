@@ -0,0 +1,471 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"umicli/pkg/plcclient"
+)
+
+// Defaults of opcua tui
+const (
+	defaultTUIDepth    = 5
+	defaultTUIInterval = time.Second
+	tuiBrowsePage      = 500 // Nodes per browse request while the tree loads
+)
+
+// Write data types of the browse data types, auto for the others
+var tuiWriteTypes = map[string]string{
+	"bool": "boolean", "int8": "sbyte", "byte": "byte", "int16": "int16", "uint16": "uint16",
+	"int32": "int32", "uint32": "uint32", "float32": "float", "float64": "double", "string": "string",
+}
+
+// tuiNode is a row of the address space tree of opcua tui. The service
+// browses variables only, so objects and folders are made up from the browse
+// paths of the variables below them and have no node
+type tuiNode struct {
+	name     string
+	node     *BrowseNode // nil for objects and folders
+	parent   *tuiNode
+	children []*tuiNode
+	byName   map[string]*tuiNode
+	expanded bool
+	depth    int
+}
+
+// child returns the child of the given name, added if there is none
+func (n *tuiNode) child(name string) *tuiNode {
+	if c, ok := n.byName[name]; ok {
+		return c
+	}
+	// The start node is expanded
+	c := &tuiNode{name: name, parent: n, depth: n.depth + 1, byName: map[string]*tuiNode{}, expanded: n.depth < 0}
+	n.children = append(n.children, c)
+	n.byName[name] = c
+	return c
+}
+
+// tuiPrompt is the write dialog of opcua tui
+type tuiPrompt struct {
+	node  BrowseNode
+	input []rune
+}
+
+// tuiCommand is what a key asks the terminal loop of opcua tui to do
+type tuiCommand struct {
+	quit   bool
+	reload bool
+	write  *plcclient.WriteRequest
+}
+
+// tuiModel is the state of opcua tui: the tree, the watch list, the live
+// values and the write dialog. It is changed by keys and by the results the
+// terminal loop gets from the service, and rendered to lines of text
+type tuiModel struct {
+	title   string
+	root    *tuiNode
+	rows    []*tuiNode // Visible rows of the tree
+	cursor  int
+	top     int // First row shown
+	nodes   int // Variables browsed
+	loading bool
+
+	watchFocus  bool
+	watch       []BrowseNode
+	watchCursor int
+	values      map[string]NodeResponse // By node ID
+
+	prompt *tuiPrompt
+	status string
+}
+
+func newTUIModel(title string) *tuiModel {
+	m := &tuiModel{title: title, values: map[string]NodeResponse{}}
+	m.reset()
+	return m
+}
+
+// reset empties the tree before it is browsed (again)
+func (m *tuiModel) reset() {
+	m.root = &tuiNode{expanded: true, depth: -1, byName: map[string]*tuiNode{}}
+	m.rows, m.cursor, m.top, m.nodes = nil, 0, 0, 0
+	m.loading = true
+}
+
+// addNodes adds a page of browsed variables to the tree
+func (m *tuiModel) addNodes(nodes []BrowseNode) {
+	selected := m.selected()
+	for i := range nodes {
+		n := m.root
+		for _, name := range strings.Split(nodes[i].Path, ".") {
+			n = n.child(name)
+		}
+		node := nodes[i]
+		n.node = &node
+		m.nodes++
+	}
+	m.layout(selected)
+}
+
+// layout lists the visible rows again and keeps the cursor on selected
+func (m *tuiModel) layout(selected *tuiNode) {
+	m.rows = m.rows[:0]
+	var walk func(n *tuiNode)
+	walk = func(n *tuiNode) {
+		for _, c := range n.children {
+			m.rows = append(m.rows, c)
+			if c.expanded {
+				walk(c)
+			}
+		}
+	}
+	walk(m.root)
+	for i, row := range m.rows {
+		if row == selected {
+			m.cursor = i
+			return
+		}
+	}
+	m.cursor = min(m.cursor, max(len(m.rows)-1, 0))
+}
+
+// selected returns the row under the cursor, nil while the tree is empty
+func (m *tuiModel) selected() *tuiNode {
+	if m.cursor < len(m.rows) {
+		return m.rows[m.cursor]
+	}
+	return nil
+}
+
+// current returns the variable the keys act on: the selected watch list
+// entry or tree row
+func (m *tuiModel) current() *BrowseNode {
+	if m.watchFocus {
+		if m.watchCursor < len(m.watch) {
+			return &m.watch[m.watchCursor]
+		}
+		return nil
+	}
+	if row := m.selected(); row != nil {
+		return row.node
+	}
+	return nil
+}
+
+// live returns the nodes whose values are shown: the selected variable and
+// the watch list
+func (m *tuiModel) live() []string {
+	var nodeIDs []string
+	if row := m.selected(); row != nil && row.node != nil {
+		nodeIDs = append(nodeIDs, row.node.NodeID)
+	}
+	for _, n := range m.watch {
+		if len(nodeIDs) == 0 || n.NodeID != nodeIDs[0] {
+			nodeIDs = append(nodeIDs, n.NodeID)
+		}
+	}
+	return nodeIDs
+}
+
+// watching returns the index of a node in the watch list, -1 if not there
+func (m *tuiModel) watching(nodeID string) int {
+	for i, n := range m.watch {
+		if n.NodeID == nodeID {
+			return i
+		}
+	}
+	return -1
+}
+
+// key handles a key, as decoded by readTUIKeys
+func (m *tuiModel) key(k string, pageSize int) tuiCommand {
+	if m.prompt != nil {
+		return m.promptKey(k)
+	}
+	if k == "ctrl-c" || k == "q" {
+		return tuiCommand{quit: true}
+	}
+	m.status = ""
+
+	// Movement in the focused pane
+	pos, count := &m.cursor, len(m.rows)
+	if m.watchFocus {
+		pos, count = &m.watchCursor, len(m.watch)
+	}
+	switch k {
+	case "up", "k":
+		*pos = max(*pos-1, 0)
+	case "down", "j":
+		*pos = max(min(*pos+1, count-1), 0)
+	case "pgup":
+		*pos = max(*pos-pageSize, 0)
+	case "pgdn":
+		*pos = max(min(*pos+pageSize, count-1), 0)
+	case "home", "g":
+		*pos = 0
+	case "end", "G":
+		*pos = max(count-1, 0)
+	case "tab":
+		m.watchFocus = !m.watchFocus && len(m.watch) > 0
+	case "r":
+		m.status = "Browsing again"
+		return tuiCommand{reload: true}
+	case "w", "delete":
+		m.toggleWatch()
+	case "e":
+		m.openPrompt()
+	case "right", "l", "left", "h", "enter":
+		if !m.watchFocus {
+			m.treeKey(k)
+		} else if k == "enter" {
+			m.openPrompt()
+		}
+	}
+	return tuiCommand{}
+}
+
+// treeKey expands and collapses tree rows
+func (m *tuiModel) treeKey(k string) {
+	row := m.selected()
+	if row == nil {
+		return
+	}
+	switch k {
+	case "right", "l":
+		if len(row.children) == 0 {
+			return
+		}
+		if row.expanded {
+			// Into the first child
+			m.cursor++
+			return
+		}
+		row.expanded = true
+	case "left", "h":
+		if !row.expanded || len(row.children) == 0 {
+			// Up to the parent
+			if row.parent != m.root {
+				m.layout(row.parent)
+			}
+			return
+		}
+		row.expanded = false
+	case "enter":
+		if len(row.children) == 0 {
+			m.openPrompt()
+			return
+		}
+		row.expanded = !row.expanded
+	}
+	m.layout(row)
+}
+
+// toggleWatch adds the current variable to the watch list, or removes it
+func (m *tuiModel) toggleWatch() {
+	node := m.current()
+	if node == nil {
+		m.status = "Only variables can be watched"
+		return
+	}
+	if i := m.watching(node.NodeID); i >= 0 {
+		m.watch = append(m.watch[:i], m.watch[i+1:]...)
+		m.watchCursor = max(min(m.watchCursor, len(m.watch)-1), 0)
+		m.watchFocus = m.watchFocus && len(m.watch) > 0
+		return
+	}
+	m.watch = append(m.watch, *node)
+}
+
+// openPrompt opens the write dialog for the current variable
+func (m *tuiModel) openPrompt() {
+	node := m.current()
+	switch {
+	case node == nil:
+		m.status = "Select a variable to write"
+	case !node.Writable:
+		m.status = node.Path + " is not writable"
+	default:
+		value := ""
+		if v, ok := m.values[node.NodeID]; ok && v.Error == "" && v.Value != nil {
+			value = fmt.Sprint(v.Value)
+		}
+		m.prompt = &tuiPrompt{node: *node, input: []rune(value)}
+	}
+}
+
+// promptKey edits the value of the write dialog, and writes it on enter
+func (m *tuiModel) promptKey(k string) tuiCommand {
+	p := m.prompt
+	switch k {
+	case "esc", "ctrl-c":
+		m.prompt = nil
+	case "backspace":
+		if len(p.input) > 0 {
+			p.input = p.input[:len(p.input)-1]
+		}
+	case "enter":
+		m.prompt = nil
+		dataType, ok := tuiWriteTypes[p.node.DataType]
+		if !ok {
+			dataType = "auto"
+		}
+		m.status = fmt.Sprintf("Writing %s to %s", string(p.input), p.node.Path)
+		return tuiCommand{write: &plcclient.WriteRequest{NodeID: p.node.NodeID, Value: string(p.input), DataType: dataType}}
+	default:
+		if utf8.RuneCountInString(k) == 1 {
+			p.input = append(p.input, []rune(k)...)
+		}
+	}
+	return tuiCommand{}
+}
+
+// render draws the screen as lines of width runes: a title bar, the tree on
+// the left, the selected variable and the watch list on the right, and a
+// status line
+func (m *tuiModel) render(width, height int) []string {
+	width, height = max(width, 40), max(height, 8)
+	lines := make([]string, 0, height)
+
+	title := " " + m.title
+	if m.loading {
+		title += fmt.Sprintf("  browsing, %d variables", m.nodes)
+	} else {
+		title += fmt.Sprintf("  %d variables", m.nodes)
+	}
+	lines = append(lines, tuiInverse(tuiPad(title, width)))
+
+	body := height - 2
+	treeWidth := width * 45 / 100
+	right := m.details(width - treeWidth - 1)
+	watchTop := len(right) + 1
+	right = append(right, tuiPad("", width-treeWidth-1), tuiPad(fmt.Sprintf("Watch list (%d)", len(m.watch)), width-treeWidth-1))
+	right = append(right, m.watchRows(width-treeWidth-1, max(body-watchTop-1, 0))...)
+
+	// Keep the cursor in view
+	if m.cursor < m.top {
+		m.top = m.cursor
+	}
+	if m.cursor >= m.top+body {
+		m.top = m.cursor - body + 1
+	}
+	for i := 0; i < body; i++ {
+		left := ""
+		if r := m.top + i; r < len(m.rows) {
+			left = tuiPad(m.treeRow(m.rows[r]), treeWidth)
+			if r == m.cursor && !m.watchFocus {
+				left = tuiInverse(left)
+			}
+		} else {
+			left = tuiPad("", treeWidth)
+		}
+		line := left + "│"
+		if i < len(right) {
+			line += right[i]
+		} else {
+			line += tuiPad("", width-treeWidth-1)
+		}
+		lines = append(lines, line)
+	}
+
+	switch {
+	case m.prompt != nil:
+		lines = append(lines, tuiPad(fmt.Sprintf("Write %s (%s): %s█  enter write, esc cancel", m.prompt.node.Path, m.prompt.node.DataType, string(m.prompt.input)), width))
+	case m.status != "":
+		lines = append(lines, tuiPad(m.status, width))
+	default:
+		lines = append(lines, tuiPad("↑↓ move  →← expand  w watch  e write  tab watch list  r reload  q quit", width))
+	}
+	return lines
+}
+
+// treeRow is the text of a tree row
+func (m *tuiModel) treeRow(n *tuiNode) string {
+	marker := "  "
+	if len(n.children) > 0 {
+		marker = "▸ "
+		if n.expanded {
+			marker = "▾ "
+		}
+	}
+	text := strings.Repeat("  ", n.depth) + marker + n.name
+	if n.node != nil && m.watching(n.node.NodeID) >= 0 {
+		text += " *"
+	}
+	return text
+}
+
+// details describes the selected row, with the live value of variables
+func (m *tuiModel) details(width int) []string {
+	row := m.selected()
+	if row == nil {
+		return []string{tuiPad("", width)}
+	}
+	if row.node == nil {
+		return []string{tuiPad(" "+row.name, width), tuiPad(fmt.Sprintf(" %d children", len(row.children)), width)}
+	}
+	n := row.node
+	lines := []string{
+		" " + n.Path,
+		" Node ID:   " + n.NodeID,
+		" Data type: " + n.DataType,
+		" Writable:  " + fmt.Sprint(n.Writable),
+	}
+	if n.Description != "" {
+		lines = append(lines, " "+n.Description)
+	}
+	lines = append(lines, " Value:     "+m.valueText(n.NodeID))
+	if v, ok := m.values[n.NodeID]; ok && v.SourceTimestamp != nil {
+		lines = append(lines, " Timestamp: "+v.SourceTimestamp.Local().Format("2006-01-02 15:04:05.000"))
+	}
+	for i := range lines {
+		lines[i] = tuiPad(lines[i], width)
+	}
+	return lines
+}
+
+// watchRows lists the watch list with the live values
+func (m *tuiModel) watchRows(width, height int) []string {
+	start := max(m.watchCursor-height+1, 0)
+	var rows []string
+	for i := start; i < len(m.watch) && len(rows) < height; i++ {
+		row := tuiPad(" "+m.watch[i].Path+" = "+m.valueText(m.watch[i].NodeID), width)
+		if i == m.watchCursor && m.watchFocus {
+			row = tuiInverse(row)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// valueText is the last value read of a node
+func (m *tuiModel) valueText(nodeID string) string {
+	v, ok := m.values[nodeID]
+	switch {
+	case !ok:
+		return "…"
+	case v.Error != "":
+		return "error: " + v.Error
+	case v.EnumName != "":
+		return fmt.Sprintf("%v (%s)", v.Value, v.EnumName)
+	}
+	return fmt.Sprint(v.Value)
+}
+
+// tuiPad cuts or pads text to width runes
+func tuiPad(text string, width int) string {
+	runes := []rune(strings.ReplaceAll(text, "\n", " "))
+	if len(runes) > width {
+		if width < 1 {
+			return ""
+		}
+		return string(runes[:width-1]) + "…"
+	}
+	return text + strings.Repeat(" ", width-len(runes))
+}
+
+// tuiInverse shows text in inverse video
+func tuiInverse(text string) string {
+	return "\x1b[7m" + text + "\x1b[0m"
+}
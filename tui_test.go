@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Variables of the tree of the TUI tests
+var tuiTestNodes = []BrowseNode{
+	{NodeID: "ns=3;s=Line1.Speed", Path: "Objects.Line1.Speed", DataType: "float32", Writable: true},
+	{NodeID: "ns=3;s=Line1.Count", Path: "Objects.Line1.Count", DataType: "uint32"},
+	{NodeID: "ns=3;s=Line1.Motor.Current", Path: "Objects.Line1.Motor.Current", DataType: "float64"},
+	{NodeID: "ns=0;i=2258", Path: "Objects.Server.ServerStatus.CurrentTime", DataType: "time.Time"},
+}
+
+// TestDecodeTUIKeys tests the keys read from a raw terminal
+func TestDecodeTUIKeys(t *testing.T) {
+	assert.Equal(t, []string{"up", "down", "right", "left", "pgdn", "home", "end", "delete"},
+		decodeTUIKeys([]byte("\x1b[A\x1b[B\x1bOC\x1b[D\x1b[6~\x1b[H\x1b[4~\x1b[3~")))
+	assert.Equal(t, []string{"7", "2", ",", "5", "ü", "enter", "backspace", "tab", "ctrl-c", "ctrl-d", "esc"},
+		decodeTUIKeys([]byte("72,5ü\r\x7f\t\x03\x04\x1b")))
+	assert.Equal(t, []string{"esc", "q"}, decodeTUIKeys([]byte("\x1bq")))
+	assert.Empty(t, decodeTUIKeys([]byte("\x1b[1;5A"+"\x01")), "unknown sequences and control characters")
+}
+
+// TestTUIModel tests the tree, watch list and write dialog of opcua tui
+func TestTUIModel(t *testing.T) {
+	m := newTUIModel("plccli  line1")
+	m.addNodes(tuiTestNodes[:2])
+	m.addNodes(tuiTestNodes[2:])
+	m.loading = false
+	assert.Equal(t, 4, m.nodes)
+
+	names := func() []string {
+		var rows []string
+		for _, row := range m.rows {
+			rows = append(rows, strings.TrimSpace(m.treeRow(row)))
+		}
+		return rows
+	}
+	assert.Equal(t, []string{"▾ Objects", "▸ Line1", "▸ Server"}, names())
+	m.key("down", 10)
+	m.key("right", 10)
+	assert.Equal(t, []string{"▾ Objects", "▾ Line1", "Speed", "Count", "▸ Motor", "▸ Server"}, names())
+	m.key("right", 10)
+	assert.Equal(t, "Speed", m.selected().name, "into the first child")
+	assert.Equal(t, []string{"ns=3;s=Line1.Speed"}, m.live())
+
+	// Watch and write
+	m.key("w", 10)
+	m.key("down", 10)
+	m.key("w", 10)
+	assert.Equal(t, []string{"ns=3;s=Line1.Count", "ns=3;s=Line1.Speed"}, m.live())
+	m.key("e", 10)
+	assert.Nil(t, m.prompt)
+	assert.Equal(t, "Objects.Line1.Count is not writable", m.status)
+	m.key("up", 10)
+	m.values["ns=3;s=Line1.Speed"] = NodeResponse{NodeID: "ns=3;s=Line1.Speed", Value: 72.5}
+	m.key("enter", 10)
+	require.NotNil(t, m.prompt)
+	assert.Equal(t, "72.5", string(m.prompt.input), "starts with the current value")
+	for _, k := range []string{"backspace", "backspace", "backspace", "5", "q"} {
+		assert.False(t, m.key(k, 10).quit)
+	}
+	cmd := m.key("enter", 10)
+	require.NotNil(t, cmd.write)
+	assert.Equal(t, "ns=3;s=Line1.Speed", cmd.write.NodeID)
+	assert.Equal(t, "75q", cmd.write.Value)
+	assert.Equal(t, "float", cmd.write.DataType)
+	assert.Nil(t, m.prompt)
+
+	// Collapse, up to the parent
+	m.key("left", 10)
+	assert.Equal(t, "Line1", m.selected().name)
+	m.key("left", 10)
+	assert.Equal(t, []string{"▾ Objects", "▸ Line1", "▸ Server"}, names())
+
+	screen := strings.Join(m.render(100, 12), "\n")
+	assert.Contains(t, screen, "plccli  line1  4 variables")
+	assert.Contains(t, screen, "Watch list (2)")
+	assert.Contains(t, screen, "Objects.Line1.Speed = 72.5")
+	assert.Contains(t, screen, "Objects.Line1.Count = …")
+	for _, line := range m.render(100, 12) {
+		assert.Equal(t, 100, len([]rune(strings.NewReplacer("\x1b[7m", "", "\x1b[0m", "").Replace(line))), line)
+	}
+
+	// The watch list has its own cursor
+	m.key("tab", 10)
+	m.key("delete", 10)
+	assert.Equal(t, []string{"ns=3;s=Line1.Count"}, m.live(), "Speed was first")
+	assert.True(t, m.key("q", 10).quit)
+}
+
+// tuiScreen is the output of the TUI tests
+type tuiScreen struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (s *tuiScreen) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buf.Reset()
+	return s.buf.Write(p)
+}
+
+func (s *tuiScreen) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.String()
+}
+
+// TestTUISession tests opcua tui against a service: the tree browsed in
+// pages, live values and writes
+func TestTUISession(t *testing.T) {
+	var mu sync.Mutex
+	var writes []map[string]string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/browse", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "i=84", r.URL.Query().Get("nodeid"))
+		if r.URL.Query().Get("continuation") == "" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"nodes": tuiTestNodes[:2], "continuation": "next"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"nodes": []BrowseNode{{NodeID: "i=2258", Path: tuiTestNodes[3].Path}}})
+	})
+	mux.HandleFunc("/api/node", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			var req map[string]string
+			json.NewDecoder(r.Body).Decode(&req)
+			mu.Lock()
+			writes = append(writes, req)
+			mu.Unlock()
+			json.NewEncoder(w).Encode(NodeResponse{NodeID: "ns=3;s=Line1.Speed", Value: req["value"]})
+			return
+		}
+		json.NewEncoder(w).Encode(NodeResponse{NodeID: r.URL.Query().Get("nodeID"), Value: 72.5})
+	})
+	mux.HandleFunc("/api/nodes", func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Nodes []map[string]string }
+		json.NewDecoder(r.Body).Decode(&req)
+		var results []NodeResponse
+		for _, n := range req.Nodes {
+			results = append(results, NodeResponse{NodeID: n["nodeID"], Value: 7})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.NoError(t, err)
+
+	session := &tuiSession{client: newServiceClient(u.Hostname(), port), nodeID: "i=84", maxDepth: 5, interval: 10 * time.Millisecond}
+	keys := make(chan string)
+	screen := &tuiScreen{}
+	done := make(chan error)
+	go func() {
+		done <- session.run(context.Background(), newTUIModel("plccli  line1"), keys, screen, func() (int, int) { return 100, 16 })
+	}()
+
+	require.Eventually(t, func() bool {
+		return strings.Contains(screen.String(), "3 variables") && !strings.Contains(screen.String(), "browsing")
+	}, 5*time.Second, 5*time.Millisecond)
+	for _, k := range []string{"down", "right", "right"} {
+		keys <- k
+	}
+	require.Eventually(t, func() bool {
+		return strings.Contains(screen.String(), "Value:     72.5")
+	}, 5*time.Second, 5*time.Millisecond)
+
+	for _, k := range []string{"e", "backspace", "backspace", "backspace", "backspace", "8", "0", "enter"} {
+		keys <- k
+	}
+	require.Eventually(t, func() bool {
+		return strings.Contains(screen.String(), "Wrote 80 to ns=3;s=Line1.Speed")
+	}, 5*time.Second, 5*time.Millisecond)
+	mu.Lock()
+	require.Len(t, writes, 1)
+	assert.Equal(t, "80", writes[0]["value"])
+	assert.Equal(t, "float", writes[0]["dataType"])
+	mu.Unlock()
+
+	// Namespace 0 nodes are read with ns=0
+	for _, k := range []string{"w", "left", "left", "end", "right", "right", "right", "right", "w"} {
+		keys <- k
+	}
+	require.Eventually(t, func() bool {
+		return strings.Contains(screen.String(), "Objects.Server.ServerStatus.CurrentTime = 7")
+	}, 5*time.Second, 5*time.Millisecond)
+
+	keys <- "q"
+	require.NoError(t, <-done)
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"umicli/pkg/plcclient"
+)
+
+// Escape sequences of the keys opcua tui knows, after ESC [ or ESC O
+var tuiEscapeKeys = map[string]string{
+	"A": "up", "B": "down", "C": "right", "D": "left", "H": "home", "F": "end",
+	"1~": "home", "7~": "home", "4~": "end", "8~": "end",
+	"3~": "delete", "5~": "pgup", "6~": "pgdn",
+}
+
+// runTUI runs opcua tui: the address space below nodeID, browsed maxDepth
+// levels deep through the service, with the values of the selected variable
+// and the watch list read every interval, until q or ctrl-c
+func runTUI(nodeID string, maxDepth int, interval time.Duration, host string, port int) error {
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("opcua tui needs a terminal")
+	}
+	client := newServiceClient(host, port)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	info, err := client.Info(ctx)
+	cancel()
+	if err != nil {
+		return err
+	}
+	title := fmt.Sprintf("plccli  %v  %v  %s", info["connection"], info["endpoint"], nodeID)
+
+	restore, err := rawTerminal()
+	if err != nil {
+		return err
+	}
+	defer restore()
+	// Alternate screen without cursor, restored on exit
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+
+	keys := make(chan string)
+	go readTUIKeys(os.Stdin, keys)
+	session := &tuiSession{client: client, nodeID: nodeID, maxDepth: maxDepth, interval: interval}
+	return session.run(context.Background(), newTUIModel(title), keys, os.Stdout, terminalSize)
+}
+
+// tuiSession connects the model of opcua tui to the service: it browses the
+// tree in pages, subscribes to the values shown and writes. Results come
+// back to the terminal loop as changes of the model, so only the loop
+// touches it
+type tuiSession struct {
+	client   *plcclient.HTTPClient
+	nodeID   string
+	maxDepth int
+	interval time.Duration
+
+	updates chan func(m *tuiModel)
+	browses int // Browses started, older results are dropped
+}
+
+// run draws the model and handles keys and results until the keys end, q
+// or ctrl-c
+func (s *tuiSession) run(ctx context.Context, m *tuiModel, keys <-chan string, out io.Writer, size func() (int, int)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s.updates = make(chan func(m *tuiModel))
+	stopBrowse := s.browse(ctx)
+	var live []string
+	stopLive := func() {}
+	redraw := time.NewTicker(s.interval)
+	defer redraw.Stop()
+
+	for {
+		// Subscribe to the values shown whenever they change
+		if nodeIDs := m.live(); !slices.Equal(nodeIDs, live) {
+			stopLive()
+			live = nodeIDs
+			var err error
+			if stopLive, err = s.subscribe(ctx, nodeIDs); err != nil {
+				m.status = "Cannot read values: " + err.Error()
+			}
+		}
+		width, height := size()
+		drawTUI(out, m.render(width, height))
+
+		select {
+		case k, ok := <-keys:
+			if !ok {
+				return nil
+			}
+			cmd := m.key(k, height-3)
+			switch {
+			case cmd.quit:
+				return nil
+			case cmd.reload:
+				stopBrowse()
+				m.reset()
+				stopBrowse = s.browse(ctx)
+			case cmd.write != nil:
+				go s.write(ctx, *cmd.write)
+			}
+		case update := <-s.updates:
+			update(m)
+		case <-redraw.C:
+			// The terminal may have been resized
+		}
+	}
+}
+
+// browse loads the tree in pages in the background, and returns a function
+// stopping it
+func (s *tuiSession) browse(ctx context.Context) func() {
+	s.browses++
+	browse := s.browses
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		continuation := ""
+		for {
+			page, err := s.client.BrowsePaged(ctx, s.nodeID, s.maxDepth, tuiBrowsePage, continuation)
+			if ctx.Err() != nil {
+				return
+			}
+			for i := range page.Nodes {
+				page.Nodes[i].NodeID = tuiNodeID(page.Nodes[i].NodeID)
+			}
+			s.send(ctx, func(m *tuiModel) {
+				if s.browses != browse {
+					return
+				}
+				if err != nil {
+					m.loading = false
+					m.status = "Browse failed: " + err.Error()
+					return
+				}
+				m.addNodes(page.Nodes)
+				m.loading = page.Continuation != ""
+			})
+			if err != nil || page.Continuation == "" {
+				return
+			}
+			continuation = page.Continuation
+		}
+	}()
+	return cancel
+}
+
+// subscribe reads the values of nodes every interval into the model, and
+// returns a function stopping it
+func (s *tuiSession) subscribe(ctx context.Context, nodeIDs []string) (func(), error) {
+	if len(nodeIDs) == 0 {
+		return func() {}, nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	values, err := s.client.Subscribe(ctx, nodeIDs, s.interval)
+	if err != nil {
+		cancel()
+		return func() {}, err
+	}
+	go func() {
+		for v := range values {
+			s.send(ctx, func(m *tuiModel) {
+				nodeID := v.RequestedNodeID
+				if nodeID == "" {
+					nodeID = v.NodeID
+				}
+				m.values[nodeID] = v
+			})
+		}
+	}()
+	return cancel, nil
+}
+
+// write writes a value of the write dialog and reports the result
+func (s *tuiSession) write(ctx context.Context, req plcclient.WriteRequest) {
+	resp, err := s.client.Write(ctx, req)
+	s.send(ctx, func(m *tuiModel) {
+		if err != nil {
+			m.status = "Write failed: " + err.Error()
+			return
+		}
+		m.status = fmt.Sprintf("Wrote %v to %s", resp.Value, req.NodeID)
+	})
+}
+
+// send hands a change of the model to the terminal loop
+func (s *tuiSession) send(ctx context.Context, update func(m *tuiModel)) {
+	select {
+	case s.updates <- update:
+	case <-ctx.Done():
+	}
+}
+
+// tuiNodeID writes the node IDs of namespace 0 that browsing returns
+// (i=2258) like the client library expects them (ns=0;i=2258)
+func tuiNodeID(nodeID string) string {
+	if strings.HasPrefix(nodeID, "ns=") || strings.HasPrefix(nodeID, "nsu=") {
+		return nodeID
+	}
+	return "ns=0;" + nodeID
+}
+
+// drawTUI draws the lines of the screen over the previous ones
+func drawTUI(out io.Writer, lines []string) {
+	var buf bytes.Buffer
+	buf.WriteString("\x1b[H")
+	for i, line := range lines {
+		if i > 0 {
+			buf.WriteString("\r\n")
+		}
+		buf.WriteString(line)
+		buf.WriteString("\x1b[K")
+	}
+	buf.WriteString("\x1b[J")
+	out.Write(buf.Bytes())
+}
+
+// readTUIKeys decodes the keys typed on a raw terminal until it is closed
+func readTUIKeys(r io.Reader, keys chan<- string) {
+	defer close(keys)
+	buf := make([]byte, 256)
+	for {
+		n, err := r.Read(buf)
+		for _, k := range decodeTUIKeys(buf[:n]) {
+			keys <- k
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// decodeTUIKeys splits what a raw terminal sent into keys: characters,
+// enter, tab, backspace, esc, ctrl-c, ctrl-d and the names of tuiEscapeKeys
+func decodeTUIKeys(data []byte) []string {
+	var keys []string
+	for len(data) > 0 {
+		switch c := data[0]; {
+		case c == 0x1b:
+			if len(data) >= 3 && (data[1] == '[' || data[1] == 'O') {
+				// The sequence ends with a letter or ~
+				end := 2
+				for end < len(data) && end < 8 && !(data[end] >= 'A' && data[end] <= 'Z' || data[end] == '~') {
+					end++
+				}
+				if end < len(data) {
+					if k, ok := tuiEscapeKeys[string(data[2:end+1])]; ok {
+						keys = append(keys, k)
+					}
+					data = data[end+1:]
+					continue
+				}
+			}
+			keys = append(keys, "esc")
+			data = data[1:]
+		case c == '\r' || c == '\n':
+			keys = append(keys, "enter")
+			data = data[1:]
+		case c == '\t':
+			keys = append(keys, "tab")
+			data = data[1:]
+		case c == 0x7f || c == 0x08:
+			keys = append(keys, "backspace")
+			data = data[1:]
+		case c == 0x03:
+			keys = append(keys, "ctrl-c")
+			data = data[1:]
+		case c == 0x04:
+			keys = append(keys, "ctrl-d")
+			data = data[1:]
+		case c < 0x20:
+			data = data[1:]
+		default:
+			r, size := utf8.DecodeRune(data)
+			if r != utf8.RuneError {
+				keys = append(keys, string(r))
+			}
+			data = data[size:]
+		}
+	}
+	return keys
+}
+
+// rawTerminal switches the terminal of stdin to raw mode with stty, so keys
+// arrive as typed and are not echoed, and returns a function restoring it
+func rawTerminal() (func(), error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the terminal settings: %v", err)
+	}
+	if _, err := stty("raw", "-echo"); err != nil {
+		return nil, fmt.Errorf("failed to set up the terminal: %v", err)
+	}
+	return func() { stty(strings.TrimSpace(saved)) }, nil
+}
+
+// terminalSize returns the columns and rows of the terminal of stdin, 80x24
+// if unknown
+func terminalSize() (int, int) {
+	out, err := stty("size")
+	if err == nil {
+		if fields := strings.Fields(out); len(fields) == 2 {
+			rows, errRows := strconv.Atoi(fields[0])
+			cols, errCols := strconv.Atoi(fields[1])
+			if errRows == nil && errCols == nil && rows > 0 && cols > 0 {
+				return cols, rows
+			}
+		}
+	}
+	return 80, 24
+}
+
+// stty runs stty on the terminal of stdin
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return string(out), err
+}
@@ -1,8 +1,33 @@
 package main
 
+import "umicli/pkg/plcclient"
+
 // Response format for API
-type NodeResponse struct {
-	NodeID string      `json:"nodeID"`
-	Value  interface{} `json:"value"`
-	Error  string      `json:"error,omitempty"`
-}
\ No newline at end of file
+type NodeResponse = plcclient.NodeResponse
+
+// Poll group configuration, shared with the client library
+type PollConfig = plcclient.PollConfig
+
+// Named node group, shared with the client library
+type NodeGroup = plcclient.NodeGroup
+
+// Recent sample of a node, shared with the client library
+type Sample = plcclient.Sample
+
+// Write permit, shared with the client library
+type WritePermit = plcclient.WritePermit
+
+// Write of a critical node waiting for a confirmation, shared with the client library
+type PendingWrite = plcclient.PendingWrite
+
+// Maintenance window of a connection, shared with the client library
+type Maintenance = plcclient.Maintenance
+
+// Annotation of a person on the timeline, shared with the client library
+type Annotation = plcclient.Annotation
+
+// Node found by browsing, shared with the client library
+type BrowseNode = plcclient.BrowseNode
+
+// Recurring write of the service, shared with the client library
+type WriteSchedule = plcclient.WriteSchedule
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clients counted one by one in /api/usage, the rest count as otherClients
+const maxUsageClients = 1000
+
+// Client of the requests beyond maxUsageClients
+const otherClients = "other"
+
+// clientUsage is what one client used of the API since the service started
+type clientUsage struct {
+	Client      string    `json:"client"` // "tenant <name>", or the remote host without tenants
+	Requests    int64     `json:"requests"`
+	Reads       int64     `json:"reads"`
+	Writes      int64     `json:"writes"`
+	Errors      int64     `json:"errors"`    // 4xx and 5xx responses
+	ErrorRate   float64   `json:"errorRate"` // Errors per request
+	BytesIn     int64     `json:"bytesIn"`   // Request bodies
+	BytesOut    int64     `json:"bytesOut"`  // Response bodies
+	LastRequest time.Time `json:"lastRequest"`
+}
+
+// usageAccounting counts the requests, reads, writes, errors and bytes of
+// each API client, so integrators can see which application keeps the PLC
+// busy. Clients are the tenants of the tokens, or remote hosts without
+// tenants; tokens themselves are never reported
+type usageAccounting struct {
+	mu      sync.Mutex
+	since   time.Time
+	clients map[string]*clientUsage
+}
+
+// API usage of this service
+var serviceUsage = newUsageAccounting()
+
+func newUsageAccounting() *usageAccounting {
+	return &usageAccounting{since: time.Now().UTC(), clients: make(map[string]*clientUsage)}
+}
+
+// record counts a finished request of a client
+func (u *usageAccounting) record(client string, read bool, status int, bytesIn, bytesOut int64, at time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	c := u.clients[client]
+	if c == nil {
+		if len(u.clients) >= maxUsageClients {
+			client = otherClients
+			c = u.clients[client]
+		}
+		if c == nil {
+			c = &clientUsage{Client: client}
+			u.clients[client] = c
+		}
+	}
+	c.Requests++
+	if read {
+		c.Reads++
+	} else {
+		c.Writes++
+	}
+	if status >= 400 {
+		c.Errors++
+	}
+	c.BytesIn += bytesIn
+	c.BytesOut += bytesOut
+	c.LastRequest = at.UTC()
+}
+
+// snapshot returns the usage of all clients, busiest first
+func (u *usageAccounting) snapshot() []clientUsage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	clients := make([]clientUsage, 0, len(u.clients))
+	for _, c := range u.clients {
+		usage := *c
+		usage.ErrorRate = float64(c.Errors) / float64(c.Requests)
+		clients = append(clients, usage)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		if clients[i].Requests != clients[j].Requests {
+			return clients[i].Requests > clients[j].Requests
+		}
+		return clients[i].Client < clients[j].Client
+	})
+	return clients
+}
+
+// middleware counts the requests of a handler. It sits behind the tenant
+// check, so requests are counted by tenant, and in front of the checks that
+// refuse requests, so their refusals count as errors
+func (u *usageAccounting) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		var bytesIn int64
+		if r.ContentLength > 0 {
+			bytesIn = r.ContentLength
+		}
+		u.record(requestClient(r), isReadRequest(r), rec.status, bytesIn, int64(rec.bytes), time.Now())
+	})
+}
+
+// requestClient returns the client of a request: the tenant, otherwise the
+// remote host
+func requestClient(r *http.Request) string {
+	if name := tenantName(r); name != "" {
+		return "tenant " + name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// statusRecorder captures the status and size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	bytes   int
+	written bool
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if !rec.written {
+		rec.status = status
+		rec.written = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	rec.written = true
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// Flush passes flushes of streamed responses on
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// handleUsageRequest reports the API usage of each client (GET /api/usage)
+func handleUsageRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sendJSONResponseGeneric(w, map[string]interface{}{
+		"since":   serviceUsage.since,
+		"clients": serviceUsage.snapshot(),
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestUsageAccounting tests that requests are counted by tenant with their
+// reads, writes, errors and bytes, and reported at /api/usage
+func TestUsageAccounting(t *testing.T) {
+	usage := newUsageAccounting()
+	tenants := &tenantRegistry{tenants: []*tenant{
+		{Name: "scada", Token: "token-scada", Access: "write"},
+		{Name: "dashboard", Token: "t2", Access: "read"},
+	}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/node", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fail") != "" {
+			http.Error(w, "Bad node", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"value":1}`))
+	})
+	handler := tenants.middleware(usage.middleware(mux))
+
+	request := func(method, token, target, body string) int {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec.Code
+	}
+	for i := 0; i < 3; i++ {
+		request("GET", "t2", "/api/node", "")
+	}
+	request("GET", "t2", "/api/node?fail=1", "")
+	request("POST", "token-scada", "/api/node", `{"value":2}`)
+	assert.Equal(t, http.StatusUnauthorized, request("GET", "nope", "/api/node", ""), "not counted")
+
+	clients := usage.snapshot()
+	require.Len(t, clients, 2)
+	assert.Equal(t, "tenant dashboard", clients[0].Client, "busiest first")
+	assert.Equal(t, int64(4), clients[0].Requests)
+	assert.Equal(t, int64(4), clients[0].Reads)
+	assert.Equal(t, int64(1), clients[0].Errors)
+	assert.Equal(t, 0.25, clients[0].ErrorRate)
+	assert.Equal(t, int64(3*len(`{"value":1}`)+len("Bad node\n")), clients[0].BytesOut)
+	assert.Equal(t, "tenant scada", clients[1].Client)
+	assert.Equal(t, int64(1), clients[1].Writes)
+	assert.Equal(t, int64(len(`{"value":2}`)), clients[1].BytesIn)
+	assert.WithinDuration(t, time.Now(), clients[1].LastRequest, time.Minute)
+
+	// Without tenants, clients are remote hosts; beyond the limit they add up
+	for i := 0; i < maxUsageClients+5; i++ {
+		usage.record(fmt.Sprintf("10.0.%d.%d", i/256, i%256), true, http.StatusOK, 0, 10, time.Now())
+	}
+	clients = usage.snapshot()
+	assert.Len(t, clients, maxUsageClients+1)
+	assert.Equal(t, otherClients, clients[0].Client)
+	assert.Equal(t, int64(7), clients[0].Requests)
+
+	serviceUsage = usage
+	t.Cleanup(func() { serviceUsage = newUsageAccounting() })
+	rec := httptest.NewRecorder()
+	handleUsageRequest(rec, httptest.NewRequest("GET", "/api/usage", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var body struct {
+		Since   time.Time     `json:"since"`
+		Clients []clientUsage `json:"clients"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Equal(t, usage.since, body.Since)
+	assert.Len(t, body.Clients, maxUsageClients+1)
+	assert.NotContains(t, rec.Body.String(), "token-scada", "tokens are not reported")
+}
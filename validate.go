@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+
+	"umicli/pkg/plcclient"
+)
+
+// Attributes read per node by a validation, in this order
+var validateAttributes = []ua.AttributeID{
+	ua.AttributeIDNodeClass,
+	ua.AttributeIDDataType,
+	ua.AttributeIDAccessLevel,
+	ua.AttributeIDUserAccessLevel,
+}
+
+// handleValidateRequest checks that nodes exist and reads their data type and
+// access (POST /api/validate). The attributes of all nodes are read in as few
+// requests as the server allows
+func handleValidateRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Nodes   []string `json:"nodes"`
+		Timeout string   `json:"timeout,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"error": fmt.Sprintf("Failed to parse request: %v", err),
+		})
+		return
+	}
+	if len(req.Nodes) == 0 {
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"error": "No nodes specified in request",
+		})
+		return
+	}
+	timeout, err := requestTimeout(r, req.Timeout, defaultReadTimeout)
+	if err != nil {
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	clientMutex.Lock()
+	client := opcuaClient
+	clientMutex.Unlock()
+	if client == nil {
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"error": "OPCUA client not connected",
+		})
+		return
+	}
+
+	results := make([]plcclient.NodeCheck, len(req.Nodes))
+	var reads []*ua.ReadValueID
+	var positions []int
+	for i, nodeID := range req.Nodes {
+		results[i].NodeID = nodeID
+		id, err := resolveNodeID(nodeID)
+		if err != nil {
+			results[i].Error = fmt.Sprintf("Invalid node ID: %v", err)
+			continue
+		}
+		for _, attribute := range validateAttributes {
+			reads = append(reads, &ua.ReadValueID{NodeID: id, AttributeID: attribute})
+		}
+		positions = append(positions, i)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	dataValues, err := readValueIDs(ctx, client, reads)
+	if err != nil {
+		sendJSONResponseGeneric(w, map[string]interface{}{
+			"error": fmt.Sprintf("Failed to read node attributes: %v", err),
+		})
+		return
+	}
+	for j, i := range positions {
+		n := len(validateAttributes)
+		setNodeCheck(&results[i], dataValues[j*n:(j+1)*n])
+	}
+
+	sendJSONResponseGeneric(w, map[string]interface{}{
+		"results": results,
+	})
+}
+
+// setNodeCheck fills a check from the attributes of validateAttributes. A
+// node without a readable NodeClass does not exist
+func setNodeCheck(check *plcclient.NodeCheck, values []*ua.DataValue) {
+	nodeClass, dataType, accessLevel, userAccessLevel := values[0], values[1], values[2], values[3]
+	if nodeClass.Status != ua.StatusOK {
+		check.Error = fmt.Sprintf("%v", nodeClass.Status)
+		return
+	}
+	check.Exists = true
+	class, _ := attributeInt(nodeClass)
+	check.NodeClass = strings.TrimPrefix(ua.NodeClass(class).String(), "NodeClass")
+
+	if dataType.Status == ua.StatusOK && dataType.Value != nil {
+		if dataTypeID := dataType.Value.NodeID(); dataTypeID != nil {
+			if name, ok := dataTypeNameForID(dataTypeID); ok {
+				check.DataType = name
+			} else {
+				check.DataType = dataTypeID.String()
+			}
+		}
+	}
+
+	// The user's access is limited to what the node allows at all
+	level, ok := attributeInt(accessLevel)
+	if !ok {
+		return
+	}
+	if user, ok := attributeInt(userAccessLevel); ok {
+		level &= user
+	}
+	check.Readable = level&int64(ua.AccessLevelTypeCurrentRead) != 0
+	check.Writable = level&int64(ua.AccessLevelTypeCurrentWrite) != 0
+}
+
+// attributeInt returns an integer attribute such as NodeClass or AccessLevel,
+// which servers send with different integer types
+func attributeInt(dv *ua.DataValue) (int64, bool) {
+	if dv == nil || dv.Status != ua.StatusOK || dv.Value == nil {
+		return 0, false
+	}
+	switch v := dv.Value.Value().(type) {
+	case uint8:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case int64:
+		return v, true
+	}
+	return 0, false
+}
+
+// nodeExpectation is a node of a validate file with its expected access and
+// data type, both optional
+type nodeExpectation struct {
+	nodeID   string
+	access   string // r, w or rw
+	dataType string
+}
+
+// parseValidateFile reads a validate file: one node per line, optionally
+// followed by the expected access (r, w or rw) and data type, e.g.
+//
+//	# Setpoints must be writable floats
+//	ns=3;s=Setpoint rw float
+//	ns=3;s=Temperature
+func parseValidateFile(r io.Reader) ([]nodeExpectation, error) {
+	var expectations []nodeExpectation
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: expected <node-id> [r|w|rw] [data-type]", line)
+		}
+		exp := nodeExpectation{nodeID: fields[0]}
+		for _, field := range fields[1:] {
+			switch strings.ToLower(field) {
+			case "r", "w", "rw":
+				exp.access = strings.ToLower(field)
+			default:
+				if exp.dataType != "" {
+					return nil, fmt.Errorf("line %d: more than one data type", line)
+				}
+				exp.dataType = strings.ToLower(field)
+			}
+		}
+		expectations = append(expectations, exp)
+	}
+	return expectations, scanner.Err()
+}
+
+// validateSummary counts the outcome of a validation
+type validateSummary struct {
+	total, ok, missing, wrongAccess, wrongType int
+}
+
+// checkExpectation returns what is wrong with a node. Without an expected
+// access, variables have to be readable
+func checkExpectation(exp nodeExpectation, check plcclient.NodeCheck, summary *validateSummary) []string {
+	if !check.Exists {
+		summary.missing++
+		return []string{"not found: " + check.Error}
+	}
+	access := exp.access
+	if access == "" && check.NodeClass == "Variable" {
+		access = "r"
+	}
+	var problems []string
+	if strings.Contains(access, "r") && !check.Readable {
+		problems = append(problems, "not readable")
+	}
+	if strings.Contains(access, "w") && !check.Writable {
+		problems = append(problems, "not writable")
+	}
+	if len(problems) > 0 {
+		summary.wrongAccess++
+	}
+	if exp.dataType != "" && !strings.EqualFold(exp.dataType, check.DataType) {
+		problems = append(problems, fmt.Sprintf("data type %s, expected %s", check.DataType, exp.dataType))
+		summary.wrongType++
+	}
+	return problems
+}
+
+// validateNodes checks the nodes through the service and prints one line per
+// node (OK or FAIL, node ID, data type, access, problems) and a summary. It
+// reports whether all nodes are as expected
+func validateNodes(expectations []nodeExpectation, host string, port int) (string, bool, error) {
+	if len(expectations) == 0 {
+		return "", false, fmt.Errorf("no nodes to validate")
+	}
+	nodeIDs := make([]string, len(expectations))
+	for i, exp := range expectations {
+		nodeIDs[i] = exp.nodeID
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout(10*time.Second))
+	defer cancel()
+	checks, err := newServiceClient(host, port).Validate(ctx, nodeIDs...)
+	if err != nil {
+		return "", false, err
+	}
+
+	summary := validateSummary{total: len(checks)}
+	lines := make([]string, 0, len(checks)+1)
+	for i, check := range checks {
+		problems := checkExpectation(expectations[i], check, &summary)
+		status := "OK"
+		if len(problems) > 0 {
+			status = "FAIL"
+		} else {
+			summary.ok++
+		}
+		lines = append(lines, strings.Join([]string{status, expectations[i].nodeID, check.DataType, formatAccess(check), strings.Join(problems, ", ")}, "\t"))
+	}
+	lines = append(lines, fmt.Sprintf("%d nodes: %d ok, %d not found, %d wrong access, %d wrong data type",
+		summary.total, summary.ok, summary.missing, summary.wrongAccess, summary.wrongType))
+	return strings.Join(lines, "\n"), summary.ok == summary.total, nil
+}
+
+// formatAccess abbreviates the access of a node as r, w, rw or -
+func formatAccess(check plcclient.NodeCheck) string {
+	access := ""
+	if check.Readable {
+		access += "r"
+	}
+	if check.Writable {
+		access += "w"
+	}
+	if access == "" {
+		return "-"
+	}
+	return access
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"umicli/pkg/plcclient"
+)
+
+// TestValidateRequest tests checking nodes of the simulated PLC
+func TestValidateRequest(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	connectMock(t, ctx)
+
+	body := `{"nodes": ["nsu=` + mockNamespaceURI + `;s=Setpoint", "nsu=` + mockNamespaceURI + `;s=Missing", "i=85", "ns=x"]}`
+	rec := httptest.NewRecorder()
+	handleValidateRequest(rec, httptest.NewRequest("POST", "/api/validate", strings.NewReader(body)))
+	var resp struct {
+		Results []plcclient.NodeCheck `json:"results"`
+		Error   string                `json:"error"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Empty(t, resp.Error)
+	require.Len(t, resp.Results, 4)
+
+	setpoint := resp.Results[0]
+	assert.True(t, setpoint.Exists)
+	assert.Equal(t, "Variable", setpoint.NodeClass)
+	assert.Equal(t, "float", setpoint.DataType)
+	assert.True(t, setpoint.Readable)
+	assert.True(t, setpoint.Writable)
+
+	assert.False(t, resp.Results[1].Exists)
+	assert.NotEmpty(t, resp.Results[1].Error)
+
+	objects := resp.Results[2]
+	assert.True(t, objects.Exists)
+	assert.Equal(t, "Object", objects.NodeClass)
+	assert.False(t, objects.Readable)
+
+	assert.False(t, resp.Results[3].Exists)
+	assert.Contains(t, resp.Results[3].Error, "Invalid node ID")
+}
+
+// TestValidateFile tests parsing a validate file and checking its expectations
+func TestValidateFile(t *testing.T) {
+	expectations, err := parseValidateFile(strings.NewReader(`
+# Setpoints
+ns=3;s=Setpoint rw Float
+ns=3;s=Temperature
+ns=3;s=Name string r
+`))
+	require.NoError(t, err)
+	assert.Equal(t, []nodeExpectation{
+		{nodeID: "ns=3;s=Setpoint", access: "rw", dataType: "float"},
+		{nodeID: "ns=3;s=Temperature"},
+		{nodeID: "ns=3;s=Name", access: "r", dataType: "string"},
+	}, expectations)
+
+	_, err = parseValidateFile(strings.NewReader("ns=3;s=Setpoint rw float double"))
+	assert.Error(t, err)
+
+	var summary validateSummary
+	readOnly := plcclient.NodeCheck{Exists: true, NodeClass: "Variable", DataType: "double", Readable: true}
+	assert.Empty(t, checkExpectation(nodeExpectation{}, readOnly, &summary))
+	assert.Equal(t, []string{"not writable", "data type double, expected float"},
+		checkExpectation(expectations[0], readOnly, &summary))
+	assert.Len(t, checkExpectation(nodeExpectation{}, plcclient.NodeCheck{Error: "BadNodeIdUnknown"}, &summary), 1)
+	assert.Equal(t, validateSummary{missing: 1, wrongAccess: 1, wrongType: 1}, summary)
+
+	// Objects are not readable, which is only a problem when asked for
+	object := plcclient.NodeCheck{Exists: true, NodeClass: "Object"}
+	assert.Empty(t, checkExpectation(nodeExpectation{}, object, &summary))
+	assert.Equal(t, []string{"not readable"}, checkExpectation(nodeExpectation{access: "r"}, object, &summary))
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"umicli/pkg/plcclient"
+)
+
+// Interval of opcua watch without --interval
+const defaultWatchInterval = time.Second
+
+// watchRow is a node of the opcua watch table
+type watchRow struct {
+	nodeID  string
+	value   string
+	quality string
+	changed time.Time // Source timestamp of the last change, or when it was seen
+	read    bool      // A value or error arrived
+
+	// Cells that changed with the last value, highlighted until the next one
+	valueChanged, qualityChanged bool
+}
+
+// watchTable is the table of opcua watch: the nodes in the order given, with
+// their last value, quality and when they last changed
+type watchTable struct {
+	heading string // Interval and command, like watch(1) shows them
+	rows    []*watchRow
+	byID    map[string]*watchRow
+}
+
+func newWatchTable(heading string, nodeIDs []string) *watchTable {
+	t := &watchTable{heading: heading, byID: map[string]*watchRow{}}
+	for _, nodeID := range nodeIDs {
+		if _, ok := t.byID[nodeID]; ok {
+			continue
+		}
+		row := &watchRow{nodeID: nodeID}
+		t.rows = append(t.rows, row)
+		t.byID[nodeID] = row
+	}
+	return t
+}
+
+// nodeIDs returns the nodes of the table, each once
+func (t *watchTable) nodeIDs() []string {
+	var nodeIDs []string
+	for _, row := range t.rows {
+		nodeIDs = append(nodeIDs, row.nodeID)
+	}
+	return nodeIDs
+}
+
+// update puts a value read at now into its row. Failed reads keep the last
+// value and show the error as the quality
+func (t *watchTable) update(v plcclient.NodeResponse, now time.Time) {
+	nodeID := v.RequestedNodeID
+	if nodeID == "" {
+		nodeID = v.NodeID
+	}
+	row, ok := t.byID[nodeID]
+	if !ok {
+		return
+	}
+
+	value, quality := row.value, "Good"
+	if v.Error != "" {
+		quality = v.Error
+	} else {
+		value = fmt.Sprint(v.Value)
+		if v.EnumName != "" {
+			value = fmt.Sprintf("%v (%s)", v.Value, v.EnumName)
+		}
+	}
+	// The first value is not a change
+	row.valueChanged = row.read && value != row.value
+	row.qualityChanged = row.read && quality != row.quality
+	if !row.read || row.valueChanged || row.qualityChanged {
+		row.changed = now
+		if v.SourceTimestamp != nil && v.Error == "" {
+			row.changed = *v.SourceTimestamp
+		}
+	}
+	row.value, row.quality, row.read = value, quality, true
+}
+
+// render draws the table as lines of at most width runes, with the cells
+// changed by the last value of their row in inverse video
+func (t *watchTable) render(width int, now time.Time) []string {
+	width = max(width, 40)
+	clock := now.Format("2006-01-02 15:04:05")
+	header := tuiPad(t.heading, max(width-len(clock)-2, 0)) + "  " + clock
+	lines := []string{header, ""}
+
+	cells := [][]string{{"NODE ID", "VALUE", "QUALITY", "LAST CHANGE"}}
+	for _, row := range t.rows {
+		value, quality, changed := "…", "", ""
+		if row.read {
+			value, quality = row.value, row.quality
+			changed = row.changed.Local().Format("15:04:05.000") + " (" + watchAge(now.Sub(row.changed)) + " ago)"
+		}
+		cells = append(cells, []string{row.nodeID, value, quality, changed})
+	}
+	// Columns as wide as their cells, values and qualities cut to fit
+	widths := make([]int, 4)
+	for _, line := range cells {
+		for i, cell := range line {
+			widths[i] = max(widths[i], len([]rune(cell)))
+		}
+	}
+	for _, i := range []int{1, 2} {
+		others := 0
+		for j, w := range widths {
+			if j != i {
+				others += w + 2
+			}
+		}
+		widths[i] = max(min(widths[i], width-others), 5)
+	}
+
+	for r, line := range cells {
+		var b strings.Builder
+		for i, cell := range line {
+			if i > 0 {
+				b.WriteString("  ")
+			}
+			text := tuiPad(cell, widths[i])
+			if r > 0 && (i == 1 && t.rows[r-1].valueChanged || i == 2 && t.rows[r-1].qualityChanged) {
+				text = tuiInverse(text)
+			}
+			b.WriteString(text)
+		}
+		lines = append(lines, strings.TrimRight(b.String(), " "))
+	}
+	return lines
+}
+
+// watchAge is a duration rounded for the last change column
+func watchAge(d time.Duration) string {
+	switch {
+	case d < time.Second:
+		return "0s"
+	case d < time.Minute:
+		return d.Truncate(time.Second).String()
+	case d < time.Hour:
+		return d.Truncate(time.Minute).String()
+	}
+	return d.Truncate(time.Hour).String()
+}
+
+// watchNodes subscribes to the nodes and draws the table to out whenever
+// values arrive and every interval, until ctx is done
+func watchNodes(ctx context.Context, client *plcclient.HTTPClient, table *watchTable, interval time.Duration, out io.Writer, width func() int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	values, err := client.Subscribe(ctx, table.nodeIDs(), interval)
+	if err != nil {
+		return err
+	}
+	redraw := time.NewTicker(interval)
+	defer redraw.Stop()
+
+	for {
+		drawTUI(out, table.render(width(), time.Now()))
+		select {
+		case v, ok := <-values:
+			if !ok {
+				return nil
+			}
+			table.update(v, time.Now())
+		case <-redraw.C:
+			// The ages of the last changes go on
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// runWatch runs opcua watch: a table of the values of the nodes, refreshed
+// every interval on the alternate screen until ctx is done
+func runWatch(ctx context.Context, nodeIDs []string, interval time.Duration, host string, port int) error {
+	// Before the screen is switched, so errors stay visible
+	client := newServiceClient(host, port)
+	for _, nodeID := range nodeIDs {
+		if _, _, _, err := plcclient.ParseNodeID(nodeID); err != nil {
+			return err
+		}
+	}
+	table := newWatchTable(fmt.Sprintf("Every %s: plccli opcua watch %s", interval, strings.Join(nodeIDs, " ")), nodeIDs)
+
+	// Alternate screen without cursor, restored on exit
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+	return watchNodes(ctx, client, table, interval, os.Stdout, func() int {
+		width, _ := terminalSize()
+		return width
+	})
+}
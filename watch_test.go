@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"umicli/pkg/plcclient"
+)
+
+// TestWatchTable tests the values, qualities and change times of opcua watch
+func TestWatchTable(t *testing.T) {
+	now := time.Date(2026, 3, 2, 8, 0, 0, 0, time.Local)
+	table := newWatchTable("Every 1s: plccli opcua watch", []string{"ns=3;s=Speed", "ns=3;s=Mode", "ns=3;s=Speed"})
+	assert.Equal(t, []string{"ns=3;s=Speed", "ns=3;s=Mode"}, table.nodeIDs())
+
+	source := now.Add(-90 * time.Second)
+	table.update(plcclient.NodeResponse{NodeID: "ns=3;s=Speed", Value: 72.5, SourceTimestamp: &source}, now)
+	table.update(plcclient.NodeResponse{NodeID: "ns=3;s=Other", Value: 1}, now)
+	lines := table.render(80, now.Add(5*time.Second))
+	require.Len(t, lines, 5)
+	assert.True(t, strings.HasPrefix(lines[0], "Every 1s: plccli opcua watch"))
+	assert.True(t, strings.HasSuffix(lines[0], "2026-03-02 08:00:05"))
+	assert.Equal(t, "NODE ID       VALUE  QUALITY  LAST CHANGE", lines[2])
+	assert.Equal(t, "ns=3;s=Speed  72.5   Good     07:58:30.000 (1m0s ago)", lines[3])
+	assert.Equal(t, "ns=3;s=Mode   …", lines[4])
+
+	// Changed cells are highlighted until the next value
+	later := now.Add(time.Second)
+	table.update(plcclient.NodeResponse{RequestedNodeID: "ns=3;s=Speed", NodeID: "ns=3;s=Speed", Value: 75.0}, later)
+	table.update(plcclient.NodeResponse{NodeID: "ns=3;s=Mode", Value: 3, EnumName: "Running"}, later)
+	lines = table.render(80, later)
+	assert.Contains(t, lines[3], tuiInverse("75         ")+"  Good")
+	assert.Contains(t, lines[4], "3 (Running)  Good", "the first value is no change")
+	assert.NotContains(t, lines[4], "\x1b[7m")
+
+	// Failed reads keep the value
+	table.update(plcclient.NodeResponse{NodeID: "ns=3;s=Speed", Error: "BadNotConnected"}, later.Add(time.Second))
+	table.update(plcclient.NodeResponse{NodeID: "ns=3;s=Mode", Value: 3, EnumName: "Running"}, later.Add(time.Second))
+	lines = table.render(80, later.Add(2*time.Second))
+	assert.Contains(t, lines[3], "75           "+tuiInverse("BadNotConnected")+"  08:00:02.000 (1s ago)")
+	assert.Equal(t, "ns=3;s=Mode   3 (Running)  Good             08:00:01.000 (2s ago)", lines[4])
+
+	// Long values are cut to the terminal
+	table.update(plcclient.NodeResponse{NodeID: "ns=3;s=Mode", Value: strings.Repeat("x", 200)}, later)
+	for _, line := range table.render(100, later) {
+		assert.LessOrEqual(t, len([]rune(strings.NewReplacer("\x1b[7m", "", "\x1b[0m", "").Replace(line))), 100, line)
+	}
+}
+
+// TestWatchNodes tests that opcua watch redraws the table with the values of
+// the service
+func TestWatchNodes(t *testing.T) {
+	var mu sync.Mutex
+	value := 1
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/nodes", func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Nodes []map[string]string }
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		defer mu.Unlock()
+		var results []NodeResponse
+		for _, n := range req.Nodes {
+			results = append(results, NodeResponse{NodeID: n["nodeID"], Value: value})
+		}
+		value++
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	screen := &tuiScreen{}
+	done := make(chan error)
+	table := newWatchTable("Every 10ms", []string{"ns=3;s=A", "ns=3;s=B"})
+	go func() {
+		done <- watchNodes(ctx, newServiceClient(u.Hostname(), port), table, 10*time.Millisecond, screen, func() int { return 80 })
+	}()
+	require.Eventually(t, func() bool {
+		s := screen.String()
+		return strings.Contains(s, "ns=3;s=A  \x1b[7m3") && strings.Contains(s, "ns=3;s=B  \x1b[7m3")
+	}, 5*time.Second, 5*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+
+	err = watchNodes(context.Background(), newServiceClient(u.Hostname(), port), newWatchTable("", []string{"ns=3;x=A"}), time.Second, screen, func() int { return 80 })
+	assert.Error(t, err)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers of webhook requests, see signWebhook
+const (
+	webhookSignatureHeader = "X-Plccli-Signature"
+	webhookTimestampHeader = "X-Plccli-Timestamp"
+)
+
+// webhookNotification is a value change in the JSON body of a webhook sink
+type webhookNotification struct {
+	Measurement string                 `json:"measurement"`
+	NodeID      string                 `json:"nodeId,omitempty"`
+	Tags        map[string]string      `json:"tags"`
+	Fields      map[string]interface{} `json:"fields"`
+	Time        time.Time              `json:"time"` // Source timestamp
+}
+
+// webhookBody is the JSON body of a webhook request
+type webhookBody struct {
+	Connection    string                `json:"connection"`
+	Notifications []webhookNotification `json:"notifications"`
+}
+
+// webhookPayload returns the JSON body of a webhook request with the lines
+// as notifications
+func webhookPayload(lines []string) ([]byte, error) {
+	body := webhookBody{Connection: connectionName, Notifications: make([]webhookNotification, 0, len(lines))}
+	for _, line := range lines {
+		l, err := parseInfluxLine(line)
+		if err != nil {
+			continue // Lines come from the poll file, this is not expected
+		}
+		n := webhookNotification{
+			Measurement: l.measurement,
+			NodeID:      l.tag("node_id"),
+			Tags:        l.tagMap(),
+			Fields:      make(map[string]interface{}, len(l.fields)),
+			Time:        l.time.UTC(),
+		}
+		for _, field := range l.fields {
+			n.Fields[field.name] = field.jsonValue()
+		}
+		body.Notifications = append(body.Notifications, n)
+	}
+	return json.Marshal(body)
+}
+
+// tagMap returns the tags of the line, unescaped
+func (l influxLine) tagMap() map[string]string {
+	tags := make(map[string]string)
+	for rest := l.tags; rest != ""; {
+		var tag string
+		tag, rest, _ = cutUnescaped(rest, ',')
+		name, value, _ := cutUnescaped(tag, '=')
+		tags[unescapeLineProtocol(name)] = unescapeLineProtocol(value)
+	}
+	return tags
+}
+
+// jsonValue returns the value of a field as a JSON string, number or boolean
+func (f influxField) jsonValue() interface{} {
+	if f.quoted {
+		return f.value
+	}
+	switch f.value {
+	case "t", "T", "true", "True", "TRUE":
+		return true
+	case "f", "F", "false", "False", "FALSE":
+		return false
+	}
+	if n, err := strconv.ParseInt(strings.TrimRight(f.value, "iu"), 10, 64); err == nil {
+		return n
+	}
+	if v, err := strconv.ParseFloat(f.value, 64); err == nil {
+		return v
+	}
+	return f.value
+}
+
+// signWebhook returns the HMAC-SHA256 signature of a webhook request,
+// "sha256=" and the hex digest of the timestamp, a dot and the JSON body
+// (before gzip). The timestamp (Unix seconds) is sent along so receivers can
+// reject replays
+func signWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookSecret returns the signing secret of a webhook sink or rule, from
+// secret or the first line of secretFile
+func webhookSecret(secret, secretFile string) ([]byte, error) {
+	if secret != "" && secretFile != "" {
+		return nil, fmt.Errorf("secret and secretFile exclude each other")
+	}
+	if secretFile == "" {
+		return []byte(secret), nil
+	}
+	data, err := os.ReadFile(secretFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the secret file: %v", err)
+	}
+	secret = strings.TrimRight(string(data), "\r\n")
+	if secret == "" {
+		return nil, fmt.Errorf("secret file %s is empty", secretFile)
+	}
+	return []byte(secret), nil
+}
+
+// changeFilter keeps only the lines whose values changed since the last line
+// of the same series a sink acknowledged, for webhook sinks notifying of
+// value changes, and Loki sinks. The first line of a series, annotations and
+// connection events always pass
+type changeFilter struct {
+	mu   sync.Mutex
+	last map[string]string // Field values by measurement, tags and field names
+}
+
+func newChangeFilter() *changeFilter {
+	return &changeFilter{last: make(map[string]string)}
+}
+
+// filter returns the lines that change the value of their series, compared
+// to the acknowledged lines and the lines before them
+func (c *changeFilter) filter(lines []string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	seen := make(map[string]string)
+	var changed []string
+	for _, line := range lines {
+		key, value := changeKey(line)
+		if isLogLine(key) {
+			changed = append(changed, line) // Every annotation and event is news
+			continue
+		}
+		prev, ok := seen[key]
+		if !ok {
+			prev, ok = c.last[key]
+		}
+		if ok && prev == value {
+			continue
+		}
+		seen[key] = value
+		changed = append(changed, line)
+	}
+	return changed
+}
+
+// ack records the values of lines the sink acknowledged
+func (c *changeFilter) ack(lines []string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, line := range lines {
+		key, value := changeKey(line)
+		c.last[key] = value
+	}
+}
+
+// changeKey returns the series of a line and its field values
+func changeKey(line string) (string, string) {
+	l, err := parseInfluxLine(line)
+	if err != nil {
+		return line, ""
+	}
+	key, value := l.measurement+","+l.tags, ""
+	for _, field := range l.fields {
+		key += " " + field.name
+		value += field.value + ","
+	}
+	return key, value
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestWebhookSink tests the signed JSON notifications and that only value
+// changes are sent, the rejected ones again on the next flush
+func TestWebhookSink(t *testing.T) {
+	var bodies []webhookBody
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		timestamp := r.Header.Get(webhookTimestampHeader)
+		assert.Equal(t, signWebhook([]byte("s3cret"), timestamp, data), r.Header.Get(webhookSignatureHeader))
+		var body webhookBody
+		require.NoError(t, json.Unmarshal(data, &body))
+		bodies = append(bodies, body)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	path := writePollFile(t, "sinks:\n  - {webhook: "+server.URL+", secret: s3cret}\npolls:\n  - {node: ns=1;s=Temperature, interval: 1s}\n")
+	pf, err := loadPollFile(path)
+	require.NoError(t, err)
+	sink := pf.Sinks[0]
+	buffer := newPriorityBuffer(10)
+	client := &http.Client{Timeout: time.Second}
+
+	temperature := `boiler,node_id=ns\=1;s\=Temperature,site=plant\ 1 value=21.5,ok=t,unit="C",count=3i 1772352000000000000`
+	sink.flush(context.Background(), client, buffer, prioritized{priorityProcess: {temperature, temperature}}, time.Second)
+	require.Len(t, bodies, 1)
+	require.Len(t, bodies[0].Notifications, 1, "the repeated value is no change")
+	n := bodies[0].Notifications[0]
+	assert.Equal(t, "boiler", n.Measurement)
+	assert.Equal(t, "ns=1;s=Temperature", n.NodeID)
+	assert.Equal(t, "plant 1", n.Tags["site"])
+	assert.Equal(t, map[string]interface{}{"value": 21.5, "ok": true, "unit": "C", "count": 3.0}, n.Fields)
+	assert.Equal(t, time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC), n.Time)
+
+	// The same value again is skipped, a failed change is sent again
+	changed := `boiler,node_id=ns\=1;s\=Temperature,site=plant\ 1 value=22,ok=t,unit="C",count=3i 1772352001000000000`
+	status = http.StatusServiceUnavailable
+	sink.flush(context.Background(), client, buffer, prioritized{priorityProcess: {temperature, changed}}, time.Second)
+	require.Len(t, bodies, 2)
+	assert.Len(t, bodies[1].Notifications, 1)
+	lines, _ := buffer.drain()
+	status = http.StatusNoContent
+	sink.flush(context.Background(), client, buffer, lines, time.Second)
+	require.Len(t, bodies, 3)
+	assert.Equal(t, 22.0, bodies[2].Notifications[0].Fields["value"])
+	sink.flush(context.Background(), client, buffer, prioritized{priorityProcess: {changed}}, time.Second)
+	assert.Len(t, bodies, 3)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gopcua/opcua/ua"
+	"gopkg.in/yaml.v3"
+)
+
+// writeLimits are the values the service may write to nodes, from
+// --write-limits. Every limit whose rule matches a node applies to its writes
+type writeLimits []writeLimit
+
+// writeLimit constrains the values written to the nodes of a rule
+type writeLimit struct {
+	rule   nodeRule
+	name   string   // Shown in errors, e.g. "Oven setpoint"
+	min    *float64 // Lowest value
+	max    *float64 // Highest value
+	step   float64  // Values are min plus a multiple of step (0 plus one without min), 0 for any
+	values []string // Allowed values, numbers or enumeration names, nil for any
+}
+
+// Write limits of this service, nil to allow all values
+var serviceWriteLimits writeLimits
+
+// loadWriteLimits reads a --write-limits file:
+//
+//	limits:
+//	  - node: ns=3;s=Oven.Setpoint
+//	    name: Oven setpoint
+//	    min: 20
+//	    max: 250
+//	    step: 0.5
+//	  - node: ns=3;s=Line1.Mode
+//	    values: [Off, Manual, Auto]
+func loadWriteLimits(path string) (writeLimits, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read write limits file %s: %v", path, err)
+	}
+	var file struct {
+		Limits []struct {
+			Node   string   `yaml:"node"`
+			Name   string   `yaml:"name"`
+			Min    *float64 `yaml:"min"`
+			Max    *float64 `yaml:"max"`
+			Step   float64  `yaml:"step"`
+			Values []string `yaml:"values"`
+		} `yaml:"limits"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid write limits file %s: %v", path, err)
+	}
+	if len(file.Limits) == 0 {
+		return nil, fmt.Errorf("invalid write limits file %s: no limits", path)
+	}
+
+	var limits writeLimits
+	for i, l := range file.Limits {
+		if l.Node == "" {
+			return nil, fmt.Errorf("invalid write limits file %s: limit %d has no node", path, i+1)
+		}
+		rule, err := parseNodeRule(l.Node)
+		if err != nil {
+			return nil, fmt.Errorf("invalid write limits file %s: %v", path, err)
+		}
+		switch {
+		case l.Min == nil && l.Max == nil && l.Step == 0 && len(l.Values) == 0:
+			return nil, fmt.Errorf("invalid write limits file %s: limit of %s has no min, max, step or values", path, l.Node)
+		case l.Min != nil && l.Max != nil && *l.Min > *l.Max:
+			return nil, fmt.Errorf("invalid write limits file %s: min of %s is above its max", path, l.Node)
+		case l.Step < 0:
+			return nil, fmt.Errorf("invalid write limits file %s: step of %s must be positive", path, l.Node)
+		}
+		limits = append(limits, writeLimit{rule: rule, name: l.Name, min: l.Min, max: l.Max, step: l.Step, values: l.Values})
+	}
+	return limits, nil
+}
+
+// check returns an error when a value converted for writing a node is not
+// within the limits of the node. enumName returns the symbolic name of an
+// integer value, it is only called for limits with allowed values
+func (limits writeLimits) check(id *ua.NodeID, value interface{}, enumName func() string) error {
+	return limits.checkMatching(id.String(), func(rule nodeRule) bool { return rule.matches(id) },
+		serviceSensitive.matches(id), value, enumName)
+}
+
+// checkRef returns an error when a value to write to a reference of a
+// backend connection is not within its limits. Values that parse as numbers
+// are checked as numbers, the backend converts them later
+func (limits writeLimits) checkRef(ref, value string) error {
+	var converted interface{} = value
+	if number, err := parseDecimal(value, 64, *decimalSeparator); err == nil {
+		converted = number
+	}
+	return limits.checkMatching(ref, func(rule nodeRule) bool { return rule.matchesRef(ref) },
+		serviceSensitive.matchesString(ref), converted, func() string { return "" })
+}
+
+// checkMatching checks a value to write to a node or reference, named
+// target, against the limits whose rules match matches. The value of a
+// sensitive target is not shown in the error
+func (limits writeLimits) checkMatching(target string, match func(nodeRule) bool, sensitive bool, value interface{}, enumName func() string) error {
+	for _, l := range limits {
+		if !match(l.rule) {
+			continue
+		}
+		node := target
+		if l.name != "" {
+			node += " (" + l.name + ")"
+		}
+		text, number, isNumber := limitValue(value)
+		shown := text // The error is logged
+		if sensitive {
+			shown = redactedValue
+		}
+
+		if len(l.values) > 0 && !l.allows(text, number, isNumber, enumName) {
+			return fmt.Errorf("writing %s to %s is not allowed, the write limits allow %s", shown, node, strings.Join(l.values, ", "))
+		}
+		if l.min == nil && l.max == nil && l.step == 0 {
+			continue
+		}
+		if !isNumber {
+			return fmt.Errorf("writing %s to %s is not allowed, the write limits take numbers", shown, node)
+		}
+		if l.min != nil && number < *l.min {
+			return fmt.Errorf("writing %s to %s is not allowed, it is below the minimum %v of the write limits", shown, node, *l.min)
+		}
+		if l.max != nil && number > *l.max {
+			return fmt.Errorf("writing %s to %s is not allowed, it is above the maximum %v of the write limits", shown, node, *l.max)
+		}
+		if l.step != 0 {
+			base := 0.0
+			if l.min != nil {
+				base = *l.min
+			}
+			// Float values are close to, not at, the steps
+			steps := (number - base) / l.step
+			if math.Abs(steps-math.Round(steps)) > 1e-6 {
+				return fmt.Errorf("writing %s to %s is not allowed, the write limits take steps of %v from %v", shown, node, l.step, base)
+			}
+		}
+	}
+	return nil
+}
+
+// allows reports whether a value is one of the allowed values of a limit,
+// compared as numbers where both are, else as text or enumeration name
+func (l writeLimit) allows(text string, number float64, isNumber bool, enumName func() string) bool {
+	name := ""
+	for _, allowed := range l.values {
+		if isNumber {
+			if n, err := strconv.ParseFloat(allowed, 64); err == nil {
+				if n == number {
+					return true
+				}
+				continue
+			}
+			if name == "" && number == math.Trunc(number) {
+				name = enumName()
+			}
+			if name != "" && allowed == name {
+				return true
+			}
+			continue
+		}
+		if allowed == text {
+			return true
+		}
+	}
+	return false
+}
+
+// limitValue returns a value to write as text and, for numbers, as float
+func limitValue(value interface{}) (string, float64, bool) {
+	switch v := value.(type) {
+	case int8, int16, int32, int64, uint8, uint16, uint32, uint64:
+		n, _ := strconv.ParseFloat(fmt.Sprint(v), 64)
+		return fmt.Sprint(v), n, true
+	case float32:
+		// As written, 0.1 is not above a maximum of 0.1
+		text := strconv.FormatFloat(float64(v), 'g', -1, 32)
+		n, _ := strconv.ParseFloat(text, 64)
+		return text, n, true
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), v, true
+	case *ua.LocalizedText:
+		return v.Text, 0, false
+	case *ua.ExtensionObject:
+		return "a structure", 0, false
+	}
+	return fmt.Sprint(value), 0, false
+}
+
+// allowWriteValue checks a value to write against the write limits of the
+// service. A rejected write is logged and answered with the error
+func allowWriteValue(w http.ResponseWriter, r *http.Request, id *ua.NodeID, nodeIDStr string, value interface{}, enumName func() string) bool {
+	err := serviceWriteLimits.check(id, value, enumName)
+	if err == nil {
+		return true
+	}
+	resp, _ := writeRejected(permitHolder(r), nodeIDStr, err)
+	sendJSONResponse(w, resp)
+	return false
+}
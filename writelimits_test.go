@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestWriteLimits tests the min, max, step and allowed values of a write
+// limits file
+func TestWriteLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limits.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+limits:
+  - node: ns=3;s=Oven.Setpoint
+    name: Oven setpoint
+    min: 20
+    max: 250
+    step: 0.5
+  - node: ns=3;s=Recipe.*
+    min: 0
+  - node: ns=3;s=Line1.Mode
+    values: [0, Manual, Auto]
+  - node: ns=3;s=Line1.Label
+    values: [press-1, press-2]
+`), 0644))
+	limits, err := loadWriteLimits(path)
+	require.NoError(t, err)
+
+	setpoint := ua.NewStringNodeID(3, "Oven.Setpoint")
+	modeNames := map[int32]string{1: "Manual", 2: "Auto", 3: "Service"}
+	mode := ua.NewStringNodeID(3, "Line1.Mode")
+	for _, tc := range []struct {
+		id    *ua.NodeID
+		value interface{}
+		err   string
+	}{
+		{setpoint, float32(180.5), ""},
+		{setpoint, float32(250), ""},
+		{setpoint, 20.0, ""},
+		{setpoint, float32(250.5), "writing 250.5 to ns=3;s=Oven.Setpoint (Oven setpoint) is not allowed, it is above the maximum 250 of the write limits"},
+		{setpoint, int16(19), "below the minimum 20"},
+		{setpoint, float32(180.2), "the write limits take steps of 0.5 from 20"},
+		{setpoint, "180", "writing 180 to ns=3;s=Oven.Setpoint (Oven setpoint) is not allowed, the write limits take numbers"},
+		{ua.NewStringNodeID(3, "Recipe.Speed"), int32(-1), "ns=3;s=Recipe.Speed is not allowed, it is below the minimum 0"},
+		{ua.NewStringNodeID(3, "Recipe.Speed"), int32(1200), ""},
+		{mode, int32(0), ""},
+		{mode, int32(2), ""},
+		{mode, int32(3), "writing 3 to ns=3;s=Line1.Mode is not allowed, the write limits allow 0, Manual, Auto"},
+		{ua.NewStringNodeID(3, "Line1.Label"), "press-2", ""},
+		{ua.NewStringNodeID(3, "Line1.Label"), ua.NewLocalizedText("press-3"), "writing press-3"},
+		{ua.NewStringNodeID(4, "Oven.Setpoint"), 1000.0, ""},
+	} {
+		err := limits.check(tc.id, tc.value, func() string { return modeNames[tc.value.(int32)] })
+		if tc.err == "" {
+			assert.NoError(t, err, "%v %v", tc.id, tc.value)
+		} else {
+			assert.ErrorContains(t, err, tc.err, "%v %v", tc.id, tc.value)
+		}
+	}
+	assert.NoError(t, writeLimits(nil).check(setpoint, 1000.0, nil))
+
+	for _, bad := range []string{
+		"limits: []\n",
+		"limits:\n  - min: 1\n",
+		"limits:\n  - node: s=A\n    min: 1\n",
+		"limits:\n  - node: ns=3;s=A\n",
+		"limits:\n  - node: ns=3;s=A\n    min: 2\n    max: 1\n",
+		"limits:\n  - node: ns=3;s=A\n    step: -1\n",
+	} {
+		require.NoError(t, os.WriteFile(path, []byte(bad), 0644))
+		_, err := loadWriteLimits(path)
+		assert.Error(t, err, bad)
+	}
+}
+
+// TestWriteLimitsRejectWrites tests that writes outside the limits are
+// rejected, dry runs included, and never reach the simulated PLC
+func TestWriteLimitsRejectWrites(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	connectMock(t, ctx)
+	setpoint := "nsu=" + mockNamespaceURI + ";s=Setpoint"
+	alarms, err := parseNodeRule("nsu=" + mockNamespaceURI + ";s=Alarms")
+	require.NoError(t, err)
+	rule, err := parseNodeRule(setpoint)
+	require.NoError(t, err)
+	lowest, highest := 10.0, 30.0
+	serviceWriteLimits = writeLimits{{rule: rule, min: &lowest, max: &highest}, {rule: alarms, max: &highest}}
+	t.Cleanup(func() { serviceWriteLimits = nil })
+
+	write := func(body string, bit bool) NodeResponse {
+		rec := httptest.NewRecorder()
+		if bit {
+			handleBitWriteRequest(rec, httptest.NewRequest("POST", "/api/nodes/bit", strings.NewReader(body)))
+		} else {
+			handleNodeWriteRequest(rec, httptest.NewRequest("POST", "/api/nodes/write", strings.NewReader(body)))
+		}
+		var resp NodeResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return resp
+	}
+	body := `{"namespace": "` + mockNamespaceURI + `", "type": "s", "identifier": "Setpoint", "value": "%s", "dataType": "auto"%s}`
+	assert.Contains(t, write(fmt.Sprintf(body, "35", ""), false).Error, "above the maximum 30")
+	assert.Contains(t, write(fmt.Sprintf(body, "5", `, "dryRun": true`), false).Error, "below the minimum 10")
+	assert.Empty(t, write(fmt.Sprintf(body, "22,5", ""), false).Error)
+
+	id, err := resolveNodeID(setpoint)
+	require.NoError(t, err)
+	value, err := readNodeDataValue(ctx, opcuaClient, id)
+	require.NoError(t, err)
+	assert.Equal(t, float32(22.5), value.Value.Value(), "only the write within the limits arrived")
+
+	// Bit writes are checked with the word they write, 0x0081 with bit 6 is 193
+	bit := write(`{"namespace": "`+mockNamespaceURI+`", "type": "s", "identifier": "Alarms", "bit": 6, "value": 1}`, true)
+	assert.Contains(t, bit.Error, "writing 193 to")
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gopcua/opcua/ua"
+	"gopkg.in/yaml.v3"
+)
+
+// writePolicy restricts the nodes that may be written through the service,
+// from --write-policy. A node is writable when it matches no deny rule and,
+// if there are allow rules, one of those. Writes of critical nodes also
+// need a second person to confirm them, see approvals.go
+type writePolicy struct {
+	allow    []nodeRule
+	deny     []nodeRule
+	critical []nodeRule
+}
+
+// nodeRule matches node IDs: a single node (ns=3;s=Cmd.Start), the nodes
+// whose identifier starts with a prefix (ns=3;s=Cmd.*) or a whole namespace
+// (ns=3). The namespace may be a URI (nsu=urn:plc;s=Cmd.*). Rules with ref=
+// match the references of backend connections instead (ref=1/holding/*)
+type nodeRule struct {
+	text       string // As in the policy file
+	uri        string // Namespace URI, "" for an index
+	namespace  uint16
+	identifier string // <type>=<identifier>, "" for the whole namespace; the reference of ref= rules
+	prefix     bool
+	ref        bool // Matches backend references, not node IDs
+}
+
+// Write policy of this service, nil to allow all writes
+var serviceWritePolicy *writePolicy
+
+// parseNodeRule parses a rule of the write policy
+func parseNodeRule(text string) (nodeRule, error) {
+	rule := nodeRule{text: text}
+	if ref, ok := strings.CutPrefix(text, "ref="); ok {
+		rule.ref = true
+		rule.identifier, rule.prefix = strings.CutSuffix(ref, "*")
+		if rule.identifier == "" && !rule.prefix {
+			return rule, fmt.Errorf("rule %s needs a reference, e.g. ref=1/holding/100 or ref=1/coil/*", text)
+		}
+		return rule, nil
+	}
+	s := strings.Replace(text, ",", ";", 1)
+	var ns string
+	if uri, identifier, ok := splitNamespaceURI(s); ok {
+		rule.uri, rule.identifier = uri, identifier
+		ns = "0" // Checked below like an index
+	} else {
+		rest, ok := strings.CutPrefix(s, "ns=")
+		if !ok {
+			return rule, fmt.Errorf("rule %s needs a namespace, e.g. ns=3;s=Cmd.* or ns=3", text)
+		}
+		ns, rule.identifier, _ = strings.Cut(rest, ";")
+	}
+	if rule.uri == "" && strings.HasPrefix(s, "nsu=") {
+		return rule, fmt.Errorf("rule %s has an empty namespace URI", text)
+	}
+
+	rule.identifier, rule.prefix = strings.CutSuffix(rule.identifier, "*")
+	if rule.prefix && !strings.Contains(rule.identifier, "=") {
+		return rule, fmt.Errorf("prefix rule %s needs an identifier type, e.g. s=Cmd.*", text)
+	}
+	check := "ns=" + ns
+	if rule.identifier != "" {
+		check += ";" + rule.identifier
+		if rule.prefix {
+			check += "x" // A prefix need not be a complete identifier
+		}
+	} else {
+		check += ";i=0"
+	}
+	id, err := ua.ParseNodeID(check)
+	if err != nil {
+		return rule, fmt.Errorf("invalid rule %s: %v", text, err)
+	}
+	rule.namespace = id.Namespace()
+	return rule, nil
+}
+
+// matches reports whether a resolved node ID matches the rule. Rules with a
+// namespace URI match only while the server has the URI
+func (rule nodeRule) matches(id *ua.NodeID) bool {
+	if rule.ref {
+		return false
+	}
+	namespace := rule.namespace
+	if rule.uri != "" {
+		index, err := serviceNamespaces.index(rule.uri)
+		if err != nil {
+			return false
+		}
+		namespace = index
+	}
+	if id.Namespace() != namespace {
+		return false
+	}
+	if rule.identifier == "" {
+		return true
+	}
+	identifier := nodeIdentifier(id)
+	if rule.prefix {
+		return strings.HasPrefix(identifier, rule.identifier)
+	}
+	return identifier == rule.identifier
+}
+
+// matchesRef reports whether a reference of a backend connection matches
+// the rule
+func (rule nodeRule) matchesRef(ref string) bool {
+	if !rule.ref {
+		return false
+	}
+	if rule.prefix {
+		return strings.HasPrefix(ref, rule.identifier)
+	}
+	return ref == rule.identifier
+}
+
+// nodeIdentifier returns the <type>=<identifier> part of a node ID
+func nodeIdentifier(id *ua.NodeID) string {
+	s := id.String()
+	if strings.HasPrefix(s, "ns=") {
+		_, s, _ = strings.Cut(s, ";")
+	}
+	return s
+}
+
+// loadWritePolicy reads a --write-policy file:
+//
+//	allow:
+//	  - ns=3;s=Cmd.*
+//	deny:
+//	  - ns=3;s=Cmd.SafetyReset
+//	  - nsu=urn:plc:safety
+//	critical:
+//	  - ns=3;s=Cmd.Bypass*
+func loadWritePolicy(path string) (*writePolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read write policy file %s: %v", path, err)
+	}
+	var file struct {
+		Allow    []string `yaml:"allow"`
+		Deny     []string `yaml:"deny"`
+		Critical []string `yaml:"critical"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid write policy file %s: %v", path, err)
+	}
+	if len(file.Allow) == 0 && len(file.Deny) == 0 && len(file.Critical) == 0 {
+		return nil, fmt.Errorf("invalid write policy file %s: no allow, deny or critical rules", path)
+	}
+
+	policy := &writePolicy{}
+	for _, text := range file.Allow {
+		rule, err := parseNodeRule(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid write policy file %s: %v", path, err)
+		}
+		policy.allow = append(policy.allow, rule)
+	}
+	for _, text := range file.Deny {
+		rule, err := parseNodeRule(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid write policy file %s: %v", path, err)
+		}
+		policy.deny = append(policy.deny, rule)
+	}
+	for _, text := range file.Critical {
+		rule, err := parseNodeRule(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid write policy file %s: %v", path, err)
+		}
+		policy.critical = append(policy.critical, rule)
+	}
+	return policy, nil
+}
+
+// check returns an error when the policy does not allow writing a node
+func (p *writePolicy) check(id *ua.NodeID) error {
+	return p.checkMatching(id.String(), func(rule nodeRule) bool { return rule.matches(id) })
+}
+
+// checkRef returns an error when the policy does not allow writing a
+// reference of a backend connection
+func (p *writePolicy) checkRef(ref string) error {
+	return p.checkMatching(ref, func(rule nodeRule) bool { return rule.matchesRef(ref) })
+}
+
+// checkMatching checks the write of a node or reference, named target, that
+// the rules match matches
+func (p *writePolicy) checkMatching(target string, match func(nodeRule) bool) error {
+	if p == nil {
+		return nil
+	}
+	for _, rule := range p.deny {
+		if match(rule) {
+			return fmt.Errorf("writing %s is denied by rule %s of the write policy", target, rule.text)
+		}
+	}
+	if len(p.allow) == 0 {
+		return nil
+	}
+	for _, rule := range p.allow {
+		if match(rule) {
+			return nil
+		}
+	}
+	return fmt.Errorf("writing %s is not allowed by the write policy", target)
+}
+
+// criticalRule returns the critical rule a node matches, nil when writes of
+// the node need no approval
+func (p *writePolicy) criticalRule(id *ua.NodeID) *nodeRule {
+	return p.criticalMatching(func(rule nodeRule) bool { return rule.matches(id) })
+}
+
+// criticalRuleRef returns the critical rule a reference of a backend
+// connection matches, nil when its writes need no approval
+func (p *writePolicy) criticalRuleRef(ref string) *nodeRule {
+	return p.criticalMatching(func(rule nodeRule) bool { return rule.matchesRef(ref) })
+}
+
+// criticalMatching returns the first critical rule that match matches
+func (p *writePolicy) criticalMatching(match func(nodeRule) bool) *nodeRule {
+	if p == nil {
+		return nil
+	}
+	for i, rule := range p.critical {
+		if match(rule) {
+			return &p.critical[i]
+		}
+	}
+	return nil
+}
+
+// allowWrite checks a write request against the policy of the service. A
+// rejected write is logged and answered with the error
+func allowWrite(w http.ResponseWriter, r *http.Request, id *ua.NodeID, nodeIDStr string) bool {
+	err := serviceWritePolicy.check(id)
+	if err == nil {
+		return true
+	}
+	resp, _ := writeRejected(permitHolder(r), nodeIDStr, err)
+	sendJSONResponse(w, resp)
+	return false
+}
+
+// writeRejected logs a write the service refuses for a caller, named by as
+// in permitHolder, and returns its response
+func writeRejected(by, nodeIDStr string, err error) (NodeResponse, error) {
+	log.Printf("[%s] Write rejected for %s: %v", connectionName, by, err)
+	return NodeResponse{NodeID: nodeIDStr, Error: err.Error(), StatusCode: uint32(ua.StatusBadUserAccessDenied)}, err
+}
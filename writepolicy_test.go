@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestWritePolicy tests the rules of a write policy file
+func TestWritePolicy(t *testing.T) {
+	serviceNamespaces.set([]string{"http://opcfoundation.org/UA/", "urn:plc", "urn:plc:safety"})
+	t.Cleanup(func() { serviceNamespaces = &namespaceTable{} })
+
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+allow:
+  - ns=1;s=Cmd.*
+  - ns=1,i=42
+  - nsu=urn:plc:safety;s=Ack
+deny:
+  - ns=1;s=Cmd.SafetyReset
+  - nsu=urn:plc:safety
+`), 0644))
+	policy, err := loadWritePolicy(path)
+	require.NoError(t, err)
+
+	for nodeID, allowed := range map[string]bool{
+		"ns=1;s=Cmd.Start":       true,
+		"ns=1;i=42":              true,
+		"ns=1;s=Cmd.SafetyReset": false, // Denied although allowed
+		"ns=1;s=Setpoint":        false, // Not allowed
+		"ns=2;s=Cmd.Start":       false,
+		"ns=2;s=Ack":             false, // Deny wins for the whole namespace
+		"i=2258":                 false,
+	} {
+		id, err := ua.ParseNodeID(nodeID)
+		require.NoError(t, err)
+		assert.Equal(t, allowed, policy.check(id) == nil, nodeID)
+	}
+
+	// Deny rules alone allow all other nodes
+	require.NoError(t, os.WriteFile(path, []byte("deny:\n  - ns=1;s=Safety.*\n"), 0644))
+	policy, err = loadWritePolicy(path)
+	require.NoError(t, err)
+	assert.NoError(t, policy.check(ua.NewStringNodeID(1, "Cmd.Start")))
+	assert.ErrorContains(t, policy.check(ua.NewStringNodeID(1, "Safety.Limit")), "rule ns=1;s=Safety.*")
+	assert.NoError(t, (*writePolicy)(nil).check(ua.NewStringNodeID(1, "Safety.Limit")))
+
+	for _, bad := range []string{"allow: []\n", "deny:\n  - s=Cmd.*\n", "deny:\n  - ns=1;*\n", "deny:\n  - ns=x\n", "deny:\n  - nsu=;s=A\n"} {
+		require.NoError(t, os.WriteFile(path, []byte(bad), 0644))
+		_, err := loadWritePolicy(path)
+		assert.Error(t, err, bad)
+	}
+}
+
+// TestWritePolicyRejectsWrites tests that the write handlers reject what the
+// policy does not allow, before anything is sent to the PLC
+func TestWritePolicyRejectsWrites(t *testing.T) {
+	rule, err := parseNodeRule("ns=3;s=Safety.*")
+	require.NoError(t, err)
+	serviceWritePolicy = &writePolicy{deny: []nodeRule{rule}}
+	t.Cleanup(func() { serviceWritePolicy = nil })
+
+	writeBody := `{"namespace": "3", "type": "s", "identifier": "Safety.MaxSpeed", "value": "9000", "dataType": "int32"`
+	for _, tc := range []struct {
+		body    string
+		handler http.HandlerFunc
+	}{
+		{writeBody + "}", handleNodeWriteRequest},
+		{writeBody + `, "dryRun": true}`, handleNodeWriteRequest},
+		{`{"namespace": "3", "type": "s", "identifier": "Safety.Flags", "bit": 2, "value": 0}`, handleBitWriteRequest},
+	} {
+		rec := httptest.NewRecorder()
+		tc.handler(rec, httptest.NewRequest("POST", "/api/nodes", strings.NewReader(tc.body)))
+		var resp NodeResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		assert.Contains(t, resp.Error, "denied by rule ns=3;s=Safety.*", tc.body)
+		assert.Equal(t, exitWriteRejected, exitCode(resp.Err()), tc.body)
+	}
+
+	// Other nodes get past the policy, here to the missing client
+	rec := httptest.NewRecorder()
+	handleNodeWriteRequest(rec, httptest.NewRequest("POST", "/api/nodes/write", strings.NewReader(`{"namespace": "3", "type": "s", "identifier": "Cmd.Start", "value": "true", "dataType": "bool"}`)))
+	var resp NodeResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "OPCUA client not connected", resp.Error)
+	assert.Equal(t, exitConnection, exitCode(resp.Err()))
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Write priorities. Operator and API writes default to high; bulk, scheduled
+// and ramp writes use low so they never delay critical commands
+const (
+	writePriorityHigh = "high"
+	writePriorityLow  = "low"
+)
+
+// writeQueue runs service writes one at a time, high priority first and in
+// arrival order within a priority. Tenants list and cancel only their own
+// writes, see ownedBy
+type writeQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []*writeOp
+	running *writeOp
+	nextID  int
+}
+
+type writeOp struct {
+	id        string
+	nodeID    string
+	kind      string // write, bit or point
+	priority  string
+	owner     string // identity of the tenant that queued it, "" without tenants
+	queuedAt  time.Time
+	cancelled bool
+}
+
+// WriteOpInfo is the API representation of a running or queued write
+type WriteOpInfo struct {
+	ID       string    `json:"id"`
+	NodeID   string    `json:"nodeID"`
+	Kind     string    `json:"kind"`
+	Priority string    `json:"priority"`
+	QueuedAt time.Time `json:"queuedAt"`
+	State    string    `json:"state"` // running or queued
+}
+
+// Global write queue for service mode
+var serviceWrites = newWriteQueue()
+
+func newWriteQueue() *writeQueue {
+	q := &writeQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// parseWritePriority validates a write priority, defaulting to high
+func parseWritePriority(priority string) (string, error) {
+	switch strings.ToLower(priority) {
+	case "", writePriorityHigh:
+		return writePriorityHigh, nil
+	case writePriorityLow:
+		return writePriorityLow, nil
+	}
+	return "", fmt.Errorf("invalid write priority %q, use high or low", priority)
+}
+
+// do queues a write of a tenant, by its identity, and runs fn once it is the
+// next write to execute. The write ID is passed to queued before waiting.
+// Blocks until fn has returned, or returns an error without running fn when
+// the write was cancelled while queued
+func (q *writeQueue) do(nodeID, kind, priority, owner string, queued func(id string), fn func()) error {
+	q.mu.Lock()
+	q.nextID++
+	op := &writeOp{
+		id:       fmt.Sprintf("w-%d", q.nextID),
+		nodeID:   nodeID,
+		kind:     kind,
+		priority: priority,
+		owner:    owner,
+		queuedAt: time.Now(),
+	}
+	q.pending = append(q.pending, op)
+	if queued != nil {
+		queued(op.id)
+	}
+
+	for !op.cancelled && (q.running != nil || q.next() != op) {
+		q.cond.Wait()
+	}
+	if op.cancelled {
+		q.mu.Unlock()
+		return fmt.Errorf("write %s was cancelled", op.id)
+	}
+	q.remove(op)
+	q.running = op
+	q.mu.Unlock()
+
+	defer func() {
+		q.mu.Lock()
+		q.running = nil
+		q.cond.Broadcast()
+		q.mu.Unlock()
+	}()
+	fn()
+	return nil
+}
+
+// cancel drops a queued write of a tenant. A write that is already running
+// cannot be cancelled, its values may already have reached the PLC
+func (q *writeQueue) cancel(id, tenant string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.running != nil && q.running.id == id && ownedBy(q.running.owner, tenant) {
+		return fmt.Errorf("write %s is already running", id)
+	}
+	for _, op := range q.pending {
+		if op.id == id && ownedBy(op.owner, tenant) {
+			op.cancelled = true
+			q.remove(op)
+			q.cond.Broadcast()
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown operation %s", id)
+}
+
+// next returns the pending write to run next. Callers must hold q.mu
+func (q *writeQueue) next() *writeOp {
+	for _, op := range q.pending {
+		if op.priority == writePriorityHigh {
+			return op
+		}
+	}
+	if len(q.pending) > 0 {
+		return q.pending[0]
+	}
+	return nil
+}
+
+// remove drops an op from the pending list. Callers must hold q.mu
+func (q *writeQueue) remove(op *writeOp) {
+	for i, pending := range q.pending {
+		if pending == op {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// snapshot lists the running write followed by the queued writes in
+// execution order, those of a tenant
+func (q *writeQueue) snapshot(tenant string) []WriteOpInfo {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	result := []WriteOpInfo{}
+	if q.running != nil && ownedBy(q.running.owner, tenant) {
+		result = append(result, q.running.info("running"))
+	}
+	for _, priority := range []string{writePriorityHigh, writePriorityLow} {
+		for _, op := range q.pending {
+			if op.priority == priority && ownedBy(op.owner, tenant) {
+				result = append(result, op.info("queued"))
+			}
+		}
+	}
+	return result
+}
+
+func (op *writeOp) info(state string) WriteOpInfo {
+	return WriteOpInfo{
+		ID:       op.id,
+		NodeID:   op.nodeID,
+		Kind:     op.kind,
+		Priority: op.priority,
+		QueuedAt: op.queuedAt,
+		State:    state,
+	}
+}
+
+// queuedWrite wraps a write handler so requests run through the write queue
+// The node ID and priority are peeked from the JSON body, which is then
+// restored for the handler. The write ID is returned in the X-Operation-ID header
+func queuedWrite(kind string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			handler(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			sendJSONResponse(w, NodeResponse{
+				Error: fmt.Sprintf("Failed to read request: %v", err),
+			})
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		var peek struct {
+			Namespace  string `json:"namespace"`
+			Type       string `json:"type"`
+			Identifier string `json:"identifier"`
+			Priority   string `json:"priority,omitempty"`
+			DryRun     bool   `json:"dryRun,omitempty"`
+		}
+		// Malformed bodies are reported by the handler itself
+		json.Unmarshal(body, &peek)
+
+		// Dry runs write nothing, they need not wait for other writes
+		if peek.DryRun {
+			handler(w, r)
+			return
+		}
+
+		priority, err := parseWritePriority(peek.Priority)
+		if err != nil {
+			sendJSONResponse(w, NodeResponse{
+				Error: err.Error(),
+			})
+			return
+		}
+
+		nodeID := fmt.Sprintf("ns=%s;%s=%s", peek.Namespace, peek.Type, peek.Identifier)
+		queued := func(id string) {
+			w.Header().Set(operationIDHeader, id)
+		}
+		err = serviceWrites.do(nodeID, kind, priority, tenantIdentity(r), queued, func() {
+			handler(w, r)
+		})
+		if err != nil {
+			sendJSONResponse(w, NodeResponse{
+				NodeID: nodeID,
+				Error:  err.Error(),
+			})
+		}
+	}
+}
+
+// handleWritesRequest lists the running and queued writes of the request's
+// tenant
+func handleWritesRequest(w http.ResponseWriter, r *http.Request) {
+	sendJSONResponseGeneric(w, map[string]interface{}{
+		"writes": serviceWrites.snapshot(tenantIdentity(r)),
+	})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestWriteQueuePriority tests that high priority writes overtake queued low priority writes
+func TestWriteQueuePriority(t *testing.T) {
+	q := newWriteQueue()
+	release := make(chan struct{})
+
+	var mu sync.Mutex
+	var order []string
+	record := func(name string) func() {
+		return func() {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+		}
+	}
+
+	var wg sync.WaitGroup
+	start := func(name, priority string, fn func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, q.do("ns=3;s="+name, "write", priority, "", nil, fn))
+		}()
+	}
+	waitQueued := func(n int) {
+		require.Eventually(t, func() bool { return len(q.snapshot("")) == n }, time.Second, time.Millisecond)
+	}
+
+	// A long low priority write is running, then more writes queue up behind it
+	start("ramp", writePriorityLow, func() { <-release; record("ramp")() })
+	waitQueued(1)
+	start("ramp2", writePriorityLow, record("ramp2"))
+	waitQueued(2)
+	start("stop", writePriorityHigh, record("stop"))
+	waitQueued(3)
+	start("start", writePriorityHigh, record("start"))
+	waitQueued(4)
+
+	snapshot := q.snapshot("")
+	assert.Equal(t, "running", snapshot[0].State)
+	assert.Equal(t, "ns=3;s=ramp", snapshot[0].NodeID)
+	var queued []string
+	for _, op := range snapshot[1:] {
+		assert.Equal(t, "queued", op.State)
+		queued = append(queued, op.NodeID)
+	}
+	assert.Equal(t, []string{"ns=3;s=stop", "ns=3;s=start", "ns=3;s=ramp2"}, queued)
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, []string{"ramp", "stop", "start", "ramp2"}, order)
+	assert.Empty(t, q.snapshot(""))
+}
+
+// TestWriteQueueCancel tests that queued writes can be cancelled and running
+// writes cannot, and that tenants only see and cancel their own
+func TestWriteQueueCancel(t *testing.T) {
+	q := newWriteQueue()
+	release := make(chan struct{})
+
+	running := make(chan string, 1)
+	go q.do("ns=3;s=ramp", "write", writePriorityLow, "file:globex", func(id string) { running <- id }, func() { <-release })
+	runningID := <-running
+	require.Eventually(t, func() bool { return len(q.snapshot("")) == 1 }, time.Second, time.Millisecond)
+
+	queued := make(chan string, 1)
+	result := make(chan error, 1)
+	ran := false
+	go func() {
+		result <- q.do("ns=3;s=start", "write", writePriorityHigh, "file:acme", func(id string) { queued <- id }, func() { ran = true })
+	}()
+	queuedID := <-queued
+
+	writes := q.snapshot("file:acme")
+	require.Len(t, writes, 1)
+	assert.Equal(t, queuedID, writes[0].ID)
+	assert.Len(t, q.snapshot(""), 2)
+	assert.EqualError(t, q.cancel(queuedID, "file:globex"), "unknown operation "+queuedID)
+	assert.EqualError(t, q.cancel(runningID, "file:acme"), "unknown operation "+runningID)
+
+	assert.Error(t, q.cancel(runningID, "file:globex"))
+	require.NoError(t, q.cancel(queuedID, "file:acme"))
+	assert.Error(t, <-result)
+	assert.False(t, ran)
+	assert.Error(t, q.cancel(queuedID, ""))
+
+	close(release)
+	require.Eventually(t, func() bool { return len(q.snapshot("")) == 0 }, time.Second, time.Millisecond)
+}
+
+// TestParseWritePriority tests write priority validation
+func TestParseWritePriority(t *testing.T) {
+	for input, want := range map[string]string{"": "high", "high": "high", "LOW": "low"} {
+		got, err := parseWritePriority(input)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+	_, err := parseWritePriority("urgent")
+	assert.Error(t, err)
+}